@@ -0,0 +1,1244 @@
+// FileManager exposes a repository to programs over gRPC. It mirrors the
+// HTTP API served by -action serve, with streamed uploads and downloads so
+// that large files flow with backpressure instead of being buffered.
+// Requests carry the API token of a user as "authorization: Bearer <token>"
+// metadata once server.users is configured.
+//
+// Generate the Go client and server stubs with:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	  --go-grpc_out=. --go-grpc_opt=paths=source_relative \
+//	  api/filemanager/v1/filemanager.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: api/filemanager/v1/filemanager.proto
+
+package filemanagerv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Job_State int32
+
+const (
+	Job_STATE_UNSPECIFIED Job_State = 0
+	Job_STATE_RUNNING     Job_State = 1
+	Job_STATE_SUCCEEDED   Job_State = 2
+	Job_STATE_FAILED      Job_State = 3
+	Job_STATE_CANCELLED   Job_State = 4
+	Job_STATE_QUEUED      Job_State = 5
+)
+
+// Enum value maps for Job_State.
+var (
+	Job_State_name = map[int32]string{
+		0: "STATE_UNSPECIFIED",
+		1: "STATE_RUNNING",
+		2: "STATE_SUCCEEDED",
+		3: "STATE_FAILED",
+		4: "STATE_CANCELLED",
+		5: "STATE_QUEUED",
+	}
+	Job_State_value = map[string]int32{
+		"STATE_UNSPECIFIED": 0,
+		"STATE_RUNNING":     1,
+		"STATE_SUCCEEDED":   2,
+		"STATE_FAILED":      3,
+		"STATE_CANCELLED":   4,
+		"STATE_QUEUED":      5,
+	}
+)
+
+func (x Job_State) Enum() *Job_State {
+	p := new(Job_State)
+	*p = x
+	return p
+}
+
+func (x Job_State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Job_State) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_filemanager_v1_filemanager_proto_enumTypes[0].Descriptor()
+}
+
+func (Job_State) Type() protoreflect.EnumType {
+	return &file_api_filemanager_v1_filemanager_proto_enumTypes[0]
+}
+
+func (x Job_State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Job_State.Descriptor instead.
+func (Job_State) EnumDescriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{13, 0}
+}
+
+type StoreRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Part:
+	//
+	//	*StoreRequest_Filename
+	//	*StoreRequest_Chunk
+	Part          isStoreRequest_Part `protobuf_oneof:"part"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StoreRequest) Reset() {
+	*x = StoreRequest{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StoreRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StoreRequest) ProtoMessage() {}
+
+func (x *StoreRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StoreRequest.ProtoReflect.Descriptor instead.
+func (*StoreRequest) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *StoreRequest) GetPart() isStoreRequest_Part {
+	if x != nil {
+		return x.Part
+	}
+	return nil
+}
+
+func (x *StoreRequest) GetFilename() string {
+	if x != nil {
+		if x, ok := x.Part.(*StoreRequest_Filename); ok {
+			return x.Filename
+		}
+	}
+	return ""
+}
+
+func (x *StoreRequest) GetChunk() []byte {
+	if x != nil {
+		if x, ok := x.Part.(*StoreRequest_Chunk); ok {
+			return x.Chunk
+		}
+	}
+	return nil
+}
+
+type isStoreRequest_Part interface {
+	isStoreRequest_Part()
+}
+
+type StoreRequest_Filename struct {
+	Filename string `protobuf:"bytes,1,opt,name=filename,proto3,oneof"`
+}
+
+type StoreRequest_Chunk struct {
+	Chunk []byte `protobuf:"bytes,2,opt,name=chunk,proto3,oneof"`
+}
+
+func (*StoreRequest_Filename) isStoreRequest_Part() {}
+
+func (*StoreRequest_Chunk) isStoreRequest_Part() {}
+
+type StoreResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Filename      string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Hash          string                 `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	StorageId     string                 `protobuf:"bytes,3,opt,name=storage_id,json=storageId,proto3" json:"storage_id,omitempty"`
+	Version       int32                  `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`     // 0 for a duplicate
+	Duplicate     bool                   `protobuf:"varint,5,opt,name=duplicate,proto3" json:"duplicate,omitempty"` // the content was already stored and no version was recorded
+	Bytes         int64                  `protobuf:"varint,6,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	BytesWritten  int64                  `protobuf:"varint,7,opt,name=bytes_written,json=bytesWritten,proto3" json:"bytes_written,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StoreResult) Reset() {
+	*x = StoreResult{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StoreResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StoreResult) ProtoMessage() {}
+
+func (x *StoreResult) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StoreResult.ProtoReflect.Descriptor instead.
+func (*StoreResult) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StoreResult) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *StoreResult) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+func (x *StoreResult) GetStorageId() string {
+	if x != nil {
+		return x.StorageId
+	}
+	return ""
+}
+
+func (x *StoreResult) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *StoreResult) GetDuplicate() bool {
+	if x != nil {
+		return x.Duplicate
+	}
+	return false
+}
+
+func (x *StoreResult) GetBytes() int64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+func (x *StoreResult) GetBytesWritten() int64 {
+	if x != nil {
+		return x.BytesWritten
+	}
+	return 0
+}
+
+type RetrieveRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Filename      string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Version       int32                  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"` // 0 for the latest
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RetrieveRequest) Reset() {
+	*x = RetrieveRequest{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RetrieveRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RetrieveRequest) ProtoMessage() {}
+
+func (x *RetrieveRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RetrieveRequest.ProtoReflect.Descriptor instead.
+func (*RetrieveRequest) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RetrieveRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *RetrieveRequest) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+type RetrieveResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Part:
+	//
+	//	*RetrieveResponse_Version
+	//	*RetrieveResponse_Chunk
+	Part          isRetrieveResponse_Part `protobuf_oneof:"part"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RetrieveResponse) Reset() {
+	*x = RetrieveResponse{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RetrieveResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RetrieveResponse) ProtoMessage() {}
+
+func (x *RetrieveResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RetrieveResponse.ProtoReflect.Descriptor instead.
+func (*RetrieveResponse) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *RetrieveResponse) GetPart() isRetrieveResponse_Part {
+	if x != nil {
+		return x.Part
+	}
+	return nil
+}
+
+func (x *RetrieveResponse) GetVersion() *Version {
+	if x != nil {
+		if x, ok := x.Part.(*RetrieveResponse_Version); ok {
+			return x.Version
+		}
+	}
+	return nil
+}
+
+func (x *RetrieveResponse) GetChunk() []byte {
+	if x != nil {
+		if x, ok := x.Part.(*RetrieveResponse_Chunk); ok {
+			return x.Chunk
+		}
+	}
+	return nil
+}
+
+type isRetrieveResponse_Part interface {
+	isRetrieveResponse_Part()
+}
+
+type RetrieveResponse_Version struct {
+	Version *Version `protobuf:"bytes,1,opt,name=version,proto3,oneof"`
+}
+
+type RetrieveResponse_Chunk struct {
+	Chunk []byte `protobuf:"bytes,2,opt,name=chunk,proto3,oneof"`
+}
+
+func (*RetrieveResponse_Version) isRetrieveResponse_Part() {}
+
+func (*RetrieveResponse_Chunk) isRetrieveResponse_Part() {}
+
+type Version struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Filename      string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Version       int32                  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	Hash          string                 `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
+	Path          string                 `protobuf:"bytes,4,opt,name=path,proto3" json:"path,omitempty"` // where the content was stored from
+	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Bytes         int64                  `protobuf:"varint,6,opt,name=bytes,proto3" json:"bytes,omitempty"` // size of the content, sent by Retrieve only
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Version) Reset() {
+	*x = Version{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Version) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Version) ProtoMessage() {}
+
+func (x *Version) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Version.ProtoReflect.Descriptor instead.
+func (*Version) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Version) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *Version) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Version) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+func (x *Version) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *Version) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Version) GetBytes() int64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+type ListFilesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListFilesRequest) Reset() {
+	*x = ListFilesRequest{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListFilesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListFilesRequest) ProtoMessage() {}
+
+func (x *ListFilesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListFilesRequest.ProtoReflect.Descriptor instead.
+func (*ListFilesRequest) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{5}
+}
+
+type ListFilesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         []*Version             `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListFilesResponse) Reset() {
+	*x = ListFilesResponse{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListFilesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListFilesResponse) ProtoMessage() {}
+
+func (x *ListFilesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListFilesResponse.ProtoReflect.Descriptor instead.
+func (*ListFilesResponse) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ListFilesResponse) GetFiles() []*Version {
+	if x != nil {
+		return x.Files
+	}
+	return nil
+}
+
+type ListVersionsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Filename      string                 `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListVersionsRequest) Reset() {
+	*x = ListVersionsRequest{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListVersionsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListVersionsRequest) ProtoMessage() {}
+
+func (x *ListVersionsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListVersionsRequest.ProtoReflect.Descriptor instead.
+func (*ListVersionsRequest) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListVersionsRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+type ListVersionsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Versions      []*Version             `protobuf:"bytes,1,rep,name=versions,proto3" json:"versions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListVersionsResponse) Reset() {
+	*x = ListVersionsResponse{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListVersionsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListVersionsResponse) ProtoMessage() {}
+
+func (x *ListVersionsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListVersionsResponse.ProtoReflect.Descriptor instead.
+func (*ListVersionsResponse) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ListVersionsResponse) GetVersions() []*Version {
+	if x != nil {
+		return x.Versions
+	}
+	return nil
+}
+
+type StartJobRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Job:
+	//
+	//	*StartJobRequest_Deduplicate
+	//	*StartJobRequest_Backup
+	Job           isStartJobRequest_Job `protobuf_oneof:"job"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StartJobRequest) Reset() {
+	*x = StartJobRequest{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StartJobRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StartJobRequest) ProtoMessage() {}
+
+func (x *StartJobRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StartJobRequest.ProtoReflect.Descriptor instead.
+func (*StartJobRequest) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *StartJobRequest) GetJob() isStartJobRequest_Job {
+	if x != nil {
+		return x.Job
+	}
+	return nil
+}
+
+func (x *StartJobRequest) GetDeduplicate() *DeduplicateJob {
+	if x != nil {
+		if x, ok := x.Job.(*StartJobRequest_Deduplicate); ok {
+			return x.Deduplicate
+		}
+	}
+	return nil
+}
+
+func (x *StartJobRequest) GetBackup() *BackupJob {
+	if x != nil {
+		if x, ok := x.Job.(*StartJobRequest_Backup); ok {
+			return x.Backup
+		}
+	}
+	return nil
+}
+
+type isStartJobRequest_Job interface {
+	isStartJobRequest_Job()
+}
+
+type StartJobRequest_Deduplicate struct {
+	Deduplicate *DeduplicateJob `protobuf:"bytes,1,opt,name=deduplicate,proto3,oneof"`
+}
+
+type StartJobRequest_Backup struct {
+	Backup *BackupJob `protobuf:"bytes,2,opt,name=backup,proto3,oneof"`
+}
+
+func (*StartJobRequest_Deduplicate) isStartJobRequest_Job() {}
+
+func (*StartJobRequest_Backup) isStartJobRequest_Job() {}
+
+type DeduplicateJob struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Directory     string                 `protobuf:"bytes,1,opt,name=directory,proto3" json:"directory,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeduplicateJob) Reset() {
+	*x = DeduplicateJob{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeduplicateJob) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeduplicateJob) ProtoMessage() {}
+
+func (x *DeduplicateJob) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeduplicateJob.ProtoReflect.Descriptor instead.
+func (*DeduplicateJob) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *DeduplicateJob) GetDirectory() string {
+	if x != nil {
+		return x.Directory
+	}
+	return ""
+}
+
+type BackupJob struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Directory     string                 `protobuf:"bytes,1,opt,name=directory,proto3" json:"directory,omitempty"`
+	Output        string                 `protobuf:"bytes,2,opt,name=output,proto3" json:"output,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BackupJob) Reset() {
+	*x = BackupJob{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BackupJob) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BackupJob) ProtoMessage() {}
+
+func (x *BackupJob) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BackupJob.ProtoReflect.Descriptor instead.
+func (*BackupJob) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *BackupJob) GetDirectory() string {
+	if x != nil {
+		return x.Directory
+	}
+	return ""
+}
+
+func (x *BackupJob) GetOutput() string {
+	if x != nil {
+		return x.Output
+	}
+	return ""
+}
+
+type GetJobRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetJobRequest) Reset() {
+	*x = GetJobRequest{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetJobRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetJobRequest) ProtoMessage() {}
+
+func (x *GetJobRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetJobRequest.ProtoReflect.Descriptor instead.
+func (*GetJobRequest) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *GetJobRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type Job struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Kind          string                 `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"` // deduplicate or backup
+	State         Job_State              `protobuf:"varint,3,opt,name=state,proto3,enum=filemanager.v1.Job_State" json:"state,omitempty"`
+	Started       *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=started,proto3" json:"started,omitempty"`
+	Finished      *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=finished,proto3" json:"finished,omitempty"`
+	Error         string                 `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Job) Reset() {
+	*x = Job{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Job) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Job) ProtoMessage() {}
+
+func (x *Job) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Job.ProtoReflect.Descriptor instead.
+func (*Job) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *Job) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Job) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *Job) GetState() Job_State {
+	if x != nil {
+		return x.State
+	}
+	return Job_STATE_UNSPECIFIED
+}
+
+func (x *Job) GetStarted() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Started
+	}
+	return nil
+}
+
+func (x *Job) GetFinished() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Finished
+	}
+	return nil
+}
+
+func (x *Job) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type Progress struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Type          string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"` // file_stored, duplicate_found, backup_progress, error or finished
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	StorageId     string                 `protobuf:"bytes,3,opt,name=storage_id,json=storageId,proto3" json:"storage_id,omitempty"`
+	Original      string                 `protobuf:"bytes,4,opt,name=original,proto3" json:"original,omitempty"`
+	Files         int32                  `protobuf:"varint,5,opt,name=files,proto3" json:"files,omitempty"`
+	Bytes         int64                  `protobuf:"varint,6,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	Error         string                 `protobuf:"bytes,7,opt,name=error,proto3" json:"error,omitempty"`
+	State         Job_State              `protobuf:"varint,8,opt,name=state,proto3,enum=filemanager.v1.Job_State" json:"state,omitempty"` // of a finished job
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Progress) Reset() {
+	*x = Progress{}
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Progress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Progress) ProtoMessage() {}
+
+func (x *Progress) ProtoReflect() protoreflect.Message {
+	mi := &file_api_filemanager_v1_filemanager_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Progress.ProtoReflect.Descriptor instead.
+func (*Progress) Descriptor() ([]byte, []int) {
+	return file_api_filemanager_v1_filemanager_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *Progress) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Progress) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Progress) GetStorageId() string {
+	if x != nil {
+		return x.StorageId
+	}
+	return ""
+}
+
+func (x *Progress) GetOriginal() string {
+	if x != nil {
+		return x.Original
+	}
+	return ""
+}
+
+func (x *Progress) GetFiles() int32 {
+	if x != nil {
+		return x.Files
+	}
+	return 0
+}
+
+func (x *Progress) GetBytes() int64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+func (x *Progress) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Progress) GetState() Job_State {
+	if x != nil {
+		return x.State
+	}
+	return Job_STATE_UNSPECIFIED
+}
+
+var File_api_filemanager_v1_filemanager_proto protoreflect.FileDescriptor
+
+const file_api_filemanager_v1_filemanager_proto_rawDesc = "" +
+	"\n" +
+	"$api/filemanager/v1/filemanager.proto\x12\x0efilemanager.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"L\n" +
+	"\fStoreRequest\x12\x1c\n" +
+	"\bfilename\x18\x01 \x01(\tH\x00R\bfilename\x12\x16\n" +
+	"\x05chunk\x18\x02 \x01(\fH\x00R\x05chunkB\x06\n" +
+	"\x04part\"\xcf\x01\n" +
+	"\vStoreResult\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x12\n" +
+	"\x04hash\x18\x02 \x01(\tR\x04hash\x12\x1d\n" +
+	"\n" +
+	"storage_id\x18\x03 \x01(\tR\tstorageId\x12\x18\n" +
+	"\aversion\x18\x04 \x01(\x05R\aversion\x12\x1c\n" +
+	"\tduplicate\x18\x05 \x01(\bR\tduplicate\x12\x14\n" +
+	"\x05bytes\x18\x06 \x01(\x03R\x05bytes\x12#\n" +
+	"\rbytes_written\x18\a \x01(\x03R\fbytesWritten\"G\n" +
+	"\x0fRetrieveRequest\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\x05R\aversion\"g\n" +
+	"\x10RetrieveResponse\x123\n" +
+	"\aversion\x18\x01 \x01(\v2\x17.filemanager.v1.VersionH\x00R\aversion\x12\x16\n" +
+	"\x05chunk\x18\x02 \x01(\fH\x00R\x05chunkB\x06\n" +
+	"\x04part\"\xb7\x01\n" +
+	"\aVersion\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\x05R\aversion\x12\x12\n" +
+	"\x04hash\x18\x03 \x01(\tR\x04hash\x12\x12\n" +
+	"\x04path\x18\x04 \x01(\tR\x04path\x128\n" +
+	"\ttimestamp\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12\x14\n" +
+	"\x05bytes\x18\x06 \x01(\x03R\x05bytes\"\x12\n" +
+	"\x10ListFilesRequest\"B\n" +
+	"\x11ListFilesResponse\x12-\n" +
+	"\x05files\x18\x01 \x03(\v2\x17.filemanager.v1.VersionR\x05files\"1\n" +
+	"\x13ListVersionsRequest\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\"K\n" +
+	"\x14ListVersionsResponse\x123\n" +
+	"\bversions\x18\x01 \x03(\v2\x17.filemanager.v1.VersionR\bversions\"\x91\x01\n" +
+	"\x0fStartJobRequest\x12B\n" +
+	"\vdeduplicate\x18\x01 \x01(\v2\x1e.filemanager.v1.DeduplicateJobH\x00R\vdeduplicate\x123\n" +
+	"\x06backup\x18\x02 \x01(\v2\x19.filemanager.v1.BackupJobH\x00R\x06backupB\x05\n" +
+	"\x03job\".\n" +
+	"\x0eDeduplicateJob\x12\x1c\n" +
+	"\tdirectory\x18\x01 \x01(\tR\tdirectory\"A\n" +
+	"\tBackupJob\x12\x1c\n" +
+	"\tdirectory\x18\x01 \x01(\tR\tdirectory\x12\x16\n" +
+	"\x06output\x18\x02 \x01(\tR\x06output\"\x1f\n" +
+	"\rGetJobRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\xdf\x02\n" +
+	"\x03Job\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04kind\x18\x02 \x01(\tR\x04kind\x12/\n" +
+	"\x05state\x18\x03 \x01(\x0e2\x19.filemanager.v1.Job.StateR\x05state\x124\n" +
+	"\astarted\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\astarted\x126\n" +
+	"\bfinished\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\bfinished\x12\x14\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\"\x7f\n" +
+	"\x05State\x12\x15\n" +
+	"\x11STATE_UNSPECIFIED\x10\x00\x12\x11\n" +
+	"\rSTATE_RUNNING\x10\x01\x12\x13\n" +
+	"\x0fSTATE_SUCCEEDED\x10\x02\x12\x10\n" +
+	"\fSTATE_FAILED\x10\x03\x12\x13\n" +
+	"\x0fSTATE_CANCELLED\x10\x04\x12\x10\n" +
+	"\fSTATE_QUEUED\x10\x05\"\xe0\x01\n" +
+	"\bProgress\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x1d\n" +
+	"\n" +
+	"storage_id\x18\x03 \x01(\tR\tstorageId\x12\x1a\n" +
+	"\boriginal\x18\x04 \x01(\tR\boriginal\x12\x14\n" +
+	"\x05files\x18\x05 \x01(\x05R\x05files\x12\x14\n" +
+	"\x05bytes\x18\x06 \x01(\x03R\x05bytes\x12\x14\n" +
+	"\x05error\x18\a \x01(\tR\x05error\x12/\n" +
+	"\x05state\x18\b \x01(\x0e2\x19.filemanager.v1.Job.StateR\x05state2\x98\x04\n" +
+	"\vFileManager\x12D\n" +
+	"\x05Store\x12\x1c.filemanager.v1.StoreRequest\x1a\x1b.filemanager.v1.StoreResult(\x01\x12O\n" +
+	"\bRetrieve\x12\x1f.filemanager.v1.RetrieveRequest\x1a .filemanager.v1.RetrieveResponse0\x01\x12P\n" +
+	"\tListFiles\x12 .filemanager.v1.ListFilesRequest\x1a!.filemanager.v1.ListFilesResponse\x12Y\n" +
+	"\fListVersions\x12#.filemanager.v1.ListVersionsRequest\x1a$.filemanager.v1.ListVersionsResponse\x12@\n" +
+	"\bStartJob\x12\x1f.filemanager.v1.StartJobRequest\x1a\x13.filemanager.v1.Job\x12<\n" +
+	"\x06GetJob\x12\x1d.filemanager.v1.GetJobRequest\x1a\x13.filemanager.v1.Job\x12E\n" +
+	"\bWatchJob\x12\x1d.filemanager.v1.GetJobRequest\x1a\x18.filemanager.v1.Progress0\x01BKZIgithub.com/Lenstack/file_manager_version/api/filemanager/v1;filemanagerv1b\x06proto3"
+
+var (
+	file_api_filemanager_v1_filemanager_proto_rawDescOnce sync.Once
+	file_api_filemanager_v1_filemanager_proto_rawDescData []byte
+)
+
+func file_api_filemanager_v1_filemanager_proto_rawDescGZIP() []byte {
+	file_api_filemanager_v1_filemanager_proto_rawDescOnce.Do(func() {
+		file_api_filemanager_v1_filemanager_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_filemanager_v1_filemanager_proto_rawDesc), len(file_api_filemanager_v1_filemanager_proto_rawDesc)))
+	})
+	return file_api_filemanager_v1_filemanager_proto_rawDescData
+}
+
+var file_api_filemanager_v1_filemanager_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_api_filemanager_v1_filemanager_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
+var file_api_filemanager_v1_filemanager_proto_goTypes = []any{
+	(Job_State)(0),                // 0: filemanager.v1.Job.State
+	(*StoreRequest)(nil),          // 1: filemanager.v1.StoreRequest
+	(*StoreResult)(nil),           // 2: filemanager.v1.StoreResult
+	(*RetrieveRequest)(nil),       // 3: filemanager.v1.RetrieveRequest
+	(*RetrieveResponse)(nil),      // 4: filemanager.v1.RetrieveResponse
+	(*Version)(nil),               // 5: filemanager.v1.Version
+	(*ListFilesRequest)(nil),      // 6: filemanager.v1.ListFilesRequest
+	(*ListFilesResponse)(nil),     // 7: filemanager.v1.ListFilesResponse
+	(*ListVersionsRequest)(nil),   // 8: filemanager.v1.ListVersionsRequest
+	(*ListVersionsResponse)(nil),  // 9: filemanager.v1.ListVersionsResponse
+	(*StartJobRequest)(nil),       // 10: filemanager.v1.StartJobRequest
+	(*DeduplicateJob)(nil),        // 11: filemanager.v1.DeduplicateJob
+	(*BackupJob)(nil),             // 12: filemanager.v1.BackupJob
+	(*GetJobRequest)(nil),         // 13: filemanager.v1.GetJobRequest
+	(*Job)(nil),                   // 14: filemanager.v1.Job
+	(*Progress)(nil),              // 15: filemanager.v1.Progress
+	(*timestamppb.Timestamp)(nil), // 16: google.protobuf.Timestamp
+}
+var file_api_filemanager_v1_filemanager_proto_depIdxs = []int32{
+	5,  // 0: filemanager.v1.RetrieveResponse.version:type_name -> filemanager.v1.Version
+	16, // 1: filemanager.v1.Version.timestamp:type_name -> google.protobuf.Timestamp
+	5,  // 2: filemanager.v1.ListFilesResponse.files:type_name -> filemanager.v1.Version
+	5,  // 3: filemanager.v1.ListVersionsResponse.versions:type_name -> filemanager.v1.Version
+	11, // 4: filemanager.v1.StartJobRequest.deduplicate:type_name -> filemanager.v1.DeduplicateJob
+	12, // 5: filemanager.v1.StartJobRequest.backup:type_name -> filemanager.v1.BackupJob
+	0,  // 6: filemanager.v1.Job.state:type_name -> filemanager.v1.Job.State
+	16, // 7: filemanager.v1.Job.started:type_name -> google.protobuf.Timestamp
+	16, // 8: filemanager.v1.Job.finished:type_name -> google.protobuf.Timestamp
+	0,  // 9: filemanager.v1.Progress.state:type_name -> filemanager.v1.Job.State
+	1,  // 10: filemanager.v1.FileManager.Store:input_type -> filemanager.v1.StoreRequest
+	3,  // 11: filemanager.v1.FileManager.Retrieve:input_type -> filemanager.v1.RetrieveRequest
+	6,  // 12: filemanager.v1.FileManager.ListFiles:input_type -> filemanager.v1.ListFilesRequest
+	8,  // 13: filemanager.v1.FileManager.ListVersions:input_type -> filemanager.v1.ListVersionsRequest
+	10, // 14: filemanager.v1.FileManager.StartJob:input_type -> filemanager.v1.StartJobRequest
+	13, // 15: filemanager.v1.FileManager.GetJob:input_type -> filemanager.v1.GetJobRequest
+	13, // 16: filemanager.v1.FileManager.WatchJob:input_type -> filemanager.v1.GetJobRequest
+	2,  // 17: filemanager.v1.FileManager.Store:output_type -> filemanager.v1.StoreResult
+	4,  // 18: filemanager.v1.FileManager.Retrieve:output_type -> filemanager.v1.RetrieveResponse
+	7,  // 19: filemanager.v1.FileManager.ListFiles:output_type -> filemanager.v1.ListFilesResponse
+	9,  // 20: filemanager.v1.FileManager.ListVersions:output_type -> filemanager.v1.ListVersionsResponse
+	14, // 21: filemanager.v1.FileManager.StartJob:output_type -> filemanager.v1.Job
+	14, // 22: filemanager.v1.FileManager.GetJob:output_type -> filemanager.v1.Job
+	15, // 23: filemanager.v1.FileManager.WatchJob:output_type -> filemanager.v1.Progress
+	17, // [17:24] is the sub-list for method output_type
+	10, // [10:17] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_api_filemanager_v1_filemanager_proto_init() }
+func file_api_filemanager_v1_filemanager_proto_init() {
+	if File_api_filemanager_v1_filemanager_proto != nil {
+		return
+	}
+	file_api_filemanager_v1_filemanager_proto_msgTypes[0].OneofWrappers = []any{
+		(*StoreRequest_Filename)(nil),
+		(*StoreRequest_Chunk)(nil),
+	}
+	file_api_filemanager_v1_filemanager_proto_msgTypes[3].OneofWrappers = []any{
+		(*RetrieveResponse_Version)(nil),
+		(*RetrieveResponse_Chunk)(nil),
+	}
+	file_api_filemanager_v1_filemanager_proto_msgTypes[9].OneofWrappers = []any{
+		(*StartJobRequest_Deduplicate)(nil),
+		(*StartJobRequest_Backup)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_filemanager_v1_filemanager_proto_rawDesc), len(file_api_filemanager_v1_filemanager_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   15,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_api_filemanager_v1_filemanager_proto_goTypes,
+		DependencyIndexes: file_api_filemanager_v1_filemanager_proto_depIdxs,
+		EnumInfos:         file_api_filemanager_v1_filemanager_proto_enumTypes,
+		MessageInfos:      file_api_filemanager_v1_filemanager_proto_msgTypes,
+	}.Build()
+	File_api_filemanager_v1_filemanager_proto = out.File
+	file_api_filemanager_v1_filemanager_proto_goTypes = nil
+	file_api_filemanager_v1_filemanager_proto_depIdxs = nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Return a context cancelled when the process receives SIGINT or SIGTERM,
+// with a cause wrapping db.ErrAborted, and the function that stops
+// listening for them. The running operation then removes its temporary
+// files and partial output. A second signal exits at once, leaving what
+// it has not removed yet to -action fsck -adopt remove, and the lock to
+// be broken as stale.
+func abortOnSignal(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			cancel(fmt.Errorf("%w by %s", db.ErrAborted, sig))
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			log.Print("Aborted again, exiting without cleaning up")
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(context.Canceled)
+	}
+}
+
+// Return err marked as aborted when ctx was cancelled by a signal, so that
+// it is recorded with that outcome
+func abortError(ctx context.Context, err error) error {
+	cause := context.Cause(ctx)
+	if errors.Is(err, context.Canceled) && errors.Is(cause, db.ErrAborted) && !errors.Is(err, db.ErrAborted) {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+	return err
+}
+
+// Remove an output file left incomplete by a failed or aborted action
+func removePartial(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Failed to remove partial output %s: %v\n", path, err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"strings"
+	"time"
+)
+
+// Print actions as a table, oldest first
+func printActions(actions []db.LoggedAction) {
+	fmt.Printf("%-19s  %-16s  %-7s  %12s  %9s  %-12s  %-10s  %-8s  %s\n",
+		"TIME", "ACTION", "OUTCOME", "BYTES", "DURATION", "HOST", "USER", "VERSION", "FILE")
+	for i := len(actions) - 1; i >= 0; i-- {
+		a := actions[i]
+		name := a.Filename
+		if a.Error != "" {
+			name += " (" + strings.ReplaceAll(a.Error, "\n", " ") + ")"
+		}
+		fmt.Printf("%-19s  %-16s  %-7s  %12d  %9s  %-12s  %-10s  %-8s  %s\n",
+			a.Timestamp.Local().Format(time.DateTime), a.ActionType, a.Outcome, a.Bytes,
+			(time.Duration(a.DurationMs) * time.Millisecond).String(), a.Hostname, a.Principal, a.Version, name)
+	}
+}
+
+// Print file versions as a table
+func printVersions(versions []db.Version) {
+	fmt.Printf("%-19s  %-7s  %-8s  %-28s  %s\n", "TIME", "VERSION", "KIND", "MIME", "FILE")
+	for _, v := range versions {
+		fmt.Printf("%-19s  %-7d  %-8s  %-28s  %s\n",
+			v.Timestamp.Local().Format(time.DateTime), v.Version, v.Kind, v.MimeType, v.Filename)
+	}
+}
+
+// Print search results as a table
+func printSearch(results []db.SearchResult) {
+	fmt.Printf("%-19s  %-7s  %-8s  %-32s  %s\n", "TIME", "VERSION", "KIND", "FILE", "METADATA")
+	for _, r := range results {
+		fmt.Printf("%-19s  %-7d  %-8s  %-32s  %s\n",
+			r.Timestamp.Local().Format(time.DateTime), r.Version.Version, r.Kind, r.Filename, r.Metadata)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+)
+
+// Run an alias subcommand: "set ALIAS FILE", "remove ALIAS" or "list".
+// Retrieve, cat, open, history and meta accept an alias wherever they take
+// a file name, and it follows the file when fsck or a plan renames it.
+func runAlias(ctx context.Context, metadata *db.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: -action alias set ALIAS FILE | remove ALIAS | list")
+	}
+	switch command := args[0]; command {
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: -action alias set ALIAS FILE")
+		}
+		alias := fsutil.NormalizeName(args[1])
+		filename, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(args[2]))
+		if err != nil {
+			return err
+		}
+		if err := db.SetAlias(ctx, metadata, alias, filename); err != nil {
+			return err
+		}
+		fmt.Printf("%s now stands for %s\n", alias, filename)
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: -action alias remove ALIAS")
+		}
+		if err := db.RemoveAlias(ctx, metadata, fsutil.NormalizeName(args[1])); err != nil {
+			return err
+		}
+		fmt.Printf("Removed alias %s\n", args[1])
+	case "list":
+		aliases, err := db.ListAliases(ctx, metadata)
+		if err != nil {
+			return err
+		}
+		for _, a := range aliases {
+			fmt.Printf("%s -> %s\n", a.Name, a.Filename)
+		}
+	default:
+		return fmt.Errorf("unknown alias command %q (use set, remove, list)", command)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/bench"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"os"
+	"text/tabwriter"
+)
+
+// Run the benchmark suite in a temporary directory and print its results.
+// They are saved to output when set, and compared with the baseline saved
+// at input, failing when one fell more than tolerance below it.
+func runBench(ctx context.Context, input, output, hashName string, scale, tolerance float64, workers int, opts fsutil.Options) error {
+	if scale <= 0 {
+		return fmt.Errorf("-scale must be positive")
+	}
+	if tolerance < 0 || tolerance >= 1 {
+		return fmt.Errorf("-tolerance must be at least 0 and below 1")
+	}
+	algorithm := hash.Default()
+	if hashName != "" {
+		var err error
+		if algorithm, err = hash.Lookup(hashName); err != nil {
+			return err
+		}
+	}
+	var baseline []bench.Result
+	if input != "" {
+		var err error
+		if baseline, err = bench.Load(input); err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "fm-bench-*")
+	if err != nil {
+		return fmt.Errorf("failed to create benchmark directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// Per-file events would drown the results and slow the operations down
+	opts.Observer = nil
+	fmt.Printf("Benchmarking in %s with %s and %d workers\n", dir, algorithm.Name, workers)
+	results, err := bench.Run(ctx, dir, bench.Trees(scale), bench.Config{Algorithm: algorithm, Workers: workers, Options: opts})
+	if printErr := printBench(results); printErr != nil && err == nil {
+		err = printErr
+	}
+	if err != nil {
+		return fmt.Errorf("benchmark failed: %w", err)
+	}
+
+	if output != "" {
+		if err := bench.Save(output, results); err != nil {
+			return err
+		}
+		fmt.Printf("Saved results to %s\n", output)
+	}
+	if baseline == nil {
+		return nil
+	}
+	regressions := bench.Compare(baseline, results, tolerance)
+	for _, r := range regressions {
+		fmt.Printf("Regression: %s at %s, %.0f%% below %s\n", r.Key, formatRate(r.Current), 100*r.Slowdown(), formatRate(r.Baseline))
+	}
+	if len(regressions) > 0 {
+		return fmt.Errorf("%d measurements regressed by more than %.0f%% against %s", len(regressions), 100*tolerance, input)
+	}
+	fmt.Printf("No regressions against %s\n", input)
+	return nil
+}
+
+// Print benchmark results as a table
+func printBench(results []bench.Result) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "TREE\tOPERATION\tFILES\tBYTES\tDURATION\tTHROUGHPUT"); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", r.Tree, r.Operation, r.Files, r.Bytes, r.Duration.Round(1e6), formatRate(r.Throughput())); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// Format a rate in bytes per second
+func formatRate(bytesPerSec float64) string {
+	return fmt.Sprintf("%.1f MiB/s", bytesPerSec/(1<<20))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/graph"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"strconv"
+)
+
+// Run a branch subcommand: "list FILE", "create FILE NAME [VERSION]",
+// "compare FILE NAME", "merge FILE NAME" or "delete FILE NAME". Versions
+// are stored on a branch with -action store -branch NAME, and read from it
+// with -branch on retrieve, cat and open.
+func runBranch(ctx context.Context, metadata *db.DB, args []string) error {
+	usage := fmt.Errorf("usage: -action branch list FILE | create FILE NAME [VERSION] | compare FILE NAME | merge FILE NAME | delete FILE NAME")
+	if len(args) < 2 {
+		return usage
+	}
+	command := args[0]
+	filename, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(args[1]))
+	if err != nil {
+		return err
+	}
+	if command == "list" {
+		branches, err := db.ListBranches(ctx, metadata, filename)
+		if err != nil {
+			return err
+		}
+		for _, b := range branches {
+			tip, err := db.GetBranchVersion(ctx, metadata, filename, b.Name, 0)
+			if err != nil {
+				return err
+			}
+			line := fmt.Sprintf("%s  from version %d, latest version %d", b.Name, b.Base, tip.Version)
+			if b.Merged > 0 {
+				line += fmt.Sprintf(", merged as version %d", b.Merged)
+			}
+			fmt.Println(line)
+		}
+		return nil
+	}
+	if len(args) < 3 {
+		return usage
+	}
+	name := args[2]
+	switch command {
+	case "create":
+		base := 0
+		if len(args) > 3 {
+			if base, err = strconv.Atoi(args[3]); err != nil || base < 1 {
+				return fmt.Errorf("invalid version %q", args[3])
+			}
+		}
+		b, err := db.CreateBranch(ctx, metadata, filename, name, base)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created branch %s of %s from version %d\n", b.Name, filename, b.Base)
+	case "compare":
+		return compareBranch(ctx, metadata, filename, name)
+	case "merge":
+		v, err := db.MergeBranch(ctx, metadata, filename, name)
+		if err != nil {
+			return err
+		}
+		if err := db.LogAction(ctx, metadata, "branch_merge", v.Filename, store.StorageID(v)); err != nil {
+			return err
+		}
+		fmt.Printf("Merged branch %s of %s as version %d\n", name, filename, v.Version)
+	case "delete":
+		if err := db.DeleteBranch(ctx, metadata, filename, name); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted branch %s of %s; its versions stay retrievable by number\n", name, filename)
+	default:
+		return fmt.Errorf("unknown branch command %q (use list, create, compare, merge, delete)", command)
+	}
+	return nil
+}
+
+// Print how a branch and the mainline went apart since the branch was
+// forked
+func compareBranch(ctx context.Context, metadata *db.DB, filename, name string) error {
+	b, err := db.GetBranch(ctx, metadata, filename, name)
+	if err != nil {
+		return err
+	}
+	versions, err := db.ListVersions(ctx, metadata, filename)
+	if err != nil {
+		return err
+	}
+	var onBranch, onMainline []db.Version
+	for _, v := range versions {
+		switch {
+		case v.Version <= b.Base:
+		case v.Branch == name:
+			onBranch = append(onBranch, v)
+		case v.Branch == "":
+			onMainline = append(onMainline, v)
+		}
+	}
+	tip, err := db.GetBranchVersion(ctx, metadata, filename, name, 0)
+	if err != nil {
+		return err
+	}
+	latest, err := db.GetVersion(ctx, metadata, filename, 0)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Branch %s of %s forked from version %d\n", name, filename, b.Base)
+	fmt.Printf("%d versions on the branch since, latest %d (%s)\n", len(onBranch), tip.Version, graph.ShortHash(tip.Hash))
+	fmt.Printf("%d versions on the mainline since, latest %d (%s)\n", len(onMainline), latest.Version, graph.ShortHash(latest.Hash))
+	switch {
+	case tip.Hash == latest.Hash:
+		fmt.Println("The branch and the mainline have the same content")
+	case len(onMainline) == 0:
+		fmt.Println("Only the branch changed; merging it makes its content the latest version")
+	case len(onBranch) == 0:
+		fmt.Println("Only the mainline changed")
+	default:
+		fmt.Println("Both changed; merging the branch replaces the mainline changes in the latest version")
+	}
+	return nil
+}
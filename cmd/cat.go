@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/client"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Return the version references of -action cat: -input, if set, and
+// the arguments following the flags
+func catRefs(input string) ([]string, error) {
+	refs, err := commandArgs()
+	if err != nil {
+		return nil, err
+	}
+	if input != "" {
+		refs = append([]string{input}, refs...)
+	}
+	if len(refs) == 0 {
+		return nil, errors.New("please name the versions to print, e.g. -action cat notes.txt@3")
+	}
+	return refs, nil
+}
+
+// Split a version reference such as notes.txt@3 into the file name and
+// the version, which is n when the reference names none
+func splitVersionRef(ref string, n int) (string, int) {
+	i := strings.LastIndex(ref, "@")
+	if i <= 0 {
+		return ref, n
+	}
+	version, err := strconv.Atoi(ref[i+1:])
+	if err != nil || version < 1 {
+		return ref, n
+	}
+	return ref[:i], version
+}
+
+// Resolve a reference to a stored version: a file name or alias,
+// optionally followed by @ and a version number, looked up on branch, or
+// the hash of the content or a prefix of at least 8 digits of it
+func resolveVersion(ctx context.Context, metadata *db.DB, ref, branch string, n int) (db.Version, error) {
+	name, n := splitVersionRef(ref, n)
+	filename, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(name))
+	if err != nil {
+		return db.Version{}, err
+	}
+	v, err := db.GetBranchVersion(ctx, metadata, filename, branch, n)
+	if errors.Is(err, db.ErrNoVersion) && n == 0 && hashPrefix(name) {
+		return db.GetVersionByHash(ctx, metadata, name)
+	}
+	return v, err
+}
+
+// Report whether s can be a prefix of a content hash
+func hashPrefix(s string) bool {
+	if len(s) < 8 {
+		return false
+	}
+	for _, c := range strings.ToLower(s) {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Write the content of the referenced versions to w one after another,
+// streaming them from storage. Each is verified as it ends, so a damaged
+// blob fails only once its content has been written.
+func catVersions(ctx context.Context, blobs *store.Store, metadata *db.DB, refs []string, branch string, n int, w io.Writer) error {
+	for _, ref := range refs {
+		v, err := resolveVersion(ctx, metadata, ref, branch, n)
+		if err != nil {
+			return err
+		}
+		r, err := blobs.OpenBlob(ctx, store.StorageID(v))
+		if err != nil {
+			return fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err)
+		}
+		_, err = fsutil.Copy(ctx, w, r)
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s version %d: %w", v.Filename, v.Version, err)
+		}
+	}
+	return nil
+}
+
+// Write the content of the referenced versions on a server to w
+func catRemote(ctx context.Context, c *client.Client, refs []string, n int, w io.Writer) error {
+	for _, ref := range refs {
+		name, n := splitVersionRef(ref, n)
+		r, version, err := c.Open(ctx, name, n)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", ref, err)
+		}
+		_, err = fsutil.Copy(ctx, w, r)
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s version %d: %w", name, version, err)
+		}
+	}
+	return nil
+}
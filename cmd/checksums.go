@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"os"
+	"path/filepath"
+)
+
+// checksumsUsage describes the checksums subcommands
+const checksumsUsage = "usage: -action checksums export [DIRECTORY | ARCHIVE] | verify FILE"
+
+// Report whether a checksums subcommand works on the repository, which is
+// an export without a directory or archive
+func checksumsOfRepository(args []string) bool {
+	return len(args) == 1 && args[0] == "export"
+}
+
+// Run a checksums subcommand outside the repository: "export TARGET"
+// writes the digests of the files of a directory or of the entries of a
+// backup archive, and "verify FILE" checks the files a checksum file lists
+// against them, resolving relative names from base. The algorithm is
+// hashName, SHA-256 by default, or guessed from the digests to verify.
+func runChecksums(ctx context.Context, args []string, base, output, hashName string, opts fsutil.Options) error {
+	if len(args) != 2 {
+		return errors.New(checksumsUsage)
+	}
+	switch args[0] {
+	case "export":
+		algorithm, err := sumsAlgorithm(hashName, "")
+		if err != nil {
+			return err
+		}
+		target := args[1]
+		info, err := os.Stat(target)
+		if err != nil {
+			return err
+		}
+		var sums []hash.Sum
+		if info.IsDir() {
+			sums, err = algorithm.Sums(ctx, fsutil.HostFS(target))
+		} else {
+			sums, err = archive.Sums(ctx, target, algorithm, opts)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", target, err)
+		}
+		return writeSums(output, sums)
+	case "verify":
+		return verifySums(ctx, args[1], base, hashName)
+	default:
+		return errors.New(checksumsUsage)
+	}
+}
+
+// Write the digests of the latest version of every stored file, named by
+// their file names. The digests recorded are used when algorithm is the
+// one addressing the blobs; otherwise the blobs are read and hashed.
+func exportRepositorySums(ctx context.Context, metadata *db.DB, blobs *store.Store, recorded hash.Algorithm, output, hashName string) error {
+	algorithm, err := sumsAlgorithm(hashName, "")
+	if err != nil {
+		return err
+	}
+	versions, err := db.ListLatestVersions(ctx, metadata, db.VersionFilter{})
+	if err != nil {
+		return err
+	}
+	sums := make([]hash.Sum, 0, len(versions))
+	for _, v := range versions {
+		digest := v.Hash
+		if algorithm.Name != recorded.Name {
+			if digest, err = hashBlob(ctx, blobs, v, algorithm); err != nil {
+				return fmt.Errorf("failed to hash %s: %w", v.Filename, err)
+			}
+		}
+		sums = append(sums, hash.Sum{Digest: digest, Name: v.Filename})
+	}
+	return writeSums(output, sums)
+}
+
+// Hash the content of a version under algorithm
+func hashBlob(ctx context.Context, blobs *store.Store, v db.Version, algorithm hash.Algorithm) (string, error) {
+	r, err := blobs.OpenBlob(ctx, store.StorageID(v))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return algorithm.Reader(ctx, r)
+}
+
+// Write sums to output, or to standard output when it is empty
+func writeSums(output string, sums []hash.Sum) (err error) {
+	if output == "" {
+		return hash.WriteSums(os.Stdout, sums)
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", output, err)
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			removePartial(output)
+		}
+	}()
+	return hash.WriteSums(file, sums)
+}
+
+// Check the files listed in a checksum file, printing a line per file the
+// way sha256sum -c does, and fail when any does not match
+func verifySums(ctx context.Context, path, base, hashName string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	sums, err := hash.ReadSums(file)
+	_ = file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var mismatched, unreadable int
+	for _, sum := range sums {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		algorithm, err := sumsAlgorithm(hashName, sum.Digest)
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(sum.Name)
+		if !filepath.IsAbs(name) && base != "" {
+			name = filepath.Join(base, name)
+		}
+		digest, err := algorithm.File(ctx, name)
+		switch {
+		case err != nil:
+			unreadable++
+			fmt.Printf("%s: FAILED open or read (%v)\n", sum.Name, err)
+		case digest != sum.Digest:
+			mismatched++
+			fmt.Printf("%s: FAILED\n", sum.Name)
+		default:
+			fmt.Printf("%s: OK\n", sum.Name)
+		}
+	}
+	if mismatched+unreadable > 0 {
+		return fmt.Errorf("%d of %d listed files did not match and %d could not be read", mismatched, len(sums), unreadable)
+	}
+	return nil
+}
+
+// Return the named algorithm, or without a name the one whose digests are
+// as long as digest, SHA-256 when it is empty
+func sumsAlgorithm(name, digest string) (hash.Algorithm, error) {
+	if name != "" {
+		return hash.Lookup(name)
+	}
+	switch len(digest) {
+	case 16:
+		return hash.Lookup("xxhash")
+	case 128:
+		return hash.Lookup("sha512")
+	default:
+		return hash.Default(), nil
+	}
+}
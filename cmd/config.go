@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/notify"
+	"github.com/Lenstack/file_manager_version/pkg/plugin"
+	"github.com/Lenstack/file_manager_version/pkg/policy"
+	"github.com/Lenstack/file_manager_version/pkg/retry"
+	"github.com/Lenstack/file_manager_version/pkg/scan"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"github.com/Lenstack/file_manager_version/pkg/watch"
+	"os"
+	"time"
+)
+
+const configFile = "file_manager.json"
+
+// config holds the optional settings read from the JSON config file
+type config struct {
+	Hooks    map[string]string `json:"hooks"`
+	Database db.Config         `json:"database"`
+
+	// Hash names the algorithm addressing stored blobs. Changing it in an
+	// existing repository requires -action rehash.
+	Hash string `json:"hash"`
+
+	Storage     storageConfig `json:"storage"`
+	Retry       retryConfig   `json:"retry"`
+	Compression string        `json:"compression"` // codec used by -action compress
+	Processors  []string      `json:"processors"`  // run in order on every stored file
+	Scan        scanConfig    `json:"scan"`
+
+	// Policies reject or warn about files by name and size as they are
+	// stored or backed up, such as *.pst or anything larger than 10G
+	Policies []policy.Rule `json:"policies"`
+
+	Scrub  scrubConfig  `json:"scrub"`
+	Parity parityConfig `json:"parity"`
+	Server serverConfig `json:"server"`
+	Audit  auditConfig  `json:"audit"`
+
+	Notifications notificationsConfig `json:"notifications"`
+	Watch         watchConfig         `json:"watch"`
+	Daemon        daemonConfig        `json:"daemon"`
+	Service       serviceConfig       `json:"service"`
+
+	// Plugins are external commands providing extra actions, codecs and
+	// processors, keyed by the name they are used under
+	Plugins map[string]plugin.Command `json:"plugins"`
+}
+
+// storageConfig selects the backend keeping the blobs
+type storageConfig struct {
+	Backend  string            `json:"backend"`
+	Settings map[string]string `json:"settings"`
+
+	// IOConcurrency is how many blobs are written to the backend at once;
+	// 0 means as many as -workers
+	IOConcurrency int `json:"io_concurrency"`
+
+	// ChunkMinSize is the size from which new blobs are stored as
+	// content-defined chunks, which blobs sharing most of their content
+	// share; 0 stores every blob whole
+	ChunkMinSize int64 `json:"chunk_min_size"`
+
+	// PackMaxSize is the size below which -action repack -pack compresses
+	// blobs into packfiles; 0 means the default of 1 MiB
+	PackMaxSize int64 `json:"pack_max_size"`
+
+	// Profile tunes the number of workers to the disks: hdd, ssd, or auto
+	// to detect them. -profile and -workers override it.
+	Profile string `json:"profile"`
+
+	// Lifecycle moves blobs between the storage classes of backends that
+	// have them when -action lifecycle runs; the first rule selecting a
+	// blob decides its class
+	Lifecycle []lifecycleRule `json:"lifecycle"`
+
+	// ThawDays is how long archived blobs stay readable once a retrieve
+	// thawed them; 0 means store.DefaultThawDays
+	ThawDays int `json:"thaw_days"`
+}
+
+// lifecycleRule moves blobs to a storage class, such as STANDARD_IA,
+// GLACIER or ARCHIVE, once the newest version referring to them is older
+// than OlderThanDays
+type lifecycleRule struct {
+	Class         string `json:"class"`
+	OlderThanDays int    `json:"older_than_days"`
+	Match         string `json:"match"`      // only blobs of files matching this pattern, as -match
+	Noncurrent    bool   `json:"noncurrent"` // only blobs no latest version refers to
+}
+
+// Return the rules of the storage lifecycle for the store
+func (c storageConfig) lifecycle() []store.LifecycleRule {
+	rules := make([]store.LifecycleRule, len(c.Lifecycle))
+	for i, rule := range c.Lifecycle {
+		rules[i] = store.LifecycleRule{Class: rule.Class, Age: time.Duration(rule.OlderThanDays) * 24 * time.Hour, Match: rule.Match, Noncurrent: rule.Noncurrent}
+	}
+	return rules
+}
+
+// retryConfig sets how storage reads and writes failing with transient
+// errors, such as a dropped network mount, and database transactions
+// failing as the database is busy are retried
+type retryConfig struct {
+	Attempts   int    `json:"attempts"`    // tries in all; 1 disables retries
+	Backoff    string `json:"backoff"`     // before the first retry, doubling for each following one, e.g. 200ms
+	MaxBackoff string `json:"max_backoff"` // longest wait between tries
+}
+
+// Return the configured retry policy, reporting retries to events
+func (c retryConfig) policy(events event.Observer) (retry.Policy, error) {
+	p, err := retry.ParsePolicy(c.Attempts, c.Backoff, c.MaxBackoff)
+	if err != nil {
+		return p, err
+	}
+	p.OnRetry = func(err error, attempt int, wait time.Duration) {
+		events.OnError(event.Error{Op: "retry", Name: fmt.Sprintf("after attempt %d in %s", attempt, wait), Err: err})
+	}
+	return p, nil
+}
+
+// scanConfig sets up virus scanning of stored content
+type scanConfig struct {
+	// Address of the scanner: unix:///path or tcp://host:port of clamd,
+	// icap://host:port/service of an ICAP server; empty disables scanning
+	Address string `json:"address"`
+	Policy  string `json:"policy"`  // reject, quarantine or flag infected content
+	Timeout string `json:"timeout"` // of a scan, e.g. 2m
+}
+
+// scrubConfig sets how much of the storage -action scrub re-hashes
+type scrubConfig struct {
+	// Fraction of the blobs verified per run, least recently verified
+	// first, so 0.1 covers the whole storage every ten runs
+	Fraction float64 `json:"fraction"`
+}
+
+// parityConfig enables parity data for repairing damaged blobs in place
+type parityConfig struct {
+	Overhead int `json:"overhead"` // percent of each blob's size; 0 disables parity
+}
+
+// serverConfig controls access to -action serve
+type serverConfig struct {
+	// Users allowed to use the server; without any, it is open to anyone
+	// who can reach it. Generate tokens with -action token.
+	Users []server.User `json:"users"`
+
+	// QuotaBytes is the storage size past which uploads are refused; 0
+	// for no limit
+	QuotaBytes int64 `json:"quota_bytes"`
+
+	// Repositories to serve instead of this one, keyed by the name they
+	// are served under. Each is a repository directory, relative to this
+	// one, with its own config file, database, storage, users and quota.
+	Repositories map[string]string `json:"repositories"`
+
+	// JobRoot is the directory, relative to the repository, that the
+	// deduplicate, backup and store jobs of the server are confined to.
+	// Without one, a repository served alone confines them to itself, and
+	// repositories served with others refuse them.
+	JobRoot string `json:"job_root"`
+}
+
+// defaultAuditKey is where audit-export keeps the key signing its reports
+// unless audit.signing_key says otherwise
+const defaultAuditKey = "audit_key.pem"
+
+// auditConfig controls -action audit-export
+type auditConfig struct {
+	// SigningKey is the PEM file of the Ed25519 key signing exports,
+	// relative to the repository; it is created on first use
+	SigningKey string `json:"signing_key"`
+}
+
+// notificationsConfig sends notifications about backups, corruption found
+// by verify and scrub, and storage growth
+type notificationsConfig struct {
+	Targets []notify.Target `json:"targets"`
+	Quota   notify.Quota    `json:"quota"` // checked after storing files
+}
+
+// watchConfig controls -action watch
+type watchConfig struct {
+	Interval string   `json:"interval"` // between scans of the tree, e.g. 2s
+	Debounce string   `json:"debounce"` // how long a changed file must stay unchanged to be stored
+	Ignore   []string `json:"ignore"`   // patterns of paths and names not to watch
+
+	// Guard detects what may be ransomware, such as canaries changing or
+	// many files turning into encrypted data, and responds by storing every
+	// file, placing a legal hold on all of them and notifying
+	Guard guardConfig `json:"guard"`
+}
+
+// guardConfig controls the anomaly detection of -action watch
+type guardConfig struct {
+	Canaries         []string `json:"canaries"`          // paths within the tree, created if missing, nothing should touch
+	MaxChanges       int      `json:"max_changes"`       // files changed within window that are an anomaly; 0 disables
+	EntropySpikes    int      `json:"entropy_spikes"`    // files turning encrypted-looking within window that are; 0 disables
+	EntropyThreshold float64  `json:"entropy_threshold"` // bits per byte above which content looks encrypted, 7.5 by default
+	Window           string   `json:"window"`            // e.g. 1m
+}
+
+// Return the guard settings for watch.Options; the window is validated by
+// loadConfig
+func (c guardConfig) guard() watch.Guard {
+	window, _ := time.ParseDuration(c.Window)
+	return watch.Guard{
+		Canaries:         c.Canaries,
+		MaxChanges:       c.MaxChanges,
+		EntropySpikes:    c.EntropySpikes,
+		EntropyThreshold: c.EntropyThreshold,
+		Window:           window,
+	}
+}
+
+// daemonConfig controls -action daemon
+type daemonConfig struct {
+	Parallelism int `json:"parallelism"` // jobs run at once; the others wait in a queue
+
+	// Schedule is recurring maintenance the daemon runs as jobs, such as
+	// {"job": "verify", "fraction": 0.05, "every": "nightly"}
+	Schedule []server.Policy `json:"schedule"`
+}
+
+// serviceConfig controls how -action serve and daemon stop
+type serviceConfig struct {
+	// ShutdownGrace is how long running jobs may take to finish once the
+	// process is asked to stop, e.g. by SIGTERM, before they are cancelled
+	ShutdownGrace string `json:"shutdown_grace"`
+}
+
+// Load the config file, falling back to defaults when it does not exist
+func loadConfig(path string) (*config, error) {
+	cfg := &config{
+		Hooks:    map[string]string{},
+		Database: db.DefaultConfig(),
+		Hash:     hash.DefaultAlgorithm,
+		Storage: storageConfig{
+			Backend:  "local",
+			Settings: map[string]string{"dir": store.DefaultDir},
+			Profile:  fsutil.ProfileAuto,
+		},
+		Retry: retryConfig{
+			Attempts:   retry.Default.Attempts,
+			Backoff:    retry.Default.Backoff.String(),
+			MaxBackoff: retry.Default.MaxBackoff.String(),
+		},
+		Compression: archive.DefaultCodec,
+		Processors:  []string{},
+		Scan:        scanConfig{Policy: store.ScanReject, Timeout: scan.DefaultTimeout.String()},
+		Scrub:       scrubConfig{Fraction: 0.1},
+		Notifications: notificationsConfig{
+			Quota: notify.Quota{WarnPercent: 90},
+		},
+		Watch: watchConfig{
+			Interval: watch.DefaultInterval.String(),
+			Debounce: watch.DefaultDebounce.String(),
+			Ignore:   watch.DefaultIgnore,
+			Guard:    guardConfig{Window: watch.DefaultGuardWindow.String()},
+		},
+		Daemon:  daemonConfig{Parallelism: 1},
+		Service: serviceConfig{ShutdownGrace: server.DefaultShutdownGrace.String()},
+		Plugins: map[string]plugin.Command{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if cfg.Database.AutoMaintain != "" {
+		if _, err := time.ParseDuration(cfg.Database.AutoMaintain); err != nil {
+			return nil, fmt.Errorf("invalid database.auto_maintain in config file %s: %w", path, err)
+		}
+	}
+
+	for name, value := range map[string]string{"watch.interval": cfg.Watch.Interval, "watch.debounce": cfg.Watch.Debounce, "watch.guard.window": cfg.Watch.Guard.Window, "service.shutdown_grace": cfg.Service.ShutdownGrace} {
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid %s in config file %s: must be a duration such as 2s", name, path)
+		}
+	}
+
+	if err := watch.ValidatePatterns(cfg.Watch.Ignore); err != nil {
+		return nil, fmt.Errorf("invalid watch.ignore in config file %s: %w", path, err)
+	}
+	guard := cfg.Watch.Guard.guard()
+	if err := guard.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid watch.guard in config file %s: %w", path, err)
+	}
+
+	if cfg.Scan.Address != "" {
+		if err := store.ValidateScanPolicy(cfg.Scan.Policy); err != nil {
+			return nil, fmt.Errorf("invalid scan.policy in config file %s: %w", path, err)
+		}
+		timeout, err := time.ParseDuration(cfg.Scan.Timeout)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid scan.timeout in config file %s: must be a duration such as 2m", path)
+		}
+		if _, err := scan.New(cfg.Scan.Address, timeout); err != nil {
+			return nil, fmt.Errorf("invalid scan.address in config file %s: %w", path, err)
+		}
+	}
+
+	if _, err := policy.New(cfg.Policies); err != nil {
+		return nil, fmt.Errorf("invalid policies in config file %s: %w", path, err)
+	}
+
+	if cfg.Scrub.Fraction <= 0 || cfg.Scrub.Fraction > 1 {
+		return nil, fmt.Errorf("invalid scrub.fraction in config file %s: must be above 0 and at most 1", path)
+	}
+
+	if cfg.Parity.Overhead < 0 || cfg.Parity.Overhead > 100 {
+		return nil, fmt.Errorf("invalid parity.overhead in config file %s: must be between 0 and 100 percent", path)
+	}
+
+	if _, err := hash.Lookup(cfg.Hash); err != nil {
+		return nil, fmt.Errorf("invalid hash in config file %s: %w", path, err)
+	}
+
+	for name, command := range cfg.Plugins {
+		if err := command.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid plugin %s in config file %s: %w", name, path, err)
+		}
+	}
+
+	if _, err := fsutil.ResolveProfile(cfg.Storage.Profile); err != nil {
+		return nil, fmt.Errorf("invalid storage.profile in config file %s: %w", path, err)
+	}
+	if _, err := cfg.Retry.policy(event.Discard{}); err != nil {
+		return nil, fmt.Errorf("invalid retry in config file %s: %w", path, err)
+	}
+	if cfg.Storage.IOConcurrency < 0 {
+		return nil, fmt.Errorf("invalid storage.io_concurrency in config file %s: must not be negative", path)
+	}
+	if cfg.Storage.ChunkMinSize < 0 {
+		return nil, fmt.Errorf("invalid storage.chunk_min_size in config file %s: must not be negative", path)
+	}
+	if cfg.Storage.PackMaxSize < 0 {
+		return nil, fmt.Errorf("invalid storage.pack_max_size in config file %s: must not be negative", path)
+	}
+	for i, rule := range cfg.Storage.Lifecycle {
+		if rule.Class == "" || rule.OlderThanDays < 0 {
+			return nil, fmt.Errorf("invalid storage.lifecycle entry %d in config file %s: it needs a class and an age of 0 days or more", i+1, path)
+		}
+		if _, err := fsutil.MatchGlob(rule.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid storage.lifecycle entry %d in config file %s: %w", i+1, path, err)
+		}
+	}
+	if cfg.Storage.ThawDays < 0 {
+		return nil, fmt.Errorf("invalid storage.thaw_days in config file %s: must not be negative", path)
+	}
+	if cfg.Daemon.Parallelism < 1 {
+		return nil, fmt.Errorf("invalid daemon.parallelism in config file %s: must be at least 1", path)
+	}
+
+	names := map[string]bool{}
+	for i := range cfg.Daemon.Schedule {
+		policy := &cfg.Daemon.Schedule[i]
+		if err := policy.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid daemon.schedule entry %d in config file %s: %w", i+1, path, err)
+		}
+		if names[policy.Name] {
+			return nil, fmt.Errorf("invalid daemon.schedule in config file %s: %q is scheduled twice; give the entries distinct names", path, policy.Name)
+		}
+		names[policy.Name] = true
+	}
+
+	if cfg.Server.QuotaBytes < 0 {
+		return nil, fmt.Errorf("invalid server.quota_bytes in config file %s: must not be negative", path)
+	}
+
+	if _, err := notify.New("", cfg.Notifications.Targets); err != nil {
+		return nil, fmt.Errorf("invalid notifications.targets in config file %s: %w", path, err)
+	}
+
+	if err := cfg.Notifications.Quota.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid notifications.quota in config file %s: %w", path, err)
+	}
+
+	for name := range cfg.Hooks {
+		if !validHook(name) {
+			return nil, fmt.Errorf("unknown hook %q in config file %s", name, path)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Return value, or fallback when value is empty
+func defaultString(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Return the values that are not empty
+func nonEmpty(values ...string) []string {
+	var kept []string
+	for _, value := range values {
+		if value != "" {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
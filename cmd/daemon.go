@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/client"
+	"github.com/Lenstack/file_manager_version/pkg/dedup"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// socketFile is where -action daemon accepts jobs, in the repository
+const socketFile = "file_manager.sock"
+
+// daemonActions run as jobs of the daemon while one holds the repository
+var daemonActions = map[string]bool{
+	"store":       true,
+	"deduplicate": true,
+	"backup":      true,
+	"verify":      true,
+	"scrub":       true,
+}
+
+// Serve the jobs API of the repository on its socket until ctx is cancelled.
+// The socket is only accessible to the user running the daemon.
+func runDaemon(ctx context.Context, api *server.Server) error {
+	path := repoPath(socketFile)
+	// Holding the lock means a socket left behind is from a daemon that died
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("failed to restrict access to %s: %w", path, err)
+	}
+	fmt.Printf("Daemon of %s accepting jobs on %s\n", repoRoot, path)
+	serviceReady(ctx)
+	return api.Serve(ctx, listener)
+}
+
+// Return a client of the daemon of the repository, or nil when none is
+// running
+func daemonClient(ctx context.Context) *client.Client {
+	path := repoPath(socketFile)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	c := client.NewSocket(path)
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if _, err := c.Jobs(ctx); err != nil {
+		return nil
+	}
+	return c
+}
+
+// Run an action as a job of the daemon, showing its progress and result as
+// if it ran here. Interrupting it cancels the job, and pause signals pause
+// or resume it.
+func submitJob(ctx context.Context, c *client.Client, action, input, output string, cfg *config, events *console, pauses <-chan os.Signal) error {
+	abs := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		a, err := filepath.Abs(p)
+		if err != nil {
+			return p
+		}
+		return a
+	}
+	kind := action
+	var request any
+	switch action {
+	case "store":
+		if input == "" {
+			return errors.New("please provide -input for storing a file")
+		}
+		request = map[string]string{"path": abs(input)}
+	case "deduplicate":
+		if input == "" {
+			return errors.New("please provide a directory for deduplication using -input")
+		}
+		request = map[string]string{"directory": abs(input)}
+	case "backup":
+		if input == "" || output == "" {
+			return errors.New("please provide -input directory and -output file for backup")
+		}
+		request = map[string]string{"directory": abs(input), "output": abs(output)}
+	case "verify", "scrub":
+		kind = "verify"
+		fraction := 0.0
+		if action == "scrub" {
+			fraction = cfg.Scrub.Fraction
+		}
+		request = map[string]float64{"fraction": fraction}
+	}
+
+	job, err := c.StartJob(ctx, kind, request)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Submitted to the daemon as job %s\n", job.ID)
+	id := job.ID
+	handlePause(ctx, pauses, func() (bool, error) {
+		current, err := c.Job(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if current.Paused {
+			current, err = c.ResumeJob(ctx, id)
+		} else {
+			current, err = c.PauseJob(ctx, id)
+		}
+		if err != nil {
+			return false, err
+		}
+		return current.Paused, nil
+	})
+	job, err = c.FollowJob(ctx, id, func(p server.Progress) {
+		replay(events, p)
+	})
+	events.Finish()
+	if ctx.Err() != nil {
+		if _, err := c.CancelJob(context.WithoutCancel(ctx), id); err != nil {
+			fmt.Printf("Failed to cancel job %s: %v\n", id, err)
+		}
+		if action == "backup" {
+			resumeHint(output)
+		}
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	if job.Result != nil {
+		if err := printJobResult(action, input, job.Result); err != nil {
+			return err
+		}
+	}
+	switch job.State {
+	case server.JobFailed:
+		return fmt.Errorf("job %s failed: %s", job.ID, job.Error)
+	case server.JobCancelled:
+		if action == "backup" {
+			resumeHint(output)
+		}
+		return fmt.Errorf("job %s: %w", job.ID, context.Canceled)
+	}
+	return nil
+}
+
+// Show a progress event of a daemon job
+func replay(events event.Observer, p server.Progress) {
+	switch p.Type {
+	case "file_stored":
+		events.OnFileStored(event.FileStored{Name: p.Name, StorageID: p.StorageID, Path: p.Path, Bytes: p.Bytes})
+	case "duplicate_found":
+		events.OnDuplicateFound(event.DuplicateFound{Op: p.Op, Name: p.Name, Original: p.Original, Bytes: p.Bytes})
+	case "backup_progress":
+		events.OnBackupProgress(event.BackupProgress{Name: p.Name, Files: p.Files, Bytes: p.Bytes})
+	case "error":
+		events.OnError(event.Error{Op: p.Op, Name: p.Name, Err: errors.New(strings.TrimPrefix(p.Error, p.Op+": "))})
+	}
+}
+
+// Print the result of a daemon job the way the action prints it
+func printJobResult(action, input string, result any) error {
+	var report interface{ Print() }
+	switch action {
+	case "store":
+		if info, err := os.Stat(input); err != nil || !info.IsDir() {
+			// Storing a file prints its progress only
+			return nil
+		}
+		report = &store.StoreReport{}
+	case "deduplicate":
+		report = &dedup.DedupReport{}
+	case "backup":
+		report = &archive.BackupSummary{}
+	case "verify", "scrub":
+		report = &store.VerifyReport{}
+	default:
+		return nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, report); err != nil {
+		return fmt.Errorf("failed to decode job result: %w", err)
+	}
+	report.Print()
+	return nil
+}
+
+// Tell how to resume an interrupted backup that left a checkpoint
+func resumeHint(output string) {
+	if archive.Resumable(output) {
+		fmt.Println("Run the same backup again to resume it")
+	}
+}
+
+// Run -action jobs: list the daemon's jobs or its schedule, or show,
+// cancel, pause or resume a job
+func runJobs(ctx context.Context, args []string) error {
+	c := daemonClient(ctx)
+	if c == nil {
+		return errors.New("no daemon is running for this repository; start one with -action daemon")
+	}
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch {
+	case command == "list" && len(args) <= 1:
+		jobs, err := c.Jobs(ctx)
+		if err != nil {
+			return err
+		}
+		printJobs(jobs)
+	case command == "schedule" && len(args) == 1:
+		policies, err := c.Schedule(ctx)
+		if err != nil {
+			return err
+		}
+		printSchedule(policies)
+	case command == "status" && len(args) == 2:
+		job, err := c.Job(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		printJob(job)
+	case command == "cancel" && len(args) == 2:
+		job, err := c.CancelJob(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Cancelling job %s (%s, %s)\n", job.ID, job.Kind, job.State)
+	case command == "pause" && len(args) == 2:
+		job, err := c.PauseJob(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Paused job %s (%s, %s); it stops at its next read\n", job.ID, job.Kind, job.State)
+	case command == "resume" && len(args) == 2:
+		job, err := c.ResumeJob(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Resumed job %s (%s, %s)\n", job.ID, job.Kind, job.State)
+	default:
+		return errors.New("usage: -action jobs [list | schedule | status <id> | cancel <id> | pause <id> | resume <id>]")
+	}
+	return nil
+}
+
+// Print jobs as a table, oldest first
+func printJobs(jobs []server.Job) {
+	fmt.Printf("%-5s  %-12s  %-9s  %-19s  %9s  %s\n", "ID", "KIND", "STATE", "SUBMITTED", "DURATION", "ERROR")
+	for _, job := range jobs {
+		state := job.State
+		if job.Paused {
+			state = "paused"
+		}
+		fmt.Printf("%-5s  %-12s  %-9s  %-19s  %9s  %s\n", job.ID, job.Kind, state,
+			job.Submitted.Local().Format(time.DateTime), jobDuration(&job), strings.ReplaceAll(job.Error, "\n", " "))
+	}
+}
+
+// Print the recurring jobs of the daemon
+func printSchedule(policies []server.Scheduled) {
+	fmt.Printf("%-30s  %-12s  %-8s  %-19s  %-19s  %s\n", "NAME", "JOB", "EVERY", "LAST RUN", "NEXT RUN", "LAST JOB")
+	for _, p := range policies {
+		last := ""
+		if p.Last != nil {
+			last = p.Last.Local().Format(time.DateTime)
+		}
+		fmt.Printf("%-30s  %-12s  %-8s  %-19s  %-19s  %s\n", p.Name, p.Job, p.Every, last, p.Next.Local().Format(time.DateTime), p.JobID)
+	}
+}
+
+// Print the details of a job and its result
+func printJob(job *server.Job) {
+	fmt.Printf("Job:       %s\nKind:      %s\nState:     %s\nSubmitted: %s\n", job.ID, job.Kind, job.State, job.Submitted.Local().Format(time.DateTime))
+	if job.Paused {
+		fmt.Println("Paused:    yes")
+	}
+	if job.User != "" {
+		fmt.Printf("User:      %s\n", job.User)
+	}
+	if job.Started != nil {
+		fmt.Printf("Duration:  %s\n", jobDuration(job))
+	}
+	if job.Error != "" {
+		fmt.Printf("Error:     %s\n", job.Error)
+	}
+	if job.Result != nil {
+		data, err := json.MarshalIndent(job.Result, "", "  ")
+		if err == nil {
+			fmt.Printf("Result:    %s\n", data)
+		}
+	}
+}
+
+// Return how long a job ran, or has been running
+func jobDuration(job *server.Job) string {
+	if job.Started == nil {
+		return ""
+	}
+	end := time.Now()
+	if job.Finished != nil {
+		end = *job.Finished
+	}
+	return end.Sub(*job.Started).Round(time.Millisecond).String()
+}
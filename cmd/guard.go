@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/notify"
+	"github.com/Lenstack/file_manager_version/pkg/watch"
+	"time"
+)
+
+// Return how -action watch responds to an anomaly in directory once every
+// file is stored: a legal hold on all files pauses pruning and garbage
+// collection until an admin releases it, and the anomaly is logged and
+// notified
+func anomalyResponse(metadata *db.DB, notifier *notify.Notifier, directory string) func(context.Context, watch.Anomaly) {
+	return func(ctx context.Context, a watch.Anomaly) {
+		ctx = context.WithoutCancel(ctx)
+		fmt.Printf("Warning: possible ransomware in %s: %s; stored %d files\n", directory, a.Message, a.Snapshot)
+		if err := holdAllFiles(ctx, metadata, a); err != nil {
+			fmt.Printf("Warning: failed to place legal hold: %v\n", err)
+		}
+		err := db.RecordAction(ctx, metadata, db.Action{ActionType: "watch_anomaly", Filename: directory, StorageID: a.Kind, Bytes: int64(len(a.Files)), Err: errors.New(a.Message)})
+		if err != nil {
+			fmt.Printf("Warning: failed to log anomaly: %v\n", err)
+		}
+		warnNotify(notifier.Anomaly(ctx, directory, a))
+	}
+}
+
+// Place a legal hold on every file for an anomaly, unless one is active
+func holdAllFiles(ctx context.Context, metadata *db.DB, a watch.Anomaly) error {
+	if err := db.CheckGlobalHold(ctx, metadata); err != nil {
+		if errors.Is(err, db.ErrHeld) {
+			return nil
+		}
+		return err
+	}
+	name := fmt.Sprintf("anomaly %s %s", a.Kind, a.Time.Local().Format(time.DateTime))
+	id, err := db.AddHold(ctx, metadata, db.LegalHold{Name: name, Pattern: db.AllFiles})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Placed legal hold %d on every file; release it with -action hold release %d once the files are checked\n", id, id)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Run a legal hold subcommand: "add [NAME]" with -match, "release ID" or
+// "list". A hold freezes every version of the files matching its pattern
+// against prune, gc, fsck and rehash until it is released, which takes
+// the token of an admin in server.users in $FM_TOKEN.
+func runHold(ctx context.Context, metadata *db.DB, users []server.User, args []string, match string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: -action hold -match PATTERN add [NAME] | release ID | list")
+	}
+	switch command := args[0]; command {
+	case "add":
+		if match == "" || len(args) > 2 {
+			return fmt.Errorf("usage: -action hold -match PATTERN add [NAME]")
+		}
+		hold := db.LegalHold{Pattern: match}
+		if len(args) == 2 {
+			hold.Name = args[1]
+		}
+		id, err := db.AddHold(ctx, metadata, hold)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Placed legal hold %d on files matching %s\n", id, match)
+	case "release":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: -action hold release ID")
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid legal hold %q", args[1])
+		}
+		token := os.Getenv("FM_TOKEN")
+		if token == "" {
+			return errors.New("releasing a legal hold needs the token of an admin in $FM_TOKEN")
+		}
+		user, err := server.Authorize(users, token, server.RoleAdmin)
+		if err != nil {
+			return err
+		}
+		ctx = db.WithOrigin(db.WithPrincipal(ctx, user.Name), user.Role, "")
+		hold, err := db.ReleaseHold(ctx, metadata, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Released legal hold %d (%s) as %s\n", id, hold, user.Name)
+	case "list":
+		holds, err := db.ListHolds(ctx, metadata)
+		if err != nil {
+			return err
+		}
+		for _, h := range holds {
+			fmt.Printf("%-4d %-20s %-30s placed %s", h.ID, h.Name, h.Pattern, h.Created.Local().Format(time.DateTime))
+			if h.Principal != "" {
+				fmt.Printf(" by %s", h.Principal)
+			}
+			if h.Released != nil {
+				fmt.Printf(", released %s by %s", h.Released.Local().Format(time.DateTime), h.ReleasedBy)
+			}
+			fmt.Println()
+		}
+	default:
+		return fmt.Errorf("unknown hold command %q (use add, release, list)", command)
+	}
+	return nil
+}
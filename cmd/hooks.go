@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// hookNames lists every hook that may be configured
+var hookNames = []string{"pre-backup", "post-backup", "pre-restore", "post-restore"}
+
+// Report whether name is a supported hook
+func validHook(name string) bool {
+	for _, hook := range hookNames {
+		if hook == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Run a configured hook command, passing job details through the
+// environment. The command is killed when ctx is cancelled.
+func runHook(ctx context.Context, cfg *config, name string, env map[string]string) error {
+	command := strings.TrimSpace(cfg.Hooks[name])
+	if command == "" {
+		return nil
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "FM_HOOK="+name)
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
+
+// Run job between its pre and post hooks. A failing pre hook aborts the
+// job; the post hook always runs, even after an interruption, and receives
+// the job outcome.
+func withHooks(ctx context.Context, cfg *config, job, input, output string, run func() error) error {
+	env := map[string]string{
+		"FM_JOB":    job,
+		"FM_INPUT":  input,
+		"FM_OUTPUT": output,
+	}
+
+	if err := runHook(ctx, cfg, "pre-"+job, env); err != nil {
+		return err
+	}
+
+	jobErr := run()
+
+	env["FM_STATUS"] = "success"
+	if jobErr != nil {
+		env["FM_STATUS"] = "failure"
+		if errors.Is(jobErr, context.Canceled) {
+			env["FM_STATUS"] = "interrupted"
+		}
+		env["FM_ERROR"] = jobErr.Error()
+	}
+	if err := runHook(context.WithoutCancel(ctx), cfg, "post-"+job, env); err != nil {
+		if jobErr != nil {
+			return fmt.Errorf("%w (additionally: %v)", jobErr, err)
+		}
+		return err
+	}
+
+	return jobErr
+}
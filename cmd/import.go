@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"github.com/Lenstack/file_manager_version/pkg/importer"
+)
+
+// importUsage describes the import subcommands
+const importUsage = "usage: -action import git DIRECTORY [REF] | restic REPOSITORY"
+
+// Return the history an import subcommand names
+func importHistory(args []string) (importer.History, error) {
+	switch {
+	case len(args) >= 2 && len(args) <= 3 && args[0] == "git":
+		git := &importer.Git{Dir: args[1]}
+		if len(args) == 3 {
+			git.Ref = args[2]
+		}
+		return git, nil
+	case len(args) == 2 && args[0] == "restic":
+		return &importer.Restic{Repo: args[1]}, nil
+	default:
+		return nil, errors.New(importUsage)
+	}
+}
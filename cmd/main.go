@@ -1,554 +1,1096 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
-	"crypto/sha256"
-	"database/sql"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
-	"io"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/audit"
+	"github.com/Lenstack/file_manager_version/pkg/content"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/dedup"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/graph"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/importer"
+	"github.com/Lenstack/file_manager_version/pkg/lock"
+	"github.com/Lenstack/file_manager_version/pkg/notify"
+	"github.com/Lenstack/file_manager_version/pkg/plugin"
+	"github.com/Lenstack/file_manager_version/pkg/policy"
+	"github.com/Lenstack/file_manager_version/pkg/ratelimit"
+	"github.com/Lenstack/file_manager_version/pkg/scan"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"github.com/Lenstack/file_manager_version/pkg/watch"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 )
 
 const (
-	databaseFile  = "file_manager.db"
-	storageDir    = "storage"
+	storageDir    = store.DefaultDir
 	compressedDir = "compressed"
+	lockFile      = "file_manager.lock"
+	quarantineDir = "quarantine"
+	infectedDir   = "quarantine/infected"
+	parityDir     = "parity"
+	uploadsDir    = "uploads"
+
+	builtinActions = "store, retrieve, cat, open, deduplicate, compress, backup, restore, prune, diff, db-export, db-import, db-maintain, db-merge, repo-merge, repo-clone, history, report, stats, rehash, verify, scrub, fsck, parity, serve, daemon, jobs, service, watch, token, init, bench, list, meta, alias, branch, search, adopt, checksums, import, index, repack, chunk, lifecycle, thaw, audit-export, audit-verify, retention, hold, mount"
 )
 
-// Initialize the database
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", databaseFile)
-	if err != nil {
-		return nil, err
+// List the built-in actions and those added by plugins
+func actionList() string {
+	names := plugin.ActionNames()
+	if len(names) == 0 {
+		return builtinActions
 	}
-
-	query := `
-	CREATE TABLE IF NOT EXISTS actions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		action_type TEXT,
-		filename TEXT,
-		storage_id TEXT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	CREATE TABLE IF NOT EXISTS versions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		filename TEXT,
-		version INTEGER,
-		hash TEXT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-	);`
-	_, err = db.Exec(query)
-	if err != nil {
-		return nil, err
-	}
-
-	return db, nil
+	return builtinActions + ", " + strings.Join(names, ", ")
 }
 
-// Log actions into the database
-func logAction(db *sql.DB, actionType, filename, storageID string) error {
-	query := `INSERT INTO actions (action_type, filename, storage_id) VALUES (?, ?, ?);`
-	_, err := db.Exec(query, actionType, filename, storageID)
-	return err
+// readOnlyActions may run while another process holds the repository lock
+var readOnlyActions = map[string]bool{
+	"cat":       true,
+	"open":      true,
+	"checksums": true,
+	"history":   true,
+	"list":      true,
+	"report":    true,
+	"stats":     true,
+	"db-export": true,
+	"diff":      true,
+	"mount":     true,
 }
 
-// Log file versioning into the database
-func logVersion(db *sql.DB, filename, hash string) error {
-	var lastVersion int
-	query := `
-	SELECT version FROM versions
-	WHERE filename = ?
-	ORDER BY version DESC
-	LIMIT 1;`
-	err := db.QueryRow(query, filename).Scan(&lastVersion)
-
-	if errors.Is(err, sql.ErrNoRows) {
-		lastVersion = 0
-	} else if err != nil {
-		return err
-	}
-
-	query = `INSERT INTO versions (filename, version, hash) VALUES (?, ?, ?);`
-	_, err = db.Exec(query, filename, lastVersion+1, hash)
-	return err
-}
-
-// Store a file and manage its versioning
-func storeFile(filePath string, db *sql.DB) (string, error) {
-	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
-		if err := os.Mkdir(storageDir, os.ModePerm); err != nil {
-			return "", fmt.Errorf("failed to create storage directory: %w", err)
+// Return the arguments following the flags, such as "cancel 3" of -action
+// jobs. Flags are only parsed before them, so later ones are refused.
+func commandArgs() ([]string, error) {
+	args := flag.Args()
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("flag %s must come before %s", arg, strings.Join(args, " "))
 		}
 	}
+	return args, nil
+}
 
-	srcFile, err := os.Open(filePath)
+// Open the metadata database of the repository in root and bring its
+// schema up to date. Busy transactions are retried as opts.Retry says.
+func initDB(ctx context.Context, cfg *config, root string, opts fsutil.Options) (*db.DB, error) {
+	metadata, err := db.Open(cfg.Database, root)
 	if err != nil {
-		return "", fmt.Errorf("failed to open source file: %w", err)
+		return nil, err
 	}
-	defer func(srcFile *os.File) {
-		err := srcFile.Close()
-		if err != nil {
-			fmt.Printf("Failed to close source file: %v\n", err)
-		}
-	}(srcFile)
+	metadata.SetRetry(opts.Retry)
 
-	hash, err := hashFile(filePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to hash file: %w", err)
+	if err := db.Migrate(ctx, metadata); err != nil {
+		return nil, err
 	}
 
-	ext := filepath.Ext(filePath)
-	filename := strings.TrimSuffix(filepath.Base(filePath), ext)
+	return metadata, nil
+}
 
-	hashedFilename := hash + ext
-	storagePath := filepath.Join(storageDir, hashedFilename)
+func main() {
+	action := flag.String("action", "", "Action to perform: "+actionList())
+	input := flag.String("input", "", "Input file/directory")
+	output := flag.String("output", "", "Output file/directory")
+	repo := flag.String("repo", "", "Repository directory (default: $FM_REPO or the nearest directory containing "+configFile+")")
+	configPath := flag.String("config", "", "Path to the JSON config file (default: "+configFile+" in the repository)")
+	limitRate := flag.String("limit-rate", "", "Limit I/O throughput, e.g. 512K, 10M, 1G (bytes per second)")
+	keepLast := flag.Int("keep-last", 0, "Prune: keep the N most recent backups")
+	keepDaily := flag.Int("keep-daily", 0, "Prune: keep the newest backup of each of the last N days")
+	keepWeekly := flag.Int("keep-weekly", 0, "Prune: keep the newest backup of each of the last N weeks")
+	keepMonthly := flag.Int("keep-monthly", 0, "Prune: keep the newest backup of each of the last N months")
+	workers := flag.Int("workers", 0, "Number of parallel workers, e.g. files a directory store hashes and copies at once (default set by -profile)")
+	profileName := flag.String("profile", "", "Device profile setting the default -workers: hdd (one at a time, avoiding seeks), ssd (many in flight), auto (detect from the disks of -input, -output and the repository; default)")
+	durable := flag.Bool("durable", false, "Fsync written files and their directories before reporting success")
+	failFast := flag.Bool("fail-fast", false, "Store, backup: fail at the first file that cannot be read instead of skipping it and listing it at the end; implies -errors-fatal")
+	errorsFatal := flag.Bool("errors-fatal", false, "Store, backup, adopt, deduplicate: fail at the first directory that cannot be read instead of skipping it")
+	paranoid := flag.Bool("paranoid", false, "Store, deduplicate: re-hash every file instead of trusting cached digests of files whose size, modification time and inode are unchanged; backup: write the archive again even when no file changed since the last backup to it")
+	limit := flag.Int("limit", 50, "History, report and search: maximum number of rows to show")
+	contentType := flag.String("type", "", "List, meta -match: only files whose latest content is of this kind ("+strings.Join(content.Kinds(), ", ")+"), MIME type, or MIME major type such as image/*")
+	copyBlobs := flag.Bool("copy", false, "Adopt: copy the content of the files into storage instead of registering them in place")
+	where := flag.String("where", "", "List, meta -match: only files with these comma-separated metadata values, e.g. project=alpha,reviewed=true")
+	takenBefore := flag.String("taken-before", "", "List, meta -match: only photos and videos taken before this date, e.g. 2020 or 2020-06-30")
+	takenAfter := flag.String("taken-after", "", "List, meta -match: only photos and videos taken on or after this date, e.g. 2020 or 2020-06-30")
+	branch := flag.String("branch", "", "Store, retrieve, cat, open: the branch of the history of -input to store the file on or read its versions from (default the mainline); see -action branch")
+	since := flag.String("since", "", "Audit-export: only actions on or after this date, e.g. 2024 or 2024-06-30, or an RFC 3339 time")
+	until := flag.String("until", "", "Audit-export: only actions up to the end of this date, e.g. 2024 or 2024-06-30, or before an RFC 3339 time")
+	auditKey := flag.String("key", "", "Audit-verify: the key the report must be signed by, as the fingerprint audit-export prints or a PEM file of the public or signing key (default the audit.signing_key of the repository)")
+	statsHistory := flag.Bool("history", false, "Stats: the size of the repository at the end of every month, derived from its versions, instead of now; -format csv charts it")
+	drawGraph := flag.Bool("graph", false, "History: draw the version chain of -input with the histories renames joined into it and rollbacks to earlier content; -format dot writes it for Graphviz")
+	match := flag.String("match", "", "List: only files whose names match this pattern, where ** spans directories, e.g. 'invoices/2024/**'; meta: set or unset values of all of them in one transaction instead of naming a FILE; hold add: the files to freeze")
+	showVersion := flag.Bool("version", false, "Print the tool version and exit")
+	format := flag.String("format", "", "Output format: jsonl, json, csv, sql for db-export/db-import (default jsonl); table, csv, json for report and stats -history (default table); json, csv for audit-export (default json); text, dot for history -graph (default text); systemd, winsw for service (default for the system)")
+	reportName := flag.String("report", "", "Report to render: "+strings.Join(db.ReportNames(), ", "))
+	wait := flag.Duration("wait", 0, "Wait up to this long for the repository lock, e.g. 30s or 10m")
+	dryRun := flag.Bool("dry-run", false, "Show what would be done without changing anything")
+	hashName := flag.String("hash", "", "Init: hash algorithm addressing stored files; bench: the one to store with; checksums: the one to export or verify with: "+strings.Join(hash.Names(), ", ")+" (default "+hash.DefaultAlgorithm+")")
+	repair := flag.String("repair", "", "Verify and scrub: comma-separated repairs of damaged blobs: replica (copy back from -replica), quarantine (move aside)")
+	replica := flag.String("replica", "", "Verify and scrub: storage directory of a replica to repair blobs from")
+	adopt := flag.String("adopt", "", "Fsck: what to do with blobs no version refers to: register (record them under "+store.RecoveredPrefix+"), remove (also discarding blobs left half-written by killed runs)")
+	deltaBlobs := flag.Bool("delta", false, "Repack: store versions other than the latest of each file as deltas against it; without it, versions stored as deltas are stored whole again")
+	packBlobs := flag.Bool("pack", false, "Repack: compress blobs smaller than storage.pack_max_size into packfiles and consolidate small packfiles; without it, packed blobs are stored loose again")
+	joinChunks := flag.Bool("join", false, "Chunk: store blobs stored in chunks whole again instead")
+	split := flag.Bool("split", false, "Fsck: separate the version histories of files with the same name stored from different paths")
+	normalizeNames := flag.Bool("normalize", false, "Fsck: merge the version histories of names recorded before names were normalized to Unicode NFC into those of their NFC form")
+	listen := flag.String("listen", "127.0.0.1:8080", "Serve: address to serve the web UI and HTTP API on; addresses other than loopback ones need server.users")
+	grpcListen := flag.String("grpc-listen", "", "Serve: address to also serve the gRPC API of api/filemanager/v1 on; addresses other than loopback ones need server.users")
+	remote := flag.String("remote", "", "Server URL to store to and retrieve from instead of a local repository, e.g. https://fm.internal/repos/team; the token is read from $FM_TOKEN")
+	conflicts := flag.String("conflicts", store.MergeAppend, "Repo-merge: what to do with files whose history in -input diverged from the local one: append (its versions after the local ones), rename (import it beside the local file, named after -input), skip")
+	collisionPolicy := flag.String("collisions", string(archive.DefaultCollisionPolicy), "Restore: what to do with entries whose names differ only in case when the target file system ignores case: rename (add a numeric suffix), skip, fail")
+	fileVersion := flag.Int("file-version", 0, "Retrieve, cat, open: version of the file to retrieve (default the latest); cat and open also take versions as name@version")
+	preserveXattrs := flag.Bool("preserve-xattrs", false, "Retrieve: set the extended attributes, ACLs and SELinux labels recorded for the version on the retrieved file")
+	scale := flag.Float64("scale", 1, "Bench: multiply the number and size of the generated files by this factor")
+	tolerance := flag.Float64("tolerance", 0.2, "Bench: fail when a throughput is more than this fraction below the -input baseline")
+	flag.Parse()
 
-	if _, err := os.Stat(storagePath); err == nil {
-		fmt.Printf("File %s already exists as %s. Skipping storage.\n", filePath, storagePath)
-		if err := logAction(db, "store_duplicate", filename+ext, hashedFilename); err != nil {
-			return "", err
-		}
-		return hashedFilename, nil
+	if *showVersion {
+		fmt.Println(db.ToolVersion)
+		return
 	}
 
-	destFile, err := os.Create(storagePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create destination file: %w", err)
+	// Ctrl-C and SIGTERM cancel the running operation, which cleans up after
+	// itself and is recorded as aborted
+	ctx, stop := abortOnSignal(context.Background())
+	defer stop()
+
+	// SIGUSR1 holds the running operation at its next read until sent again
+	pause := &fsutil.Pause{}
+	ctx = fsutil.WithPause(ctx, pause)
+	pauses := pauseSignals()
+
+	events := newConsole()
+	if *action == "cat" {
+		events.out = os.Stderr
 	}
-	defer func(destFile *os.File) {
-		err := destFile.Close()
+	opts := fsutil.Options{Durable: *durable, Paranoid: *paranoid, Observer: events, ErrorsFatal: *errorsFatal, FailFast: *failFast}
+	if *limitRate != "" {
+		bytesPerSec, err := fsutil.ParseRate(*limitRate)
 		if err != nil {
-			fmt.Printf("Failed to close destination file: %v\n", err)
+			log.Fatalf("Invalid -limit-rate: %v", err)
 		}
-	}(destFile)
-
-	if _, err := io.Copy(destFile, srcFile); err != nil {
-		return "", fmt.Errorf("failed to copy file: %w", err)
+		opts.Limiter = ratelimit.New(bytesPerSec)
 	}
 
-	if err := logAction(db, "store", filename+ext, hashedFilename); err != nil {
-		return "", fmt.Errorf("failed to log action: %w", err)
+	if *action == "token" {
+		token, digest, err := server.NewToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Token:        %s\ntoken_sha256: %s\n", token, digest)
+		fmt.Println("Give the token to the user and add the digest to server.users in the config file")
+		return
 	}
 
-	if err := logVersion(db, filename+ext, hash); err != nil {
-		return "", fmt.Errorf("failed to log version: %w", err)
+	if *remote != "" {
+		if err := runRemote(ctx, *remote, *action, *input, *output, *fileVersion); err != nil {
+			if errors.Is(err, context.Canceled) {
+				log.Printf("%s: interrupted", *action)
+				os.Exit(130)
+			}
+			log.Fatal(err)
+		}
+		return
 	}
 
-	fmt.Printf("File stored as %s\n", storagePath)
-	return hashedFilename, nil
-}
-
-// Deduplicate files in a directory
-func deduplicateFiles(directory string, db *sql.DB) error {
-	hashes := make(map[string]string)
-	hashesMutex := &sync.Mutex{}
-
-	errCh := make(chan error, 1)
-	done := make(chan bool)
-
-	go func() {
-		err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+	if *action == "bench" {
+		if *workers <= 0 {
+			profile, err := fsutil.ResolveProfile(*profileName, os.TempDir())
 			if err != nil {
-				return err
+				log.Fatalf("Invalid -profile: %v", err)
 			}
-			if !info.IsDir() {
-				fileHash, err := hashFile(path)
-				if err != nil {
-					return err
-				}
-
-				hashesMutex.Lock()
-				if originalPath, exists := hashes[fileHash]; exists {
-					fmt.Printf("Duplicate found: %s (original: %s). Deleting...\n", path, originalPath)
-					if err := os.Remove(path); err != nil {
-						hashesMutex.Unlock()
-						return err
-					}
-					if err := logAction(db, "deduplicate", path, ""); err != nil {
-						hashesMutex.Unlock()
-						return err
-					}
-				} else {
-					hashes[fileHash] = path
-				}
-				hashesMutex.Unlock()
+			*workers = profile.Workers
+		}
+		if err := runBench(ctx, *input, *output, *hashName, *scale, *tolerance, *workers, opts); err != nil {
+			if errors.Is(err, context.Canceled) {
+				log.Printf("%s: interrupted", *action)
+				os.Exit(130)
 			}
-			return nil
-		})
-		if err != nil {
-			errCh <- err
+			log.Fatal(err)
 		}
-		done <- true
-	}()
-
-	select {
-	case err := <-errCh:
-		return err
-	case <-done:
-		return nil
+		return
 	}
-}
 
-// Hash a file using SHA-256
-func hashFile(filepath string) (string, error) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open file: %w", err)
-	}
-	defer func(file *os.File) {
-		err := file.Close()
+	if *action == "checksums" {
+		args, err := commandArgs()
 		if err != nil {
-			fmt.Printf("Failed to close file: %v\n", err)
+			log.Fatal(err)
+		}
+		if !checksumsOfRepository(args) {
+			if err := runChecksums(ctx, args, *input, *output, *hashName, opts); err != nil {
+				log.Fatal(err)
+			}
+			return
 		}
-	}(file)
+	}
 
-	hashed := sha256.New()
-	if _, err := io.Copy(hashed, file); err != nil {
-		return "", fmt.Errorf("failed to hash file: %w", err)
+	if *action == "init" {
+		dir := *repo
+		if dir == "" {
+			dir = "."
+		}
+		if err := initRepo(dir, *hashName); err != nil {
+			log.Fatalf("Failed to initialize repository: %v", err)
+		}
+		fmt.Printf("Initialized repository in %s\n", dir)
+		return
 	}
 
-	return fmt.Sprintf("%x", hashed.Sum(nil)), nil
-}
+	if *action == "repo-clone" {
+		if err := cloneRepository(ctx, *input, *output, *wait, max(*workers, 1), opts); err != nil {
+			if errors.Is(err, context.Canceled) {
+				log.Printf("%s: interrupted", *action)
+				os.Exit(130)
+			}
+			log.Fatalf("Failed to clone repository: %v", err)
+		}
+		return
+	}
 
-// Compress a file using gzip
-func compressFile(inputFile, outputDir string) error {
-	// Ensure the output directory exists
-	err := os.MkdirAll(outputDir, os.ModePerm)
+	root, err := findRepoRoot(*repo)
 	if err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+		log.Fatalf("Failed to locate repository: %v", err)
 	}
+	repoRoot = root
 
-	// Open the input file
-	inFile, err := os.Open(inputFile)
+	if *configPath == "" {
+		*configPath = repoPath(configFile)
+	}
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
-	defer func(inFile *os.File) {
-		err := inFile.Close()
+	// Validated by loadConfig
+	opts.Retry, _ = cfg.Retry.policy(events)
+	if *workers <= 0 {
+		// storage.profile was validated by loadConfig
+		profile, err := fsutil.ResolveProfile(defaultString(*profileName, cfg.Storage.Profile), nonEmpty(*input, *output, repoRoot)...)
 		if err != nil {
-			fmt.Printf("Failed to close input file: %v\n", err)
+			log.Fatalf("Invalid -profile: %v", err)
 		}
-	}(inFile)
-
-	// Construct the output file path
-	outputFile := filepath.Join(outputDir, filepath.Base(inputFile)+".gz")
-
-	// Create the output file
-	outFile, err := os.Create(outputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		*workers = profile.Workers
 	}
-	defer func(outFile *os.File) {
-		err := outFile.Close()
-		if err != nil {
-			fmt.Printf("Failed to close output file: %v\n", err)
+	for name, command := range cfg.Plugins {
+		if err := plugin.Load(name, command); err != nil {
+			log.Fatalf("Failed to load plugins: %v", err)
 		}
-	}(outFile)
+	}
 
-	// Create a new gzip writer with metadata
-	gzipWriter := gzip.NewWriter(outFile)
-	defer func(gzipWriter *gzip.Writer) {
-		err := gzipWriter.Close()
+	if *action == "audit-verify" {
+		trusted := *auditKey
+		if trusted == "" {
+			trusted = repoPath(defaultString(cfg.Audit.SigningKey, defaultAuditKey))
+			if _, err := os.Stat(trusted); err != nil {
+				log.Fatalf("Failed to verify audit export: no trusted key; give the fingerprint or PEM file of the key signing the report with -key")
+			}
+		}
+		if *input == "" {
+			log.Fatalf("Failed to verify audit export: please provide -input with the report to verify")
+		}
+		signature, err := audit.Verify(*input, trusted)
 		if err != nil {
-			fmt.Printf("Failed to close gzip writer: %v\n", err)
+			log.Fatalf("Failed to verify audit export: %v", err)
 		}
-	}(gzipWriter)
-	gzipWriter.Name = filepath.Base(inputFile) // Store the original file name in the header
-
-	// Copy data from the input file to the gzip writer
-	_, err = io.Copy(gzipWriter, inFile)
-	if err != nil {
-		return fmt.Errorf("failed to write compressed data: %w", err)
+		fmt.Printf("Report %s is intact: %d actions exported from %s at %s, signed by key %s\n",
+			*input, signature.Entries, signature.Repository, signature.GeneratedAt.Format(time.RFC3339), signature.Signer())
+		return
 	}
 
-	return nil
-}
-
-// Decompress a file using gzip
-func decompressFile(inputFile, outputDir string) error {
-	// Ensure the output directory exists
-	err := os.MkdirAll(outputDir, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
-	}
-
-	// Open the compressed input file
-	inFile, err := os.Open(inputFile)
-	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
-	}
-	defer func(inFile *os.File) {
-		err := inFile.Close()
+	if *action == "jobs" || *action == "service" {
+		args, err := commandArgs()
+		if err == nil && *action == "jobs" {
+			err = runJobs(ctx, args)
+		} else if err == nil {
+			err = installService(args, cfg, *listen, *format, *output, *dryRun)
+		}
 		if err != nil {
-			fmt.Printf("Failed to close input file: %v\n", err)
+			log.Fatal(err)
 		}
-	}(inFile)
+		return
+	}
 
-	// Create a new gzip reader
-	gzipReader, err := gzip.NewReader(inFile)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+	// While a daemon holds the repository, it runs these actions as jobs
+	if daemonActions[*action] && *repair == "" && *replica == "" {
+		if c := daemonClient(ctx); c != nil {
+			if err := submitJob(ctx, c, *action, *input, *output, cfg, events, pauses); err != nil {
+				if errors.Is(err, context.Canceled) {
+					log.Printf("%s: interrupted", *action)
+					os.Exit(130)
+				}
+				log.Fatal(err)
+			}
+			return
+		}
 	}
-	defer func(gzipReader *gzip.Reader) {
-		err := gzipReader.Close()
+
+	handlePause(ctx, pauses, func() (bool, error) {
+		return pause.Toggle(), nil
+	})
+
+	var repoLock *lock.Lock
+	if !readOnlyActions[*action] {
+		repoLock, err = lock.Acquire(ctx, repoPath(lockFile), *action, *wait, events)
 		if err != nil {
-			fmt.Printf("Failed to close gzip reader: %v\n", err)
+			log.Fatalf("Failed to lock repository: %v", err)
 		}
-	}(gzipReader)
+	}
+	defer repoLock.Release()
 
-	// Use the original file name from the gzip header
-	outputFile := filepath.Join(outputDir, gzipReader.Name)
-	if outputFile == "" {
-		return fmt.Errorf("gzip header does not contain the original file name")
+	// log.Fatal skips deferred calls, so the lock is released explicitly
+	fatal := func(v ...any) {
+		events.Finish()
+		repoLock.Release()
+		log.Fatal(v...)
 	}
 
-	// Create the output file
-	outFile, err := os.Create(outputFile)
+	metadata, err := initDB(ctx, cfg, repoRoot, opts)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		fatal("Failed to initialize database: ", err)
 	}
-	defer func(outFile *os.File) {
-		err := outFile.Close()
+	defer func(metadata *db.DB) {
+		err := metadata.Close()
 		if err != nil {
-			fmt.Printf("Failed to close output file: %v\n", err)
+			fmt.Printf("Failed to close database: %v\n", err)
 		}
-	}(outFile)
+	}(metadata)
 
-	// Copy data from the gzip reader to the output file
-	_, err = io.Copy(outFile, gzipReader)
+	// Validated by loadConfig
+	algorithm, _ := hash.Lookup(cfg.Hash)
+	recorded, err := repoHash(ctx, metadata, cfg.Hash)
 	if err != nil {
-		return fmt.Errorf("failed to write decompressed data: %w", err)
+		fatal("Failed to determine hash algorithm: ", err)
 	}
-
-	return nil
-}
-
-// Backup all files in a directory with compression
-func backup(directory, output string) error {
-	outFile, err := os.Create(output)
+	if recorded.Name != algorithm.Name && *action != "rehash" {
+		fatal(fmt.Sprintf("The config file selects hash %s, but stored files are addressed by %s; run -action rehash to convert them", algorithm.Name, recorded.Name))
+	}
+	if len(cfg.Policies) > 0 {
+		// Validated by loadConfig
+		contentPolicy, _ := policy.New(cfg.Policies)
+		opts.Admit = contentPolicy.Admit(metadata, events)
+	}
+	backend, err := store.OpenBackend(cfg.Storage.Backend, cfg.Storage.Settings, repoRoot, opts)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		fatal("Failed to open storage: ", err)
 	}
-	defer func(outFile *os.File) {
-		err := outFile.Close()
+	blobs := store.New(backend, metadata, algorithm, opts)
+	blobs.SetConcurrency(*workers, cfg.Storage.IOConcurrency)
+	blobs.SetThawDays(cfg.Storage.ThawDays)
+	for _, name := range cfg.Processors {
+		processor, err := store.LookupProcessor(name)
 		if err != nil {
-			fmt.Printf("Failed to close output file: %v\n", err)
+			fatal("Failed to set up processors: ", err)
 		}
-	}(outFile)
+		blobs.AddProcessor(processor)
+	}
+	if cfg.Scan.Address != "" {
+		// Validated by loadConfig
+		timeout, _ := time.ParseDuration(cfg.Scan.Timeout)
+		scanner, _ := scan.New(cfg.Scan.Address, timeout)
+		blobs.SetScanner(store.ScanOptions{Scanner: scanner, Policy: cfg.Scan.Policy, Quarantine: store.NewLocal(repoPath(infectedDir), opts)})
+	}
+	parityStore := store.NewLocal(repoPath(parityDir), opts)
+	// Validated by loadConfig
+	notifier, _ := notify.New(filepath.Base(repoRoot), cfg.Notifications.Targets)
+	if cfg.Parity.Overhead > 0 {
+		blobs.AddProcessor(store.ParityProcessor(parityStore, cfg.Parity.Overhead))
+	}
+	if cfg.Storage.ChunkMinSize > 0 {
+		blobs.AddProcessor(store.ChunkProcessor(cfg.Storage.ChunkMinSize))
+	}
 
-	gzipWriter := gzip.NewWriter(outFile)
-	defer func(gzipWriter *gzip.Writer) {
-		err := gzipWriter.Close()
-		if err != nil {
-			fmt.Printf("Failed to close gzip writer: %v\n", err)
+	// Failed and interrupted operations are recorded in the action log
+	// before exiting
+	start := time.Now()
+	fail := func(message string, err error) {
+		err = abortError(ctx, err)
+		logErr := db.RecordAction(context.WithoutCancel(ctx), metadata, db.Action{
+			ActionType: *action,
+			Filename:   *input,
+			Duration:   time.Since(start),
+			Err:        err,
+		})
+		if logErr != nil {
+			fmt.Printf("Failed to record failure in action log: %v\n", logErr)
+		}
+		if errors.Is(err, context.Canceled) {
+			events.Finish()
+			repoLock.Release()
+			log.Printf("%s: %v", message, context.Cause(ctx))
+			os.Exit(130)
 		}
-	}(gzipWriter)
+		fatal(message+": ", err)
+	}
 
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer func(tarWriter *tar.Writer) {
-		err := tarWriter.Close()
-		if err != nil {
-			fmt.Printf("Failed to close tar writer: %v\n", err)
+	// Select files by the -type, -where, -taken-before, -taken-after and
+	// -match flags
+	versionFilter := func() db.VersionFilter {
+		filter := db.VersionFilter{ContentType: *contentType, Match: *match}
+		var err error
+		if *where != "" {
+			if filter.Meta, err = db.ParseMeta(strings.Split(*where, ",")); err != nil {
+				fatal("Invalid -where: ", err)
+			}
 		}
-	}(tarWriter)
+		if *takenBefore != "" {
+			if filter.TakenBefore, err = content.ParseTaken(*takenBefore); err != nil {
+				fatal("Invalid -taken-before: ", err)
+			}
+		}
+		if *takenAfter != "" {
+			if filter.TakenAfter, err = content.ParseTaken(*takenAfter); err != nil {
+				fatal("Invalid -taken-after: ", err)
+			}
+		}
+		return filter
+	}
 
-	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+	switch *action {
+	case "store":
+		if *input == "" {
+			fatal("Please provide -input for storing a file")
+		}
+		info, err := os.Stat(*input)
 		if err != nil {
-			return fmt.Errorf("error accessing file %s: %w", path, err)
+			fail("Error storing file", err)
+		}
+		var written int64
+		if info.IsDir() && *branch != "" {
+			fatal("Please provide -input with a single file for storing on a branch")
 		}
 		if info.IsDir() {
-			return nil
+			report, err := blobs.StoreDirectory(ctx, *input)
+			if err != nil {
+				fail("Error storing file", err)
+			}
+			report.Print()
+			written = report.BytesWritten
+			if !report.Complete() {
+				warnNotify(checkQuota(ctx, cfg, notifier, blobs, written))
+				repoLock.Release()
+				os.Exit(1)
+			}
+		} else {
+			result, err := blobs.StoreFileOnBranch(ctx, *input, *branch)
+			if err != nil {
+				fail("Error storing file", err)
+			}
+			written = result.BytesWritten
 		}
-
-		file, err := os.Open(path)
+		warnNotify(checkQuota(ctx, cfg, notifier, blobs, written))
+	case "retrieve":
+		if *input == "" {
+			fatal("Please provide -input with the name of a stored file")
+		}
+		name, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(*input))
 		if err != nil {
-			return fmt.Errorf("failed to open file %s: %w", path, err)
+			fail("Error retrieving file", err)
 		}
-		defer func(file *os.File) {
-			err := file.Close()
+		dest, actionType := *output, "retrieve"
+		if dest == "" {
+			// Without -output the file is rolled back where it was stored from
+			actionType = "rollback"
+			v, err := db.GetBranchVersion(ctx, metadata, name, *branch, *fileVersion)
 			if err != nil {
-				fmt.Printf("Failed to close file: %v\n", err)
+				fail("Error retrieving file", err)
 			}
-		}(file)
-
-		header, err := tar.FileInfoHeader(info, info.Name())
+			if !filepath.IsAbs(filepath.FromSlash(v.Path)) {
+				fatal("Please provide -output; the original location of " + *input + " is unknown")
+			}
+			dest = filepath.FromSlash(v.Path)
+		}
+		blobs.SetPreserveXattrs(*preserveXattrs)
+		v, err := blobs.RetrieveFromBranch(ctx, name, *branch, *fileVersion, dest)
 		if err != nil {
-			return fmt.Errorf("failed to create tar header for file %s: %w", path, err)
+			fail("Error retrieving file", err)
 		}
-
-		relativePath, err := filepath.Rel(directory, path)
+		if err := db.LogAction(ctx, metadata, actionType, v.Filename, store.StorageID(v)); err != nil {
+			fail("Error logging retrieve", err)
+		}
+		fmt.Printf("Retrieved %s version %d to %s\n", v.Filename, v.Version, dest)
+	case "cat":
+		refs, err := catRefs(*input)
 		if err != nil {
-			return fmt.Errorf("failed to calculate relative path for file %s: %w", path, err)
+			fatal(err)
 		}
-		header.Name = relativePath
-
-		err = tarWriter.WriteHeader(header)
+		if err := catVersions(ctx, blobs, metadata, refs, *branch, *fileVersion, os.Stdout); err != nil {
+			fatal("Error printing file: ", err)
+		}
+	case "open":
+		if *input == "" {
+			fatal("Please provide -input with the name of a stored file, e.g. report.docx@3")
+		}
+		if err := openVersion(ctx, blobs, metadata, *input, *branch, *fileVersion); err != nil {
+			fatal("Error opening file: ", err)
+		}
+	case "mount":
+		args, err := commandArgs()
 		if err != nil {
-			return fmt.Errorf("failed to write tar header for file %s: %w", path, err)
+			fatal(err)
 		}
-
-		_, err = io.Copy(tarWriter, file)
+		if len(args) != 1 {
+			fatal("Please provide the directory to mount the repository on, e.g. -action mount /mnt/fm")
+		}
+		if err := mountRepository(ctx, blobs, args[0]); err != nil {
+			fail("Error mounting repository", err)
+		}
+	case "deduplicate":
+		if *input == "" {
+			fatal("Please provide a directory for deduplication using -input")
+		}
+		report, err := dedup.Files(ctx, *input, algorithm, metadata, opts)
 		if err != nil {
-			return fmt.Errorf("failed to write file %s to tar archive: %w", path, err)
+			fail("Error during deduplication", err)
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		return fmt.Errorf("failed to create backup: %w", err)
-	}
-
-	return nil
-}
-
-// Restore files from a compressed archive
-func restore(archive, targetDir string) error {
-	// Open the archive file
-	inFile, err := os.Open(archive)
-	if err != nil {
-		return fmt.Errorf("failed to open archive file: %w", err)
-	}
-	defer func(inFile *os.File) {
-		err := inFile.Close()
+		report.Print()
+	case "compress":
+		if *input == "" {
+			fatal("Please provide -input for compression")
+		}
+		codec, err := archive.LookupCodec(cfg.Compression)
 		if err != nil {
-			fmt.Printf("Failed to close archive file: %v\n", err)
+			fatal("Invalid compression in config file: ", err)
 		}
-	}(inFile)
-
-	// Create a gzip reader
-	gzipReader, err := gzip.NewReader(inFile)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
-	}
-	defer func(gzipReader *gzip.Reader) {
-		err := gzipReader.Close()
+		if err := archive.Compress(ctx, *input, repoPath(compressedDir), codec, opts); err != nil {
+			fail("Error compressing file", err)
+		}
+	case "decompress":
+		if *input == "" || *output == "" {
+			fatal("Please provide -input and -output for decompression")
+		}
+		if err := archive.Decompress(ctx, *input, *output, opts); err != nil {
+			fail("Error decompressing file", err)
+		}
+	case "backup":
+		if *input == "" || *output == "" {
+			fatal("Please provide -input directory and -output file for backup")
+		}
+		var summary *archive.BackupSummary
+		err := withHooks(ctx, cfg, "backup", *input, *output, func() error {
+			var err error
+			summary, err = archive.BackupOnce(ctx, metadata, *input, *output, opts)
+			return err
+		})
+		events.Finish()
 		if err != nil {
-			fmt.Printf("Failed to close gzip reader: %v\n", err)
+			warnNotify(notifier.Backup(context.WithoutCancel(ctx), *input, *output, summary, err))
+			if errors.Is(err, context.Canceled) {
+				resumeHint(*output)
+			}
+			fail("Error creating backup", err)
 		}
-	}(gzipReader)
-
-	// Create a tar reader
-	tarReader := tar.NewReader(gzipReader)
-
-	// Extract files
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break // End of archive
+		summary.Print()
+		warnNotify(notifier.Backup(ctx, *input, *output, summary, nil))
+		if !summary.Complete() {
+			repoLock.Release()
+			os.Exit(1)
+		}
+	case "restore":
+		if *input == "" || *output == "" {
+			fatal("Please provide -input backup file and -output directory for restoration")
 		}
+		// Entries named after the flags are restored alone, using the index
+		entries, err := commandArgs()
 		if err != nil {
-			return fmt.Errorf("failed to read tar header: %w", err)
+			fatal(err)
 		}
-
-		// Construct the target path
-		targetPath := filepath.Join(targetDir, header.Name)
-
-		// Check the type of the header
-		switch header.Typeflag {
-		case tar.TypeDir: // Directory
-			if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
-			}
-		case tar.TypeReg: // Regular file
-			// Ensure the parent directory exists
-			if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
-				return fmt.Errorf("failed to create directory for file %s: %w", targetPath, err)
+		policy, err := archive.ParseCollisionPolicy(*collisionPolicy)
+		if err != nil {
+			fatal("Invalid -collisions: ", err)
+		}
+		var report *archive.RestoreReport
+		err = withHooks(ctx, cfg, "restore", *input, *output, func() error {
+			var err error
+			if len(entries) > 0 {
+				report, err = archive.RestoreEntries(ctx, *input, entries, fsutil.DirFS(*output), policy, opts)
+				return err
 			}
-
-			// Create the file
-			outFile, err := os.Create(targetPath)
+			report, err = archive.Restore(ctx, *input, *output, *workers, policy, opts)
+			return err
+		})
+		if report != nil {
+			report.Print()
+		}
+		if err != nil {
+			fail("Error restoring backup", err)
+		}
+		if err := db.RecordAction(ctx, metadata, db.Action{ActionType: "restore", Filename: *input, StorageID: *output, Duration: time.Since(start)}); err != nil {
+			fail("Error logging restore", err)
+		}
+	case "index":
+		if *input == "" {
+			fatal("Please provide -input with the backup file to index")
+		}
+		index, err := archive.BuildIndex(ctx, *input, opts)
+		if err != nil {
+			fail("Error indexing backup", err)
+		}
+		fmt.Printf("Indexed %d entries of %s\n", len(index.Entries), *input)
+	case "prune":
+		policy := archive.RetentionPolicy{
+			KeepLast:    *keepLast,
+			KeepDaily:   *keepDaily,
+			KeepWeekly:  *keepWeekly,
+			KeepMonthly: *keepMonthly,
+		}
+		report, err := archive.Prune(ctx, metadata, policy, *dryRun)
+		report.Print()
+		if err != nil {
+			fail("Error pruning backups", err)
+		}
+	case "diff":
+		if *input == "" || *output == "" {
+			fatal("Please provide -input backup file and -output directory to compare against")
+		}
+		report, err := archive.Diff(ctx, *input, *output, algorithm, opts)
+		if err != nil {
+			fail("Error comparing backup", err)
+		}
+		report.Print()
+		if !report.Clean() {
+			os.Exit(1)
+		}
+	case "db-export":
+		out := os.Stdout
+		if *output != "" {
+			out, err = os.Create(*output)
 			if err != nil {
-				return fmt.Errorf("failed to create file %s: %w", targetPath, err)
+				fail("Error creating export file", err)
 			}
-			func(outFile *os.File) {
-				err := outFile.Close()
+			defer func(out *os.File) {
+				err := out.Close()
 				if err != nil {
-					fmt.Printf("Failed to close file: %v\n", err)
+					fmt.Printf("Failed to close export file: %v\n", err)
 				}
-			}(outFile)
-
-			// Copy file content
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return fmt.Errorf("failed to extract file %s: %w", targetPath, err)
+			}(out)
+		}
+		if err := db.ExportHistory(ctx, metadata, defaultString(*format, "jsonl"), out); err != nil {
+			if *output != "" {
+				// fail exits without running the deferred close
+				_ = out.Close()
+				removePartial(*output)
 			}
-		default:
-			return fmt.Errorf("unsupported header type: %c in %s", header.Typeflag, header.Name)
+			fail("Error exporting history", err)
 		}
-	}
-
-	return nil
-}
-
-func main() {
-	action := flag.String("action", "", "Action to perform: store, deduplicate, compress, backup, restore")
-	input := flag.String("input", "", "Input file/directory")
-	output := flag.String("output", "", "Output file/directory")
-	flag.Parse()
-
-	db, err := initDB()
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
-	}
-	defer func(db *sql.DB) {
-		err := db.Close()
+	case "db-import":
+		if *input == "" {
+			fatal("Please provide -input file to import history from")
+		}
+		in, err := os.Open(*input)
 		if err != nil {
-			fmt.Printf("Failed to close database: %v\n", err)
+			fail("Error opening import file", err)
 		}
-	}(db)
-
-	switch *action {
-	case "store":
+		defer func(in *os.File) {
+			err := in.Close()
+			if err != nil {
+				fmt.Printf("Failed to close import file: %v\n", err)
+			}
+		}(in)
+		count, err := db.ImportHistory(ctx, metadata, defaultString(*format, "jsonl"), in)
+		if err != nil {
+			fail("Error importing history", err)
+		}
+		fmt.Printf("Imported %d records\n", count)
+	case "db-merge":
 		if *input == "" {
-			log.Fatal("Please provide -input for storing a file")
+			fatal("Please provide -input database file or directory to search for stray databases")
 		}
-		if _, err := storeFile(*input, db); err != nil {
-			log.Fatalf("Error storing file: %v", err)
+		if err := mergeStrayDatabases(ctx, metadata, blobs, algorithm, *input, *dryRun); err != nil {
+			fail("Error merging databases", err)
 		}
-	case "deduplicate":
-		if *input == "" {
-			log.Fatal("Please provide a directory for deduplication using -input")
+	case "repo-merge":
+		if err := mergeRepository(ctx, metadata, blobs, *input, *conflicts, *wait, *workers, *dryRun, opts); err != nil {
+			fail("Error merging repository", err)
 		}
-		if err := deduplicateFiles(*input, db); err != nil {
-			log.Fatalf("Error during deduplication: %v", err)
+	case "history":
+		name, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(*input))
+		if err != nil {
+			fail("Error reading history", err)
 		}
-	case "compress":
+		if *drawGraph {
+			if name == "" {
+				fail("Error drawing history", errors.New("please provide -input with the name of a stored file"))
+			}
+			if err := graph.Write(ctx, os.Stdout, metadata, name, *format); err != nil {
+				fail("Error drawing history", err)
+			}
+			break
+		}
+		actions, err := db.ListActions(ctx, metadata, name, *limit)
+		if err != nil {
+			fail("Error reading history", err)
+		}
+		printActions(actions)
+	case "list":
+		versions, err := db.ListLatestVersions(ctx, metadata, versionFilter())
+		if err != nil {
+			fail("Error listing files", err)
+		}
+		printVersions(versions)
+	case "search":
+		args, err := commandArgs()
+		if err != nil {
+			fatal(err)
+		}
+		if len(args) == 0 {
+			fatal("Please provide the words to search for, e.g. -action search \"invoice 2024\"")
+		}
+		results, err := db.Search(ctx, metadata, strings.Join(args, " "), *limit)
+		if err != nil {
+			fail("Error searching", err)
+		}
+		printSearch(results)
+	case "adopt":
 		if *input == "" {
-			log.Fatal("Please provide -input for compression")
+			fatal("Please provide -input with the directory to adopt")
 		}
-		if err := compressFile(*input, compressedDir); err != nil {
-			log.Fatalf("Error compressing file: %v", err)
+		report, err := blobs.Adopt(ctx, *input, *copyBlobs)
+		if err != nil {
+			fail("Error adopting directory", err)
 		}
-	case "decompress":
-		if *input == "" || *output == "" {
-			log.Fatal("Please provide -input and -output for decompression")
+		report.Print()
+	case "import":
+		args, err := commandArgs()
+		if err != nil {
+			fatal(err)
 		}
-		if err := decompressFile(*input, *output); err != nil {
-			log.Fatalf("Error decompressing file: %v", err)
+		history, err := importHistory(args)
+		if err != nil {
+			fatal(err)
 		}
-	case "backup":
-		if *input == "" || *output == "" {
-			log.Fatal("Please provide -input directory and -output file for backup")
+		report, err := importer.Import(ctx, blobs, history)
+		if err != nil {
+			fail("Error importing history", err)
 		}
-		if err := backup(*input, *output); err != nil {
-			log.Fatalf("Error creating backup: %v", err)
+		report.Print()
+	case "checksums":
+		if err := exportRepositorySums(ctx, metadata, blobs, recorded, *output, *hashName); err != nil {
+			fail("Error exporting checksums", err)
 		}
-	case "restore":
-		if *input == "" || *output == "" {
-			log.Fatal("Please provide -input backup file and -output directory for restoration")
+	case "meta":
+		args, err := commandArgs()
+		if err != nil {
+			fatal(err)
+		}
+		var filter *db.VersionFilter
+		if *match != "" {
+			f := versionFilter()
+			filter = &f
+		}
+		if err := runMeta(ctx, metadata, args, filter, *dryRun); err != nil {
+			fail("Error updating metadata", err)
+		}
+	case "branch":
+		args, err := commandArgs()
+		if err != nil {
+			fatal(err)
+		}
+		if err := runBranch(ctx, metadata, args); err != nil {
+			fail("Error updating branches", err)
+		}
+	case "alias":
+		args, err := commandArgs()
+		if err != nil {
+			fatal(err)
+		}
+		if err := runAlias(ctx, metadata, args); err != nil {
+			fail("Error updating aliases", err)
+		}
+	case "hold":
+		args, err := commandArgs()
+		if err != nil {
+			fatal(err)
+		}
+		if err := runHold(ctx, metadata, cfg.Server.Users, args, *match); err != nil {
+			fail("Error updating legal holds", err)
+		}
+	case "retention":
+		args, err := commandArgs()
+		if err != nil {
+			fatal(err)
 		}
-		if err := restore(*input, *output); err != nil {
-			log.Fatalf("Error restoring backup: %v", err)
+		if err := runRetention(ctx, metadata, args); err != nil {
+			fail("Error updating retention", err)
 		}
+	case "report":
+		result, err := db.RunReport(ctx, metadata, *reportName, *limit)
+		if err != nil {
+			fail("Error running report", err)
+		}
+		if err := renderReport(result, os.Stdout, defaultString(*format, "table")); err != nil {
+			fail("Error rendering report", err)
+		}
+	case "stats":
+		if err := runStats(ctx, metadata, blobs, *statsHistory, *format); err != nil {
+			fail("Error reading statistics", err)
+		}
+	case "audit-export":
+		keyPath := repoPath(defaultString(cfg.Audit.SigningKey, defaultAuditKey))
+		if *output == "" {
+			fail("Error exporting audit log", errors.New("please provide -output for the report"))
+		}
+		signature, err := audit.Export(ctx, metadata, repoRoot, keyPath, *since, *until, *format, *output)
+		if err != nil {
+			fail("Error exporting audit log", err)
+		}
+		fmt.Printf("Exported %d actions to %s, signed in %s.sig by key %s\n", signature.Entries, *output, *output, signature.Signer())
+		if err := db.LogAction(ctx, metadata, "audit_export", *output, ""); err != nil {
+			fail("Error logging action", err)
+		}
+	case "lifecycle":
+		report, err := blobs.ApplyLifecycle(ctx, cfg.Storage.lifecycle(), *dryRun)
+		if report != nil {
+			report.Print()
+		}
+		if err != nil {
+			fail("Error applying storage lifecycle", err)
+		}
+	case "thaw":
+		name, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(*input))
+		if err != nil {
+			fail("Error thawing file", err)
+		}
+		v, err := db.GetBranchVersion(ctx, metadata, name, *branch, *fileVersion)
+		if err != nil {
+			fail("Error thawing file", err)
+		}
+		if err := blobs.Thaw(ctx, store.StorageID(v)); err != nil {
+			fail("Error thawing file", err)
+		}
+		fmt.Printf("Requested a thaw of %s version %d; retrieve it once the thaw completes\n", v.Filename, v.Version)
+	case "rehash":
+		if recorded.Name == algorithm.Name {
+			fmt.Printf("Stored files are already addressed by %s\n", algorithm.Name)
+			return
+		}
+		report, err := blobs.Rehash(ctx, recorded)
+		if err != nil {
+			fail("Error rehashing stored files", err)
+		}
+		report.Print()
+	case "repack":
+		report, err := blobs.Repack(ctx, *deltaBlobs)
+		report.Print()
+		if err != nil {
+			fail("Error repacking stored files", err)
+		}
+		var packMaxSize int64
+		if *packBlobs {
+			packMaxSize = cfg.Storage.PackMaxSize
+			if packMaxSize == 0 {
+				packMaxSize = store.DefaultPackMaxSize
+			}
+		}
+		packReport, err := blobs.Pack(ctx, packMaxSize)
+		packReport.Print()
+		if err != nil {
+			fail("Error packing stored files", err)
+		}
+	case "chunk":
+		// Without chunking configured, blobs are chunked from the default size
+		minSize := cfg.Storage.ChunkMinSize
+		if minSize == 0 {
+			minSize = store.DefaultChunkMinSize
+		}
+		if *joinChunks {
+			minSize = 0
+		}
+		report, err := blobs.Chunk(ctx, minSize)
+		report.Print()
+		if err != nil {
+			fail("Error chunking stored files", err)
+		}
+	case "verify", "scrub":
+		vopts, err := verifyOptions(*repair, *replica, opts)
+		if err != nil {
+			fatal("Invalid -repair: ", err)
+		}
+		if *action == "scrub" {
+			vopts.Fraction = cfg.Scrub.Fraction
+		}
+		vopts.Parity = parityStore
+		report, err := blobs.Verify(ctx, vopts)
+		report.Print()
+		warnNotify(notifier.Corruption(context.WithoutCancel(ctx), *action, report))
+		if err != nil {
+			fail("Error verifying storage", err)
+		}
+		if len(report.Repaired) > 0 || len(report.Quarantined) > 0 {
+			if err := db.RecordAction(ctx, metadata, db.Action{ActionType: *action, Filename: *repair, Duration: time.Since(start)}); err != nil {
+				fail("Error logging "+*action, err)
+			}
+		}
+		if !report.Clean() {
+			repoLock.Release()
+			os.Exit(1)
+		}
+	case "fsck":
+		if *input != "" {
+			plan, err := readRepairPlan(*input)
+			if err != nil {
+				fail("Error reading repair plan", err)
+			}
+			if *dryRun {
+				plan.Print()
+				return
+			}
+			report, err := blobs.ApplyPlan(ctx, plan)
+			report.Print()
+			if err != nil {
+				fail("Error applying repair plan", err)
+			}
+			return
+		}
+		report, err := blobs.Fsck(ctx, store.FsckOptions{Adopt: *adopt, Split: *split, Normalize: *normalizeNames, DryRun: *dryRun})
+		report.Print()
+		if err != nil {
+			fail("Error checking repository", err)
+		}
+		if *output != "" {
+			if err := writeRepairPlan(*output, report.Plan); err != nil {
+				fail("Error writing repair plan", err)
+			}
+			fmt.Printf("Wrote repair plan to %s; review it, then apply it with -action fsck -input %s\n", *output, *output)
+		}
+		if !report.Clean() {
+			repoLock.Release()
+			os.Exit(1)
+		}
+	case "parity":
+		if cfg.Parity.Overhead == 0 {
+			fatal("Parity is disabled; set parity.overhead in the config file")
+		}
+		count, err := blobs.WriteMissingParity(ctx, parityStore, cfg.Parity.Overhead)
+		if err != nil {
+			fail("Error writing parity", err)
+		}
+		fmt.Printf("Wrote parity for %d blobs\n", count)
+	case "serve":
+		if len(cfg.Server.Repositories) > 0 {
+			if err := serveTenants(ctx, cfg, *listen, *wait, *workers, opts); err != nil {
+				fail("Error serving API", err)
+			}
+			return
+		}
+		api := server.New(blobs, metadata, algorithm, opts)
+		api.SetNotifier(notifier)
+		api.SetQuota(cfg.Server.QuotaBytes)
+		api.SetUploadDir(repoPath(uploadsDir))
+		api.ConfineJobs(repoPath(defaultString(cfg.Server.JobRoot, ".")))
+		api.SetShutdownGrace(shutdownGrace(cfg))
+		if err := api.SetUsers(cfg.Server.Users); err != nil {
+			fatal("Invalid server.users: ", err)
+		}
+		if len(cfg.Server.Users) == 0 {
+			for _, addr := range []string{*listen, *grpcListen} {
+				if addr != "" && !loopback(addr) {
+					fatal(fmt.Sprintf("Refusing to serve %s without server.users: anyone who can reach it would have full access; configure users or listen on a loopback address", addr))
+				}
+			}
+			fmt.Println("Warning: no server.users configured; anyone who can reach the server has full access")
+		}
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			fail("Error serving API", err)
+		}
+		grpcErr := make(chan error, 1)
+		if *grpcListen != "" {
+			grpcListener, err := net.Listen("tcp", *grpcListen)
+			if err != nil {
+				fail("Error serving gRPC API", err)
+			}
+			fmt.Printf("Serving the gRPC API on %s\n", *grpcListen)
+			// Either API failing shuts down the other
+			serveCtx, stop := context.WithCancel(ctx)
+			defer stop()
+			go func() {
+				err := api.ServeGRPC(serveCtx, grpcListener)
+				stop()
+				grpcErr <- err
+			}()
+			ctx = serveCtx
+		} else {
+			grpcErr <- nil
+		}
+		fmt.Printf("Serving repository %s on %s\n", repoRoot, *listen)
+		serviceReady(ctx)
+		if err := api.Serve(ctx, listener); err != nil {
+			fail("Error serving API", err)
+		}
+		if err := <-grpcErr; err != nil {
+			fail("Error serving gRPC API", err)
+		}
+	case "daemon":
+		api := server.New(blobs, metadata, algorithm, opts)
+		api.SetNotifier(notifier)
+		api.SetParity(parityStore)
+		api.SetParallelism(cfg.Daemon.Parallelism)
+		api.SetPause(pause)
+		api.SetShutdownGrace(shutdownGrace(cfg))
+		if err := api.Schedule(cfg.Daemon.Schedule); err != nil {
+			fail("Error scheduling maintenance", err)
+		}
+		if err := runDaemon(ctx, api); err != nil {
+			fail("Error running daemon", err)
+		}
+	case "watch":
+		if *input == "" {
+			fatal("Please provide the directory to watch with -input")
+		}
+		wopts, err := watchOptions(cfg, *input, events)
+		if err != nil {
+			fatal("Invalid watch settings: ", err)
+		}
+		wopts.Guard.OnAnomaly = anomalyResponse(metadata, notifier, *input)
+		fmt.Printf("Watching %s for changes; press Ctrl-C to stop\n", *input)
+		report, err := watch.Run(ctx, blobs, *input, wopts)
+		events.Finish()
+		if err != nil {
+			fail("Error watching directory", err)
+		}
+		report.Print()
+	case "db-maintain":
+		report, err := db.Maintain(ctx, metadata)
+		report.Print()
+		if err != nil {
+			fail("Error maintaining database", err)
+		}
+		return
 	default:
-		fmt.Println("Invalid action. Use -action with one of: store, deduplicate, compress, backup, restore")
+		custom, ok := plugin.LookupAction(*action)
+		if !ok {
+			fmt.Println("Invalid action. Use -action with one of: " + actionList())
+			return
+		}
+		err := custom.Run(ctx, &plugin.Env{
+			Root:    repoRoot,
+			Store:   blobs,
+			DB:      metadata,
+			Input:   *input,
+			Output:  *output,
+			DryRun:  *dryRun,
+			Options: opts,
+		})
+		if err != nil {
+			fail("Error running "+*action, err)
+		}
+		if err := db.RecordAction(ctx, metadata, db.Action{ActionType: *action, Filename: *input, StorageID: *output, Duration: time.Since(start)}); err != nil {
+			fail("Error logging "+*action, err)
+		}
+	}
+
+	// Validated by loadConfig, so a parse error cannot happen here
+	if interval, _ := time.ParseDuration(cfg.Database.AutoMaintain); interval > 0 {
+		report, err := db.MaintainIfDue(ctx, metadata, interval)
+		if report != nil {
+			report.Print()
+		}
+		if err != nil {
+			fmt.Printf("Automatic database maintenance failed: %v\n", err)
+		}
 	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"sort"
+)
+
+// Run a meta subcommand: "set FILE KEY=VALUE...", "unset FILE [KEY...]"
+// or "get FILE", or "set KEY=VALUE..." and "unset [KEY...]" on every file
+// a filter selects
+func runMeta(ctx context.Context, metadata *db.DB, args []string, filter *db.VersionFilter, dryRun bool) error {
+	if filter != nil {
+		return runBulkMeta(ctx, metadata, args, *filter, dryRun)
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("usage: -action meta set FILE KEY=VALUE... | unset FILE [KEY...] | get FILE")
+	}
+	command, rest := args[0], args[2:]
+	filename, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(args[1]))
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "set":
+		if len(rest) == 0 {
+			return fmt.Errorf("meta set needs at least one KEY=VALUE")
+		}
+		meta, err := db.ParseMeta(rest)
+		if err != nil {
+			return err
+		}
+		if err := db.SetMeta(ctx, metadata, filename, meta); err != nil {
+			return err
+		}
+		fmt.Printf("Set %d metadata values on %s\n", len(meta), filename)
+	case "unset":
+		removed, err := db.UnsetMeta(ctx, metadata, filename, rest)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d metadata values from %s\n", removed, filename)
+	case "get":
+		meta, err := db.GetMeta(ctx, metadata, filename)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(meta))
+		for key := range meta {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s=%s\n", key, meta[key])
+		}
+	default:
+		return fmt.Errorf("unknown meta command %q (use set, unset, get)", command)
+	}
+	return nil
+}
+
+// Set or unset metadata of every file the filter selects in one
+// transaction, listing them
+func runBulkMeta(ctx context.Context, metadata *db.DB, args []string, filter db.VersionFilter, dryRun bool) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: -action meta -match PATTERN set KEY=VALUE... | unset [KEY...]")
+	}
+	command, rest := args[0], args[1:]
+	var meta map[string]string
+	switch command {
+	case "set":
+		if len(rest) == 0 {
+			return fmt.Errorf("meta set needs at least one KEY=VALUE")
+		}
+		var err error
+		if meta, err = db.ParseMeta(rest); err != nil {
+			return err
+		}
+	case "unset":
+	default:
+		return fmt.Errorf("unknown meta command %q with -match (use set, unset)", command)
+	}
+
+	versions, err := db.ListLatestVersions(ctx, metadata, filter)
+	if err != nil {
+		return err
+	}
+	filenames := make([]string, len(versions))
+	for i, v := range versions {
+		filenames[i] = v.Filename
+		fmt.Println(v.Filename)
+	}
+	verb := map[string]string{"set": "Set", "unset": "Removed"}[command]
+	if dryRun {
+		verb = map[string]string{"set": "Would set", "unset": "Would remove"}[command]
+	}
+
+	if command == "set" {
+		if !dryRun {
+			if err := db.SetMetaAll(ctx, metadata, filenames, meta); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%s %d metadata values on %d files\n", verb, len(meta), len(filenames))
+		return nil
+	}
+	var removed int
+	if dryRun {
+		for _, filename := range filenames {
+			values, err := db.GetMeta(ctx, metadata, filename)
+			if err != nil {
+				return err
+			}
+			if len(rest) == 0 {
+				removed += len(values)
+				continue
+			}
+			for _, key := range rest {
+				if _, ok := values[key]; ok {
+					removed++
+				}
+			}
+		}
+	} else if removed, err = db.UnsetMetaAll(ctx, metadata, filenames, rest); err != nil {
+		return err
+	}
+	fmt.Printf("%s %d metadata values from %d files\n", verb, removed, len(filenames))
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/mount"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"time"
+)
+
+// Mount the versions and backup snapshots of the repository read-only on
+// dir until the process is interrupted or the mount is detached
+func mountRepository(ctx context.Context, blobs *store.Store, dir string) error {
+	fsys, err := blobs.MountFS(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := mount.Serve(fsys, dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Mounted the repository on %s; press Ctrl-C to unmount\n", dir)
+	unmounted := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(unmounted)
+	}()
+	select {
+	case <-unmounted:
+		return nil
+	case <-ctx.Done():
+	}
+	// Files still open keep it mounted until they are closed
+	for {
+		err := m.Unmount()
+		if err == nil {
+			<-unmounted
+			return nil
+		}
+		fmt.Printf("Waiting for the files open under %s to be closed: %v\n", dir, err)
+		select {
+		case <-unmounted:
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
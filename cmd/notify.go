@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/notify"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+)
+
+// Warn about notifications that could not be sent; the action they report
+// on is not failed by them
+func warnNotify(err error) {
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// Notify when storing written bytes took the storage past the configured
+// quota or its warning threshold
+func checkQuota(ctx context.Context, cfg *config, notifier *notify.Notifier, blobs *store.Store, written int64) error {
+	quota := cfg.Notifications.Quota
+	if quota.Bytes == 0 || written == 0 {
+		return nil
+	}
+	used, err := blobs.Usage(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to measure storage usage: %w", err)
+	}
+	return notifier.Quota(ctx, quota, used-written, used)
+}
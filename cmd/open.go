@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// openGrace is how long a version opened without a terminal to wait on is
+// kept for the application to read it
+const openGrace = 30 * time.Second
+
+// Copy the referenced version into a temporary directory and open it with
+// the default application
+func openVersion(ctx context.Context, blobs *store.Store, metadata *db.DB, ref, branch string, n int) error {
+	v, err := resolveVersion(ctx, metadata, ref, branch, n)
+	if err != nil {
+		return err
+	}
+	return openCopy(ctx, v.Filename, func(dest string) (int, error) {
+		_, err := blobs.Retrieve(ctx, v.Filename, v.Version, dest)
+		return v.Version, err
+	})
+}
+
+// Write a version of name to a temporary file with retrieve, which returns
+// the version written, and open it with the default application. The copy
+// is read-only, so that changes are not made to it by mistake, and removed
+// once the user presses Enter, or after openGrace when standard input
+// ends, or when the process is interrupted.
+func openCopy(ctx context.Context, name string, retrieve func(dest string) (int, error)) error {
+	dir, err := os.MkdirTemp("", "fm-open-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() {
+		// Applications may still hold the file open on Windows
+		if err := os.RemoveAll(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove the temporary copy: %v\n", err)
+		}
+	}()
+
+	retrieved := filepath.Join(dir, "retrieved")
+	n, err := retrieve(retrieved)
+	if err != nil {
+		return err
+	}
+	// Named after the version, so that the application shows which it is
+	base := path.Base(name)
+	ext := path.Ext(base)
+	dest := filepath.Join(dir, fmt.Sprintf("%s (version %d)%s", base[:len(base)-len(ext)], n, ext))
+	if err := os.Rename(retrieved, dest); err != nil {
+		return err
+	}
+	if err := os.Chmod(dest, 0o444); err != nil {
+		return err
+	}
+	if err := openCommand(dest).Run(); err != nil {
+		return fmt.Errorf("failed to open %s with the default application: %w", dest, err)
+	}
+
+	fmt.Printf("Opened %s; press Enter to remove the copy\n", dest)
+	entered := make(chan error, 1)
+	go func() {
+		_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		entered <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-entered:
+		if err == nil {
+			return nil
+		}
+	}
+	// Standard input is not a terminal to wait on
+	select {
+	case <-ctx.Done():
+	case <-time.After(openGrace):
+	}
+	return nil
+}
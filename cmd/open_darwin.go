@@ -0,0 +1,8 @@
+package main
+
+import "os/exec"
+
+// Return the command opening path with its default application
+func openCommand(path string) *exec.Cmd {
+	return exec.Command("open", path)
+}
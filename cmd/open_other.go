@@ -0,0 +1,11 @@
+//go:build !darwin && !windows
+
+package main
+
+import "os/exec"
+
+// Return the command opening path with its default application, as
+// configured for the desktop through xdg-utils
+func openCommand(path string) *exec.Cmd {
+	return exec.Command("xdg-open", path)
+}
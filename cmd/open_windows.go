@@ -0,0 +1,9 @@
+package main
+
+import "os/exec"
+
+// Return the command opening path with its default application. The empty
+// argument is the window title start takes first when quoted.
+func openCommand(path string) *exec.Cmd {
+	return exec.Command("cmd", "/c", "start", "", path)
+}
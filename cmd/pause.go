@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// Toggle pausing whenever a pause signal arrives, until ctx is cancelled.
+// toggle reports whether the operation is now paused.
+func handlePause(ctx context.Context, signals <-chan os.Signal, toggle func() (bool, error)) {
+	if signals == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-signals:
+			case <-ctx.Done():
+				return
+			}
+			paused, err := toggle()
+			switch {
+			case err != nil:
+				log.Printf("Failed to pause or resume: %v", err)
+			case paused:
+				log.Printf("Paused; %s (pid %d)", pauseHint, os.Getpid())
+			default:
+				log.Printf("Resumed")
+			}
+		}
+	}()
+}
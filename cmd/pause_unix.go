@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// pauseHint tells how to resume a paused operation
+const pauseHint = "send SIGUSR1 again to resume"
+
+// Return the signals that pause or resume the running operation
+func pauseSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	return signals
+}
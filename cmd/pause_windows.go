@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// pauseHint tells how to resume a paused operation
+const pauseHint = "run -action jobs resume on a daemon job to resume"
+
+// Return the signals that pause or resume the running operation. Windows
+// has none, so only daemon jobs can be paused, with -action jobs pause.
+func pauseSignals() <-chan os.Signal {
+	return nil
+}
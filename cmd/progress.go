@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"io"
+	"os"
+	"sync"
+)
+
+// console prints operation events for the user. Backup progress is only
+// shown when stderr is a terminal, on a single line that is rewritten.
+type console struct {
+	mu       sync.Mutex
+	progress bool // a progress line is waiting for its newline
+	terminal bool
+
+	// out is where events are printed: stdout, unless that carries file
+	// contents
+	out io.Writer
+}
+
+func newConsole() *console {
+	info, err := os.Stderr.Stat()
+	return &console{terminal: err == nil && info.Mode()&os.ModeCharDevice != 0, out: os.Stdout}
+}
+
+func (c *console) OnFileStored(e event.FileStored) {
+	c.println(fmt.Sprintf("File stored as %s", e.Path))
+}
+
+func (c *console) OnDuplicateFound(e event.DuplicateFound) {
+	if e.Op == "deduplicate" {
+		c.println(fmt.Sprintf("Duplicate found: %s (original: %s). Deleting...", e.Name, e.Original))
+		return
+	}
+	c.println(fmt.Sprintf("File %s already exists as %s. Skipping storage.", e.Name, e.Original))
+}
+
+func (c *console) OnBackupProgress(e event.BackupProgress) {
+	if !c.terminal {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "\rBacked up %d files, %d bytes", e.Files, e.Bytes)
+	c.progress = true
+}
+
+func (c *console) OnError(e event.Error) {
+	c.println(fmt.Sprintf("Warning: %s %s: %v", e.Op, e.Name, e.Err))
+}
+
+// Print a line, ending the progress line first
+func (c *console) println(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finishProgress()
+	fmt.Fprintln(c.out, line)
+}
+
+// Finish ends the progress line, if one is shown
+func (c *console) Finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finishProgress()
+}
+
+func (c *console) finishProgress() {
+	if c.progress {
+		fmt.Fprintln(os.Stderr)
+		c.progress = false
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/client"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// remoteActions are the actions -remote supports
+const remoteActions = "store, retrieve, cat, open"
+
+// Run an action against the server at serverURL instead of a local
+// repository, authenticating with the token in $FM_TOKEN
+func runRemote(ctx context.Context, serverURL, action, input, output string, version int) error {
+	c, err := client.New(serverURL, os.Getenv("FM_TOKEN"))
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "store":
+		if input == "" {
+			return errors.New("please provide -input for storing a file")
+		}
+		info, err := os.Stat(input)
+		if err != nil {
+			return fmt.Errorf("error storing file: %w", err)
+		}
+		if !info.IsDir() {
+			result, err := c.StoreFile(ctx, input, filepath.Base(input))
+			if err != nil {
+				return fmt.Errorf("error storing file: %w", err)
+			}
+			printRemoteStore(result)
+			return nil
+		}
+		// Files are named by their path within the directory, as locally
+		report := &store.StoreReport{Source: input}
+		err = filepath.WalkDir(input, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(input, name)
+			if err != nil {
+				return err
+			}
+			result, err := c.StoreFile(ctx, name, filepath.ToSlash(rel))
+			if err != nil {
+				return fmt.Errorf("failed to store %s: %w", name, err)
+			}
+			printRemoteStore(result)
+			if result.Duplicate {
+				report.Duplicates++
+			} else {
+				report.Stored++
+				report.BytesWritten += result.BytesWritten
+			}
+			return nil
+		})
+		report.Print()
+		if err != nil {
+			return fmt.Errorf("error storing file: %w", err)
+		}
+	case "retrieve":
+		if input == "" {
+			return errors.New("please provide -input with the name of a stored file")
+		}
+		dest := output
+		if dest == "" {
+			dest = path.Base(input)
+		}
+		n, err := c.Retrieve(ctx, input, version, dest)
+		if err != nil {
+			return fmt.Errorf("error retrieving file: %w", err)
+		}
+		fmt.Printf("Retrieved %s version %d to %s\n", input, n, dest)
+	case "cat":
+		refs, err := catRefs(input)
+		if err != nil {
+			return err
+		}
+		return catRemote(ctx, c, refs, version, os.Stdout)
+	case "open":
+		if input == "" {
+			return errors.New("please provide -input with the name of a stored file")
+		}
+		name, n := splitVersionRef(input, version)
+		return openCopy(ctx, name, func(dest string) (int, error) {
+			return c.Retrieve(ctx, name, n, dest)
+		})
+	default:
+		return fmt.Errorf("-action %s is not supported with -remote (use %s)", action, remoteActions)
+	}
+	return nil
+}
+
+// Print the outcome of storing a file on the server
+func printRemoteStore(result *store.StoreResult) {
+	if result.Duplicate {
+		fmt.Printf("%s is already stored\n", result.Filename)
+		return
+	}
+	fmt.Printf("Stored %s as version %d\n", result.Filename, result.Version)
+}
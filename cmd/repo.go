@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/client"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/lock"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"github.com/Lenstack/file_manager_version/pkg/watch"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// repoRoot is the directory holding the config file, database and storage
+// of the repository in use. Relative repository paths resolve against it.
+var repoRoot = "."
+
+// Resolve a repository-relative path against the repository root
+func repoPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(repoRoot, name)
+}
+
+// Find the repository root: an explicit -repo directory, the FM_REPO
+// environment variable, or the nearest ancestor of the working directory
+// containing a config file. Without any of these the working directory is
+// used, as older versions did.
+func findRepoRoot(explicit string) (string, error) {
+	if explicit == "" {
+		explicit = os.Getenv("FM_REPO")
+	}
+	if explicit != "" {
+		root, err := filepath.Abs(explicit)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			return "", fmt.Errorf("repository %s: %w", root, err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("repository %s is not a directory", root)
+		}
+		return root, nil
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for dir := cwd; ; {
+		if _, err := os.Stat(filepath.Join(dir, configFile)); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return cwd, nil
+		}
+		dir = parent
+	}
+}
+
+// Create a repository in dir by writing a config file with the defaults
+func initRepo(dir, algorithm string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create repository directory: %w", err)
+	}
+
+	path := filepath.Join(dir, configFile)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if algorithm != "" {
+		if _, err := hash.Lookup(algorithm); err != nil {
+			return err
+		}
+		cfg.Hash = algorithm
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+
+	for _, sub := range []string{storageDir, compressedDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create %s: %w", sub, err)
+		}
+	}
+	return nil
+}
+
+// Return the hash algorithm addressing the repository's blobs, recording
+// configured as the repository's algorithm when none was recorded yet.
+// Repositories that stored files before algorithms were recorded use the
+// default.
+func repoHash(ctx context.Context, metadata *db.DB, configured string) (hash.Algorithm, error) {
+	name, err := db.Setting(ctx, metadata, db.HashAlgorithmSetting)
+	if err != nil {
+		return hash.Algorithm{}, fmt.Errorf("failed to read hash algorithm: %w", err)
+	}
+	if name == "" {
+		name = configured
+		legacy, err := db.HasVersions(ctx, metadata)
+		if err != nil {
+			return hash.Algorithm{}, err
+		}
+		if legacy {
+			name = hash.DefaultAlgorithm
+		}
+		if err := db.SetSetting(ctx, metadata, db.HashAlgorithmSetting, name); err != nil {
+			return hash.Algorithm{}, fmt.Errorf("failed to record hash algorithm: %w", err)
+		}
+	}
+	return hash.Lookup(name)
+}
+
+// repository is a repository opened beside the one in use, such as one of
+// those served together or one merged into it
+type repository struct {
+	root      string
+	cfg       *config
+	lock      *lock.Lock
+	metadata  *db.DB
+	algorithm hash.Algorithm
+	blobs     *store.Store
+}
+
+// Open the repository in dir, locking it for action like a repository used
+// on its own
+func openRepository(ctx context.Context, dir, action string, wait time.Duration, workers int, opts fsutil.Options) (r *repository, err error) {
+	root, err := filepath.Abs(repoPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	r = &repository{root: root}
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	if r.cfg, err = loadConfig(filepath.Join(root, configFile)); err != nil {
+		return nil, err
+	}
+	// Validated by loadConfig
+	opts.Retry, _ = r.cfg.Retry.policy(opts.Events())
+	if r.lock, err = lock.Acquire(ctx, filepath.Join(root, lockFile), action, wait, opts.Events()); err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", root, err)
+	}
+	if r.metadata, err = initDB(ctx, r.cfg, root, opts); err != nil {
+		return nil, fmt.Errorf("failed to initialize database of %s: %w", root, err)
+	}
+
+	// Validated by loadConfig
+	r.algorithm, _ = hash.Lookup(r.cfg.Hash)
+	recorded, err := repoHash(ctx, r.metadata, r.cfg.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if recorded.Name != r.algorithm.Name {
+		return nil, fmt.Errorf("the config file of %s selects hash %s, but stored files are addressed by %s; run -action rehash in it", root, r.algorithm.Name, recorded.Name)
+	}
+	backend, err := store.OpenBackend(r.cfg.Storage.Backend, r.cfg.Storage.Settings, root, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage of %s: %w", root, err)
+	}
+	r.blobs = store.New(backend, r.metadata, r.algorithm, opts)
+	r.blobs.SetConcurrency(workers, r.cfg.Storage.IOConcurrency)
+	r.blobs.SetThawDays(r.cfg.Storage.ThawDays)
+	for _, name := range r.cfg.Processors {
+		processor, err := store.LookupProcessor(name)
+		if err != nil {
+			return nil, err
+		}
+		r.blobs.AddProcessor(processor)
+	}
+	if r.cfg.Parity.Overhead > 0 {
+		r.blobs.AddProcessor(store.ParityProcessor(store.NewLocal(filepath.Join(root, parityDir), opts), r.cfg.Parity.Overhead))
+	}
+	if r.cfg.Storage.ChunkMinSize > 0 {
+		r.blobs.AddProcessor(store.ChunkProcessor(r.cfg.Storage.ChunkMinSize))
+	}
+	return r, nil
+}
+
+// Close the database of an opened repository and unlock it
+func (r *repository) Close() {
+	if r.metadata != nil {
+		if err := r.metadata.Close(); err != nil {
+			fmt.Printf("Failed to close database of %s: %v\n", r.root, err)
+		}
+	}
+	r.lock.Release()
+}
+
+// Merge the repository in dir into the one in use as MergeRepository
+// describes, logging the merge
+func mergeRepository(ctx context.Context, metadata *db.DB, blobs *store.Store, dir, conflicts string, wait time.Duration, workers int, dryRun bool, opts fsutil.Options) error {
+	if dir == "" {
+		return errors.New("please provide -input with the directory of the repository to merge")
+	}
+	other, err := openRepository(ctx, dir, "repo-merge", wait, workers, opts)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+	if own, err := filepath.Abs(repoRoot); err == nil && own == other.root {
+		return fmt.Errorf("%s is the repository itself", dir)
+	}
+
+	name := filepath.Base(other.root)
+	report, err := blobs.MergeRepository(ctx, other.blobs, store.MergeOptions{Conflicts: conflicts, Name: name, DryRun: dryRun})
+	if err != nil {
+		return err
+	}
+	report.Print()
+	if dryRun {
+		return nil
+	}
+	return db.RecordAction(ctx, metadata, db.Action{ActionType: "repo_merge", Filename: name, StorageID: other.root, Bytes: report.Bytes})
+}
+
+// Clone the repository src, a directory or a server URL, into dst. A dst
+// without a config file is created with the defaults and the hash algorithm
+// of src; give it one first to clone into other storage, such as S3. Local
+// sources stay locked while they are cloned.
+func cloneRepository(ctx context.Context, src, dst string, wait time.Duration, workers int, opts fsutil.Options) error {
+	if src == "" || dst == "" {
+		return errors.New("please provide -input with the repository to clone and -output with the directory to clone it into")
+	}
+	var snap *db.Snapshot
+	var open func(ctx context.Context, id string) (io.ReadCloser, error)
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		c, err := client.New(src, os.Getenv("FM_TOKEN"))
+		if err != nil {
+			return err
+		}
+		if snap, err = c.Snapshot(ctx); err != nil {
+			return fmt.Errorf("failed to read metadata of %s: %w", src, err)
+		}
+		open = c.OpenBlob
+	} else {
+		source, err := openRepository(ctx, src, "repo-clone", wait, workers, opts)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		if snap, err = db.ReadSnapshot(ctx, source.metadata); err != nil {
+			return fmt.Errorf("failed to read metadata of %s: %w", src, err)
+		}
+		open = source.blobs.OpenBlob
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, configFile)); errors.Is(err, os.ErrNotExist) {
+		if err := initRepo(dst, snap.Hash); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	target, err := openRepository(ctx, dst, "repo-clone", wait, workers, opts)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	report, err := target.blobs.Clone(ctx, src, snap, open)
+	if err != nil {
+		return err
+	}
+	report.Print()
+	return db.RecordAction(ctx, target.metadata, db.Action{ActionType: "repo_clone", Filename: filepath.Base(src), StorageID: src, Bytes: report.Bytes})
+}
+
+// Find stray databases left behind by running older versions from other
+// working directories. target may be a database file or a directory tree.
+func findStrayDatabases(target string) ([]string, error) {
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	own, err := filepath.Abs(repoPath(db.DefaultFile))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return nil, err
+		}
+		if abs == own {
+			return nil, fmt.Errorf("%s is the database of the repository itself", target)
+		}
+		return []string{abs}, nil
+	}
+
+	var found []string
+	err = filepath.WalkDir(target, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || d.Name() != db.DefaultFile {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if abs != own {
+			found = append(found, abs)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Merge the history and blobs of stray databases into the repository. Each
+// merged database is renamed with a .merged suffix so it is not merged twice.
+func mergeStrayDatabases(ctx context.Context, metadata *db.DB, blobs *store.Store, algorithm hash.Algorithm, target string, dryRun bool) error {
+	// Older versions always addressed blobs by SHA-256
+	if algorithm.Name != hash.DefaultAlgorithm {
+		return fmt.Errorf("stray databases use %s, but the repository uses %s; rehash to %s before merging", hash.DefaultAlgorithm, algorithm.Name, hash.DefaultAlgorithm)
+	}
+
+	strays, err := findStrayDatabases(target)
+	if err != nil {
+		return fmt.Errorf("failed to search for stray databases: %w", err)
+	}
+	if len(strays) == 0 {
+		fmt.Println("No stray databases found")
+		return nil
+	}
+
+	for _, stray := range strays {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasSuffix(stray, ".merged") {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("would merge %s\n", stray)
+			continue
+		}
+		if err := mergeDatabase(ctx, metadata, blobs, stray); err != nil {
+			return fmt.Errorf("failed to merge %s: %w", stray, err)
+		}
+	}
+	return nil
+}
+
+// Merge a single stray SQLite database and the storage directory beside it,
+// copying the blobs first so that no merged version lacks its content
+func mergeDatabase(ctx context.Context, metadata *db.DB, blobs *store.Store, path string) error {
+	copied, err := blobs.CopyBlobs(ctx, store.NewLocal(filepath.Join(filepath.Dir(path), storageDir), fsutil.Options{}))
+	if err != nil {
+		return err
+	}
+	merged, read, err := db.MergeStray(ctx, metadata, path, repoRoot)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+".merged"); err != nil {
+		return fmt.Errorf("merged, but failed to rename stray database: %w", err)
+	}
+	fmt.Printf("Merged %s: %d records (%d versions present already), %d blobs\n", path, merged, read-merged, copied)
+	return nil
+}
+
+// Build the verify repair options from the comma-separated -repair list
+func verifyOptions(repair, replica string, opts fsutil.Options) (store.VerifyOptions, error) {
+	var vopts store.VerifyOptions
+	for _, name := range strings.Split(repair, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "replica":
+			if replica == "" {
+				return vopts, errors.New("repairing from a replica needs -replica")
+			}
+			vopts.Replica = store.NewLocal(replica, opts)
+		case "quarantine":
+			vopts.Quarantine = store.NewLocal(repoPath(quarantineDir), opts)
+		default:
+			return vopts, fmt.Errorf("unknown repair %q (use replica, quarantine)", name)
+		}
+	}
+	return vopts, nil
+}
+
+// Write a repair plan as JSON for review
+func writeRepairPlan(path string, plan *store.RepairPlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Read a reviewed repair plan
+func readRepairPlan(path string) (*store.RepairPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &store.RepairPlan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("failed to parse repair plan: %w", err)
+	}
+	return plan, nil
+}
+
+// Build the options of -action watch from the config file. A repository
+// inside the watched directory is ignored, as storing files changes it.
+func watchOptions(cfg *config, directory string, events event.Observer) (watch.Options, error) {
+	// Validated by loadConfig
+	interval, _ := time.ParseDuration(cfg.Watch.Interval)
+	debounce, _ := time.ParseDuration(cfg.Watch.Debounce)
+	opts := watch.Options{
+		Interval: interval,
+		Debounce: debounce,
+		Ignore:   slices.Clone(cfg.Watch.Ignore),
+		Events:   events,
+		Guard:    cfg.Watch.Guard.guard(),
+	}
+
+	dir, err := filepath.Abs(directory)
+	if err != nil {
+		return opts, err
+	}
+	rel, err := filepath.Rel(dir, repoRoot)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return opts, nil
+	}
+	if rel == "." {
+		return opts, fmt.Errorf("%s is the repository itself; watch a directory beside it", directory)
+	}
+	opts.Ignore = append(opts.Ignore, filepath.ToSlash(rel))
+	return opts, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Render a report as an aligned table, csv or json
+func renderReport(t *db.ReportTable, w io.Writer, format string) error {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		if _, err := fmt.Fprintln(tw, strings.ToUpper(strings.Join(t.Columns, "\t"))); err != nil {
+			return err
+		}
+		for _, row := range t.Rows {
+			if _, err := fmt.Fprintln(tw, strings.Join(row, "\t")); err != nil {
+				return err
+			}
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(t.Columns); err != nil {
+			return err
+		}
+		if err := cw.WriteAll(t.Rows); err != nil {
+			return err
+		}
+		return cw.Error()
+	case "json":
+		records := make([]map[string]string, 0, len(t.Rows))
+		for _, row := range t.Rows {
+			record := make(map[string]string, len(t.Columns))
+			for i, column := range t.Columns {
+				record[column] = row[i]
+			}
+			records = append(records, record)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	default:
+		return fmt.Errorf("unsupported report format %q (use table, csv or json)", format)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"strconv"
+	"time"
+)
+
+// Run a retention subcommand: "lock DAYS [KEY=VALUE]", "list" or "show
+// FILE". A lock keeps versions, of every file or of the files with the
+// metadata value, from being deleted or rewritten for DAYS after they were
+// stored; locks cannot be removed.
+func runRetention(ctx context.Context, metadata *db.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: -action retention lock DAYS [KEY=VALUE] | list | show FILE")
+	}
+	switch command := args[0]; command {
+	case "lock":
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("usage: -action retention lock DAYS [KEY=VALUE]")
+		}
+		days, err := strconv.Atoi(args[1])
+		if err != nil || days <= 0 {
+			return fmt.Errorf("invalid number of days %q", args[1])
+		}
+		lock := db.RetentionLock{Days: days}
+		if len(args) == 3 {
+			meta, err := db.ParseMeta(args[2:])
+			if err != nil {
+				return err
+			}
+			for key, value := range meta {
+				lock.MetaKey, lock.MetaValue = key, value
+			}
+		}
+		if err := db.AddRetentionLock(ctx, metadata, lock); err != nil {
+			return err
+		}
+		fmt.Printf("Versions of %s are now retained for %d days after they were stored\n", describeScope(lock), days)
+	case "list":
+		locks, err := db.ListRetentionLocks(ctx, metadata)
+		if err != nil {
+			return err
+		}
+		for _, l := range locks {
+			fmt.Printf("%-4d %-30s %5d days  since %s", l.ID, l.Scope(), l.Days, l.Created.Local().Format(time.DateTime))
+			if l.Principal != "" {
+				fmt.Printf(" by %s", l.Principal)
+			}
+			fmt.Println()
+		}
+	case "show":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: -action retention show FILE")
+		}
+		filename, err := db.ResolveName(ctx, metadata, fsutil.NormalizeName(args[1]))
+		if err != nil {
+			return err
+		}
+		versions, err := db.FileRetention(ctx, metadata, filename)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("%s: %w", filename, db.ErrNoVersion)
+		}
+		for _, v := range versions {
+			status := "not retained"
+			if v.Retained() {
+				status = "retained until " + v.Until.Local().Format(time.DateTime)
+			}
+			if v.Hold != "" {
+				status += ", held by " + v.Hold
+			}
+			fmt.Printf("v%-4d %s  %s\n", v.Version, v.Timestamp.Local().Format(time.DateTime), status)
+		}
+	default:
+		return fmt.Errorf("unknown retention command %q (use lock, list, show)", command)
+	}
+	return nil
+}
+
+// Describe what a lock covers in a sentence
+func describeScope(l db.RetentionLock) string {
+	if l.MetaKey == "" {
+		return "every file"
+	}
+	return "files with " + l.Scope()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/service"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Tell the service manager that the server is ready, and that it is
+// stopping once ctx is cancelled
+func serviceReady(ctx context.Context) {
+	warnNotify(service.Notify("READY=1"))
+	go func() {
+		<-ctx.Done()
+		warnNotify(service.Notify("STOPPING=1"))
+	}()
+}
+
+// Return how long running jobs may take to finish when the server stops
+func shutdownGrace(cfg *config) time.Duration {
+	// Validated by loadConfig
+	grace, _ := time.ParseDuration(cfg.Service.ShutdownGrace)
+	return grace
+}
+
+// Run -action service install [daemon | serve]: write the definition of a
+// service running the repository's daemon or server, as a systemd unit or,
+// on Windows, a WinSW configuration. With dryRun it is printed instead.
+func installService(args []string, cfg *config, listen, format, output string, dryRun bool) error {
+	if len(args) == 0 || args[0] != "install" || len(args) > 2 {
+		return errors.New("usage: -action service install [daemon | serve]")
+	}
+	mode := "daemon"
+	if len(args) == 2 {
+		mode = args[1]
+	}
+	if mode != "daemon" && mode != "serve" {
+		return fmt.Errorf("cannot install -action %s as a service (use daemon or serve)", mode)
+	}
+	if format == "" {
+		format = "systemd"
+		if runtime.GOOS == "windows" {
+			format = "winsw"
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the executable: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+	def := &service.Definition{
+		Name:        "file-manager-" + mode + "-" + serviceName(filepath.Base(repoRoot)),
+		Description: fmt.Sprintf("File manager %s for %s", mode, repoRoot),
+		Executable:  executable,
+		Args:        []string{"-repo", repoRoot, "-action", mode},
+		Dir:         repoRoot,
+		// Running jobs get the grace period, then requests in flight a while
+		StopTimeout: shutdownGrace(cfg) + 30*time.Second,
+	}
+	if mode == "serve" {
+		def.Args = append(def.Args, "-listen", listen)
+	}
+	if u, err := user.Current(); err == nil {
+		def.User = u.Username
+	}
+	content, err := def.Write(format)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Print(string(content))
+		return nil
+	}
+
+	if output == "" {
+		if format == "systemd" {
+			output = filepath.Join("/etc/systemd/system", def.Name+".service")
+		} else {
+			output = repoPath(def.Name + ".xml")
+		}
+	}
+	if err := os.WriteFile(output, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write service definition: %w", err)
+	}
+	fmt.Printf("Wrote %s\n", output)
+	if format == "systemd" {
+		fmt.Printf("Start it with: systemctl daemon-reload && systemctl enable --now %s\n", strings.TrimSuffix(filepath.Base(output), ".service"))
+	} else {
+		fmt.Printf("Copy the WinSW executable to %s.exe, then run it with install and start\n", strings.TrimSuffix(output, ".xml"))
+	}
+	if mode == "serve" && len(cfg.Server.Users) == 0 {
+		fmt.Println("Warning: no server.users configured; anyone who can reach the server has full access")
+	}
+	return nil
+}
+
+// Reduce a directory name to the characters service names allow
+func serviceName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, s)
+}
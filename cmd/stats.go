@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"os"
+	"strconv"
+)
+
+// Print the size of the repository now, or with history its size at the
+// end of every month as a report to chart growth and deduplication
+func runStats(ctx context.Context, metadata *db.DB, blobs *store.Store, history bool, format string) error {
+	samples, err := db.StatsHistory(ctx, metadata)
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+	if history {
+		table := &db.ReportTable{Columns: []string{"month", "files", "versions", "versions_added", "blobs", "logical_bytes", "stored_bytes", "dedup_ratio"}}
+		for _, s := range samples {
+			table.Rows = append(table.Rows, []string{s.Month, strconv.Itoa(s.Files), strconv.Itoa(s.Versions), strconv.Itoa(s.VersionsAdded),
+				strconv.Itoa(s.Blobs), strconv.FormatInt(s.LogicalBytes, 10), strconv.FormatInt(s.StoredBytes, 10), fmt.Sprintf("%.2f", s.DedupRatio())})
+		}
+		return renderReport(table, os.Stdout, defaultString(format, "table"))
+	}
+
+	var now db.StatsSample
+	if len(samples) > 0 {
+		now = samples[len(samples)-1]
+	}
+	usage, err := blobs.Usage(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to measure storage: %w", err)
+	}
+	fmt.Printf("Files:          %d\n", now.Files)
+	fmt.Printf("Versions:       %d\n", now.Versions)
+	fmt.Printf("Blobs:          %d\n", now.Blobs)
+	fmt.Printf("Logical bytes:  %d\n", now.LogicalBytes)
+	fmt.Printf("Stored bytes:   %d\n", now.StoredBytes)
+	fmt.Printf("Dedup ratio:    %.2f\n", now.DedupRatio())
+	fmt.Printf("Storage used:   %d bytes\n", usage)
+	return nil
+}
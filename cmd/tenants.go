@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/notify"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// tenant is one of the repositories served together by -action serve
+type tenant struct {
+	*repository
+	name string
+	api  *server.Server
+	open bool // anyone who can reach the server may use it
+}
+
+// Open the repository in dir, listed under server.repositories as name,
+// for serving. It is locked like a repository served on its own.
+func openTenant(ctx context.Context, name, dir string, wait time.Duration, workers int, opts fsutil.Options) (*tenant, error) {
+	r, err := openRepository(ctx, dir, "serve", wait, workers, opts)
+	if err != nil {
+		return nil, err
+	}
+	t := &tenant{repository: r, name: name}
+	if len(r.cfg.Server.Repositories) > 0 {
+		t.Close()
+		return nil, fmt.Errorf("%s lists server.repositories itself", r.root)
+	}
+
+	// Validated by loadConfig
+	notifier, _ := notify.New(name, r.cfg.Notifications.Targets)
+	t.api = server.New(r.blobs, r.metadata, r.algorithm, opts)
+	t.api.SetNotifier(notifier)
+	t.api.SetQuota(r.cfg.Server.QuotaBytes)
+	t.api.SetUploadDir(filepath.Join(r.root, uploadsDir))
+	// Tenants must not reach each other's files through job paths
+	jobRoot := r.cfg.Server.JobRoot
+	if jobRoot != "" && !filepath.IsAbs(jobRoot) {
+		jobRoot = filepath.Join(r.root, jobRoot)
+	}
+	t.api.ConfineJobs(jobRoot)
+	if err := t.api.SetUsers(r.cfg.Server.Users); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("invalid server.users of %s: %w", r.root, err)
+	}
+	t.open = len(r.cfg.Server.Users) == 0
+	return t, nil
+}
+
+// Serve the repositories listed under server.repositories on addr until ctx
+// is cancelled
+func serveTenants(ctx context.Context, cfg *config, addr string, wait time.Duration, workers int, opts fsutil.Options) error {
+	tenants := server.NewTenants()
+	for name, dir := range cfg.Server.Repositories {
+		t, err := openTenant(ctx, name, dir, wait, workers, opts)
+		if err != nil {
+			return fmt.Errorf("repository %s: %w", name, err)
+		}
+		defer t.Close()
+		t.api.SetShutdownGrace(shutdownGrace(cfg))
+		if err := tenants.Add(name, t.api); err != nil {
+			return err
+		}
+		if t.open {
+			if !loopback(addr) {
+				return fmt.Errorf("refusing to serve repository %s on %s without server.users: anyone who can reach it would have full access; configure users or listen on a loopback address", name, addr)
+			}
+			fmt.Printf("Warning: repository %s has no server.users configured; anyone who can reach the server has full access\n", name)
+		}
+	}
+	for _, name := range tenants.Names() {
+		fmt.Printf("Serving repository %s under /repos/%s/\n", cfg.Server.Repositories[name], name)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Listening on %s\n", addr)
+	serviceReady(ctx)
+	return tenants.Serve(ctx, listener)
+}
+
+// Report whether addr only listens on loopback interfaces
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
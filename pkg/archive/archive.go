@@ -0,0 +1,578 @@
+// Package archive creates, restores and compares compressed backups and
+// applies retention to the backup catalog.
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/content"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Compress compresses inputFile with codec into outputDir, appending the
+// codec's extension to the file name
+func Compress(ctx context.Context, inputFile, outputDir string, codec Codec, opts fsutil.Options) (err error) {
+	// Ensure the output directory exists
+	err = os.MkdirAll(outputDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Open the input file
+	inFile, err := os.Open(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer func(inFile *os.File) {
+		err := inFile.Close()
+		if err != nil {
+			fmt.Printf("Failed to close input file: %v\n", err)
+		}
+	}(inFile)
+
+	// Construct the output file path
+	outputFile := filepath.Join(outputDir, filepath.Base(inputFile)+codec.Extension())
+
+	// Create the output file
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer removeOnError(outputFile, &err)
+	defer func(outFile *os.File) {
+		err := outFile.Close()
+		if err != nil {
+			fmt.Printf("Failed to close output file: %v\n", err)
+		}
+	}(outFile)
+
+	return CompressStream(ctx, filepath.Base(inputFile), inFile, outFile, codec, opts)
+}
+
+// CompressStream compresses everything read from r into w with codec,
+// recording name as the original file name where the format allows
+func CompressStream(ctx context.Context, name string, r io.Reader, w io.Writer, codec Codec, opts fsutil.Options) error {
+	compressor, err := codec.NewWriter(w, name)
+	if err != nil {
+		return fmt.Errorf("failed to start compression: %w", err)
+	}
+
+	if _, err := fsutil.Copy(ctx, compressor, opts.Reader(ctx, r)); err != nil {
+		_ = compressor.Close()
+		return fmt.Errorf("failed to write compressed data: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("failed to finish compressed stream: %w", err)
+	}
+	return nil
+}
+
+// Decompress extracts a compressed file into outputDir. The codec is chosen
+// by the file's extension, and the output is named after the original name
+// recorded in the file or else the input name without its extension.
+func Decompress(ctx context.Context, inputFile, outputDir string, opts fsutil.Options) (err error) {
+	// Ensure the output directory exists
+	err = os.MkdirAll(outputDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Open the compressed input file
+	inFile, err := os.Open(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer func(inFile *os.File) {
+		err := inFile.Close()
+		if err != nil {
+			fmt.Printf("Failed to close input file: %v\n", err)
+		}
+	}(inFile)
+
+	codec := codecForFile(inputFile)
+	decompressor, name, err := codec.NewReader(inFile)
+	if err != nil {
+		return err
+	}
+	defer func(decompressor io.ReadCloser) {
+		err := decompressor.Close()
+		if err != nil {
+			fmt.Printf("Failed to close decompressor: %v\n", err)
+		}
+	}(decompressor)
+
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(inputFile), codec.Extension())
+	}
+	// The recorded name comes from the file, so only its base name is used
+	name = filepath.Base(name)
+	if err := checkHostName(name); err != nil {
+		return err
+	}
+	outputFile := filepath.Join(outputDir, name)
+
+	// Create the output file
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer removeOnError(outputFile, &err)
+	defer func(outFile *os.File) {
+		err := outFile.Close()
+		if err != nil {
+			fmt.Printf("Failed to close output file: %v\n", err)
+		}
+	}(outFile)
+
+	// Copy the decompressed data to the output file
+	_, err = opts.Copy(ctx, outFile, decompressor)
+	if err != nil {
+		return fmt.Errorf("failed to write decompressed data: %w", err)
+	}
+
+	return nil
+}
+
+// BackupSummary describes a written backup archive
+type BackupSummary struct {
+	Files        int   `json:"files"`
+	Bytes        int64 `json:"bytes"` // file contents before compression
+	ArchiveBytes int64 `json:"archive_bytes"`
+	Resumed      int   `json:"resumed,omitempty"` // files written by an interrupted run
+
+	// Collisions are files whose names differ only in case from one backed
+	// up before, which restoring onto macOS or Windows cannot keep apart
+	Collisions []string `json:"collisions,omitempty"`
+
+	// Unreadable lists the parts of the tree left out of the archive as
+	// they could not be read, with why, and Failed the errors of the files
+	// left out as they could not be opened
+	Unreadable []string `json:"unreadable,omitempty"`
+	Failed     []string `json:"failed,omitempty"`
+
+	// UnchangedSince is when the archive BackupOnce kept instead of
+	// writing it again was made from the same files
+	UnchangedSince *time.Time `json:"unchanged_since,omitempty"`
+}
+
+// Complete reports whether every file of the tree was backed up
+func (s *BackupSummary) Complete() bool {
+	return len(s.Unreadable) == 0 && len(s.Failed) == 0
+}
+
+// Print the summary in a human-readable form
+func (s *BackupSummary) Print() {
+	if s.UnchangedSince != nil {
+		fmt.Printf("Backup is up to date: nothing changed since it was made at %s, keeping the %d-byte archive\n",
+			s.UnchangedSince.Local().Format(time.DateTime), s.ArchiveBytes)
+		return
+	}
+	resumed := ""
+	if s.Resumed > 0 {
+		resumed = fmt.Sprintf(" (%d of them before being interrupted)", s.Resumed)
+	}
+	for _, name := range s.Collisions {
+		fmt.Printf("case collision %s\n", name)
+	}
+	for _, skipped := range s.Unreadable {
+		fmt.Printf("unreadable %s\n", skipped)
+	}
+	for _, failed := range s.Failed {
+		fmt.Println(failed)
+	}
+	fmt.Printf("Backed up %d files%s, %d bytes compressed to %d bytes\n", s.Files, resumed, s.Bytes, s.ArchiveBytes)
+}
+
+// Backup writes every file below directory into a tar.gz archive, which
+// appears at output once it is complete. If writing fails, the partial
+// archive is removed. If ctx is cancelled, it is kept up to the last
+// checkpoint, and backing up the same directory to output again continues
+// from there; files that changed before the checkpoint meanwhile are
+// backed up as they were. An index of the entries is written next to the
+// archive, for RestoreEntries.
+func Backup(ctx context.Context, directory, output string, opts fsutil.Options) (summary *BackupSummary, err error) {
+	partial := output + partialSuffix
+	checkpointPath := output + checkpointSuffix
+	source, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	resume := loadCheckpoint(checkpointPath, source, partial)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume != nil {
+		flags = os.O_WRONLY
+	}
+	outFile, err := os.OpenFile(partial, flags, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	saved := resume
+	defer func() {
+		if err == nil {
+			return
+		}
+		if saved != nil && errors.Is(err, context.Canceled) {
+			// Drop what was written after the checkpoint
+			if truncErr := os.Truncate(partial, saved.Offset); truncErr == nil {
+				return
+			}
+		}
+		for _, path := range []string{partial, checkpointPath} {
+			if removeErr := os.Remove(path); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+				fmt.Printf("Failed to remove partial output %s: %v\n", path, removeErr)
+			}
+		}
+	}()
+	defer func(outFile *os.File) {
+		err := outFile.Close()
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			fmt.Printf("Failed to close output file: %v\n", err)
+		}
+	}(outFile)
+
+	index := &Index{}
+	if resume != nil {
+		// The entries written before are indexed from the partial archive
+		if index.Entries, err = indexPrefix(ctx, partial, resume.Offset, opts); err != nil {
+			return nil, fmt.Errorf("failed to resume backup: %w", err)
+		}
+		if err := outFile.Truncate(resume.Offset); err != nil {
+			return nil, fmt.Errorf("failed to resume backup: %w", err)
+		}
+		if _, err := outFile.Seek(resume.Offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to resume backup: %w", err)
+		}
+	}
+	save := func(cp *backupCheckpoint) error {
+		if err := opts.SyncFile(outFile); err != nil {
+			return err
+		}
+		cp.Directory = source
+		if err := writeCheckpoint(checkpointPath, cp); err != nil {
+			return err
+		}
+		saved = cp
+		return nil
+	}
+	summary, err = backupFS(ctx, fsutil.HostFS(directory), outFile, opts, resume, save, index)
+	if err != nil {
+		return summary, err
+	}
+	if err := opts.SyncFile(outFile); err != nil {
+		return summary, err
+	}
+	if err := outFile.Close(); err != nil {
+		return summary, fmt.Errorf("failed to close output file: %w", err)
+	}
+	// An index left by an earlier archive at output is replaced first
+	if err := writeIndex(output, index, opts); err != nil {
+		return summary, err
+	}
+	if err := os.Rename(partial, output); err != nil {
+		return summary, fmt.Errorf("failed to move backup into place: %w", err)
+	}
+	_ = os.Remove(checkpointPath)
+	if err := opts.SyncDir(filepath.Dir(output)); err != nil {
+		return summary, err
+	}
+
+	return summary, nil
+}
+
+// Index the entries of the first size bytes of the archive at path
+func indexPrefix(ctx context.Context, path string, size int64, opts fsutil.Options) ([]IndexEntry, error) {
+	inFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = inFile.Close()
+	}()
+	return scanIndex(ctx, io.LimitReader(opts.Reader(ctx, inFile), size))
+}
+
+// BackupStream writes every file below directory as a tar.gz stream to w
+func BackupStream(ctx context.Context, directory string, w io.Writer, opts fsutil.Options) (*BackupSummary, error) {
+	return BackupFS(ctx, fsutil.HostFS(directory), w, opts)
+}
+
+// BackupFS writes every file of fsys as a tar.gz stream to w. Entry names
+// are the slash-separated names within fsys.
+func BackupFS(ctx context.Context, fsys fs.FS, w io.Writer, opts fsutil.Options) (*BackupSummary, error) {
+	return backupFS(ctx, fsys, w, opts, nil, nil, nil)
+}
+
+// Write the tar.gz stream of BackupFS. When save is set, a checkpoint is
+// passed to it now and then, after ending the gzip member so that the
+// stream written so far is complete. When resume is set, the stream
+// continues one saved earlier: w is positioned at its offset, and the
+// files up to its last entry are skipped. When index is set, every entry
+// written is added to it, and a new gzip member starts every
+// indexFrameSize bytes so that entries can be read from near where they
+// start.
+func backupFS(ctx context.Context, fsys fs.FS, w io.Writer, opts fsutil.Options, resume *backupCheckpoint, save func(*backupCheckpoint) error, index *Index) (*BackupSummary, error) {
+	summary := &BackupSummary{}
+	var base int64
+	if resume != nil {
+		summary.Files, summary.Bytes, summary.Resumed = resume.Files, resume.Bytes, resume.Files
+		base = resume.Offset
+	}
+	counter := &fsutil.CountingWriter{W: opts.Writer(ctx, w)}
+	gzipWriter := newMembers(counter)
+	defer func(gzipWriter *members) {
+		err := gzipWriter.Close()
+		if err != nil {
+			fmt.Printf("Failed to close gzip writer: %v\n", err)
+		}
+	}(gzipWriter)
+
+	// Counts the tar stream, to locate entries within their member
+	plain := &fsutil.CountingWriter{W: gzipWriter}
+	tarWriter := tar.NewWriter(plain)
+	defer func(tarWriter *tar.Writer) {
+		err := tarWriter.Close()
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Failed to close tar writer: %v\n", err)
+		}
+	}(tarWriter)
+
+	// The gzip member being written, which entries are located from
+	current := frame{offset: base}
+	next := func(store bool) error {
+		if err := tarWriter.Flush(); err != nil {
+			return fmt.Errorf("failed to write tar archive: %w", err)
+		}
+		if err := gzipWriter.Next(store); err != nil {
+			return fmt.Errorf("failed to write gzip stream: %w", err)
+		}
+		current = frame{offset: base + counter.N, plain: plain.N}
+		return nil
+	}
+
+	lastSave := time.Now()
+	folded := map[string]string{}
+	skip := func(name string, err error) {
+		summary.Unreadable = append(summary.Unreadable, fmt.Sprintf("%s: %v", name, err))
+	}
+	err := fs.WalkDir(fsys, ".", opts.SkipUnreadable("backup", ".", skip, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error accessing file %s: %w", path, err)
+		}
+		if err := fsutil.Checkpoint(ctx); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if resume != nil && !walksAfter(path, resume.Last) {
+			return nil
+		}
+		// A file failing before its header is written is left out; after
+		// that, the archive cannot go on without its content
+		info, err := entry.Info()
+		if err != nil {
+			return opts.SkipFailed("backup", path, fmt.Errorf("error accessing file %s: %w", path, err), &summary.Failed)
+		}
+		if err := opts.Admits(ctx, "backup", path, info.Size()); err != nil {
+			return opts.SkipFailed("backup", path, err, &summary.Failed)
+		}
+
+		file, err := fsys.Open(path)
+		if err != nil {
+			return opts.SkipFailed("backup", path, fmt.Errorf("failed to open file %s: %w", path, err), &summary.Failed)
+		}
+		defer func(file fs.File) {
+			err := file.Close()
+			if err != nil {
+				fmt.Printf("Failed to close file: %v\n", err)
+			}
+		}(file)
+
+		header, err := tar.FileInfoHeader(info, info.Name())
+		if err != nil {
+			return opts.SkipFailed("backup", path, fmt.Errorf("failed to create tar header for file %s: %w", path, err), &summary.Failed)
+		}
+
+		setEntryName(header, path)
+		if runtime.GOOS == "windows" {
+			header.Mode = windowsMode(path, info.Mode())
+		}
+		if earlier, ok := folded[foldName(path)]; ok {
+			summary.Collisions = append(summary.Collisions, path)
+			opts.Events().OnError(event.Error{Op: "backup", Name: path, Err: fmt.Errorf("name differs only in case from %s; restoring onto a case-insensitive file system applies the collision policy", earlier)})
+		} else {
+			folded[foldName(path)] = path
+		}
+		if err := addXattrs(header, file); err != nil {
+			return opts.SkipFailed("backup", path, fmt.Errorf("failed to read extended attributes of %s: %w", path, err), &summary.Failed)
+		}
+
+		var n int64
+		regions, sparse := sparseRegions(file, header)
+		var reader io.Reader = file
+		store := false
+		if !sparse && header.Typeflag == tar.TypeReg && header.Size >= storeAsIsSize {
+			// Compressing media and archives again only costs time
+			head := make([]byte, content.SniffLen)
+			read, err := io.ReadFull(file, head)
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return opts.SkipFailed("backup", path, fmt.Errorf("failed to read file %s: %w", path, err), &summary.Failed)
+			}
+			store = content.Detect(path, head[:read]).Compressed()
+			reader = io.MultiReader(bytes.NewReader(head[:read]), file)
+		}
+		if store != gzipWriter.Stored() || (index != nil && plain.N-current.plain >= indexFrameSize) {
+			if err := next(store); err != nil {
+				return err
+			}
+		}
+		if index != nil {
+			if err := tarWriter.Flush(); err != nil {
+				return fmt.Errorf("failed to write tar archive: %w", err)
+			}
+			index.Entries = append(index.Entries, IndexEntry{Name: path, Offset: current.offset, Skip: plain.N - current.plain, Size: header.Size})
+		}
+
+		if sparse {
+			n, err = writeSparseEntry(ctx, tarWriter, plain, header, file.(*os.File), regions, opts)
+		} else {
+			err = tarWriter.WriteHeader(header)
+			if err != nil {
+				return fmt.Errorf("failed to write tar header for file %s: %w", path, err)
+			}
+			if header.Typeflag == tar.TypeReg {
+				n, err = copyEntry(ctx, tarWriter, reader, header.Size, path, opts)
+			} else {
+				n, err = fsutil.Copy(ctx, tarWriter, file)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write file %s to tar archive: %w", path, err)
+		}
+
+		summary.Files++
+		summary.Bytes += n
+		opts.Events().OnBackupProgress(event.BackupProgress{Name: path, Files: summary.Files, Bytes: summary.Bytes})
+
+		if save == nil || time.Since(lastSave) < checkpointInterval {
+			return nil
+		}
+		// A new gzip member starts after the checkpoint, which gzip
+		// readers continue into as if the stream were one
+		if err := next(gzipWriter.Stored()); err != nil {
+			return err
+		}
+		if err := save(&backupCheckpoint{Offset: base + counter.N, Last: path, Files: summary.Files, Bytes: summary.Bytes}); err != nil {
+			return fmt.Errorf("failed to save backup checkpoint: %w", err)
+		}
+		lastSave = time.Now()
+		return nil
+	}))
+
+	if err != nil {
+		return summary, fmt.Errorf("failed to create backup: %w", err)
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return summary, fmt.Errorf("failed to finish tar archive: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return summary, fmt.Errorf("failed to finish gzip stream: %w", err)
+	}
+
+	summary.ArchiveBytes = base + counter.N
+	return summary, nil
+}
+
+// storeAsIsSize is the size from which files whose content is compressed
+// already go into the archive without compressing them again
+const storeAsIsSize = 64 << 10
+
+// members writes a gzip stream as a series of members, each compressed or
+// stored as is, which gzip readers read as if the stream were one
+type members struct {
+	w          io.Writer
+	compressed *gzip.Writer
+	stored     *gzip.Writer
+	current    *gzip.Writer
+}
+
+func newMembers(w io.Writer) *members {
+	// The level is valid, so there is no error
+	stored, _ := gzip.NewWriterLevel(w, gzip.NoCompression)
+	compressed := gzip.NewWriter(w)
+	return &members{w: w, compressed: compressed, stored: stored, current: compressed}
+}
+
+func (m *members) Write(p []byte) (int, error) {
+	return m.current.Write(p)
+}
+
+// Stored reports whether the current member stores data as is
+func (m *members) Stored() bool {
+	return m.current == m.stored
+}
+
+// Next ends the current member, leaving the stream written so far
+// complete, and starts a new one, stored as is when store is set
+func (m *members) Next(store bool) error {
+	if err := m.current.Close(); err != nil {
+		return err
+	}
+	m.current = m.compressed
+	if store {
+		m.current = m.stored
+	}
+	m.current.Reset(m.w)
+	return nil
+}
+
+// Close ends the current member
+func (m *members) Close() error {
+	return m.current.Close()
+}
+
+// Stream exactly size bytes of a file into the archive, the size its
+// header promised. A file that grew since is cut there; one that shrank is
+// padded with zeros and reported.
+func copyEntry(ctx context.Context, w io.Writer, file io.Reader, size int64, name string, opts fsutil.Options) (int64, error) {
+	n, err := fsutil.Copy(ctx, w, io.LimitReader(file, size))
+	if err != nil || n == size {
+		return n, err
+	}
+	opts.Events().OnError(event.Error{Op: "backup", Name: name, Err: fmt.Errorf(
+		"file shrank from %d to %d bytes while being backed up; the rest is archived as zeros", size, n)})
+	padding, err := fsutil.Copy(ctx, w, io.LimitReader(zeros{}, size-n))
+	return n + padding, err
+}
+
+// zeros reads as an endless run of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Remove a partially written output file when the operation failed. It must
+// be deferred before the file's close so that it runs after it.
+func removeOnError(path string, err *error) {
+	if *err == nil {
+		return
+	}
+	if removeErr := os.Remove(path); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+		fmt.Printf("Failed to remove partial output %s: %v\n", path, removeErr)
+	}
+}
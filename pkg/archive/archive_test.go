@@ -0,0 +1,103 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Check that dir holds exactly files
+func checkTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	found := 0
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		want, ok := files[filepath.ToSlash(name)]
+		if !ok {
+			t.Errorf("unexpected file %s", name)
+			return nil
+		}
+		found++
+		got, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if string(got) != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != len(files) {
+		t.Errorf("found %d files, want %d", found, len(files))
+	}
+}
+
+func TestBackupFSListing(t *testing.T) {
+	var out bytes.Buffer
+	summary, err := archive.BackupFS(context.Background(), fmtest.Fixture(t, fmtest.SampleFiles), &out, fsutil.Options{})
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if !summary.Complete() {
+		t.Errorf("backup is incomplete: %+v", summary)
+	}
+	want := fmtest.GoldenArchive(t, "sample-v1.listing")
+	if got := fmtest.ArchiveListing(t, &out); got != string(want) {
+		t.Errorf("backup listing differs from sample-v1:\n--- want\n%s\n--- got\n%s", want, got)
+	}
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := t.TempDir()
+	for name, content := range fmtest.SampleFiles {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if _, err := archive.Backup(ctx, source, output, fsutil.Options{}); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	target := t.TempDir()
+	report, err := archive.Restore(ctx, output, target, 2, archive.DefaultCollisionPolicy, fsutil.Options{})
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if len(report.Created) != len(fmtest.SampleFiles) || len(report.Failed) != 0 {
+		t.Errorf("restore created %v and failed %v", report.Created, report.Failed)
+	}
+	checkTree(t, target, fmtest.SampleFiles)
+}
+
+// Archives written by earlier versions must stay restorable
+func TestRestoreGoldenArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample-v1.tar.gz")
+	if err := os.WriteFile(path, fmtest.GoldenArchive(t, "sample-v1.tar.gz"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if _, err := archive.Restore(context.Background(), path, target, 1, archive.DefaultCollisionPolicy, fsutil.Options{}); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	checkTree(t, target, fmtest.SampleFiles)
+}
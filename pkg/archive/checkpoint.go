@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// partialSuffix names the archive Backup writes until it is complete
+	partialSuffix = ".partial"
+
+	// checkpointSuffix names the record of how far the partial archive got
+	checkpointSuffix = ".checkpoint"
+
+	// checkpointInterval is how often Backup makes its partial archive
+	// resumable
+	checkpointInterval = 30 * time.Second
+)
+
+// backupCheckpoint records how far an interrupted backup got
+type backupCheckpoint struct {
+	Directory string `json:"directory"` // absolute path of the directory backed up
+	Offset    int64  `json:"offset"`    // size of the partial archive up to the checkpoint
+	Last      string `json:"last"`      // entry written last before it
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// Resumable reports whether an interrupted backup to output left a
+// checkpoint that backing up the same directory again continues from
+func Resumable(output string) bool {
+	_, err := os.Stat(output + checkpointSuffix)
+	return err == nil
+}
+
+// Return the checkpoint of a backup of directory whose partial archive is
+// intact, or nil when there is none to resume
+func loadCheckpoint(path, directory, partial string) *backupCheckpoint {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	cp := &backupCheckpoint{}
+	if json.Unmarshal(data, cp) != nil || cp.Directory != directory || cp.Last == "" {
+		return nil
+	}
+	info, err := os.Stat(partial)
+	if err != nil || info.Size() < cp.Offset {
+		return nil
+	}
+	return cp
+}
+
+// Replace the checkpoint at path
+func writeCheckpoint(path string, cp *backupCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Report whether fs.WalkDir visits the slash-separated path a after b. It
+// visits the entries of each directory sorted by name, so paths compare
+// by component.
+func walksAfter(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] > bs[i]
+		}
+	}
+	return len(as) > len(bs)
+}
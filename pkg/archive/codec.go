@@ -0,0 +1,91 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DefaultCodec compresses files unless another codec is chosen
+const DefaultCodec = "gzip"
+
+// Codec compresses single files for Compress and Decompress
+type Codec interface {
+	// Extension is appended to the names of compressed files, dot included
+	Extension() string
+
+	// NewWriter compresses everything written to it into w. Codecs that
+	// can record the original file name should record name.
+	NewWriter(w io.Writer, name string) (io.WriteCloser, error)
+
+	// NewReader decompresses r and returns the recorded original file name,
+	// or "" if the format does not record one
+	NewReader(r io.Reader) (io.ReadCloser, string, error)
+}
+
+var codecs = map[string]Codec{
+	DefaultCodec: gzipCodec{},
+}
+
+// RegisterCodec makes a codec available under name. It is meant to be
+// called from the init function of the package providing the codec and
+// panics if the name is taken.
+func RegisterCodec(name string, c Codec) {
+	if _, exists := codecs[name]; exists {
+		panic("archive: codec " + name + " registered twice")
+	}
+	codecs[name] = c
+}
+
+// LookupCodec returns the codec registered under name
+func LookupCodec(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %q (use %s)", name, strings.Join(CodecNames(), ", "))
+	}
+	return c, nil
+}
+
+// CodecNames returns the names of the registered codecs, sorted
+func CodecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pick the codec whose extension ends the file name, falling back to gzip
+// as older versions only wrote gzip files
+func codecForFile(name string) Codec {
+	for _, c := range codecs {
+		if strings.HasSuffix(name, c.Extension()) {
+			return c
+		}
+	}
+	return codecs[DefaultCodec]
+}
+
+// gzipCodec keeps the original file name in the gzip header
+type gzipCodec struct{}
+
+func (gzipCodec) Extension() string {
+	return ".gz"
+}
+
+func (gzipCodec) NewWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	gzipWriter := gzip.NewWriter(w)
+	gzipWriter.Name = name
+	return gzipWriter, nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, string, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	return gzipReader, gzipReader.Name, nil
+}
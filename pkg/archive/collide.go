@@ -0,0 +1,120 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// CollisionPolicy decides what a restore does with an entry whose name
+// differs only in case from an earlier one, such as README.md after
+// Readme.md, when the target file system does not tell them apart, as
+// those of macOS and Windows do not by default
+type CollisionPolicy string
+
+const (
+	CollisionRename CollisionPolicy = "rename" // restore it under its name with a numeric suffix
+	CollisionSkip   CollisionPolicy = "skip"   // keep the earlier entry only
+	CollisionFail   CollisionPolicy = "fail"   // fail the restore
+)
+
+// DefaultCollisionPolicy keeps every entry
+const DefaultCollisionPolicy = CollisionRename
+
+// ErrNameCollision is returned by restores with CollisionFail
+var ErrNameCollision = errors.New("name differs only in case from an earlier entry")
+
+// ParseCollisionPolicy returns the policy named name
+func ParseCollisionPolicy(name string) (CollisionPolicy, error) {
+	switch policy := CollisionPolicy(name); policy {
+	case CollisionRename, CollisionSkip, CollisionFail:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown collision policy %q (use rename, skip or fail)", name)
+}
+
+// Return the form of a slash-separated name that names differing only in
+// case or Unicode normalization share
+func foldName(name string) string {
+	return strings.ToLower(fsutil.NormalizeName(name))
+}
+
+// collisions tracks the names entries are restored under by their folded
+// form. A nil tracker lets every name through.
+type collisions struct {
+	policy  CollisionPolicy
+	seen    map[string]string // folded name to the name restored under it
+	renamed []string
+	skipped []string
+}
+
+// Return a tracker for restoring into target, or nil when target tells
+// names apart by case and nothing can collide
+func newCollisions(target fsutil.WriteFS, policy CollisionPolicy) (*collisions, error) {
+	insensitive, err := caseInsensitive(target)
+	if err != nil || !insensitive {
+		return nil, err
+	}
+	return &collisions{policy: policy, seen: map[string]string{}}, nil
+}
+
+// Report whether target treats names differing only in case as the same
+func caseInsensitive(target fsutil.WriteFS) (bool, error) {
+	const probe = ".fm-case-probe"
+	w, err := target.Create(probe, 0o600)
+	if err != nil {
+		return false, fmt.Errorf("failed to probe the target file system: %w", err)
+	}
+	_ = w.Close()
+	defer func() {
+		_ = target.Remove(probe)
+	}()
+	_, err = fs.Stat(target, strings.ToUpper(probe))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Return the slash-separated name to restore the file entry name under, or
+// "" to skip it, as the policy decides for names taken already
+func (c *collisions) resolve(name string) (string, error) {
+	if c == nil {
+		return name, nil
+	}
+	key := foldName(name)
+	earlier, taken := c.seen[key]
+	if !taken || earlier == name {
+		c.seen[key] = name
+		return name, nil
+	}
+	switch c.policy {
+	case CollisionSkip:
+		c.skipped = append(c.skipped, name)
+		return "", nil
+	case CollisionFail:
+		return "", fmt.Errorf("archive entry %s: %w, %s", name, ErrNameCollision, earlier)
+	}
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if _, taken := c.seen[foldName(candidate)]; !taken {
+			c.seen[foldName(candidate)] = candidate
+			c.renamed = append(c.renamed, name+" -> "+candidate)
+			return candidate, nil
+		}
+	}
+}
+
+// Add the entries renamed and skipped to a restore report
+func (c *collisions) report(report *RestoreReport) {
+	if c == nil {
+		return
+	}
+	report.Renamed = append(report.Renamed, c.renamed...)
+	report.Skipped = append(report.Skipped, c.skipped...)
+}
@@ -0,0 +1,126 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DiffReport describes how a directory differs from a backup archive
+type DiffReport struct {
+	Differ  []string `json:"differ"`  // present in both with different content
+	Missing []string `json:"missing"` // in the archive but not in the directory
+	Extra   []string `json:"extra"`   // in the directory but not in the archive
+	Same    int      `json:"same"`
+}
+
+// Clean reports whether the directory matches the archive exactly
+func (r *DiffReport) Clean() bool {
+	return len(r.Differ) == 0 && len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// Print the report in a human-readable form
+func (r *DiffReport) Print() {
+	for _, name := range r.Differ {
+		fmt.Printf("M %s\n", name)
+	}
+	for _, name := range r.Missing {
+		fmt.Printf("- %s\n", name)
+	}
+	for _, name := range r.Extra {
+		fmt.Printf("+ %s\n", name)
+	}
+	fmt.Printf("Diff summary: %d identical, %d differ, %d missing, %d extra\n",
+		r.Same, len(r.Differ), len(r.Missing), len(r.Extra))
+}
+
+// Diff compares the files in a directory against the contents of a backup
+// archive by their digests under algorithm
+func Diff(ctx context.Context, archive, directory string, algorithm hash.Algorithm, opts fsutil.Options) (*DiffReport, error) {
+	inFile, err := os.Open(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer func(inFile *os.File) {
+		err := inFile.Close()
+		if err != nil {
+			fmt.Printf("Failed to close archive file: %v\n", err)
+		}
+	}(inFile)
+
+	return DiffFS(ctx, opts.Reader(ctx, inFile), fsutil.HostFS(directory), algorithm)
+}
+
+// DiffFS compares the files of fsys against a tar.gz stream by hash. Names
+// in the report are slash-separated.
+func DiffFS(ctx context.Context, r io.Reader, fsys fs.FS, algorithm hash.Algorithm) (*DiffReport, error) {
+	archived := make(map[string]string)
+	err := WalkReader(ctx, r, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		name, err := SanitizeEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		hash, err := algorithm.Reader(ctx, r)
+		if err != nil {
+			return fmt.Errorf("failed to hash archive entry %s: %w", name, err)
+		}
+		archived[filepath.ToSlash(name)] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DiffReport{}
+	err = fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error accessing file %s: %w", name, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		archivedHash, ok := archived[name]
+		if !ok {
+			report.Extra = append(report.Extra, name)
+			return nil
+		}
+		delete(archived, name)
+
+		hash, err := algorithm.FSFile(ctx, fsys, name)
+		if err != nil {
+			return err
+		}
+		if hash == archivedHash {
+			report.Same++
+		} else {
+			report.Differ = append(report.Differ, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory: %w", err)
+	}
+
+	for name := range archived {
+		report.Missing = append(report.Missing, name)
+	}
+	sort.Strings(report.Differ)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+
+	return report, nil
+}
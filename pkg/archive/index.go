@@ -0,0 +1,323 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// IndexSuffix names the index Backup writes next to an archive
+	IndexSuffix = ".index"
+
+	// indexFrameSize is how much tar data a gzip member of an indexed
+	// archive holds before the next entry starts a new one, which bounds
+	// what restoring a single entry decompresses before reaching it
+	indexFrameSize = 4 << 20
+
+	// indexVersion is the format version of the index
+	indexVersion = 1
+)
+
+// ErrNoIndex is returned for selective restores from archives without an index
+var ErrNoIndex = errors.New("archive has no index")
+
+// IndexEntry locates an archive entry. A gzip member starts at Offset in
+// the archive file; decompressing it from there, the entry's tar header
+// follows Skip bytes of earlier entries.
+type IndexEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Skip   int64  `json:"skip"`
+	Size   int64  `json:"size"`
+}
+
+// Index maps the entries of a tar.gz archive to where they can be read
+// without decompressing what precedes them
+type Index struct {
+	Version int          `json:"version"`
+	Format  string       `json:"format"` // compression of the frames, "gzip"
+	Entries []IndexEntry `json:"entries"`
+}
+
+// Find returns the entry named name
+func (idx *Index) Find(name string) (IndexEntry, bool) {
+	i := sort.Search(len(idx.Entries), func(i int) bool { return idx.Entries[i].Name >= name })
+	if i < len(idx.Entries) && idx.Entries[i].Name == name {
+		return idx.Entries[i], true
+	}
+	return IndexEntry{}, false
+}
+
+// Sort the entries by name for Find
+func (idx *Index) sort() {
+	sort.Slice(idx.Entries, func(i, j int) bool { return idx.Entries[i].Name < idx.Entries[j].Name })
+}
+
+// ReadIndex reads the index of the archive at archive
+func ReadIndex(archive string) (*Index, error) {
+	data, err := os.ReadFile(archive + IndexSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w (create one with -action index)", archive, ErrNoIndex)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	idx := &Index{}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("failed to parse index of %s: %w", archive, err)
+	}
+	if idx.Version != indexVersion || idx.Format != DefaultCodec {
+		return nil, fmt.Errorf("index of %s has unsupported version %d or format %q", archive, idx.Version, idx.Format)
+	}
+	idx.sort()
+	return idx, nil
+}
+
+// Write the index of an archive next to it
+func writeIndex(archive string, idx *Index, opts fsutil.Options) error {
+	idx.Version, idx.Format = indexVersion, DefaultCodec
+	idx.sort()
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmp := archive + IndexSuffix + partialSuffix
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = opts.SyncFile(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := os.Rename(tmp, archive+IndexSuffix); err != nil {
+		return fmt.Errorf("failed to move index into place: %w", err)
+	}
+	return nil
+}
+
+// BuildIndex reads a whole tar.gz archive and writes its index. Archives
+// Backup writes have one; this indexes those written before it did. The
+// entries of an archive that is a single gzip member can only be reached
+// by decompressing it from its start.
+func BuildIndex(ctx context.Context, archive string, opts fsutil.Options) (*Index, error) {
+	inFile, err := os.Open(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer func() {
+		_ = inFile.Close()
+	}()
+	idx := &Index{}
+	if idx.Entries, err = scanIndex(ctx, opts.Reader(ctx, inFile)); err != nil {
+		return nil, err
+	}
+	if err := writeIndex(archive, idx, opts); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Index the entries of a tar.gz stream by reading it through. The stream
+// may end after a gzip member without ending the tar archive, as partial
+// archives do.
+func scanIndex(ctx context.Context, r io.Reader) ([]IndexEntry, error) {
+	frames := &memberReader{r: &byteCounter{r: bufio.NewReader(fsutil.ContextReader(ctx, r))}}
+	tarReader := tar.NewReader(frames)
+	var entries []IndexEntry
+	for {
+		// Entry data is read through, and tar pads it to whole blocks
+		start := (frames.n + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+		frame := frames.frameAt(start)
+		entries = append(entries, IndexEntry{Name: header.Name, Offset: frame.offset, Skip: start - frame.plain, Size: header.Size})
+		if _, err := io.Copy(io.Discard, tarReader); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+	}
+}
+
+// tarBlockSize is the unit tar headers and padded entry data come in
+const tarBlockSize = 512
+
+// frame is where a gzip member starts, in the archive and in the
+// decompressed stream
+type frame struct {
+	offset int64
+	plain  int64
+}
+
+// memberReader decompresses a stream of gzip members as one, recording
+// where each starts
+type memberReader struct {
+	r      *byteCounter
+	gzip   *gzip.Reader
+	frames []frame
+	n      int64 // decompressed bytes read
+	done   bool
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	for !m.done {
+		if m.gzip == nil {
+			// The stream ends cleanly between members
+			if _, err := m.r.r.Peek(1); err == io.EOF {
+				m.done = true
+				break
+			}
+			m.frames = append(m.frames, frame{offset: m.r.n, plain: m.n})
+			var err error
+			if m.gzip, err = gzip.NewReader(m.r); err != nil {
+				return 0, fmt.Errorf("failed to create gzip reader: %w", err)
+			}
+			m.gzip.Multistream(false)
+		}
+		n, err := m.gzip.Read(p)
+		m.n += int64(n)
+		if err == io.EOF {
+			m.gzip = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// Return the last member starting at or before the decompressed offset plain
+func (m *memberReader) frameAt(plain int64) frame {
+	i := sort.Search(len(m.frames), func(i int) bool { return m.frames[i].plain > plain })
+	return m.frames[i-1]
+}
+
+// byteCounter counts what is read through it. It is an io.ByteReader so
+// that gzip readers take no more from it than their member.
+type byteCounter struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *byteCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *byteCounter) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// RestoreEntries extracts the named entries of an indexed tar.gz archive
+// into target, decompressing only from the gzip member each starts in. A
+// name that is a directory restores the entries below it. Entries whose
+// names collide on a case-insensitive target are handled by policy.
+func RestoreEntries(ctx context.Context, archive string, names []string, target fsutil.WriteFS, policy CollisionPolicy, opts fsutil.Options) (*RestoreReport, error) {
+	report := &RestoreReport{}
+	idx, err := ReadIndex(archive)
+	if err != nil {
+		return report, err
+	}
+	inFile, err := os.Open(archive)
+	if err != nil {
+		return report, fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer func() {
+		_ = inFile.Close()
+	}()
+
+	var wanted []IndexEntry
+	for _, name := range names {
+		name = path.Clean(filepath.ToSlash(name))
+		if entry, ok := idx.Find(name); ok {
+			wanted = append(wanted, entry)
+			continue
+		}
+		// Archives name entries by their NFC form
+		name = fsutil.NormalizeName(name)
+		if entry, ok := idx.Find(name); ok {
+			wanted = append(wanted, entry)
+			continue
+		}
+		prefix := name + "/"
+		i := sort.Search(len(idx.Entries), func(i int) bool { return idx.Entries[i].Name >= prefix })
+		before := len(wanted)
+		for ; i < len(idx.Entries) && len(idx.Entries[i].Name) > len(prefix) && idx.Entries[i].Name[:len(prefix)] == prefix; i++ {
+			wanted = append(wanted, idx.Entries[i])
+		}
+		if len(wanted) == before {
+			return report, fmt.Errorf("%s is not in %s", name, archive)
+		}
+	}
+	// Reading in archive order keeps the reads sequential
+	sort.Slice(wanted, func(i, j int) bool {
+		if wanted[i].Offset != wanted[j].Offset {
+			return wanted[i].Offset < wanted[j].Offset
+		}
+		return wanted[i].Skip < wanted[j].Skip
+	})
+
+	tracker, err := newCollisions(target, policy)
+	if err != nil {
+		return report, err
+	}
+	defer tracker.report(report)
+	for _, entry := range wanted {
+		if err := restoreIndexed(ctx, inFile, entry, target, tracker, report, opts); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Extract the single entry an index entry locates
+func restoreIndexed(ctx context.Context, inFile *os.File, entry IndexEntry, target fsutil.WriteFS, tracker *collisions, report *RestoreReport, opts fsutil.Options) error {
+	section := io.NewSectionReader(inFile, entry.Offset, 1<<62)
+	gzipReader, err := gzip.NewReader(fsutil.ContextReader(ctx, opts.Reader(ctx, section)))
+	if err != nil {
+		return fmt.Errorf("failed to read %s at offset %d: %w", entry.Name, entry.Offset, err)
+	}
+	defer func() {
+		_ = gzipReader.Close()
+	}()
+	if _, err := io.CopyN(io.Discard, gzipReader, entry.Skip); err != nil {
+		return fmt.Errorf("failed to read %s at offset %d: %w", entry.Name, entry.Offset, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	header, err := tarReader.Next()
+	if err != nil {
+		return fmt.Errorf("failed to read tar header of %s: %w", entry.Name, err)
+	}
+	if header.Name != entry.Name {
+		return fmt.Errorf("index does not match archive: found %s where %s was expected", header.Name, entry.Name)
+	}
+	return restoreEntry(ctx, header, tarReader, target, tracker, report, opts)
+}
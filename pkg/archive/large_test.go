@@ -0,0 +1,139 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// A huge sparse file under a long name goes through a backup in PAX
+// headers, streamed rather than buffered
+func TestBackupHugeFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("backs up a 9 GiB file")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	name := fmtest.LongName(300)
+	fmtest.SparseFile(t, dir, name, fmtest.HugeSize)
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	r, w := io.Pipe()
+	backupErr := make(chan error, 1)
+	go func() {
+		_, err := archive.BackupStream(ctx, dir, w, fsutil.Options{})
+		_ = w.CloseWithError(err)
+		backupErr <- err
+	}()
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	header, err := tarReader.Next()
+	if err != nil {
+		t.Fatalf("failed to read the archive: %v", err)
+	}
+	if header.Name != name || header.Size != fmtest.HugeSize || header.Format != tar.FormatPAX {
+		t.Errorf("entry %s of %d bytes in format %v, want %s of %d bytes in PAX", header.Name, header.Size, header.Format, name, int64(fmtest.HugeSize))
+	}
+	marker := []byte(name)
+	start := make([]byte, len(marker))
+	if _, err := io.ReadFull(tarReader, start); err != nil {
+		t.Fatal(err)
+	}
+	middle, err := io.CopyN(io.Discard, tarReader, header.Size-2*int64(len(marker)))
+	if err != nil {
+		t.Fatalf("archive ends after %d bytes: %v", middle, err)
+	}
+	end, err := io.ReadAll(tarReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(start, marker) || !bytes.Equal(end, marker) {
+		t.Errorf("file restored as %q...%q", start, end)
+	}
+	if _, err := tarReader.Next(); err != io.EOF {
+		t.Errorf("archive goes on after the file: %v", err)
+	}
+	if err := <-backupErr; err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Errorf("backing up and reading the archive allocated %d MiB", allocated>>20)
+	}
+}
+
+// shrinkingFS serves files with less content than their size says, as if
+// they shrank between being listed and being read
+type shrinkingFS struct {
+	*fsutil.MemFS
+	content map[string]string
+}
+
+func (s shrinkingFS) Open(name string) (fs.File, error) {
+	file, err := s.MemFS.Open(name)
+	if content, ok := s.content[name]; ok && err == nil {
+		return shrunkFile{File: file, r: strings.NewReader(content)}, nil
+	}
+	return file, err
+}
+
+type shrunkFile struct {
+	fs.File
+	r io.Reader
+}
+
+func (f shrunkFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func TestBackupFileThatShrank(t *testing.T) {
+	fsys := shrinkingFS{
+		MemFS:   fmtest.Fixture(t, map[string]string{"a.txt": "alpha\n", "b.txt": "bravo\n"}),
+		content: map[string]string{"a.txt": "al"},
+	}
+	events := &fmtest.Recorder{}
+	var out bytes.Buffer
+	if _, err := archive.BackupFS(context.Background(), fsys, &out, fsutil.Options{Observer: events}); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if len(events.Errors) != 1 || events.Errors[0].Name != "a.txt" {
+		t.Errorf("backup reported %+v, want the shrunk a.txt", events.Errors)
+	}
+
+	// The archive stays readable, the missing part archived as zeros
+	tarReader := tar.NewReader(mustGzip(t, &out))
+	for _, want := range []string{"al\x00\x00\x00\x00", "bravo\n"} {
+		if _, err := tarReader.Next(); err != nil {
+			t.Fatalf("failed to read the archive: %v", err)
+		}
+		if got, err := io.ReadAll(tarReader); err != nil || string(got) != want {
+			t.Errorf("entry holds %q (%v), want %q", got, err, want)
+		}
+	}
+}
+
+func mustGzip(t *testing.T, r io.Reader) io.Reader {
+	t.Helper()
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gzipReader
+}
@@ -0,0 +1,88 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// Characters Windows does not allow in file names, besides control
+// characters
+const windowsInvalidChars = `<>:"|?*`
+
+// Device names Windows reserves in every directory, with any extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// CheckWindowsName reports why a slash-separated entry name cannot be
+// created on Windows, or returns nil
+func CheckWindowsName(name string) error {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		if i := strings.IndexFunc(part, func(r rune) bool {
+			return r < 32 || strings.ContainsRune(windowsInvalidChars, r)
+		}); i >= 0 {
+			return fmt.Errorf("archive entry %s: %q is not allowed in Windows file names", name, part[i])
+		}
+		if strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+			return fmt.Errorf("archive entry %s: Windows file names cannot end in a dot or space", name)
+		}
+		base, _, _ := strings.Cut(part, ".")
+		if windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+			return fmt.Errorf("archive entry %s: %s is a reserved device name on Windows", name, part)
+		}
+	}
+	return nil
+}
+
+// Check an entry name against the rules of the host platform
+func checkHostName(name string) error {
+	if runtime.GOOS == "windows" {
+		return CheckWindowsName(name)
+	}
+	return nil
+}
+
+// Permissions recorded for a file in a backup. Windows only knows whether
+// a file is read-only, which its os package reports as 0444 or 0666, so
+// Unix defaults are recorded instead, executable for programs and scripts.
+func windowsMode(name string, mode fs.FileMode) int64 {
+	perm := int64(0o644)
+	switch strings.ToLower(path.Ext(name)) {
+	case ".exe", ".com", ".bat", ".cmd", ".ps1":
+		perm = 0o755
+	}
+	if mode.Perm()&0o200 == 0 {
+		perm &^= 0o222
+	}
+	return perm
+}
+
+// PAX record keeping the name of an entry as it was read when the entry is
+// named by its NFC form
+const originalNameRecord = "FM.original_name"
+
+// Name an entry by the NFC form of path, so that archives of the same tree
+// made on macOS and elsewhere list the same names, recording path itself
+// when it differs
+func setEntryName(header *tar.Header, path string) {
+	header.Name = fsutil.NormalizeName(path)
+	if header.Name == path {
+		return
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = map[string]string{}
+	}
+	header.PAXRecords[originalNameRecord] = path
+}
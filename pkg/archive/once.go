@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// outputLocks serializes the backups of this process writing the same
+// archive, keyed by its absolute path; the repository lock serializes
+// those of different processes
+var outputLocks sync.Map
+
+// BackupOnce backs up directory to output like Backup and records the
+// archive in the catalog, unless the last backup of directory to output
+// was made from the same files and the archive is still there, in which
+// case it is kept and the summary says since when. Running the same backup
+// twice, at once or in succession, so leaves one archive. The catalog
+// entry carries an idempotency key derived from the paths and the names,
+// sizes, modes and modification times of the files; paranoid options
+// back up again whatever they say.
+func BackupOnce(ctx context.Context, metadata *db.DB, directory, output string, opts fsutil.Options) (*BackupSummary, error) {
+	source, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	target, err := filepath.Abs(output)
+	if err != nil {
+		return nil, err
+	}
+	mu, _ := outputLocks.LoadOrStore(target, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	start := time.Now()
+	digest, err := SourceDigest(ctx, directory)
+	if err != nil {
+		return nil, err
+	}
+	key := db.IdempotencyKey("backup", source, target, digest)
+	previous, found, err := db.FindIdempotent(ctx, metadata, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up earlier backups: %w", err)
+	}
+	if info, statErr := os.Stat(target); found && !opts.Paranoid && statErr == nil && info.Size() == previous.Bytes && !Resumable(target) {
+		summary := &BackupSummary{ArchiveBytes: info.Size(), UnchangedSince: &previous.Timestamp}
+		err := db.RecordAction(ctx, metadata, db.Action{
+			ActionType:     "backup_duplicate",
+			Filename:       filepath.Base(target),
+			StorageID:      target,
+			Bytes:          info.Size(),
+			Duration:       time.Since(start),
+			IdempotencyKey: key,
+		})
+		return summary, err
+	}
+
+	summary, err := Backup(ctx, directory, output, opts)
+	if err != nil {
+		return summary, err
+	}
+	// An archive missing files is not the result of backing up these
+	if !summary.Complete() {
+		key = ""
+	}
+	if err := db.AddBackup(ctx, metadata, output, time.Since(start), key); err != nil {
+		return summary, fmt.Errorf("failed to record backup in catalog: %w", err)
+	}
+	return summary, nil
+}
+
+// SourceDigest summarizes the tree at directory by the names, types,
+// sizes, modes and modification times of its files, which change when
+// their contents do. Parts that cannot be read count by their name.
+func SourceDigest(ctx context.Context, directory string) (string, error) {
+	digest := sha256.New()
+	err := fs.WalkDir(fsutil.HostFS(directory), ".", func(name string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		var info fs.FileInfo
+		if err == nil {
+			info, err = d.Info()
+		}
+		if err != nil {
+			if name == "." && !errors.Is(err, fs.ErrPermission) {
+				return fmt.Errorf("failed to read %s: %w", directory, err)
+			}
+			fmt.Fprintf(digest, "%s\x00unreadable\n", name)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fmt.Fprintf(digest, "%s\x00%s\x00%d\x00%d\n", name, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
@@ -0,0 +1,178 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RetentionPolicy describes how many backups to keep per period (GFS rotation)
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+}
+
+// ApplyRetention decides which backups to keep and returns their IDs.
+// Backups must be sorted newest first.
+func ApplyRetention(backups []db.Backup, policy RetentionPolicy) map[int64]bool {
+	keep := make(map[int64]bool)
+
+	for i := 0; i < len(backups) && i < policy.KeepLast; i++ {
+		keep[backups[i].ID] = true
+	}
+
+	buckets := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	for _, bucket := range buckets {
+		seen := make(map[string]bool)
+		for _, b := range backups {
+			if len(seen) >= bucket.count {
+				break
+			}
+			period := bucket.period(b.Timestamp.Local())
+			if seen[period] {
+				continue
+			}
+			seen[period] = true
+			keep[b.ID] = true
+		}
+	}
+
+	return keep
+}
+
+// PruneReport lists the retention decision for each catalogued backup,
+// newest first
+type PruneReport struct {
+	DryRun bool        `json:"dry_run"` // nothing was deleted
+	Kept   []db.Backup `json:"kept"`
+	Pruned []db.Backup `json:"pruned"` // deleted, or to be deleted in a dry run
+
+	// Retained lists the backups the policy would prune but a retention
+	// lock or legal hold keeps
+	Retained []db.Backup `json:"retained"`
+}
+
+// Print the report in a human-readable form
+func (r *PruneReport) Print() {
+	for _, b := range r.Kept {
+		fmt.Printf("keep   %s (%s)\n", b.Path, b.Timestamp.Local().Format(time.DateTime))
+	}
+	for _, b := range r.Retained {
+		fmt.Printf("retain %s (%s)\n", b.Path, b.Timestamp.Local().Format(time.DateTime))
+	}
+	verb := "pruned"
+	if r.DryRun {
+		verb = "would prune"
+	}
+	for _, b := range r.Pruned {
+		fmt.Printf("%s %s (%s)\n", verb, b.Path, b.Timestamp.Local().Format(time.DateTime))
+	}
+}
+
+// Prune deletes catalogued backups that fall outside the retention policy,
+// except those a repository-wide retention lock retains and those holding
+// files under a legal hold
+func Prune(ctx context.Context, metadata *db.DB, policy RetentionPolicy, dryRun bool) (*PruneReport, error) {
+	report := &PruneReport{DryRun: dryRun}
+	if policy.KeepLast+policy.KeepDaily+policy.KeepWeekly+policy.KeepMonthly == 0 {
+		return report, fmt.Errorf("refusing to prune without any -keep-* option")
+	}
+
+	backups, err := db.ListBackups(ctx, metadata)
+	if err != nil {
+		return report, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	holds, err := db.ActiveHolds(ctx, metadata)
+	if err != nil {
+		return report, err
+	}
+
+	keep := ApplyRetention(backups, policy)
+	for _, b := range backups {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if keep[b.ID] {
+			report.Kept = append(report.Kept, b)
+			continue
+		}
+		err := db.CheckBackupRetention(ctx, metadata, b)
+		if err == nil {
+			err = checkBackupHolds(b, holds)
+		}
+		if db.IsRefused(err) {
+			report.Retained = append(report.Retained, b)
+			if !dryRun {
+				if err := db.RecordAction(ctx, metadata, db.Action{ActionType: "prune", Filename: filepath.Base(b.Path), StorageID: b.Path, Err: err}); err != nil {
+					return report, err
+				}
+			}
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		if dryRun {
+			report.Pruned = append(report.Pruned, b)
+			continue
+		}
+
+		// The archive is deleted last so a failure leaves the catalog untouched
+		err = db.WithTx(ctx, metadata, func(tx *db.Tx) error {
+			if err := db.RemoveBackup(ctx, tx, b); err != nil {
+				return err
+			}
+			if err := os.Remove(b.Path + IndexSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to delete index of backup %s: %w", b.Path, err)
+			}
+			if err := os.Remove(b.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to delete backup %s: %w", b.Path, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+		report.Pruned = append(report.Pruned, b)
+	}
+
+	return report, nil
+}
+
+// Fail with ErrHeld when the backup holds a file a legal hold covers. A
+// backup without an index could hold any file, so it is kept while any
+// hold is active.
+func checkBackupHolds(b db.Backup, holds []db.LegalHold) error {
+	if len(holds) == 0 {
+		return nil
+	}
+	idx, err := ReadIndex(b.Path)
+	if err != nil {
+		return fmt.Errorf("%w: backup %s has no readable index to tell which files it holds, while %s is active", db.ErrHeld, b.Path, holds[0])
+	}
+	for _, e := range idx.Entries {
+		for _, h := range holds {
+			if h.Covers(e.Name) {
+				return fmt.Errorf("%w: backup %s holds %s, which %s covers", db.ErrHeld, b.Path, e.Name, h)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RestoreReport lists what a restore did to the target directory
+type RestoreReport struct {
+	Created     []string `json:"created"`
+	Overwritten []string `json:"overwritten"`
+	Failed      []string `json:"failed"`
+	Renamed     []string `json:"renamed,omitempty"` // entries whose names collided, as "name -> restored name"
+	Skipped     []string `json:"skipped,omitempty"` // entries whose names collided
+}
+
+// Print the report in a human-readable form
+func (r *RestoreReport) Print() {
+	for _, name := range r.Created {
+		fmt.Printf("created     %s\n", name)
+	}
+	for _, name := range r.Overwritten {
+		fmt.Printf("overwritten %s\n", name)
+	}
+	for _, name := range r.Failed {
+		fmt.Printf("failed      %s\n", name)
+	}
+	for _, name := range r.Renamed {
+		fmt.Printf("renamed     %s\n", name)
+	}
+	for _, name := range r.Skipped {
+		fmt.Printf("skipped     %s\n", name)
+	}
+	fmt.Printf("Restore summary: %d created, %d overwritten, %d failed, %d renamed, %d skipped\n",
+		len(r.Created), len(r.Overwritten), len(r.Failed), len(r.Renamed), len(r.Skipped))
+}
+
+// journalEntry records a single change made to the target directory
+type journalEntry struct {
+	target string // path inside the target directory
+	saved  string // previous content moved aside, empty if target was created
+	isDir  bool
+}
+
+// Restore files from a compressed archive. The archive is first extracted
+// into a staging directory inside targetDir; only when that succeeds are the
+// entries moved into place. If moving fails, every change is rolled back.
+// Extraction writes small files with the given number of workers. Entries
+// whose names collide on a case-insensitive target are handled by policy.
+func Restore(ctx context.Context, archive, targetDir string, workers int, policy CollisionPolicy, opts fsutil.Options) (*RestoreReport, error) {
+	report := &RestoreReport{}
+	targetDir = fsutil.LongPath(targetDir)
+
+	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return report, fmt.Errorf("failed to create target directory: %w", err)
+	}
+
+	staging, err := os.MkdirTemp(targetDir, ".fm-restore-")
+	if err != nil {
+		return report, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer func(staging string) {
+		err := os.RemoveAll(staging)
+		if err != nil {
+			fmt.Printf("Failed to remove staging directory: %v\n", err)
+		}
+	}(staging)
+
+	tracker, err := newCollisions(fsutil.DirFS(targetDir), policy)
+	if err != nil {
+		return report, err
+	}
+	extracted := filepath.Join(staging, "new")
+	entries, err := extractArchive(ctx, archive, extracted, workers, tracker, opts)
+	tracker.report(report)
+	if err != nil {
+		var entryErr *restoreEntryError
+		if errors.As(err, &entryErr) {
+			report.Failed = append(report.Failed, entryErr.name)
+		}
+		return report, err
+	}
+
+	saved := filepath.Join(staging, "old")
+	var journal []journalEntry
+	touched := map[string]bool{targetDir: true}
+	for _, name := range entries {
+		entry, err := commitEntry(name, extracted, saved, targetDir, &journal)
+		if err == nil {
+			// An interrupted restore is rolled back like a failed one
+			err = ctx.Err()
+		}
+		if err != nil {
+			report.Failed = append(report.Failed, name)
+			if rbErr := rollback(journal); rbErr != nil {
+				return report, fmt.Errorf("failed to restore %s: %w (rollback incomplete: %v)", name, err, rbErr)
+			}
+			report.Created, report.Overwritten = nil, nil
+			return report, fmt.Errorf("failed to restore %s, changes rolled back: %w", name, err)
+		}
+		if entry == nil || entry.isDir {
+			continue
+		}
+		touched[filepath.Dir(entry.target)] = true
+		if entry.saved == "" {
+			report.Created = append(report.Created, name)
+		} else {
+			report.Overwritten = append(report.Overwritten, name)
+		}
+	}
+
+	for _, entry := range journal {
+		if entry.isDir {
+			touched[filepath.Dir(entry.target)] = true
+		}
+	}
+	for dir := range touched {
+		if err := opts.SyncDir(dir); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// restoreEntryError identifies the archive entry that failed to extract
+type restoreEntryError struct {
+	name string
+	err  error
+}
+
+func (e *restoreEntryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *restoreEntryError) Unwrap() error {
+	return e.err
+}
+
+// Walk calls fn for every entry of a tar.gz archive, in archive order,
+// until ctx is cancelled
+func Walk(ctx context.Context, archive string, opts fsutil.Options, fn func(header *tar.Header, r io.Reader) error) error {
+	inFile, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer func(inFile *os.File) {
+		err := inFile.Close()
+		if err != nil {
+			fmt.Printf("Failed to close archive file: %v\n", err)
+		}
+	}(inFile)
+
+	return WalkReader(ctx, opts.Reader(ctx, inFile), fn)
+}
+
+// WalkReader calls fn for every entry of a tar.gz stream, in archive order,
+// until ctx is cancelled
+func WalkReader(ctx context.Context, r io.Reader, fn func(header *tar.Header, r io.Reader) error) error {
+	gzipReader, err := gzip.NewReader(fsutil.ContextReader(ctx, r))
+	if err != nil {
+		return fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer func(gzipReader *gzip.Reader) {
+		err := gzipReader.Close()
+		if err != nil {
+			fmt.Printf("Failed to close gzip reader: %v\n", err)
+		}
+	}(gzipReader)
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+		if err := fn(header, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// Entries up to this size are buffered and written by the worker pool;
+// larger ones are streamed straight to disk by the reading goroutine.
+const parallelExtractLimit = 1 << 20
+
+// extractJob is a buffered file waiting to be written by a worker
+type extractJob struct {
+	name    string
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+	xattrs  map[string][]byte
+	data    []byte
+}
+
+// Extract a tar.gz archive into dir using the given number of writer
+// workers, and return the relative entry names in an order where parents
+// precede their children. Files are extracted under the names tracker
+// resolves them to.
+func extractArchive(ctx context.Context, archive, dir string, workers int, tracker *collisions, opts fsutil.Options) ([]string, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan extractJob, workers*2)
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	setErr := func(err error) {
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+	}
+	failed := func() bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return firstErr != nil
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if failed() {
+					continue
+				}
+				if err := extractFile(ctx, bytes.NewReader(job.data), int64(len(job.data)), false, job.path, job.mode, job.modTime, job.xattrs, opts); err != nil {
+					setErr(&restoreEntryError{name: job.name, err: err})
+				}
+			}
+		}()
+	}
+
+	var entries []string
+	walkErr := Walk(ctx, archive, opts, func(header *tar.Header, r io.Reader) error {
+		if failed() {
+			return errAborted
+		}
+
+		name, err := SanitizeEntryName(header.Name)
+		if err != nil {
+			return &restoreEntryError{name: header.Name, err: err}
+		}
+		if header.Typeflag != tar.TypeDir {
+			resolved, err := tracker.resolve(filepath.ToSlash(name))
+			if err != nil {
+				return &restoreEntryError{name: name, err: err}
+			}
+			if resolved == "" {
+				return nil
+			}
+			name = filepath.FromSlash(resolved)
+		}
+		targetPath := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(targetPath, os.FileMode(header.Mode).Perm()|0o700); err != nil {
+				return &restoreEntryError{name: name, err: fmt.Errorf("failed to create directory %s: %w", name, err)}
+			}
+		case tar.TypeReg, tar.TypeGNUSparse:
+			if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
+				return &restoreEntryError{name: name, err: fmt.Errorf("failed to create directory for file %s: %w", name, err)}
+			}
+			mode := os.FileMode(header.Mode)
+			if sparse := isSparse(header); sparse || header.Size > parallelExtractLimit || workers == 1 {
+				if err := extractFile(ctx, r, header.Size, sparse, targetPath, mode, header.ModTime, headerXattrs(header), opts); err != nil {
+					return &restoreEntryError{name: name, err: err}
+				}
+				break
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return &restoreEntryError{name: name, err: fmt.Errorf("failed to read %s from archive: %w", name, err)}
+			}
+			jobs <- extractJob{name: name, path: targetPath, mode: mode, modTime: header.ModTime, xattrs: headerXattrs(header), data: data}
+		default:
+			return &restoreEntryError{name: name, err: fmt.Errorf("unsupported header type: %c in %s", header.Typeflag, header.Name)}
+		}
+		entries = append(entries, name)
+		return nil
+	})
+
+	close(jobs)
+	wg.Wait()
+
+	if walkErr != nil && !errors.Is(walkErr, errAborted) {
+		return nil, walkErr
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Strings(entries)
+	return entries, nil
+}
+
+// Write the size bytes of r to an empty file, allocating them up front
+func copyPreallocated(ctx context.Context, file *os.File, r io.Reader, size int64) error {
+	if err := fsutil.Preallocate(file, size); err != nil {
+		return err
+	}
+	written, err := fsutil.Copy(ctx, file, r)
+	if err != nil {
+		return err
+	}
+	return fsutil.TrimPreallocated(file, written, size)
+}
+
+// errAborted stops an archive walk after a worker has already failed
+var errAborted = errors.New("aborted")
+
+// Write the size bytes of r to path and apply the entry's extended
+// attributes and modification time. A sparse entry is written leaving holes
+// where it holds zeros.
+func extractFile(ctx context.Context, r io.Reader, size int64, sparse bool, path string, mode os.FileMode, modTime time.Time, xattrs map[string][]byte, opts fsutil.Options) error {
+	outFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", path, err)
+	}
+
+	if sparse {
+		err = copySparse(ctx, outFile, r)
+	} else {
+		err = copyPreallocated(ctx, outFile, r, size)
+	}
+	if err != nil {
+		_ = outFile.Close()
+		return fmt.Errorf("failed to extract file %s: %w", path, err)
+	}
+	restoreXattrs(outFile, path, xattrs, opts)
+	if err := opts.SyncFile(outFile); err != nil {
+		_ = outFile.Close()
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", path, err)
+	}
+
+	if !modTime.IsZero() {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// SanitizeEntryName rejects archive entry names that would escape the
+// target directory or cannot be created on this platform, and returns the
+// cleaned, OS-specific name, in the Unicode normalization form of the
+// platform
+func SanitizeEntryName(name string) (string, error) {
+	if err := checkHostName(name); err != nil {
+		return "", err
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %s escapes the target directory", name)
+	}
+	return fsutil.HostName(cleaned), nil
+}
+
+// Move one extracted entry into the target directory, journaling the change
+func commitEntry(name, extracted, saved, targetDir string, journal *[]journalEntry) (*journalEntry, error) {
+	src := filepath.Join(extracted, name)
+	dest := filepath.Join(targetDir, name)
+
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	destInfo, err := os.Lstat(dest)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if srcInfo.IsDir() {
+		if exists {
+			if !destInfo.IsDir() {
+				return nil, fmt.Errorf("%s exists and is not a directory", dest)
+			}
+			return nil, nil
+		}
+		if err := os.Mkdir(dest, srcInfo.Mode().Perm()); err != nil {
+			return nil, err
+		}
+		entry := journalEntry{target: dest, isDir: true}
+		*journal = append(*journal, entry)
+		return &entry, nil
+	}
+
+	if err := createParents(targetDir, name, journal); err != nil {
+		return nil, err
+	}
+
+	entry := journalEntry{target: dest}
+	if exists {
+		if destInfo.IsDir() {
+			return nil, fmt.Errorf("%s exists and is a directory", dest)
+		}
+		entry.saved = filepath.Join(saved, name)
+		if err := os.MkdirAll(filepath.Dir(entry.saved), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(dest, entry.saved); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(src, dest); err != nil {
+		if entry.saved != "" {
+			if restoreErr := os.Rename(entry.saved, dest); restoreErr != nil {
+				return nil, fmt.Errorf("%w (and failed to put back original: %v)", err, restoreErr)
+			}
+		}
+		return nil, err
+	}
+
+	*journal = append(*journal, entry)
+	return &entry, nil
+}
+
+// Create the missing parent directories of name inside targetDir, journaling each
+func createParents(targetDir, name string, journal *[]journalEntry) error {
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return nil
+	}
+
+	current := targetDir
+	for _, part := range strings.Split(dir, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s exists and is not a directory", current)
+			}
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Mkdir(current, os.ModePerm); err != nil {
+			return err
+		}
+		*journal = append(*journal, journalEntry{target: current, isDir: true})
+	}
+	return nil
+}
+
+// Undo journaled changes in reverse order
+func rollback(journal []journalEntry) error {
+	var errs []error
+	for i := len(journal) - 1; i >= 0; i-- {
+		entry := journal[i]
+		if err := os.Remove(entry.target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		if entry.saved != "" {
+			if err := os.Rename(entry.saved, entry.target); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
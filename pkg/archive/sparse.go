@@ -0,0 +1,195 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// blockSize is the unit tar archives are written in
+const blockSize = 512
+
+// maxOctal11 is the largest number an 11-digit octal header field holds,
+// such as the size of a ustar entry
+const maxOctal11 = 1<<33 - 1
+
+// Report whether an archive entry holds a sparse file, which restoring
+// leaves holes in
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for _, key := range []string{"GNU.sparse.major", "GNU.sparse.map", "GNU.sparse.numblocks"} {
+		if _, ok := header.PAXRecords[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the data regions of a file to archive as a sparse entry, if it is
+// a regular file on disk with holes
+func sparseRegions(file fs.File, header *tar.Header) ([]fsutil.Region, bool) {
+	osFile, ok := file.(*os.File)
+	if !ok || header.Typeflag != tar.TypeReg {
+		return nil, false
+	}
+	regions, sparse, err := fsutil.DataRegions(osFile, header.Size)
+	if err != nil || !sparse {
+		return nil, false
+	}
+	return regions, true
+}
+
+// Write a sparse file to the tar stream w as a GNU sparse entry in PAX
+// format 1.0: only its data regions are stored, after a map of where they
+// belong. archive/tar reads these entries but cannot write them, so the
+// blocks are encoded here; tarWriter is flushed first so that the entry
+// starts on a block boundary.
+func writeSparseEntry(ctx context.Context, tarWriter *tar.Writer, w io.Writer, header *tar.Header, file *os.File, regions []fsutil.Region, opts fsutil.Options) (int64, error) {
+	if err := tarWriter.Flush(); err != nil {
+		return 0, err
+	}
+
+	// The map lists the regions, ending with an empty one at the end of
+	// the file when it ends in a hole
+	if len(regions) == 0 || regions[len(regions)-1].Offset+regions[len(regions)-1].Length < header.Size {
+		regions = append(regions, fsutil.Region{Offset: header.Size})
+	}
+	sparseMap := strconv.AppendInt(nil, int64(len(regions)), 10)
+	sparseMap = append(sparseMap, '\n')
+	stored := int64(0)
+	for _, r := range regions {
+		sparseMap = strconv.AppendInt(sparseMap, r.Offset, 10)
+		sparseMap = append(sparseMap, '\n')
+		sparseMap = strconv.AppendInt(sparseMap, r.Length, 10)
+		sparseMap = append(sparseMap, '\n')
+		stored += r.Length
+	}
+	sparseMap = append(sparseMap, make([]byte, padding(int64(len(sparseMap))))...)
+	stored += int64(len(sparseMap))
+
+	records := paxRecord("GNU.sparse.major", "1") +
+		paxRecord("GNU.sparse.minor", "0") +
+		paxRecord("GNU.sparse.name", header.Name) +
+		paxRecord("GNU.sparse.realsize", strconv.FormatInt(header.Size, 10))
+	if stored > maxOctal11 {
+		records += paxRecord("size", strconv.FormatInt(stored, 10))
+	}
+	keys := make([]string, 0, len(header.PAXRecords))
+	for key := range header.PAXRecords {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		records += paxRecord(key, header.PAXRecords[key])
+	}
+	dir, base := path.Split(header.Name)
+	extended := *header
+	extended.Name = "PaxHeaders.0/" + base
+	extended.Mode = 0o644
+	extended.Size = int64(len(records))
+	if err := writeBlocks(w, ustarBlock(&extended, tar.TypeXHeader), []byte(records)); err != nil {
+		return 0, err
+	}
+	entry := *header
+	entry.Name = path.Join(dir, "GNUSparseFile.0", base)
+	entry.Size = stored
+	if err := writeBlocks(w, ustarBlock(&entry, tar.TypeReg), sparseMap); err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for _, r := range regions {
+		n, err := copyEntry(ctx, w, io.NewSectionReader(file, r.Offset, r.Length), r.Length, header.Name, opts)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	if pad := padding(written); pad > 0 {
+		if _, err := w.Write(make([]byte, pad)); err != nil {
+			return written, err
+		}
+	}
+	return header.Size, nil
+}
+
+// Write a header block followed by content padded to whole blocks
+func writeBlocks(w io.Writer, block, content []byte) error {
+	if _, err := w.Write(block); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding(int64(len(content)))))
+	return err
+}
+
+// Return the bytes that pad n to whole blocks
+func padding(n int64) int64 {
+	return -n & (blockSize - 1)
+}
+
+// Encode a ustar header block. Names are cut to fit, as the PAX records
+// before the block carry the full ones; numbers that do not fit are 0.
+func ustarBlock(header *tar.Header, typeflag byte) []byte {
+	block := make([]byte, blockSize)
+	str := func(offset, length int, s string) {
+		copy(block[offset:offset+length-1], s)
+	}
+	num := func(offset, length int, n int64) {
+		if n < 0 || n >= 1<<(3*(length-1)) {
+			n = 0
+		}
+		copy(block[offset:], fmt.Sprintf("%0*o", length-1, n))
+	}
+	str(0, 100, header.Name)
+	num(100, 8, header.Mode&0o7777)
+	num(108, 8, int64(header.Uid))
+	num(116, 8, int64(header.Gid))
+	num(124, 12, header.Size)
+	num(136, 12, header.ModTime.Unix())
+	block[156] = typeflag
+	copy(block[257:], "ustar\x0000")
+	str(265, 32, header.Uname)
+	str(297, 32, header.Gname)
+
+	// The checksum is computed with its own field as spaces
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, b := range block {
+		sum += int(b)
+	}
+	copy(block[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+// Format a PAX record, which starts with its own length
+func paxRecord(key, value string) string {
+	size := len(key) + len(value) + 3 // space, '=' and newline
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	if len(record) != size {
+		// The length gained a digit
+		record = strconv.Itoa(len(record)) + " " + key + "=" + value + "\n"
+	}
+	return record
+}
+
+// Write r to an empty file, leaving holes for its runs of zeros
+func copySparse(ctx context.Context, file *os.File, r io.Reader) error {
+	w := fsutil.NewSparseWriter(file)
+	if _, err := fsutil.Copy(ctx, w, r); err != nil {
+		return err
+	}
+	return w.Finish()
+}
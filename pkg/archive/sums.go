@@ -0,0 +1,42 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Sums hashes the regular files of a backup archive under algorithm, in
+// archive order, naming them by their slash-separated paths in it
+func Sums(ctx context.Context, archive string, algorithm hash.Algorithm, opts fsutil.Options) ([]hash.Sum, error) {
+	inFile, err := os.Open(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive file: %w", err)
+	}
+	defer func() {
+		_ = inFile.Close()
+	}()
+
+	var sums []hash.Sum
+	err = WalkReader(ctx, opts.Reader(ctx, inFile), func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeGNUSparse {
+			return nil
+		}
+		name, err := SanitizeEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		digest, err := algorithm.Reader(ctx, r)
+		if err != nil {
+			return fmt.Errorf("failed to hash archive entry %s: %w", name, err)
+		}
+		sums = append(sums, hash.Sum{Digest: digest, Name: filepath.ToSlash(name)})
+		return nil
+	})
+	return sums, err
+}
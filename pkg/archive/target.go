@@ -0,0 +1,127 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// RestoreTo extracts a tar.gz stream into target entry by entry. Unlike
+// Restore there is no staging or rollback; an error leaves the entries
+// written so far in place. Report names are slash-separated. Entries whose
+// names collide on a case-insensitive target are handled by policy.
+func RestoreTo(ctx context.Context, r io.Reader, target fsutil.WriteFS, policy CollisionPolicy, opts fsutil.Options) (*RestoreReport, error) {
+	report := &RestoreReport{}
+	tracker, err := newCollisions(target, policy)
+	if err != nil {
+		return report, err
+	}
+	err = WalkReader(ctx, r, func(header *tar.Header, r io.Reader) error {
+		return restoreEntry(ctx, header, r, target, tracker, report, opts)
+	})
+	tracker.report(report)
+	return report, err
+}
+
+// Write one archive entry into target under the name tracker resolves it
+// to, recording it in report
+func restoreEntry(ctx context.Context, header *tar.Header, r io.Reader, target fsutil.WriteFS, tracker *collisions, report *RestoreReport, opts fsutil.Options) error {
+	cleaned, err := SanitizeEntryName(header.Name)
+	if err != nil {
+		report.Failed = append(report.Failed, header.Name)
+		return err
+	}
+	name := filepath.ToSlash(cleaned)
+	if header.Typeflag != tar.TypeDir {
+		resolved, err := tracker.resolve(name)
+		if err != nil {
+			report.Failed = append(report.Failed, name)
+			return err
+		}
+		if resolved == "" {
+			return nil
+		}
+		name = resolved
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := target.MkdirAll(name, fs.FileMode(header.Mode).Perm()|0o700); err != nil {
+			report.Failed = append(report.Failed, name)
+			return fmt.Errorf("failed to create directory %s: %w", name, err)
+		}
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if err := target.MkdirAll(path.Dir(name), os.ModePerm); err != nil {
+			report.Failed = append(report.Failed, name)
+			return fmt.Errorf("failed to create directory for file %s: %w", name, err)
+		}
+		_, statErr := fs.Stat(target, name)
+		if statErr != nil && !errors.Is(statErr, fs.ErrNotExist) {
+			report.Failed = append(report.Failed, name)
+			return statErr
+		}
+		if err := writeEntry(ctx, target, name, r, header, opts); err != nil {
+			report.Failed = append(report.Failed, name)
+			return err
+		}
+		if statErr == nil {
+			report.Overwritten = append(report.Overwritten, name)
+		} else {
+			report.Created = append(report.Created, name)
+		}
+	default:
+		report.Failed = append(report.Failed, name)
+		return fmt.Errorf("unsupported header type: %c in %s", header.Typeflag, header.Name)
+	}
+	return nil
+}
+
+// Write one regular archive entry into target and apply its extended
+// attributes and modification time
+func writeEntry(ctx context.Context, target fsutil.WriteFS, name string, r io.Reader, header *tar.Header, opts fsutil.Options) error {
+	w, err := target.Create(name, fs.FileMode(header.Mode).Perm()|0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", name, err)
+	}
+
+	file, ok := w.(*os.File)
+	switch {
+	case ok && isSparse(header):
+		err = copySparse(ctx, file, r)
+	case ok:
+		err = fsutil.Preallocate(file, header.Size)
+		if err == nil {
+			_, err = fsutil.Copy(ctx, w, r)
+		}
+	default:
+		_, err = fsutil.Copy(ctx, w, r)
+	}
+	if err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to extract file %s: %w", name, err)
+	}
+	if ok {
+		restoreXattrs(file, name, headerXattrs(header), opts)
+		if err := opts.SyncFile(file); err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", name, err)
+	}
+
+	if !header.ModTime.IsZero() {
+		if err := target.Chtimes(name, header.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", name, err)
+		}
+	}
+	return nil
+}
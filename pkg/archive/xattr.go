@@ -0,0 +1,61 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// xattrPrefix starts the PAX records holding extended attributes, named
+// as GNU tar and bsdtar name them so that either restores them too
+const xattrPrefix = "SCHILY.xattr."
+
+// Record the extended attributes of a file, ACLs and SELinux labels
+// included, in the PAX records of its header. Files not on the host have
+// none.
+func addXattrs(header *tar.Header, file fs.File) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return nil
+	}
+	attrs, err := fsutil.Xattrs(osFile)
+	if err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[xattrPrefix+name] = string(value)
+	}
+	return nil
+}
+
+// Return the extended attributes recorded in the PAX records of a header
+func headerXattrs(header *tar.Header) map[string][]byte {
+	var attrs map[string][]byte
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, xattrPrefix)
+		if !ok {
+			continue
+		}
+		if attrs == nil {
+			attrs = map[string][]byte{}
+		}
+		attrs[name] = []byte(value)
+	}
+	return attrs
+}
+
+// Set the extended attributes recorded for an entry on the file extracted
+// from it. Those that cannot be set, such as SELinux labels without the
+// privilege to set them, are reported without failing the restore.
+func restoreXattrs(file *os.File, name string, attrs map[string][]byte, opts fsutil.Options) {
+	if err := fsutil.SetXattrs(file, attrs); err != nil {
+		opts.Events().OnError(event.Error{Op: "restore", Name: name, Err: fmt.Errorf("failed to restore extended attributes: %w", err)})
+	}
+}
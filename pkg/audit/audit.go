@@ -0,0 +1,337 @@
+// Package audit exports the action log for auditors as signed CSV or JSON
+// reports, and verifies those reports against their signatures.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// report is an audit export in JSON
+type report struct {
+	Repository  string          `json:"repository"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Since       *time.Time      `json:"since,omitempty"`
+	Until       *time.Time      `json:"until,omitempty"`
+	Actions     []db.AuditEntry `json:"actions"`
+}
+
+// Signature is written next to an audit export as <report>.sig. The
+// signature is made over this JSON document without it, so that the
+// timestamp and range are signed along with the digest of the report.
+type Signature struct {
+	Report      string     `json:"report"` // base name of the report
+	Format      string     `json:"format"`
+	SHA256      string     `json:"sha256"`
+	Entries     int        `json:"entries"`
+	Repository  string     `json:"repository"`
+	GeneratedAt time.Time  `json:"generated_at"`
+	Since       *time.Time `json:"since,omitempty"`
+	Until       *time.Time `json:"until,omitempty"`
+	PublicKey   string     `json:"public_key"` // base64 PKIX DER of the Ed25519 key
+	Signature   string     `json:"signature,omitempty"`
+}
+
+// Return the bytes the signature of an audit export is made over
+func (s Signature) payload() ([]byte, error) {
+	s.Signature = ""
+	return json.Marshal(s)
+}
+
+// Signer returns the fingerprint of the key that made the signature
+func (s Signature) Signer() string {
+	publicKey, _ := base64.StdEncoding.DecodeString(s.PublicKey)
+	return Fingerprint(publicKey)
+}
+
+// Parse a -since or -until date: a prefix of YYYY-MM-DD such as 2024 or
+// 2024-06 in local time, or an RFC 3339 time. An -until date covers the
+// whole period it names, so the range ends where the period after it
+// starts.
+func parseDate(value string, until bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	for _, p := range []struct {
+		layout              string
+		years, months, days int
+	}{{"2006", 1, 0, 0}, {"2006-01", 0, 1, 0}, {"2006-01-02", 0, 0, 1}} {
+		t, err := time.ParseInLocation(p.layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if until {
+			t = t.AddDate(p.years, p.months, p.days)
+		}
+		return &t, nil
+	}
+	return nil, fmt.Errorf("invalid date %q (use a prefix of YYYY-MM-DD, such as 2024 or 2024-06-30, or an RFC 3339 time)", value)
+}
+
+// Export writes the actions of repository logged between since and until
+// to output as a CSV or JSON report for auditors, signed in output.sig with
+// the key at keyPath, which is created on first use. It returns the
+// signature written.
+func Export(ctx context.Context, metadata *db.DB, repository, keyPath, since, until, format, output string) (*Signature, error) {
+	from, err := parseDate(since, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -since: %w", err)
+	}
+	to, err := parseDate(until, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -until: %w", err)
+	}
+	var fromTime, toTime time.Time
+	if from != nil {
+		fromTime = *from
+	}
+	if to != nil {
+		toTime = *to
+	}
+	entries, err := db.AuditActions(ctx, metadata, fromTime, toTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read actions: %w", err)
+	}
+
+	exported := report{Repository: repository, GeneratedAt: time.Now().UTC(), Since: from, Until: to, Actions: entries}
+	var buf bytes.Buffer
+	if format == "" {
+		format = "json"
+	}
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(exported)
+	case "csv":
+		err = writeCSV(&buf, entries)
+	default:
+		return nil, fmt.Errorf("unknown audit export format %q (use json, csv)", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(buf.Bytes())
+	signature := Signature{
+		Report:      filepath.Base(output),
+		Format:      format,
+		SHA256:      hex.EncodeToString(digest[:]),
+		Entries:     len(entries),
+		Repository:  exported.Repository,
+		GeneratedAt: exported.GeneratedAt,
+		Since:       from,
+		Until:       to,
+		PublicKey:   base64.StdEncoding.EncodeToString(publicKey),
+	}
+	payload, err := signature.payload()
+	if err != nil {
+		return nil, err
+	}
+	signature.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	signed, err := json.MarshalIndent(signature, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := os.WriteFile(output+".sig", append(signed, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write signature: %w", err)
+	}
+	return &signature, nil
+}
+
+// Write audit entries as CSV with a header row
+func writeCSV(buf *bytes.Buffer, entries []db.AuditEntry) error {
+	w := csv.NewWriter(buf)
+	header := []string{"id", "timestamp", "principal", "role", "remote_addr", "hostname", "action", "filename", "storage_id", "bytes", "duration_ms", "outcome", "error", "tool_version"}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		row := []string{strconv.FormatInt(e.ID, 10), e.Timestamp.UTC().Format(time.RFC3339), e.Principal, e.Role, e.RemoteAddr, e.Hostname,
+			e.ActionType, e.Filename, e.StorageID, strconv.FormatInt(e.Bytes, 10), strconv.FormatInt(e.DurationMs, 10), e.Outcome, e.Error, e.ToolVersion}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Load the Ed25519 key signing audit exports, creating it on first use
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, fmt.Errorf("failed to create audit key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to read audit key %s: not a PEM file", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit key %s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to read audit key %s: not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+// Read the public half of a PEM key trusted to sign audit exports: a
+// public key, or the private key signing them
+func readPublicKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to read trusted key %s: not a PEM file", path)
+	}
+	var key any
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "PRIVATE KEY":
+		var private any
+		if private, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			if signer, ok := private.(ed25519.PrivateKey); ok {
+				key = signer.Public()
+			}
+		}
+	default:
+		return nil, fmt.Errorf("failed to read trusted key %s: unexpected PEM block %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted key %s: %w", path, err)
+	}
+	if _, ok := key.(ed25519.PublicKey); !ok {
+		return nil, fmt.Errorf("failed to read trusted key %s: not an Ed25519 key", path)
+	}
+	return x509.MarshalPKIXPublicKey(key)
+}
+
+// Check that an audit export was signed by the trusted key, given by its
+// fingerprint as audit-export prints it or as a PEM file
+func trustKey(publicKey []byte, trusted string) error {
+	signer := Fingerprint(publicKey)
+	if strings.HasPrefix(trusted, "SHA256:") {
+		if signer != trusted {
+			return fmt.Errorf("the report was signed by key %s instead of the trusted key %s", signer, trusted)
+		}
+		return nil
+	}
+	expected, err := readPublicKey(trusted)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, publicKey) {
+		return fmt.Errorf("the report was signed by key %s instead of the trusted key %s", signer, Fingerprint(expected))
+	}
+	return nil
+}
+
+// Verify checks the audit export at path against its signature in
+// path.sig, which must be made by the trusted key: its fingerprint as
+// Fingerprint returns it, or a PEM file of it. It returns the signature
+// of an intact report.
+func Verify(path, trusted string) (*Signature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report: %w", err)
+	}
+	sigData, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+	var signature Signature
+	if err := json.Unmarshal(sigData, &signature); err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(signature.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in signature: %w", err)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in signature: %w", err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid public key in signature: not an Ed25519 key")
+	}
+	if err := trustKey(publicKey, trusted); err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	payload, err := signature.payload()
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return nil, errors.New("the signature does not match: the signature file was altered")
+	}
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != signature.SHA256 {
+		return nil, errors.New("the report does not match its signature: it was altered")
+	}
+	return &signature, nil
+}
+
+// Fingerprint returns a short fingerprint of a public key for people to
+// compare
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
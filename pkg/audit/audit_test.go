@@ -0,0 +1,56 @@
+package audit_test
+
+import (
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/audit"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportVerify(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	if _, err := repo.Store.StoreReader(ctx, "a.txt", strings.NewReader("alpha\n")); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	key := filepath.Join(dir, "audit_key.pem")
+	report := filepath.Join(dir, "audit.csv")
+
+	exported, err := audit.Export(ctx, repo.DB, "repo", key, "", "", "csv", report)
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if exported.Entries == 0 || exported.Repository != "repo" {
+		t.Errorf("export signed %+v", exported)
+	}
+	// The key is trusted by its fingerprint or by its file
+	for _, trusted := range []string{exported.Signer(), key} {
+		verified, err := audit.Verify(report, trusted)
+		if err != nil {
+			t.Fatalf("verifying with %s failed: %v", trusted, err)
+		}
+		if verified.Entries != exported.Entries || verified.Signer() != exported.Signer() {
+			t.Errorf("verified %+v, want %+v", verified, exported)
+		}
+	}
+	if _, err := audit.Verify(report, "SHA256:other"); err == nil {
+		t.Error("a report signed by another key verified")
+	}
+
+	f, err := os.OpenFile(report, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("1,forged\n")
+	if closeErr := f.Close(); err != nil || closeErr != nil {
+		t.Fatal(err, closeErr)
+	}
+	if _, err := audit.Verify(report, key); err == nil || !strings.Contains(err.Error(), "altered") {
+		t.Errorf("verifying an altered report gave %v", err)
+	}
+}
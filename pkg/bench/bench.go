@@ -0,0 +1,184 @@
+// Package bench measures the throughput of storing, deduplicating,
+// backing up and restoring synthetic file trees, and compares the results
+// with a saved baseline to catch performance regressions. The hashing and
+// copy paths have Go benchmarks of their own, run with go test -bench.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/dedup"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Result is the time one operation took on a tree
+type Result struct {
+	Tree      string        `json:"tree"`
+	Operation string        `json:"operation"`
+	Files     int           `json:"files"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"duration_ns"`
+}
+
+// Throughput is the rate the operation processed data at, in bytes per second
+func (r Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// Key identifies the measurement across runs
+func (r Result) Key() string {
+	return r.Tree + "/" + r.Operation
+}
+
+// Config tunes a suite run
+type Config struct {
+	Algorithm hash.Algorithm
+	Workers   int
+	Options   fsutil.Options
+}
+
+// Run generates each tree below dir and measures storing it into a fresh
+// repository, backing it up, restoring the backup and deduplicating it,
+// in that order as deduplication removes files
+func Run(ctx context.Context, dir string, trees []Tree, cfg Config) ([]Result, error) {
+	// Every file is hashed, whatever the digest cache remembers
+	cfg.Options.Paranoid = true
+
+	var results []Result
+	for _, tree := range trees {
+		treeResults, err := runTree(ctx, filepath.Join(dir, tree.Name), tree, cfg)
+		results = append(results, treeResults...)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", tree.Name, err)
+		}
+	}
+	return results, nil
+}
+
+// Measure the operations on one tree generated below dir
+func runTree(ctx context.Context, dir string, tree Tree, cfg Config) ([]Result, error) {
+	source := filepath.Join(dir, "source")
+	if err := tree.Generate(source); err != nil {
+		return nil, err
+	}
+	repoDir := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(repoDir, 0o755); err != nil {
+		return nil, err
+	}
+	metadata, err := db.Open(db.DefaultConfig(), repoDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = metadata.Close()
+	}()
+	if err := db.Migrate(ctx, metadata); err != nil {
+		return nil, err
+	}
+	blobs := store.New(store.NewLocal(filepath.Join(repoDir, "storage"), cfg.Options), metadata, cfg.Algorithm, cfg.Options)
+	blobs.SetConcurrency(cfg.Workers, 0)
+	backup := filepath.Join(dir, "backup.tar.gz")
+
+	var results []Result
+	measure := func(operation string, fn func() error) error {
+		start := time.Now()
+		if err := fn(); err != nil {
+			return fmt.Errorf("%s: %w", operation, err)
+		}
+		results = append(results, Result{Tree: tree.Name, Operation: operation, Files: tree.Files, Bytes: tree.Bytes(), Duration: time.Since(start)})
+		return nil
+	}
+	err = measure("store", func() error {
+		_, err := blobs.StoreDirectory(ctx, source)
+		return err
+	})
+	if err == nil {
+		err = measure("backup", func() error {
+			_, err := archive.Backup(ctx, source, backup, cfg.Options)
+			return err
+		})
+	}
+	if err == nil {
+		err = measure("restore", func() error {
+			_, err := archive.Restore(ctx, backup, filepath.Join(dir, "restored"), cfg.Workers, archive.DefaultCollisionPolicy, cfg.Options)
+			return err
+		})
+	}
+	if err == nil {
+		err = measure("dedup", func() error {
+			_, err := dedup.Files(ctx, source, cfg.Algorithm, metadata, cfg.Options)
+			return err
+		})
+	}
+	return results, err
+}
+
+// Regression is a measurement slower than its baseline by more than the
+// tolerated fraction
+type Regression struct {
+	Key      string  `json:"key"`
+	Baseline float64 `json:"baseline"` // bytes per second
+	Current  float64 `json:"current"`
+}
+
+// Slowdown is the fraction of the baseline throughput lost
+func (r Regression) Slowdown() float64 {
+	return 1 - r.Current/r.Baseline
+}
+
+// Compare returns the results whose throughput fell more than tolerance,
+// a fraction, below that of the same measurement in baseline. Measurements
+// missing from either side are ignored.
+func Compare(baseline, current []Result, tolerance float64) []Regression {
+	previous := make(map[string]float64, len(baseline))
+	for _, r := range baseline {
+		previous[r.Key()] = r.Throughput()
+	}
+	var regressions []Regression
+	for _, r := range current {
+		before, ok := previous[r.Key()]
+		if !ok || before <= 0 {
+			continue
+		}
+		if now := r.Throughput(); now < before*(1-tolerance) {
+			regressions = append(regressions, Regression{Key: r.Key(), Baseline: before, Current: now})
+		}
+	}
+	return regressions
+}
+
+// Save writes results to path as JSON, to compare later runs with
+func Save(path string, results []Result) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to save benchmark results: %w", err)
+	}
+	return nil
+}
+
+// Load reads results saved by Save
+func Load(path string) ([]Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read benchmark baseline: %w", err)
+	}
+	var results []Result
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse benchmark baseline %s: %w", path, err)
+	}
+	return results, nil
+}
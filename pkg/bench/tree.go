@@ -0,0 +1,83 @@
+package bench
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+// Tree is a synthetic file tree a suite measures operations on
+type Tree struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Files are spread over Dirs directories. Of their contents, Distinct
+	// are different and the rest repeat them; 0 means all differ.
+	Files    int   `json:"files"`
+	FileSize int64 `json:"file_size"`
+	Dirs     int   `json:"dirs"`
+	Distinct int   `json:"distinct"`
+}
+
+// Bytes is the total size of the tree's files
+func (t Tree) Bytes() int64 {
+	return int64(t.Files) * t.FileSize
+}
+
+// Trees returns the standard trees scaled by factor, which multiplies the
+// number of files of the small and duplicate trees and the size of the
+// huge files
+func Trees(scale float64) []Tree {
+	scaled := func(n float64) int {
+		return max(1, int(n*scale))
+	}
+	return []Tree{
+		{Name: "small-files", Description: "many small files", Files: scaled(10000), FileSize: 4 << 10, Dirs: scaled(100)},
+		{Name: "huge-files", Description: "few huge files", Files: 2, FileSize: int64(scaled(256)) << 20, Dirs: 1},
+		{Name: "duplicates", Description: "duplicate-heavy files", Files: scaled(2000), FileSize: 64 << 10, Dirs: scaled(20), Distinct: scaled(50)},
+	}
+}
+
+// Generate writes the tree below dir. Contents are pseudo-random, so that
+// they neither compress nor deduplicate unless the tree repeats them, and
+// the same on every run.
+func (t Tree) Generate(dir string) error {
+	distinct := t.Distinct
+	if distinct <= 0 {
+		distinct = t.Files
+	}
+	buf := make([]byte, min(t.FileSize, 1<<20))
+	for i := 0; i < t.Files; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%04d", i%max(t.Dirs, 1)))
+		if err := os.MkdirAll(sub, 0o755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := writeContent(filepath.Join(sub, fmt.Sprintf("f%06d.bin", i)), uint64(i%distinct), t.FileSize, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write size pseudo-random bytes determined by seed to path
+func writeContent(path string, seed uint64, size int64, buf []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	source := rand.NewChaCha8([32]byte{0: byte(seed), 1: byte(seed >> 8), 2: byte(seed >> 16), 3: byte(seed >> 24)})
+	for written := int64(0); written < size; {
+		chunk := buf[:min(int64(len(buf)), size-written)]
+		_, _ = source.Read(chunk)
+		if _, err := file.Write(chunk); err != nil {
+			_ = file.Close()
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		written += int64(len(chunk))
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Package chunker splits content into content-defined chunks: boundaries
+// are placed where a rolling hash of the bytes before them matches a
+// pattern, so that an insertion only changes the chunks around it and
+// files sharing most of their content share most of their chunks.
+package chunker
+
+import (
+	"errors"
+	"io"
+)
+
+// Chunk sizes. Boundaries fall on average AvgSize bytes past MinSize, and
+// a chunk that reaches MaxSize ends there. Changing any of them, or the
+// gear table, moves every boundary, so stored chunks would no longer match.
+const (
+	MinSize = 512 << 10
+	AvgSize = 1 << 20
+	MaxSize = 4 << 20
+)
+
+// mask selects the hash bits that must be zero at a boundary
+const mask = AvgSize - 1
+
+// gear maps every byte to a random value the rolling hash adds up
+var gear [256]uint64
+
+func init() {
+	// splitmix64 from a fixed seed, so that boundaries never change
+	state := uint64(0x6c656e737461636b)
+	for i := range gear {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker reads content chunk by chunk
+type Chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int // unread part of buf
+	eof        bool
+}
+
+// New returns a chunker of the content read from r
+func New(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, MaxSize)}
+}
+
+// Next returns the next chunk, which stays valid until the following call,
+// or io.EOF after the last one
+func (c *Chunker) Next() ([]byte, error) {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+	c.start = boundary(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
+
+// Return the length of the chunk data starts with
+func boundary(data []byte) int {
+	if len(data) <= MinSize {
+		return len(data)
+	}
+	var hash uint64
+	for i := MinSize; i < len(data); i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,493 @@
+// Package client uses a repository served by -action serve over its HTTP
+// API, so that files can be stored and retrieved without local storage.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	gohash "hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultChunkSize is how much of a file each upload request carries
+const DefaultChunkSize = 8 << 20
+
+// DefaultDeltaMinSize is the size from which a file is uploaded as a delta
+// against its latest version on the server
+const DefaultDeltaMinSize = 1 << 20
+
+// maxRetries bounds how often a failed chunk is resent
+const maxRetries = 5
+
+// Client talks to a file manager server
+type Client struct {
+	base  *url.URL
+	token string
+	http  *http.Client
+
+	// ChunkSize is how much of a file each upload request carries
+	ChunkSize int64
+
+	// StateDir remembers unfinished uploads, so that storing the same file
+	// again resumes them. Without it uploads restart from the beginning.
+	StateDir string
+
+	// DeltaMinSize is the size from which a file with a version on the
+	// server is sent as the blocks that changed since, the way rsync does.
+	// Zero sends every file whole.
+	DeltaMinSize int64
+
+	// NoDedup uploads every file without first asking whether the server
+	// has its content already
+	NoDedup bool
+
+	mu    sync.Mutex
+	dedup *hash.Algorithm // the server's, once asked; zero when it cannot tell
+}
+
+// Error is an error response of the server
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server answered %d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// New returns a client of the server at baseURL, which may include the
+// /repos/<name> path of a repository, authenticating with token unless it
+// is empty
+func New(baseURL, token string) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q: must be an http or https URL", baseURL)
+	}
+	c := &Client{
+		base:         base,
+		token:        token,
+		http:         &http.Client{},
+		ChunkSize:    DefaultChunkSize,
+		DeltaMinSize: DefaultDeltaMinSize,
+	}
+	if cache, err := os.UserCacheDir(); err == nil {
+		c.StateDir = filepath.Join(cache, "file_manager", "uploads")
+	}
+	return c, nil
+}
+
+// Return the URL of an API path, whose file name part is escaped
+func (c *Client) url(route, name string, query url.Values) string {
+	u := *c.base
+	u.Path += route
+	if name != "" {
+		u.Path += "/" + name
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Send an authenticated request
+func (c *Client) send(ctx context.Context, method, target string, body io.Reader) (*http.Response, error) {
+	return c.sendWith(ctx, method, target, nil, body)
+}
+
+// Send an authenticated request with extra headers
+func (c *Client) sendWith(ctx context.Context, method, target string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// Send a request and decode its JSON response into v, failing with an
+// *Error on responses other than a success
+func (c *Client) do(ctx context.Context, method, target string, body io.Reader, v any) (*http.Response, error) {
+	return c.doWith(ctx, method, target, nil, body, v)
+}
+
+// Send a request with extra headers as do does
+func (c *Client) doWith(ctx context.Context, method, target string, header http.Header, body io.Reader, v any) (*http.Response, error) {
+	resp, err := c.sendWith(ctx, method, target, header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		return resp, responseError(resp)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return resp, fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// Build the error of an unsuccessful response
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) != nil || body.Error == "" {
+		body.Error = strings.TrimSpace(string(data))
+	}
+	return &Error{Status: resp.StatusCode, Message: body.Error}
+}
+
+// Report whether a request failed in a way that retrying may fix
+func temporary(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Status >= 500 && apiErr.Status != http.StatusNotImplemented && apiErr.Status != http.StatusInsufficientStorage
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// StoreFile uploads the file at path as a new version of name, in chunks,
+// or from DeltaMinSize on as a delta against the version the server has.
+// An upload interrupted by a failure or an earlier run is resumed where the
+// server stopped receiving it. Each chunk carries its checksum, so that one
+// damaged in transit is resent, and the server checks the whole file
+// against its checksum before storing it.
+func (c *Client) StoreFile(ctx context.Context, path, name string) (*store.StoreResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	statePath := c.statePath(path, name, info)
+	upload, err := c.resumeUpload(ctx, statePath)
+	if err != nil {
+		return nil, err
+	}
+	if upload == nil && !c.NoDedup {
+		result, err := c.storeKnown(ctx, f, name, info.Size())
+		if err != nil {
+			return nil, fmt.Errorf("failed to store %s: %w", path, err)
+		}
+		if result != nil {
+			return result, nil
+		}
+	}
+	if upload == nil {
+		upload = &server.Upload{}
+		if _, err := c.doJSON(ctx, http.MethodPost, c.url("/uploads", "", nil), map[string]string{"filename": name}, upload); err != nil {
+			return nil, fmt.Errorf("failed to start upload: %w", err)
+		}
+		c.saveState(statePath, upload.ID)
+		if c.DeltaMinSize > 0 && info.Size() >= c.DeltaMinSize {
+			if err := c.sendDelta(ctx, f, name, upload); err != nil {
+				return nil, fmt.Errorf("failed to upload %s: %w", path, err)
+			}
+		}
+	}
+
+	chunk := make([]byte, max(c.ChunkSize, 1))
+	for failures := 0; upload.Offset < info.Size(); {
+		n, err := f.ReadAt(chunk, upload.Offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		query := url.Values{"offset": {strconv.FormatInt(upload.Offset, 10)}}
+		sum := sha256.Sum256(chunk[:n])
+		header := http.Header{server.ChecksumHeader: {"sha256 " + hex.EncodeToString(sum[:])}}
+		_, err = c.doWith(ctx, http.MethodPut, c.url("/uploads", upload.ID, query), header, bytes.NewReader(chunk[:n]), upload)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if failures++; failures > maxRetries || (!temporary(err) && !isConflict(err) && !isCorrupt(err)) {
+			return nil, fmt.Errorf("failed to upload %s: %w", path, err)
+		}
+		// Ask how much arrived before resending
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(failures) * time.Second):
+		}
+		if _, err := c.do(ctx, http.MethodGet, c.url("/uploads", upload.ID, nil), nil, upload); err != nil && !temporary(err) {
+			return nil, fmt.Errorf("failed to resume upload of %s: %w", path, err)
+		}
+	}
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(f, 0, info.Size())); err != nil {
+		return nil, err
+	}
+	result := &store.StoreResult{}
+	query := url.Values{"size": {strconv.FormatInt(info.Size(), 10)}, "sha256": {hex.EncodeToString(digest.Sum(nil))}}
+	if _, err := c.do(ctx, http.MethodPost, c.url("/uploads", upload.ID+"/finish", query), nil, result); err != nil {
+		return nil, fmt.Errorf("failed to finish upload of %s: %w", path, err)
+	}
+	_ = os.Remove(statePath)
+	return result, nil
+}
+
+// Ask the server to record a new version of name from the content it has
+// already, returning nil when it does not have it and the file must be
+// uploaded
+func (c *Client) storeKnown(ctx context.Context, f *os.File, name string, size int64) (*store.StoreResult, error) {
+	algorithm, err := c.dedupAlgorithm(ctx)
+	if err != nil || algorithm.Name == "" {
+		return nil, err
+	}
+	sum, err := algorithm.Reader(ctx, io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	result := &store.StoreResult{}
+	_, err = c.doJSON(ctx, http.MethodPost, c.url("/dedup", name, nil), map[string]any{"hash": sum, "size": size}, result)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Return the hash algorithm the server names content by, asking it the
+// first time. It is zero for servers that cannot be asked for content.
+func (c *Client) dedupAlgorithm(ctx context.Context) (hash.Algorithm, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dedup != nil {
+		return *c.dedup, nil
+	}
+	answer := &server.Dedup{}
+	_, err := c.do(ctx, http.MethodGet, c.url("/dedup", "", nil), nil, answer)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && (apiErr.Status == http.StatusNotFound || apiErr.Status == http.StatusMethodNotAllowed) {
+		c.dedup = &hash.Algorithm{}
+		return *c.dedup, nil
+	}
+	if err != nil {
+		return hash.Algorithm{}, fmt.Errorf("failed to ask for the hash algorithm: %w", err)
+	}
+	algorithm, err := hash.Lookup(answer.Algorithm)
+	if err != nil {
+		// The content is uploaded as it cannot be named
+		algorithm = hash.Algorithm{}
+	}
+	c.dedup = &algorithm
+	return algorithm, nil
+}
+
+// Report whether a request was refused because it conflicts with the
+// upload's state, such as a chunk sent at a stale offset
+func isConflict(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusConflict
+}
+
+// Report whether a chunk was refused as it does not match its checksum
+func isCorrupt(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusUnprocessableEntity
+}
+
+// Send v as JSON
+func (c *Client) doJSON(ctx context.Context, method, target string, v, result any) (*http.Response, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, method, target, bytes.NewReader(data), result)
+}
+
+// Return where the upload of a file is remembered. The key changes when
+// the file does, so that a modified file is uploaded anew.
+func (c *Client) statePath(path, name string, info fs.FileInfo) string {
+	if c.StateDir == "" {
+		return ""
+	}
+	abs, _ := filepath.Abs(path)
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%d", c.base, name, abs, info.Size(), info.ModTime().UnixNano())
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.StateDir, hex.EncodeToString(sum[:16]))
+}
+
+// Return the unfinished upload remembered in statePath, or nil when there
+// is none the server still has
+func (c *Client) resumeUpload(ctx context.Context, statePath string) (*server.Upload, error) {
+	if statePath == "" {
+		return nil, nil
+	}
+	id, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, nil
+	}
+	upload := &server.Upload{}
+	_, err = c.do(ctx, http.MethodGet, c.url("/uploads", strings.TrimSpace(string(id)), nil), nil, upload)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && (apiErr.Status == http.StatusNotFound || apiErr.Status == http.StatusForbidden) {
+		_ = os.Remove(statePath)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume upload: %w", err)
+	}
+	return upload, nil
+}
+
+// Remember an unfinished upload. Failing to only loses the ability to
+// resume it.
+func (c *Client) saveState(statePath, id string) {
+	if statePath == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0o700); err == nil {
+		_ = os.WriteFile(statePath, []byte(id), 0o600)
+	}
+}
+
+// Open streams a version of name, the latest when n is 0, and returns the
+// version opened. Reading it to the end fails if the content does not
+// match the hash the server recorded.
+func (c *Client) Open(ctx context.Context, name string, n int) (io.ReadCloser, int, error) {
+	query := url.Values{}
+	if n > 0 {
+		query.Set("version", strconv.Itoa(n))
+	}
+	resp, err := c.send(ctx, http.MethodGet, c.url("/files", name, query), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, _ := strconv.Atoi(resp.Header.Get("X-Version"))
+	body, err := openDownload(resp, fmt.Sprintf("%s version %d", name, version))
+	return body, version, err
+}
+
+// OpenBlob streams the blob with the storage ID id, which a version of the
+// repository refers to. Reading it to the end fails if the content does not
+// match its hash.
+func (c *Client) OpenBlob(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, c.url("/blobs", id, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	return openDownload(resp, "blob "+id)
+}
+
+// Snapshot returns the metadata of the repository read at one point in
+// time, for cloning it. It needs an admin token.
+func (c *Client) Snapshot(ctx context.Context) (*db.Snapshot, error) {
+	snap := &db.Snapshot{}
+	if _, err := c.do(ctx, http.MethodGet, c.url("/snapshot", "", nil), nil, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Return the body of a download, verified against the hash the server sent
+// once it is read to the end
+func openDownload(resp *http.Response, name string) (io.ReadCloser, error) {
+	if resp.StatusCode != http.StatusOK {
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		return nil, responseError(resp)
+	}
+	algorithm, err := hash.Lookup(resp.Header.Get("X-Hash-Algorithm"))
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("cannot verify download: %w", err)
+	}
+	return &download{
+		ReadCloser: resp.Body,
+		digest:     algorithm.New(),
+		want:       resp.Header.Get("X-Hash"),
+		name:       name,
+	}, nil
+}
+
+// download verifies a downloaded version once it is read to the end
+type download struct {
+	io.ReadCloser
+	digest gohash.Hash
+	want   string
+	name   string
+}
+
+func (d *download) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.digest.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(d.digest.Sum(nil)) != d.want {
+		err = fmt.Errorf("%s: %w", d.name, store.ErrChecksumMismatch)
+	}
+	return n, err
+}
+
+// Retrieve downloads a version of name, the latest when n is 0, to dest.
+// The content is verified against the hash the server recorded before it
+// replaces dest. It returns the version retrieved.
+func (c *Client) Retrieve(ctx context.Context, name string, n int, dest string) (int, error) {
+	body, version, err := c.Open(ctx, name, n)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(dest), ".fm-retrieve-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}()
+	if _, err := io.Copy(tmpFile, body); errors.Is(err, store.ErrChecksumMismatch) {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpFile.Name(), dest); err != nil {
+		return 0, fmt.Errorf("failed to replace %s: %w", dest, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/Lenstack/file_manager_version/pkg/delta"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// Fill a new upload with the delta of f against the latest version of name
+// on the server, so that only the blocks that changed travel. When there is
+// no version, or the server cannot take the delta, the upload is left empty
+// for the file to be sent in chunks; only a cancelled ctx fails.
+func (c *Client) sendDelta(ctx context.Context, f *os.File, name string, upload *server.Upload) error {
+	sig := &delta.Signature{}
+	resp, err := c.do(ctx, http.MethodGet, c.url("/signatures", name, nil), nil, sig)
+	if err != nil {
+		return ctx.Err()
+	}
+	// The delta applies to the version signed, whatever is stored since
+	version := resp.Header.Get("X-Version")
+	if _, err := strconv.Atoi(version); err != nil {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	body, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := delta.Diff(sig, io.NewSectionReader(f, 0, info.Size()), pw)
+		_ = pw.CloseWithError(err)
+		done <- err
+	}()
+	query := url.Values{"version": {version}, "size": {strconv.FormatInt(info.Size(), 10)}}
+	_, err = c.do(ctx, http.MethodPut, c.url("/uploads", upload.ID+"/delta", query), body, upload)
+	_ = body.CloseWithError(errors.New("delta upload ended"))
+	diffErr := <-done
+	if err != nil || diffErr != nil {
+		// The server empties the upload when a delta fails
+		upload.Offset = 0
+		return ctx.Err()
+	}
+	return nil
+}
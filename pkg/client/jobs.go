@@ -0,0 +1,127 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// NewSocket returns a client of a server listening on the Unix socket at
+// path, such as the one of -action daemon
+func NewSocket(path string) *Client {
+	var dialer net.Dialer
+	return &Client{
+		base: &url.URL{Scheme: "http", Host: "daemon"},
+		http: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}},
+		ChunkSize: DefaultChunkSize,
+	}
+}
+
+// StartJob starts a job of the given kind, such as store or backup, with
+// request as its JSON parameters
+func (c *Client) StartJob(ctx context.Context, kind string, request any) (*server.Job, error) {
+	job := &server.Job{}
+	if _, err := c.doJSON(ctx, http.MethodPost, c.url("/jobs", kind, nil), request, job); err != nil {
+		return nil, fmt.Errorf("failed to start %s job: %w", kind, err)
+	}
+	return job, nil
+}
+
+// Jobs lists the jobs of the server, oldest first
+func (c *Client) Jobs(ctx context.Context) ([]server.Job, error) {
+	var jobs []server.Job
+	if _, err := c.do(ctx, http.MethodGet, c.url("/jobs", "", nil), nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Job returns a job and, once it finished, its result
+func (c *Client) Job(ctx context.Context, id string) (*server.Job, error) {
+	job := &server.Job{}
+	if _, err := c.do(ctx, http.MethodGet, c.url("/jobs", id, nil), nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CancelJob cancels a queued or running job
+func (c *Client) CancelJob(ctx context.Context, id string) (*server.Job, error) {
+	job := &server.Job{}
+	if _, err := c.do(ctx, http.MethodPost, c.url("/jobs", id+"/cancel", nil), nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// PauseJob holds a job at its next checkpoint until ResumeJob is called
+func (c *Client) PauseJob(ctx context.Context, id string) (*server.Job, error) {
+	job := &server.Job{}
+	if _, err := c.do(ctx, http.MethodPost, c.url("/jobs", id+"/pause", nil), nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// ResumeJob lets a paused job continue
+func (c *Client) ResumeJob(ctx context.Context, id string) (*server.Job, error) {
+	job := &server.Job{}
+	if _, err := c.do(ctx, http.MethodPost, c.url("/jobs", id+"/resume", nil), nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Schedule lists the recurring jobs of the server
+func (c *Client) Schedule(ctx context.Context) ([]server.Scheduled, error) {
+	var policies []server.Scheduled
+	if _, err := c.do(ctx, http.MethodGet, c.url("/schedule", "", nil), nil, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// FollowJob calls fn with every progress event of a job, from its start
+// until it finishes, then returns the finished job. When the server stops
+// right after the job, the job is returned without its result.
+func (c *Client) FollowJob(ctx context.Context, id string, fn func(server.Progress)) (*server.Job, error) {
+	resp, err := c.send(ctx, http.MethodGet, c.url("/jobs", id+"/events", nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var p server.Progress
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			return nil, fmt.Errorf("failed to decode job progress: %w", err)
+		}
+		if p.Type == "finished" {
+			job, err := c.Job(ctx, id)
+			if err != nil {
+				return &server.Job{ID: id, State: p.State, Error: p.Error}, nil
+			}
+			return job, nil
+		}
+		fn(p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to follow job %s: %w", id, err)
+	}
+	return nil, fmt.Errorf("job %s: the server stopped before it finished", id)
+}
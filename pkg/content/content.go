@@ -0,0 +1,141 @@
+// Package content recognizes the type of files from their first bytes and
+// their names, as a MIME type and a broad kind such as image or document.
+package content
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SniffLen is how many leading bytes of a file Detect looks at
+const SniffLen = 512
+
+// Kinds of content
+const (
+	Image    = "image"
+	Video    = "video"
+	Audio    = "audio"
+	Document = "document"
+	Archive  = "archive"
+	Text     = "text"
+	Other    = "other"
+)
+
+// Kinds returns the kinds of content, in the order reports list them
+func Kinds() []string {
+	return []string{Image, Video, Audio, Document, Archive, Text, Other}
+}
+
+// Type is the detected type of a file's content
+type Type struct {
+	MIME string `json:"mime_type"` // without parameters such as the charset
+	Kind string `json:"kind"`
+}
+
+// Detect returns the type of a file named name starting with head. The
+// bytes decide unless they only tell that the file is text, zip or
+// unknown binary data, where a more specific type by the name's extension
+// wins, such as text/csv or an OOXML document.
+func Detect(name string, head []byte) Type {
+	sniffed := bareType(http.DetectContentType(head))
+	switch sniffed {
+	case "text/plain", "application/octet-stream", "application/zip":
+		if byName := bareType(mime.TypeByExtension(strings.ToLower(path.Ext(name)))); byName != "" {
+			sniffed = byName
+		}
+	}
+	return Type{MIME: sniffed, Kind: KindOf(sniffed)}
+}
+
+// Strip the parameters from a MIME type
+func bareType(mimeType string) string {
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// archiveTypes are MIME types of archives and compressed files
+var archiveTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-tar":            true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/java-archive":     true,
+}
+
+// documentTypes are MIME types of documents outside the vendor trees
+var documentTypes = map[string]bool{
+	"application/pdf":        true,
+	"application/msword":     true,
+	"application/rtf":        true,
+	"application/postscript": true,
+	"application/epub+zip":   true,
+	"text/html":              true,
+	"text/markdown":          true,
+}
+
+// KindOf returns the kind of content of a MIME type
+func KindOf(mimeType string) string {
+	mimeType = bareType(mimeType)
+	major, minor, _ := strings.Cut(mimeType, "/")
+	switch {
+	case major == Image || major == Video || major == Audio:
+		return major
+	case archiveTypes[mimeType]:
+		return Archive
+	case documentTypes[mimeType],
+		strings.HasPrefix(minor, "vnd.openxmlformats-officedocument."),
+		strings.HasPrefix(minor, "vnd.oasis.opendocument."),
+		strings.HasPrefix(minor, "vnd.ms-"):
+		return Document
+	case major == Text:
+		return Text
+	default:
+		return Other
+	}
+}
+
+// Compressed reports whether content of the type is compressed already,
+// so that compressing it again costs time and saves next to nothing
+func (t Type) Compressed() bool {
+	switch t.Kind {
+	case Video, Archive:
+		return true
+	case Image:
+		return t.MIME != "image/bmp" && t.MIME != "image/svg+xml" && t.MIME != "image/x-icon"
+	case Audio:
+		return t.MIME != "audio/wave" && t.MIME != "audio/wav" && t.MIME != "audio/x-wav" && t.MIME != "audio/aiff"
+	case Document:
+		// OOXML and OpenDocument files are zip archives
+		return strings.Contains(t.MIME, "openxmlformats") || strings.Contains(t.MIME, "opendocument") || t.MIME == "application/epub+zip"
+	default:
+		return false
+	}
+}
+
+// Head keeps the first SniffLen bytes written to it, to detect the type of
+// a stream as it passes
+type Head struct {
+	buf []byte
+}
+
+func (h *Head) Write(p []byte) (int, error) {
+	if n := SniffLen - len(h.buf); n > 0 {
+		h.buf = append(h.buf, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns the bytes kept
+func (h *Head) Bytes() []byte {
+	return h.buf
+}
@@ -0,0 +1,116 @@
+package content
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// MaxText is how much text ExtractText extracts from a file at most
+const MaxText = 1 << 20
+
+// maxPDF is the size of the largest PDF whose text layer ExtractText reads
+const maxPDF = 64 << 20
+
+// Extractable reports whether ExtractText can extract text from content of the type
+func (t Type) Extractable() bool {
+	return t.Kind == Text || t.MIME == "application/pdf" || t.MIME == "application/json" || t.MIME == "application/xml"
+}
+
+// ExtractText extracts up to MaxText bytes of text from content of type t read
+// from r: plain text as is, and the text layer of PDF documents. Types that
+// are not Extractable give no text.
+func ExtractText(r io.Reader, t Type) (string, error) {
+	switch {
+	case t.MIME == "application/pdf":
+		data, err := io.ReadAll(io.LimitReader(r, maxPDF))
+		if err != nil {
+			return "", err
+		}
+		return pdfText(data), nil
+	case t.Extractable():
+		data, err := io.ReadAll(io.LimitReader(r, MaxText))
+		if err != nil {
+			return "", err
+		}
+		return strings.ToValidUTF8(string(data), ""), nil
+	default:
+		return "", nil
+	}
+}
+
+var (
+	streamPattern = regexp.MustCompile(`stream\r?\n`)
+	// A literal string shown by Tj, ', " or as an element of a TJ array
+	textPattern = regexp.MustCompile(`\((?:[^()\\]|\\.|\([^()]*\))*\)\s*(?:Tj|'|")|\[(?:[^\]\\]|\\.)*\]\s*TJ`)
+	literal     = regexp.MustCompile(`\((?:[^()\\]|\\.|\([^()]*\))*\)`)
+)
+
+// Extract the text drawn by the content streams of a PDF document. Only
+// literal strings in simple encodings are understood, which covers the
+// text layer of most documents produced by office suites and scanners.
+func pdfText(data []byte) string {
+	var text strings.Builder
+	for _, loc := range streamPattern.FindAllIndex(data, -1) {
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[start : start+end]
+		if r, err := zlib.NewReader(bytes.NewReader(stream)); err == nil {
+			if inflated, err := io.ReadAll(io.LimitReader(r, maxPDF)); err == nil || len(inflated) > 0 {
+				stream = inflated
+			}
+		}
+		if !bytes.Contains(stream, []byte("BT")) {
+			continue
+		}
+		for _, op := range textPattern.FindAll(stream, -1) {
+			for _, s := range literal.FindAll(op, -1) {
+				text.WriteString(pdfString(s[1 : len(s)-1]))
+			}
+			text.WriteByte(' ')
+			if text.Len() >= MaxText {
+				return strings.ToValidUTF8(text.String()[:MaxText], "")
+			}
+		}
+		text.WriteByte('\n')
+	}
+	return strings.ToValidUTF8(text.String(), "")
+}
+
+// Decode the escapes of a PDF literal string; bytes outside ASCII are read
+// as Latin-1
+func pdfString(s []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteRune(rune(c))
+			continue
+		}
+		i++
+		switch c = s[i]; c {
+		case 'n', 'r':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'b', 'f':
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			value := 0
+			for n := 0; n < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; n++ {
+				value = value*8 + int(s[i]-'0')
+				i++
+			}
+			i--
+			b.WriteRune(rune(value & 0xff))
+		case '\n':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,375 @@
+package content
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"io"
+	"strings"
+	"time"
+)
+
+// TakenLayout is how capture dates are written in metadata, so that
+// comparing them as strings orders them in time
+const TakenLayout = "2006-01-02T15:04:05"
+
+// ParseTaken checks that value is a capture date in TakenLayout or a
+// prefix of it down to the year, such as 2020 or 2020-06, and returns it
+func ParseTaken(value string) (string, error) {
+	for _, layout := range []string{"2006", "2006-01", "2006-01-02", "2006-01-02T15", "2006-01-02T15:04", TakenLayout} {
+		if _, err := time.Parse(layout, value); err == nil {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("invalid date %q (use a prefix of YYYY-MM-DDTHH:MM:SS, such as 2020 or 2020-06-30)", value)
+}
+
+// Media describes a photo or video: when it was taken, by which camera,
+// and its dimensions in pixels. Fields the file does not record are zero.
+type Media struct {
+	Taken  time.Time
+	Camera string
+	Width  int
+	Height int
+}
+
+// Metadata returns the known fields of m as file metadata: taken, camera,
+// width and height
+func (m Media) Metadata() map[string]string {
+	meta := map[string]string{}
+	if !m.Taken.IsZero() {
+		meta["taken"] = m.Taken.Format(TakenLayout)
+	}
+	if m.Camera != "" {
+		meta["camera"] = m.Camera
+	}
+	if m.Width > 0 && m.Height > 0 {
+		meta["width"] = fmt.Sprint(m.Width)
+		meta["height"] = fmt.Sprint(m.Height)
+	}
+	return meta
+}
+
+// ReadMedia reads what content of type t read from r records about the
+// photo or video: the EXIF data and frame size of JPEG photos, the size of
+// other images, and the creation time and frame size of MP4 and QuickTime
+// videos. When r is an io.Seeker, the media data of videos is skipped
+// rather than read.
+func ReadMedia(r io.Reader, t Type) (Media, error) {
+	switch {
+	case t.MIME == "image/jpeg":
+		return readJPEG(bufio.NewReader(r))
+	case t.Kind == Image:
+		config, _, err := image.DecodeConfig(r)
+		if err != nil {
+			// Formats without a registered decoder have no known size
+			return Media{}, nil
+		}
+		return Media{Width: config.Width, Height: config.Height}, nil
+	case t.MIME == "video/mp4" || t.MIME == "video/quicktime":
+		m := Media{}
+		return m, readBoxes(r, -1, &m)
+	default:
+		return Media{}, nil
+	}
+}
+
+// Read the segments of a JPEG file up to the image data
+func readJPEG(r *bufio.Reader) (Media, error) {
+	var m Media
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return m, fmt.Errorf("not a JPEG file")
+	}
+	for {
+		marker, err := r.ReadByte()
+		if err != nil {
+			return m, err
+		}
+		if marker != 0xff {
+			continue
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return m, err
+		}
+		switch {
+		case kind == 0xff || kind == 0x01 || kind >= 0xd0 && kind <= 0xd7:
+			// Fill bytes and markers without a length
+			if kind == 0xff {
+				_ = r.UnreadByte()
+			}
+			continue
+		case kind == 0xd9 || kind == 0xda:
+			// The end, or the start of the image data
+			return m, nil
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return m, err
+		}
+		if length < 2 {
+			return m, fmt.Errorf("invalid JPEG segment length %d", length)
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return m, err
+		}
+		switch {
+		case kind == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			readEXIF(segment[6:], &m)
+		case kind >= 0xc0 && kind <= 0xcf && kind != 0xc4 && kind != 0xc8 && kind != 0xcc && len(segment) >= 5:
+			// A start of frame gives the size unless EXIF did
+			if m.Width == 0 {
+				m.Height = int(binary.BigEndian.Uint16(segment[1:]))
+				m.Width = int(binary.BigEndian.Uint16(segment[3:]))
+			}
+		}
+	}
+}
+
+// EXIF tags read from photos
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+	tagPixelXDimension  = 0xa002
+	tagPixelYDimension  = 0xa003
+)
+
+// exifLayout is how EXIF writes dates, in the camera's local time
+const exifLayout = "2006:01:02 15:04:05"
+
+// Read the camera, capture date and size from the TIFF structure of EXIF
+// data. Damaged entries are skipped.
+func readEXIF(data []byte, m *Media) {
+	if len(data) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+	var maker, model, modified, original string
+	var width, height int
+	ifds := []uint32{order.Uint32(data[4:])}
+	seen := map[uint32]bool{}
+	for len(ifds) > 0 {
+		offset := int(ifds[0])
+		ifds = ifds[1:]
+		if seen[uint32(offset)] || offset+2 > len(data) {
+			continue
+		}
+		seen[uint32(offset)] = true
+		count := int(order.Uint16(data[offset:]))
+		for i := 0; i < count; i++ {
+			entry := offset + 2 + 12*i
+			if entry+12 > len(data) {
+				break
+			}
+			tag := order.Uint16(data[entry:])
+			format := order.Uint16(data[entry+2:])
+			n := order.Uint32(data[entry+4:])
+			value := data[entry+8 : entry+12]
+			switch tag {
+			case tagMake:
+				maker = exifString(data, order, format, n, value)
+			case tagModel:
+				model = exifString(data, order, format, n, value)
+			case tagDateTime:
+				modified = exifString(data, order, format, n, value)
+			case tagDateTimeOriginal:
+				original = exifString(data, order, format, n, value)
+			case tagExifIFD:
+				ifds = append(ifds, order.Uint32(value))
+			case tagPixelXDimension:
+				width = exifInt(order, format, value)
+			case tagPixelYDimension:
+				height = exifInt(order, format, value)
+			}
+		}
+	}
+
+	for _, date := range []string{original, modified} {
+		if taken, err := time.Parse(exifLayout, date); err == nil {
+			m.Taken = taken
+			break
+		}
+	}
+	m.Camera = strings.TrimSpace(maker)
+	if model = strings.TrimSpace(model); model != "" {
+		// Many models repeat the make
+		if m.Camera != "" && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(m.Camera)) {
+			model = m.Camera + " " + model
+		}
+		m.Camera = model
+	}
+	if width > 0 && height > 0 {
+		m.Width, m.Height = width, height
+	}
+}
+
+// Return an EXIF ASCII value, stored in the entry when it fits in 4 bytes
+func exifString(data []byte, order binary.ByteOrder, format uint16, n uint32, value []byte) string {
+	const ascii = 2
+	if format != ascii {
+		return ""
+	}
+	raw := value
+	if n > 4 {
+		offset := order.Uint32(value)
+		if uint64(offset)+uint64(n) > uint64(len(data)) {
+			return ""
+		}
+		raw = data[offset : offset+n]
+	} else {
+		raw = raw[:n]
+	}
+	return string(bytes.TrimRight(raw, "\x00 "))
+}
+
+// Return an EXIF SHORT or LONG value
+func exifInt(order binary.ByteOrder, format uint16, value []byte) int {
+	const short, long = 3, 4
+	switch format {
+	case short:
+		return int(order.Uint16(value))
+	case long:
+		return int(order.Uint32(value))
+	default:
+		return 0
+	}
+}
+
+// mp4Epoch is when the times of MP4 and QuickTime files count from
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Read the MP4 boxes of r, limit bytes long or up to the end when limit is
+// negative, descending into those holding the movie and track headers
+func readBoxes(r io.Reader, limit int64, m *Media) error {
+	var header [8]byte
+	for limit < 0 || limit >= 8 {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) && limit < 0 {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// The box runs to the end of the file
+			return nil
+		case 1:
+			var large uint64
+			if err := binary.Read(r, binary.BigEndian, &large); err != nil {
+				return err
+			}
+			size, headerSize = int64(large), 16
+		}
+		if size < headerSize || limit >= 0 && size > limit {
+			return fmt.Errorf("invalid %q box of %d bytes", kind, size)
+		}
+		body := size - headerSize
+
+		var err error
+		switch kind {
+		case "moov", "trak":
+			err = readBoxes(r, body, m)
+		case "mvhd":
+			err = readMovieHeader(r, body, m)
+		case "tkhd":
+			err = readTrackHeader(r, body, m)
+		default:
+			err = skip(r, body)
+		}
+		if err != nil {
+			return err
+		}
+		if kind == "moov" && limit < 0 {
+			// Nothing else at the top is of interest
+			return nil
+		}
+		if limit >= 0 {
+			limit -= size
+		}
+	}
+	return skip(r, limit)
+}
+
+// maxHeaderBox is the size of the largest movie or track header box read
+const maxHeaderBox = 1 << 16
+
+// Read a header box whole
+func readHeaderBox(r io.Reader, size int64) ([]byte, error) {
+	if size > maxHeaderBox {
+		return nil, fmt.Errorf("header box of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// Read the creation time from a movie header box
+func readMovieHeader(r io.Reader, size int64, m *Media) error {
+	data, err := readHeaderBox(r, size)
+	if err != nil {
+		return err
+	}
+	var seconds uint64
+	switch {
+	case len(data) >= 12 && data[0] == 1:
+		seconds = binary.BigEndian.Uint64(data[4:])
+	case len(data) >= 8:
+		seconds = uint64(binary.BigEndian.Uint32(data[4:]))
+	}
+	if seconds > 0 {
+		m.Taken = mp4Epoch.Add(time.Duration(seconds) * time.Second)
+	}
+	return nil
+}
+
+// Read the frame size from a track header box; audio tracks have none
+func readTrackHeader(r io.Reader, size int64, m *Media) error {
+	data, err := readHeaderBox(r, size)
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 || m.Width > 0 {
+		return nil
+	}
+	// Both are 16.16 fixed-point numbers ending the box
+	width := int(binary.BigEndian.Uint32(data[len(data)-8:]) >> 16)
+	height := int(binary.BigEndian.Uint32(data[len(data)-4:]) >> 16)
+	if width > 0 && height > 0 {
+		m.Width, m.Height = width, height
+	}
+	return nil
+}
+
+// Skip n bytes of r, seeking past them when r can
+func skip(r io.Reader, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
@@ -0,0 +1,269 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// ToolVersion is stamped into every action; release builds set it with
+// -ldflags "-X github.com/Lenstack/file_manager_version/pkg/db.ToolVersion=v1.2.3"
+var ToolVersion = "dev"
+
+// ErrAborted is wrapped by the errors of actions cancelled because the
+// process was asked to stop, such as by SIGINT, which are recorded with
+// the outcome "aborted" rather than "interrupted"
+var ErrAborted = errors.New("aborted")
+
+// Action is a single entry of the action log
+type Action struct {
+	ActionType string
+	Filename   string
+	StorageID  string
+	Bytes      int64
+	Duration   time.Duration
+	Err        error
+	Principal  string // who requested the action; defaults to the principal of the context
+
+	// IdempotencyKey identifies what the action did by its inputs and
+	// their content, so that repeating it can be recognized; see
+	// IdempotencyKey
+	IdempotencyKey string
+}
+
+// IdempotencyKey derives the key of an action from the parts determining
+// its result, such as the action type, the file name and its digest
+func IdempotencyKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindIdempotent returns the latest successful action recorded with the
+// idempotency key, reporting whether there is one
+func FindIdempotent(ctx context.Context, db Executor, key string) (LoggedAction, bool, error) {
+	var a LoggedAction
+	err := db.QueryRowContext(ctx, `
+	SELECT timestamp, COALESCE(action_type, ''), COALESCE(filename, ''), COALESCE(storage_id, ''),
+		COALESCE(bytes, 0), COALESCE(duration_ms, 0), COALESCE(outcome, ''), COALESCE(error, ''),
+		COALESCE(hostname, ''), COALESCE(tool_version, ''), COALESCE(principal, '')
+	FROM actions
+	WHERE idempotency_key = ? AND COALESCE(outcome, 'success') = 'success'
+	ORDER BY timestamp DESC, id DESC LIMIT 1;`, key).Scan(&a.Timestamp, &a.ActionType, &a.Filename, &a.StorageID, &a.Bytes,
+		&a.DurationMs, &a.Outcome, &a.Error, &a.Hostname, &a.Version, &a.Principal)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, false, nil
+	}
+	return a, err == nil, err
+}
+
+// principalKey is the context key of the principal
+type principalKey struct{}
+
+// WithPrincipal returns a context whose actions are recorded as requested
+// by the authenticated principal name
+func WithPrincipal(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, principalKey{}, name)
+}
+
+// Principal returns the principal set by WithPrincipal, or "" when there
+// is none
+func Principal(ctx context.Context) string {
+	name, _ := ctx.Value(principalKey{}).(string)
+	return name
+}
+
+// originKey is the context key of the origin of a request
+type originKey struct{}
+
+type origin struct {
+	role, address string
+}
+
+// WithOrigin returns a context whose actions are recorded as requested
+// with the given role from the given network address, as by a client of
+// the server
+func WithOrigin(ctx context.Context, role, address string) context.Context {
+	return context.WithValue(ctx, originKey{}, origin{role: role, address: address})
+}
+
+// Origin returns the role and address set by WithOrigin, or empty strings
+// when there are none
+func Origin(ctx context.Context) (role, address string) {
+	o, _ := ctx.Value(originKey{}).(origin)
+	return o.role, o.address
+}
+
+// actionInsertQuery inserts one action log row; see actionArgs
+const actionInsertQuery = `
+	INSERT INTO actions (action_type, filename, storage_id, bytes, duration_ms, outcome, error, hostname, tool_version, principal, idempotency_key, role, remote_addr)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+// Arguments for actionInsertQuery, stamping outcome, hostname, tool version,
+// principal and origin. Only successful actions keep their idempotency key.
+func actionArgs(ctx context.Context, record Action) []any {
+	outcome, errText := "success", ""
+	switch {
+	case errors.Is(record.Err, ErrAborted):
+		outcome, errText = "aborted", record.Err.Error()
+	case errors.Is(record.Err, context.Canceled):
+		outcome, errText = "interrupted", record.Err.Error()
+	case record.Err != nil:
+		outcome, errText = "failure", record.Err.Error()
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+
+	principal := record.Principal
+	if principal == "" {
+		principal = Principal(ctx)
+	}
+
+	key := sql.NullString{String: record.IdempotencyKey, Valid: record.IdempotencyKey != "" && record.Err == nil}
+
+	role, address := Origin(ctx)
+
+	return []any{record.ActionType, record.Filename, record.StorageID, record.Bytes,
+		record.Duration.Milliseconds(), outcome, errText, hostname, ToolVersion, principal, key, role, address}
+}
+
+// RecordAction writes an action to the log
+func RecordAction(ctx context.Context, db Executor, record Action) error {
+	_, err := db.ExecContext(ctx, actionInsertQuery, actionArgs(ctx, record)...)
+	return err
+}
+
+// LogAction writes a successful action without size or duration to the log
+func LogAction(ctx context.Context, db Executor, actionType, filename, storageID string) error {
+	return RecordAction(ctx, db, Action{ActionType: actionType, Filename: filename, StorageID: storageID})
+}
+
+// LastAction returns when an action of actionType on filename was last
+// logged, or the zero time when it never was
+func LastAction(ctx context.Context, db Executor, actionType, filename string) (time.Time, error) {
+	var last string
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(timestamp), '') FROM actions WHERE action_type = ? AND filename = ?;`,
+		actionType, filename).Scan(&last)
+	if err != nil || last == "" {
+		return time.Time{}, err
+	}
+	return parseDBTime(last)
+}
+
+// LoggedAction is an action log entry as read back from the database
+type LoggedAction struct {
+	Timestamp  time.Time
+	ActionType string
+	Filename   string
+	StorageID  string
+	Bytes      int64
+	DurationMs int64
+	Outcome    string
+	Error      string
+	Hostname   string
+	Version    string
+	Principal  string
+}
+
+// ListActions lists the most recent actions, optionally restricted to one
+// filename
+func ListActions(ctx context.Context, db Executor, filename string, limit int) ([]LoggedAction, error) {
+	query := `
+	SELECT timestamp, COALESCE(action_type, ''), COALESCE(filename, ''), COALESCE(storage_id, ''),
+		COALESCE(bytes, 0), COALESCE(duration_ms, 0), COALESCE(outcome, ''), COALESCE(error, ''),
+		COALESCE(hostname, ''), COALESCE(tool_version, ''), COALESCE(principal, '')
+	FROM actions`
+	var args []any
+	if filename != "" {
+		query += ` WHERE filename = ?`
+		args = append(args, filename)
+	}
+	query += ` ORDER BY timestamp DESC, id DESC LIMIT ?;`
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var actions []LoggedAction
+	for rows.Next() {
+		var a LoggedAction
+		err := rows.Scan(&a.Timestamp, &a.ActionType, &a.Filename, &a.StorageID, &a.Bytes,
+			&a.DurationMs, &a.Outcome, &a.Error, &a.Hostname, &a.Version, &a.Principal)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// RollbackActions lists the successful rollbacks of filename, oldest first
+func RollbackActions(ctx context.Context, db Executor, filename string) ([]LoggedAction, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT timestamp, COALESCE(action_type, ''), COALESCE(filename, ''), COALESCE(storage_id, ''),
+		COALESCE(bytes, 0), COALESCE(duration_ms, 0), COALESCE(outcome, ''), COALESCE(error, ''),
+		COALESCE(hostname, ''), COALESCE(tool_version, ''), COALESCE(principal, '')
+	FROM actions
+	WHERE action_type = 'rollback' AND filename = ? AND COALESCE(outcome, 'success') = 'success'
+	ORDER BY timestamp, id;`, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var actions []LoggedAction
+	for rows.Next() {
+		var a LoggedAction
+		err := rows.Scan(&a.Timestamp, &a.ActionType, &a.Filename, &a.StorageID, &a.Bytes,
+			&a.DurationMs, &a.Outcome, &a.Error, &a.Hostname, &a.Version, &a.Principal)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// StoreActions lists the successful actions that wrote or adopted a blob,
+// oldest first
+func StoreActions(ctx context.Context, db Executor) ([]LoggedAction, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT timestamp, COALESCE(action_type, ''), COALESCE(filename, ''), COALESCE(storage_id, ''),
+		COALESCE(bytes, 0), COALESCE(duration_ms, 0), COALESCE(outcome, ''), COALESCE(error, ''),
+		COALESCE(hostname, ''), COALESCE(tool_version, ''), COALESCE(principal, '')
+	FROM actions
+	WHERE action_type IN ('store', 'adopt') AND COALESCE(outcome, 'success') = 'success'
+	ORDER BY timestamp, id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var actions []LoggedAction
+	for rows.Next() {
+		var a LoggedAction
+		err := rows.Scan(&a.Timestamp, &a.ActionType, &a.Filename, &a.StorageID, &a.Bytes,
+			&a.DurationMs, &a.Outcome, &a.Error, &a.Hostname, &a.Version, &a.Principal)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoAlias is returned when removing an alias that was never set
+var ErrNoAlias = errors.New("no such alias")
+
+// Alias is a logical name standing for a tracked file
+type Alias struct {
+	Name     string `json:"alias"`
+	Filename string `json:"filename"`
+}
+
+// SetAlias makes alias stand for filename, replacing what it stood for
+// before. The file must have a recorded version, and the alias must not be
+// the name of one itself, so that it never hides a tracked file.
+func SetAlias(ctx context.Context, db *DB, alias, filename string) error {
+	alias = strings.TrimSpace(alias)
+	if alias == "" {
+		return fmt.Errorf("alias must not be empty")
+	}
+	if _, err := GetVersion(ctx, db, filename, 0); err != nil {
+		return err
+	}
+	if _, err := GetVersion(ctx, db, alias, 0); err == nil {
+		return fmt.Errorf("alias %s is the name of a stored file", alias)
+	} else if !errors.Is(err, ErrNoVersion) {
+		return err
+	}
+	return WithTx(ctx, db, func(tx *Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM file_aliases WHERE alias = ?;`, alias); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO file_aliases (alias, filename) VALUES (?, ?);`, alias, filename)
+		return err
+	})
+}
+
+// RemoveAlias removes alias, leaving the file it stood for as it is
+func RemoveAlias(ctx context.Context, db Executor, alias string) error {
+	result, err := db.ExecContext(ctx, `DELETE FROM file_aliases WHERE alias = ?;`, alias)
+	if err != nil {
+		return err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("%w: %s", ErrNoAlias, alias)
+	}
+	return nil
+}
+
+// ListAliases returns every alias sorted by name
+func ListAliases(ctx context.Context, db Executor) ([]Alias, error) {
+	rows, err := db.QueryContext(ctx, `SELECT alias, filename FROM file_aliases ORDER BY alias;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var aliases []Alias
+	for rows.Next() {
+		var a Alias
+		if err := rows.Scan(&a.Name, &a.Filename); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+// ResolveName returns the file an alias stands for, or name itself when it
+// is no alias
+func ResolveName(ctx context.Context, db Executor, name string) (string, error) {
+	var filename string
+	err := db.QueryRowContext(ctx, `SELECT filename FROM file_aliases WHERE alias = ?;`, name).Scan(&filename)
+	if errors.Is(err, sql.ErrNoRows) {
+		return name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve alias %s: %w", name, err)
+	}
+	return filename, nil
+}
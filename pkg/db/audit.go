@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// AuditEntry is an action log entry with who requested it and from where,
+// as handed to auditors
+type AuditEntry struct {
+	ID          int64     `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Principal   string    `json:"principal"`
+	Role        string    `json:"role"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Hostname    string    `json:"hostname"`
+	ActionType  string    `json:"action"`
+	Filename    string    `json:"filename"`
+	StorageID   string    `json:"storage_id"`
+	Bytes       int64     `json:"bytes"`
+	DurationMs  int64     `json:"duration_ms"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error"`
+	ToolVersion string    `json:"tool_version"`
+}
+
+// AuditActions lists the actions logged from since until before until,
+// oldest first. A zero bound leaves that end of the range open.
+func AuditActions(ctx context.Context, db Executor, since, until time.Time) ([]AuditEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT id, timestamp, COALESCE(principal, ''), COALESCE(role, ''), COALESCE(remote_addr, ''), COALESCE(hostname, ''),
+		COALESCE(action_type, ''), COALESCE(filename, ''), COALESCE(storage_id, ''), COALESCE(bytes, 0),
+		COALESCE(duration_ms, 0), COALESCE(outcome, ''), COALESCE(error, ''), COALESCE(tool_version, '')
+	FROM actions
+	ORDER BY timestamp, id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		err := rows.Scan(&e.ID, &e.Timestamp, &e.Principal, &e.Role, &e.RemoteAddr, &e.Hostname,
+			&e.ActionType, &e.Filename, &e.StorageID, &e.Bytes,
+			&e.DurationMs, &e.Outcome, &e.Error, &e.ToolVersion)
+		if err != nil {
+			return nil, err
+		}
+		// Timestamps are compared here as the dialects store them differently
+		if (!since.IsZero() && e.Timestamp.Before(since)) || (!until.IsZero() && !e.Timestamp.Before(until)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// BatchSize is the default number of rows written per batch transaction
+const BatchSize = 500
+
+// StoredFile is a newly written blob whose action and version rows are
+// still to be recorded
+type StoredFile struct {
+	Action   Action
+	Filename string
+	Hash     string
+	Path     string // where the blob was stored from
+	MimeType string // type of the content, and its kind; empty when unknown
+	Kind     string
+	Remove   func() error      // deletes the blob again if the rows cannot be committed; nil when nothing was written
+	External *ExternalBlob     // where the content stays when it was not copied into storage
+	Xattrs   map[string][]byte // extended attributes of the file stored from
+
+	OriginalName string // the name as read, when Filename is its normalized form
+}
+
+// Batch buffers action and version rows from bulk operations and writes
+// them in a single transaction with prepared statements, instead of one
+// implicit transaction per row
+type Batch struct {
+	db      *DB
+	size    int
+	actions []Action
+	stores  []StoredFile
+}
+
+// NewBatch creates a batch that flushes automatically every size rows
+func NewBatch(db *DB, size int) *Batch {
+	return &Batch{db: db, size: size}
+}
+
+// AddAction queues an action log row
+func (b *Batch) AddAction(ctx context.Context, record Action) error {
+	b.actions = append(b.actions, record)
+	return b.flushIfFull(ctx)
+}
+
+// AddStore queues the action and version rows of a newly written blob. If
+// the batch fails to commit, the blob is removed again.
+func (b *Batch) AddStore(ctx context.Context, file StoredFile) error {
+	b.stores = append(b.stores, file)
+	return b.flushIfFull(ctx)
+}
+
+func (b *Batch) flushIfFull(ctx context.Context) error {
+	if len(b.actions)+len(b.stores) < b.size {
+		return nil
+	}
+	return b.Flush(ctx)
+}
+
+// Flush writes all queued rows in one transaction
+func (b *Batch) Flush(ctx context.Context) error {
+	if len(b.actions) == 0 && len(b.stores) == 0 {
+		return nil
+	}
+
+	err := WithTx(ctx, b.db, func(tx *Tx) error {
+		insertAction, err := tx.PrepareContext(ctx, actionInsertQuery)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = insertAction.Close()
+		}()
+		lastVersion, err := tx.PrepareContext(ctx, latestHashQuery)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = lastVersion.Close()
+		}()
+		insertVersion, err := tx.PrepareContext(ctx, versionInsertQuery)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = insertVersion.Close()
+		}()
+
+		for _, record := range b.actions {
+			if _, err := insertAction.ExecContext(ctx, actionArgs(ctx, record)...); err != nil {
+				return fmt.Errorf("failed to log action: %w", err)
+			}
+		}
+		for _, blob := range b.stores {
+			var version int
+			var latest string
+			if err := lastVersion.QueryRowContext(ctx, blob.Filename, blob.Filename).Scan(&version, &latest); err != nil {
+				return fmt.Errorf("failed to read version: %w", err)
+			}
+			if latest == blob.Hash {
+				// A concurrent run stored the same content, which is the
+				// latest version already
+				action := blob.Action
+				action.ActionType = "store_duplicate"
+				if _, err := insertAction.ExecContext(ctx, actionArgs(ctx, action)...); err != nil {
+					return fmt.Errorf("failed to log action: %w", err)
+				}
+				continue
+			}
+			if _, err := insertAction.ExecContext(ctx, actionArgs(ctx, blob.Action)...); err != nil {
+				return fmt.Errorf("failed to log action: %w", err)
+			}
+			if _, err := insertVersion.ExecContext(ctx, blob.Filename, version+1, blob.Hash, blob.Path, blob.MimeType, blob.Kind); err != nil {
+				return fmt.Errorf("failed to log version: %w", versionConflict(err))
+			}
+			if err := SetVersionXattrs(ctx, tx, blob.Filename, version+1, blob.Xattrs); err != nil {
+				return fmt.Errorf("failed to record extended attributes: %w", err)
+			}
+			if err := SetVersionOriginalName(ctx, tx, blob.Filename, version+1, blob.OriginalName); err != nil {
+				return fmt.Errorf("failed to record original name: %w", err)
+			}
+			if blob.External != nil {
+				if err := addExternalBlob(ctx, tx, *blob.External); err != nil {
+					return fmt.Errorf("failed to register external blob: %w", err)
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		// Blobs written for this batch are unreferenced now
+		var errs []error
+		for _, blob := range b.stores {
+			if blob.Remove == nil {
+				continue
+			}
+			if removeErr := blob.Remove(); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+				errs = append(errs, removeErr)
+			}
+		}
+		err = errors.Join(append([]error{err}, errs...)...)
+	}
+
+	b.actions, b.stores = nil, nil
+	return err
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoBranch is returned for branches that were never created
+var ErrNoBranch = errors.New("no such branch")
+
+// Branch is a named line of versions of a file forked from one of its
+// versions, stored beside the mainline so that parallel edits are
+// versioned independently
+type Branch struct {
+	Filename string `json:"filename"`
+	Name     string `json:"name"`
+	Base     int    `json:"base"`             // version the branch was forked from
+	Merged   int    `json:"merged,omitempty"` // mainline version the branch was last merged as
+}
+
+// CreateBranch forks a branch of filename called name from version base,
+// or from the latest mainline version when base is 0. Until a version is
+// stored on it the branch has the content of its base.
+func CreateBranch(ctx context.Context, db *DB, filename, name string, base int) (Branch, error) {
+	if name == "" || strings.ContainsAny(name, "@/") {
+		return Branch{}, fmt.Errorf("invalid branch name %q (it must not be empty or contain @ or /)", name)
+	}
+	v, err := GetVersion(ctx, db, filename, base)
+	if err != nil {
+		return Branch{}, err
+	}
+	b := Branch{Filename: filename, Name: name, Base: v.Version}
+	err = WithTx(ctx, db, func(tx *Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, `SELECT 1 FROM file_branches WHERE filename = ? AND branch = ?;`, filename, name).Scan(&exists)
+		if err == nil {
+			return fmt.Errorf("%s already has a branch %s", filename, name)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO file_branches (filename, branch, base_version) VALUES (?, ?, ?);`, filename, name, b.Base)
+		return err
+	})
+	return b, err
+}
+
+// GetBranch returns the branch of filename called name
+func GetBranch(ctx context.Context, db Executor, filename, name string) (Branch, error) {
+	b := Branch{Filename: filename, Name: name}
+	var merged sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT base_version, merged_version FROM file_branches WHERE filename = ? AND branch = ?;`, filename, name).Scan(&b.Base, &merged)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, fmt.Errorf("%s branch %s: %w", filename, name, ErrNoBranch)
+	}
+	b.Merged = int(merged.Int64)
+	return b, err
+}
+
+// ListBranches returns the branches of filename sorted by name
+func ListBranches(ctx context.Context, db Executor, filename string) ([]Branch, error) {
+	rows, err := db.QueryContext(ctx, `SELECT branch, base_version, merged_version FROM file_branches WHERE filename = ? ORDER BY branch;`, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var branches []Branch
+	for rows.Next() {
+		b := Branch{Filename: filename}
+		var merged sql.NullInt64
+		if err := rows.Scan(&b.Name, &b.Base, &merged); err != nil {
+			return nil, err
+		}
+		b.Merged = int(merged.Int64)
+		branches = append(branches, b)
+	}
+	return branches, rows.Err()
+}
+
+// DeleteBranch forgets the branch of filename called name. Its versions
+// stay recorded and can still be retrieved by number.
+func DeleteBranch(ctx context.Context, db Executor, filename, name string) error {
+	result, err := db.ExecContext(ctx, `DELETE FROM file_branches WHERE filename = ? AND branch = ?;`, filename, name)
+	if err != nil {
+		return err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("%s branch %s: %w", filename, name, ErrNoBranch)
+	}
+	return nil
+}
+
+// GetBranchVersion returns version n of filename on branch, or its latest
+// version when n is 0, which is the base of a branch nothing was stored on
+// yet. An empty branch is the mainline, as with GetVersion.
+func GetBranchVersion(ctx context.Context, db Executor, filename, branch string, n int) (Version, error) {
+	if branch == "" {
+		return GetVersion(ctx, db, filename, n)
+	}
+	b, err := GetBranch(ctx, db, filename, branch)
+	if err != nil {
+		return Version{}, err
+	}
+	if n == b.Base {
+		return GetVersion(ctx, db, filename, n)
+	}
+	query := `SELECT ` + versionColumns + ` FROM versions WHERE filename = ? AND branch = ? AND version = ?;`
+	args := []any{filename, branch, n}
+	if n == 0 {
+		query = `SELECT ` + versionColumns + ` FROM versions WHERE filename = ? AND branch = ? ORDER BY version DESC LIMIT 1;`
+		args = args[:2]
+	}
+	v, err := scanVersion(db.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		if n == 0 {
+			return GetVersion(ctx, db, filename, b.Base)
+		}
+		return v, fmt.Errorf("%s version %d on branch %s: %w", filename, n, branch, ErrNoVersion)
+	}
+	return v, err
+}
+
+// LogBranchVersion appends the next version of filename to branch like
+// LogChangedVersion does to the mainline, returning the latest version of
+// the branch and whether it was appended
+func LogBranchVersion(ctx context.Context, db Executor, filename, branch, hash, path, mimeType, kind string) (int, bool, error) {
+	latest, err := GetBranchVersion(ctx, db, filename, branch, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	if latest.Hash == hash {
+		return latest.Version, false, nil
+	}
+	version, err := LogVersion(ctx, db, filename, hash, path, mimeType, kind)
+	if err != nil {
+		return 0, false, err
+	}
+	if err := SetVersionBranch(ctx, db, filename, version, branch); err != nil {
+		return 0, false, err
+	}
+	return version, true, nil
+}
+
+// MergeBranch appends the latest version of a branch to the mainline of
+// filename, returning the new mainline version. Mainline versions stored
+// since the branch was forked stay in the history behind it.
+func MergeBranch(ctx context.Context, db *DB, filename, name string) (Version, error) {
+	var merged Version
+	err := WithTx(ctx, db, func(tx *Tx) error {
+		b, err := GetBranch(ctx, tx, filename, name)
+		if err != nil {
+			return err
+		}
+		tip, err := GetBranchVersion(ctx, tx, filename, name, 0)
+		if err != nil {
+			return err
+		}
+		if tip.Version == b.Base || tip.Version < b.Merged {
+			return fmt.Errorf("%s branch %s has no versions to merge", filename, name)
+		}
+		version, err := LogVersion(ctx, tx, filename, tip.Hash, tip.Path, tip.MimeType, tip.Kind)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE file_branches SET merged_version = ? WHERE filename = ? AND branch = ?;`, version, filename, name); err != nil {
+			return err
+		}
+		merged, err = GetVersion(ctx, tx, filename, version)
+		return err
+	})
+	return merged, err
+}
+
+// Move the branches of from to to, renumbering their bases and merges as
+// RenameFile renumbered the versions
+func moveBranches(ctx context.Context, tx *Tx, from, to string, renumbered map[int]int) error {
+	branches, err := ListBranches(ctx, tx, from)
+	if err != nil {
+		return err
+	}
+	for _, b := range branches {
+		var merged any
+		if b.Merged > 0 {
+			merged = renumbered[b.Merged]
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE file_branches SET filename = ?, base_version = ?, merged_version = ? WHERE filename = ? AND branch = ?;`,
+			to, renumbered[b.Base], merged, from, b.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddBranch records a branch as it is, as when importing the history of
+// another repository whose versions were renumbered into b's already
+func AddBranch(ctx context.Context, db Executor, b Branch) error {
+	var merged any
+	if b.Merged > 0 {
+		merged = b.Merged
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO file_branches (filename, branch, base_version, merged_version) VALUES (?, ?, ?, ?);`, b.Filename, b.Name, b.Base, merged)
+	return err
+}
+
+// SetVersionBranch puts version n of filename on branch
+func SetVersionBranch(ctx context.Context, db Executor, filename string, n int, branch string) error {
+	_, err := db.ExecContext(ctx, `UPDATE versions SET branch = ? WHERE filename = ? AND version = ?;`, branch, filename, n)
+	return err
+}
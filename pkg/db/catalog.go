@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backup is a backup archive recorded in the catalog
+type Backup struct {
+	ID        int64     `json:"id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AddBackup records a finished backup archive in the catalog, with the
+// idempotency key of its action; see IdempotencyKey
+func AddBackup(ctx context.Context, db *DB, archive string, duration time.Duration, key string) error {
+	absPath, err := filepath.Abs(archive)
+	if err != nil {
+		return fmt.Errorf("failed to resolve archive path: %w", err)
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat archive: %w", err)
+	}
+
+	return WithTx(ctx, db, func(tx *Tx) error {
+		query := `INSERT INTO backups (path, size) VALUES (?, ?);`
+		if _, err := tx.ExecContext(ctx, query, absPath, info.Size()); err != nil {
+			return err
+		}
+		return RecordAction(ctx, tx, Action{
+			ActionType: "backup",
+			Filename:   filepath.Base(absPath),
+			StorageID:  absPath,
+			Bytes:      info.Size(),
+			Duration:   duration,
+
+			IdempotencyKey: key,
+		})
+	})
+}
+
+// ListBackups lists catalogued backups, newest first
+func ListBackups(ctx context.Context, db Executor) ([]Backup, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, path, size, timestamp FROM backups ORDER BY timestamp DESC, id DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var backups []Backup
+	for rows.Next() {
+		var b Backup
+		if err := rows.Scan(&b.ID, &b.Path, &b.Size, &b.Timestamp); err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	return backups, rows.Err()
+}
+
+// RemoveBackup deletes a backup from the catalog and logs the prune. It
+// fails with ErrRetained while a repository-wide lock retains the backup.
+func RemoveBackup(ctx context.Context, db Executor, b Backup) error {
+	if err := CheckBackupRetention(ctx, db, b); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM backups WHERE id = ?;`, b.ID); err != nil {
+		return fmt.Errorf("failed to remove backup %s from catalog: %w", b.Path, err)
+	}
+	return LogAction(ctx, db, "prune", filepath.Base(b.Path), b.Path)
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// BlobChecks returns when each blob was last verified, keyed by storage ID
+func BlobChecks(ctx context.Context, db Executor) (map[string]time.Time, error) {
+	rows, err := db.QueryContext(ctx, `SELECT storage_id, checked_at FROM blob_checks;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	checks := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var checkedAt time.Time
+		if err := rows.Scan(&id, &checkedAt); err != nil {
+			return nil, err
+		}
+		checks[id] = checkedAt
+	}
+	return checks, rows.Err()
+}
+
+// RecordBlobCheck records that a blob was verified at the given time
+func RecordBlobCheck(ctx context.Context, db *DB, id string, checkedAt time.Time) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM blob_checks WHERE storage_id = ?;`, id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO blob_checks (storage_id, checked_at) VALUES (?, ?);`, id, checkedAt.UTC())
+		return err
+	})
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+)
+
+// Chunk is a piece of a blob stored in chunks
+type Chunk struct {
+	ID   string // storage ID of the chunk
+	Size int64
+}
+
+// SetBlobChunks records the chunks the content of the blob id consists of,
+// in order, replacing those recorded before
+func SetBlobChunks(ctx context.Context, db Executor, id string, chunks []Chunk) error {
+	if err := RemoveBlobChunks(ctx, db, id); err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		if _, err := db.ExecContext(ctx, `INSERT INTO blob_chunks (storage_id, seq, chunk_id, size) VALUES (?, ?, ?, ?);`, id, i, chunk.ID, chunk.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveBlobChunks forgets the chunks of the blob id
+func RemoveBlobChunks(ctx context.Context, db Executor, id string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM blob_chunks WHERE storage_id = ?;`, id)
+	return err
+}
+
+// BlobChunks returns the chunks of the blob id in order, or none when it
+// is not stored in chunks
+func BlobChunks(ctx context.Context, db Executor, id string) ([]Chunk, error) {
+	rows, err := db.QueryContext(ctx, `SELECT chunk_id, size FROM blob_chunks WHERE storage_id = ? ORDER BY seq;`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var chunks []Chunk
+	for rows.Next() {
+		var chunk Chunk
+		if err := rows.Scan(&chunk.ID, &chunk.Size); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// ChunkedBlobs returns the size of every blob stored in chunks, keyed by
+// storage ID
+func ChunkedBlobs(ctx context.Context, db Executor) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT storage_id, SUM(size) FROM blob_chunks GROUP BY storage_id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var id string
+		var size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			return nil, err
+		}
+		sizes[id] = size
+	}
+	return sizes, rows.Err()
+}
+
+// ChunkUses returns how many pieces of blobs each chunk is, keyed by the
+// chunk's storage ID
+func ChunkUses(ctx context.Context, db Executor) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, `SELECT chunk_id, COUNT(*) FROM blob_chunks GROUP BY chunk_id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	uses := map[string]int{}
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		uses[id] = n
+	}
+	return uses, rows.Err()
+}
+
+// ChunkInUse reports whether the chunk id is a piece of any blob
+func ChunkInUse(ctx context.Context, db Executor, id string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM blob_chunks WHERE chunk_id = ?;`, id).Scan(&n)
+	return n > 0, err
+}
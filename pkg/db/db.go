@@ -0,0 +1,280 @@
+// Package db is the metadata database: action log, version history and
+// backup catalog, on SQLite, PostgreSQL or MySQL.
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/retry"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultFile is the SQLite database file used when no dsn is configured
+const DefaultFile = "file_manager.db"
+
+// MemoryDSN as the sqlite3 dsn opens a private in-memory database that
+// disappears when it is closed, as tests and dry runs need
+const MemoryDSN = ":memory:"
+
+// memoryDatabases numbers in-memory databases so that each Open gets its own
+var memoryDatabases atomic.Int64
+
+// Config selects and tunes the metadata database. Driver is one of
+// sqlite3 (default), postgres or mysql; DSN is the driver's connection
+// string, or the database file path for sqlite3. The remaining settings
+// only apply to SQLite.
+type Config struct {
+	Driver      string `json:"driver"`
+	DSN         string `json:"dsn"`
+	JournalMode string `json:"journal_mode"`
+	BusyTimeout int    `json:"busy_timeout_ms"`
+	Synchronous string `json:"synchronous"`
+	ForeignKeys *bool  `json:"foreign_keys"`
+
+	// AutoMaintain is a duration such as "168h"; when set, db-maintain runs
+	// automatically once that much time has passed since the previous run
+	AutoMaintain string `json:"auto_maintain"`
+}
+
+// DefaultConfig returns the settings used when no config file overrides them
+func DefaultConfig() Config {
+	return Config{
+		Driver:      "sqlite3",
+		JournalMode: "WAL",
+		BusyTimeout: 5000,
+		Synchronous: "NORMAL",
+	}
+}
+
+// Build the go-sqlite3 DSN for path. Pragmas are passed as DSN parameters
+// so that every pooled connection gets them, not just the first one.
+func (c Config) sqliteDSN(path string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", c.JournalMode)
+	params.Set("_busy_timeout", strconv.Itoa(c.BusyTimeout))
+	params.Set("_synchronous", c.Synchronous)
+	if c.ForeignKeys == nil || *c.ForeignKeys {
+		params.Set("_foreign_keys", "on")
+	} else {
+		params.Set("_foreign_keys", "off")
+	}
+	return "file:" + path + "?" + params.Encode()
+}
+
+// dialect captures the differences between the supported metadata databases.
+// Queries are always written with ? placeholders and rebound per dialect.
+type dialect struct {
+	name                 string // migrations subdirectory
+	driver               string // database/sql driver name
+	numberedPlaceholders bool   // $1, $2, ... instead of ?
+	schemaVersionDDL     string
+}
+
+var dialects = map[string]dialect{
+	"sqlite3": {
+		name:   "sqlite",
+		driver: "sqlite3",
+		schemaVersionDDL: `CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+	},
+	"postgres": {
+		name:                 "postgres",
+		driver:               "pgx",
+		numberedPlaceholders: true,
+		schemaVersionDDL: `CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT,
+			applied_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);`,
+	},
+	"mysql": {
+		name:   "mysql",
+		driver: "mysql",
+		schemaVersionDDL: `CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255),
+			applied_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+		);`,
+	},
+}
+
+// Rewrite ? placeholders into the dialect's native form
+func (d dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Return an SQL expression truncating a timestamp column to a YYYY-MM-DD day
+func (d dialect) day(column string) string {
+	switch d.name {
+	case "postgres":
+		return "to_char(" + column + ", 'YYYY-MM-DD')"
+	case "mysql":
+		return "DATE_FORMAT(" + column + ", '%Y-%m-%d')"
+	default:
+		return "strftime('%Y-%m-%d', " + column + ")"
+	}
+}
+
+// Executor is satisfied by both *DB and *Tx, so the log helpers can run
+// standalone or as part of a larger transaction
+type Executor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// DB is the metadata database: action log, version history and backup catalog
+type DB struct {
+	db      *sql.DB
+	dialect dialect
+	retry   retry.Policy // of transactions
+}
+
+// Open the metadata database described by the config. A relative sqlite3
+// path is resolved against root.
+func Open(cfg Config, root string) (*DB, error) {
+	d, ok := dialects[cfg.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %q (use sqlite3, postgres or mysql)", cfg.Driver)
+	}
+
+	dsn := cfg.DSN
+	switch cfg.Driver {
+	case "sqlite3":
+		if dsn == MemoryDSN {
+			// A named shared-cache database is seen by every pooled connection
+			name := "fm-memory-" + strconv.FormatInt(memoryDatabases.Add(1), 10)
+			dsn = cfg.sqliteDSN(name) + "&mode=memory&cache=shared"
+			break
+		}
+		path := dsn
+		if path == "" {
+			path = DefaultFile
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		dsn = cfg.sqliteDSN(path)
+	case "mysql":
+		// Timestamps must scan into time.Time like the other drivers
+		if !strings.Contains(dsn, "parseTime=") {
+			if strings.Contains(dsn, "?") {
+				dsn += "&parseTime=true"
+			} else {
+				dsn += "?parseTime=true"
+			}
+		}
+	}
+	if dsn == "" {
+		return nil, fmt.Errorf("database driver %s requires a dsn", cfg.Driver)
+	}
+
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db, dialect: d}, nil
+}
+
+func (m *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return m.db.ExecContext(ctx, m.dialect.rebind(query), args...)
+}
+
+func (m *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return m.db.QueryContext(ctx, m.dialect.rebind(query), args...)
+}
+
+func (m *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return m.db.QueryRowContext(ctx, m.dialect.rebind(query), args...)
+}
+
+// BeginTx starts a transaction that is rolled back if ctx is cancelled
+func (m *DB) BeginTx(ctx context.Context) (*Tx, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{tx: tx, dialect: m.dialect}, nil
+}
+
+// PingContext checks that the database can be reached
+func (m *DB) PingContext(ctx context.Context) error {
+	return m.db.PingContext(ctx)
+}
+
+// Close the underlying connection pool
+func (m *DB) Close() error {
+	return m.db.Close()
+}
+
+// Tx is a transaction on the metadata database
+type Tx struct {
+	tx      *sql.Tx
+	dialect dialect
+}
+
+func (t *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return t.tx.ExecContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return t.tx.QueryContext(ctx, t.dialect.rebind(query), args...)
+}
+
+func (t *Tx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return t.tx.QueryRowContext(ctx, t.dialect.rebind(query), args...)
+}
+
+// Run an INSERT of one row into a table with an id column and return the
+// id the row got, as MySQL reports it and the others return it
+func (t *Tx) insertID(ctx context.Context, query string, args ...any) (int64, error) {
+	if t.dialect.name == "mysql" {
+		result, err := t.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.LastInsertId()
+	}
+	var id int64
+	err := t.QueryRowContext(ctx, strings.TrimSuffix(query, ";")+" RETURNING id;", args...).Scan(&id)
+	return id, err
+}
+
+// PrepareContext prepares a statement for repeated execution within the
+// transaction
+func (t *Tx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return t.tx.PrepareContext(ctx, t.dialect.rebind(query))
+}
+
+func (t *Tx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *Tx) Rollback() error {
+	return t.tx.Rollback()
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// DeltaBlob is content stored as the difference to another blob: applying
+// the blob DeltaID to the content of BaseID gives the content of StorageID
+type DeltaBlob struct {
+	StorageID string
+	BaseID    string
+	DeltaID   string
+	Size      int64 // bytes of the content
+}
+
+// AddDeltaBlob inserts or replaces a delta blob
+func AddDeltaBlob(ctx context.Context, db Executor, blob DeltaBlob) error {
+	if err := RemoveDeltaBlob(ctx, db, blob.StorageID); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO delta_blobs (storage_id, base_id, delta_id, size) VALUES (?, ?, ?, ?);`,
+		blob.StorageID, blob.BaseID, blob.DeltaID, blob.Size)
+	return err
+}
+
+// RemoveDeltaBlob forgets the delta blob with the given storage ID
+func RemoveDeltaBlob(ctx context.Context, db Executor, id string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM delta_blobs WHERE storage_id = ?;`, id)
+	return err
+}
+
+// GetDeltaBlob returns the delta blob with the given storage ID, reporting
+// whether there is one
+func GetDeltaBlob(ctx context.Context, db Executor, id string) (DeltaBlob, bool, error) {
+	blob := DeltaBlob{StorageID: id}
+	err := db.QueryRowContext(ctx, `SELECT base_id, delta_id, size FROM delta_blobs WHERE storage_id = ?;`, id).Scan(&blob.BaseID, &blob.DeltaID, &blob.Size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return blob, false, nil
+	}
+	return blob, err == nil, err
+}
+
+// DeltaBlobs returns the delta blobs, keyed by storage ID
+func DeltaBlobs(ctx context.Context, db Executor) (map[string]DeltaBlob, error) {
+	rows, err := db.QueryContext(ctx, `SELECT storage_id, base_id, delta_id, size FROM delta_blobs;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	blobs := map[string]DeltaBlob{}
+	for rows.Next() {
+		var blob DeltaBlob
+		if err := rows.Scan(&blob.StorageID, &blob.BaseID, &blob.DeltaID, &blob.Size); err != nil {
+			return nil, err
+		}
+		blobs[blob.StorageID] = blob
+	}
+	return blobs, rows.Err()
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ExternalBlob is content registered in place rather than copied into
+// storage: the blob is the file at Path, as long as it still holds the
+// content it had when registered
+type ExternalBlob struct {
+	StorageID string
+	Path      string // host path of the file
+	Size      int64
+	ModTime   time.Time
+}
+
+// Insert or replace an external blob
+func addExternalBlob(ctx context.Context, db Executor, blob ExternalBlob) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM external_blobs WHERE storage_id = ?;`, blob.StorageID); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO external_blobs (storage_id, path, size, mod_time) VALUES (?, ?, ?, ?);`,
+		blob.StorageID, blob.Path, blob.Size, blob.ModTime.UnixNano())
+	return err
+}
+
+// GetExternalBlob returns the external blob with the given storage ID,
+// reporting whether there is one
+func GetExternalBlob(ctx context.Context, db Executor, id string) (ExternalBlob, bool, error) {
+	blob := ExternalBlob{StorageID: id}
+	var modTime int64
+	err := db.QueryRowContext(ctx, `SELECT path, size, mod_time FROM external_blobs WHERE storage_id = ?;`, id).Scan(&blob.Path, &blob.Size, &modTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return blob, false, nil
+	}
+	blob.ModTime = time.Unix(0, modTime)
+	return blob, err == nil, err
+}
+
+// ExternalBlobIDs returns the storage IDs of the external blobs
+func ExternalBlobIDs(ctx context.Context, db Executor) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT storage_id FROM external_blobs;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	ids := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// racyWindow is how recently a file may have been modified for its digest
+// to be cached. A write within the file system's timestamp granularity of
+// the hashing could leave size and modification time unchanged.
+const racyWindow = 2 * time.Second
+
+// HashCache remembers the digests of files by path, so that files whose
+// size, modification time and inode are unchanged need not be hashed again.
+// New digests are written in batches; Flush writes the pending ones.
+type HashCache struct {
+	db        *DB
+	algorithm string
+
+	mu      sync.Mutex
+	pending []cachedHash
+}
+
+// cachedHash is a digest with the state of the file it was computed from
+type cachedHash struct {
+	path    string
+	size    int64
+	modTime int64 // Unix nanoseconds
+	inode   int64
+	hash    string
+}
+
+// NewHashCache creates a cache of the digests of files under algorithm
+func NewHashCache(db *DB, algorithm string) *HashCache {
+	return &HashCache{db: db, algorithm: algorithm}
+}
+
+// Return the cache entry describing a file in its current state
+func newCachedHash(path string, info fs.FileInfo, sum string) cachedHash {
+	return cachedHash{
+		path:    path,
+		size:    info.Size(),
+		modTime: info.ModTime().UnixNano(),
+		inode:   int64(fsutil.FileID(info)),
+		hash:    sum,
+	}
+}
+
+// Lookup returns the digest of the file at path if it was cached while
+// the file was in the state info describes. Failed lookups count as misses.
+func (c *HashCache) Lookup(ctx context.Context, path string, info fs.FileInfo) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	want := newCachedHash(path, info, "")
+	var got cachedHash
+	err := c.db.QueryRowContext(ctx, `SELECT size, mod_time, inode, hash FROM hash_cache WHERE path = ? AND algorithm = ?;`,
+		path, c.algorithm).Scan(&got.size, &got.modTime, &got.inode, &got.hash)
+	if err != nil || got.size != want.size || got.modTime != want.modTime || got.inode != want.inode {
+		return "", false
+	}
+	return got.hash, true
+}
+
+// Remember caches the digest of the file at path, hashed in the state info
+// describes, writing the batch once it is full. Files modified too recently
+// to tell later changes apart are not cached.
+func (c *HashCache) Remember(ctx context.Context, path string, info fs.FileInfo, sum string) error {
+	if c == nil || time.Since(info.ModTime()) < racyWindow {
+		return nil
+	}
+	c.mu.Lock()
+	c.pending = append(c.pending, newCachedHash(path, info, sum))
+	full := len(c.pending) >= BatchSize
+	c.mu.Unlock()
+	if full {
+		return c.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush writes the pending digests in one transaction
+func (c *HashCache) Flush(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return WithTx(ctx, c.db, func(tx *Tx) error {
+		remove, err := tx.PrepareContext(ctx, `DELETE FROM hash_cache WHERE path = ? AND algorithm = ?;`)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = remove.Close()
+		}()
+		insert, err := tx.PrepareContext(ctx, `INSERT INTO hash_cache (path, algorithm, size, mod_time, inode, hash) VALUES (?, ?, ?, ?, ?, ?);`)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = insert.Close()
+		}()
+		for _, h := range pending {
+			// Delete and insert is the one upsert every dialect understands
+			if _, err := remove.ExecContext(ctx, h.path, c.algorithm); err != nil {
+				return err
+			}
+			if _, err := insert.ExecContext(ctx, h.path, c.algorithm, h.size, h.modTime, h.inode, h.hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,337 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is one row of the actions, versions or backups table in a
+// backend-neutral form used by export, import and merge
+type Record struct {
+	Table      string    `json:"table"`
+	ID         int64     `json:"id"`
+	ActionType string    `json:"action_type,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	StorageID  string    `json:"storage_id,omitempty"`
+	Version    int       `json:"version,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	MimeType   string    `json:"mime_type,omitempty"`
+	Kind       string    `json:"kind,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+
+	// Action details
+	Bytes       int64  `json:"bytes,omitempty"`
+	DurationMs  int64  `json:"duration_ms,omitempty"`
+	Outcome     string `json:"outcome,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
+	ToolVersion string `json:"tool_version,omitempty"`
+	Principal   string `json:"principal,omitempty"`
+}
+
+var historyCSVHeader = []string{
+	"table", "id", "action_type", "filename", "storage_id", "version", "hash", "path", "size", "timestamp",
+	"bytes", "duration_ms", "outcome", "error", "hostname", "tool_version", "principal", "mime_type", "kind",
+}
+
+// ReadHistory reads every history row from the database
+func ReadHistory(ctx context.Context, db Executor) ([]Record, error) {
+	queries := []struct {
+		table string
+		query string
+		scan  func(scanner interface{ Scan(...any) error }, r *Record) error
+	}{
+		{"actions", `SELECT id, COALESCE(action_type, ''), COALESCE(filename, ''), COALESCE(storage_id, ''), timestamp,
+			COALESCE(bytes, 0), COALESCE(duration_ms, 0), COALESCE(outcome, ''), COALESCE(error, ''),
+			COALESCE(hostname, ''), COALESCE(tool_version, ''), COALESCE(principal, '') FROM actions ORDER BY id;`,
+			func(s interface{ Scan(...any) error }, r *Record) error {
+				return s.Scan(&r.ID, &r.ActionType, &r.Filename, &r.StorageID, &r.Timestamp,
+					&r.Bytes, &r.DurationMs, &r.Outcome, &r.Error, &r.Hostname, &r.ToolVersion, &r.Principal)
+			}},
+		{"versions", `SELECT id, COALESCE(filename, ''), COALESCE(version, 0), COALESCE(hash, ''), COALESCE(path, ''),
+			COALESCE(mime_type, ''), COALESCE(kind, ''), timestamp FROM versions ORDER BY id;`,
+			func(s interface{ Scan(...any) error }, r *Record) error {
+				return s.Scan(&r.ID, &r.Filename, &r.Version, &r.Hash, &r.Path, &r.MimeType, &r.Kind, &r.Timestamp)
+			}},
+		{"backups", `SELECT id, COALESCE(path, ''), COALESCE(size, 0), timestamp FROM backups ORDER BY id;`,
+			func(s interface{ Scan(...any) error }, r *Record) error {
+				return s.Scan(&r.ID, &r.Path, &r.Size, &r.Timestamp)
+			}},
+	}
+
+	var records []Record
+	for _, q := range queries {
+		rows, err := db.QueryContext(ctx, q.query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", q.table, err)
+		}
+		for rows.Next() {
+			r := Record{Table: q.table}
+			if err := q.scan(rows, &r); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("failed to read %s: %w", q.table, err)
+			}
+			records = append(records, r)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", q.table, err)
+		}
+	}
+	return records, nil
+}
+
+// ExportHistory writes the action log, version history and backup catalog
+// in the given format: jsonl, json, csv or sql
+func ExportHistory(ctx context.Context, db Executor, format string, w io.Writer) error {
+	records, err := ReadHistory(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "jsonl":
+		encoder := json.NewEncoder(bw)
+		for _, r := range records {
+			if err := encoder.Encode(r); err != nil {
+				return err
+			}
+		}
+	case "json":
+		encoder := json.NewEncoder(bw)
+		encoder.SetIndent("", "  ")
+		if records == nil {
+			records = []Record{}
+		}
+		if err := encoder.Encode(records); err != nil {
+			return err
+		}
+	case "csv":
+		cw := csv.NewWriter(bw)
+		if err := cw.Write(historyCSVHeader); err != nil {
+			return err
+		}
+		for _, r := range records {
+			row := []string{
+				r.Table, strconv.FormatInt(r.ID, 10), r.ActionType, r.Filename, r.StorageID,
+				strconv.Itoa(r.Version), r.Hash, r.Path, strconv.FormatInt(r.Size, 10),
+				r.Timestamp.UTC().Format(time.RFC3339Nano),
+				strconv.FormatInt(r.Bytes, 10), strconv.FormatInt(r.DurationMs, 10), r.Outcome, r.Error,
+				r.Hostname, r.ToolVersion, r.Principal, r.MimeType, r.Kind,
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	case "sql":
+		for _, r := range records {
+			if _, err := fmt.Fprintln(bw, r.insertStatement()); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported export format %q (use jsonl, json, csv or sql)", format)
+	}
+
+	return bw.Flush()
+}
+
+// Render the record as a portable INSERT statement
+func (r Record) insertStatement() string {
+	ts := quoteSQL(r.Timestamp.UTC().Format(time.DateTime))
+	switch r.Table {
+	case "actions":
+		return fmt.Sprintf("INSERT INTO actions (action_type, filename, storage_id, timestamp, bytes, duration_ms, outcome, error, hostname, tool_version, principal) VALUES (%s, %s, %s, %s, %d, %d, %s, %s, %s, %s, %s);",
+			quoteSQL(r.ActionType), quoteSQL(r.Filename), quoteSQL(r.StorageID), ts, r.Bytes, r.DurationMs,
+			quoteSQL(r.outcome()), quoteSQL(r.Error), quoteSQL(r.Hostname), quoteSQL(r.ToolVersion), quoteSQL(r.Principal))
+	case "versions":
+		return fmt.Sprintf("INSERT INTO versions (filename, version, hash, path, mime_type, kind, timestamp) VALUES (%s, %d, %s, %s, %s, %s, %s);",
+			quoteSQL(r.Filename), r.Version, quoteSQL(r.Hash), quoteSQL(r.Path), quoteSQL(r.MimeType), quoteSQL(r.Kind), ts)
+	default:
+		return fmt.Sprintf("INSERT INTO backups (path, size, timestamp) VALUES (%s, %d, %s);",
+			quoteSQL(r.Path), r.Size, ts)
+	}
+}
+
+// Outcome of an action record; records exported before outcomes were
+// tracked only contain successful actions
+func (r Record) outcome() string {
+	if r.Outcome == "" {
+		return "success"
+	}
+	return r.Outcome
+}
+
+// Quote a string as an SQL literal
+func quoteSQL(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// Insert the record into its table. Row IDs are reassigned by the target
+// database so that imports never collide with existing rows.
+func (r Record) Insert(ctx context.Context, tx Executor) error {
+	var err error
+	switch r.Table {
+	case "actions":
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO actions (action_type, filename, storage_id, timestamp, bytes, duration_ms, outcome, error, hostname, tool_version, principal)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+			r.ActionType, r.Filename, r.StorageID, r.Timestamp.UTC(), r.Bytes, r.DurationMs, r.outcome(),
+			r.Error, r.Hostname, r.ToolVersion, r.Principal)
+	case "versions":
+		_, err = tx.ExecContext(ctx, `INSERT INTO versions (filename, version, hash, path, mime_type, kind, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?);`,
+			r.Filename, r.Version, r.Hash, r.Path, r.MimeType, r.Kind, r.Timestamp.UTC())
+	case "backups":
+		_, err = tx.ExecContext(ctx, `INSERT INTO backups (path, size, timestamp) VALUES (?, ?, ?);`,
+			r.Path, r.Size, r.Timestamp.UTC())
+	default:
+		err = fmt.Errorf("unknown table %q", r.Table)
+	}
+	return err
+}
+
+// ImportHistory imports history previously written by ExportHistory, in a
+// single transaction, and returns the number of records or statements applied
+func ImportHistory(ctx context.Context, db *DB, format string, r io.Reader) (int, error) {
+	if format == "sql" {
+		script, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		statements := splitStatements(string(script))
+		err = WithTx(ctx, db, func(tx *Tx) error {
+			for _, statement := range statements {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("failed to execute %q: %w", statement, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		return len(statements), nil
+	}
+
+	records, err := decodeHistory(format, r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = WithTx(ctx, db, func(tx *Tx) error {
+		for i, record := range records {
+			if err := record.Insert(ctx, tx); err != nil {
+				return fmt.Errorf("failed to import record %d: %w", i+1, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// Decode jsonl, json or csv history records
+func decodeHistory(format string, r io.Reader) ([]Record, error) {
+	var records []Record
+	switch format {
+	case "jsonl":
+		decoder := json.NewDecoder(r)
+		for {
+			var record Record
+			err := decoder.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode record %d: %w", len(records)+1, err)
+			}
+			records = append(records, record)
+		}
+	case "json":
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, fmt.Errorf("failed to decode history: %w", err)
+		}
+	case "csv":
+		cr := csv.NewReader(r)
+		// Exports made before principals and content types were recorded
+		// lack the last columns
+		cr.FieldsPerRecord = -1
+		rows, err := cr.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv: %w", err)
+		}
+		for i, row := range rows {
+			if i == 0 {
+				continue // header
+			}
+			if len(row) != len(historyCSVHeader) && len(row) != len(historyCSVHeader)-2 && len(row) != len(historyCSVHeader)-3 {
+				return nil, fmt.Errorf("invalid csv row %d: expected %d fields, got %d", i+1, len(historyCSVHeader), len(row))
+			}
+			record, err := parseHistoryRow(row)
+			if err != nil {
+				return nil, fmt.Errorf("invalid csv row %d: %w", i+1, err)
+			}
+			records = append(records, record)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported import format %q (use jsonl, json, csv or sql)", format)
+	}
+	return records, nil
+}
+
+// Parse a csv row laid out as historyCSVHeader
+func parseHistoryRow(row []string) (Record, error) {
+	record := Record{
+		Table:      row[0],
+		ActionType: row[2],
+		Filename:   row[3],
+		StorageID:  row[4],
+		Hash:       row[6],
+		Path:       row[7],
+	}
+
+	var err error
+	if record.ID, err = strconv.ParseInt(row[1], 10, 64); err != nil {
+		return record, fmt.Errorf("invalid id: %w", err)
+	}
+	if record.Version, err = strconv.Atoi(row[5]); err != nil {
+		return record, fmt.Errorf("invalid version: %w", err)
+	}
+	if record.Size, err = strconv.ParseInt(row[8], 10, 64); err != nil {
+		return record, fmt.Errorf("invalid size: %w", err)
+	}
+	if record.Timestamp, err = time.Parse(time.RFC3339Nano, row[9]); err != nil {
+		return record, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	if record.Bytes, err = strconv.ParseInt(row[10], 10, 64); err != nil {
+		return record, fmt.Errorf("invalid bytes: %w", err)
+	}
+	if record.DurationMs, err = strconv.ParseInt(row[11], 10, 64); err != nil {
+		return record, fmt.Errorf("invalid duration: %w", err)
+	}
+	record.Outcome, record.Error, record.Hostname, record.ToolVersion = row[12], row[13], row[14], row[15]
+	if len(row) > 16 {
+		record.Principal = row[16]
+	}
+	if len(row) > 18 {
+		record.MimeType, record.Kind = row[17], row[18]
+	}
+	return record, nil
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"strings"
+	"time"
+)
+
+// ErrHeld is wrapped by the errors of changes refused because they would
+// delete or rewrite versions or backups under a legal hold
+var ErrHeld = errors.New("under legal hold")
+
+// AllFiles is the pattern of a legal hold covering every file, which also
+// keeps orphaned blobs from being removed
+const AllFiles = "**"
+
+// LegalHold freezes every version of the files whose names match Pattern
+// until it is released, however old they are. Unlike retention locks,
+// holds do not expire and are released on request.
+type LegalHold struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name,omitempty"` // such as a case number
+	Pattern    string     `json:"pattern"`        // as by fsutil.MatchGlob
+	Principal  string     `json:"principal,omitempty"`
+	Created    time.Time  `json:"created"`
+	ReleasedBy string     `json:"released_by,omitempty"`
+	Released   *time.Time `json:"released,omitempty"` // nil while the hold is active
+}
+
+// Describe the hold by its name, or its pattern when it has none
+func (h LegalHold) String() string {
+	if h.Name == "" {
+		return h.Pattern
+	}
+	return h.Name
+}
+
+// Covers reports whether the hold is active and freezes the file
+func (h LegalHold) Covers(filename string) bool {
+	if h.Released != nil {
+		return false
+	}
+	ok, _ := fsutil.MatchGlob(h.Pattern, filename)
+	return ok
+}
+
+// AddHold places a hold and logs it as a hold_add action
+func AddHold(ctx context.Context, db *DB, hold LegalHold) (int64, error) {
+	hold.Pattern = strings.TrimSpace(hold.Pattern)
+	if hold.Pattern == "" {
+		return 0, errors.New("a legal hold needs a pattern")
+	}
+	if _, err := fsutil.MatchGlob(hold.Pattern, ""); err != nil {
+		return 0, fmt.Errorf("invalid pattern %q: %w", hold.Pattern, err)
+	}
+	var id int64
+	err := WithTx(ctx, db, func(tx *Tx) error {
+		name := sql.NullString{String: hold.Name, Valid: hold.Name != ""}
+		var err error
+		id, err = tx.insertID(ctx, `INSERT INTO legal_holds (name, pattern, principal) VALUES (?, ?, ?);`, name, hold.Pattern, Principal(ctx))
+		if err != nil {
+			return err
+		}
+		return RecordAction(ctx, tx, Action{ActionType: "hold_add", Filename: hold.Pattern, StorageID: hold.Name})
+	})
+	return id, err
+}
+
+// ReleaseHold releases an active hold and logs it as a hold_release action.
+// Callers check that the principal of ctx is allowed to.
+func ReleaseHold(ctx context.Context, db *DB, id int64) (LegalHold, error) {
+	var hold LegalHold
+	err := WithTx(ctx, db, func(tx *Tx) error {
+		holds, err := listHolds(ctx, tx, `id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if len(holds) == 0 {
+			return fmt.Errorf("no legal hold %d", id)
+		}
+		if hold = holds[0]; hold.Released != nil {
+			return fmt.Errorf("legal hold %d was released already", id)
+		}
+		now := time.Now().UTC()
+		if _, err := tx.ExecContext(ctx, `UPDATE legal_holds SET released_by = ?, released_at = ? WHERE id = ?;`, Principal(ctx), now, id); err != nil {
+			return err
+		}
+		hold.ReleasedBy, hold.Released = Principal(ctx), &now
+		return RecordAction(ctx, tx, Action{ActionType: "hold_release", Filename: hold.Pattern, StorageID: hold.Name})
+	})
+	return hold, err
+}
+
+// ListHolds returns every legal hold, released ones included, oldest first
+func ListHolds(ctx context.Context, db Executor) ([]LegalHold, error) {
+	return listHolds(ctx, db, `1 = 1`)
+}
+
+// ActiveHolds returns the legal holds not released yet
+func ActiveHolds(ctx context.Context, db Executor) ([]LegalHold, error) {
+	return listHolds(ctx, db, `released_at IS NULL`)
+}
+
+// Return the legal holds a condition selects, oldest first
+func listHolds(ctx context.Context, db Executor, where string, args ...any) ([]LegalHold, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT id, COALESCE(name, ''), pattern, COALESCE(principal, ''), created_at, COALESCE(released_by, ''), released_at
+	FROM legal_holds WHERE `+where+` ORDER BY id;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read legal holds: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var holds []LegalHold
+	for rows.Next() {
+		var h LegalHold
+		var released sql.NullTime
+		if err := rows.Scan(&h.ID, &h.Name, &h.Pattern, &h.Principal, &h.Created, &h.ReleasedBy, &released); err != nil {
+			return nil, err
+		}
+		if released.Valid {
+			h.Released = &released.Time
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+// CheckGlobalHold fails with ErrHeld while a hold covers every file
+func CheckGlobalHold(ctx context.Context, db Executor) error {
+	holds, err := ActiveHolds(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, h := range holds {
+		if h.Pattern == AllFiles {
+			return fmt.Errorf("%w: %s covers every file", ErrHeld, h)
+		}
+	}
+	return nil
+}
+
+// IsRefused reports whether err refused a change because of a retention
+// lock or a legal hold
+func IsRefused(err error) bool {
+	return errors.Is(err, ErrRetained) || errors.Is(err, ErrHeld)
+}
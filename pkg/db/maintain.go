@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maintenanceTables are the tables checked and optimized by maintenance
+var maintenanceTables = []string{"actions", "versions", "backups"}
+
+// Size returns the size of the metadata database in bytes
+func Size(ctx context.Context, db *DB) (int64, error) {
+	var size int64
+	var err error
+	switch db.dialect.name {
+	case "sqlite":
+		err = db.QueryRowContext(ctx, `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size();`).Scan(&size)
+	case "postgres":
+		err = db.QueryRowContext(ctx, `SELECT pg_database_size(current_database());`).Scan(&size)
+	case "mysql":
+		err = db.QueryRowContext(ctx, `SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE();`).Scan(&size)
+	default:
+		err = fmt.Errorf("size not supported for %s", db.dialect.name)
+	}
+	return size, err
+}
+
+// IntegrityCheck verifies the integrity of the database, returning the
+// problems found
+func IntegrityCheck(ctx context.Context, db *DB) ([]string, error) {
+	var problems []string
+	switch db.dialect.name {
+	case "sqlite":
+		rows, err := db.QueryContext(ctx, `PRAGMA integrity_check;`)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+		for rows.Next() {
+			var result string
+			if err := rows.Scan(&result); err != nil {
+				return nil, err
+			}
+			if result != "ok" {
+				problems = append(problems, result)
+			}
+		}
+		return problems, rows.Err()
+	case "mysql":
+		for _, table := range maintenanceTables {
+			var name, op, msgType, msgText string
+			if err := db.QueryRowContext(ctx, `CHECK TABLE `+table+`;`).Scan(&name, &op, &msgType, &msgText); err != nil {
+				return nil, err
+			}
+			if msgType == "error" || (msgType == "status" && !strings.EqualFold(msgText, "OK")) {
+				problems = append(problems, name+": "+msgText)
+			}
+		}
+		return problems, nil
+	default:
+		// PostgreSQL has no online integrity check; amcheck requires an extension
+		return nil, nil
+	}
+}
+
+// Statements that rebuild indexes, reclaim space and refresh planner statistics
+func maintenanceStatements(d dialect) []string {
+	switch d.name {
+	case "sqlite":
+		return []string{`REINDEX;`, `VACUUM;`, `ANALYZE;`}
+	case "postgres":
+		var statements []string
+		for _, table := range maintenanceTables {
+			statements = append(statements, `REINDEX TABLE `+table+`;`)
+		}
+		return append(statements, `VACUUM ANALYZE;`)
+	case "mysql":
+		var statements []string
+		for _, table := range maintenanceTables {
+			statements = append(statements, `OPTIMIZE TABLE `+table+`;`, `ANALYZE TABLE `+table+`;`)
+		}
+		return statements
+	}
+	return nil
+}
+
+// MaintainReport describes a maintenance run
+type MaintainReport struct {
+	Problems   []string `json:"problems"` // integrity check findings; none when the database is sound
+	SizeBefore int64    `json:"size_before"`
+	SizeAfter  int64    `json:"size_after"` // zero when maintenance stopped at the integrity check
+}
+
+// Print the report in a human-readable form
+func (r *MaintainReport) Print() {
+	for _, problem := range r.Problems {
+		fmt.Printf("integrity: %s\n", problem)
+	}
+	if len(r.Problems) > 0 {
+		return
+	}
+	fmt.Println("Integrity check: ok")
+	if r.SizeAfter > 0 {
+		fmt.Printf("Database size: %d bytes before, %d bytes after (%+d)\n", r.SizeBefore, r.SizeAfter, r.SizeAfter-r.SizeBefore)
+	}
+}
+
+// Maintain runs an integrity check, reindex, vacuum and analyze, reporting
+// the size change
+func Maintain(ctx context.Context, db *DB) (*MaintainReport, error) {
+	report := &MaintainReport{}
+	before, err := Size(ctx, db)
+	if err != nil {
+		return report, fmt.Errorf("failed to measure database size: %w", err)
+	}
+	report.SizeBefore = before
+
+	report.Problems, err = IntegrityCheck(ctx, db)
+	if err != nil {
+		return report, fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	if len(report.Problems) > 0 {
+		return report, fmt.Errorf("integrity check found %d problems; not optimizing a damaged database", len(report.Problems))
+	}
+
+	for _, statement := range maintenanceStatements(db.dialect) {
+		// MySQL's OPTIMIZE and ANALYZE return result sets, so use Query for all
+		rows, err := db.QueryContext(ctx, statement)
+		if err != nil {
+			return report, fmt.Errorf("failed to run %s: %w", statement, err)
+		}
+		_ = rows.Close()
+	}
+
+	report.SizeAfter, err = Size(ctx, db)
+	if err != nil {
+		return report, fmt.Errorf("failed to measure database size: %w", err)
+	}
+
+	return report, LogAction(ctx, db, "db_maintain", "", "")
+}
+
+// MaintainIfDue runs maintenance if interval has passed since the last run.
+// The report is nil when maintenance was not due.
+func MaintainIfDue(ctx context.Context, db *DB, interval time.Duration) (*MaintainReport, error) {
+	if interval <= 0 {
+		return nil, nil
+	}
+
+	var last string
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(timestamp), '') FROM actions WHERE action_type = 'db_maintain';`).Scan(&last)
+	if err != nil {
+		return nil, err
+	}
+	if last != "" {
+		lastRun, err := parseDBTime(last)
+		if err == nil && time.Since(lastRun) < interval {
+			return nil, nil
+		}
+	}
+
+	return Maintain(ctx, db)
+}
+
+// Parse a timestamp returned as text by an aggregate query
+func parseDBTime(value string) (time.Time, error) {
+	layouts := []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00", time.DateTime}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", value)
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// MergeStray merges the history of the stray SQLite database at path, left
+// behind by running older versions from other working directories, into
+// db in a single transaction logged as a db_merge action. Stray versions
+// are numbered after the local ones, and those present already, as after
+// an earlier merge, are skipped. It returns the number of records merged
+// and the number read.
+func MergeStray(ctx context.Context, db *DB, path, root string) (int, int, error) {
+	stray, err := Open(Config{Driver: "sqlite3", DSN: path, JournalMode: "DELETE", BusyTimeout: 5000, Synchronous: "FULL"}, root)
+	if err != nil {
+		return 0, 0, err
+	}
+	records, err := ReadHistory(ctx, stray)
+	if closeErr := stray.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close database: %w", closeErr)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	merged := 0
+	err = WithTx(ctx, db, func(tx *Tx) error {
+		histories := map[string]*mergedHistory{}
+		for _, record := range records {
+			if record.Table == "versions" {
+				history, ok := histories[record.Filename]
+				if !ok {
+					var err error
+					if history, err = readMergedHistory(ctx, tx, record.Filename); err != nil {
+						return err
+					}
+					histories[record.Filename] = history
+				}
+				if !history.add(&record) {
+					continue
+				}
+			}
+			if err := record.Insert(ctx, tx); err != nil {
+				return err
+			}
+			merged++
+		}
+		return LogAction(ctx, tx, "db_merge", filepath.Base(path), path)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return merged, len(records), nil
+}
+
+// mergedHistory is the local history of a file stray versions are merged
+// into
+type mergedHistory struct {
+	last    int             // the last version number
+	present map[string]bool // the versions by content hash and time
+}
+
+// Read the local history of filename
+func readMergedHistory(ctx context.Context, tx *Tx, filename string) (*mergedHistory, error) {
+	versions, err := ListVersions(ctx, tx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of %s: %w", filename, err)
+	}
+	history := &mergedHistory{present: map[string]bool{}}
+	for _, v := range versions {
+		history.last = max(history.last, v.Version)
+		history.present[mergedKey(v.Hash, v.Timestamp)] = true
+	}
+	return history, nil
+}
+
+// Renumber a stray version after the local ones, reporting false when a
+// version of the same content stored at the same time is present already,
+// as after an earlier merge
+func (h *mergedHistory) add(record *Record) bool {
+	key := mergedKey(record.Hash, record.Timestamp)
+	if h.present[key] {
+		return false
+	}
+	h.present[key] = true
+	h.last++
+	record.Version = h.last
+	return true
+}
+
+// Key a version by its content and the second it was stored
+func mergedKey(hash string, at time.Time) string {
+	return fmt.Sprintf("%s@%d", hash, at.Unix())
+}
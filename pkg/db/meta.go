@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseMeta parses key=value pairs into a map. Keys must be non-empty, and
+// a value may be empty but not left out.
+func ParseMeta(pairs []string) (map[string]string, error) {
+	meta := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid metadata %q (use key=value)", pair)
+		}
+		meta[key] = value
+	}
+	return meta, nil
+}
+
+// SetMeta sets metadata of filename, replacing the values of keys it has
+// already. The file must have a recorded version.
+func SetMeta(ctx context.Context, db *DB, filename string, meta map[string]string) error {
+	if _, err := GetVersion(ctx, db, filename, 0); err != nil {
+		return err
+	}
+	return SetMetaAll(ctx, db, []string{filename}, meta)
+}
+
+// SetMetaAll sets metadata of every one of filenames as SetMeta does, in
+// one transaction
+func SetMetaAll(ctx context.Context, db *DB, filenames []string, meta map[string]string) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		for _, filename := range filenames {
+			if err := holdRetention(ctx, tx, filename); err != nil {
+				return err
+			}
+			for _, key := range sortedKeys(meta) {
+				if _, err := tx.ExecContext(ctx, `DELETE FROM file_metadata WHERE filename = ? AND meta_key = ?;`, filename, key); err != nil {
+					return err
+				}
+				if _, err := tx.ExecContext(ctx, `INSERT INTO file_metadata (filename, meta_key, meta_value) VALUES (?, ?, ?);`, filename, key, meta[key]); err != nil {
+					return err
+				}
+			}
+			if err := indexFile(ctx, tx, filename, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UnsetMeta removes the given metadata keys of filename, or all of them
+// when keys is empty, returning how many were removed
+func UnsetMeta(ctx context.Context, db *DB, filename string, keys []string) (int, error) {
+	return UnsetMetaAll(ctx, db, []string{filename}, keys)
+}
+
+// UnsetMetaAll removes metadata of every one of filenames as UnsetMeta
+// does, in one transaction, returning how many values were removed
+func UnsetMetaAll(ctx context.Context, db *DB, filenames []string, keys []string) (int, error) {
+	var removed int64
+	err := WithTx(ctx, db, func(tx *Tx) error {
+		// A retried transaction counts again from the start
+		removed = 0
+		for _, filename := range filenames {
+			if err := holdRetention(ctx, tx, filename); err != nil {
+				return err
+			}
+			query := `DELETE FROM file_metadata WHERE filename = ?`
+			args := []any{filename}
+			if len(keys) > 0 {
+				query += ` AND meta_key IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ") + `)`
+				for _, key := range keys {
+					args = append(args, key)
+				}
+			}
+			result, err := tx.ExecContext(ctx, query+`;`, args...)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			removed += n
+			if err := indexFile(ctx, tx, filename, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return int(removed), err
+}
+
+// GetMeta returns the metadata of filename
+func GetMeta(ctx context.Context, db Executor, filename string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT meta_key, meta_value FROM file_metadata WHERE filename = ?;`, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	meta := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		meta[key] = value
+	}
+	return meta, rows.Err()
+}
+
+// Return the keys of meta, sorted
+func sortedKeys[V any](meta map[string]V) []string {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are numbered SQL files applied in order, e.g. 0003_add_sizes.sql,
+// kept in one subdirectory per dialect with matching numbers. A migration
+// must never be edited once released; add a new one instead.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration is a single schema change
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Load the embedded migrations of a dialect sorted by version
+func loadMigrations(d dialect) ([]migration, error) {
+	dir := path.Join("migrations", d.name)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var migrations []migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok || !strings.HasSuffix(name, ".sql") {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", name, err)
+		}
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, version)
+		}
+		seen[version] = name
+
+		data, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// Return the highest applied schema version, 0 for a fresh database
+func schemaVersion(ctx context.Context, db *DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version;`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Migrate applies every pending migration, each in its own transaction
+func Migrate(ctx context.Context, db *DB) error {
+	if _, err := db.ExecContext(ctx, db.dialect.schemaVersionDDL); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	migrations, err := loadMigrations(db.dialect)
+	if err != nil {
+		return err
+	}
+	if len(migrations) > 0 && current > migrations[len(migrations)-1].version {
+		return fmt.Errorf("database schema version %d is newer than this tool supports (%d)",
+			current, migrations[len(migrations)-1].version)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, db, m); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// Run one migration and record it in schema_version atomically
+func applyMigration(ctx context.Context, db *DB, m migration) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Not every driver accepts several statements per Exec
+	for _, statement := range splitStatements(m.sql) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil && !(db.dialect.name == "mysql" && appliedAlready(err)) {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_version (version, name) VALUES (?, ?);`, m.version, m.name); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Report whether a migration statement failed on MySQL as it was applied
+// already. MySQL commits every DDL statement on its own, so a migration
+// failing part way leaves its earlier statements applied without its
+// schema_version row, and they fail so when it runs again: the table,
+// column or index exists, or the index dropped is gone.
+func appliedAlready(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	// ER_TABLE_EXISTS_ERROR, ER_DUP_FIELDNAME, ER_DUP_KEYNAME, ER_CANT_DROP_FIELD_OR_KEY
+	return mysqlErr.Number == 1050 || mysqlErr.Number == 1060 || mysqlErr.Number == 1061 || mysqlErr.Number == 1091
+}
+
+// Split a migration script into statements terminated by a semicolon at the
+// end of a line
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			if statement := strings.TrimSpace(current.String()); statement != "" {
+				statements = append(statements, statement)
+			}
+			current.Reset()
+		}
+	}
+	if statement := strings.TrimSpace(current.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
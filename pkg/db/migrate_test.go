@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Open a migrated in-memory database closed when the test finishes
+func openMemory(t *testing.T) *DB {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.DSN = MemoryDSN
+	metadata, err := Open(cfg, "")
+	if err != nil {
+		t.Fatalf("failed to open in-memory database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = metadata.Close()
+	})
+	if err := Migrate(context.Background(), metadata); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	return metadata
+}
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	names := map[string][]string{}
+	for driver, d := range dialects {
+		migrations, err := loadMigrations(d)
+		if err != nil {
+			t.Fatalf("%s: %v", driver, err)
+		}
+		for i, m := range migrations {
+			if m.version != i+1 {
+				t.Errorf("%s: migration %s has version %d, want %d", driver, m.name, m.version, i+1)
+			}
+			names[d.name] = append(names[d.name], m.name)
+		}
+	}
+	for dialect, got := range names {
+		if !reflect.DeepEqual(got, names["sqlite"]) {
+			t.Errorf("%s migrations differ from sqlite ones:\n%v\n%v", dialect, got, names["sqlite"])
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	metadata := openMemory(t)
+
+	migrations, err := loadMigrations(metadata.dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].version
+	if version, err := schemaVersion(ctx, metadata); err != nil || version != latest {
+		t.Fatalf("schema version is %d (%v), want %d", version, err, latest)
+	}
+
+	// Migrating again applies nothing
+	if err := Migrate(ctx, metadata); err != nil {
+		t.Fatalf("second migration failed: %v", err)
+	}
+	var applied int
+	if err := metadata.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_version;`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("%d migrations recorded, want %d", applied, len(migrations))
+	}
+
+	// The migrated schema takes versions
+	if _, err := LogVersion(ctx, metadata, "a.txt", "abc", "/src/a.txt", "text/plain", "text"); err != nil {
+		t.Fatalf("failed to log a version: %v", err)
+	}
+	if _, err := LogVersion(ctx, metadata, "a.txt", "def", "/src/a.txt", "text/plain", "text"); err != nil {
+		t.Fatalf("failed to log a version: %v", err)
+	}
+	v, err := GetVersion(ctx, metadata, "a.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != 2 || v.Hash != "def" {
+		t.Errorf("latest version is %d with hash %s, want 2 with def", v.Version, v.Hash)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	metadata := openMemory(t)
+	if _, err := metadata.ExecContext(ctx, `INSERT INTO schema_version (version, name) VALUES (?, ?);`, 9999, "9999_future.sql"); err != nil {
+		t.Fatal(err)
+	}
+	err := Migrate(ctx, metadata)
+	if err == nil || !strings.Contains(err.Error(), "newer than this tool supports") {
+		t.Errorf("migrating a newer schema gave %v", err)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := "-- comment\nCREATE TABLE a (\n  id INTEGER\n);\n\nCREATE INDEX b ON a (id);\nDROP TABLE c"
+	want := []string{
+		"-- comment\nCREATE TABLE a (\n  id INTEGER\n);",
+		"CREATE INDEX b ON a (id);",
+		"DROP TABLE c",
+	}
+	if got := splitStatements(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements gave %q, want %q", got, want)
+	}
+}
+
+// Migrating to unique version numbers renumbers the duplicates concurrent
+// writers left behind
+func TestMigrateRenumbersDuplicateVersions(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.DSN = MemoryDSN
+	metadata, err := Open(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = metadata.Close()
+	})
+	if _, err := metadata.ExecContext(ctx, metadata.dialect.schemaVersionDDL); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := loadMigrations(metadata.dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if strings.HasSuffix(m.name, "_unique_versions.sql") {
+			break
+		}
+		if err := applyMigration(ctx, metadata, m); err != nil {
+			t.Fatalf("failed to apply %s: %v", m.name, err)
+		}
+	}
+	for _, row := range []struct {
+		version int
+		hash    string
+	}{{1, "a"}, {2, "b"}, {2, "c"}, {3, "d"}, {2, "e"}} {
+		if _, err := metadata.ExecContext(ctx, `INSERT INTO versions (filename, version, hash) VALUES (?, ?, ?);`, "a.txt", row.version, row.hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Migrate(ctx, metadata); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	versions, err := ListVersions(ctx, metadata, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, v := range versions {
+		hashes = append(hashes, v.Hash)
+	}
+	// The first row of a number keeps it; the others follow the last one
+	if got := strings.Join(hashes, ""); got != "abdce" {
+		t.Errorf("versions are in the order %s, want abdce", got)
+	}
+	if _, err := LogVersion(ctx, metadata, "a.txt", "f", "", "", ""); err != nil {
+		t.Errorf("failed to log a version after the renumbered ones: %v", err)
+	}
+}
+
+func TestVersionConflictRetried(t *testing.T) {
+	ctx := context.Background()
+	metadata := openMemory(t)
+
+	if _, err := LogVersion(ctx, metadata, "a.txt", "a", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	err := insertVersionRow(ctx, metadata, "a.txt", 1, "b", "", "", "")
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("inserting a taken version number gave %v, want %v", err, ErrVersionConflict)
+	}
+
+	// The first attempt loses the number to another writer, as when it
+	// read the last version before that writer committed
+	attempts := 0
+	var version int
+	err = WithTx(ctx, metadata, func(tx *Tx) error {
+		attempts++
+		if attempts == 1 {
+			return insertVersionRow(ctx, tx, "a.txt", 1, "b", "", "", "")
+		}
+		var err error
+		version, err = LogVersion(ctx, tx, "a.txt", "b", "", "", "")
+		return err
+	})
+	if err != nil || attempts != 2 || version != 2 {
+		t.Errorf("transaction gave %v after %d attempts with version %d, want version 2 after 2", err, attempts, version)
+	}
+}
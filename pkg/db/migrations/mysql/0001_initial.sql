@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS actions (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	action_type VARCHAR(64),
+	filename VARCHAR(512),
+	storage_id VARCHAR(1024),
+	timestamp DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE IF NOT EXISTS versions (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	filename VARCHAR(512),
+	version INTEGER,
+	hash VARCHAR(128),
+	timestamp DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+);
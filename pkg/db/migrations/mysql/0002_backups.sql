@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS backups (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	path VARCHAR(1024),
+	size BIGINT,
+	timestamp DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+);
@@ -0,0 +1,5 @@
+CREATE INDEX idx_versions_filename_version ON versions (filename, version);
+CREATE INDEX idx_versions_hash ON versions (hash);
+CREATE INDEX idx_actions_filename_timestamp ON actions (filename, timestamp);
+CREATE INDEX idx_actions_timestamp ON actions (timestamp);
+CREATE INDEX idx_backups_timestamp ON backups (timestamp);
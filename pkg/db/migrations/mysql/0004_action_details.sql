@@ -0,0 +1,6 @@
+ALTER TABLE actions ADD COLUMN bytes BIGINT DEFAULT 0;
+ALTER TABLE actions ADD COLUMN duration_ms BIGINT DEFAULT 0;
+ALTER TABLE actions ADD COLUMN outcome VARCHAR(16) DEFAULT 'success';
+ALTER TABLE actions ADD COLUMN error TEXT;
+ALTER TABLE actions ADD COLUMN hostname VARCHAR(255) DEFAULT '';
+ALTER TABLE actions ADD COLUMN tool_version VARCHAR(64) DEFAULT '';
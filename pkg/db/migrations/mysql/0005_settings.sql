@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS settings (
+	name VARCHAR(255) PRIMARY KEY,
+	value TEXT
+);
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS blob_checks (
+	storage_id VARCHAR(255) PRIMARY KEY,
+	checked_at DATETIME(6)
+);
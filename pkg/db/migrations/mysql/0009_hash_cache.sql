@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS hash_cache (
+	path VARCHAR(700) NOT NULL,
+	algorithm VARCHAR(32) NOT NULL,
+	size BIGINT NOT NULL,
+	mod_time BIGINT NOT NULL,
+	inode BIGINT NOT NULL,
+	hash VARCHAR(255) NOT NULL,
+	PRIMARY KEY (path, algorithm)
+);
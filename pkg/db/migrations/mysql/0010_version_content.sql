@@ -0,0 +1,3 @@
+ALTER TABLE versions ADD COLUMN mime_type VARCHAR(255);
+ALTER TABLE versions ADD COLUMN kind VARCHAR(32);
+CREATE INDEX idx_versions_kind ON versions (kind);
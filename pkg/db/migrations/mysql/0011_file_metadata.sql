@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS file_metadata (
+	filename VARCHAR(512) NOT NULL,
+	meta_key VARCHAR(128) NOT NULL,
+	meta_value VARCHAR(512) NOT NULL,
+	PRIMARY KEY (filename, meta_key)
+);
+CREATE INDEX idx_file_metadata_key ON file_metadata (meta_key, meta_value);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS search_index (
+	filename VARCHAR(512) PRIMARY KEY,
+	metadata TEXT NOT NULL,
+	body MEDIUMTEXT NOT NULL
+);
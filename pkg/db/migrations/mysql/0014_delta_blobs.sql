@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS delta_blobs (
+	storage_id VARCHAR(255) PRIMARY KEY,
+	base_id VARCHAR(255) NOT NULL,
+	delta_id VARCHAR(255) NOT NULL,
+	size BIGINT NOT NULL
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS packed_blobs (
+	storage_id VARCHAR(255) PRIMARY KEY,
+	pack_id VARCHAR(255) NOT NULL,
+	pack_offset BIGINT NOT NULL,
+	packed_size BIGINT NOT NULL,
+	size BIGINT NOT NULL
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS version_xattrs (
+	version_id BIGINT NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	value MEDIUMTEXT NOT NULL,
+	PRIMARY KEY (version_id, name)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE actions ADD COLUMN idempotency_key VARCHAR(64);
+CREATE INDEX idx_actions_idempotency_key ON actions (idempotency_key);
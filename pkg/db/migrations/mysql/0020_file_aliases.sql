@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS file_aliases (
+	alias VARCHAR(255) PRIMARY KEY,
+	filename VARCHAR(512) NOT NULL
+);
+CREATE INDEX idx_file_aliases_filename ON file_aliases (filename);
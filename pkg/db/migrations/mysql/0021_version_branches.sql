@@ -0,0 +1,8 @@
+ALTER TABLE versions ADD COLUMN branch VARCHAR(128);
+CREATE TABLE IF NOT EXISTS file_branches (
+	filename VARCHAR(512) NOT NULL,
+	branch VARCHAR(128) NOT NULL,
+	base_version INTEGER NOT NULL,
+	merged_version INTEGER,
+	PRIMARY KEY (filename, branch)
+);
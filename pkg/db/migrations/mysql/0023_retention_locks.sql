@@ -0,0 +1,9 @@
+ALTER TABLE versions ADD COLUMN retain_until DATETIME(6);
+CREATE TABLE IF NOT EXISTS retention_locks (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	meta_key VARCHAR(255),
+	meta_value TEXT,
+	days INTEGER NOT NULL,
+	principal TEXT,
+	created_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS legal_holds (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(255),
+	pattern TEXT NOT NULL,
+	principal TEXT,
+	created_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+	released_by TEXT,
+	released_at DATETIME(6)
+);
@@ -0,0 +1,6 @@
+UPDATE versions
+	JOIN (SELECT filename, MAX(version) AS last FROM versions GROUP BY filename) latest ON latest.filename = versions.filename
+	JOIN (SELECT DISTINCT d.id FROM versions d JOIN versions e ON e.filename = d.filename AND e.version = d.version AND e.id < d.id) duplicates ON duplicates.id = versions.id
+	SET versions.version = latest.last + versions.id;
+DROP INDEX idx_versions_filename_version ON versions;
+CREATE UNIQUE INDEX idx_versions_filename_version ON versions (filename, version);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS actions (
+	id BIGSERIAL PRIMARY KEY,
+	action_type TEXT,
+	filename TEXT,
+	storage_id TEXT,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS versions (
+	id BIGSERIAL PRIMARY KEY,
+	filename TEXT,
+	version INTEGER,
+	hash TEXT,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
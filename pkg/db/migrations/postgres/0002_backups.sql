@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS backups (
+	id BIGSERIAL PRIMARY KEY,
+	path TEXT,
+	size BIGINT,
+	timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,5 @@
+CREATE INDEX IF NOT EXISTS idx_versions_filename_version ON versions (filename, version);
+CREATE INDEX IF NOT EXISTS idx_versions_hash ON versions (hash);
+CREATE INDEX IF NOT EXISTS idx_actions_filename_timestamp ON actions (filename, timestamp);
+CREATE INDEX IF NOT EXISTS idx_actions_timestamp ON actions (timestamp);
+CREATE INDEX IF NOT EXISTS idx_backups_timestamp ON backups (timestamp);
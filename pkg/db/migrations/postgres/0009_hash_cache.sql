@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS hash_cache (
+	path TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	mod_time BIGINT NOT NULL,
+	inode BIGINT NOT NULL,
+	hash TEXT NOT NULL,
+	PRIMARY KEY (path, algorithm)
+);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS search_index (
+	filename TEXT PRIMARY KEY,
+	metadata TEXT NOT NULL,
+	body TEXT NOT NULL
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS delta_blobs (
+	storage_id TEXT PRIMARY KEY,
+	base_id TEXT NOT NULL,
+	delta_id TEXT NOT NULL,
+	size BIGINT NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS blob_chunks (
+	storage_id TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	chunk_id TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	PRIMARY KEY (storage_id, seq)
+);
+CREATE INDEX IF NOT EXISTS idx_blob_chunks_chunk_id ON blob_chunks (chunk_id);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS packed_blobs (
+	storage_id TEXT PRIMARY KEY,
+	pack_id TEXT NOT NULL,
+	pack_offset BIGINT NOT NULL,
+	packed_size BIGINT NOT NULL,
+	size BIGINT NOT NULL
+);
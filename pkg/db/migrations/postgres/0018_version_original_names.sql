@@ -0,0 +1 @@
+ALTER TABLE versions ADD COLUMN original_name TEXT;
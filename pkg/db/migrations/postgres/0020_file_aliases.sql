@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS file_aliases (
+	alias TEXT PRIMARY KEY,
+	filename TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_file_aliases_filename ON file_aliases (filename);
@@ -0,0 +1,9 @@
+ALTER TABLE versions ADD COLUMN retain_until TIMESTAMPTZ;
+CREATE TABLE IF NOT EXISTS retention_locks (
+	id BIGSERIAL PRIMARY KEY,
+	meta_key TEXT,
+	meta_value TEXT,
+	days INTEGER NOT NULL,
+	principal TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
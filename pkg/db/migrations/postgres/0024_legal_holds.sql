@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS legal_holds (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT,
+	pattern TEXT NOT NULL,
+	principal TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	released_by TEXT,
+	released_at TIMESTAMPTZ
+);
@@ -0,0 +1,4 @@
+UPDATE versions SET version = (SELECT MAX(v.version) FROM versions v WHERE v.filename = versions.filename) + id
+	WHERE EXISTS (SELECT 1 FROM versions e WHERE e.filename = versions.filename AND e.version = versions.version AND e.id < versions.id);
+DROP INDEX IF EXISTS idx_versions_filename_version;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_versions_filename_version ON versions (filename, version);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS actions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	action_type TEXT,
+	filename TEXT,
+	storage_id TEXT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS versions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	filename TEXT,
+	version INTEGER,
+	hash TEXT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+);
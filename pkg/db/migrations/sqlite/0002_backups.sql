@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS backups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	path TEXT,
+	size INTEGER,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,6 @@
+ALTER TABLE actions ADD COLUMN bytes INTEGER DEFAULT 0;
+ALTER TABLE actions ADD COLUMN duration_ms INTEGER DEFAULT 0;
+ALTER TABLE actions ADD COLUMN outcome TEXT DEFAULT 'success';
+ALTER TABLE actions ADD COLUMN error TEXT DEFAULT '';
+ALTER TABLE actions ADD COLUMN hostname TEXT DEFAULT '';
+ALTER TABLE actions ADD COLUMN tool_version TEXT DEFAULT '';
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS blob_checks (
+	storage_id TEXT PRIMARY KEY,
+	checked_at DATETIME
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS hash_cache (
+	path TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	mod_time INTEGER NOT NULL,
+	inode INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	PRIMARY KEY (path, algorithm)
+);
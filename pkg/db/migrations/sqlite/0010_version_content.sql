@@ -0,0 +1,3 @@
+ALTER TABLE versions ADD COLUMN mime_type TEXT;
+ALTER TABLE versions ADD COLUMN kind TEXT;
+CREATE INDEX idx_versions_kind ON versions (kind);
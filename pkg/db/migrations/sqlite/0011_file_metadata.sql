@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS file_metadata (
+	filename TEXT NOT NULL,
+	meta_key TEXT NOT NULL,
+	meta_value TEXT NOT NULL,
+	PRIMARY KEY (filename, meta_key)
+);
+CREATE INDEX IF NOT EXISTS idx_file_metadata_key ON file_metadata (meta_key, meta_value);
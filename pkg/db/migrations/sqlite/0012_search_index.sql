@@ -0,0 +1 @@
+CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts4 (filename, metadata, body, tokenize=unicode61);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS external_blobs (
+	storage_id TEXT PRIMARY KEY,
+	path TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	mod_time INTEGER NOT NULL
+);
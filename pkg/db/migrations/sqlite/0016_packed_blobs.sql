@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS packed_blobs (
+	storage_id TEXT PRIMARY KEY,
+	pack_id TEXT NOT NULL,
+	pack_offset INTEGER NOT NULL,
+	packed_size INTEGER NOT NULL,
+	size INTEGER NOT NULL
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS version_xattrs (
+	version_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (version_id, name)
+);
@@ -0,0 +1,8 @@
+ALTER TABLE versions ADD COLUMN branch TEXT;
+CREATE TABLE IF NOT EXISTS file_branches (
+	filename TEXT NOT NULL,
+	branch TEXT NOT NULL,
+	base_version INTEGER NOT NULL,
+	merged_version INTEGER,
+	PRIMARY KEY (filename, branch)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE actions ADD COLUMN role TEXT;
+ALTER TABLE actions ADD COLUMN remote_addr TEXT;
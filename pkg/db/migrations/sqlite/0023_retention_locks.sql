@@ -0,0 +1,9 @@
+ALTER TABLE versions ADD COLUMN retain_until DATETIME;
+CREATE TABLE IF NOT EXISTS retention_locks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	meta_key TEXT,
+	meta_value TEXT,
+	days INTEGER NOT NULL,
+	principal TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS legal_holds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT,
+	pattern TEXT NOT NULL,
+	principal TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	released_by TEXT,
+	released_at DATETIME
+);
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// PackedBlob is a blob stored inside a packfile: the compressed content
+// takes PackedSize bytes of the blob PackID from Offset on
+type PackedBlob struct {
+	StorageID  string
+	PackID     string
+	Offset     int64
+	PackedSize int64
+	Size       int64 // bytes of the content
+}
+
+// AddPackedBlob inserts or replaces a packed blob
+func AddPackedBlob(ctx context.Context, db Executor, blob PackedBlob) error {
+	if err := RemovePackedBlob(ctx, db, blob.StorageID); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO packed_blobs (storage_id, pack_id, pack_offset, packed_size, size) VALUES (?, ?, ?, ?, ?);`,
+		blob.StorageID, blob.PackID, blob.Offset, blob.PackedSize, blob.Size)
+	return err
+}
+
+// RemovePackedBlob forgets the packed blob with the given storage ID
+func RemovePackedBlob(ctx context.Context, db Executor, id string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM packed_blobs WHERE storage_id = ?;`, id)
+	return err
+}
+
+// GetPackedBlob returns the packed blob with the given storage ID,
+// reporting whether there is one
+func GetPackedBlob(ctx context.Context, db Executor, id string) (PackedBlob, bool, error) {
+	blob := PackedBlob{StorageID: id}
+	err := db.QueryRowContext(ctx, `SELECT pack_id, pack_offset, packed_size, size FROM packed_blobs WHERE storage_id = ?;`, id).Scan(&blob.PackID, &blob.Offset, &blob.PackedSize, &blob.Size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return blob, false, nil
+	}
+	return blob, err == nil, err
+}
+
+// PackedBlobs returns the packed blobs, keyed by storage ID
+func PackedBlobs(ctx context.Context, db Executor) (map[string]PackedBlob, error) {
+	rows, err := db.QueryContext(ctx, `SELECT storage_id, pack_id, pack_offset, packed_size, size FROM packed_blobs;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	blobs := map[string]PackedBlob{}
+	for rows.Next() {
+		var blob PackedBlob
+		if err := rows.Scan(&blob.StorageID, &blob.PackID, &blob.Offset, &blob.PackedSize, &blob.Size); err != nil {
+			return nil, err
+		}
+		blobs[blob.StorageID] = blob
+	}
+	return blobs, rows.Err()
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ReportTable is the tabular result of a report
+type ReportTable struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// report is a canned query over the action log and version history
+type report struct {
+	description string
+	query       func(d dialect) string
+	limited     bool // takes the -limit value as its only argument
+}
+
+var reports = map[string]report{
+	"actions-per-day": {
+		description: "number of actions and bytes processed per day and action type",
+		query: func(d dialect) string {
+			return `
+			SELECT ` + d.day("timestamp") + ` AS day, action_type, COUNT(*), COALESCE(SUM(bytes), 0),
+				SUM(CASE WHEN outcome = 'failure' THEN 1 ELSE 0 END)
+			FROM actions
+			GROUP BY day, action_type
+			ORDER BY day, action_type;`
+		},
+	},
+	"storage-growth": {
+		description: "bytes added to storage per day and running total",
+		query: func(d dialect) string {
+			return `
+			SELECT day, added, SUM(added) OVER (ORDER BY day)
+			FROM (
+				SELECT ` + d.day("timestamp") + ` AS day, COALESCE(SUM(bytes), 0) AS added
+				FROM actions
+				WHERE action_type = 'store' AND outcome = 'success'
+				GROUP BY day
+			) daily
+			ORDER BY day;`
+		},
+	},
+	"most-versioned": {
+		description: "files with the most versions",
+		query: func(d dialect) string {
+			return `
+			SELECT filename, COUNT(*), MAX(version), COUNT(DISTINCT hash)
+			FROM versions
+			GROUP BY filename
+			ORDER BY COUNT(*) DESC, filename
+			LIMIT ?;`
+		},
+		limited: true,
+	},
+	"dedup-savings": {
+		description: "duplicates removed or skipped and bytes saved per day",
+		query: func(d dialect) string {
+			return `
+			SELECT ` + d.day("timestamp") + ` AS day, action_type, COUNT(*), COALESCE(SUM(bytes), 0)
+			FROM actions
+			WHERE action_type IN ('deduplicate', 'store_duplicate') AND outcome = 'success'
+			GROUP BY day, action_type
+			ORDER BY day, action_type;`
+		},
+	},
+	"content-kinds": {
+		description: "files by the kind of their latest content, with the versions and MIME types of each kind",
+		query: func(d dialect) string {
+			return `
+			SELECT COALESCE(NULLIF(kind, ''), 'unknown') AS content_kind,
+				SUM(CASE WHEN v.branch IS NULL AND version = (SELECT MAX(version) FROM versions latest WHERE latest.filename = v.filename AND latest.branch IS NULL) THEN 1 ELSE 0 END) AS files,
+				COUNT(*), COUNT(DISTINCT mime_type)
+			FROM versions v
+			GROUP BY content_kind
+			ORDER BY files DESC, content_kind;`
+		},
+	},
+	"photo-duplicates": {
+		description: "photos and videos taken at the same moment by the same camera but stored with different content, such as edited or resized copies",
+		query: func(d dialect) string {
+			return `
+			SELECT taken.meta_value, COALESCE(camera.meta_value, ''), COUNT(DISTINCT taken.filename), COUNT(DISTINCT v.hash)
+			FROM file_metadata taken
+			JOIN versions v ON v.filename = taken.filename AND v.branch IS NULL
+				AND v.version = (SELECT MAX(version) FROM versions latest WHERE latest.filename = v.filename AND latest.branch IS NULL)
+			LEFT JOIN file_metadata camera ON camera.filename = taken.filename AND camera.meta_key = 'camera'
+			WHERE taken.meta_key = 'taken'
+			GROUP BY taken.meta_value, COALESCE(camera.meta_value, '')
+			HAVING COUNT(DISTINCT v.hash) > 1
+			ORDER BY taken.meta_value
+			LIMIT ?;`
+		},
+		limited: true,
+	},
+}
+
+var reportColumns = map[string][]string{
+	"actions-per-day":  {"day", "action", "count", "bytes", "failures"},
+	"storage-growth":   {"day", "bytes_added", "bytes_total"},
+	"most-versioned":   {"filename", "versions", "latest", "distinct_contents"},
+	"dedup-savings":    {"day", "action", "duplicates", "bytes_saved"},
+	"content-kinds":    {"kind", "files", "versions", "mime_types"},
+	"photo-duplicates": {"taken", "camera", "files", "distinct_contents"},
+}
+
+// ReportNames returns the names of the available reports, sorted
+func ReportNames() []string {
+	names := make([]string, 0, len(reports))
+	for name := range reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunReport runs a named report
+func RunReport(ctx context.Context, db *DB, name string, limit int) (*ReportTable, error) {
+	r, ok := reports[name]
+	if !ok {
+		var available []string
+		for _, n := range ReportNames() {
+			available = append(available, fmt.Sprintf("  %-16s %s", n, reports[n].description))
+		}
+		return nil, fmt.Errorf("unknown report %q; available reports:\n%s", name, strings.Join(available, "\n"))
+	}
+
+	var args []any
+	if r.limited {
+		args = append(args, limit)
+	}
+	rows, err := db.QueryContext(ctx, r.query(db.dialect), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	columns := reportColumns[name]
+	table := &ReportTable{Columns: columns}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		for i := range values {
+			values[i] = new(any)
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = formatReportValue(*(v.(*any)))
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table, rows.Err()
+}
+
+// Render a scanned database value as text
+func formatReportValue(v any) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrRetained is wrapped by the errors of changes refused because they
+// would delete or rewrite versions or backups under a retention lock
+var ErrRetained = errors.New("under retention")
+
+// RetentionLock keeps versions from being deleted or rewritten for Days
+// after they were stored. A lock with a metadata key only covers the files
+// with that metadata value; one without covers the whole repository, its
+// backups included. Locks cannot be removed or shortened.
+type RetentionLock struct {
+	ID        int64     `json:"id"`
+	MetaKey   string    `json:"meta_key,omitempty"`
+	MetaValue string    `json:"meta_value,omitempty"`
+	Days      int       `json:"days"`
+	Principal string    `json:"principal,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// Scope describes what the lock covers
+func (l RetentionLock) Scope() string {
+	if l.MetaKey == "" {
+		return "repository"
+	}
+	return l.MetaKey + "=" + l.MetaValue
+}
+
+// Report whether the lock covers a file with the given metadata
+func (l RetentionLock) covers(meta map[string]string) bool {
+	if l.MetaKey == "" {
+		return true
+	}
+	value, ok := meta[l.MetaKey]
+	return ok && value == l.MetaValue
+}
+
+// Return the metadata columns of the lock, null for the repository
+func (l RetentionLock) metaArgs() (key, value sql.NullString) {
+	if l.MetaKey == "" {
+		return key, value
+	}
+	return sql.NullString{String: l.MetaKey, Valid: true}, sql.NullString{String: l.MetaValue, Valid: true}
+}
+
+// AddRetentionLock adds a lock and logs it as a retention_lock action
+func AddRetentionLock(ctx context.Context, db *DB, lock RetentionLock) error {
+	if lock.Days <= 0 {
+		return fmt.Errorf("retention must last at least one day")
+	}
+	lock.MetaKey = strings.TrimSpace(lock.MetaKey)
+	return WithTx(ctx, db, func(tx *Tx) error {
+		key, value := lock.metaArgs()
+		_, err := tx.ExecContext(ctx, `INSERT INTO retention_locks (meta_key, meta_value, days, principal) VALUES (?, ?, ?, ?);`,
+			key, value, lock.Days, Principal(ctx))
+		if err != nil {
+			return err
+		}
+		return RecordAction(ctx, tx, Action{ActionType: "retention_lock", Filename: lock.Scope(), Bytes: int64(lock.Days)})
+	})
+}
+
+// ListRetentionLocks returns every retention lock, oldest first
+func ListRetentionLocks(ctx context.Context, db Executor) ([]RetentionLock, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT id, COALESCE(meta_key, ''), COALESCE(meta_value, ''), days, COALESCE(principal, ''), created_at
+	FROM retention_locks ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var locks []RetentionLock
+	for rows.Next() {
+		var l RetentionLock
+		if err := rows.Scan(&l.ID, &l.MetaKey, &l.MetaValue, &l.Days, &l.Principal, &l.Created); err != nil {
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, rows.Err()
+}
+
+// RetainedVersion is a version with the time until which it is retained
+// and the legal hold freezing it, if any
+type RetainedVersion struct {
+	id        int64
+	Filename  string    `json:"filename"`
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Until     time.Time `json:"retain_until"`   // zero when no lock covers it
+	Hold      string    `json:"hold,omitempty"` // the first active hold covering it
+	recorded  time.Time // as recorded with the version
+}
+
+// Retained reports whether the version cannot be deleted or rewritten now
+func (v RetainedVersion) Retained() bool {
+	return v.Until.After(time.Now())
+}
+
+// Return the retention of the versions a condition on the versions table
+// selects. A version is retained until the later of what was recorded
+// with it and what the locks covering its file now give it.
+func retainedVersions(ctx context.Context, db Executor, where string, args ...any) ([]RetainedVersion, error) {
+	locks, err := ListRetentionLocks(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retention locks: %w", err)
+	}
+	holds, err := ActiveHolds(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id, filename, version, timestamp, retain_until FROM versions WHERE `+where+` ORDER BY filename, version;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var versions []RetainedVersion
+	for rows.Next() {
+		var v RetainedVersion
+		var until sql.NullTime
+		if err := rows.Scan(&v.id, &v.Filename, &v.Version, &v.Timestamp, &until); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		v.recorded = until.Time
+		v.Until = until.Time
+		for _, h := range holds {
+			if h.Covers(v.Filename) {
+				v.Hold = h.String()
+				break
+			}
+		}
+		versions = append(versions, v)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil || len(locks) == 0 {
+		return versions, err
+	}
+
+	// Metadata is read once the rows are closed, as some drivers cannot
+	// run a query while another is open in a transaction
+	metas := map[string]map[string]string{}
+	for i, v := range versions {
+		meta, ok := metas[v.Filename]
+		if !ok {
+			if meta, err = GetMeta(ctx, db, v.Filename); err != nil {
+				return nil, err
+			}
+			metas[v.Filename] = meta
+		}
+		for _, l := range locks {
+			if until := v.Timestamp.AddDate(0, 0, l.Days); l.covers(meta) && until.After(versions[i].Until) {
+				versions[i].Until = until
+			}
+		}
+	}
+	return versions, nil
+}
+
+// FileRetention returns the retention of every version of filename
+func FileRetention(ctx context.Context, db Executor, filename string) ([]RetainedVersion, error) {
+	return retainedVersions(ctx, db, `filename = ?`, filename)
+}
+
+// Fail with ErrHeld when one of versions is held, or with ErrRetained when
+// one is retained
+func checkRetained(versions []RetainedVersion) error {
+	for _, v := range versions {
+		if v.Hold != "" {
+			return fmt.Errorf("%w: version %d of %s is held by %s", ErrHeld, v.Version, v.Filename, v.Hold)
+		}
+	}
+	for _, v := range versions {
+		if v.Retained() {
+			return fmt.Errorf("%w: version %d of %s is retained until %s", ErrRetained, v.Version, v.Filename, v.Until.Local().Format(time.DateTime))
+		}
+	}
+	return nil
+}
+
+// CheckRetention fails with ErrHeld or ErrRetained when one of the given
+// versions of filename, or any of them when none are given, is held or
+// retained
+func CheckRetention(ctx context.Context, db Executor, filename string, versions ...int) error {
+	where, args := `filename = ?`, []any{filename}
+	if len(versions) > 0 {
+		where += ` AND version IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(versions)), ", ") + `)`
+		for _, n := range versions {
+			args = append(args, n)
+		}
+	}
+	retained, err := retainedVersions(ctx, db, where, args...)
+	if err != nil {
+		return err
+	}
+	return checkRetained(retained)
+}
+
+// CheckContentRetention fails with ErrHeld or ErrRetained when a held or
+// retained version has the content with the given hash
+func CheckContentRetention(ctx context.Context, db Executor, hash string) error {
+	retained, err := retainedVersions(ctx, db, `hash = ?`, hash)
+	if err != nil {
+		return err
+	}
+	return checkRetained(retained)
+}
+
+// CheckAnyRetention fails with ErrHeld or ErrRetained when any version is
+// held or retained
+func CheckAnyRetention(ctx context.Context, db Executor) error {
+	retained, err := retainedVersions(ctx, db, `1 = 1`)
+	if err != nil {
+		return err
+	}
+	return checkRetained(retained)
+}
+
+// CheckBackupRetention fails with ErrRetained when a repository-wide lock
+// retains the backup
+func CheckBackupRetention(ctx context.Context, db Executor, b Backup) error {
+	locks, err := ListRetentionLocks(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to read retention locks: %w", err)
+	}
+	for _, l := range locks {
+		if until := b.Timestamp.AddDate(0, 0, l.Days); l.MetaKey == "" && until.After(time.Now()) {
+			return fmt.Errorf("%w: backup %s is retained until %s", ErrRetained, b.Path, until.Local().Format(time.DateTime))
+		}
+	}
+	return nil
+}
+
+// Record with the versions of filename the retention their locks give them
+// now, so that changing the metadata a lock selects them by does not
+// release them
+func holdRetention(ctx context.Context, tx *Tx, filename string) error {
+	versions, err := FileRetention(ctx, tx, filename)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if v.Retained() && v.Until.After(v.recorded) {
+			if _, err := tx.ExecContext(ctx, `UPDATE versions SET retain_until = ? WHERE id = ?;`, v.Until.UTC(), v.id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"github.com/Lenstack/file_manager_version/pkg/retry"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SetRetry makes WithTx retry transactions that fail as the database is
+// busy or a transient error occurs, as the policy says
+func (db *DB) SetRetry(p retry.Policy) {
+	db.retry = p.Or(Busy)
+}
+
+// Busy reports whether err comes from the database being busy with
+// another writer: a locked SQLite file, or a deadlock, lock timeout or
+// serialization failure of PostgreSQL and MySQL. Retrying the
+// transaction may succeed.
+func Busy(err error) bool {
+	if sqliteBusy(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// serialization_failure, deadlock_detected, lock_not_available
+		return pgErr.Code == "40001" || pgErr.Code == "40P01" || pgErr.Code == "55P03"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_LOCK_WAIT_TIMEOUT, ER_LOCK_DEADLOCK
+		return mysqlErr.Number == 1205 || mysqlErr.Number == 1213
+	}
+	return false
+}
+
+// Report whether err comes from an insert or update breaking a unique
+// index
+func uniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	if sqliteUnique(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// unique_violation
+		return pgErr.Code == "23505"
+	}
+	var mysqlErr *mysql.MySQLError
+	// ER_DUP_ENTRY
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
@@ -0,0 +1,20 @@
+//go:build cgo
+
+package db
+
+import (
+	"errors"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Report whether err is SQLite's locked database error
+func sqliteBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// Report whether err is SQLite's unique constraint error
+func sqliteUnique(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
@@ -0,0 +1,12 @@
+//go:build !cgo
+
+package db
+
+// SQLite needs cgo, so without it no error comes from SQLite
+func sqliteBusy(err error) bool {
+	return false
+}
+
+func sqliteUnique(err error) bool {
+	return false
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// SearchResult is a file matching a search, with its latest version
+type SearchResult struct {
+	Version
+	Metadata string `json:"metadata"` // the metadata of the file as indexed, key value pairs separated by spaces
+}
+
+// IndexContent stores the text extracted from the content of filename in
+// the search index, replacing what was indexed for it before
+func IndexContent(ctx context.Context, db *DB, filename, body string) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		return indexFile(ctx, tx, filename, &body)
+	})
+}
+
+// Update the search entry of filename with its current metadata, and with
+// body as its text unless it is nil, which keeps the text indexed already
+func indexFile(ctx context.Context, tx *Tx, filename string, body *string) error {
+	if body == nil {
+		var indexed string
+		err := tx.QueryRowContext(ctx, `SELECT body FROM search_index WHERE filename = ?;`, filename).Scan(&indexed)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		body = &indexed
+	}
+	meta, err := GetMeta(ctx, tx, filename)
+	if err != nil {
+		return err
+	}
+	var words []string
+	for _, key := range sortedKeys(meta) {
+		words = append(words, key, meta[key])
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM search_index WHERE filename = ?;`, filename); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO search_index (filename, metadata, body) VALUES (?, ?, ?);`, filename, strings.Join(words, " "), *body)
+	return err
+}
+
+// Add the files recorded since the last search to the search index and
+// drop those whose versions are all gone
+func syncSearchIndex(ctx context.Context, db *DB) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO search_index (filename, metadata, body)
+			SELECT DISTINCT filename, '', '' FROM versions
+			WHERE filename NOT IN (SELECT filename FROM search_index);`); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM search_index WHERE filename NOT IN (SELECT filename FROM versions);`)
+		return err
+	})
+}
+
+// Search returns up to limit files whose name, metadata or indexed content
+// contain every word of query, sorted by name. SQLite matches whole words
+// through its full-text index, where a word ending in * matches as a
+// prefix; other databases match the words anywhere, ignoring case.
+func Search(ctx context.Context, db *DB, query string, limit int) ([]SearchResult, error) {
+	words := strings.Fields(strings.ReplaceAll(query, `"`, " "))
+	if len(words) == 0 {
+		return nil, nil
+	}
+	if err := syncSearchIndex(ctx, db); err != nil {
+		return nil, err
+	}
+
+	statement := `SELECT filename, metadata FROM search_index WHERE `
+	var args []any
+	if db.dialect.name == "sqlite" {
+		terms := make([]string, len(words))
+		for i, word := range words {
+			terms[i] = `"` + word + `"`
+		}
+		statement += `search_index MATCH ?`
+		args = append(args, strings.Join(terms, " "))
+	} else {
+		conditions := make([]string, len(words))
+		for i, word := range words {
+			conditions[i] = `(LOWER(filename) LIKE ? OR LOWER(metadata) LIKE ? OR LOWER(body) LIKE ?)`
+			pattern := "%" + strings.ToLower(strings.TrimRight(word, "*")) + "%"
+			args = append(args, pattern, pattern, pattern)
+		}
+		statement += strings.Join(conditions, ` AND `)
+	}
+	statement += ` ORDER BY filename LIMIT ?;`
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.Filename, &r.Metadata); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		v, err := GetVersion(ctx, db, results[i].Filename, 0)
+		if err != nil {
+			return nil, err
+		}
+		results[i].Version = v
+	}
+	return results, nil
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// HashAlgorithmSetting names the hash algorithm that addresses the blobs
+const HashAlgorithmSetting = "hash_algorithm"
+
+// Setting returns a repository setting, or "" when it was never set
+func Setting(ctx context.Context, db Executor, name string) (string, error) {
+	var value string
+	err := db.QueryRowContext(ctx, `SELECT value FROM settings WHERE name = ?;`, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+// SetSetting stores a repository setting, replacing any previous value
+func SetSetting(ctx context.Context, db *DB, name, value string) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		// Delete and insert is the one upsert every dialect understands
+		if _, err := tx.ExecContext(ctx, `DELETE FROM settings WHERE name = ?;`, name); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO settings (name, value) VALUES (?, ?);`, name, value)
+		return err
+	})
+}
+
+// HasVersions reports whether any file version has been recorded
+func HasVersions(ctx context.Context, db Executor) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (SELECT 1 FROM versions LIMIT 1) v;`).Scan(&count)
+	return count > 0, err
+}
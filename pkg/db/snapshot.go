@@ -0,0 +1,220 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// Snapshot is the metadata of a repository read at one point in time, as
+// cloned into an empty repository with its blobs
+type Snapshot struct {
+	Hash     string                       `json:"hash_algorithm"`
+	Versions []Version                    `json:"versions"`
+	Branches []Branch                     `json:"branches"`
+	Meta     map[string]map[string]string `json:"metadata"`
+	Aliases  []Alias                      `json:"aliases"`
+	Xattrs   []VersionXattr               `json:"xattrs"`
+	History  []Record                     `json:"history"` // the action log and backup catalog
+
+	// Retention locks, and the versions under retention, which the clone
+	// keeps as long
+	Retention []RetentionLock   `json:"retention_locks"`
+	Retained  []RetainedVersion `json:"retained"`
+	Holds     []LegalHold       `json:"legal_holds"` // released ones included
+}
+
+// VersionXattr is an extended attribute recorded for a version, with its
+// value in base64
+type VersionXattr struct {
+	Filename string `json:"filename"`
+	Version  int    `json:"version"`
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+}
+
+// ReadSnapshot reads the metadata of a repository in one transaction, so
+// that what it holds is consistent however the repository changes meanwhile
+func ReadSnapshot(ctx context.Context, db *DB) (*Snapshot, error) {
+	var snap *Snapshot
+	err := WithTx(ctx, db, func(tx *Tx) error {
+		snap = &Snapshot{Meta: map[string]map[string]string{}}
+		var err error
+		if snap.Hash, err = Setting(ctx, tx, HashAlgorithmSetting); err != nil {
+			return fmt.Errorf("failed to read hash algorithm: %w", err)
+		}
+		if snap.Versions, err = ListVersions(ctx, tx, ""); err != nil {
+			return fmt.Errorf("failed to read versions: %w", err)
+		}
+		if snap.Aliases, err = ListAliases(ctx, tx); err != nil {
+			return fmt.Errorf("failed to read aliases: %w", err)
+		}
+		if err := readSnapshotRows(ctx, tx, snap); err != nil {
+			return err
+		}
+		if snap.Retention, err = ListRetentionLocks(ctx, tx); err != nil {
+			return fmt.Errorf("failed to read retention locks: %w", err)
+		}
+		if snap.Holds, err = ListHolds(ctx, tx); err != nil {
+			return err
+		}
+		versions, err := retainedVersions(ctx, tx, `1 = 1`)
+		if err != nil {
+			return fmt.Errorf("failed to read retention: %w", err)
+		}
+		for _, v := range versions {
+			if v.Retained() {
+				snap.Retained = append(snap.Retained, v)
+			}
+		}
+		records, err := ReadHistory(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if r.Table != "versions" {
+				snap.History = append(snap.History, r)
+			}
+		}
+		return nil
+	})
+	return snap, err
+}
+
+// Read the branches, metadata and extended attributes of every file
+func readSnapshotRows(ctx context.Context, tx *Tx, snap *Snapshot) error {
+	queries := []struct {
+		table string
+		query string
+		scan  func(scanner interface{ Scan(...any) error }) error
+	}{
+		{"branches", `SELECT filename, branch, base_version, COALESCE(merged_version, 0) FROM file_branches ORDER BY filename, branch;`,
+			func(s interface{ Scan(...any) error }) error {
+				var b Branch
+				if err := s.Scan(&b.Filename, &b.Name, &b.Base, &b.Merged); err != nil {
+					return err
+				}
+				snap.Branches = append(snap.Branches, b)
+				return nil
+			}},
+		{"metadata", `SELECT filename, meta_key, meta_value FROM file_metadata ORDER BY filename, meta_key;`,
+			func(s interface{ Scan(...any) error }) error {
+				var filename, key, value string
+				if err := s.Scan(&filename, &key, &value); err != nil {
+					return err
+				}
+				if snap.Meta[filename] == nil {
+					snap.Meta[filename] = map[string]string{}
+				}
+				snap.Meta[filename][key] = value
+				return nil
+			}},
+		{"extended attributes", `SELECT v.filename, v.version, x.name, x.value FROM version_xattrs x JOIN versions v ON v.id = x.version_id ORDER BY v.filename, v.version, x.name;`,
+			func(s interface{ Scan(...any) error }) error {
+				var x VersionXattr
+				if err := s.Scan(&x.Filename, &x.Version, &x.Name, &x.Value); err != nil {
+					return err
+				}
+				snap.Xattrs = append(snap.Xattrs, x)
+				return nil
+			}},
+	}
+	for _, q := range queries {
+		rows, err := tx.QueryContext(ctx, q.query)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", q.table, err)
+		}
+		for rows.Next() {
+			if err := q.scan(rows); err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("failed to read %s: %w", q.table, err)
+			}
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", q.table, err)
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot records the metadata of a snapshot in a repository that
+// has no versions yet, in one transaction. Versions keep their numbers and
+// dates; row IDs are assigned anew.
+func RestoreSnapshot(ctx context.Context, db *DB, snap *Snapshot) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		if exists, err := HasVersions(ctx, tx); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("the repository has versions already")
+		}
+		for _, v := range snap.Versions {
+			var branch any
+			if v.Branch != "" {
+				branch = v.Branch
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO versions (filename, version, hash, path, mime_type, kind, timestamp, branch) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+				v.Filename, v.Version, v.Hash, v.Path, v.MimeType, v.Kind, v.Timestamp.UTC(), branch); err != nil {
+				return fmt.Errorf("failed to record %s version %d: %w", v.Filename, v.Version, err)
+			}
+			if err := SetVersionOriginalName(ctx, tx, v.Filename, v.Version, v.OriginalName); err != nil {
+				return err
+			}
+		}
+		for _, b := range snap.Branches {
+			if err := AddBranch(ctx, tx, b); err != nil {
+				return fmt.Errorf("failed to record branch %s of %s: %w", b.Name, b.Filename, err)
+			}
+		}
+		for _, filename := range sortedKeys(snap.Meta) {
+			meta := snap.Meta[filename]
+			for _, key := range sortedKeys(meta) {
+				if _, err := tx.ExecContext(ctx, `INSERT INTO file_metadata (filename, meta_key, meta_value) VALUES (?, ?, ?);`, filename, key, meta[key]); err != nil {
+					return fmt.Errorf("failed to record metadata of %s: %w", filename, err)
+				}
+			}
+			if err := indexFile(ctx, tx, filename, nil); err != nil {
+				return err
+			}
+		}
+		for _, a := range snap.Aliases {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO file_aliases (alias, filename) VALUES (?, ?);`, a.Name, a.Filename); err != nil {
+				return fmt.Errorf("failed to record alias %s: %w", a.Name, err)
+			}
+		}
+		for _, x := range snap.Xattrs {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO version_xattrs (version_id, name, value) SELECT id, ?, ? FROM versions WHERE filename = ? AND version = ?;`,
+				x.Name, x.Value, x.Filename, x.Version); err != nil {
+				return fmt.Errorf("failed to record extended attributes of %s version %d: %w", x.Filename, x.Version, err)
+			}
+		}
+		for _, r := range snap.History {
+			if err := r.Insert(ctx, tx); err != nil {
+				return fmt.Errorf("failed to record history: %w", err)
+			}
+		}
+		for _, l := range snap.Retention {
+			key, value := l.metaArgs()
+			if _, err := tx.ExecContext(ctx, `INSERT INTO retention_locks (meta_key, meta_value, days, principal, created_at) VALUES (?, ?, ?, ?, ?);`,
+				key, value, l.Days, l.Principal, l.Created.UTC()); err != nil {
+				return fmt.Errorf("failed to record retention lock: %w", err)
+			}
+		}
+		for _, h := range snap.Holds {
+			var released any
+			if h.Released != nil {
+				released = h.Released.UTC()
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO legal_holds (name, pattern, principal, created_at, released_by, released_at) VALUES (?, ?, ?, ?, ?, ?);`,
+				h.Name, h.Pattern, h.Principal, h.Created.UTC(), h.ReleasedBy, released); err != nil {
+				return fmt.Errorf("failed to record legal hold: %w", err)
+			}
+		}
+		for _, v := range snap.Retained {
+			if _, err := tx.ExecContext(ctx, `UPDATE versions SET retain_until = ? WHERE filename = ? AND version = ?;`, v.Until.UTC(), v.Filename, v.Version); err != nil {
+				return fmt.Errorf("failed to record retention of %s version %d: %w", v.Filename, v.Version, err)
+			}
+		}
+		return nil
+	})
+}
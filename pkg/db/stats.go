@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"path"
+	"sort"
+	"time"
+)
+
+// StatsSample is the size of a repository at the end of a month, derived
+// from the versions recorded by then and the sizes their blobs were stored
+// with. Versions deleted since are not counted.
+type StatsSample struct {
+	Month         string `json:"month"` // in the layout 2006-01, UTC
+	Files         int    `json:"files"`
+	Versions      int    `json:"versions"`
+	VersionsAdded int    `json:"versions_added"`
+	Blobs         int    `json:"blobs"`         // distinct contents
+	LogicalBytes  int64  `json:"logical_bytes"` // content of every version, repeats included
+	StoredBytes   int64  `json:"stored_bytes"`  // content of the distinct blobs
+}
+
+// DedupRatio returns how many bytes of versions each stored byte holds
+func (s StatsSample) DedupRatio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.StoredBytes)
+}
+
+// StatsHistory returns a sample of the size of the repository for every
+// month from the one its oldest version was stored in to the latest,
+// oldest first
+func StatsHistory(ctx context.Context, db Executor) ([]StatsSample, error) {
+	sizes, err := StoredSizes(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := ListVersions(ctx, db, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Timestamp.Before(versions[j].Timestamp)
+	})
+
+	var samples []StatsSample
+	var sample StatsSample
+	files := map[string]bool{}
+	blobs := map[string]bool{}
+	month := monthStart(versions[0].Timestamp)
+	for i := 0; i < len(versions); month = month.AddDate(0, 1, 0) {
+		sample.Month = month.Format("2006-01")
+		sample.VersionsAdded = 0
+		next := month.AddDate(0, 1, 0)
+		for ; i < len(versions) && versions[i].Timestamp.Before(next); i++ {
+			v := versions[i]
+			id := v.Hash + path.Ext(v.Filename)
+			files[v.Filename] = true
+			sample.Versions++
+			sample.VersionsAdded++
+			sample.LogicalBytes += sizes[id]
+			if !blobs[id] {
+				blobs[id] = true
+				sample.StoredBytes += sizes[id]
+			}
+		}
+		sample.Files = len(files)
+		sample.Blobs = len(blobs)
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// Return the start of the UTC month of t
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// conflictAttempts is how often WithTx runs a transaction whose version
+// numbers concurrent writers keep taking first
+const conflictAttempts = 5
+
+// WithTx runs fn inside a transaction, committing on success and rolling
+// back on error. A transaction failing as the database is busy is run
+// again as set by SetRetry, and one failing with ErrVersionConflict right
+// away, so fn must not have effects outside it.
+func WithTx(ctx context.Context, db *DB, fn func(tx *Tx) error) error {
+	return db.retry.Do(ctx, func() error {
+		for attempt := 1; ; attempt++ {
+			err := runTx(ctx, db, fn)
+			if attempt == conflictAttempts || !errors.Is(err, ErrVersionConflict) {
+				return err
+			}
+		}
+	})
+}
+
+// Run fn inside one transaction
+func runTx(ctx context.Context, db *DB, fn func(tx *Tx) error) error {
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		// A cancelled context has already rolled the transaction back
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			return errors.Join(err, rbErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,512 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"strings"
+	"time"
+)
+
+// Queries used to append a version; the MAX over the unique (filename,
+// version) index is a single index seek. Versions of every branch of a file are
+// numbered in one sequence, and latestHashQuery, taking the file name
+// twice, returns the last number and the hash of the latest mainline
+// version.
+const (
+	lastVersionQuery   = `SELECT COALESCE(MAX(version), 0) FROM versions WHERE filename = ?;`
+	versionInsertQuery = `INSERT INTO versions (filename, version, hash, path, mime_type, kind) VALUES (?, ?, ?, ?, ?, ?);`
+	latestHashQuery    = `SELECT (SELECT COALESCE(MAX(version), 0) FROM versions WHERE filename = ?),
+		COALESCE((SELECT hash FROM versions WHERE filename = ? AND branch IS NULL ORDER BY version DESC LIMIT 1), '');`
+)
+
+// ErrVersionConflict is wrapped by the errors of versions another writer
+// took the number of first. WithTx runs their transaction again.
+var ErrVersionConflict = errors.New("version number taken by a concurrent writer")
+
+// Insert version n of filename, failing with an error wrapping
+// ErrVersionConflict when it exists already
+func insertVersionRow(ctx context.Context, db Executor, filename string, n int, hash, path, mimeType, kind string) error {
+	_, err := db.ExecContext(ctx, versionInsertQuery, filename, n, hash, path, mimeType, kind)
+	return versionConflict(err)
+}
+
+// Wrap the error of a version insert in ErrVersionConflict when it broke
+// the uniqueness of version numbers
+func versionConflict(err error) error {
+	if uniqueViolation(err) {
+		return fmt.Errorf("%w: %w", ErrVersionConflict, err)
+	}
+	return err
+}
+
+// LogVersion appends the next version of filename with the given content
+// hash, stored from the source path, and returns its number. The MIME type
+// and kind of the content are empty when unknown.
+func LogVersion(ctx context.Context, db Executor, filename, hash, path, mimeType, kind string) (int, error) {
+	var lastVersion int
+	if err := db.QueryRowContext(ctx, lastVersionQuery, filename).Scan(&lastVersion); err != nil {
+		return 0, err
+	}
+
+	if err := insertVersionRow(ctx, db, filename, lastVersion+1, hash, path, mimeType, kind); err != nil {
+		return 0, err
+	}
+	return lastVersion + 1, nil
+}
+
+// LogChangedVersion appends the next version of filename like LogVersion
+// unless its latest version has the same content hash already, as when
+// two runs store the same content at once. It returns the latest version
+// and whether it was appended.
+func LogChangedVersion(ctx context.Context, db Executor, filename, hash, path, mimeType, kind string) (int, bool, error) {
+	var last int
+	var latest string
+	if err := db.QueryRowContext(ctx, latestHashQuery, filename, filename).Scan(&last, &latest); err != nil {
+		return 0, false, err
+	}
+	if latest == hash {
+		v, err := GetVersion(ctx, db, filename, 0)
+		return v.Version, false, err
+	}
+	if err := insertVersionRow(ctx, db, filename, last+1, hash, path, mimeType, kind); err != nil {
+		return 0, false, err
+	}
+	return last + 1, true, nil
+}
+
+// ErrNoVersion is returned when a requested file version was never recorded
+var ErrNoVersion = errors.New("no such version")
+
+// Version is a recorded version of a file
+type Version struct {
+	Filename  string    `json:"filename"`
+	Version   int       `json:"version"`
+	Hash      string    `json:"hash"`
+	Path      string    `json:"path"`      // where the content was stored from; empty in versions recorded before paths were
+	MimeType  string    `json:"mime_type"` // type of the content; empty in versions recorded before types were
+	Kind      string    `json:"kind"`      // image, video, audio, document, archive, text or other
+	Timestamp time.Time `json:"timestamp"`
+
+	// OriginalName is the name as it was read when it differs from
+	// Filename, which is kept in Unicode normalization form C
+	OriginalName string `json:"original_name,omitempty"`
+
+	// Branch names the branch of the history the version was stored on,
+	// and is empty on the mainline
+	Branch string `json:"branch,omitempty"`
+}
+
+const versionColumns = `COALESCE(filename, ''), COALESCE(version, 0), COALESCE(hash, ''), COALESCE(path, ''), COALESCE(mime_type, ''), COALESCE(kind, ''), timestamp, COALESCE(original_name, ''), COALESCE(branch, '')`
+
+// Scan a row of versionColumns
+func scanVersion(row interface{ Scan(...any) error }) (Version, error) {
+	var v Version
+	err := row.Scan(&v.Filename, &v.Version, &v.Hash, &v.Path, &v.MimeType, &v.Kind, &v.Timestamp, &v.OriginalName, &v.Branch)
+	return v, err
+}
+
+// ListVersions returns the versions of filename, oldest first, or those of
+// every file when filename is empty
+func ListVersions(ctx context.Context, db Executor, filename string) ([]Version, error) {
+	query := `SELECT ` + versionColumns + ` FROM versions`
+	var args []any
+	if filename != "" {
+		query += ` WHERE filename = ?`
+		args = append(args, filename)
+	}
+	query += ` ORDER BY filename, version;`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var versions []Version
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// VersionFilter selects files by their latest mainline version
+type VersionFilter struct {
+	// ContentType is a kind of content such as image, an exact MIME type,
+	// or a MIME major type such as image/*
+	ContentType string
+	// Meta holds metadata values the files must all have
+	Meta map[string]string
+	// TakenBefore and TakenAfter bound the capture dates of photos and
+	// videos, in the layout of their taken metadata or a prefix of it such
+	// as 2020 or 2020-06. Before excludes the date, after includes it.
+	TakenBefore, TakenAfter string
+	// Match is a pattern the file names must match, as by fsutil.MatchGlob
+	Match string
+}
+
+// ListLatestVersions returns the latest mainline version of every file the
+// filter selects, sorted by name
+func ListLatestVersions(ctx context.Context, db Executor, filter VersionFilter) ([]Version, error) {
+	if filter.Match != "" {
+		if _, err := fsutil.MatchGlob(filter.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", filter.Match, err)
+		}
+	}
+	query := `SELECT ` + versionColumns + ` FROM versions v
+		WHERE branch IS NULL AND version = (SELECT MAX(version) FROM versions latest WHERE latest.filename = v.filename AND latest.branch IS NULL)`
+	var args []any
+	switch contentType := strings.ToLower(filter.ContentType); {
+	case contentType == "":
+	case strings.HasSuffix(contentType, "/*"):
+		query += ` AND mime_type LIKE ?`
+		args = append(args, strings.TrimSuffix(contentType, "*")+"%")
+	case strings.Contains(contentType, "/"):
+		query += ` AND mime_type = ?`
+		args = append(args, contentType)
+	default:
+		query += ` AND kind = ?`
+		args = append(args, contentType)
+	}
+	for _, key := range sortedKeys(filter.Meta) {
+		query += ` AND EXISTS (SELECT 1 FROM file_metadata m WHERE m.filename = v.filename AND m.meta_key = ? AND m.meta_value = ?)`
+		args = append(args, key, filter.Meta[key])
+	}
+	// Capture dates compare in time as strings
+	if filter.TakenBefore != "" {
+		query += ` AND EXISTS (SELECT 1 FROM file_metadata m WHERE m.filename = v.filename AND m.meta_key = 'taken' AND m.meta_value < ?)`
+		args = append(args, filter.TakenBefore)
+	}
+	if filter.TakenAfter != "" {
+		query += ` AND EXISTS (SELECT 1 FROM file_metadata m WHERE m.filename = v.filename AND m.meta_key = 'taken' AND m.meta_value >= ?)`
+		args = append(args, filter.TakenAfter)
+	}
+	query += ` ORDER BY filename;`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var versions []Version
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Match != "" {
+			if ok, _ := fsutil.MatchGlob(filter.Match, v.Filename); !ok {
+				continue
+			}
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// GetVersion returns version n of filename, or the latest mainline version
+// when n is 0. A missing version gives an error wrapping ErrNoVersion.
+func GetVersion(ctx context.Context, db Executor, filename string, n int) (Version, error) {
+	query := `SELECT ` + versionColumns + ` FROM versions WHERE filename = ? AND version = ?;`
+	args := []any{filename, n}
+	if n == 0 {
+		query = `SELECT ` + versionColumns + ` FROM versions WHERE filename = ? AND branch IS NULL ORDER BY version DESC LIMIT 1;`
+		args = args[:1]
+	}
+
+	v, err := scanVersion(db.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		if n == 0 {
+			return v, fmt.Errorf("%s: %w", filename, ErrNoVersion)
+		}
+		return v, fmt.Errorf("%s version %d: %w", filename, n, ErrNoVersion)
+	}
+	return v, err
+}
+
+// ErrAmbiguousHash is returned for hash prefixes matching several contents
+var ErrAmbiguousHash = errors.New("hash prefix matches several contents")
+
+// GetVersionByHash returns the latest version whose content hash starts
+// with prefix, which must match the hash of only one content
+func GetVersionByHash(ctx context.Context, db Executor, prefix string) (Version, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+versionColumns+` FROM versions WHERE hash LIKE ? ORDER BY timestamp DESC, id DESC;`,
+		strings.ToLower(prefix)+"%")
+	if err != nil {
+		return Version{}, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var found Version
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return Version{}, err
+		}
+		if found.Hash == "" {
+			found = v
+		} else if v.Hash != found.Hash {
+			return Version{}, fmt.Errorf("%s: %w", prefix, ErrAmbiguousHash)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return Version{}, err
+	}
+	if found.Hash == "" {
+		return found, fmt.Errorf("hash %s: %w", prefix, ErrNoVersion)
+	}
+	return found, nil
+}
+
+// ListVersionsByHash returns every version whose content has the given
+// hash, on any branch
+func ListVersionsByHash(ctx context.Context, db Executor, sum string) ([]Version, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+versionColumns+` FROM versions WHERE hash = ? ORDER BY filename, version;`, strings.ToLower(sum))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var versions []Version
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// StoredSizes returns the size logged when each blob was written, keyed by
+// storage ID
+func StoredSizes(ctx context.Context, db Executor) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT storage_id, MAX(bytes) FROM actions WHERE action_type = 'store' AND bytes > 0 GROUP BY storage_id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var id string
+		var size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			return nil, err
+		}
+		sizes[id] = size
+	}
+	return sizes, rows.Err()
+}
+
+// TangledVersions returns the files whose versions were stored from more
+// than one path, with those paths sorted
+func TangledVersions(ctx context.Context, db Executor) (map[string][]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT filename, path FROM versions WHERE path <> '' GROUP BY filename, path ORDER BY filename, path;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	paths := map[string][]string{}
+	for rows.Next() {
+		var filename, path string
+		if err := rows.Scan(&filename, &path); err != nil {
+			return nil, err
+		}
+		paths[filename] = append(paths[filename], path)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for filename, list := range paths {
+		if len(list) < 2 {
+			delete(paths, filename)
+		}
+	}
+	return paths, nil
+}
+
+// SplitVersions moves the versions of filename stored from each path in
+// keys to the file named by keys[path], renumbering every affected version
+// chain in its original order. Versions of other paths stay under filename.
+func SplitVersions(ctx context.Context, db *DB, filename string, keys map[string]string) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		if err := CheckRetention(ctx, tx, filename); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT id, COALESCE(path, '') FROM versions WHERE filename = ? ORDER BY version, id;`, filename)
+		if err != nil {
+			return err
+		}
+		type move struct {
+			id  int64
+			key string
+		}
+		var moves []move
+		for rows.Next() {
+			var m move
+			var path string
+			if err := rows.Scan(&m.id, &path); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			m.key = filename
+			if key, ok := keys[path]; ok {
+				m.key = key
+			}
+			moves = append(moves, m)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return err
+		}
+
+		next := map[string]int{}
+		for _, m := range moves {
+			if _, ok := next[m.key]; !ok && m.key != filename {
+				// Split versions continue any chain already under the new name
+				var last int
+				if err := tx.QueryRowContext(ctx, lastVersionQuery, m.key).Scan(&last); err != nil {
+					return err
+				}
+				next[m.key] = last
+			}
+			next[m.key]++
+			if _, err := tx.ExecContext(ctx, `UPDATE versions SET filename = ?, version = ? WHERE id = ?;`, m.key, next[m.key], m.id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RenameFile moves every version of from to the end of the chain of to,
+// in their original order, remembering from as their original name, and
+// moves the metadata of from that to has no value for. Aliases and
+// branches of from then belong to to.
+func RenameFile(ctx context.Context, db *DB, from, to string) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		if err := CheckRetention(ctx, tx, from); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE versions SET original_name = ? WHERE filename = ? AND original_name IS NULL;`, from, from); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE file_aliases SET filename = ? WHERE filename = ?;`, to, from); err != nil {
+			return err
+		}
+		var last int
+		if err := tx.QueryRowContext(ctx, lastVersionQuery, to).Scan(&last); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT id, version FROM versions WHERE filename = ? ORDER BY version, id;`, from)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		renumbered := map[int]int{}
+		for rows.Next() {
+			var id int64
+			var version int
+			if err := rows.Scan(&id, &version); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			renumbered[version] = last + len(ids)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if _, err := tx.ExecContext(ctx, `UPDATE versions SET filename = ?, version = ? WHERE id = ?;`, to, last+i+1, id); err != nil {
+				return err
+			}
+		}
+		if err := moveBranches(ctx, tx, from, to, renumbered); err != nil {
+			return err
+		}
+
+		meta, err := GetMeta(ctx, tx, from)
+		if err != nil {
+			return err
+		}
+		kept, err := GetMeta(ctx, tx, to)
+		if err != nil {
+			return err
+		}
+		for _, key := range sortedKeys(meta) {
+			if _, ok := kept[key]; ok {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO file_metadata (filename, meta_key, meta_value) VALUES (?, ?, ?);`, to, key, meta[key]); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM file_metadata WHERE filename = ?;`, from); err != nil {
+			return err
+		}
+		if len(meta) == 0 {
+			return nil
+		}
+		return indexFile(ctx, tx, to, nil)
+	})
+}
+
+// SetVersionTime dates version n of filename at t, for versions imported
+// from histories kept elsewhere
+func SetVersionTime(ctx context.Context, db Executor, filename string, n int, t time.Time) error {
+	_, err := db.ExecContext(ctx, `UPDATE versions SET timestamp = ? WHERE filename = ? AND version = ?;`, t.UTC(), filename, n)
+	return err
+}
+
+// SetVersionOriginalName records the name version n of filename had before
+// it was normalized, unless it had none other
+func SetVersionOriginalName(ctx context.Context, db Executor, filename string, n int, original string) error {
+	if original == "" || original == filename {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `UPDATE versions SET original_name = ? WHERE filename = ? AND version = ?;`, original, filename, n)
+	return err
+}
+
+// DeleteVersion removes version n of filename if it still holds the given
+// content hash, reporting whether it did. It fails with ErrRetained or
+// ErrHeld while the version is retained or held.
+func DeleteVersion(ctx context.Context, db Executor, filename string, n int, hash string) (bool, error) {
+	if err := CheckRetention(ctx, db, filename, n); err != nil {
+		return false, err
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM version_xattrs WHERE version_id IN (SELECT id FROM versions WHERE filename = ? AND version = ? AND hash = ?);`, filename, n, hash); err != nil {
+		return false, err
+	}
+	result, err := db.ExecContext(ctx, `DELETE FROM versions WHERE filename = ? AND version = ? AND hash = ?;`, filename, n, hash)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
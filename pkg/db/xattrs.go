@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+)
+
+// SetVersionXattrs records the extended attributes the file of version n
+// of filename had when it was stored. Values are kept in base64, as they
+// are often binary, such as POSIX ACLs.
+func SetVersionXattrs(ctx context.Context, db Executor, filename string, n int, attrs map[string][]byte) error {
+	for _, name := range sortedKeys(attrs) {
+		_, err := db.ExecContext(ctx, `INSERT INTO version_xattrs (version_id, name, value) SELECT id, ?, ? FROM versions WHERE filename = ? AND version = ?;`,
+			name, base64.StdEncoding.EncodeToString(attrs[name]), filename, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VersionXattrs returns the extended attributes recorded for version n of
+// filename, or none when it had none or was stored before they were
+// recorded
+func VersionXattrs(ctx context.Context, db Executor, filename string, n int) (map[string][]byte, error) {
+	rows, err := db.QueryContext(ctx, `SELECT x.name, x.value FROM version_xattrs x JOIN versions v ON v.id = x.version_id WHERE v.filename = ? AND v.version = ?;`, filename, n)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var attrs map[string][]byte
+	for rows.Next() {
+		var name, encoded string
+		if err := rows.Scan(&name, &encoded); err != nil {
+			return nil, err
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if attrs == nil {
+			attrs = map[string][]byte{}
+		}
+		attrs[name] = value
+	}
+	return attrs, rows.Err()
+}
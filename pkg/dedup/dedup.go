@@ -0,0 +1,258 @@
+// Package dedup removes files with identical content from a directory tree.
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+)
+
+// Duplicate is a file removed because an earlier file had the same content
+type Duplicate struct {
+	Name     string `json:"name"`
+	Original string `json:"original"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// DedupReport lists what a deduplication removed
+type DedupReport struct {
+	Scanned    int         `json:"scanned"` // files hashed
+	Removed    []Duplicate `json:"removed"`
+	BytesFreed int64       `json:"bytes_freed"`
+
+	// Unreadable lists the parts of the tree that were skipped as they
+	// could not be read, with why
+	Unreadable []string `json:"unreadable,omitempty"`
+
+	// Mismatched lists the files kept as their digest matched an earlier
+	// file but their content did not, such as from a stale hash cache
+	Mismatched []string `json:"mismatched,omitempty"`
+}
+
+// Print the report in a human-readable form
+func (r *DedupReport) Print() {
+	for _, skipped := range r.Unreadable {
+		fmt.Printf("unreadable %s\n", skipped)
+	}
+	for _, kept := range r.Mismatched {
+		fmt.Printf("mismatched %s\n", kept)
+	}
+	fmt.Printf("Deduplication summary: %d files scanned, %d removed, %d bytes freed\n", r.Scanned, len(r.Removed), r.BytesFreed)
+}
+
+// Files deletes every file below directory whose content, compared by
+// digest under algorithm, matches a file seen earlier in the walk, logging
+// each removal before making it. Files are compared byte for byte with the
+// earlier one before being removed, and kept when they differ.
+// Digests of unchanged files come from the hash cache unless the options
+// are paranoid.
+func Files(ctx context.Context, directory string, algorithm hash.Algorithm, metadata *db.DB, opts fsutil.Options) (*DedupReport, error) {
+	root, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	return files(ctx, fsutil.DirFS(directory), algorithm, metadata, opts, filepath.ToSlash(root), func(name string) string {
+		return filepath.Join(directory, filepath.FromSlash(name))
+	})
+}
+
+// FilesFS deletes duplicate files from fsys like Files, hashing every file
+func FilesFS(ctx context.Context, fsys fsutil.WriteFS, algorithm hash.Algorithm, metadata *db.DB, opts fsutil.Options) (*DedupReport, error) {
+	return files(ctx, fsys, algorithm, metadata, opts, "", func(name string) string {
+		return name
+	})
+}
+
+// Deduplicate fsys; display turns file system names into the names shown
+// and logged. Files are cached by their path below root, the slash-separated
+// absolute path of fsys on the host, unless it is empty.
+func files(ctx context.Context, fsys fsutil.WriteFS, algorithm hash.Algorithm, metadata *db.DB, opts fsutil.Options, root string, display func(string) string) (report *DedupReport, err error) {
+	report = &DedupReport{}
+
+	cache := db.NewHashCache(metadata, algorithm.Name)
+	defer func() {
+		if err := cache.Flush(context.WithoutCancel(ctx)); err != nil {
+			opts.Events().OnError(event.Error{Op: "hash cache", Name: "flush", Err: err})
+		}
+	}()
+	hashFile := func(name string, info fs.FileInfo) (string, error) {
+		if root == "" {
+			return algorithm.FSFile(ctx, fsys, name)
+		}
+		key := path.Join(root, name)
+		if !opts.Paranoid {
+			if sum, ok := cache.Lookup(ctx, key, info); ok {
+				return sum, nil
+			}
+		}
+		sum, err := algorithm.FSFile(ctx, fsys, name)
+		if err != nil {
+			return "", err
+		}
+		if err := cache.Remember(ctx, key, info, sum); err != nil {
+			opts.Events().OnError(event.Error{Op: "hash cache", Name: key, Err: err})
+		}
+		return sum, nil
+	}
+
+	seen := newIndex(memoryLimit)
+	defer func() {
+		if err := seen.Close(); err != nil {
+			opts.Events().OnError(event.Error{Op: "deduplicate", Name: "index", Err: err})
+		}
+	}()
+
+	// Hashed files are looked up in the index in batches
+	type hashedFile struct {
+		indexEntry
+		size int64
+	}
+	pending := make([]hashedFile, 0, db.BatchSize)
+	resolve := func() error {
+		entries := make([]indexEntry, len(pending))
+		for i, f := range pending {
+			entries[i] = f.indexEntry
+		}
+		originals, err := seen.Resolve(ctx, entries)
+		if err != nil {
+			return err
+		}
+		var duplicates []Duplicate
+		var names []string
+		for i, f := range pending {
+			if originals[i] == "" {
+				continue
+			}
+			// A digest alone may come from a stale cache entry
+			same, err := sameContent(ctx, fsys, originals[i], f.name)
+			if err != nil {
+				return fmt.Errorf("failed to compare %s with %s: %w", display(f.name), display(originals[i]), err)
+			}
+			if !same {
+				report.Mismatched = append(report.Mismatched, display(f.name))
+				opts.Events().OnError(event.Error{Op: "deduplicate", Name: display(f.name), Err: fmt.Errorf("digest matches %s but the content differs; kept", display(originals[i]))})
+				continue
+			}
+			duplicates = append(duplicates, Duplicate{Name: display(f.name), Original: display(originals[i]), Bytes: f.size})
+			names = append(names, f.name)
+		}
+		pending = pending[:0]
+		if len(duplicates) == 0 {
+			return nil
+		}
+
+		// The removals of the batch are logged in one transaction before
+		// any file is removed, so that no file is gone without its entry
+		err = db.WithTx(ctx, metadata, func(tx *db.Tx) error {
+			for _, d := range duplicates {
+				if err := db.RecordAction(ctx, tx, db.Action{ActionType: "deduplicate", Filename: d.Name, Bytes: d.Bytes}); err != nil {
+					return fmt.Errorf("failed to log removal of %s: %w", d.Name, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Logged removals are made even when cancelled
+		for i, d := range duplicates {
+			opts.Events().OnDuplicateFound(event.DuplicateFound{Op: "deduplicate", Name: d.Name, Original: d.Original, Bytes: d.Bytes})
+			if err := fsys.Remove(names[i]); err != nil {
+				// The entry logged already is followed by the failure
+				logErr := db.RecordAction(context.WithoutCancel(ctx), metadata, db.Action{ActionType: "deduplicate", Filename: d.Name, Bytes: d.Bytes, Err: err})
+				return errors.Join(err, logErr)
+			}
+			report.Removed = append(report.Removed, d)
+			report.BytesFreed += d.Bytes
+		}
+		return nil
+	}
+
+	skip := func(name string, err error) {
+		report.Unreadable = append(report.Unreadable, fmt.Sprintf("%s: %v", name, err))
+	}
+	err = fs.WalkDir(fsys, ".", opts.SkipUnreadable("deduplicate", ".", skip, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fileHash, err := hashFile(name, info)
+		if err != nil {
+			return err
+		}
+		report.Scanned++
+		pending = append(pending, hashedFile{indexEntry{hash: fileHash, name: name}, info.Size()})
+		if len(pending) < cap(pending) {
+			return nil
+		}
+		return resolve()
+	}))
+	if err != nil {
+		return report, err
+	}
+	return report, resolve()
+}
+
+// Report whether files a and b of fsys hold the same bytes
+func sameContent(ctx context.Context, fsys fs.FS, a, b string) (bool, error) {
+	fileA, err := fsys.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = fileA.Close()
+	}()
+	fileB, err := fsys.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = fileB.Close()
+	}()
+
+	readerA, readerB := fsutil.ContextReader(ctx, fileA), fsutil.ContextReader(ctx, fileB)
+	bufA, bufB := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		nA, errA := io.ReadFull(readerA, bufA)
+		nB, errB := io.ReadFull(readerB, bufB)
+		if err := readError(errA); err != nil {
+			return false, err
+		}
+		if err := readError(errB); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		if errA != nil || errB != nil {
+			// Both ended, or one is a prefix of the other
+			return errA != nil && errB != nil, nil
+		}
+	}
+}
+
+// Return the error of an io.ReadFull other than reaching the end
+func readError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
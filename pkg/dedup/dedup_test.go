@@ -0,0 +1,95 @@
+package dedup_test
+
+import (
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/dedup"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write files below dir, all modified at fmtest.FixedTime
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, fmtest.FixedTime, fmtest.FixedTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	dir := t.TempDir()
+	writeFiles(t, dir, fmtest.SampleFiles)
+
+	report, err := dedup.Files(context.Background(), dir, hash.Default(), repo.DB, repo.Options)
+	if err != nil {
+		t.Fatalf("deduplication failed: %v", err)
+	}
+	if report.Scanned != 4 || len(report.Removed) != 1 || report.BytesFreed != 6 {
+		t.Errorf("scanned %d, removed %+v, freed %d; want 4, one file and 6", report.Scanned, report.Removed, report.BytesFreed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Errorf("the original is gone: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir", "sub", "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("the duplicate is still there: %v", err)
+	}
+}
+
+// A stale hash cache entry claiming a file matches another must not get it
+// removed
+func TestFilesKeepsMismatchedContent(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "alpha\n", "b.txt": "bravo\n"})
+
+	algorithm := hash.Default()
+	alpha, err := algorithm.Reader(ctx, strings.NewReader("alpha\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, "b.txt")
+	info, err := os.Stat(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := db.NewHashCache(repo.DB, algorithm.Name)
+	if err := cache.Remember(ctx, filepath.ToSlash(root)+"/b.txt", info, alpha); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := dedup.Files(ctx, dir, algorithm, repo.DB, repo.Options)
+	if err != nil {
+		t.Fatalf("deduplication failed: %v", err)
+	}
+	if len(report.Removed) != 0 || len(report.Mismatched) != 1 || report.Mismatched[0] != stale {
+		t.Errorf("removed %+v and kept %v as mismatched, want only %s kept", report.Removed, report.Mismatched, stale)
+	}
+	if data, err := os.ReadFile(stale); err != nil || string(data) != "bravo\n" {
+		t.Errorf("b.txt holds %q (%v)", data, err)
+	}
+	if len(repo.Events.Errors) != 1 {
+		t.Errorf("reported %+v, want the mismatch", repo.Events.Errors)
+	}
+}
@@ -0,0 +1,181 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"os"
+	"strings"
+)
+
+// memoryLimit is how many digests the index holds in memory before it
+// moves them to a database on disk, which keeps the memory used by huge
+// trees bounded
+const memoryLimit = 1 << 20
+
+// spillBatch is how many digests moving to disk are written per transaction
+const spillBatch = 1 << 16
+
+// indexEntry is a hashed file waiting to be looked up in the index
+type indexEntry struct {
+	hash string
+	name string
+}
+
+// index maps the digests of the files seen so far to the first file with
+// each, in memory until it outgrows limit and in a temporary SQLite
+// database after that
+type index struct {
+	limit  int
+	memory map[string]string
+	disk   *db.DB
+	path   string
+}
+
+func newIndex(limit int) *index {
+	return &index{limit: limit, memory: make(map[string]string)}
+}
+
+// Resolve looks up a batch of files in walk order, returning for each the
+// name of the earlier file with the same digest, or "" for the first one,
+// which the index then remembers
+func (x *index) Resolve(ctx context.Context, entries []indexEntry) ([]string, error) {
+	originals := make([]string, len(entries))
+	if x.disk == nil {
+		for i, e := range entries {
+			if original, ok := x.memory[e.hash]; ok {
+				originals[i] = original
+			} else {
+				x.memory[e.hash] = e.name
+			}
+		}
+		if len(x.memory) > x.limit {
+			return originals, x.spill(ctx)
+		}
+		return originals, nil
+	}
+
+	known, err := x.lookup(ctx, entries)
+	if err != nil {
+		return nil, err
+	}
+	var added []indexEntry
+	for i, e := range entries {
+		if original, ok := known[e.hash]; ok {
+			originals[i] = original
+			continue
+		}
+		// Later files of the batch are duplicates of this one
+		known[e.hash] = e.name
+		added = append(added, e)
+	}
+	return originals, x.insert(ctx, added)
+}
+
+// Find the names recorded for the digests of entries in one query
+func (x *index) lookup(ctx context.Context, entries []indexEntry) (map[string]string, error) {
+	known := make(map[string]string, len(entries))
+	if len(entries) == 0 {
+		return known, nil
+	}
+	args := make([]any, len(entries))
+	for i, e := range entries {
+		args[i] = e.hash
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(entries)), ", ")
+	rows, err := x.disk.QueryContext(ctx, `SELECT hash, name FROM seen WHERE hash IN (`+placeholders+`);`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dedup index: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var hash, name string
+		if err := rows.Scan(&hash, &name); err != nil {
+			return nil, err
+		}
+		known[hash] = name
+	}
+	return known, rows.Err()
+}
+
+// Record first files in one transaction
+func (x *index) insert(ctx context.Context, entries []indexEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	err := db.WithTx(ctx, x.disk, func(tx *db.Tx) error {
+		insert, err := tx.PrepareContext(ctx, `INSERT INTO seen (hash, name) VALUES (?, ?);`)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = insert.Close()
+		}()
+		for _, e := range entries {
+			if _, err := insert.ExecContext(ctx, e.hash, e.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update dedup index: %w", err)
+	}
+	return nil
+}
+
+// Move the digests held in memory to a new temporary database
+func (x *index) spill(ctx context.Context) error {
+	file, err := os.CreateTemp("", "fm-dedup-*.db")
+	if err != nil {
+		return fmt.Errorf("failed to create dedup index: %w", err)
+	}
+	x.path = file.Name()
+	_ = file.Close()
+
+	// The index is thrown away afterwards, so it need not survive crashes
+	cfg := db.DefaultConfig()
+	cfg.DSN = x.path
+	cfg.JournalMode = "OFF"
+	cfg.Synchronous = "OFF"
+	x.disk, err = db.Open(cfg, "")
+	if err != nil {
+		return fmt.Errorf("failed to open dedup index: %w", err)
+	}
+	if _, err := x.disk.ExecContext(ctx, `CREATE TABLE seen (hash TEXT PRIMARY KEY, name TEXT NOT NULL) WITHOUT ROWID;`); err != nil {
+		return fmt.Errorf("failed to create dedup index: %w", err)
+	}
+
+	entries := make([]indexEntry, 0, spillBatch)
+	for hash, name := range x.memory {
+		entries = append(entries, indexEntry{hash: hash, name: name})
+		if len(entries) == cap(entries) {
+			if err := x.insert(ctx, entries); err != nil {
+				return err
+			}
+			entries = entries[:0]
+		}
+	}
+	if err := x.insert(ctx, entries); err != nil {
+		return err
+	}
+	x.memory = nil
+	return nil
+}
+
+// Close removes the database the index spilled to, if any
+func (x *index) Close() error {
+	if x.path == "" {
+		return nil
+	}
+	var err error
+	if x.disk != nil {
+		err = x.disk.Close()
+	}
+	if removeErr := os.Remove(x.path); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,351 @@
+// Package delta transfers a file as the difference to an older copy the
+// receiver has, the way rsync does: the receiver describes the blocks of
+// its copy with a signature, the sender finds those blocks in its file with
+// a rolling checksum, and only the bytes between them travel.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MinBlockSize and MaxBlockSize bound the block size BlockSize picks
+const (
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 128 << 10
+)
+
+// maxLiteral is the most bytes a single literal operation carries
+const maxLiteral = 1 << 20
+
+// magic starts every delta
+const magic = "fmdelta1"
+
+// Operations of a delta
+const (
+	opCopy    = 'C' // copy a run of blocks of the base
+	opLiteral = 'L' // insert the bytes that follow
+	opEnd     = 'E' // the delta is complete
+)
+
+// ErrCorrupt is returned when a delta is malformed or refers to blocks the
+// base does not have
+var ErrCorrupt = errors.New("corrupt delta")
+
+// Block describes a block of the base
+type Block struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// Signature describes the blocks of a base file. The last block may be
+// shorter than BlockSize.
+type Signature struct {
+	BlockSize int     `json:"block_size"`
+	Size      int64   `json:"size"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// Stats counts what a delta is made of
+type Stats struct {
+	Copied  int64 `json:"copied"`  // bytes taken from the base
+	Literal int64 `json:"literal"` // bytes sent in the delta
+}
+
+// BlockSize returns the block size for a base of size bytes: about its
+// square root, which balances the size of the signature against the bytes
+// resent around each change
+func BlockSize(size int64) int {
+	block := int(math.Sqrt(float64(size))) &^ 1023
+	return min(max(block, MinBlockSize), MaxBlockSize)
+}
+
+// Sign computes the signature of base with the given block size
+func Sign(base io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(base, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Return the rsync weak checksum of block
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// Return the strong checksum of block, which confirms a weak match
+func strongSum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:16]
+}
+
+// Diff writes the delta turning the base sig describes into the content of
+// r, and returns what it is made of
+func Diff(sig *Signature, r io.Reader, w io.Writer) (Stats, error) {
+	var stats Stats
+	bs := sig.BlockSize
+	if bs <= 0 {
+		return stats, fmt.Errorf("invalid block size %d", bs)
+	}
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+	lastLen := int(sig.Size - int64(len(sig.Blocks)-1)*int64(bs))
+
+	enc := &encoder{w: bufio.NewWriter(w), stats: &stats}
+	if err := enc.header(bs); err != nil {
+		return stats, err
+	}
+
+	// buf holds the pending literal bytes, then the window being matched
+	br := bufio.NewReaderSize(r, 64<<10)
+	buf := make([]byte, 0, maxLiteral+2*bs)
+	literal := 0
+	eof := false
+	fill := func() error {
+		for !eof && len(buf)-literal < bs {
+			c, err := br.ReadByte()
+			if errors.Is(err, io.EOF) {
+				eof = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			buf = append(buf, c)
+		}
+		return nil
+	}
+	match := func(window []byte, weak uint32) int {
+		for _, i := range index[weak] {
+			size := bs
+			if i == len(sig.Blocks)-1 {
+				size = lastLen
+			}
+			if size == len(window) && bytes.Equal(strongSum(window), sig.Blocks[i].Strong) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if err := fill(); err != nil {
+		return stats, err
+	}
+	weak := weakSum(buf[literal:])
+	for len(buf) > literal {
+		window := buf[literal:]
+		if i := match(window, weak); i >= 0 {
+			if err := enc.literal(buf[:literal]); err != nil {
+				return stats, err
+			}
+			if err := enc.copy(i, len(window)); err != nil {
+				return stats, err
+			}
+			buf, literal = buf[:0], 0
+			if err := fill(); err != nil {
+				return stats, err
+			}
+			weak = weakSum(buf)
+			continue
+		}
+
+		// Slide the window by a byte, which joins the literal
+		out := uint32(buf[literal])
+		literal++
+		if literal == maxLiteral {
+			if err := enc.literal(buf[:literal]); err != nil {
+				return stats, err
+			}
+			buf = append(buf[:0], buf[literal:]...)
+			literal = 0
+		}
+		n := len(buf) - literal
+		if err := fill(); err != nil {
+			return stats, err
+		}
+		if len(buf)-literal > n {
+			// A full window rolled: drop out, add the byte that came in
+			in := uint32(buf[len(buf)-1])
+			a := (weak&0xffff - out + in) & 0xffff
+			b := ((weak >> 16) - uint32(bs)*out + a) & 0xffff
+			weak = a | b<<16
+		} else if len(buf)-literal == lastLen {
+			// The end of the input shrank the window to the size of the
+			// last block, the only one it can still match
+			weak = weakSum(buf[literal:])
+		}
+	}
+	if err := enc.literal(buf[:literal]); err != nil {
+		return stats, err
+	}
+	return stats, enc.end()
+}
+
+// encoder writes the operations of a delta, joining runs of blocks into
+// one copy
+type encoder struct {
+	w     *bufio.Writer
+	stats *Stats
+	start int // first block of the pending copy
+	count int // blocks of the pending copy, none when 0
+	tmp   [1 + 2*binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) header(blockSize int) error {
+	if _, err := e.w.WriteString(magic); err != nil {
+		return err
+	}
+	_, err := e.w.Write(binary.AppendUvarint(e.tmp[:0], uint64(blockSize)))
+	return err
+}
+
+func (e *encoder) copy(block, size int) error {
+	e.stats.Copied += int64(size)
+	if e.count > 0 && e.start+e.count == block {
+		e.count++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.start, e.count = block, 1
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.count == 0 {
+		return nil
+	}
+	op := append(e.tmp[:0], opCopy)
+	op = binary.AppendUvarint(op, uint64(e.start))
+	op = binary.AppendUvarint(op, uint64(e.count))
+	e.count = 0
+	_, err := e.w.Write(op)
+	return err
+}
+
+func (e *encoder) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.stats.Literal += int64(len(data))
+	op := binary.AppendUvarint(append(e.tmp[:0], opLiteral), uint64(len(data)))
+	if _, err := e.w.Write(op); err != nil {
+		return err
+	}
+	_, err := e.w.Write(data)
+	return err
+}
+
+func (e *encoder) end() error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	if err := e.w.WriteByte(opEnd); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// Apply writes the content a delta describes, taking the blocks it copies
+// from base, which holds size bytes, and returns the bytes written. The
+// content must be exactly target bytes: a delta giving more fails with
+// ErrCorrupt before writing them, as does one ending short of target.
+func Apply(base io.ReaderAt, size int64, delta io.Reader, w io.Writer, target int64) (int64, error) {
+	r := bufio.NewReader(delta)
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != magic {
+		return 0, fmt.Errorf("%w: bad header", ErrCorrupt)
+	}
+	blockSize, err := binary.ReadUvarint(r)
+	if err != nil || blockSize == 0 || blockSize > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: bad block size", ErrCorrupt)
+	}
+	blocks := (uint64(size) + blockSize - 1) / blockSize
+
+	var written int64
+	overflows := func(length uint64) bool {
+		return length > uint64(target-written)
+	}
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return written, fmt.Errorf("%w: truncated", ErrCorrupt)
+		}
+		switch op {
+		case opCopy:
+			start, err1 := binary.ReadUvarint(r)
+			count, err2 := binary.ReadUvarint(r)
+			if err := errors.Join(err1, err2); err != nil {
+				return written, fmt.Errorf("%w: truncated", ErrCorrupt)
+			}
+			if count == 0 || start >= blocks || count > blocks-start {
+				return written, fmt.Errorf("%w: copy of blocks outside the base", ErrCorrupt)
+			}
+			offset := start * blockSize
+			length := min(count*blockSize, uint64(size)-offset)
+			if overflows(length) {
+				return written, fmt.Errorf("%w: content exceeds %d bytes", ErrCorrupt, target)
+			}
+			n, err := io.Copy(w, io.NewSectionReader(base, int64(offset), int64(length)))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		case opLiteral:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > maxLiteral {
+				return written, fmt.Errorf("%w: bad literal", ErrCorrupt)
+			}
+			if overflows(length) {
+				return written, fmt.Errorf("%w: content exceeds %d bytes", ErrCorrupt, target)
+			}
+			n, err := io.CopyN(w, r, int64(length))
+			written += n
+			if errors.Is(err, io.EOF) {
+				return written, fmt.Errorf("%w: truncated", ErrCorrupt)
+			}
+			if err != nil {
+				return written, err
+			}
+		case opEnd:
+			if written != target {
+				return written, fmt.Errorf("%w: content of %d bytes, not %d", ErrCorrupt, written, target)
+			}
+			return written, nil
+		default:
+			return written, fmt.Errorf("%w: unknown operation %q", ErrCorrupt, op)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDiffApply(t *testing.T) {
+	base := []byte(strings.Repeat("0123456789abcdef", 1000))
+	changed := append(append([]byte("new start "), base[:8000]...), []byte(" inserted ")...)
+	changed = append(changed, base[8000:]...)
+
+	sig, err := Sign(bytes.NewReader(base), MinBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patch bytes.Buffer
+	stats, err := Diff(sig, bytes.NewReader(changed), &patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied == 0 || stats.Literal >= int64(len(changed)) {
+		t.Errorf("delta copies %d and sends %d bytes", stats.Copied, stats.Literal)
+	}
+
+	var out bytes.Buffer
+	n, err := Apply(bytes.NewReader(base), int64(len(base)), bytes.NewReader(patch.Bytes()), &out, int64(len(changed)))
+	if err != nil {
+		t.Fatalf("failed to apply the delta: %v", err)
+	}
+	if n != int64(len(changed)) || !bytes.Equal(out.Bytes(), changed) {
+		t.Errorf("delta gave %d bytes differing from the changed file", n)
+	}
+
+	// The declared size must be the size of the content
+	for _, target := range []int64{int64(len(changed)) - 1, int64(len(changed)) + 1} {
+		if _, err := Apply(bytes.NewReader(base), int64(len(base)), bytes.NewReader(patch.Bytes()), io.Discard, target); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("applying to %d bytes gave %v, want %v", target, err, ErrCorrupt)
+		}
+	}
+}
+
+// A few bytes of repeated copies cannot expand beyond the declared size
+func TestApplyStopsAtTarget(t *testing.T) {
+	base := bytes.Repeat([]byte{'x'}, MinBlockSize)
+	patch := binary.AppendUvarint([]byte(magic), MinBlockSize)
+	for i := 0; i < 10000; i++ {
+		patch = binary.AppendUvarint(binary.AppendUvarint(append(patch, opCopy), 0), 1)
+	}
+	patch = append(patch, opEnd)
+
+	var out bytes.Buffer
+	_, err := Apply(bytes.NewReader(base), int64(len(base)), bytes.NewReader(patch), &out, 3*MinBlockSize)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("applying the delta gave %v, want %v", err, ErrCorrupt)
+	}
+	if out.Len() > 3*MinBlockSize {
+		t.Errorf("delta wrote %d bytes beyond its declared size", out.Len())
+	}
+}
@@ -0,0 +1,53 @@
+// Package event reports the progress of library operations to the
+// application embedding them.
+package event
+
+// FileStored describes a file copied into storage
+type FileStored struct {
+	Name      string // source file as given to the operation
+	StorageID string
+	Path      string // blob inside the storage directory
+	Bytes     int64
+}
+
+// DuplicateFound describes a file whose content is already present. Op is
+// "store" when the existing blob is reused and "deduplicate" when the file
+// is about to be deleted.
+type DuplicateFound struct {
+	Op       string
+	Name     string
+	Original string // blob or earlier file holding the same content
+	Bytes    int64
+}
+
+// BackupProgress is sent after each file written to a backup archive
+type BackupProgress struct {
+	Name  string // entry name within the archive
+	Files int    // files written so far, including this one
+	Bytes int64  // file bytes written so far, before compression
+}
+
+// Error describes a problem that did not stop the operation, such as a
+// cleanup step that failed or a file that was skipped
+type Error struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+// Observer receives events from running operations. Operations that use
+// several workers may call it concurrently.
+type Observer interface {
+	OnFileStored(FileStored)
+	OnDuplicateFound(DuplicateFound)
+	OnBackupProgress(BackupProgress)
+	OnError(Error)
+}
+
+// Discard is an Observer that ignores every event
+type Discard struct{}
+
+func (Discard) OnFileStored(FileStored)         {}
+func (Discard) OnDuplicateFound(DuplicateFound) {}
+func (Discard) OnBackupProgress(BackupProgress) {}
+func (Discard) OnError(Error)                   {}
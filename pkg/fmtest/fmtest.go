@@ -0,0 +1,102 @@
+// Package fmtest helps test code built on this module: an in-memory
+// repository, event recording, sample file trees and golden files,
+// including archives written by earlier versions of the backup format.
+package fmtest
+
+import (
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"sync"
+	"testing"
+)
+
+// Repo is a repository living entirely in memory
+type Repo struct {
+	DB      *db.DB
+	Backend *store.Memory
+	Store   *store.Store
+	Options fsutil.Options
+	Events  *Recorder
+}
+
+// NewRepo creates an empty in-memory repository using algorithm, or
+// SHA-256 when it is zero. It is closed when the test finishes.
+func NewRepo(tb testing.TB, algorithm hash.Algorithm) *Repo {
+	tb.Helper()
+	if algorithm.Name == "" {
+		algorithm = hash.Default()
+	}
+
+	cfg := db.DefaultConfig()
+	cfg.DSN = db.MemoryDSN
+	metadata, err := db.Open(cfg, "")
+	if err != nil {
+		tb.Fatalf("failed to open in-memory database: %v", err)
+	}
+	tb.Cleanup(func() {
+		if err := metadata.Close(); err != nil {
+			tb.Errorf("failed to close in-memory database: %v", err)
+		}
+	})
+	if err := db.Migrate(context.Background(), metadata); err != nil {
+		tb.Fatalf("failed to migrate in-memory database: %v", err)
+	}
+	if err := db.SetSetting(context.Background(), metadata, db.HashAlgorithmSetting, algorithm.Name); err != nil {
+		tb.Fatalf("failed to record hash algorithm: %v", err)
+	}
+
+	events := &Recorder{}
+	opts := fsutil.Options{Observer: events}
+	backend := store.NewMemory()
+	return &Repo{
+		DB:      metadata,
+		Backend: backend,
+		Store:   store.New(backend, metadata, algorithm, opts),
+		Options: opts,
+		Events:  events,
+	}
+}
+
+// Recorder is an event.Observer that keeps every event it receives
+type Recorder struct {
+	mu         sync.Mutex
+	Stored     []event.FileStored
+	Duplicates []event.DuplicateFound
+	Progress   []event.BackupProgress
+	Errors     []event.Error
+}
+
+func (r *Recorder) OnFileStored(e event.FileStored) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stored = append(r.Stored, e)
+}
+
+func (r *Recorder) OnDuplicateFound(e event.DuplicateFound) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Duplicates = append(r.Duplicates, e)
+}
+
+func (r *Recorder) OnBackupProgress(e event.BackupProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Progress = append(r.Progress, e)
+}
+
+func (r *Recorder) OnError(e event.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, e)
+}
+
+// Reset forgets the events received so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stored, r.Duplicates, r.Progress, r.Errors = nil, nil, nil, nil
+}
@@ -0,0 +1,140 @@
+package fmtest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// UpdateEnv names the environment variable that makes Golden rewrite
+// golden files instead of comparing against them
+const UpdateEnv = "FM_UPDATE_GOLDEN"
+
+// FixedTime is the modification time of fixture files, so that archives
+// built from them are reproducible
+var FixedTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SampleFiles is a small tree with nested directories, a duplicate and an
+// empty file
+var SampleFiles = map[string]string{
+	"a.txt":         "alpha\n",
+	"empty.txt":     "",
+	"dir/b.txt":     "bravo\n",
+	"dir/sub/c.txt": "alpha\n",
+}
+
+//go:embed testdata
+var testdata embed.FS
+
+// Fixture builds an in-memory file system holding files, keyed by slash
+// separated name, all modified at FixedTime
+func Fixture(tb testing.TB, files map[string]string) *fsutil.MemFS {
+	tb.Helper()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fsys := fsutil.NewMemFS()
+	for _, name := range names {
+		if dir := path.Dir(name); dir != "." {
+			if err := fsys.MkdirAll(dir, 0o755); err != nil {
+				tb.Fatalf("failed to create fixture directory %s: %v", dir, err)
+			}
+		}
+		w, err := fsys.Create(name, 0o644)
+		if err != nil {
+			tb.Fatalf("failed to create fixture file %s: %v", name, err)
+		}
+		if _, err := io.WriteString(w, files[name]); err != nil {
+			tb.Fatalf("failed to write fixture file %s: %v", name, err)
+		}
+		if err := w.Close(); err != nil {
+			tb.Fatalf("failed to write fixture file %s: %v", name, err)
+		}
+		if err := fsys.Chtimes(name, FixedTime); err != nil {
+			tb.Fatalf("failed to date fixture file %s: %v", name, err)
+		}
+	}
+	return fsys
+}
+
+// ArchiveListing describes every entry of a tar.gz archive on one line:
+// type, mode, size, SHA-256 of the contents and name. Unlike the
+// compressed bytes, listings do not change between Go releases.
+func ArchiveListing(tb testing.TB, r io.Reader) string {
+	tb.Helper()
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		tb.Fatalf("failed to read archive: %v", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	var b strings.Builder
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			tb.Fatalf("failed to read archive: %v", err)
+		}
+		sum := sha256.New()
+		if _, err := io.Copy(sum, tarReader); err != nil {
+			tb.Fatalf("failed to read archive entry %s: %v", header.Name, err)
+		}
+		fmt.Fprintf(&b, "%c %04o %8d %x %s\n", header.Typeflag, header.Mode&0o7777, header.Size, sum.Sum(nil), header.Name)
+	}
+	return b.String()
+}
+
+// Golden compares got with the golden file at path, relative to the
+// directory of the package under test. With FM_UPDATE_GOLDEN=1 in the
+// environment the file is rewritten instead.
+func Golden(tb testing.TB, path string, got []byte) {
+	tb.Helper()
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			tb.Fatalf("failed to create golden directory: %v", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			tb.Fatalf("failed to update golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("failed to read golden file (set %s=1 to create it): %v", UpdateEnv, err)
+	}
+	if !bytes.Equal(got, want) {
+		tb.Errorf("%s differs from the output:\n--- want\n%s\n--- got\n%s", path, want, got)
+	}
+}
+
+// GoldenArchive returns a file from this package's testdata. The archives
+// there were written by earlier versions and must stay readable:
+// sample-v1.tar.gz holds SampleFiles as written by archive.BackupFS, and
+// sample-v1.listing is its ArchiveListing.
+func GoldenArchive(tb testing.TB, name string) []byte {
+	tb.Helper()
+	data, err := testdata.ReadFile("testdata/" + name)
+	if err != nil {
+		tb.Fatalf("no golden archive %s: %v", name, err)
+	}
+	return data
+}
@@ -0,0 +1,60 @@
+package fmtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// HugeSize is a file size past the 8 GiB limit of the ustar format, which
+// archives only hold in PAX headers
+const HugeSize = 9 << 30
+
+// SparseFile creates a file of size bytes under dir that takes almost no
+// disk space: it holds the marker at its start and end, its name, and
+// zeros in between. It is modified at FixedTime.
+func SparseFile(tb testing.TB, dir, name string, size int64) string {
+	tb.Helper()
+	marker := []byte(name)
+	if size < 2*int64(len(marker)) {
+		tb.Fatalf("sparse file %s of %d bytes is too small for its markers", name, size)
+	}
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		tb.Fatalf("failed to create directory for %s: %v", name, err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatalf("failed to create sparse file %s: %v", name, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if err := file.Truncate(size); err != nil {
+		tb.Fatalf("failed to size sparse file %s: %v", name, err)
+	}
+	if _, err := file.WriteAt(marker, 0); err != nil {
+		tb.Fatalf("failed to write sparse file %s: %v", name, err)
+	}
+	if _, err := file.WriteAt(marker, size-int64(len(marker))); err != nil {
+		tb.Fatalf("failed to write sparse file %s: %v", name, err)
+	}
+	if err := os.Chtimes(path, FixedTime, FixedTime); err != nil {
+		tb.Fatalf("failed to date sparse file %s: %v", name, err)
+	}
+	return path
+}
+
+// LongName returns a slash-separated file name of at least n bytes, nested
+// in directories of at most 50 bytes each, as names over 100 bytes only fit
+// archives in PAX headers
+func LongName(n int) string {
+	var parts []string
+	for length := 0; length < n; length += 51 {
+		parts = append(parts, fmt.Sprintf("%02d-%s", len(parts), strings.Repeat("d", 47)))
+	}
+	parts[len(parts)-1] += ".txt"
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request
+const ficlone = 0x40049409
+
+// Clone the file with the FICLONE ioctl
+func clone(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.ENOTTY, syscall.EXDEV, syscall.EINVAL, syscall.ENOSYS, syscall.EPERM:
+		return errors.ErrUnsupported
+	default:
+		return &os.PathError{Op: "clone", Path: dst.Name(), Err: errno}
+	}
+}
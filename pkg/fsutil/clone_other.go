@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+)
+
+// Files are only cloned on Linux, as the clonefile call of macOS needs
+// cgo or a system call package
+func clone(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
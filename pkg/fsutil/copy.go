@@ -0,0 +1,90 @@
+package fsutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// copyBufferSize is the size of the buffers Copy reuses, large enough
+	// that multi-gigabyte copies make few system calls
+	copyBufferSize = 256 << 10
+
+	// fileChunkSize is how much Copy hands the kernel at once between
+	// files, checking the context in between
+	fileChunkSize = 64 << 20
+)
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// Copy copies src to dst like io.Copy, stopping when ctx is cancelled and
+// waiting while it is paused. Between two files the kernel copies the data
+// itself where it can, such as with copy_file_range on Linux; otherwise the
+// data passes through a pooled buffer.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	if dstFile, ok := dst.(*os.File); ok {
+		if srcFile, ok := src.(*os.File); ok {
+			return copyFileChunks(ctx, dstFile, srcFile)
+		}
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hiding io.ReaderFrom keeps *os.File from copying through a small
+	// buffer of its own
+	return io.CopyBuffer(struct{ io.Writer }{dst}, ContextReader(ctx, src), *buf)
+}
+
+// Copy src to dst in chunks the kernel copies directly
+func copyFileChunks(ctx context.Context, dst, src *os.File) (int64, error) {
+	var written int64
+	for {
+		if err := Checkpoint(ctx); err != nil {
+			return written, err
+		}
+		// A limited *os.File lets ReadFrom use copy_file_range or sendfile
+		n, err := dst.ReadFrom(io.LimitReader(src, fileChunkSize))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n < fileChunkSize {
+			return written, nil
+		}
+	}
+}
+
+// Copy copies src to dst like Copy, throttled by the configured rate limit
+func (o Options) Copy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return Copy(ctx, o.Writer(ctx, dst), src)
+}
+
+// Preallocate reserves size bytes for a file about to be written, so that
+// it is laid out contiguously and a full disk fails the write up front.
+// Files a copy turns out shorter are cut to size by TrimPreallocated.
+func Preallocate(file *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := preallocate(file, size)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	return err
+}
+
+// TrimPreallocated cuts a preallocated file down to the written bytes when
+// the copy was shorter than preallocated
+func TrimPreallocated(file *os.File, written, preallocated int64) error {
+	if written >= preallocated {
+		return nil
+	}
+	return file.Truncate(written)
+}
@@ -0,0 +1,47 @@
+package fsutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchSize is the data each iteration of a benchmark copies
+const benchSize = 4 << 20
+
+func benchData() []byte {
+	data := make([]byte, benchSize)
+	_, _ = rand.NewChaCha8([32]byte{}).Read(data)
+	return data
+}
+
+func BenchmarkCopy(b *testing.B) {
+	data := benchData()
+	b.SetBytes(benchSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := Copy(context.Background(), io.Discard, bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	dir := b.TempDir()
+	source := filepath.Join(dir, "source")
+	if err := os.WriteFile(source, benchData(), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	dest := filepath.Join(dir, "copy")
+	b.SetBytes(benchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = os.Remove(dest)
+		if err := (Options{}).CopyFile(context.Background(), source, dest); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Names of the device profiles
+const (
+	ProfileAuto = "auto"
+	ProfileHDD  = "hdd"
+	ProfileSSD  = "ssd"
+)
+
+// Profile sets how many files are read and written at once, to suit the
+// storage they live on: spinning disks slow down when several readers
+// make them seek back and forth, while SSDs and NVMe drives only reach
+// their speed with many requests in flight
+type Profile struct {
+	Name    string
+	Workers int // files read and written at once
+}
+
+// ProfileNames returns the names ResolveProfile accepts
+func ProfileNames() []string {
+	return []string{ProfileAuto, ProfileHDD, ProfileSSD}
+}
+
+// ResolveProfile returns the named profile. The auto profile picks hdd
+// when any of paths is on a rotational disk, ssd when all are known to be
+// on solid-state ones, and otherwise one worker per CPU.
+func ResolveProfile(name string, paths ...string) (Profile, error) {
+	switch strings.ToLower(name) {
+	case ProfileHDD:
+		return Profile{Name: ProfileHDD, Workers: 1}, nil
+	case ProfileSSD:
+		return Profile{Name: ProfileSSD, Workers: max(4, 2*runtime.NumCPU())}, nil
+	case ProfileAuto, "":
+	default:
+		return Profile{}, fmt.Errorf("unsupported profile %q (use %s)", name, strings.Join(ProfileNames(), ", "))
+	}
+
+	solid := len(paths) > 0
+	for _, path := range paths {
+		rotational, known := Rotational(path)
+		if known && rotational {
+			return ResolveProfile(ProfileHDD)
+		}
+		solid = solid && known
+	}
+	if solid {
+		return ResolveProfile(ProfileSSD)
+	}
+	return Profile{Name: ProfileAuto, Workers: runtime.NumCPU()}, nil
+}
+
+// Rotational reports whether path, or the nearest existing directory
+// above it, is on a spinning disk, and whether the system could tell
+func Rotational(path string) (bool, bool) {
+	return isRotational(existingParent(path))
+}
+
+// Return path or, when it does not exist yet, its nearest existing parent
+func existingParent(path string) string {
+	path, _ = filepath.Abs(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package fsutil
+
+// Only Linux tells whether a disk is rotational without extra tools
+func isRotational(path string) (bool, bool) {
+	return false, false
+}
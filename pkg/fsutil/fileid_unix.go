@@ -0,0 +1,17 @@
+//go:build !windows
+
+package fsutil
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// FileID returns the inode of a file, which changes when the file is
+// replaced rather than written in place
+func FileID(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
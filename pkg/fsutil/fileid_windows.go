@@ -0,0 +1,14 @@
+//go:build windows
+
+package fsutil
+
+import (
+	"io/fs"
+)
+
+// FileID returns the inode of a file, which changes when the file is
+// replaced rather than written in place. Windows only reports file indexes
+// through an open handle, so it is 0 there.
+func FileID(info fs.FileInfo) uint64 {
+	return 0
+}
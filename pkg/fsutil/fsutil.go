@@ -0,0 +1,184 @@
+// Package fsutil holds the file writing helpers shared by the store and
+// archive packages.
+package fsutil
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/ratelimit"
+	"github.com/Lenstack/file_manager_version/pkg/retry"
+	"io"
+	"os"
+	"runtime"
+)
+
+// Options control how file contents are copied and persisted
+type Options struct {
+	// Limiter throttles streaming reads and writes; nil means unlimited
+	Limiter *ratelimit.Limiter
+
+	// Durable makes every written file and its parent directory get
+	// fsynced before an operation reports success
+	Durable bool
+
+	// Paranoid re-hashes every file instead of trusting the digests cached
+	// for files whose size, modification time and inode are unchanged
+	Paranoid bool
+
+	// Observer receives the events of operations using these options; nil
+	// discards them
+	Observer event.Observer
+
+	// ErrorsFatal makes directory walks fail at the first directory they
+	// cannot read instead of skipping it; see SkipUnreadable
+	ErrorsFatal bool
+
+	// FailFast makes operations over many files fail at the first file
+	// they cannot process instead of reporting it at the end; see
+	// SkipFailed. It implies ErrorsFatal.
+	FailFast bool
+
+	// Retry is how storage backends retry reads and writes failing with
+	// transient errors; the zero Policy tries them once
+	Retry retry.Policy
+
+	// Admit decides whether store and backup operations take the named
+	// file of the given size, returning why not; nil takes every file
+	Admit func(ctx context.Context, op, name string, size int64) error
+}
+
+// Events returns the configured observer, or one discarding every event
+func (o Options) Events() event.Observer {
+	if o.Observer == nil {
+		return event.Discard{}
+	}
+	return o.Observer
+}
+
+// Admits runs the configured Admit check on a file
+func (o Options) Admits(ctx context.Context, op, name string, size int64) error {
+	if o.Admit == nil {
+		return nil
+	}
+	return o.Admit(ctx, op, name, size)
+}
+
+// Reader wraps r with the configured rate limit
+func (o Options) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return o.Limiter.Reader(ctx, r)
+}
+
+// Writer wraps w with the configured rate limit
+func (o Options) Writer(ctx context.Context, w io.Writer) io.Writer {
+	return o.Limiter.Writer(ctx, w)
+}
+
+// ContextReader wraps r so that reads fail with the context's error once
+// ctx is cancelled, and wait while the context is paused
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := Checkpoint(c.ctx); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// CountingWriter counts the bytes written through it to W
+type CountingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// SyncFile flushes a file to stable storage when durable writes are enabled
+func (o Options) SyncFile(file *os.File) error {
+	if !o.Durable {
+		return nil
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", file.Name(), err)
+	}
+	return nil
+}
+
+// SyncDir flushes a directory entry list to stable storage when durable
+// writes are enabled, so that newly created or renamed files survive a
+// power loss
+func (o Options) SyncDir(path string) error {
+	if !o.Durable || runtime.GOOS == "windows" {
+		// Windows cannot open directories for syncing; NTFS journals metadata itself
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s for sync: %w", path, err)
+	}
+	defer func(dir *os.File) {
+		if err := dir.Close(); err != nil {
+			o.Events().OnError(event.Error{Op: "sync", Name: path, Err: fmt.Errorf("failed to close directory: %w", err)})
+		}
+	}(dir)
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", path, err)
+	}
+	return nil
+}
+
+// CopyFile copies src to dest, which must not exist yet. A cancelled copy
+// removes dest again.
+func (o Options) CopyFile(ctx context.Context, src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func(srcFile *os.File) {
+		if err := srcFile.Close(); err != nil {
+			o.Events().OnError(event.Error{Op: "copy", Name: src, Err: fmt.Errorf("failed to close source file: %w", err)})
+		}
+	}(srcFile)
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %w", err)
+	}
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+
+	err = Preallocate(destFile, info.Size())
+	if err == nil {
+		var n int64
+		n, err = o.Copy(ctx, destFile, srcFile)
+		if err == nil {
+			err = TrimPreallocated(destFile, n, info.Size())
+		}
+	}
+	if err != nil {
+		_ = destFile.Close()
+		_ = os.Remove(dest)
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := o.SyncFile(destFile); err != nil {
+		_ = destFile.Close()
+		_ = os.Remove(dest)
+		return err
+	}
+	return destFile.Close()
+}
@@ -0,0 +1,42 @@
+package fsutil
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchGlob reports whether the slash-separated name matches pattern. The
+// pattern has the syntax of path.Match per path element, and an element **
+// matches any number of elements, none included, so invoices/2024/**
+// matches every file below invoices/2024.
+func MatchGlob(pattern, name string) (bool, error) {
+	elements := strings.Split(pattern, "/")
+	for _, element := range elements {
+		if _, err := path.Match(element, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchElements(elements, strings.Split(name, "/")), nil
+}
+
+// Match the elements of a name against those of a valid pattern
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := range len(name) + 1 {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
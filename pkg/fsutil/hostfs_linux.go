@@ -0,0 +1,108 @@
+//go:build linux
+
+package fsutil
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// The file system of a host directory, which reads the names too long for
+// a single system call, past PATH_MAX, one directory at a time
+func hostFS(dir string) fs.FS {
+	return longFS{FS: os.DirFS(dir), dir: dir}
+}
+
+// Limits of Linux on the length of a path and of each name in it
+const (
+	pathMax = 4096
+	nameMax = 255
+)
+
+// longFS is os.DirFS falling back to openat when a name is too long
+type longFS struct {
+	fs.FS
+	dir string
+}
+
+func (l longFS) Open(name string) (fs.File, error) {
+	file, err := l.FS.Open(name)
+	if errors.Is(err, syscall.ENAMETOOLONG) {
+		return l.openLong(name)
+	}
+	return file, err
+}
+
+func (l longFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := fs.Stat(l.FS, name)
+	if !errors.Is(err, syscall.ENAMETOOLONG) {
+		return info, err
+	}
+	file, err := l.openLong(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return file.Stat()
+}
+
+func (l longFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	// The entries of os.ReadDir stat their full path when asked for their
+	// info, which fails once the names in the directory make it too long
+	if len(l.dir)+len(name)+nameMax+2 < pathMax {
+		return fs.ReadDir(l.FS, name)
+	}
+	file, err := l.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	dir, ok := file.(*os.File)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.ErrUnsupported}
+	}
+	// Readdir stats entries relative to the directory, so that their names
+	// never get too long, where the entries of ReadDir stat full paths
+	infos, err := dir.Readdir(-1)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+// Open name by opening each directory leading to it relative to the one
+// before, following symbolic links like os.DirFS does
+func (l longFS) openLong(name string) (*os.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	fd, err := syscall.Open(l.dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		flags := syscall.O_RDONLY | syscall.O_CLOEXEC
+		if i < len(parts)-1 {
+			flags |= syscall.O_DIRECTORY
+		}
+		next, err := syscall.Openat(fd, part, flags, 0)
+		_ = syscall.Close(fd)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		fd = next
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(l.dir, name)), nil
+}
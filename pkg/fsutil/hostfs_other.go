@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fsutil
+
+import (
+	"io/fs"
+	"os"
+)
+
+// The file system of a host directory. Windows reads long names through
+// the \\?\ form instead, and other platforms are left to their limits.
+func hostFS(dir string) fs.FS {
+	return os.DirFS(dir)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package fsutil
+
+// LongPath returns path unchanged; only Windows limits path length
+func LongPath(path string) string {
+	return path
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package fsutil
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// LongPath returns path in the absolute \\?\ form, which lifts the
+// MAX_PATH limit for it and for every path joined to it. The \\?\ form
+// must only be joined with filepath, never with slashes.
+func LongPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,17 @@
+package fsutil
+
+import "golang.org/x/text/unicode/norm"
+
+// NormalizeName returns name in Unicode normalization form C, the form
+// Linux and Windows tools produce, so that a name read from macOS, whose
+// file systems hand out decomposed names, compares equal to the same name
+// read elsewhere
+func NormalizeName(name string) string {
+	return norm.NFC.String(name)
+}
+
+// HostName returns name in the normalization form files are created with
+// on this platform
+func HostName(name string) string {
+	return hostForm.String(name)
+}
@@ -0,0 +1,8 @@
+//go:build darwin
+
+package fsutil
+
+import "golang.org/x/text/unicode/norm"
+
+// Names are decomposed on macOS, as HFS+ stores them and Finder expects
+var hostForm = norm.NFD
@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package fsutil
+
+import "golang.org/x/text/unicode/norm"
+
+// Names are composed everywhere but macOS
+var hostForm = norm.NFC
@@ -0,0 +1,93 @@
+package fsutil
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Pause holds the operations whose context carries it at their next
+// checkpoint while it is paused. The zero value is running.
+type Pause struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed by Resume; nil while running
+}
+
+// Pause holds operations, reporting whether they were running
+func (p *Pause) Pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// Resume lets held operations continue, reporting whether they were paused
+func (p *Pause) Resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		return false
+	}
+	close(p.resumed)
+	p.resumed = nil
+	return true
+}
+
+// Toggle pauses running operations or resumes paused ones, reporting
+// whether they are now paused
+func (p *Pause) Toggle() bool {
+	if p.Pause() {
+		return true
+	}
+	p.Resume()
+	return false
+}
+
+// Paused reports whether operations are held
+func (p *Pause) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// Return the channel closed on resume, or nil while running
+func (p *Pause) waiting() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed
+}
+
+// pauseKey is the context key of the pauses holding an operation
+type pauseKey struct{}
+
+// WithPause returns a context whose operations are also held while p is
+// paused
+func WithPause(ctx context.Context, p *Pause) context.Context {
+	pauses, _ := ctx.Value(pauseKey{}).([]*Pause)
+	return context.WithValue(ctx, pauseKey{}, append(slices.Clip(pauses), p))
+}
+
+// Checkpoint waits while a pause of ctx is paused, then returns the
+// context's error. Operations call it where they can stop.
+func Checkpoint(ctx context.Context) error {
+	pauses, _ := ctx.Value(pauseKey{}).([]*Pause)
+	for waited := true; waited; {
+		waited = false
+		for _, p := range pauses {
+			resumed := p.waiting()
+			if resumed == nil {
+				continue
+			}
+			waited = true
+			select {
+			case <-resumed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return ctx.Err()
+}
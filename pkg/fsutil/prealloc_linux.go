@@ -0,0 +1,18 @@
+//go:build linux
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Allocate the blocks of the file with fallocate
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
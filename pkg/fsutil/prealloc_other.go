@@ -0,0 +1,13 @@
+//go:build !linux
+
+package fsutil
+
+import (
+	"os"
+)
+
+// Extend the file to its final size, which file systems such as NTFS
+// allocate right away
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,9 @@
+//go:build darwin
+
+package fsutil
+
+// Whence values of lseek that find data and holes
+const (
+	seekHole = 3
+	seekData = 4
+)
@@ -0,0 +1,9 @@
+//go:build linux || freebsd
+
+package fsutil
+
+// Whence values of lseek that find data and holes
+const (
+	seekData = 3
+	seekHole = 4
+)
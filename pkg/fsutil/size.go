@@ -0,0 +1,62 @@
+package fsutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a size such as "512K", "10M", "10GB" or "1T" into
+// bytes. Sizes that are not a whole number of bytes, such as 0.5, are
+// invalid.
+func ParseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.TrimSpace(strings.ToUpper(value)), "B")
+	if number == "" {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	multiplier := float64(1)
+	switch number[len(number)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	case 'T':
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+
+	parsed, err := strconv.ParseFloat(number, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid size %q: use a number of bytes with an optional K, M, G or T suffix", value)
+	}
+	size := parsed * multiplier
+	if size >= 1<<63 {
+		return 0, fmt.Errorf("invalid size %q: too large", value)
+	}
+	if size != float64(int64(size)) {
+		return 0, fmt.Errorf("invalid size %q: not a whole number of bytes", value)
+	}
+	return int64(size), nil
+}
+
+// ParseRate parses a rate such as "512K", "10M/s" or "1G" into bytes per
+// second, written as a size with an optional "/s" suffix
+func ParseRate(value string) (int64, error) {
+	size := strings.TrimSpace(value)
+	if trimmed, ok := strings.CutSuffix(strings.ToLower(size), "/s"); ok {
+		size = size[:len(trimmed)]
+	}
+	rate, err := ParseSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %w", value, err)
+	}
+	if rate < 1 {
+		return 0, fmt.Errorf("invalid rate %q: must be at least 1 byte per second", value)
+	}
+	return rate, nil
+}
@@ -0,0 +1,95 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// sparseBlock is the size of the zero runs SparseWriter turns into holes,
+// the block size of common file systems
+const sparseBlock = 4096
+
+var zeroBlock [sparseBlock]byte
+
+// Region is a run of data in a sparse file; the rest of the file reads as
+// zeros without taking disk space
+type Region struct {
+	Offset int64
+	Length int64
+}
+
+// DataRegions returns where a file of the given size holds data, asking
+// the file system for its holes. It reports the file as not sparse when it
+// has no holes or the system cannot tell. The file is left positioned at
+// its start.
+func DataRegions(file *os.File, size int64) (regions []Region, sparse bool, err error) {
+	if size == 0 {
+		return nil, false, nil
+	}
+	regions, err = dataRegions(file, size)
+	if _, seekErr := file.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil || regions == nil {
+		return nil, false, err
+	}
+	if len(regions) == 1 && regions[0] == (Region{Length: size}) {
+		return nil, false, nil
+	}
+	return regions, true, nil
+}
+
+// IsSparse reports whether the file at path has holes
+func IsSparse(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	_, sparse, _ := DataRegions(file, info.Size())
+	return sparse
+}
+
+// SparseWriter writes to an empty file, leaving holes where whole aligned
+// blocks are zeros instead of writing them. Finish sets the file's final
+// size, which a trailing hole does not.
+type SparseWriter struct {
+	file   *os.File
+	offset int64
+}
+
+// NewSparseWriter creates a writer filling file from its start
+func NewSparseWriter(file *os.File) *SparseWriter {
+	return &SparseWriter{file: file}
+}
+
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	start := 0 // of the data not written yet
+	for i := 0; i < len(p); {
+		n := min(len(p)-i, sparseBlock-int((w.offset+int64(i))%sparseBlock))
+		if n == sparseBlock && bytes.Equal(p[i:i+n], zeroBlock[:]) {
+			if _, err := w.file.WriteAt(p[start:i], w.offset+int64(start)); err != nil {
+				return start, err
+			}
+			start = i + n
+		}
+		i += n
+	}
+	if _, err := w.file.WriteAt(p[start:], w.offset+int64(start)); err != nil {
+		return start, err
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// Finish extends the file over a trailing hole
+func (w *SparseWriter) Finish() error {
+	return w.file.Truncate(w.offset)
+}
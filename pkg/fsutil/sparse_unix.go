@@ -0,0 +1,38 @@
+//go:build linux || darwin || freebsd
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// List the data regions of a file with SEEK_DATA and SEEK_HOLE, or return
+// nil when the file system does not support them
+func dataRegions(file *os.File, size int64) ([]Region, error) {
+	regions := []Region{}
+	for offset := int64(0); offset < size; {
+		data, err := file.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole follows
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := file.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		if hole > data {
+			regions = append(regions, Region{Offset: data, Length: hole - data})
+		}
+		offset = hole
+	}
+	return regions, nil
+}
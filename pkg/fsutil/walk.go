@@ -0,0 +1,44 @@
+package fsutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"io/fs"
+)
+
+// SkipUnreadable wraps a function for fs.WalkDir so that the parts of the
+// tree the walk cannot read, such as directories without permission and
+// names too long for the platform, are skipped instead of failing the
+// walk. Each is reported to the observer as an error of op and passed to
+// skipped, which may be nil. The root failing still fails the walk, as
+// does any error with ErrorsFatal or FailFast set.
+func (o Options) SkipUnreadable(op, root string, skipped func(name string, err error), fn fs.WalkDirFunc) fs.WalkDirFunc {
+	return func(name string, entry fs.DirEntry, err error) error {
+		if err == nil || o.ErrorsFatal || o.FailFast || name == root || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return fn(name, entry, err)
+		}
+		o.Events().OnError(event.Error{Op: op, Name: name, Err: fmt.Errorf("skipped as unreadable: %w", err)})
+		if skipped != nil {
+			skipped(name, err)
+		}
+		if entry != nil && entry.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	}
+}
+
+// SkipFailed reports a file an operation could not process and returns
+// nil, so that the operation goes on with the next file, recording err in
+// failed for the report at its end. With FailFast set, or when err comes
+// from cancelling the operation, err is returned as it is instead.
+func (o Options) SkipFailed(op, name string, err error, failed *[]string) error {
+	if o.FailFast || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	o.Events().OnError(event.Error{Op: op, Name: name, Err: fmt.Errorf("skipped: %w", err)})
+	*failed = append(*failed, err.Error())
+	return nil
+}
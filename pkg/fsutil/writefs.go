@@ -0,0 +1,215 @@
+package fsutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+// WriteFS is a file system that can be written to as well as read. Names
+// follow the io/fs rules: slash-separated and relative to the root.
+type WriteFS interface {
+	fs.FS
+
+	// MkdirAll creates a directory and any missing parents
+	MkdirAll(name string, perm fs.FileMode) error
+
+	// Create creates or truncates a file for writing
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+
+	// Remove deletes a file or an empty directory
+	Remove(name string) error
+
+	// Chtimes sets the modification time of a file
+	Chtimes(name string, modTime time.Time) error
+}
+
+// DirFS returns a WriteFS for the directory tree rooted at dir
+func DirFS(dir string) WriteFS {
+	return dirFS{FS: HostFS(dir), dir: LongPath(dir)}
+}
+
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+// ReadDir and Stat go through the host file system, which reads long
+// names on Linux
+func (d dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(d.FS, name)
+}
+
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(d.FS, name)
+}
+
+// Resolve a file system name to a host path below the root
+func (d dirFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(name)), nil
+}
+
+func (d dirFS) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := d.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (d dirFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	p, err := d.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+}
+
+func (d dirFS) Remove(name string) error {
+	p, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d dirFS) Chtimes(name string, modTime time.Time) error {
+	p, err := d.path("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, modTime, modTime)
+}
+
+// MemFS is an in-memory WriteFS, safe for concurrent use
+type MemFS struct {
+	mu    sync.RWMutex
+	files fstest.MapFS
+}
+
+// NewMemFS creates an empty in-memory file system
+func NewMemFS() *MemFS {
+	return &MemFS{files: fstest.MapFS{}}
+}
+
+// Open opens a file or directory for reading
+func (m *MemFS) Open(name string) (fs.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Files are copied so that later writes do not race with the reader
+	snapshot := make(fstest.MapFS, len(m.files))
+	for key, file := range m.files {
+		copied := *file
+		snapshot[key] = &copied
+	}
+	return snapshot.Open(name)
+}
+
+// MkdirAll creates a directory and any missing parents
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := name; dir != "."; dir = path.Dir(dir) {
+		if file, ok := m.files[dir]; ok {
+			if !file.Mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+			}
+			continue
+		}
+		m.files[dir] = &fstest.MapFile{Mode: fs.ModeDir | perm.Perm(), ModTime: time.Now()}
+	}
+	return nil
+}
+
+// Create creates or truncates a file; its contents become visible on Close
+func (m *MemFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.RLock()
+	parent, ok := m.files[path.Dir(name)]
+	m.mu.RUnlock()
+	if path.Dir(name) != "." && (!ok || !parent.Mode.IsDir()) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memWriter{fs: m, name: name, perm: perm.Perm()}, nil
+}
+
+// Remove deletes a file or an empty directory
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if file.Mode.IsDir() {
+		prefix := name + "/"
+		for other := range m.files {
+			if len(other) > len(prefix) && other[:len(prefix)] == prefix {
+				return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// Chtimes sets the modification time of a file
+func (m *MemFS) Chtimes(name string, modTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	file.ModTime = modTime
+	return nil
+}
+
+// memWriter buffers a file written to a MemFS
+type memWriter struct {
+	fs   *MemFS
+	name string
+	perm fs.FileMode
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Close() error {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.fs.files[w.name] = &fstest.MapFile{Data: w.buf.Bytes(), Mode: w.perm, ModTime: time.Now()}
+	return nil
+}
+
+// HostFS returns os.DirFS for the absolute form of dir. The os package only
+// lifts the Windows MAX_PATH limit for absolute paths, so this keeps long
+// names below a relative dir readable. On Linux, names longer than PATH_MAX
+// are read one directory at a time.
+func HostFS(dir string) fs.FS {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return hostFS(dir)
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package fsutil
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Xattrs returns the extended attributes of a file, keyed by name. POSIX
+// ACLs are the system.posix_acl_access and system.posix_acl_default
+// attributes and SELinux labels security.selinux, so they come along. File
+// systems without extended attributes give none.
+func Xattrs(file *os.File) (map[string][]byte, error) {
+	names, err := xattrCall(func(buf []byte) (uintptr, syscall.Errno) {
+		n, _, errno := syscall.Syscall(syscall.SYS_FLISTXATTR, file.Fd(), uintptr(bufPtr(buf)), uintptr(len(buf)))
+		return n, errno
+	})
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: file.Name(), Err: err}
+	}
+
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		namePtr, err := syscall.BytePtrFromString(string(name))
+		if err != nil {
+			return nil, err
+		}
+		value, err := xattrCall(func(buf []byte) (uintptr, syscall.Errno) {
+			n, _, errno := syscall.Syscall6(syscall.SYS_FGETXATTR, file.Fd(), uintptr(unsafe.Pointer(namePtr)), uintptr(bufPtr(buf)), uintptr(len(buf)), 0, 0)
+			return n, errno
+		})
+		if errors.Is(err, syscall.ENODATA) {
+			// Removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr " + string(name), Path: file.Name(), Err: err}
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+// SetXattrs sets extended attributes of a file, leaving the others as they
+// are
+func SetXattrs(file *os.File, attrs map[string][]byte) error {
+	var errs []error
+	for name, value := range attrs {
+		namePtr, err := syscall.BytePtrFromString(name)
+		if err != nil {
+			return err
+		}
+		_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR, file.Fd(), uintptr(unsafe.Pointer(namePtr)), uintptr(bufPtr(value)), uintptr(len(value)), 0, 0)
+		if errno != 0 {
+			errs = append(errs, &os.PathError{Op: "setxattr " + name, Path: file.Name(), Err: errno})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Call an xattr system call filling buf, with a buffer of the size it asks
+// for, until the value stops growing between calls
+func xattrCall(call func(buf []byte) (uintptr, syscall.Errno)) ([]byte, error) {
+	for {
+		size, errno := call(nil)
+		if errno != 0 {
+			return nil, errno
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, errno := call(buf)
+		if errno == syscall.ERANGE {
+			continue
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		return buf[:n], nil
+	}
+}
+
+// Pointer to the first byte of buf, or nil when it is empty
+func bufPtr(buf []byte) unsafe.Pointer {
+	if len(buf) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&buf[0])
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package fsutil
+
+import (
+	"errors"
+	"os"
+)
+
+// Xattrs returns no extended attributes: they are only read on Linux, as
+// macOS and Windows need cgo or a system call package for them
+func Xattrs(file *os.File) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// SetXattrs sets extended attributes of a file, which only Linux supports
+func SetXattrs(file *os.File, attrs map[string][]byte) error {
+	if len(attrs) == 0 {
+		return nil
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,361 @@
+// Package graph draws the version history of a file, with its branches,
+// renames and rollbacks, as text or as a Graphviz DOT digraph.
+package graph
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A version placed in the graph of its file
+type node struct {
+	db.Version
+	lane    int
+	origin  string // name the version was stored under, or its branch
+	repeats int    // earlier version whose content it repeats, or 0
+	merge   string // branch the version merged, if any
+}
+
+// Lay out the versions of a file, oldest first, in lanes: each branch, and
+// versions stored under another name before a rename, get a lane of their
+// own while the mainline goes on beside them
+func layout(versions []db.Version, branches []db.Branch) ([]node, int) {
+	merges := map[int]string{}
+	for _, b := range branches {
+		if b.Merged > 0 {
+			merges[b.Merged] = b.Name
+		}
+	}
+	last := map[string]int{}
+	for i, v := range versions {
+		last[versionOrigin(v)] = i
+	}
+	nodes := make([]node, len(versions))
+	lanes := map[string]int{}
+	seen := map[string]int{}
+	width := 0
+	for i, v := range versions {
+		origin := versionOrigin(v)
+		lane, ok := lanes[origin]
+		if !ok {
+			lane = width
+			if i > 0 {
+				// A renamed history that ends where another begins goes on
+				// in its lane
+				if prev := nodes[i-1]; last[prev.origin] == i-1 && prev.Branch == "" && v.Branch == "" {
+					lane = prev.lane
+				}
+			}
+			lanes[origin] = lane
+			width = max(width, lane+1)
+		}
+		nodes[i] = node{Version: v, lane: lane, origin: origin, repeats: seen[v.Hash], merge: merges[v.Version]}
+		seen[v.Hash] = v.Version
+	}
+	return nodes, width
+}
+
+// A rollback of the file to an earlier version
+type rollback struct {
+	time.Time
+	target int // version rolled back to
+	after  int // index of the latest version at the time
+}
+
+// Place rollbacks after the versions that were the latest when they were
+// made, oldest first, skipping those of content no version had by then
+func placeRollbacks(nodes []node, actions []db.LoggedAction) []rollback {
+	var rollbacks []rollback
+	for _, a := range actions {
+		after := -1
+		for i, n := range nodes {
+			if !n.Timestamp.After(a.Timestamp) {
+				after = i
+			}
+		}
+		for i := after; i >= 0; i-- {
+			if store.StorageID(nodes[i].Version) == a.StorageID {
+				rollbacks = append(rollbacks, rollback{Time: a.Timestamp, target: nodes[i].Version.Version, after: after})
+				break
+			}
+		}
+	}
+	return rollbacks
+}
+
+// Return the name a version was stored under, or the branch it is on
+func versionOrigin(v db.Version) string {
+	if v.Branch != "" {
+		return "branch " + v.Branch
+	}
+	if v.OriginalName != "" {
+		return v.OriginalName
+	}
+	return v.Filename
+}
+
+// Return what the graph notes about a version
+func (n node) notes() []string {
+	var notes []string
+	if n.Branch != "" {
+		notes = append(notes, "on "+n.origin)
+	} else if n.origin != n.Filename {
+		notes = append(notes, "from "+n.origin)
+	}
+	if n.merge != "" {
+		notes = append(notes, "merge of branch "+n.merge)
+	}
+	if n.repeats > 0 && n.merge == "" {
+		notes = append(notes, fmt.Sprintf("same content as v%d", n.repeats))
+	}
+	return notes
+}
+
+// Write the version graph of filename with its branches, rollbacks,
+// aliases and metadata to w, in the text or dot format
+func Write(ctx context.Context, w io.Writer, metadata *db.DB, filename, format string) error {
+	versions, err := db.ListVersions(ctx, metadata, filename)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("%s: %w", filename, db.ErrNoVersion)
+	}
+	rollbacks, err := db.RollbackActions(ctx, metadata, filename)
+	if err != nil {
+		return err
+	}
+	branches, err := db.ListBranches(ctx, metadata, filename)
+	if err != nil {
+		return err
+	}
+	all, err := db.ListAliases(ctx, metadata)
+	if err != nil {
+		return err
+	}
+	header := []string{filename}
+	var aliases []string
+	for _, a := range all {
+		if a.Filename == filename {
+			aliases = append(aliases, a.Name)
+		}
+	}
+	if len(aliases) > 0 {
+		header = append(header, "aka "+strings.Join(aliases, ", "))
+	}
+	meta, err := db.GetMeta(ctx, metadata, filename)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		header = append(header, key+"="+meta[key])
+	}
+
+	nodes, width := layout(versions, branches)
+	switch format {
+	case "", "text":
+		return writeText(w, header, nodes, width, branches, placeRollbacks(nodes, rollbacks))
+	case "dot":
+		return writeDot(w, header, nodes, branches, placeRollbacks(nodes, rollbacks))
+	default:
+		return fmt.Errorf("unknown graph format %q (use text, dot)", format)
+	}
+}
+
+// Draw the lanes of the graph in columns beside the versions. A branch
+// lane runs from the version it was forked from to the one that merged it,
+// and renamed histories join the lane of the versions after them.
+func writeText(w io.Writer, header []string, nodes []node, width int, branches []db.Branch, rollbacks []rollback) error {
+	// Each lane is drawn between the indexes lo and hi
+	lo := make([]int, width)
+	hi := make([]int, width)
+	for i := range lo {
+		lo[i] = len(nodes)
+	}
+	index := map[int]int{}
+	branchLane := map[string]int{}
+	for i, n := range nodes {
+		lo[n.lane] = min(lo[n.lane], i)
+		hi[n.lane] = max(hi[n.lane], i)
+		index[n.Version.Version] = i
+		if n.Branch != "" {
+			branchLane[n.Branch] = n.lane
+		}
+	}
+	forks := map[int][]int{}  // lanes forked just above each index
+	merges := map[int][]int{} // lanes merged just below each index
+	for _, b := range branches {
+		lane, ok := branchLane[b.Name]
+		if !ok {
+			continue
+		}
+		if base, ok := index[b.Base]; ok {
+			lo[lane] = base
+			forks[base] = append(forks[base], lane)
+		}
+		if merged, ok := index[b.Merged]; ok && merged > hi[lane] {
+			hi[lane] = merged
+			merges[merged] = append(merges[merged], lane)
+		}
+	}
+	columns := func() []byte {
+		return []byte(strings.Repeat(" ", 2*width))
+	}
+	// Write a row joining the lanes between index i and the one below it
+	join := func(i int, marks map[int]byte) error {
+		row := columns()
+		for lane := range width {
+			if lo[lane] < i && i-1 < hi[lane] {
+				row[2*lane] = '|'
+			}
+		}
+		for pos, mark := range marks {
+			row[pos] = mark
+		}
+		_, err := fmt.Fprintln(w, strings.TrimRight(string(row), " "))
+		return err
+	}
+
+	if _, err := fmt.Fprintln(w, strings.Join(header, "  ")); err != nil {
+		return err
+	}
+	r := len(rollbacks) - 1
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		row := columns()
+		for ; r >= 0 && rollbacks[r].after == i; r-- {
+			for lane := range width {
+				if lo[lane] <= i && i < hi[lane] || lane == n.lane {
+					row[2*lane] = '|'
+				}
+			}
+			line := fmt.Sprintf("%s  rollback %s  to v%d", row, rollbacks[r].Local().Format("2006-01-02 15:04"), rollbacks[r].target)
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+			row = columns()
+		}
+		for lane := range width {
+			if lane == n.lane {
+				row[2*lane] = '*'
+			} else if lo[lane] < i && i < hi[lane] {
+				row[2*lane] = '|'
+			}
+		}
+		line := fmt.Sprintf("%s  v%-4d %s  %s", row, n.Version.Version, n.Timestamp.Local().Format("2006-01-02 15:04"), ShortHash(n.Hash))
+		if notes := n.notes(); len(notes) > 0 {
+			line += "  " + strings.Join(notes, ", ")
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimRight(line, " ")); err != nil {
+			return err
+		}
+		if i == 0 {
+			continue
+		}
+
+		marks := map[int]byte{}
+		for _, lane := range merges[i] {
+			marks[2*lane-1] = '\\'
+			marks[2*lane] = ' '
+		}
+		for _, lane := range forks[i-1] {
+			marks[2*lane-1] = '/'
+			marks[2*lane] = ' '
+		}
+		// A renamed history joins the lane of the version after it
+		if prev := nodes[i-1]; prev.lane != n.lane && prev.Branch == "" && n.Branch == "" {
+			if n.lane > prev.lane {
+				marks[2*n.lane-1] = '/'
+			} else {
+				marks[2*prev.lane-1] = '\\'
+			}
+		}
+		if len(marks) > 0 {
+			if err := join(i, marks); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write the graph as a DOT digraph drawn oldest at the bottom, with
+// branches forking from their base versions, the moves between lanes of
+// renames dashed, and rollbacks as notes dotted back to the version they
+// restored
+func writeDot(w io.Writer, header []string, nodes []node, branches []db.Branch, rollbacks []rollback) error {
+	bases := map[string]int{}
+	for _, b := range branches {
+		bases[b.Name] = b.Base
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph history {\n\trankdir=BT;\n\tlabel=%s;\n\tnode [shape=box];\n", dotQuote(strings.Join(header, "\n")))
+	prev := map[int]int{}
+	for i, n := range nodes {
+		label := []string{fmt.Sprintf("v%d", n.Version.Version), n.Timestamp.Local().Format(time.DateTime), ShortHash(n.Hash)}
+		label = append(label, n.notes()...)
+		fmt.Fprintf(&b, "\tv%d [label=%s];\n", n.Version.Version, dotQuote(strings.Join(label, "\n")))
+		p, ok := prev[n.lane]
+		if base, forked := bases[n.Branch]; !ok && forked {
+			p, ok = base, true
+		}
+		if ok {
+			fmt.Fprintf(&b, "\tv%d -> v%d;\n", p, n.Version.Version)
+		}
+		if n.merge != "" {
+			if tip, merged := prev[mergedLane(nodes[:i], n.merge)]; merged {
+				fmt.Fprintf(&b, "\tv%d -> v%d [label=\"merge\"];\n", tip, n.Version.Version)
+			}
+		}
+		if i > 0 && nodes[i-1].lane != n.lane && n.Branch == "" && nodes[i-1].Branch == "" {
+			fmt.Fprintf(&b, "\tv%d -> v%d [style=dashed];\n", nodes[i-1].Version.Version, n.Version.Version)
+		}
+		if n.repeats > 0 && n.merge == "" {
+			fmt.Fprintf(&b, "\tv%d -> v%d [style=dotted, label=\"same content\"];\n", n.repeats, n.Version.Version)
+		}
+		prev[n.lane] = n.Version.Version
+	}
+	for i, r := range rollbacks {
+		fmt.Fprintf(&b, "\trollback%d [shape=note, label=%s];\n", i+1, dotQuote("rollback\n"+r.Local().Format(time.DateTime)))
+		fmt.Fprintf(&b, "\tv%d -> rollback%d [style=dotted];\n", r.target, i+1)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Return the lane of the named branch among nodes, or -1
+func mergedLane(nodes []node, branch string) int {
+	for _, n := range nodes {
+		if n.Branch == branch {
+			return n.lane
+		}
+	}
+	return -1
+}
+
+// ShortHash returns the first digits of a content hash
+func ShortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// Quote s as a DOT string, keeping line breaks
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
@@ -0,0 +1,52 @@
+package graph_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/graph"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	for _, content := range []string{"one\n", "two\n", "one\n"} {
+		if _, err := repo.Store.StoreVersion(ctx, "notes.txt", strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var text bytes.Buffer
+	if err := graph.Write(ctx, &text, repo.DB, "notes.txt", "text"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if len(lines) != 4 || lines[0] != "notes.txt" {
+		t.Fatalf("text graph is %q", text.String())
+	}
+	// Newest first, noting content stored before
+	for i, want := range []string{"*   v3", "*   v2", "*   v1"} {
+		if !strings.HasPrefix(lines[i+1], want) {
+			t.Errorf("line %d is %q, want it to start with %q", i+1, lines[i+1], want)
+		}
+	}
+	if !strings.HasSuffix(lines[1], "same content as v1") {
+		t.Errorf("v3 drawn as %q, want it noted as repeating v1", lines[1])
+	}
+
+	var dot bytes.Buffer
+	if err := graph.Write(ctx, &dot, repo.DB, "notes.txt", "dot"); err != nil {
+		t.Fatal(err)
+	}
+	for _, edge := range []string{"v1 -> v2;", "v2 -> v3;", `v1 -> v3 [style=dotted, label="same content"];`} {
+		if !strings.Contains(dot.String(), edge) {
+			t.Errorf("dot graph lacks %s:\n%s", edge, dot.String())
+		}
+	}
+	if err := graph.Write(ctx, &dot, repo.DB, "missing.txt", "text"); err == nil {
+		t.Error("drawing a file without versions succeeded")
+	}
+}
@@ -0,0 +1,105 @@
+// Package hash computes the content hashes used to address stored blobs.
+package hash
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+	gohash "hash"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DefaultAlgorithm is used by repositories that never chose another one
+const DefaultAlgorithm = "sha256"
+
+// Algorithm is a content hash function. Digests are hex-encoded.
+type Algorithm struct {
+	Name string
+
+	// Cryptographic algorithms make accidental or crafted collisions
+	// practically impossible; xxhash is only safe against accidents
+	Cryptographic bool
+
+	new func() gohash.Hash
+}
+
+var algorithms = map[string]Algorithm{
+	"sha256": {Name: "sha256", Cryptographic: true, new: sha256.New},
+	"sha512": {Name: "sha512", Cryptographic: true, new: sha512.New},
+	"blake3": {Name: "blake3", Cryptographic: true, new: func() gohash.Hash { return blake3.New() }},
+	"xxhash": {Name: "xxhash", new: func() gohash.Hash { return xxhash.New() }},
+}
+
+// Lookup returns the algorithm with the given name
+func Lookup(name string) (Algorithm, error) {
+	algorithm, ok := algorithms[strings.ToLower(name)]
+	if !ok {
+		return Algorithm{}, fmt.Errorf("unsupported hash algorithm %q (use %s)", name, strings.Join(Names(), ", "))
+	}
+	return algorithm, nil
+}
+
+// Default returns the SHA-256 algorithm
+func Default() Algorithm {
+	return algorithms[DefaultAlgorithm]
+}
+
+// Names returns the names of the supported algorithms, sorted
+func Names() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New returns a fresh hash state
+func (a Algorithm) New() gohash.Hash {
+	return a.new()
+}
+
+// File hashes the contents of the file at path
+func (a Algorithm) File(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	return a.readClose(ctx, file)
+}
+
+// FSFile hashes the file name of fsys like File
+func (a Algorithm) FSFile(ctx context.Context, fsys fs.FS, name string) (string, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	return a.readClose(ctx, file)
+}
+
+// Hash an opened file and close it, failing when it cannot be closed
+func (a Algorithm) readClose(ctx context.Context, file io.ReadCloser) (string, error) {
+	sum, err := a.Reader(ctx, file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		return "", fmt.Errorf("failed to close file: %w", closeErr)
+	}
+	return sum, err
+}
+
+// Reader hashes everything read from r. Hashing stops when ctx is cancelled.
+func (a Algorithm) Reader(ctx context.Context, r io.Reader) (string, error) {
+	hashed := a.New()
+	if _, err := fsutil.Copy(ctx, hashed, r); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	return fmt.Sprintf("%x", hashed.Sum(nil)), nil
+}
@@ -0,0 +1,27 @@
+package hash
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"testing"
+)
+
+// benchSize is the data each iteration of a benchmark hashes
+const benchSize = 4 << 20
+
+func BenchmarkReader(b *testing.B) {
+	data := make([]byte, benchSize)
+	_, _ = rand.NewChaCha8([32]byte{}).Read(data)
+	for _, name := range Names() {
+		algorithm, _ := Lookup(name)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(benchSize)
+			for i := 0; i < b.N; i++ {
+				if _, err := algorithm.Reader(context.Background(), bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package hash
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Sum is a line of a checksum file: the digest of a file and its name
+type Sum struct {
+	Digest string
+	Name   string
+}
+
+// sumEscaper escapes names the way GNU coreutils does, which then marks
+// the line with a leading backslash
+var sumEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+// sumUnescaper reverses sumEscaper
+var sumUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+
+// WriteSums writes sums in the format of sha256sum and its siblings, which
+// they verify with -c
+func WriteSums(w io.Writer, sums []Sum) error {
+	bw := bufio.NewWriter(w)
+	for _, sum := range sums {
+		name := sumEscaper.Replace(sum.Name)
+		if name != sum.Name {
+			if _, err := bw.WriteString(`\`); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(bw, "%s  %s\n", sum.Digest, name); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadSums parses a checksum file written by WriteSums or sha256sum and its
+// siblings, in text or binary mode. Blank lines and comments are skipped.
+func ReadSums(r io.Reader) ([]Sum, error) {
+	var sums []Sum
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		escaped := strings.HasPrefix(text, `\`)
+		text = strings.TrimPrefix(text, `\`)
+		digest, name, ok := strings.Cut(text, " ")
+		if !ok || len(name) < 2 || (name[0] != ' ' && name[0] != '*') || !isHex(digest) {
+			return nil, fmt.Errorf("line %d: not a checksum line", line)
+		}
+		name = name[1:]
+		if escaped {
+			name = sumUnescaper.Replace(name)
+		}
+		sums = append(sums, Sum{Digest: strings.ToLower(digest), Name: name})
+	}
+	return sums, scanner.Err()
+}
+
+// Report whether s is a non-empty hex string
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Sums hashes every regular file of fsys, in lexical order, naming them by
+// their slash-separated paths within fsys
+func (a Algorithm) Sums(ctx context.Context, fsys fs.FS) ([]Sum, error) {
+	var sums []Sum
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		digest, err := a.FSFile(ctx, fsys, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		sums = append(sums, Sum{Digest: digest, Name: name})
+		return nil
+	})
+	return sums, err
+}
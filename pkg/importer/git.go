@@ -0,0 +1,173 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Git is the history of a Git repository: the commits reachable from Ref
+// along first parents, each changing the files it added or modified.
+// Symbolic links and submodules are left out.
+type Git struct {
+	Dir string // the work tree or bare repository
+	Ref string // HEAD when empty
+}
+
+// Source names the repository
+func (g *Git) Source() string {
+	return "git:" + g.Dir
+}
+
+// Walk the commits of the repository, oldest first
+func (g *Git) Walk(ctx context.Context, fn func(Revision) error) error {
+	ref := g.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	log, err := g.output(ctx, "log", "--reverse", "--first-parent", "--format=%H %ct", ref, "--")
+	if err != nil {
+		return err
+	}
+
+	objects, err := g.catFile(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = objects.Close()
+	}()
+
+	for _, line := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+		if line == "" {
+			continue
+		}
+		id, seconds, _ := strings.Cut(line, " ")
+		unix, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse commit %s: %w", id, err)
+		}
+		changes, err := g.changes(ctx, id, objects)
+		if err != nil {
+			return err
+		}
+		if err := fn(Revision{ID: id, Time: time.Unix(unix, 0), Changes: changes}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the files commit id added or modified against its first parent
+func (g *Git) changes(ctx context.Context, id string, objects *catFile) ([]Change, error) {
+	diff, err := g.output(ctx, "diff-tree", "-r", "--root", "-z", "--no-renames", "--no-commit-id", id)
+	if err != nil {
+		return nil, err
+	}
+	// Records are ":mode mode object object status" NUL path NUL
+	var changes []Change
+	fields := strings.Split(string(diff), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) < 5 {
+			return nil, fmt.Errorf("unexpected diff-tree output for %s: %q", id, fields[i])
+		}
+		mode, object, status := meta[1], meta[3], meta[4]
+		if status == "D" || !strings.HasPrefix(mode, "100") {
+			// Deletions, symbolic links (120000) and submodules (160000)
+			continue
+		}
+		changes = append(changes, Change{
+			Name: fields[i+1],
+			Open: func() (io.ReadCloser, error) { return objects.Open(object) },
+		})
+	}
+	return changes, nil
+}
+
+// Run git in the repository and return its standard output
+func (g *Git) output(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", g.Dir}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// catFile reads objects through a single git cat-file --batch process
+type catFile struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	unread int64 // bytes of the last object, and its newline, not read yet
+}
+
+// Start git cat-file --batch in the repository
+func (g *Git) catFile(ctx context.Context) (*catFile, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", g.Dir, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start git cat-file: %w", err)
+	}
+	return &catFile{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// Open returns the contents of a blob, valid until the next call
+func (c *catFile) Open(object string) (io.ReadCloser, error) {
+	if _, err := c.stdout.Discard(int(c.unread)); err != nil {
+		return nil, err
+	}
+	c.unread = 0
+	if _, err := fmt.Fprintln(c.stdin, object); err != nil {
+		return nil, err
+	}
+	header, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", object, err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[1] != "blob" {
+		return nil, fmt.Errorf("object %s is not a blob: %s", object, strings.TrimSpace(header))
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %w", object, err)
+	}
+	c.unread = size + 1
+	return io.NopCloser(&objectReader{c: c, r: io.LimitReader(c.stdout, size)}), nil
+}
+
+// objectReader counts what is read of an object so that the rest is
+// skipped before the next one
+type objectReader struct {
+	c *catFile
+	r io.Reader
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.c.unread -= int64(n)
+	return n, err
+}
+
+// Close stops the process
+func (c *catFile) Close() error {
+	_ = c.stdin.Close()
+	return c.cmd.Wait()
+}
@@ -0,0 +1,81 @@
+// Package importer brings the file histories of other tools, such as Git
+// repositories and restic snapshots, into a repository as versions.
+package importer
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"time"
+)
+
+// Change is a file a revision added or modified. Open returns its
+// contents, which must be read and closed before the next change is opened.
+type Change struct {
+	Name string // slash-separated, the version key of the file
+	Open func() (io.ReadCloser, error)
+}
+
+// Revision is a point in an imported history: a commit or a snapshot
+type Revision struct {
+	ID      string
+	Time    time.Time
+	Changes []Change
+}
+
+// History walks the revisions of a history, oldest first
+type History interface {
+	// Source names the history in reports and recorded versions
+	Source() string
+	Walk(ctx context.Context, fn func(Revision) error) error
+}
+
+// Report summarizes an import
+type Report struct {
+	Source    string `json:"source"`
+	Revisions int    `json:"revisions"`
+	Versions  int    `json:"versions"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// Print the report in a human-readable form
+func (r *Report) Print() {
+	fmt.Printf("Imported %d revisions of %s as %d versions, %d bytes\n", r.Revisions, r.Source, r.Versions, r.Bytes)
+}
+
+// Import records a version of every file each revision of h changed,
+// dated at the revision and stored from the file's path within h. Files a
+// revision deleted keep their versions.
+func Import(ctx context.Context, s *store.Store, h History) (*Report, error) {
+	report := &Report{Source: h.Source()}
+	err := h.Walk(ctx, func(rev Revision) error {
+		for _, change := range rev.Changes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			result, err := importChange(ctx, s, h.Source()+"/"+change.Name, change, rev.Time)
+			if err != nil {
+				return fmt.Errorf("failed to import %s at %s: %w", change.Name, rev.ID, err)
+			}
+			report.Versions++
+			report.Bytes += result.Bytes
+		}
+		report.Revisions++
+		return nil
+	})
+	return report, err
+}
+
+// Store one changed file of a revision
+func importChange(ctx context.Context, s *store.Store, source string, change Change, at time.Time) (*store.StoreResult, error) {
+	r, err := change.Open()
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.ImportVersion(ctx, change.Name, source, r, at)
+	if closeErr := r.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return result, err
+}
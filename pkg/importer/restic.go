@@ -0,0 +1,149 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Restic is the history of a restic repository: its snapshots in time
+// order, each changing the files whose size or modification time differ
+// from the previous snapshot. The repository password is read by restic
+// itself, from RESTIC_PASSWORD and its siblings.
+type Restic struct {
+	Repo string
+}
+
+// resticSnapshot is an entry of restic snapshots --json
+type resticSnapshot struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// resticNode is a line of restic ls --json
+type resticNode struct {
+	StructType string    `json:"struct_type"`
+	Type       string    `json:"type"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+}
+
+// Source names the repository
+func (r *Restic) Source() string {
+	return "restic:" + r.Repo
+}
+
+// Walk the snapshots of the repository, oldest first
+func (r *Restic) Walk(ctx context.Context, fn func(Revision) error) error {
+	out, err := r.output(ctx, "snapshots", "--json")
+	if err != nil {
+		return err
+	}
+	var snapshots []resticSnapshot
+	if err := json.Unmarshal(out, &snapshots); err != nil {
+		return fmt.Errorf("failed to parse restic snapshots: %w", err)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+
+	previous := map[string]resticNode{}
+	for _, snapshot := range snapshots {
+		files, err := r.files(ctx, snapshot.ID)
+		if err != nil {
+			return err
+		}
+		var changes []Change
+		for _, file := range files {
+			if before, ok := previous[file.Path]; ok && before.Size == file.Size && before.ModTime.Equal(file.ModTime) {
+				continue
+			}
+			changes = append(changes, Change{
+				Name: strings.TrimPrefix(file.Path, "/"),
+				Open: r.dump(ctx, snapshot.ID, file.Path),
+			})
+		}
+		previous = make(map[string]resticNode, len(files))
+		for _, file := range files {
+			previous[file.Path] = file
+		}
+		if err := fn(Revision{ID: snapshot.ID, Time: snapshot.Time, Changes: changes}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the regular files of a snapshot
+func (r *Restic) files(ctx context.Context, id string) ([]resticNode, error) {
+	out, err := r.output(ctx, "ls", "--json", id)
+	if err != nil {
+		return nil, err
+	}
+	var files []resticNode
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var node resticNode
+		if err := json.Unmarshal(scanner.Bytes(), &node); err != nil {
+			return nil, fmt.Errorf("failed to parse restic ls output: %w", err)
+		}
+		if node.StructType == "node" && node.Type == "file" {
+			files = append(files, node)
+		}
+	}
+	return files, scanner.Err()
+}
+
+// Return a function streaming a file of a snapshot through restic dump
+func (r *Restic) dump(ctx context.Context, id, path string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		cmd := exec.CommandContext(ctx, "restic", "-r", r.Repo, "dump", id, path)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start restic: %w", err)
+		}
+		return &dumpReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+	}
+}
+
+// dumpReader reads the output of restic dump, failing when restic does
+type dumpReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+// Close waits for restic to exit
+func (d *dumpReader) Close() error {
+	_, _ = io.Copy(io.Discard, d.ReadCloser)
+	if err := d.cmd.Wait(); err != nil {
+		return fmt.Errorf("restic dump failed: %w: %s", err, strings.TrimSpace(d.stderr.String()))
+	}
+	return nil
+}
+
+// Run restic on the repository and return its standard output
+func (r *Restic) output(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "restic", append([]string{"-r", r.Repo, "--no-lock"}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("restic %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
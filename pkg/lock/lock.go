@@ -0,0 +1,186 @@
+// Package lock implements the advisory repository lock that serializes
+// writers across processes and hosts.
+package lock
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"os"
+	"time"
+)
+
+// A lock whose heartbeat is older than this is considered abandoned even
+// when its owner runs on another host and cannot be checked directly
+const (
+	heartbeatInterval = 30 * time.Second
+	staleAge          = 5 * heartbeatInterval
+)
+
+// Owner is written into the lock file to identify its holder
+type Owner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Action   string    `json:"action"`
+	Acquired time.Time `json:"acquired"`
+	Token    string    `json:"token"` // tells this lock from later ones
+}
+
+// Lock is an acquired advisory lock
+type Lock struct {
+	path     string
+	token    string
+	observer event.Observer
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Acquire takes the exclusive lock file at path on behalf of action,
+// waiting up to wait for a holder to release it. Stale locks left by
+// crashed processes are broken. Waiting stops when ctx is cancelled.
+// Broken locks and failures to refresh or remove the lock are reported
+// to observer.
+func Acquire(ctx context.Context, path, action string, wait time.Duration, observer event.Observer) (*Lock, error) {
+	hostname, _ := os.Hostname()
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate lock token: %w", err)
+	}
+	owner := Owner{PID: os.Getpid(), Hostname: hostname, Action: action, Acquired: time.Now(), Token: hex.EncodeToString(secret)}
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_, writeErr := file.Write(data)
+			closeErr := file.Close()
+			if err := errors.Join(writeErr, closeErr); err != nil {
+				_ = os.Remove(path)
+				return nil, fmt.Errorf("failed to write lock file: %w", err)
+			}
+			lock := &Lock{path: path, token: owner.Token, observer: observer, stop: make(chan struct{}), done: make(chan struct{})}
+			go lock.heartbeat()
+			return lock, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		holder, content, stale := inspectLock(path, hostname)
+		if stale {
+			observer.OnError(event.Error{Op: "lock", Name: path, Err: fmt.Errorf("breaking stale lock held by pid %d on %s", holder.PID, holder.Hostname)})
+			err := takeAway(path, func(data []byte) bool { return bytes.Equal(data, content) })
+			if err != nil {
+				return nil, fmt.Errorf("failed to break stale lock: %w", err)
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("repository is locked by pid %d on %s (%s since %s); use -wait to wait for it",
+				holder.PID, holder.Hostname, holder.Action, holder.Acquired.Local().Format(time.DateTime))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// Read the lock file and decide whether its holder is gone, returning the
+// content it was decided on
+func inspectLock(path, hostname string) (Owner, []byte, bool) {
+	var holder Owner
+	info, err := os.Stat(path)
+	if err != nil {
+		// Released between our create attempt and now; retry immediately
+		return holder, nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, &holder) != nil {
+		// A half-written lock file is only stale once its heartbeat expired
+		return holder, data, time.Since(info.ModTime()) > staleAge
+	}
+
+	if holder.Hostname == hostname && holder.PID != os.Getpid() && !processAlive(holder.PID) {
+		return holder, data, true
+	}
+	return holder, data, time.Since(info.ModTime()) > staleAge
+}
+
+// Remove the lock file at path if its content is still the one ours
+// accepts. Another process may break the lock and take it between our
+// reading it and removing it, so the file is renamed out of the way
+// atomically and put back when it turns out to be another lock. The
+// renamed file is removed whatever happens.
+func takeAway(path string, ours func([]byte) bool) error {
+	moved := fmt.Sprintf("%s.broken-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, moved); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed by another process already
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		_ = os.Remove(moved)
+	}()
+	data, err := os.ReadFile(moved)
+	if err != nil {
+		return err
+	}
+	if !ours(data) {
+		// Linking fails rather than replace a lock taken in the meantime
+		if err := os.Link(moved, path); err != nil {
+			return fmt.Errorf("failed to put back the lock of another process: %w", err)
+		}
+	}
+	return nil
+}
+
+// Touch the lock file periodically so other hosts can tell it is still held
+func (l *Lock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				l.observer.OnError(event.Error{Op: "lock", Name: l.path, Err: fmt.Errorf("failed to refresh lock: %w", err)})
+			}
+		}
+	}
+}
+
+// Release the lock, leaving the lock file alone when another process
+// broke the lock and holds it now. Safe to call on a nil lock and more
+// than once.
+func (l *Lock) Release() {
+	if l == nil || l.stop == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	l.stop = nil
+	err := takeAway(l.path, func(data []byte) bool {
+		var holder Owner
+		return json.Unmarshal(data, &holder) == nil && holder.Token == l.token
+	})
+	if err != nil {
+		l.observer.OnError(event.Error{Op: "lock", Name: l.path, Err: fmt.Errorf("failed to remove lock: %w", err)})
+	}
+}
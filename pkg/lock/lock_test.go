@@ -0,0 +1,43 @@
+package lock_test
+
+import (
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/lock"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReleaseKeepsLockOfAnotherProcess(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fm.lock")
+
+	held, err := lock.Acquire(ctx, path, "store", 0, event.Discard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another process broke the lock and took it
+	other := []byte(`{"pid":1,"hostname":"elsewhere","action":"backup","token":"other"}`)
+	if err := os.WriteFile(path, other, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	held.Release()
+	if got, err := os.ReadFile(path); err != nil || string(got) != string(other) {
+		t.Errorf("release left the lock file as %q (%v), want the other lock", got, err)
+	}
+
+	// Releasing its own lock removes it, and nothing is left behind
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	held, err = lock.Acquire(ctx, path, "store", 0, event.Discard{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	held.Release()
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("release left %v (%v), want an empty directory", entries, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package lock
+
+import (
+	"os"
+)
+
+// Report whether a process with the given pid exists on this host
+func processAlive(pid int) bool {
+	// On Windows FindProcess opens a handle and fails for unknown pids
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = process.Release()
+	return true
+}
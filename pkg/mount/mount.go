@@ -0,0 +1,9 @@
+// Package mount serves a read-only file system, such as the versions of a
+// repository, as a FUSE mount so that they can be browsed and copied with
+// ordinary tools.
+package mount
+
+import "errors"
+
+// ErrUnsupported is returned by Serve on platforms without FUSE
+var ErrUnsupported = errors.New("FUSE mounts are not supported on this platform")
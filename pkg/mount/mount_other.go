@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd
+
+package mount
+
+import "io/fs"
+
+// Mount is a file system mounted by Serve
+type Mount struct{}
+
+// Serve fails with ErrUnsupported: there is no FUSE on this platform
+func Serve(fsys fs.FS, dir string) (*Mount, error) {
+	return nil, ErrUnsupported
+}
+
+// Unmount does nothing, as nothing can be mounted
+func (m *Mount) Unmount() error {
+	return ErrUnsupported
+}
+
+// Wait returns at once, as nothing can be mounted
+func (m *Mount) Wait() {}
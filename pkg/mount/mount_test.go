@@ -0,0 +1,42 @@
+//go:build linux || darwin || freebsd
+
+package mount_test
+
+import (
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/mount"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	m, err := mount.Serve(fmtest.Fixture(t, fmtest.SampleFiles), dir)
+	if err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := m.Unmount(); err != nil {
+			t.Errorf("failed to unmount: %v", err)
+		}
+		m.Wait()
+	})
+
+	for name, want := range fmtest.SampleFiles {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || string(got) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, got, err, want)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Error("the mount is empty")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new.txt"), []byte("new\n"), 0o644); err == nil {
+		t.Error("wrote to a read-only mount")
+	}
+}
@@ -0,0 +1,207 @@
+//go:build linux || darwin || freebsd
+
+package mount
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Mount is a file system mounted by Serve
+type Mount struct {
+	server *fuse.Server
+}
+
+// Serve mounts fsys read-only on dir and serves it in the background until
+// it is unmounted. Contents are read as the kernel asks for them, so
+// files are only opened once they are read.
+func Serve(fsys fs.FS, dir string) (*Mount, error) {
+	timeout := time.Second
+	server, err := gofs.Mount(dir, &node{fsys: fsys, name: "."}, &gofs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		MountOptions: fuse.MountOptions{
+			FsName: "fm",
+			Name:   "fm",
+			// Mount directly when allowed, then through fusermount
+			DirectMount: true,
+			Options:     []string{"ro"},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount on %s: %w", dir, err)
+	}
+	return &Mount{server: server}, nil
+}
+
+// Unmount detaches the file system, failing while it is in use
+func (m *Mount) Unmount() error {
+	if err := m.server.Unmount(); err != nil {
+		return fmt.Errorf("failed to unmount: %w", err)
+	}
+	return nil
+}
+
+// Wait until the file system is unmounted, by Unmount or by the user
+func (m *Mount) Wait() {
+	m.server.Wait()
+}
+
+// node is a file or directory of the mounted file system
+type node struct {
+	gofs.Inode
+	fsys fs.FS
+	name string // within fsys
+}
+
+var (
+	_ gofs.NodeLookuper  = (*node)(nil)
+	_ gofs.NodeGetattrer = (*node)(nil)
+	_ gofs.NodeReaddirer = (*node)(nil)
+	_ gofs.NodeOpener    = (*node)(nil)
+)
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	child := path.Join(n.name, name)
+	info, err := fs.Stat(n.fsys, child)
+	if err != nil {
+		return nil, errno(err)
+	}
+	fillAttr(&out.Attr, info)
+	inode := n.NewInode(ctx, &node{fsys: n.fsys, name: child}, gofs.StableAttr{Mode: fileType(info)})
+	return inode, 0
+}
+
+func (n *node) Getattr(ctx context.Context, _ gofs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	info, err := fs.Stat(n.fsys, n.name)
+	if err != nil {
+		return errno(err)
+	}
+	fillAttr(&out.Attr, info)
+	return 0
+}
+
+func (n *node) Readdir(ctx context.Context) (gofs.DirStream, syscall.Errno) {
+	entries, err := fs.ReadDir(n.fsys, n.name)
+	if err != nil {
+		return nil, errno(err)
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		mode := uint32(fuse.S_IFREG)
+		if entry.IsDir() {
+			mode = fuse.S_IFDIR
+		}
+		list = append(list, fuse.DirEntry{Name: entry.Name(), Mode: mode})
+	}
+	return gofs.NewListDirStream(list), 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (gofs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	file, err := n.fsys.Open(n.name)
+	if err != nil {
+		return nil, 0, errno(err)
+	}
+	// Versions never change, so the kernel may keep what it read
+	return &handle{fsys: n.fsys, name: n.name, file: file}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// handle is an open file. Files of fsys are read sequentially; reads
+// further on skip ahead and reads further back open the file again.
+type handle struct {
+	fsys fs.FS
+	name string
+
+	mu     sync.Mutex
+	file   fs.File
+	offset int64
+}
+
+var (
+	_ gofs.FileReader   = (*handle)(nil)
+	_ gofs.FileReleaser = (*handle)(nil)
+)
+
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if off < h.offset {
+		_ = h.file.Close()
+		file, err := h.fsys.Open(h.name)
+		if err != nil {
+			return nil, errno(err)
+		}
+		h.file, h.offset = file, 0
+	}
+	if off > h.offset {
+		skipped, err := io.CopyN(io.Discard, h.file, off-h.offset)
+		h.offset += skipped
+		if errors.Is(err, io.EOF) {
+			return fuse.ReadResultData(nil), 0
+		}
+		if err != nil {
+			return nil, errno(err)
+		}
+	}
+	n, err := io.ReadFull(h.file, dest)
+	h.offset += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		// Such as content failing its hash, which must not pass as a short file
+		return nil, errno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return errno(h.file.Close())
+}
+
+// Return the file type bits of a file
+func fileType(info fs.FileInfo) uint32 {
+	if info.IsDir() {
+		return fuse.S_IFDIR
+	}
+	return fuse.S_IFREG
+}
+
+// Fill the attributes of a file, read-only whatever its permissions
+func fillAttr(attr *fuse.Attr, info fs.FileInfo) {
+	attr.Mode = fileType(info) | uint32(info.Mode().Perm()&0o555)
+	attr.Size = uint64(info.Size())
+	attr.Nlink = 1
+	modTime := info.ModTime()
+	attr.SetTimes(&modTime, &modTime, &modTime)
+}
+
+// Return the error number of a failed operation
+func errno(err error) syscall.Errno {
+	var number syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &number):
+		return number
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+	default:
+		return syscall.EIO
+	}
+}
@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"github.com/Lenstack/file_manager_version/pkg/watch"
+	"strconv"
+	"strings"
+)
+
+// Quota sets the storage size QuotaExceeded is sent for
+type Quota struct {
+	Bytes       int64 `json:"bytes"`        // 0 disables quota notifications
+	WarnPercent int   `json:"warn_percent"` // also notify once this share of Bytes is used
+}
+
+// Validate checks the quota settings
+func (q Quota) Validate() error {
+	if q.Bytes < 0 {
+		return errors.New("bytes must not be negative")
+	}
+	if q.WarnPercent < 0 || q.WarnPercent > 100 {
+		return errors.New("warn_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// Backup notifies about a backup of directory to output, which failed when
+// err is set
+func (n *Notifier) Backup(ctx context.Context, directory, output string, summary *archive.BackupSummary, err error) error {
+	details := map[string]string{"directory": directory, "output": output}
+	if err != nil {
+		details["error"] = err.Error()
+		if errors.Is(err, context.Canceled) {
+			details["error"] = "interrupted"
+		}
+		return n.Notify(ctx, BackupFailed, "Backup of "+directory+" failed", details)
+	}
+	details["files"] = strconv.Itoa(summary.Files)
+	details["bytes"] = strconv.FormatInt(summary.Bytes, 10)
+	details["archive_bytes"] = strconv.FormatInt(summary.ArchiveBytes, 10)
+	return n.Notify(ctx, BackupSucceeded, fmt.Sprintf("Backed up %d files from %s", summary.Files, directory), details)
+}
+
+// Corruption notifies about damaged or missing blobs found by a verify or
+// scrub run. Nothing is sent when every checked blob was intact.
+func (n *Notifier) Corruption(ctx context.Context, action string, report *store.VerifyReport) error {
+	damaged := len(report.Corrupted) + len(report.Truncated) + len(report.Missing)
+	if damaged == 0 {
+		return nil
+	}
+	details := map[string]string{"action": action, "checked": strconv.Itoa(report.Checked)}
+	for key, ids := range map[string][]string{
+		"corrupted":   report.Corrupted,
+		"truncated":   report.Truncated,
+		"missing":     report.Missing,
+		"repaired":    report.Repaired,
+		"quarantined": report.Quarantined,
+	} {
+		if len(ids) > 0 {
+			details[key] = strings.Join(ids, ", ")
+		}
+	}
+	return n.Notify(ctx, CorruptionFound, fmt.Sprintf("%s found %d damaged or missing blobs", action, damaged), details)
+}
+
+// Quota notifies when the storage growing from before to after bytes
+// crossed the warning threshold or the quota itself
+func (n *Notifier) Quota(ctx context.Context, q Quota, before, after int64) error {
+	if q.Bytes == 0 {
+		return nil
+	}
+	threshold := q.Bytes
+	if q.WarnPercent > 0 && !(before < q.Bytes && after >= q.Bytes) {
+		threshold = q.Bytes * int64(q.WarnPercent) / 100
+	}
+	if before >= threshold || after < threshold {
+		return nil
+	}
+	percent := after * 100 / q.Bytes
+	details := map[string]string{
+		"used_bytes":  strconv.FormatInt(after, 10),
+		"quota_bytes": strconv.FormatInt(q.Bytes, 10),
+		"percent":     strconv.FormatInt(percent, 10),
+	}
+	return n.Notify(ctx, QuotaExceeded, fmt.Sprintf("Storage is %d%% full (%d of %d bytes)", percent, after, q.Bytes), details)
+}
+
+// Anomaly notifies about what may be ransomware at work in a watched
+// directory
+func (n *Notifier) Anomaly(ctx context.Context, directory string, a watch.Anomaly) error {
+	details := map[string]string{
+		"directory": directory,
+		"kind":      a.Kind,
+		"files":     strings.Join(a.Files, ", "),
+		"snapshot":  strconv.Itoa(a.Snapshot),
+	}
+	return n.Notify(ctx, AnomalyDetected, "Possible ransomware in "+directory+": "+a.Message, details)
+}
@@ -0,0 +1,204 @@
+// Package notify tells people about finished backups, corruption, full
+// storage and suspected ransomware through webhooks, Slack and email.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Events a notification can be sent for
+const (
+	BackupSucceeded = "backup_succeeded"
+	BackupFailed    = "backup_failed"
+	CorruptionFound = "corruption_found" // by verify or scrub
+	QuotaExceeded   = "quota_exceeded"   // the storage grew past its quota or the warning threshold
+	AnomalyDetected = "anomaly_detected" // watch saw what may be ransomware at work
+)
+
+// events lists every event a target may subscribe to
+var events = []string{BackupSucceeded, BackupFailed, CorruptionFound, QuotaExceeded, AnomalyDetected}
+
+// Notification describes something that happened in a repository. It is the
+// data payload templates are executed with.
+type Notification struct {
+	Event      string            `json:"event"`
+	Repository string            `json:"repository"`
+	Message    string            `json:"message"`
+	Details    map[string]string `json:"details,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// Target is a configured destination for notifications
+type Target struct {
+	Type   string   `json:"type"`   // webhook, slack or email
+	Events []string `json:"events"` // sent for; every event when empty
+
+	// Template renders the payload, the request body of webhooks and the
+	// message of Slack and email, from the Notification. Without one the
+	// type's default payload is sent.
+	Template string `json:"template"`
+
+	// Settings of the type: url for webhook and slack; host, port,
+	// username, password, from, to and subject for email
+	Settings map[string]string `json:"settings"`
+}
+
+// Sender delivers notifications of one type
+type Sender interface {
+	// Payload renders a notification when the target has no template
+	Payload(n Notification) ([]byte, error)
+
+	// Send delivers a rendered payload
+	Send(ctx context.Context, n Notification, payload []byte) error
+}
+
+// SenderFactory creates a sender from a target's settings
+type SenderFactory func(settings map[string]string) (Sender, error)
+
+var senders = map[string]SenderFactory{
+	"webhook": newWebhook,
+	"slack":   newSlack,
+	"email":   newEmail,
+}
+
+// Register makes a sender type available under name. It panics if the name
+// is taken.
+func Register(name string, factory SenderFactory) {
+	if _, exists := senders[name]; exists {
+		panic("notify: sender " + name + " registered twice")
+	}
+	senders[name] = factory
+}
+
+// Names returns the names of the registered sender types, sorted
+func Names() []string {
+	names := make([]string, 0, len(senders))
+	for name := range senders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Notifier sends notifications to the targets subscribed to them
+type Notifier struct {
+	repository string
+	targets    []target
+}
+
+// target is a Target ready to send
+type target struct {
+	Target
+	sender   Sender
+	template *template.Template
+}
+
+// templateFuncs are available to payload templates
+var templateFuncs = template.FuncMap{
+	// json encodes a value, so that strings can be embedded in JSON payloads
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Parse a payload template
+func newTemplate(name, source string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(source)
+}
+
+// New validates the targets and returns a notifier sending on behalf of the
+// named repository
+func New(repository string, targets []Target) (*Notifier, error) {
+	n := &Notifier{repository: repository}
+	for i, t := range targets {
+		factory, ok := senders[t.Type]
+		if !ok {
+			return nil, fmt.Errorf("target %d has unknown type %q (use %s)", i+1, t.Type, strings.Join(Names(), ", "))
+		}
+		for _, event := range t.Events {
+			if !slices.Contains(events, event) {
+				return nil, fmt.Errorf("target %d has unknown event %q (use %s)", i+1, event, strings.Join(events, ", "))
+			}
+		}
+		sender, err := factory(t.Settings)
+		if err != nil {
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+		ready := target{Target: t, sender: sender}
+		if t.Template != "" {
+			ready.template, err = newTemplate(t.Type, t.Template)
+			if err != nil {
+				return nil, fmt.Errorf("target %d has an invalid template: %w", i+1, err)
+			}
+		}
+		n.targets = append(n.targets, ready)
+	}
+	return n, nil
+}
+
+// Notify sends a notification to every target subscribed to its event. All
+// targets are tried; the errors of those that failed are returned joined. A
+// nil notifier sends nothing.
+func (n *Notifier) Notify(ctx context.Context, event, message string, details map[string]string) error {
+	if n == nil {
+		return nil
+	}
+	note := Notification{
+		Event:      event,
+		Repository: n.repository,
+		Message:    message,
+		Details:    details,
+		Time:       time.Now().UTC(),
+	}
+	var errs []error
+	for _, t := range n.targets {
+		if len(t.Events) > 0 && !slices.Contains(t.Events, event) {
+			continue
+		}
+		if err := t.send(ctx, note); err != nil {
+			errs = append(errs, fmt.Errorf("failed to send %s notification to %s: %w", event, t.Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Render and deliver a notification
+func (t *target) send(ctx context.Context, n Notification) error {
+	if t.template == nil {
+		payload, err := t.sender.Payload(n)
+		if err != nil {
+			return err
+		}
+		return t.sender.Send(ctx, n, payload)
+	}
+	var payload bytes.Buffer
+	if err := t.template.Execute(&payload, n); err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+	return t.sender.Send(ctx, n, payload.Bytes())
+}
+
+// Describe a notification in plain text, with its details sorted by name
+func text(n Notification) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", n.Repository, n.Message)
+	keys := make([]string, 0, len(n.Details))
+	for key := range n.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\n%s: %s", key, n.Details[key])
+	}
+	return b.String()
+}
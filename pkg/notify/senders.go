@@ -0,0 +1,184 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// httpClient posts webhook and Slack notifications
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// webhook posts notifications as JSON to a URL
+type webhook struct {
+	url         string
+	contentType string
+}
+
+func newWebhook(settings map[string]string) (Sender, error) {
+	u, err := requireURL(settings)
+	if err != nil {
+		return nil, err
+	}
+	contentType := settings["content_type"]
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return &webhook{url: u, contentType: contentType}, nil
+}
+
+func (w *webhook) Payload(n Notification) ([]byte, error) {
+	return json.Marshal(n)
+}
+
+func (w *webhook) Send(ctx context.Context, _ Notification, payload []byte) error {
+	return post(ctx, w.url, w.contentType, payload)
+}
+
+// slack posts notifications to a Slack incoming webhook
+type slack struct {
+	url string
+}
+
+func newSlack(settings map[string]string) (Sender, error) {
+	u, err := requireURL(settings)
+	if err != nil {
+		return nil, err
+	}
+	return &slack{url: u}, nil
+}
+
+func (s *slack) Payload(n Notification) ([]byte, error) {
+	return json.Marshal(map[string]string{"text": text(n)})
+}
+
+func (s *slack) Send(ctx context.Context, _ Notification, payload []byte) error {
+	if !json.Valid(payload) {
+		// A template rendering plain text becomes the message text
+		payload, _ = json.Marshal(map[string]string{"text": string(payload)})
+	}
+	return post(ctx, s.url, "application/json", payload)
+}
+
+// Return the url setting, which must be an HTTP or HTTPS URL
+func requireURL(settings map[string]string) (string, error) {
+	u, err := url.Parse(settings["url"])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("settings.url must be an http or https URL")
+	}
+	return u.String(), nil
+}
+
+// POST a payload, failing unless the response is a success
+func post(ctx context.Context, url, contentType string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// email sends notifications through an SMTP server
+type email struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+	subject  *template.Template
+}
+
+func newEmail(settings map[string]string) (Sender, error) {
+	e := &email{
+		host:     settings["host"],
+		username: settings["username"],
+		password: settings["password"],
+		from:     settings["from"],
+	}
+	if e.host == "" {
+		return nil, errors.New("settings.host must name the SMTP server")
+	}
+	port := settings["port"]
+	if port == "" {
+		port = "587"
+	}
+	e.addr = net.JoinHostPort(e.host, port)
+	if e.from == "" {
+		return nil, errors.New("settings.from must give the sender address")
+	}
+	for _, to := range strings.Split(settings["to"], ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			e.to = append(e.to, to)
+		}
+	}
+	if len(e.to) == 0 {
+		return nil, errors.New("settings.to must list the recipient addresses, separated by commas")
+	}
+	subject := settings["subject"]
+	if subject == "" {
+		subject = "[{{.Repository}}] {{.Message}}"
+	}
+	var err error
+	if e.subject, err = newTemplate("subject", subject); err != nil {
+		return nil, fmt.Errorf("settings.subject is an invalid template: %w", err)
+	}
+	return e, nil
+}
+
+func (e *email) Payload(n Notification) ([]byte, error) {
+	return []byte(text(n) + "\n"), nil
+}
+
+func (e *email) Send(_ context.Context, n Notification, payload []byte) error {
+	subject, err := e.renderSubject(n)
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(bytes.ReplaceAll(payload, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n")))
+
+	var auth smtp.Auth
+	if e.username != "" {
+		auth = smtp.PlainAuth("", e.username, e.password, e.host)
+	}
+	return smtp.SendMail(e.addr, auth, e.from, e.to, msg.Bytes())
+}
+
+// Render the subject template, keeping it on a single header line
+func (e *email) renderSubject(n Notification) (string, error) {
+	var subject strings.Builder
+	if err := e.subject.Execute(&subject, n); err != nil {
+		return "", fmt.Errorf("failed to render subject: %w", err)
+	}
+	return mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")), nil
+}
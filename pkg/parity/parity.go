@@ -0,0 +1,187 @@
+// Package parity computes parity data that lets limited damage to a blob be
+// repaired without another copy of it.
+//
+// The blob is split into equal shards, and consecutive shards are grouped so
+// that each group gets one XOR parity shard; the overhead percentage sets the
+// group size. A CRC of every shard locates the damage, so one damaged shard
+// per group can be rebuilt from the others and the parity shard.
+package parity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// magic starts every parity file
+const magic = "FMPAR1\n"
+
+// Shard size bounds; within them shards are sized so that a small blob
+// still gets a single group instead of one parity shard per data shard
+const (
+	minShardSize = 64
+	maxShardSize = 64 << 10
+)
+
+// ErrUnrepairable is returned when a group has more damaged shards than its
+// parity can rebuild
+var ErrUnrepairable = errors.New("too much damage to repair")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// header describes the layout of a parity file. It is followed, for every
+// group, by the CRCs of its data shards, the CRC of its parity shard and
+// the parity shard itself.
+type header struct {
+	Size      int64  // blob size in bytes
+	ShardSize uint32 // bytes per shard; the last data shard is zero-padded
+	GroupSize uint32 // data shards per parity shard
+}
+
+// Return the number of data shards per parity shard for an overhead given
+// in percent of the blob size
+func groupSize(overhead int) (int, error) {
+	if overhead < 1 || overhead > 100 {
+		return 0, fmt.Errorf("parity overhead must be between 1 and 100 percent, got %d", overhead)
+	}
+	return (100 + overhead - 1) / overhead, nil
+}
+
+// Choose the shard size for a blob of the given size
+func shardSize(size int64, group int) int {
+	n := (size + int64(group) - 1) / int64(group)
+	n = (n + minShardSize - 1) / minShardSize * minShardSize
+	return int(max(minShardSize, min(n, maxShardSize)))
+}
+
+// Encode reads a blob of the given size from r and writes its parity data
+// to w, adding about overhead percent of the size
+func Encode(r io.Reader, size int64, w io.Writer, overhead int) error {
+	group, err := groupSize(overhead)
+	if err != nil {
+		return err
+	}
+	h := header{Size: size, ShardSize: uint32(shardSize(size, group)), GroupSize: uint32(group)}
+	if _, err := io.WriteString(w, magic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, h); err != nil {
+		return err
+	}
+
+	shard := make([]byte, h.ShardSize)
+	parity := make([]byte, h.ShardSize)
+	var crcs []uint32
+	for remaining := size; remaining > 0; {
+		clear(parity)
+		crcs = crcs[:0]
+		for i := 0; i < group && remaining > 0; i++ {
+			n := min(int64(len(shard)), remaining)
+			clear(shard)
+			if _, err := io.ReadFull(r, shard[:n]); err != nil {
+				return fmt.Errorf("failed to read blob: %w", err)
+			}
+			remaining -= n
+			crcs = append(crcs, crc32.Checksum(shard, crcTable))
+			xor(parity, shard)
+		}
+		crcs = append(crcs, crc32.Checksum(parity, crcTable))
+		if err := binary.Write(w, binary.BigEndian, crcs); err != nil {
+			return err
+		}
+		if _, err := w.Write(parity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repair reads a possibly damaged blob from r and its parity data from p,
+// and writes the blob to w with damaged shards rebuilt, returning how many
+// were. A blob that is too short is repaired like one whose missing tail is
+// damaged.
+func Repair(r, p io.Reader, w io.Writer) (int, error) {
+	got := make([]byte, len(magic))
+	if _, err := io.ReadFull(p, got); err != nil || !bytes.Equal(got, []byte(magic)) {
+		return 0, errors.New("not a parity file")
+	}
+	var h header
+	if err := binary.Read(p, binary.BigEndian, &h); err != nil {
+		return 0, fmt.Errorf("failed to read parity header: %w", err)
+	}
+	if h.ShardSize == 0 || h.ShardSize > maxShardSize || h.GroupSize == 0 || h.Size < 0 {
+		return 0, errors.New("invalid parity header")
+	}
+
+	repaired := 0
+	shardBytes := int64(h.ShardSize)
+	shards := make([][]byte, h.GroupSize)
+	for i := range shards {
+		shards[i] = make([]byte, h.ShardSize)
+	}
+	parity := make([]byte, h.ShardSize)
+	for remaining := h.Size; remaining > 0; {
+		count := int(min(int64(h.GroupSize), (remaining+shardBytes-1)/shardBytes))
+		lengths := make([]int64, count)
+		for i := range lengths {
+			lengths[i] = min(shardBytes, remaining)
+			remaining -= lengths[i]
+		}
+
+		crcs := make([]uint32, count+1)
+		if err := binary.Read(p, binary.BigEndian, crcs); err != nil {
+			return repaired, fmt.Errorf("failed to read parity data: %w", err)
+		}
+		if _, err := io.ReadFull(p, parity); err != nil {
+			return repaired, fmt.Errorf("failed to read parity data: %w", err)
+		}
+
+		damaged := -1
+		for i := 0; i < count; i++ {
+			clear(shards[i])
+			// A short read leaves zeros, which the CRC then reports as damage
+			_, _ = io.ReadFull(r, shards[i][:lengths[i]])
+			if crc32.Checksum(shards[i], crcTable) == crcs[i] {
+				continue
+			}
+			if damaged >= 0 {
+				return repaired, ErrUnrepairable
+			}
+			damaged = i
+		}
+
+		if damaged >= 0 {
+			if crc32.Checksum(parity, crcTable) != crcs[count] {
+				return repaired, ErrUnrepairable
+			}
+			rebuilt := shards[damaged]
+			copy(rebuilt, parity)
+			for i := 0; i < count; i++ {
+				if i != damaged {
+					xor(rebuilt, shards[i])
+				}
+			}
+			if crc32.Checksum(rebuilt, crcTable) != crcs[damaged] {
+				return repaired, ErrUnrepairable
+			}
+			repaired++
+		}
+
+		for i := 0; i < count; i++ {
+			if _, err := w.Write(shards[i][:lengths[i]]); err != nil {
+				return repaired, err
+			}
+		}
+	}
+	return repaired, nil
+}
+
+// XOR src into dst
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
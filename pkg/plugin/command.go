@@ -0,0 +1,194 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// actionRequest is written as JSON to the stdin of action plugins
+type actionRequest struct {
+	Action string `json:"action"`
+	Repo   string `json:"repo"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// processRequest is written as JSON to the stdin of processor plugins
+type processRequest struct {
+	Result *store.StoreResult `json:"result"`
+}
+
+// processResponse may be written as JSON to stdout by processor plugins
+type processResponse struct {
+	Error string `json:"error"`
+}
+
+// Run an action plugin in the repository directory. Its output goes
+// straight to the user and a non-zero exit status fails the action.
+func commandAction(name string, command []string) func(ctx context.Context, env *Env) error {
+	return func(ctx context.Context, env *Env) error {
+		request, err := json.Marshal(actionRequest{
+			Action: name,
+			Repo:   env.Root,
+			Input:  env.Input,
+			Output: env.Output,
+			DryRun: env.DryRun,
+		})
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Dir = env.Root
+		cmd.Stdin = bytes.NewReader(request)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("plugin %s failed: %w", name, err)
+		}
+		return nil
+	}
+}
+
+// Run a processor plugin for a stored file. It fails by exiting with a
+// non-zero status or by answering with an error.
+func commandProcessor(command []string) store.Processor {
+	return store.ProcessorFunc(func(ctx context.Context, s *store.Store, result *store.StoreResult) error {
+		request, err := json.Marshal(processRequest{Result: result})
+		if err != nil {
+			return err
+		}
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stdin = bytes.NewReader(request)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return commandError(command, err, &stderr)
+		}
+
+		if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+			return nil
+		}
+		var response processResponse
+		if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+			return fmt.Errorf("%s: invalid response: %w", command[0], err)
+		}
+		if response.Error != "" {
+			return fmt.Errorf("%s: %s", command[0], response.Error)
+		}
+		return nil
+	})
+}
+
+// commandCodec runs "command compress <name>" and "command decompress",
+// which filter their stdin to their stdout
+type commandCodec struct {
+	command   []string
+	extension string
+}
+
+func (c *commandCodec) Extension() string {
+	return c.extension
+}
+
+func (c *commandCodec) NewWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	cmd := c.cmd("compress", name)
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", c.command[0], err)
+	}
+	return &commandWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (c *commandCodec) NewReader(r io.Reader) (io.ReadCloser, string, error) {
+	cmd := c.cmd("decompress")
+	cmd.Stdin = r
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, "", fmt.Errorf("failed to start %s: %w", c.command[0], err)
+	}
+	return &commandReader{cmd: cmd, stdout: stdout}, "", nil
+}
+
+// Build the command for a codec operation, collecting its stderr for
+// error messages
+func (c *commandCodec) cmd(args ...string) *exec.Cmd {
+	cmd := exec.Command(c.command[0], append(c.command[1:], args...)...)
+	cmd.Stderr = &bytes.Buffer{}
+	return cmd
+}
+
+// commandWriter feeds a compressing command
+type commandWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func (w *commandWriter) Write(p []byte) (int, error) {
+	return w.stdin.Write(p)
+}
+
+// Close ends the input and waits for the command to write the rest
+func (w *commandWriter) Close() error {
+	closeErr := w.stdin.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return commandError(w.cmd.Args, err, w.cmd.Stderr.(*bytes.Buffer))
+	}
+	return closeErr
+}
+
+// commandReader reads the output of a decompressing command. A command
+// that fails turns the end of its output into an error.
+type commandReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	done   bool
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if errors.Is(err, io.EOF) && !r.done {
+		r.done = true
+		if waitErr := r.cmd.Wait(); waitErr != nil {
+			return n, commandError(r.cmd.Args, waitErr, r.cmd.Stderr.(*bytes.Buffer))
+		}
+	}
+	return n, err
+}
+
+// Close stops the command if its output was not read to the end
+func (r *commandReader) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	_ = r.cmd.Process.Kill()
+	_ = r.cmd.Wait()
+	return nil
+}
+
+// Describe a failed command, including what it wrote to stderr
+func commandError(command []string, err error, stderr *bytes.Buffer) error {
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		return fmt.Errorf("%s: %w: %s", command[0], err, message)
+	}
+	return fmt.Errorf("%s: %w", command[0], err)
+}
@@ -0,0 +1,122 @@
+// Package plugin lets third parties add actions, storage backends,
+// compression codecs and post-store processors without forking the tool.
+// Go plugins are packages that register themselves from an init function,
+// using RegisterAction, store.RegisterBackend, archive.RegisterCodec or
+// store.RegisterProcessor, and are linked in with a blank import. Command
+// plugins are external programs described by a Command.
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"sort"
+)
+
+// Env is the repository and arguments an action runs with
+type Env struct {
+	Root    string // repository directory
+	Store   *store.Store
+	DB      *db.DB
+	Input   string
+	Output  string
+	DryRun  bool
+	Options fsutil.Options
+}
+
+// Action is an additional CLI action
+type Action struct {
+	Name        string
+	Description string
+	Run         func(ctx context.Context, env *Env) error
+}
+
+var actions = map[string]Action{}
+
+// RegisterAction makes an action available under its name. It is meant to
+// be called from the init function of the package providing the action and
+// panics if the name is taken.
+func RegisterAction(a Action) {
+	if _, exists := actions[a.Name]; exists {
+		panic("plugin: action " + a.Name + " registered twice")
+	}
+	actions[a.Name] = a
+}
+
+// LookupAction returns the action registered under name
+func LookupAction(name string) (Action, bool) {
+	a, ok := actions[name]
+	return a, ok
+}
+
+// ActionNames returns the names of the registered actions, sorted
+func ActionNames() []string {
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Plugin kinds a Command can provide
+const (
+	KindAction    = "action"
+	KindCodec     = "codec"
+	KindProcessor = "processor"
+)
+
+// Command describes a plugin implemented by an external program
+type Command struct {
+	Kind        string   `json:"kind"`
+	Command     []string `json:"command"`     // program and arguments
+	Extension   string   `json:"extension"`   // codec: file name extension, dot included
+	Description string   `json:"description"` // action: shown in the usage message
+}
+
+// Validate checks that the command is complete
+func (c Command) Validate() error {
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return fmt.Errorf("no command given")
+	}
+	switch c.Kind {
+	case KindAction, KindProcessor:
+		return nil
+	case KindCodec:
+		if c.Extension == "" {
+			return fmt.Errorf("codec plugins need an extension")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown plugin kind %q (use %s, %s or %s)", c.Kind, KindAction, KindCodec, KindProcessor)
+	}
+}
+
+// Load registers a command plugin under name
+func Load(name string, c Command) error {
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("plugin %s: %w", name, err)
+	}
+
+	switch c.Kind {
+	case KindAction:
+		if _, exists := actions[name]; exists {
+			return fmt.Errorf("plugin %s: action already registered", name)
+		}
+		RegisterAction(Action{Name: name, Description: c.Description, Run: commandAction(name, c.Command)})
+	case KindCodec:
+		if _, err := archive.LookupCodec(name); err == nil {
+			return fmt.Errorf("plugin %s: codec already registered", name)
+		}
+		archive.RegisterCodec(name, &commandCodec{command: c.Command, extension: c.Extension})
+	case KindProcessor:
+		if _, err := store.LookupProcessor(name); err == nil {
+			return fmt.Errorf("plugin %s: processor already registered", name)
+		}
+		store.RegisterProcessor(name, commandProcessor(c.Command))
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Package policy enforces the content policy of a repository: rules
+// rejecting or warning about files by name and size as they are stored or
+// backed up.
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"path"
+	"strings"
+)
+
+// What a rule does with the files it covers
+const (
+	Reject = "reject" // leave them out
+	Warn   = "warn"   // take them, reporting them
+)
+
+// ErrRejected is wrapped by the errors of files a rule leaves out
+var ErrRejected = errors.New("rejected by content policy")
+
+// Rule covers the files matching all of its conditions, every file when it
+// has none
+type Rule struct {
+	Name string `json:"name"` // reported with violations; describes the conditions when empty
+
+	// Match is a pattern of names as by fsutil.MatchGlob, such as *.pst;
+	// a pattern without a slash matches base names anywhere
+	Match string `json:"match"`
+
+	LargerThan string `json:"larger_than"` // a size such as 10G
+	Action     string `json:"action"`      // Reject or Warn
+}
+
+// Policy is a validated list of rules
+type Policy struct {
+	rules []rule
+}
+
+// rule is a Rule with its size parsed
+type rule struct {
+	Rule
+	larger int64 // -1 for any size
+}
+
+// New validates rules into a policy
+func New(rules []Rule) (*Policy, error) {
+	p := &Policy{}
+	for i, r := range rules {
+		switch r.Action {
+		case Reject, Warn:
+		default:
+			return nil, fmt.Errorf("rule %d has unknown action %q (use %s, %s)", i+1, r.Action, Reject, Warn)
+		}
+		if r.Match != "" {
+			if _, err := fsutil.MatchGlob(r.Match, ""); err != nil {
+				return nil, fmt.Errorf("rule %d has an invalid pattern %q: %w", i+1, r.Match, err)
+			}
+		}
+		parsed := rule{Rule: r, larger: -1}
+		if r.LargerThan != "" {
+			size, err := fsutil.ParseSize(r.LargerThan)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			parsed.larger = size
+		}
+		if parsed.Name == "" {
+			parsed.Name = parsed.describe()
+		}
+		p.rules = append(p.rules, parsed)
+	}
+	return p, nil
+}
+
+// Describe the conditions of a rule
+func (r rule) describe() string {
+	var conditions []string
+	if r.Match != "" {
+		conditions = append(conditions, r.Match)
+	}
+	if r.larger >= 0 {
+		conditions = append(conditions, "larger than "+r.LargerThan)
+	}
+	if len(conditions) == 0 {
+		return r.Action + " every file"
+	}
+	return r.Action + " " + strings.Join(conditions, " ")
+}
+
+// Report whether the rule covers a file
+func (r rule) covers(name string, size int64) bool {
+	if r.larger >= 0 && size <= r.larger {
+		return false
+	}
+	if r.Match == "" {
+		return true
+	}
+	if !strings.Contains(r.Match, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := fsutil.MatchGlob(r.Match, name)
+	return ok
+}
+
+// Violation is a file a rule covers
+type Violation struct {
+	Rule   string
+	Action string
+}
+
+// Check returns the rules covering a file of the given slash-separated
+// name and size, rejecting ones first
+func (p *Policy) Check(name string, size int64) []Violation {
+	var rejected, warned []Violation
+	for _, r := range p.rules {
+		if !r.covers(name, size) {
+			continue
+		}
+		v := Violation{Rule: r.Name, Action: r.Action}
+		if r.Action == Reject {
+			rejected = append(rejected, v)
+		} else {
+			warned = append(warned, v)
+		}
+	}
+	return append(rejected, warned...)
+}
+
+// Admit returns the fsutil.Options.Admit enforcing the policy. Every
+// violation is logged in metadata as a policy_reject or policy_warn action,
+// and warnings are reported to observer.
+func (p *Policy) Admit(metadata *db.DB, observer event.Observer) func(ctx context.Context, op, name string, size int64) error {
+	return func(ctx context.Context, op, name string, size int64) error {
+		violations := p.Check(name, size)
+		for _, v := range violations {
+			err := fmt.Errorf("%s: %w: %s", name, ErrRejected, v.Rule)
+			if v.Action == Warn {
+				err = fmt.Errorf("content policy warns: %s", v.Rule)
+			}
+			logErr := db.RecordAction(context.WithoutCancel(ctx), metadata, db.Action{ActionType: "policy_" + v.Action, Filename: name, StorageID: op, Bytes: size, Err: err})
+			if logErr != nil {
+				observer.OnError(event.Error{Op: op, Name: name, Err: fmt.Errorf("failed to log policy violation: %w", logErr)})
+			}
+			if v.Action == Reject {
+				return err
+			}
+			observer.OnError(event.Error{Op: op, Name: name, Err: err})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,130 @@
+// Package ratelimit throttles streaming I/O to a fixed number of bytes per second.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by all readers and writers it wraps. A
+// nil *Limiter does not limit anything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter allowing bytesPerSec bytes per second, which must
+// be at least 1
+func New(bytesPerSec int64) *Limiter {
+	burst := float64(bytesPerSec)
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Block until n bytes may pass through the limiter or ctx is done. The
+// bytes are taken from the bucket right away, running it into debt that
+// later callers wait for too, and the wait happens without holding the lock.
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader limits the rate at which data is read
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > int(t.limiter.burst) {
+		p = p[:int(t.limiter.burst)]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// throttledWriter limits the rate at which data is written
+type throttledWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *Limiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > int(t.limiter.burst) {
+			chunk = chunk[:int(t.limiter.burst)]
+		}
+		if err := t.limiter.wait(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Reader wraps r so that reads are throttled by the limiter, failing with
+// the error of ctx once it is done
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: l}
+}
+
+// Writer wraps w so that writes are throttled by the limiter, failing with
+// the error of ctx once it is done
+func (l *Limiter) Writer(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &throttledWriter{ctx: ctx, w: w, limiter: l}
+}
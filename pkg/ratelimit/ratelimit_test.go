@@ -0,0 +1,42 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/Lenstack/file_manager_version/pkg/ratelimit"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWriterStopsWhenCanceled(t *testing.T) {
+	// The burst passes at once, after which a byte per second is allowed
+	limiter := ratelimit.New(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var out bytes.Buffer
+	start := time.Now()
+	_, err := limiter.Writer(ctx, &out).Write(make([]byte, 64*1024))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("throttled write gave %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled write returned after %v", elapsed)
+	}
+	if out.Len() != 32*1024 {
+		t.Errorf("%d bytes written, want the burst of %d", out.Len(), 32*1024)
+	}
+}
+
+func TestReaderStopsWhenCanceled(t *testing.T) {
+	limiter := ratelimit.New(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := io.Copy(io.Discard, limiter.Reader(ctx, bytes.NewReader(make([]byte, 64*1024))))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("throttled read gave %v, want it canceled", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Package retry repeats operations that fail in ways waiting may fix, such
+// as a flaky network mount, a throttled object store or a busy database.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// Policy says how often and how patiently an operation is retried. The
+// zero Policy tries operations once.
+type Policy struct {
+	// Attempts is how often an operation is tried in all, the first time
+	// included; 0 and 1 try it once
+	Attempts int
+
+	// Backoff is the wait before the first retry, which doubles before
+	// each following one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable reports whether an error is worth retrying; nil means
+	// Transient
+	Retryable func(error) bool
+
+	// OnRetry, if set, is called before waiting to retry after err
+	OnRetry func(err error, attempt int, wait time.Duration)
+}
+
+// Default is the policy used unless configured otherwise
+var Default = Policy{Attempts: 3, Backoff: 200 * time.Millisecond, MaxBackoff: 5 * time.Second}
+
+// Do calls fn until it succeeds, fails with an error that is not worth
+// retrying, or has been tried Attempts times, waiting between the tries.
+// It returns the last error, and the context's error when ctx ends while
+// waiting.
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = Transient
+	}
+	wait := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(err, attempt, wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		wait = min(wait*2, max(p.MaxBackoff, p.Backoff))
+	}
+}
+
+// Or returns a copy of the policy that also retries the errors retryable
+// reports worth it
+func (p Policy) Or(retryable func(error) bool) Policy {
+	first := p.Retryable
+	if first == nil {
+		first = Transient
+	}
+	p.Retryable = func(err error) bool {
+		return first(err) || retryable(err)
+	}
+	return p
+}
+
+// Transient reports whether err looks like a failure that goes away by
+// itself: interrupted and timed out system calls, dropped connections,
+// stale NFS handles, I/O errors, and errors whose Temporary or Timeout
+// method says so, as net errors and plugin backends can tell. Missing
+// files, permissions and cancellations are not.
+func Transient(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrExist), errors.Is(err, fs.ErrPermission):
+		return false
+	case errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.EIO), errors.Is(err, syscall.ESTALE), errors.Is(err, syscall.EBUSY),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// ParsePolicy builds a policy from its configured settings: attempts, and
+// the backoff durations such as 200ms. Empty durations keep those of
+// Default, and attempts of 0 keep its attempts.
+func ParsePolicy(attempts int, backoff, maxBackoff string) (Policy, error) {
+	p := Default
+	if attempts < 0 {
+		return p, fmt.Errorf("invalid retry attempts %d: must not be negative", attempts)
+	}
+	if attempts > 0 {
+		p.Attempts = attempts
+	}
+	for _, setting := range []struct {
+		value string
+		dest  *time.Duration
+	}{{backoff, &p.Backoff}, {maxBackoff, &p.MaxBackoff}} {
+		if setting.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(setting.value)
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("invalid retry backoff %q", setting.value)
+		}
+		*setting.dest = d
+	}
+	return p, nil
+}
@@ -0,0 +1,86 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// clamdChunk is how much content each INSTREAM chunk carries
+const clamdChunk = 64 << 10
+
+// clamd scans with the INSTREAM command of a clamd daemon. Content beyond
+// its StreamMaxLength fails to scan rather than passing unchecked.
+type clamd struct {
+	network, address string
+	timeout          time.Duration
+}
+
+func (c *clamd) Scan(ctx context.Context, name string, r io.Reader) (Result, error) {
+	conn, done, err := dial(ctx, c.network, c.address, c.timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer done()
+
+	w := bufio.NewWriterSize(conn, clamdChunk+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return Result{}, c.failed(ctx, err)
+	}
+	buf := make([]byte, clamdChunk)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+				return Result{}, c.failed(ctx, err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return Result{}, c.failed(ctx, err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return Result{}, fmt.Errorf("failed to read %s: %w", name, readErr)
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+		return Result{}, c.failed(ctx, err)
+	}
+	if err := w.Flush(); err != nil {
+		return Result{}, c.failed(ctx, err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return Result{}, c.failed(ctx, err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// Return the cancellation of ctx when it cut a scan short, or err
+func (c *clamd) failed(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("failed to scan with clamd at %s: %w", c.address, err)
+}
+
+// Parse a reply to INSTREAM: "stream: OK", "stream: SIGNATURE FOUND" or
+// an error such as "INSTREAM size limit exceeded. ERROR"
+func parseClamdReply(reply string) (Result, error) {
+	status := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd could not scan: %s", reply)
+	}
+}
@@ -0,0 +1,128 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icap scans with RESPMOD requests to an ICAP service (RFC 3507), sending
+// the content as the body of an HTTP response for it to check
+type icap struct {
+	url     *url.URL
+	timeout time.Duration
+}
+
+// icapInfectionHeaders are the headers ICAP servers name what they found in
+var icapInfectionHeaders = []string{"X-Infection-Found", "X-Violations-Found", "X-Virus-ID"}
+
+func (c *icap) Scan(ctx context.Context, name string, r io.Reader) (Result, error) {
+	conn, done, err := dial(ctx, "tcp", c.url.Host, c.timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer done()
+
+	httpHeader := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=" + strconv.Quote(name) + "\r\n\r\n"
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\n", c.url)
+	fmt.Fprintf(w, "Host: %s\r\n", c.url.Host)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(httpHeader))
+	w.WriteString(httpHeader)
+	buf := make([]byte, clamdChunk)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return Result{}, fmt.Errorf("failed to read %s: %w", name, readErr)
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return Result{}, c.failed(ctx, err)
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	status, err := reader.ReadLine()
+	if err != nil {
+		return Result{}, c.failed(ctx, err)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return Result{}, c.failed(ctx, err)
+	}
+	code, err := icapStatus(status)
+	if err != nil {
+		return Result{}, err
+	}
+	for _, key := range icapInfectionHeaders {
+		if found := header.Get(key); found != "" {
+			return Result{Infected: true, Signature: icapThreat(found)}, nil
+		}
+	}
+	switch {
+	case code == 204:
+		return Result{}, nil
+	case code != 200:
+		return Result{}, fmt.Errorf("ICAP service %s could not scan: %s", c.url, status)
+	}
+
+	// Some services answer with the page blocking the download instead
+	if !strings.Contains(header.Get("Encapsulated"), "res-hdr=0") {
+		return Result{}, nil
+	}
+	httpStatus, err := reader.ReadLine()
+	if err != nil {
+		return Result{}, c.failed(ctx, err)
+	}
+	if fields := strings.Fields(httpStatus); len(fields) >= 2 && fields[1] == "403" {
+		return Result{Infected: true, Signature: "blocked by " + c.url.Host}, nil
+	}
+	return Result{}, nil
+}
+
+// Return the cancellation of ctx when it cut a scan short, or err
+func (c *icap) failed(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("failed to scan with ICAP service %s: %w", c.url, err)
+}
+
+// Parse the status code of an ICAP status line such as "ICAP/1.0 204 No Content"
+func icapStatus(line string) (int, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return 0, fmt.Errorf("invalid ICAP response %q", line)
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid ICAP response %q", line)
+	}
+	return code, nil
+}
+
+// Return the threat named in an X-Infection-Found value such as
+// "Type=0; Resolution=2; Threat=Eicar-Test-Signature;", or the value
+func icapThreat(value string) string {
+	for _, part := range strings.Split(value, ";") {
+		if threat, ok := strings.CutPrefix(strings.TrimSpace(part), "Threat="); ok {
+			return threat
+		}
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,82 @@
+// Package scan checks content for viruses with a clamd daemon or an ICAP
+// server as it is stored.
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// DefaultTimeout bounds a scan, from connecting to the verdict
+const DefaultTimeout = 2 * time.Minute
+
+// Result is the verdict on scanned content
+type Result struct {
+	Infected  bool
+	Signature string // what was found, such as Eicar-Signature
+}
+
+// Scanner checks content for viruses. Name is the file the content is
+// stored as, for the scanner's logs.
+type Scanner interface {
+	Scan(ctx context.Context, name string, r io.Reader) (Result, error)
+}
+
+// New returns the scanner at address: unix:///path or tcp://host:port for
+// clamd, icap://host:port/service for ICAP. A scan taking longer than
+// timeout fails; 0 means DefaultTimeout.
+func New(address string, timeout time.Duration) (Scanner, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scanner address %q: %w", address, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid scanner address %q: no socket path", address)
+		}
+		return &clamd{network: "unix", address: u.Path, timeout: timeout}, nil
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid scanner address %q: no host", address)
+		}
+		return &clamd{network: "tcp", address: u.Host, timeout: timeout}, nil
+	case "icap":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid scanner address %q: no host", address)
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1344")
+		}
+		return &icap{url: u, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("invalid scanner address %q (use unix:///path or tcp://host:port for clamd, icap://host:port/service)", address)
+	}
+}
+
+// Connect to a scanner, with the connection closed when ctx is cancelled
+// or the timeout passes
+func dial(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("failed to connect to scanner %s: %w", address, err)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	return conn, func() {
+		stop()
+		cancel()
+		_ = conn.Close()
+	}, nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"net/http"
+	"strings"
+)
+
+// Roles, each allowed everything the ones before it are
+const (
+	RoleReadOnly = "read-only" // browse and download
+	RoleOperator = "operator"  // also upload files and run jobs
+	RoleAdmin    = "admin"     // everything
+)
+
+// roleRanks orders the roles by what they are allowed
+var roleRanks = map[string]int{RoleReadOnly: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// User is a principal allowed to use the server. Users authenticate with
+// their API token, as a bearer token or as the password of basic auth
+// under their name, which WebDAV clients need. S3 clients sign requests
+// with the user's name as access key and S3Secret as secret key; as the
+// signatures can only be checked with the secret itself, it is kept as is.
+type User struct {
+	Name        string `json:"name"`
+	Role        string `json:"role"`
+	TokenSHA256 string `json:"token_sha256"`        // hex SHA-256 digest of the token, see NewToken
+	S3Secret    string `json:"s3_secret,omitempty"` // secret access key for the S3 gateway, which is closed to users without one
+}
+
+// NewToken generates a random API token and the digest to configure for it
+func NewToken() (token, digest string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token = hex.EncodeToString(secret)
+	return token, tokenDigest(token), nil
+}
+
+// Return the hex SHA-256 digest of a token
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetUsers restricts the server to the given users. Without users every
+// request is allowed and recorded without a principal.
+func (s *Server) SetUsers(users []User) error {
+	seen := map[string]bool{}
+	for _, u := range users {
+		if u.Name == "" {
+			return errors.New("every user needs a name")
+		}
+		if _, ok := roleRanks[u.Role]; !ok {
+			return fmt.Errorf("user %s has unknown role %q (use %s, %s or %s)", u.Name, u.Role, RoleReadOnly, RoleOperator, RoleAdmin)
+		}
+		if digest, err := hex.DecodeString(u.TokenSHA256); err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("user %s needs token_sha256 set to the hex SHA-256 digest of its token", u.Name)
+		}
+		if seen[u.Name] {
+			return fmt.Errorf("user %s is configured twice", u.Name)
+		}
+		seen[u.Name] = true
+	}
+	s.users = users
+	return nil
+}
+
+// Find the user a request authenticates as
+func (s *Server) authenticate(r *http.Request) (User, bool) {
+	var name, token string
+	if username, password, ok := r.BasicAuth(); ok {
+		name, token = username, password
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	return findUser(s.users, name, token)
+}
+
+// Find the user a token belongs to, also named name unless it is empty
+func findUser(users []User, name, token string) (User, bool) {
+	if token == "" {
+		return User{}, false
+	}
+
+	digest := []byte(tokenDigest(token))
+	var found User
+	matched := false
+	for _, u := range users {
+		// Every user is compared so that timing does not reveal which matched
+		if subtle.ConstantTimeCompare(digest, []byte(strings.ToLower(u.TokenSHA256))) == 1 && (name == "" || name == u.Name) {
+			found, matched = u, true
+		}
+	}
+	return found, matched
+}
+
+// Authorize finds the user of the given users a token belongs to, for
+// commands run outside the server that need a role, and fails unless the
+// user has at least role
+func Authorize(users []User, token, role string) (User, error) {
+	if len(users) == 0 {
+		return User{}, fmt.Errorf("no users are configured; add one with the %s role to server.users", role)
+	}
+	user, ok := findUser(users, "", token)
+	if !ok {
+		return User{}, errors.New("the token does not belong to any configured user")
+	}
+	if roleRanks[user.Role] < roleRanks[role] {
+		return User{}, fmt.Errorf("user %s has role %s; %s is required", user.Name, user.Role, role)
+	}
+	return user, nil
+}
+
+// Wrap a handler so that it only runs for users with at least the given
+// role, with the user, role and client address recorded as the origin of
+// its actions
+func (s *Server) require(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.users) == 0 {
+			handler(w, r.WithContext(db.WithOrigin(r.Context(), "", r.RemoteAddr)))
+			return
+		}
+		user, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="file manager", charset="UTF-8"`)
+			writeError(w, http.StatusUnauthorized, errors.New("authentication required"))
+			return
+		}
+		if roleRanks[user.Role] < roleRanks[role] {
+			writeError(w, http.StatusForbidden, fmt.Errorf("user %s has role %s; %s is required", user.Name, user.Role, role))
+			return
+		}
+		ctx := db.WithOrigin(db.WithPrincipal(r.Context(), user.Name), user.Role, r.RemoteAddr)
+		handler(w, r.WithContext(ctx))
+	}
+}
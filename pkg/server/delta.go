@@ -0,0 +1,124 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/delta"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Describe the blocks of a version, the latest unless the version query
+// parameter says otherwise, so that a client can upload a new version as a
+// delta against it
+func (s *Server) getSignature(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.requestedVersion(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	id := store.StorageID(v)
+	size, err := s.store.BlobSize(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+	content, err := s.store.OpenBlob(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+	defer func() {
+		_ = content.Close()
+	}()
+	sig, err := delta.Sign(content, delta.BlockSize(size))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+	w.Header().Set("X-Version", strconv.Itoa(v.Version))
+	writeJSON(w, http.StatusOK, sig)
+}
+
+// Fill an upload that has received nothing yet with the content the delta
+// in the request body describes against a version of the upload's file,
+// given by the version query parameter. The size query parameter declares
+// the bytes of the content, which the delta may not go beyond. A failed
+// delta leaves the upload empty, to be sent in chunks instead.
+func (s *Server) writeDelta(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.claimUpload(w, id) {
+		return
+	}
+	defer s.uploads.release(id)
+	upload, ok := s.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if upload.Offset != 0 {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeError(w, http.StatusConflict, fmt.Errorf("upload %s has received %d bytes already", id, upload.Offset))
+		return
+	}
+	target, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || target < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid size %q; deltas need the size of their content", r.URL.Query().Get("size")))
+		return
+	}
+	if !s.checkQuota(w, r) {
+		return
+	}
+	r.SetPathValue("name", upload.Filename)
+	v, ok := s.requestedVersion(w, r)
+	if !ok {
+		return
+	}
+
+	// Deltas copy blocks in any order, which needs the base at hand
+	ctx := r.Context()
+	base, err := os.CreateTemp(s.uploadDir, id+"-*.base")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer func() {
+		_ = base.Close()
+		_ = os.Remove(base.Name())
+	}()
+	content, err := s.store.OpenBlob(ctx, store.StorageID(v))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+	size, err := io.Copy(base, content)
+	_ = content.Close()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+
+	_, contentPath := s.uploadPaths(id)
+	f, err := os.OpenFile(contentPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	written, err := delta.Apply(base, size, r.Body, f, target)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Truncate(contentPath, 0)
+		status := http.StatusInternalServerError
+		if errors.Is(err, delta.ErrCorrupt) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, fmt.Errorf("failed to apply delta to upload %s: %w", id, err))
+		return
+	}
+	upload.Offset = written
+	writeJSON(w, http.StatusOK, upload)
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	filemanagerv1 "github.com/Lenstack/file_manager_version/api/filemanager/v1"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/policy"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// grpcChunkSize is how much content each message of a gRPC download carries
+const grpcChunkSize = 64 << 10
+
+// grpcRoles are the roles the gRPC methods need once SetUsers is called
+var grpcRoles = map[string]string{
+	filemanagerv1.FileManager_Store_FullMethodName:        RoleOperator,
+	filemanagerv1.FileManager_Retrieve_FullMethodName:     RoleReadOnly,
+	filemanagerv1.FileManager_ListFiles_FullMethodName:    RoleReadOnly,
+	filemanagerv1.FileManager_ListVersions_FullMethodName: RoleReadOnly,
+	filemanagerv1.FileManager_StartJob_FullMethodName:     RoleOperator,
+	filemanagerv1.FileManager_GetJob_FullMethodName:       RoleReadOnly,
+	filemanagerv1.FileManager_WatchJob_FullMethodName:     RoleReadOnly,
+}
+
+// GRPCServer returns a gRPC server serving the FileManager service of
+// api/filemanager/v1, the typed counterpart of Handler. Once SetUsers is
+// called, requests authenticate with a bearer token in their authorization
+// metadata and need the same roles as over HTTP.
+func (s *Server) GRPCServer() *grpc.Server {
+	g := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, err := s.authorizeRPC(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := s.authorizeRPC(stream.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, authorizedStream{ServerStream: stream, ctx: ctx})
+		}),
+	)
+	filemanagerv1.RegisterFileManagerServer(g, grpcService{s: s})
+	return g
+}
+
+// ServeGRPC serves the gRPC API on listener until ctx is cancelled, then
+// waits for the calls in flight as long as the HTTP API waits for its
+// requests. It leaves the jobs to Close.
+func (s *Server) ServeGRPC(ctx context.Context, listener net.Listener) error {
+	g := s.GRPCServer()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			g.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(shutdownTimeout):
+			g.Stop()
+		}
+	}()
+
+	if err := g.Serve(listener); err != nil {
+		g.Stop()
+		return fmt.Errorf("failed to serve gRPC: %w", err)
+	}
+	<-done
+	return nil
+}
+
+// Authenticate the caller of a gRPC method like require does for HTTP,
+// returning its context with the user, role and client address recorded as
+// the origin of its actions
+func (s *Server) authorizeRPC(ctx context.Context, method string) (context.Context, error) {
+	address := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		address = p.Addr.String()
+	}
+	if len(s.users) == 0 {
+		return db.WithOrigin(ctx, "", address), nil
+	}
+	token := ""
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if bearer, ok := strings.CutPrefix(value, "Bearer "); ok {
+			token = bearer
+		}
+	}
+	user, ok := findUser(s.users, "", token)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+	role, ok := grpcRoles[method]
+	if !ok {
+		role = RoleAdmin
+	}
+	if roleRanks[user.Role] < roleRanks[role] {
+		return nil, status.Errorf(codes.PermissionDenied, "user %s has role %s; %s is required", user.Name, user.Role, role)
+	}
+	return db.WithOrigin(db.WithPrincipal(ctx, user.Name), user.Role, address), nil
+}
+
+// authorizedStream is a server stream carrying the context authorizeRPC
+// returned
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcService implements the FileManager service over a Server
+type grpcService struct {
+	filemanagerv1.UnimplementedFileManagerServer
+	s *Server
+}
+
+func (g grpcService) Store(stream filemanagerv1.FileManager_StoreServer) error {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	name := first.GetFilename()
+	if name == "" {
+		return status.Error(codes.InvalidArgument, "the first message must carry the filename")
+	}
+	if code, err := g.s.quotaExceeded(ctx); err != nil {
+		return status.Error(httpCode(code), err.Error())
+	}
+	result, err := g.s.store.StoreReader(ctx, name, &chunkReader{stream: stream})
+	if err != nil {
+		return storeStatus(err)
+	}
+	return stream.SendAndClose(&filemanagerv1.StoreResult{
+		Filename:     result.Filename,
+		Hash:         result.Hash,
+		StorageId:    result.StorageID,
+		Version:      int32(result.Version),
+		Duplicate:    result.Duplicate,
+		Bytes:        result.Bytes,
+		BytesWritten: result.BytesWritten,
+	})
+}
+
+// chunkReader reads the content of a Store call from the messages after
+// the first
+type chunkReader struct {
+	stream filemanagerv1.FileManager_StoreServer
+	chunk  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := msg.GetPart().(*filemanagerv1.StoreRequest_Chunk); !ok {
+			return 0, errors.New("only the first message may carry the filename")
+		}
+		r.chunk = msg.GetChunk()
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (g grpcService) Retrieve(req *filemanagerv1.RetrieveRequest, stream filemanagerv1.FileManager_RetrieveServer) error {
+	ctx := stream.Context()
+	if req.GetVersion() < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid version %d", req.GetVersion())
+	}
+	name, err := db.ResolveName(ctx, g.s.db, fsutil.NormalizeName(req.GetFilename()))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	v, err := db.GetVersion(ctx, g.s.db, name, int(req.GetVersion()))
+	if errors.Is(err, db.ErrNoVersion) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	id := store.StorageID(v)
+	size, err := g.s.store.BlobSize(ctx, id)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to open %s version %d: %v", v.Filename, v.Version, err)
+	}
+	content, err := g.s.store.OpenBlob(ctx, id)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to open %s version %d: %v", v.Filename, v.Version, err)
+	}
+	defer func() {
+		_ = content.Close()
+	}()
+
+	version := versionMessage(v)
+	version.Bytes = size
+	if err := stream.Send(&filemanagerv1.RetrieveResponse{Part: &filemanagerv1.RetrieveResponse_Version{Version: version}}); err != nil {
+		return err
+	}
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := content.Read(buf)
+		if n > 0 {
+			chunk := &filemanagerv1.RetrieveResponse_Chunk{Chunk: buf[:n]}
+			if err := stream.Send(&filemanagerv1.RetrieveResponse{Part: chunk}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The content sent so far fails the hash the client was sent
+			return status.Errorf(codes.DataLoss, "failed to read %s version %d: %v", v.Filename, v.Version, err)
+		}
+	}
+	g.s.logRetrieve(ctx, v.Filename, id)
+	return nil
+}
+
+func (g grpcService) ListFiles(ctx context.Context, _ *filemanagerv1.ListFilesRequest) (*filemanagerv1.ListFilesResponse, error) {
+	versions, err := g.s.store.Versions(ctx, "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// Versions are ordered by file, then version
+	resp := &filemanagerv1.ListFilesResponse{}
+	for i, v := range versions {
+		if i+1 == len(versions) || versions[i+1].Filename != v.Filename {
+			resp.Files = append(resp.Files, versionMessage(v))
+		}
+	}
+	return resp, nil
+}
+
+func (g grpcService) ListVersions(ctx context.Context, req *filemanagerv1.ListVersionsRequest) (*filemanagerv1.ListVersionsResponse, error) {
+	versions, err := g.s.store.Versions(ctx, req.GetFilename())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(versions) == 0 {
+		return nil, status.Errorf(codes.NotFound, "%s: %v", req.GetFilename(), db.ErrNoVersion)
+	}
+	resp := &filemanagerv1.ListVersionsResponse{}
+	for _, v := range versions {
+		resp.Versions = append(resp.Versions, versionMessage(v))
+	}
+	return resp, nil
+}
+
+func (g grpcService) StartJob(ctx context.Context, req *filemanagerv1.StartJobRequest) (*filemanagerv1.Job, error) {
+	var kind string
+	var fn jobFunc
+	switch job := req.GetJob().(type) {
+	case *filemanagerv1.StartJobRequest_Deduplicate:
+		if job.Deduplicate.GetDirectory() == "" {
+			return nil, status.Error(codes.InvalidArgument, "directory is required")
+		}
+		directory, err := g.s.jobPath(job.Deduplicate.GetDirectory())
+		if err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		kind, fn = "deduplicate", g.s.deduplicateJob(directory)
+	case *filemanagerv1.StartJobRequest_Backup:
+		if job.Backup.GetDirectory() == "" || job.Backup.GetOutput() == "" {
+			return nil, status.Error(codes.InvalidArgument, "directory and output are required")
+		}
+		directory, err := g.s.jobPath(job.Backup.GetDirectory())
+		if err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		output, err := g.s.jobPath(job.Backup.GetOutput())
+		if err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		kind, fn = "backup", g.s.backupJob(directory, output)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "a deduplicate or backup job is required")
+	}
+	j, err := g.s.submit(ctx, kind, fn)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return jobMessage(j.snapshot()), nil
+}
+
+func (g grpcService) GetJob(ctx context.Context, req *filemanagerv1.GetJobRequest) (*filemanagerv1.Job, error) {
+	j, err := g.s.findJob(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return jobMessage(j.snapshot()), nil
+}
+
+func (g grpcService) WatchJob(req *filemanagerv1.GetJobRequest, stream filemanagerv1.FileManager_WatchJobServer) error {
+	j, err := g.s.findJob(req.GetId())
+	if err != nil {
+		return err
+	}
+	send := func(p Progress) error {
+		return stream.Send(&filemanagerv1.Progress{
+			Type:      p.Type,
+			Name:      p.Name,
+			StorageId: p.StorageID,
+			Original:  p.Original,
+			Files:     int32(p.Files),
+			Bytes:     p.Bytes,
+			Error:     p.Error,
+			State:     jobState(p.State),
+		})
+	}
+	// Messages are sent as they come
+	return j.follow(stream.Context(), send, func() {})
+}
+
+// Look up a job for a gRPC call
+func (s *Server) findJob(id string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no job %q", id)
+	}
+	return j, nil
+}
+
+// Return the status of a file that could not be stored, like
+// writeStoreError does for HTTP
+func storeStatus(err error) error {
+	if errors.Is(err, store.ErrInfected) || errors.Is(err, policy.ErrRejected) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Return the gRPC code of an HTTP error status
+func httpCode(code int) codes.Code {
+	switch code {
+	case http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	default:
+		return codes.Internal
+	}
+}
+
+func versionMessage(v db.Version) *filemanagerv1.Version {
+	return &filemanagerv1.Version{
+		Filename:  v.Filename,
+		Version:   int32(v.Version),
+		Hash:      v.Hash,
+		Path:      v.Path,
+		Timestamp: timestamppb.New(v.Timestamp),
+	}
+}
+
+func jobMessage(info Job) *filemanagerv1.Job {
+	msg := &filemanagerv1.Job{
+		Id:    info.ID,
+		Kind:  info.Kind,
+		State: jobState(info.State),
+		Error: info.Error,
+	}
+	if info.Started != nil {
+		msg.Started = timestamppb.New(*info.Started)
+	}
+	if info.Finished != nil {
+		msg.Finished = timestamppb.New(*info.Finished)
+	}
+	return msg
+}
+
+var jobStates = map[string]filemanagerv1.Job_State{
+	JobQueued:    filemanagerv1.Job_STATE_QUEUED,
+	JobRunning:   filemanagerv1.Job_STATE_RUNNING,
+	JobSucceeded: filemanagerv1.Job_STATE_SUCCEEDED,
+	JobFailed:    filemanagerv1.Job_STATE_FAILED,
+	JobCancelled: filemanagerv1.Job_STATE_CANCELLED,
+}
+
+// Return the message state of a job state, unspecified for none
+func jobState(state string) filemanagerv1.Job_State {
+	return jobStates[state]
+}
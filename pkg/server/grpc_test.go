@@ -0,0 +1,165 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	filemanagerv1 "github.com/Lenstack/file_manager_version/api/filemanager/v1"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Serve the gRPC API of a server on an in-memory repository, configured by
+// setup, and return a client of it
+func newGRPCClient(t *testing.T, setup func(*server.Server)) filemanagerv1.FileManagerClient {
+	t.Helper()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	api := server.New(repo.Store, repo.DB, repo.Store.Algorithm(), repo.Options)
+	t.Cleanup(api.Close)
+	if setup != nil {
+		setup(api)
+	}
+	listener := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- api.ServeGRPC(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("serving gRPC failed: %v", err)
+		}
+	})
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return filemanagerv1.NewFileManagerClient(conn)
+}
+
+// Store content under name in chunks of a few bytes
+func storeGRPC(ctx context.Context, client filemanagerv1.FileManagerClient, name, content string) (*filemanagerv1.StoreResult, error) {
+	stream, err := client.Store(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&filemanagerv1.StoreRequest{Part: &filemanagerv1.StoreRequest_Filename{Filename: name}}); err != nil {
+		return nil, err
+	}
+	for rest := content; rest != ""; {
+		chunk := rest[:min(4, len(rest))]
+		rest = rest[len(chunk):]
+		if err := stream.Send(&filemanagerv1.StoreRequest{Part: &filemanagerv1.StoreRequest_Chunk{Chunk: []byte(chunk)}}); err != nil {
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestGRPCStoreAndRetrieve(t *testing.T) {
+	ctx := context.Background()
+	client := newGRPCClient(t, nil)
+
+	result, err := storeGRPC(ctx, client, "docs/a.txt", "alpha\n")
+	if err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if result.Filename != "docs/a.txt" || result.Version != 1 || result.Bytes != 6 || result.Duplicate {
+		t.Errorf("store gave %+v", result)
+	}
+	if result, err := storeGRPC(ctx, client, "docs/a.txt", "alpha\n"); err != nil || !result.Duplicate {
+		t.Errorf("storing a duplicate gave %+v (%v)", result, err)
+	}
+	if _, err := storeGRPC(ctx, client, "docs/a.txt", "alpha 2\n"); err != nil {
+		t.Fatalf("storing a new version failed: %v", err)
+	}
+
+	for version, want := range []string{"alpha 2\n", "alpha\n"} {
+		stream, err := client.Retrieve(ctx, &filemanagerv1.RetrieveRequest{Filename: "docs/a.txt", Version: int32(version)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("retrieving version %d failed: %v", version, err)
+		}
+		if v := first.GetVersion(); v == nil || v.Bytes != int64(len(want)) {
+			t.Errorf("version %d described as %+v", version, v)
+		}
+		var content bytes.Buffer
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("retrieving version %d failed: %v", version, err)
+			}
+			content.Write(msg.GetChunk())
+		}
+		if content.String() != want {
+			t.Errorf("version %d holds %q, want %q", version, content.String(), want)
+		}
+	}
+
+	files, err := client.ListFiles(ctx, &filemanagerv1.ListFilesRequest{})
+	if err != nil || len(files.Files) != 1 || files.Files[0].Version != 2 {
+		t.Errorf("listing gave %+v (%v)", files, err)
+	}
+	if _, err := client.ListVersions(ctx, &filemanagerv1.ListVersionsRequest{Filename: "missing.txt"}); status.Code(err) != codes.NotFound {
+		t.Errorf("versions of a missing file gave %v", err)
+	}
+}
+
+func TestGRPCRoles(t *testing.T) {
+	readerToken, readerDigest, err := server.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newGRPCClient(t, func(api *server.Server) {
+		err := api.SetUsers([]server.User{{Name: "reader", Role: server.RoleReadOnly, TokenSHA256: readerDigest}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, tc := range []struct {
+		token string
+		list  codes.Code
+		store codes.Code
+	}{
+		{"", codes.Unauthenticated, codes.Unauthenticated},
+		{"wrong", codes.Unauthenticated, codes.Unauthenticated},
+		{readerToken, codes.OK, codes.PermissionDenied},
+	} {
+		ctx := context.Background()
+		if tc.token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tc.token)
+		}
+		if _, err := client.ListFiles(ctx, &filemanagerv1.ListFilesRequest{}); status.Code(err) != tc.list {
+			t.Errorf("listing with token %q gave %v, want %v", tc.token, err, tc.list)
+		}
+		if _, err := storeGRPC(ctx, client, "a.txt", strings.Repeat("a", 10)); status.Code(err) != tc.store {
+			t.Errorf("storing with token %q gave %v, want %v", tc.token, err, tc.store)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/archive"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/dedup"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job describes a long-running operation started through the API
+type Job struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	User      string     `json:"user,omitempty"` // who started the job
+	State     string     `json:"state"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"` // once it leaves the queue
+	Finished  *time.Time `json:"finished,omitempty"`
+	Paused    bool       `json:"paused,omitempty"` // held until resumed
+	Error     string     `json:"error,omitempty"`
+	Result    any        `json:"result,omitempty"`
+}
+
+// job is a running or finished Job and the progress it reported. It is
+// the Observer of its operation.
+type job struct {
+	mu       sync.Mutex
+	info     Job
+	progress []Progress
+	changed  chan struct{} // closed and replaced whenever progress is added
+	done     chan struct{} // closed once it finished
+	observer event.Observer
+	cancel   context.CancelFunc
+	pause    fsutil.Pause
+	pauses   []*fsutil.Pause // its own and the server's
+}
+
+// Progress is one event of a running job
+type Progress struct {
+	Type      string `json:"type"`         // file_stored, duplicate_found, backup_progress, error or finished
+	Op        string `json:"op,omitempty"` // of a duplicate found or an error
+	Name      string `json:"name,omitempty"`
+	StorageID string `json:"storage_id,omitempty"`
+	Path      string `json:"path,omitempty"` // blob of a stored file
+	Original  string `json:"original,omitempty"`
+	Files     int    `json:"files,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+	State     string `json:"state,omitempty"` // of a finished job
+}
+
+// Record a progress event and wake the streams following the job
+func (j *job) add(p Progress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.progress = append(j.progress, p)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *job) OnFileStored(e event.FileStored) {
+	j.observer.OnFileStored(e)
+	j.add(Progress{Type: "file_stored", Name: e.Name, StorageID: e.StorageID, Path: e.Path, Bytes: e.Bytes})
+}
+
+func (j *job) OnDuplicateFound(e event.DuplicateFound) {
+	j.observer.OnDuplicateFound(e)
+	j.add(Progress{Type: "duplicate_found", Op: e.Op, Name: e.Name, Original: e.Original, Bytes: e.Bytes})
+}
+
+func (j *job) OnBackupProgress(e event.BackupProgress) {
+	j.observer.OnBackupProgress(e)
+	j.add(Progress{Type: "backup_progress", Name: e.Name, Files: e.Files, Bytes: e.Bytes})
+}
+
+func (j *job) OnError(e event.Error) {
+	j.observer.OnError(e)
+	j.add(Progress{Type: "error", Op: e.Op, Name: e.Name, Error: fmt.Sprintf("%s: %v", e.Op, e.Err)})
+}
+
+// Return the current description of the job
+func (j *job) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info := j.info
+	if info.Finished == nil {
+		for _, p := range j.pauses {
+			info.Paused = info.Paused || p.Paused()
+		}
+	}
+	return info
+}
+
+// jobFunc runs a job, reporting progress through the options it is given
+type jobFunc func(ctx context.Context, opts fsutil.Options) (any, error)
+
+// errShuttingDown refuses jobs once the server is shutting down
+var errShuttingDown = errors.New("the server is shutting down")
+
+// Start a job for the principal of a request and answer with the job, or
+// with 503 when the server is shutting down
+func (s *Server) startJob(w http.ResponseWriter, r *http.Request, kind string, fn jobFunc) {
+	j, err := s.submit(r.Context(), kind, fn)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j.snapshot())
+}
+
+// Start a job for the principal of from, running fn in the background once
+// a slot is free with the actions recorded as from the origin of from
+func (s *Server) submit(from context.Context, kind string, fn jobFunc) (*job, error) {
+	user := db.Principal(from)
+	role, address := db.Origin(from)
+	state := JobRunning
+	if s.slots != nil {
+		state = JobQueued
+	}
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return nil, errShuttingDown
+	}
+	ctx, cancel := context.WithCancel(db.WithOrigin(db.WithPrincipal(s.ctx, user), role, address))
+	s.nextID++
+	j := &job{
+		info:     Job{ID: strconv.Itoa(s.nextID), Kind: kind, User: user, State: state, Submitted: time.Now()},
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+		observer: s.opts.Events(),
+		cancel:   cancel,
+	}
+	if state == JobRunning {
+		started := j.info.Submitted
+		j.info.Started = &started
+	}
+	ctx = fsutil.WithPause(ctx, &j.pause)
+	j.pauses = []*fsutil.Pause{&j.pause}
+	if s.pause != nil {
+		ctx = fsutil.WithPause(ctx, s.pause)
+		j.pauses = append(j.pauses, s.pause)
+	}
+	s.jobs[j.info.ID] = j
+	s.mu.Unlock()
+
+	opts := s.opts
+	opts.Observer = j
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+				defer func() { <-s.slots }()
+			case <-ctx.Done():
+				j.finish(nil, ctx.Err())
+				return
+			case <-s.drain:
+				j.finish(nil, context.Canceled)
+				return
+			}
+			select {
+			case <-s.drain:
+				j.finish(nil, context.Canceled)
+				return
+			default:
+			}
+			j.mu.Lock()
+			started := time.Now()
+			j.info.State = JobRunning
+			j.info.Started = &started
+			j.mu.Unlock()
+		}
+		result, err := fn(ctx, opts)
+		j.finish(result, err)
+	}()
+	return j, nil
+}
+
+// Record the outcome of the job
+func (j *job) finish(result any, err error) {
+	j.mu.Lock()
+	info := &j.info
+	finished := time.Now()
+	info.Finished = &finished
+	info.Result = result
+	switch {
+	case errors.Is(err, context.Canceled):
+		info.State = JobCancelled
+	case err != nil:
+		info.State = JobFailed
+		info.Error = err.Error()
+	default:
+		info.State = JobSucceeded
+	}
+	final := Progress{Type: "finished", State: info.State, Error: info.Error}
+	j.mu.Unlock()
+	j.add(final)
+	close(j.done)
+}
+
+// Look up the job named in the request path, answering 404 when there is none
+func (s *Server) lookupJob(w http.ResponseWriter, r *http.Request) (*job, bool) {
+	s.mu.Lock()
+	job, ok := s.jobs[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %q", r.PathValue("id")))
+	}
+	return job, ok
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job.snapshot())
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Submitted.Before(jobs[j].Submitted)
+	})
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	if job, ok := s.lookupJob(w, r); ok {
+		writeJSON(w, http.StatusOK, job.snapshot())
+	}
+}
+
+// Cancel a queued or running job. A running job stops at its next
+// cancellation point and cleans up after itself.
+func (s *Server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	if info := job.snapshot(); info.Finished != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s already %s", info.ID, info.State))
+		return
+	}
+	job.cancel()
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+// Hold an unfinished job at its next checkpoint until it is resumed. A
+// queued job is held once it starts.
+func (s *Server) pauseJob(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, (*fsutil.Pause).Pause)
+}
+
+// Let a paused job continue
+func (s *Server) resumeJob(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, (*fsutil.Pause).Resume)
+}
+
+func (s *Server) setPaused(w http.ResponseWriter, r *http.Request, change func(*fsutil.Pause) bool) {
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	if info := job.snapshot(); info.Finished != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s already %s", info.ID, info.State))
+		return
+	}
+	change(&job.pause)
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+// Stream a job's progress as JSON lines, from its start until it finishes
+// or the client goes away
+func (s *Server) streamJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	send := func(p Progress) error {
+		return encoder.Encode(p)
+	}
+	_ = job.follow(r.Context(), send, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
+
+// Pass a job's progress to send, from its start until it finishes or ctx
+// is cancelled, calling flush whenever it waits for more
+func (j *job) follow(ctx context.Context, send func(Progress) error, flush func()) error {
+	sent := 0
+	for {
+		j.mu.Lock()
+		pending := j.progress[sent:]
+		changed := j.changed
+		j.mu.Unlock()
+
+		for _, p := range pending {
+			if err := send(p); err != nil {
+				return err
+			}
+			if p.Type == "finished" {
+				return nil
+			}
+		}
+		sent += len(pending)
+		flush()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Decode a JSON request body into v, answering 400 when it is invalid
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return false
+	}
+	return true
+}
+
+func (s *Server) startDeduplicate(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Directory string `json:"directory"`
+	}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Directory == "" {
+		writeError(w, http.StatusBadRequest, errors.New("directory is required"))
+		return
+	}
+	directory, err := s.jobPath(request.Directory)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	s.startJob(w, r, "deduplicate", s.deduplicateJob(directory))
+}
+
+// Deduplicate the files of directory
+func (s *Server) deduplicateJob(directory string) jobFunc {
+	return func(ctx context.Context, opts fsutil.Options) (any, error) {
+		return dedup.Files(ctx, directory, s.algorithm, s.db, opts)
+	}
+}
+
+func (s *Server) startBackup(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Directory string `json:"directory"`
+		Output    string `json:"output"`
+	}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Directory == "" || request.Output == "" {
+		writeError(w, http.StatusBadRequest, errors.New("directory and output are required"))
+		return
+	}
+	directory, err := s.jobPath(request.Directory)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	output, err := s.jobPath(request.Output)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	s.startJob(w, r, "backup", s.backupJob(directory, output))
+}
+
+// Back up directory to output, notifying of the outcome
+func (s *Server) backupJob(directory, output string) jobFunc {
+	return func(ctx context.Context, opts fsutil.Options) (any, error) {
+		summary, err := archive.BackupOnce(ctx, s.db, directory, output, opts)
+		if notifyErr := s.notifier.Backup(context.WithoutCancel(ctx), directory, output, summary, err); notifyErr != nil {
+			opts.Events().OnError(event.Error{Op: "notify", Name: output, Err: notifyErr})
+		}
+		return summary, err
+	}
+}
+
+func (s *Server) startStore(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Path string `json:"path"`
+	}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Path == "" {
+		writeError(w, http.StatusBadRequest, errors.New("path is required"))
+		return
+	}
+	path, err := s.jobPath(request.Path)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	s.startJob(w, r, "store", func(ctx context.Context, opts fsutil.Options) (any, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		blobs := s.store.WithOptions(opts)
+		if info.IsDir() {
+			return blobs.StoreDirectory(ctx, path)
+		}
+		return blobs.StoreFile(ctx, path)
+	})
+}
+
+// Return the server path a job request names, with its symbolic links
+// resolved, refusing paths outside the job root of a confined server
+func (s *Server) jobPath(name string) (string, error) {
+	if !s.confined {
+		return name, nil
+	}
+	if s.jobRoot == "" {
+		return "", errors.New("jobs on server paths are disabled for this repository")
+	}
+	root, err := resolvePath(s.jobRoot)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve job root: %w", err)
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(root, name)
+	}
+	resolved, err := resolvePath(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside the job root of this repository", name)
+	}
+	return resolved, nil
+}
+
+// Make p absolute and resolve the symbolic links of as much of it as
+// exists, so that none can lead out of a directory checked to contain it
+func resolvePath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		parent := filepath.Dir(p)
+		if !errors.Is(err, fs.ErrNotExist) || parent == p {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(p)}, missing...)
+		p = parent
+	}
+}
+
+func (s *Server) startVerify(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Fraction float64 `json:"fraction"` // of the blobs to re-hash; 0 for all
+	}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Fraction < 0 || request.Fraction > 1 {
+		writeError(w, http.StatusBadRequest, errors.New("fraction must be between 0 and 1"))
+		return
+	}
+	s.startJob(w, r, "verify", s.verifyJob(request.Fraction))
+}
+
+// Re-hash fraction of the blobs, repairing those damaged from parity. The
+// job fails when blobs are left damaged or missing.
+func (s *Server) verifyJob(fraction float64) jobFunc {
+	return func(ctx context.Context, opts fsutil.Options) (any, error) {
+		start := time.Now()
+		report, err := s.store.WithOptions(opts).Verify(ctx, store.VerifyOptions{Fraction: fraction, Parity: s.parity})
+		if notifyErr := s.notifier.Corruption(context.WithoutCancel(ctx), "verify", report); notifyErr != nil {
+			opts.Events().OnError(event.Error{Op: "notify", Name: "verify", Err: notifyErr})
+		}
+		if err != nil {
+			return report, err
+		}
+		if len(report.Repaired) > 0 {
+			if err := db.RecordAction(ctx, s.db, db.Action{ActionType: "verify", Duration: time.Since(start)}); err != nil {
+				return report, err
+			}
+		}
+		if !report.Clean() {
+			return report, errors.New("found damaged or missing blobs")
+		}
+		return report, nil
+	}
+}
@@ -0,0 +1,657 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/policy"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Prefix is where the S3-compatible gateway is served, path-style
+const s3Prefix = "/s3/"
+
+// S3Bucket is the single bucket the S3 gateway serves, holding every file
+// as an object keyed by its name, with the file's versions as the object's
+const S3Bucket = "files"
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3TimeFormat is the layout of times in S3 listings
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// s3MaxKeys is the most entries a listing returns
+const s3MaxKeys = 1000
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+type s3Buckets struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefixes struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3Objects is the result of ListObjects and ListObjectsV2, which share
+// most of their fields
+type s3Objects struct {
+	XMLName               xml.Name     `xml:"ListBucketResult"`
+	Xmlns                 string       `xml:"xmlns,attr"`
+	Name                  string       `xml:"Name"`
+	Prefix                string       `xml:"Prefix"`
+	Delimiter             string       `xml:"Delimiter,omitempty"`
+	EncodingType          string       `xml:"EncodingType,omitempty"`
+	MaxKeys               int          `xml:"MaxKeys"`
+	IsTruncated           bool         `xml:"IsTruncated"`
+	Marker                *string      `xml:"Marker"`
+	NextMarker            string       `xml:"NextMarker,omitempty"`
+	ContinuationToken     string       `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string       `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string       `xml:"StartAfter,omitempty"`
+	KeyCount              *int         `xml:"KeyCount"`
+	Contents              []s3Object   `xml:"Contents"`
+	CommonPrefixes        []s3Prefixes `xml:"CommonPrefixes"`
+}
+
+type s3ObjectVersion struct {
+	Key          string `xml:"Key"`
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Versions struct {
+	XMLName             xml.Name          `xml:"ListVersionsResult"`
+	Xmlns               string            `xml:"xmlns,attr"`
+	Name                string            `xml:"Name"`
+	Prefix              string            `xml:"Prefix"`
+	Delimiter           string            `xml:"Delimiter,omitempty"`
+	EncodingType        string            `xml:"EncodingType,omitempty"`
+	KeyMarker           string            `xml:"KeyMarker"`
+	VersionIDMarker     string            `xml:"VersionIdMarker"`
+	NextKeyMarker       string            `xml:"NextKeyMarker,omitempty"`
+	NextVersionIDMarker string            `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int               `xml:"MaxKeys"`
+	IsTruncated         bool              `xml:"IsTruncated"`
+	Versions            []s3ObjectVersion `xml:"Version"`
+	CommonPrefixes      []s3Prefixes      `xml:"CommonPrefixes"`
+}
+
+type s3Versioning struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Status  string   `xml:"Status"`
+}
+
+type s3Location struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// Serve a subset of the S3 API over the versions: listing the bucket, its
+// objects and their versions, reading any version and writing new ones, so
+// that S3 tooling can use the repository. Every write records a version,
+// as in a bucket with versioning enabled. Deleting objects, copying them
+// and multipart uploads are not supported.
+func (s *Server) serveS3(w http.ResponseWriter, r *http.Request) {
+	var payloadHash string
+	var sig *sigv4Request
+	if len(s.users) > 0 {
+		user, signed, err := s.authenticateS3(r, basePath(r.Context())+r.URL.Path)
+		if err != nil {
+			code := "AccessDenied"
+			if errors.Is(err, errSignature) {
+				code = "SignatureDoesNotMatch"
+			}
+			writeS3Error(w, r, http.StatusForbidden, code, err)
+			return
+		}
+		role := RoleOperator
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role = RoleReadOnly
+		}
+		if roleRanks[user.Role] < roleRanks[role] {
+			writeS3Error(w, r, http.StatusForbidden, "AccessDenied", fmt.Errorf("user %s has role %s; %s is required", user.Name, user.Role, role))
+			return
+		}
+		payloadHash, sig = signed.payloadHash, signed
+		r = r.WithContext(db.WithOrigin(db.WithPrincipal(r.Context(), user.Name), user.Role, r.RemoteAddr))
+	} else {
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		r = r.WithContext(db.WithOrigin(r.Context(), "", r.RemoteAddr))
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, s3Prefix), "/")
+	query := r.URL.Query()
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		s.listS3Buckets(w)
+	case bucket == "":
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", errors.New("only listing buckets is supported here"))
+	case bucket != S3Bucket:
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket", fmt.Errorf("the gateway serves the single bucket %s", S3Bucket))
+	case key == "":
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPut:
+			// Creating the bucket that exists succeeds, as in us-east-1
+			w.WriteHeader(http.StatusOK)
+		case r.Method != http.MethodGet:
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", fmt.Errorf("%s on the bucket is not supported", r.Method))
+		case query.Has("location"):
+			writeXML(w, http.StatusOK, s3Location{Xmlns: s3Namespace})
+		case query.Has("versioning"):
+			writeXML(w, http.StatusOK, s3Versioning{Xmlns: s3Namespace, Status: "Enabled"})
+		case query.Has("versions"):
+			s.listS3Versions(w, r)
+		case query.Has("uploads"):
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", errors.New("multipart uploads are not supported"))
+		default:
+			s.listS3Objects(w, r)
+		}
+	default:
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			s.getS3Object(w, r, key)
+		case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") == "" && !query.Has("uploadId"):
+			s.putS3Object(w, r, key, payloadHash, sig)
+		case r.Method == http.MethodDelete:
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", errors.New("versions are kept; objects cannot be deleted"))
+		default:
+			writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", errors.New("copying objects and multipart uploads are not supported"))
+		}
+	}
+}
+
+func (s *Server) listS3Buckets(w http.ResponseWriter) {
+	writeXML(w, http.StatusOK, s3Buckets{
+		Xmlns:   s3Namespace,
+		Buckets: []s3Bucket{{Name: S3Bucket, CreationDate: time.Unix(0, 0).UTC().Format(s3TimeFormat)}},
+	})
+}
+
+// s3Entry is a version in a listing: the latest of each object for
+// ListObjects, every one for ListObjectVersions
+type s3Entry struct {
+	version db.Version
+	latest  bool
+}
+
+// s3Page is a page of a listing: the entries on it and the common
+// prefixes rolling up the keys below a delimiter
+type s3Page struct {
+	entries   []s3Entry
+	prefixes  []string
+	truncated bool
+	last      s3Entry // the last entry or rolled up key on the page
+}
+
+// Page through entries sorted by key, skipping those up to after, keeping
+// those under prefix and rolling up the keys with delimiter past prefix
+func paginateS3(entries []s3Entry, prefix, delimiter string, after func(s3Entry) bool, maxKeys int) s3Page {
+	var page s3Page
+	count := 0
+	for _, entry := range entries {
+		key := entry.version.Filename
+		if !strings.HasPrefix(key, prefix) || after(entry) {
+			continue
+		}
+		rolled := rolledUp(key, prefix, delimiter)
+		if rolled != "" && len(page.prefixes) > 0 && page.prefixes[len(page.prefixes)-1] == rolled {
+			page.last = entry
+			continue
+		}
+		if count == maxKeys {
+			page.truncated = true
+			break
+		}
+		count++
+		page.last = entry
+		if rolled != "" {
+			page.prefixes = append(page.prefixes, rolled)
+		} else {
+			page.entries = append(page.entries, entry)
+		}
+	}
+	return page
+}
+
+// Return the maximum number of keys a listing asks for
+func s3MaxKeysParam(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("max-keys")
+	if value == "" {
+		return s3MaxKeys, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid max-keys %q", value)
+	}
+	return min(n, s3MaxKeys), nil
+}
+
+func (s *Server) listS3Objects(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	maxKeys, err := s3MaxKeysParam(r)
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", err)
+		return
+	}
+	latest, err := db.ListLatestVersions(ctx, s.db, db.VersionFilter{})
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", err)
+		return
+	}
+	entries := make([]s3Entry, len(latest))
+	for i, v := range latest {
+		entries[i] = s3Entry{version: v, latest: true}
+	}
+	sortS3Entries(entries)
+
+	result := s3Objects{
+		Xmlns:        s3Namespace,
+		Name:         S3Bucket,
+		Prefix:       query.Get("prefix"),
+		Delimiter:    query.Get("delimiter"),
+		EncodingType: query.Get("encoding-type"),
+		MaxKeys:      maxKeys,
+	}
+	after := query.Get("marker")
+	v2 := query.Get("list-type") == "2"
+	if v2 {
+		after = query.Get("start-after")
+		result.StartAfter = after
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", errors.New("invalid continuation-token"))
+				return
+			}
+			after = max(after, string(decoded))
+			result.ContinuationToken = token
+		}
+	} else {
+		result.Marker = &after
+	}
+	page := paginateS3(entries, result.Prefix, result.Delimiter, func(e s3Entry) bool {
+		rolled := rolledUp(e.version.Filename, result.Prefix, result.Delimiter)
+		return e.version.Filename <= after || (rolled != "" && strings.HasPrefix(after, rolled))
+	}, maxKeys)
+
+	sizes := s.s3Sizes(r, page.entries)
+	encode := s3Encoder(result.EncodingType)
+	for _, entry := range page.entries {
+		result.Contents = append(result.Contents, s3ObjectOf(entry.version, sizes, encode))
+	}
+	for _, prefix := range page.prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3Prefixes{Prefix: encode(prefix)})
+	}
+	result.Prefix = encode(result.Prefix)
+	result.IsTruncated = page.truncated
+	if page.truncated {
+		next := page.last.version.Filename
+		if v2 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+		} else {
+			result.NextMarker = encode(next)
+		}
+	}
+	if v2 {
+		keyCount := len(result.Contents) + len(result.CommonPrefixes)
+		result.KeyCount = &keyCount
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// Return the common prefix key rolls up to under delimiter past prefix,
+// empty when it does not roll up
+func rolledUp(key, prefix, delimiter string) string {
+	if delimiter != "" && strings.HasPrefix(key, prefix) {
+		if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+			return key[:len(prefix)+i+len(delimiter)]
+		}
+	}
+	return ""
+}
+
+func (s *Server) listS3Versions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	maxKeys, err := s3MaxKeysParam(r)
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", err)
+		return
+	}
+	versions, err := db.ListVersions(ctx, s.db, "")
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", err)
+		return
+	}
+	// Listed newest first within each key; the latest is that of the
+	// mainline, not of a branch
+	entries := make([]s3Entry, len(versions))
+	latest := map[string]int{}
+	for i, v := range versions {
+		entries[i] = s3Entry{version: v}
+		if v.Branch == "" {
+			latest[v.Filename] = i
+		}
+	}
+	for _, i := range latest {
+		entries[i].latest = true
+	}
+	sortS3Entries(entries)
+
+	result := s3Versions{
+		Xmlns:           s3Namespace,
+		Name:            S3Bucket,
+		Prefix:          query.Get("prefix"),
+		Delimiter:       query.Get("delimiter"),
+		EncodingType:    query.Get("encoding-type"),
+		KeyMarker:       query.Get("key-marker"),
+		VersionIDMarker: query.Get("version-id-marker"),
+		MaxKeys:         maxKeys,
+	}
+	keyMarker := result.KeyMarker
+	versionMarker, _ := strconv.Atoi(result.VersionIDMarker)
+	page := paginateS3(entries, result.Prefix, result.Delimiter, func(e s3Entry) bool {
+		key := e.version.Filename
+		switch {
+		case key < keyMarker:
+			return true
+		case key > keyMarker:
+			rolled := rolledUp(key, result.Prefix, result.Delimiter)
+			return rolled != "" && strings.HasPrefix(keyMarker, rolled)
+		default:
+			// Versions of the marker's key up to the marker's version are
+			// listed; without a version marker all of them are
+			return versionMarker == 0 || e.version.Version >= versionMarker
+		}
+	}, maxKeys)
+
+	sizes := s.s3Sizes(r, page.entries)
+	encode := s3Encoder(result.EncodingType)
+	for _, entry := range page.entries {
+		object := s3ObjectOf(entry.version, sizes, encode)
+		result.Versions = append(result.Versions, s3ObjectVersion{
+			Key:          object.Key,
+			VersionID:    strconv.Itoa(entry.version.Version),
+			IsLatest:     entry.latest,
+			LastModified: object.LastModified,
+			ETag:         object.ETag,
+			Size:         object.Size,
+			StorageClass: object.StorageClass,
+		})
+	}
+	for _, prefix := range page.prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3Prefixes{Prefix: encode(prefix)})
+	}
+	result.Prefix = encode(result.Prefix)
+	result.IsTruncated = page.truncated
+	if page.truncated {
+		// A page ending in a common prefix continues after it
+		next := rolledUp(page.last.version.Filename, query.Get("prefix"), result.Delimiter)
+		if next == "" {
+			next = page.last.version.Filename
+			result.NextVersionIDMarker = strconv.Itoa(page.last.version.Version)
+		}
+		result.NextKeyMarker = encode(next)
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// Sort entries by key in byte order, as S3 lists them, and newest first
+// within a key
+func sortS3Entries(entries []s3Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].version, entries[j].version
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Version > b.Version
+	})
+}
+
+// Return the sizes of the blobs of entries, from the sizes logged when
+// they were stored or failing that from the backend
+func (s *Server) s3Sizes(r *http.Request, entries []s3Entry) map[string]int64 {
+	ctx := r.Context()
+	sizes, err := db.StoredSizes(ctx, s.db)
+	if err != nil {
+		sizes = map[string]int64{}
+	}
+	for _, entry := range entries {
+		id := store.StorageID(entry.version)
+		if _, ok := sizes[id]; !ok {
+			if size, err := s.store.BlobSize(ctx, id); err == nil {
+				sizes[id] = size
+			}
+		}
+	}
+	return sizes
+}
+
+// Describe a version as an object of a listing
+func s3ObjectOf(v db.Version, sizes map[string]int64, encode func(string) string) s3Object {
+	return s3Object{
+		Key:          encode(v.Filename),
+		LastModified: v.Timestamp.UTC().Format(s3TimeFormat),
+		ETag:         `"` + v.Hash + `"`,
+		Size:         sizes[store.StorageID(v)],
+		StorageClass: "STANDARD",
+	}
+}
+
+// Return how keys are encoded in a listing: as URLs when the client asks
+// so, which lets XML carry keys with any bytes
+func s3Encoder(encodingType string) func(string) string {
+	if encodingType == "url" {
+		return func(key string) string { return sigv4Escape(key, false) }
+	}
+	return func(key string) string { return key }
+}
+
+// Send a version of an object, the latest unless the versionId query
+// parameter says otherwise, or the range of it the request asks for
+func (s *Server) getS3Object(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := r.Context()
+	n := 0
+	if versionID := r.URL.Query().Get("versionId"); versionID != "" && versionID != "null" {
+		var err error
+		if n, err = strconv.Atoi(versionID); err != nil || n <= 0 {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", fmt.Errorf("invalid versionId %q", versionID))
+			return
+		}
+	}
+	v, err := db.GetVersion(ctx, s.db, fsutil.NormalizeName(key), n)
+	if errors.Is(err, db.ErrNoVersion) {
+		code := "NoSuchKey"
+		if n > 0 {
+			code = "NoSuchVersion"
+		}
+		writeS3Error(w, r, http.StatusNotFound, code, err)
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", err)
+		return
+	}
+	id := store.StorageID(v)
+	size, err := s.store.BlobSize(ctx, id)
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+
+	start, length, partial, ok := s3Range(r.Header.Get("Range"), size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", errors.New("the requested range is not satisfiable"))
+		return
+	}
+	contentType := v.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", `"`+v.Hash+`"`)
+	w.Header().Set("Last-Modified", v.Timestamp.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Amz-Version-Id", strconv.Itoa(v.Version))
+	status := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		status = http.StatusPartialContent
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	content, err := s.store.OpenBlob(ctx, id)
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+	defer func() {
+		_ = content.Close()
+	}()
+	if _, err := io.CopyN(io.Discard, content, start); err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", fmt.Errorf("failed to read %s version %d: %w", v.Filename, v.Version, err))
+		return
+	}
+	w.WriteHeader(status)
+	if _, err := io.CopyN(w, content, length); err != nil {
+		s.opts.Events().OnError(event.Error{Op: "download", Name: v.Filename, Err: err})
+		panic(http.ErrAbortHandler)
+	}
+	s.logRetrieve(r.Context(), v.Filename, id)
+}
+
+// Parse a Range header of a single byte range over size bytes, returning
+// where it starts, its length, whether it is a part of the content and
+// whether it can be served. Other ranges are served as the whole content.
+func s3Range(header string, size int64) (start, length int64, partial, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, size, false, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, size, false, true
+	}
+	end := size - 1
+	var err error
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, false
+		}
+		start = max(size-n, 0)
+	} else {
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+			return 0, size, false, true
+		}
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, size, false, true
+			}
+			end = min(end, size-1)
+		}
+	}
+	if start >= size {
+		return 0, 0, false, false
+	}
+	return start, end - start + 1, true, true
+}
+
+// Store the request body as a new version of key
+func (s *Server) putS3Object(w http.ResponseWriter, r *http.Request, key, payloadHash string, sig *sigv4Request) {
+	ctx := r.Context()
+	if status, err := s.quotaExceeded(ctx); err != nil {
+		code := "InternalError"
+		if status == http.StatusInsufficientStorage {
+			code = "QuotaExceeded"
+		}
+		writeS3Error(w, r, status, code, err)
+		return
+	}
+	result, err := s.store.StoreVersion(ctx, key, s3Body(r, payloadHash, sig))
+	if errors.Is(err, errSignature) {
+		writeS3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err)
+		return
+	}
+	if errors.Is(err, store.ErrInfected) || errors.Is(err, policy.ErrRejected) {
+		writeS3Error(w, r, http.StatusForbidden, "AccessDenied", err)
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", err)
+		return
+	}
+	w.Header().Set("ETag", `"`+result.Hash+`"`)
+	w.Header().Set("X-Amz-Version-Id", strconv.Itoa(result.Version))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Write v as an XML response
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+// Write an S3 error response
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code string, err error) {
+	if r.Method == http.MethodHead {
+		// HEAD responses have no body to carry the error
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, status, s3Error{Code: code, Message: err.Error(), Resource: r.URL.Path})
+}
@@ -0,0 +1,185 @@
+package server_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	s3User   = "uploader"
+	s3Secret = "s3-secret"
+	s3Scope  = "/us-east-1/s3/aws4_request"
+)
+
+// Start a server whose S3 gateway lets s3User in with s3Secret
+func newS3Server(t *testing.T) string {
+	t.Helper()
+	_, digest, err := server.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newServer(t, func(api *server.Server) {
+		err := api.SetUsers([]server.User{{Name: s3User, Role: server.RoleOperator, TokenSHA256: digest, S3Secret: s3Secret}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	return ts.URL + "/s3/" + server.S3Bucket + "/"
+}
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign req with AWS signature version 4 over the given headers and payload
+// hash, returning the signature, the time it was made at, the credential
+// scope and the signing key
+func signS3(req *http.Request, payloadHash string, headers []string) (string, string, string, []byte) {
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + s3Scope
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), "", canonicalHeaders.String(), strings.Join(headers, ";"), payloadHash}, "\n")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonical)}, "\n")
+	key := []byte("AWS4" + s3Secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSum(key, part)
+	}
+	signature := hex.EncodeToString(hmacSum(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3User, scope, strings.Join(headers, ";"), signature))
+	return signature, amzDate, scope, key
+}
+
+// Encode chunks as an aws-chunked body signed in a chain from seed,
+// including the final empty chunk
+func signedChunks(chunks []string, seed, amzDate, scope string, key []byte) string {
+	var body strings.Builder
+	previous := seed
+	for _, chunk := range append(chunks, "") {
+		toSign := strings.Join([]string{"AWS4-HMAC-SHA256-PAYLOAD", amzDate, scope, previous, sha256Hex(""), sha256Hex(chunk)}, "\n")
+		previous = hex.EncodeToString(hmacSum(key, toSign))
+		fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), previous, chunk)
+	}
+	return body.String()
+}
+
+// Send a streamed upload of chunks, letting tamper change the encoded body
+func putChunked(t *testing.T, url string, chunks []string, tamper func(string) string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	seed, amzDate, scope, key := signS3(req, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD", []string{"content-encoding", "host", "x-amz-content-sha256", "x-amz-date"})
+	body := tamper(signedChunks(chunks, seed, amzDate, scope, key))
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return send(t, req)
+}
+
+func send(t *testing.T, req *http.Request) (int, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestS3ChunkSignatures(t *testing.T) {
+	bucket := newS3Server(t)
+	chunks := []string{"alpha ", "beta\n"}
+
+	if status, body := putChunked(t, bucket+"a.txt", chunks, func(s string) string { return s }); status != http.StatusOK {
+		t.Fatalf("signed streamed upload answered %d: %s", status, body)
+	}
+	req, err := http.NewRequest(http.MethodGet, bucket+"a.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signS3(req, "UNSIGNED-PAYLOAD", []string{"host", "x-amz-content-sha256", "x-amz-date"})
+	if status, body := send(t, req); status != http.StatusOK || body != "alpha beta\n" {
+		t.Errorf("reading the upload answered %d: %q", status, body)
+	}
+
+	// Changing a chunk breaks the chain, and so does dropping one
+	forged := func(s string) string { return strings.Replace(s, "beta", "BETA", 1) }
+	if status, body := putChunked(t, bucket+"b.txt", chunks, forged); status != http.StatusBadRequest {
+		t.Errorf("upload with a forged chunk answered %d: %s", status, body)
+	}
+	dropped := func(s string) string {
+		first, _, _ := strings.Cut(s, "\r\n5;")
+		return first + s[strings.LastIndex(s, "\r\n0;"):]
+	}
+	if status, body := putChunked(t, bucket+"b.txt", chunks, dropped); status != http.StatusBadRequest {
+		t.Errorf("upload with a dropped chunk answered %d: %s", status, body)
+	}
+}
+
+func TestS3RejectsWeakSignatures(t *testing.T) {
+	bucket := newS3Server(t)
+
+	// Without the host signed, a request could be replayed elsewhere
+	req, err := http.NewRequest(http.MethodGet, bucket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signS3(req, "UNSIGNED-PAYLOAD", []string{"x-amz-content-sha256", "x-amz-date"})
+	if status, body := send(t, req); status != http.StatusForbidden || !strings.Contains(body, "host") {
+		t.Errorf("request without the host signed answered %d: %s", status, body)
+	}
+
+	// Presigned URLs are valid for 7 days at most
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	url := fmt.Sprintf("%s?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=%s%%2F%s%s&X-Amz-Date=%s&X-Amz-Expires=604801&X-Amz-SignedHeaders=host&X-Amz-Signature=00",
+		bucket, s3User, amzDate[:8], strings.ReplaceAll(s3Scope, "/", "%2F"), amzDate)
+	req, err = http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := send(t, req); status != http.StatusForbidden || !strings.Contains(body, "X-Amz-Expires") {
+		t.Errorf("presigned URL valid for too long answered %d: %s", status, body)
+	}
+
+	// Chunks signed in ways the gateway cannot check are refused
+	req, err = http.NewRequest(http.MethodPut, bucket+"c.txt", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signS3(req, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER", []string{"host", "x-amz-content-sha256", "x-amz-date"})
+	if status, body := send(t, req); status != http.StatusForbidden {
+		t.Errorf("upload with signed trailers answered %d: %s", status, body)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SchedulePrincipal is who the action log records as requesting the jobs
+// of policies
+const SchedulePrincipal = "schedule"
+
+// scheduleAction is the action type recording each run of a policy
+const scheduleAction = "schedule"
+
+// intervals are the names Policy.Every accepts besides durations
+var intervals = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"nightly": 24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+}
+
+// Policy is recurring maintenance the server runs as a job
+type Policy struct {
+	// Name identifies the policy's runs in the action log; it defaults to
+	// the job and its directory
+	Name string `json:"name"`
+
+	// Job is deduplicate, verify, gc (remove blobs no version refers to)
+	// or db-maintain
+	Job       string  `json:"job"`
+	Directory string  `json:"directory"` // deduplicated by deduplicate
+	Fraction  float64 `json:"fraction"`  // of the blobs verify re-hashes; 0 for all
+
+	// Every is hourly, daily, nightly, weekly, monthly or a duration such
+	// as 12h, counted from the end of the previous run
+	Every string `json:"every"`
+}
+
+// Validate checks the policy and fills in its default name
+func (p *Policy) Validate() error {
+	switch p.Job {
+	case "deduplicate":
+		if p.Directory == "" {
+			return errors.New("deduplicate needs a directory")
+		}
+	case "verify":
+		if p.Fraction < 0 || p.Fraction > 1 {
+			return errors.New("fraction must be between 0 and 1")
+		}
+	case "gc", "db-maintain":
+	default:
+		return fmt.Errorf("unknown job %q (use deduplicate, verify, gc or db-maintain)", p.Job)
+	}
+	if _, err := p.interval(); err != nil {
+		return err
+	}
+	if p.Name == "" {
+		p.Name = p.Job
+		if p.Directory != "" {
+			p.Name += " " + p.Directory
+		}
+	}
+	return nil
+}
+
+// Return the time between runs
+func (p *Policy) interval() (time.Duration, error) {
+	if d, ok := intervals[p.Every]; ok {
+		return d, nil
+	}
+	d, err := time.ParseDuration(p.Every)
+	if err != nil || d < time.Minute {
+		return 0, fmt.Errorf("invalid every %q: use hourly, daily, nightly, weekly, monthly or a duration of at least 1m", p.Every)
+	}
+	return d, nil
+}
+
+// Scheduled is a policy and when it runs
+type Scheduled struct {
+	Policy
+	Last  *time.Time `json:"last,omitempty"` // end of the previous run
+	Next  time.Time  `json:"next"`
+	JobID string     `json:"job_id,omitempty"` // of the latest run
+}
+
+// schedule is the state of the policies the server runs
+type schedule struct {
+	mu       sync.Mutex
+	policies []*Scheduled
+}
+
+// Schedule runs policies as jobs until the server shuts down. Each runs
+// when its interval has passed since its last run recorded in the action
+// log, so a policy that never ran starts right away.
+func (s *Server) Schedule(policies []Policy) error {
+	for i := range policies {
+		if err := policies[i].Validate(); err != nil {
+			return fmt.Errorf("policy %d: %w", i+1, err)
+		}
+	}
+	for _, p := range policies {
+		every, _ := p.interval()
+		last, err := db.LastAction(s.ctx, s.db, scheduleAction, p.Name)
+		if err != nil {
+			return fmt.Errorf("failed to read the last run of %s: %w", p.Name, err)
+		}
+		entry := &Scheduled{Policy: p, Next: time.Now()}
+		if !last.IsZero() {
+			entry.Last = &last
+			entry.Next = last.Add(every)
+		}
+		s.schedule.mu.Lock()
+		s.schedule.policies = append(s.schedule.policies, entry)
+		s.schedule.mu.Unlock()
+		go s.runPolicy(entry, every)
+	}
+	return nil
+}
+
+// Run a policy whenever it is due, one run at a time
+func (s *Server) runPolicy(entry *Scheduled, every time.Duration) {
+	for {
+		s.schedule.mu.Lock()
+		wait := time.Until(entry.Next)
+		s.schedule.mu.Unlock()
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-timer.C:
+		case <-s.drain:
+			timer.Stop()
+			return
+		}
+
+		j, err := s.submit(db.WithPrincipal(s.ctx, SchedulePrincipal), entry.Job, s.policyJob(entry.Policy))
+		if err != nil {
+			return
+		}
+		s.schedule.mu.Lock()
+		entry.JobID = j.info.ID
+		s.schedule.mu.Unlock()
+		select {
+		case <-j.done:
+		case <-s.drain:
+			return
+		}
+
+		finished := time.Now()
+		s.schedule.mu.Lock()
+		entry.Last = &finished
+		entry.Next = finished.Add(every)
+		s.schedule.mu.Unlock()
+	}
+}
+
+// Return the job running a policy, which records the run in the action log
+func (s *Server) policyJob(p Policy) jobFunc {
+	var run jobFunc
+	switch p.Job {
+	case "deduplicate":
+		run = s.deduplicateJob(p.Directory)
+	case "verify":
+		run = s.verifyJob(p.Fraction)
+	case "gc":
+		run = func(ctx context.Context, opts fsutil.Options) (any, error) {
+			return s.store.WithOptions(opts).Fsck(ctx, store.FsckOptions{Adopt: store.AdoptRemove})
+		}
+	case "db-maintain":
+		run = func(ctx context.Context, opts fsutil.Options) (any, error) {
+			return db.Maintain(ctx, s.db)
+		}
+	}
+	return func(ctx context.Context, opts fsutil.Options) (any, error) {
+		start := time.Now()
+		result, err := run(ctx, opts)
+		logErr := db.RecordAction(context.WithoutCancel(ctx), s.db, db.Action{
+			ActionType: scheduleAction,
+			Filename:   p.Name,
+			Duration:   time.Since(start),
+			Err:        err,
+		})
+		if logErr != nil {
+			opts.Events().OnError(event.Error{Op: scheduleAction, Name: p.Name, Err: logErr})
+		}
+		return result, err
+	}
+}
+
+func (s *Server) listSchedule(w http.ResponseWriter, r *http.Request) {
+	s.schedule.mu.Lock()
+	policies := make([]Scheduled, 0, len(s.schedule.policies))
+	for _, entry := range s.schedule.policies {
+		policies = append(policies, *entry)
+	}
+	s.schedule.mu.Unlock()
+	writeJSON(w, http.StatusOK, policies)
+}
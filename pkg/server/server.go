@@ -0,0 +1,594 @@
+// Package server exposes a repository over an HTTP REST API, so that other
+// applications can store and download file versions and run maintenance
+// jobs without linking the library.
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/notify"
+	"github.com/Lenstack/file_manager_version/pkg/policy"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// index is the single-page web UI, which browses the repository through the API
+//
+//go:embed ui/index.html
+var index []byte
+
+const (
+	// shutdownTimeout bounds how long ListenAndServe waits for requests in
+	// flight once its context is cancelled
+	shutdownTimeout = 10 * time.Second
+
+	// DefaultShutdownGrace is how long running jobs may take to finish
+	// once the server is shutting down, before they are cancelled
+	DefaultShutdownGrace = time.Minute
+
+	// healthTimeout bounds the checks of GET /healthz
+	healthTimeout = 5 * time.Second
+)
+
+// Server serves the API for one repository
+type Server struct {
+	store     *store.Store
+	db        *db.DB
+	algorithm hash.Algorithm
+	opts      fsutil.Options
+	users     []User
+	notifier  *notify.Notifier
+	quota     int64 // bytes of storage uploads may fill; 0 for no limit
+	uploadDir string
+	uploads   uploads
+	parity    store.Backend // repairs blobs damaged in verify jobs
+
+	// Jobs on server paths take only those within jobRoot when confined,
+	// and none when it is empty
+	jobRoot  string
+	confined bool
+
+	// slots limits how many jobs run at once; the others wait in a queue.
+	// Nil runs every job as soon as it starts.
+	slots    chan struct{}
+	schedule schedule
+	pause    *fsutil.Pause // holds every job while paused
+
+	// Jobs outlive the requests that start them and are cancelled by Close
+	// once they overrun the shutdown grace period
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	grace  time.Duration
+	drain  chan struct{} // closed when the server starts shutting down
+
+	mu       sync.Mutex
+	jobs     map[string]*job
+	nextID   int
+	draining bool
+}
+
+// New creates a server for the repository made of blobs and metadata,
+// whose blobs are addressed by algorithm
+func New(blobs *store.Store, metadata *db.DB, algorithm hash.Algorithm, opts fsutil.Options) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		store:     blobs,
+		db:        metadata,
+		algorithm: algorithm,
+		opts:      opts,
+		ctx:       ctx,
+		cancel:    cancel,
+		grace:     DefaultShutdownGrace,
+		drain:     make(chan struct{}),
+		jobs:      map[string]*job{},
+	}
+}
+
+// SetNotifier sends notifications about the backup jobs the server runs
+func (s *Server) SetNotifier(n *notify.Notifier) {
+	s.notifier = n
+}
+
+// SetQuota rejects uploads once the blobs take the given number of bytes.
+// Zero removes the limit.
+func (s *Server) SetQuota(bytes int64) {
+	s.quota = bytes
+}
+
+// SetShutdownGrace sets how long running jobs may take to finish when the
+// server shuts down, before they are cancelled. Queued jobs are cancelled
+// right away.
+func (s *Server) SetShutdownGrace(grace time.Duration) {
+	s.grace = grace
+}
+
+// SetParity repairs the blobs verify jobs find damaged from parity data
+func (s *Server) SetParity(parity store.Backend) {
+	s.parity = parity
+}
+
+// ConfineJobs restricts the server paths deduplicate, backup and store
+// jobs take to those within root, which relative paths are resolved
+// against. An empty root refuses those jobs, as for a repository served
+// with others that has no root of its own.
+func (s *Server) ConfineJobs(root string) {
+	s.jobRoot, s.confined = root, true
+}
+
+// SetPause holds every job at its next checkpoint while p is paused, on
+// top of pausing jobs one by one
+func (s *Server) SetPause(p *fsutil.Pause) {
+	s.pause = p
+}
+
+// SetParallelism queues jobs so that at most n run at once
+func (s *Server) SetParallelism(n int) {
+	s.slots = make(chan struct{}, max(n, 1))
+}
+
+// Handler returns the HTTP handler serving the web UI at / and the API:
+//
+//	GET  /healthz                whether the server is up, for service monitors
+//	GET  /files                  latest version of every file
+//	POST /files/{name}           store the request body as a new version
+//	GET  /files/{name}?version=n download a version, the latest by default
+//	GET  /versions/{name}        every version of a file
+//	GET  /dedup                  the {"algorithm"} to ask for content by hash with
+//	POST /dedup/{name}           store {"hash", "size"} as a new version if the content is stored already
+//	POST /uploads                start a resumable upload of {"filename"}
+//	GET  /uploads/{id}           an upload and the offset to resume it at
+//	PUT  /uploads/{id}?offset=n  append the request body to an upload, checked against its Upload-Checksum
+//	POST /uploads/{id}/finish?size=n&sha256=x  store a completed upload as a new version
+//	DELETE /uploads/{id}         abandon an upload
+//	GET  /signatures/{name}      block signature of a version, to upload a delta against
+//	PUT  /uploads/{id}/delta?version=n  fill an empty upload from a delta against a version
+//	GET  /backups                backups in the catalog, newest first
+//	POST /jobs/store             start storing the file or directory at {"path"}
+//	POST /jobs/deduplicate       start deduplicating {"directory"}
+//	POST /jobs/backup            start backing up {"directory"} to {"output"}
+//	POST /jobs/verify            start re-hashing {"fraction"} of the blobs
+//	GET  /jobs                   every job
+//	GET  /jobs/{id}              one job
+//	GET  /jobs/{id}/events       stream a job's progress as JSON lines
+//	POST /jobs/{id}/cancel       cancel a queued or running job
+//	POST /jobs/{id}/pause        hold a job at its next checkpoint
+//	POST /jobs/{id}/resume       let a paused job continue
+//	GET  /schedule               recurring jobs and when they run next
+//
+// Under /dav/ it serves the versions read-only over WebDAV, laid out as
+// <filename>/v<version>/<name>, for clients that map it as a network drive.
+// Under /s3/ it serves the files as the objects of the bucket S3Bucket, for
+// S3 tooling pointed at the /s3 endpoint with path-style addressing.
+// Once SetUsers is called, /healthz still needs no token; reading needs the read-only role, uploading
+// and starting jobs the operator role.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.require(RoleReadOnly, serveUI))
+	mux.HandleFunc("GET /healthz", s.healthz)
+	mux.HandleFunc("GET /files", s.require(RoleReadOnly, s.listFiles))
+	mux.HandleFunc("POST /files/{name...}", s.require(RoleOperator, s.storeFile))
+	mux.HandleFunc("GET /files/{name...}", s.require(RoleReadOnly, s.downloadFile))
+	mux.HandleFunc("GET /versions/{name...}", s.require(RoleReadOnly, s.listVersions))
+	mux.HandleFunc("GET /dedup", s.require(RoleOperator, s.getDedup))
+	mux.HandleFunc("POST /dedup/{name...}", s.require(RoleOperator, s.storeKnown))
+	mux.HandleFunc("POST /uploads", s.require(RoleOperator, s.startUpload))
+	mux.HandleFunc("GET /uploads/{id}", s.require(RoleOperator, s.getUpload))
+	mux.HandleFunc("PUT /uploads/{id}", s.require(RoleOperator, s.writeUpload))
+	mux.HandleFunc("POST /uploads/{id}/finish", s.require(RoleOperator, s.finishUpload))
+	mux.HandleFunc("DELETE /uploads/{id}", s.require(RoleOperator, s.cancelUpload))
+	mux.HandleFunc("GET /signatures/{name...}", s.require(RoleOperator, s.getSignature))
+	mux.HandleFunc("PUT /uploads/{id}/delta", s.require(RoleOperator, s.writeDelta))
+	mux.HandleFunc("GET /backups", s.require(RoleReadOnly, s.listBackups))
+	mux.HandleFunc("GET /snapshot", s.require(RoleAdmin, s.getSnapshot))
+	mux.HandleFunc("GET /blobs/{id}", s.require(RoleAdmin, s.downloadBlob))
+	mux.HandleFunc("POST /jobs/store", s.require(RoleOperator, s.startStore))
+	mux.HandleFunc("POST /jobs/deduplicate", s.require(RoleOperator, s.startDeduplicate))
+	mux.HandleFunc("POST /jobs/backup", s.require(RoleOperator, s.startBackup))
+	mux.HandleFunc("POST /jobs/verify", s.require(RoleOperator, s.startVerify))
+	mux.HandleFunc("GET /jobs", s.require(RoleReadOnly, s.listJobs))
+	mux.HandleFunc("GET /jobs/{id}", s.require(RoleReadOnly, s.getJob))
+	mux.HandleFunc("GET /jobs/{id}/events", s.require(RoleReadOnly, s.streamJob))
+	mux.HandleFunc("POST /jobs/{id}/cancel", s.require(RoleOperator, s.cancelJob))
+	mux.HandleFunc("POST /jobs/{id}/pause", s.require(RoleOperator, s.pauseJob))
+	mux.HandleFunc("POST /jobs/{id}/resume", s.require(RoleOperator, s.resumeJob))
+	mux.HandleFunc("GET /schedule", s.require(RoleReadOnly, s.listSchedule))
+	mux.HandleFunc(davPrefix, s.require(RoleReadOnly, s.serveDAV))
+	mux.HandleFunc(s3Prefix, s.serveS3)
+	return mux
+}
+
+// ListenAndServe serves the API on addr until ctx is cancelled, then lets
+// the running jobs finish within the shutdown grace period and waits for
+// requests in flight
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	return listenAndServe(ctx, addr, s.Handler(), s.Close)
+}
+
+// Serve the API on listener, such as a Unix socket, like ListenAndServe
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	return serve(ctx, listener, s.Handler(), s.Close)
+}
+
+// Serve handler on addr until ctx is cancelled, then wait for requests in
+// flight and call closeFn
+func listenAndServe(ctx context.Context, addr string, handler http.Handler, closeFn func()) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return serve(ctx, listener, handler, closeFn)
+}
+
+// Serve handler on listener until ctx is cancelled, then wait for requests
+// in flight and call closeFn
+func serve(ctx context.Context, listener net.Listener, handler http.Handler, closeFn func()) error {
+	httpServer := &http.Server{Handler: handler, ReadHeaderTimeout: 30 * time.Second}
+
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		// Jobs end first, so that the clients following them see how
+		closeFn()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		done <- httpServer.Shutdown(shutdownCtx)
+	}()
+
+	err := httpServer.Serve(listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		closeFn()
+		return err
+	}
+	return <-done
+}
+
+// Close stops accepting jobs and cancels the queued ones, gives the running
+// ones the shutdown grace period to finish, then cancels them and waits for
+// them to clean up. It may be called more than once.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if !s.draining {
+		s.draining = true
+		close(s.drain)
+	}
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(s.grace):
+	}
+	s.cancel()
+	<-finished
+}
+
+// Health is the answer of GET /healthz
+type Health struct {
+	Status  string `json:"status"` // ok, stopping or unhealthy
+	Error   string `json:"error,omitempty"`
+	Queued  int    `json:"queued_jobs"`
+	Running int    `json:"running_jobs"`
+}
+
+// Check whether the server can serve requests and count its unfinished jobs
+func (s *Server) health(ctx context.Context) Health {
+	h := Health{Status: "ok"}
+	s.mu.Lock()
+	if s.draining {
+		h.Status = "stopping"
+	}
+	for _, job := range s.jobs {
+		switch job.snapshot().State {
+		case JobQueued:
+			h.Queued++
+		case JobRunning:
+			h.Running++
+		}
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	if err := s.db.PingContext(ctx); err != nil {
+		h.Status = "unhealthy"
+		h.Error = fmt.Sprintf("database: %v", err)
+	}
+	return h
+}
+
+// Answer 200 while the server is healthy and 503 otherwise, including while
+// it shuts down
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	h := s.health(r.Context())
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, h)
+}
+
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(index)
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	versions, err := s.store.Versions(r.Context(), "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Versions are ordered by file, then version
+	latest := []db.Version{}
+	for i, v := range versions {
+		if i+1 == len(versions) || versions[i+1].Filename != v.Filename {
+			latest = append(latest, v)
+		}
+	}
+	writeJSON(w, http.StatusOK, latest)
+}
+
+func (s *Server) listVersions(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	versions, err := s.store.Versions(r.Context(), name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(versions) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", name, db.ErrNoVersion))
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+func (s *Server) listBackups(w http.ResponseWriter, r *http.Request) {
+	backups, err := db.ListBackups(r.Context(), s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if backups == nil {
+		backups = []db.Backup{}
+	}
+	writeJSON(w, http.StatusOK, backups)
+}
+
+// Report whether the storage has room for an upload, writing the error
+// response when it is full
+func (s *Server) checkQuota(w http.ResponseWriter, r *http.Request) bool {
+	if status, err := s.quotaExceeded(r.Context()); err != nil {
+		writeError(w, status, err)
+		return false
+	}
+	return true
+}
+
+// Return the status and error of a repository that is full, or that cannot
+// tell how full it is
+func (s *Server) quotaExceeded(ctx context.Context) (int, error) {
+	if s.quota == 0 {
+		return 0, nil
+	}
+	used, err := s.store.Usage(ctx)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if used >= s.quota {
+		return http.StatusInsufficientStorage, fmt.Errorf("the repository is full: %d of %d bytes used", used, s.quota)
+	}
+	return 0, nil
+}
+
+func (s *Server) storeFile(w http.ResponseWriter, r *http.Request) {
+	if !s.checkQuota(w, r) {
+		return
+	}
+	result, err := s.store.StoreReader(r.Context(), r.PathValue("name"), r.Body)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	status := http.StatusCreated
+	if result.Duplicate {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, result)
+}
+
+// Write the response to a file that could not be stored: 422 when the
+// virus scanner or the content policy refused it
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrInfected) || errors.Is(err, policy.ErrRejected) {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+// Dedup is the answer of GET /dedup: the hash algorithm clients must
+// digest files with to ask whether the server has their content
+type Dedup struct {
+	Algorithm string `json:"algorithm"`
+}
+
+func (s *Server) getDedup(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Dedup{Algorithm: s.store.Algorithm().Name})
+}
+
+// Record a new version of a file whose content the server has already,
+// named by its digest and size, so that the client need not send it.
+// Answers 404 when the content has to be uploaded.
+func (s *Server) storeKnown(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Hash string `json:"hash"`
+		Size int64  `json:"size"`
+	}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if _, err := hex.DecodeString(request.Hash); err != nil || request.Hash == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid hash %q", request.Hash))
+		return
+	}
+	result, err := s.store.StoreKnown(r.Context(), r.PathValue("name"), request.Hash, request.Size)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	status := http.StatusCreated
+	if result.Duplicate {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, result)
+}
+
+// Look up the version of the named file or alias a request asks for, the
+// latest unless the version query parameter says otherwise, writing the
+// error response when there is none
+func (s *Server) requestedVersion(w http.ResponseWriter, r *http.Request) (db.Version, bool) {
+	n := 0
+	if query := r.URL.Query().Get("version"); query != "" {
+		var err error
+		if n, err = strconv.Atoi(query); err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid version %q", query))
+			return db.Version{}, false
+		}
+	}
+	name, err := db.ResolveName(r.Context(), s.db, fsutil.NormalizeName(r.PathValue("name")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return db.Version{}, false
+	}
+	v, err := db.GetVersion(r.Context(), s.db, name, n)
+	if errors.Is(err, db.ErrNoVersion) {
+		writeError(w, http.StatusNotFound, err)
+		return v, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return v, false
+	}
+	return v, true
+}
+
+func (s *Server) downloadFile(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.requestedVersion(w, r)
+	if !ok {
+		return
+	}
+	id := store.StorageID(v)
+	w.Header().Set("X-Version", strconv.Itoa(v.Version))
+	if s.writeBlob(w, r, id, v.Hash, fmt.Sprintf("%s version %d", v.Filename, v.Version)) {
+		s.logRetrieve(r.Context(), v.Filename, id)
+	}
+}
+
+// Serve the blob a recorded version refers to by its storage ID, for
+// cloning the repository
+func (s *Server) downloadBlob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sum, _, _ := strings.Cut(id, ".")
+	if strings.ContainsAny(id, `/\`) || id != sum+path.Ext(id) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid blob %q", id))
+		return
+	}
+	v, err := db.GetVersionByHash(r.Context(), s.db, sum)
+	if err == nil && v.Hash != sum || errors.Is(err, db.ErrNoVersion) || errors.Is(err, db.ErrAmbiguousHash) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("blob %s: %w", id, db.ErrNoVersion))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeBlob(w, r, id, sum, "blob "+id)
+}
+
+// Stream a blob with its size and hash, reporting whether all of it was
+// sent
+func (s *Server) writeBlob(w http.ResponseWriter, r *http.Request, id, sum, name string) bool {
+	ctx := r.Context()
+	size, err := s.store.BlobSize(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to open %s: %w", name, err))
+		return false
+	}
+	content, err := s.store.OpenBlob(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to open %s: %w", name, err))
+		return false
+	}
+	defer func() {
+		_ = content.Close()
+	}()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Hash", sum)
+	w.Header().Set("X-Hash-Algorithm", s.algorithm.Name)
+	if _, err := io.Copy(w, content); err != nil {
+		// The status is already sent; aborting the response lets the client
+		// see that the content is incomplete or damaged
+		s.opts.Events().OnError(event.Error{Op: "download", Name: name, Err: err})
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
+
+// Serve the metadata of the repository read in one transaction, for
+// cloning it
+func (s *Server) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	snap, err := db.ReadSnapshot(r.Context(), s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// Record a download in the action log
+func (s *Server) logRetrieve(ctx context.Context, filename, id string) {
+	if err := db.LogAction(ctx, s.db, "retrieve", filename, id); err != nil {
+		s.opts.Events().OnError(event.Error{Op: "retrieve", Name: filename, Err: err})
+	}
+}
+
+// Write v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+// Write an error as a JSON response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,242 @@
+package server_test
+
+import (
+	"encoding/json"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/delta"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/server"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Start a server on an in-memory repository, configured by setup. Its
+// jobs finish before the repository is closed.
+func newServer(t *testing.T, setup func(*server.Server)) *httptest.Server {
+	t.Helper()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	api := server.New(repo.Store, repo.DB, repo.Store.Algorithm(), repo.Options)
+	t.Cleanup(api.Close)
+	if setup != nil {
+		setup(api)
+	}
+	ts := httptest.NewServer(api.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// Send a request with an optional bearer token, returning the response
+// with its body read
+func do(t *testing.T, method, url, token, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestStoreAndDownload(t *testing.T) {
+	ts := newServer(t, nil)
+
+	resp, body := do(t, "POST", ts.URL+"/files/docs/a.txt", "", "alpha\n")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("store answered %d: %s", resp.StatusCode, body)
+	}
+	var result store.StoreResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Filename != "docs/a.txt" || result.Version != 1 || result.Bytes != 6 {
+		t.Errorf("store gave %+v", result)
+	}
+
+	// The same content again is a duplicate
+	if resp, body := do(t, "POST", ts.URL+"/files/docs/a.txt", "", "alpha\n"); resp.StatusCode != http.StatusOK {
+		t.Errorf("storing a duplicate answered %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := do(t, "POST", ts.URL+"/files/docs/a.txt", "", "alpha 2\n"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("storing a new version answered %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/files/docs/a.txt", "", "")
+	if resp.StatusCode != http.StatusOK || body != "alpha 2\n" || resp.Header.Get("X-Version") != "2" {
+		t.Errorf("download answered %d, version %s: %q", resp.StatusCode, resp.Header.Get("X-Version"), body)
+	}
+	resp, body = do(t, "GET", ts.URL+"/files/docs/a.txt?version=1", "", "")
+	if resp.StatusCode != http.StatusOK || body != "alpha\n" {
+		t.Errorf("download of version 1 answered %d: %q", resp.StatusCode, body)
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/files", "", "")
+	var latest []db.Version
+	if err := json.Unmarshal([]byte(body), &latest); err != nil {
+		t.Fatalf("listing answered %d: %s", resp.StatusCode, body)
+	}
+	if len(latest) != 1 || latest[0].Version != 2 {
+		t.Errorf("listing gave %+v", latest)
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/versions/docs/a.txt", "", "")
+	var versions []db.Version
+	if err := json.Unmarshal([]byte(body), &versions); err != nil || len(versions) != 2 {
+		t.Errorf("versions answered %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/versions/missing.txt", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("versions of a missing file answered %d", resp.StatusCode)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	readerToken, readerDigest, err := server.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	operatorToken, operatorDigest, err := server.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newServer(t, func(api *server.Server) {
+		err := api.SetUsers([]server.User{
+			{Name: "reader", Role: server.RoleReadOnly, TokenSHA256: readerDigest},
+			{Name: "operator", Role: server.RoleOperator, TokenSHA256: operatorDigest},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, tc := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", "/files", "", http.StatusUnauthorized},
+		{"GET", "/files", "wrong", http.StatusUnauthorized},
+		{"GET", "/files", readerToken, http.StatusOK},
+		{"POST", "/files/a.txt", readerToken, http.StatusForbidden},
+		{"POST", "/files/a.txt", operatorToken, http.StatusCreated},
+		{"GET", "/snapshot", operatorToken, http.StatusForbidden},
+	} {
+		if resp, body := do(t, tc.method, ts.URL+tc.path, tc.token, "alpha\n"); resp.StatusCode != tc.status {
+			t.Errorf("%s %s answered %d, want %d: %s", tc.method, tc.path, resp.StatusCode, tc.status, body)
+		}
+	}
+}
+
+func TestJobsConfinedToRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("alpha\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Dir(outside), filepath.Join(root, "link")); err != nil {
+		t.Skipf("symbolic links are not available: %v", err)
+	}
+	ts := newServer(t, func(api *server.Server) {
+		api.ConfineJobs(root)
+	})
+
+	for path, status := range map[string]int{
+		filepath.Join(root, "a.txt"):           http.StatusAccepted,
+		"a.txt":                                http.StatusAccepted,
+		outside:                                http.StatusForbidden,
+		"../" + filepath.Base(outside):         http.StatusForbidden,
+		filepath.Join("link", "secret.txt"):    http.StatusForbidden,
+		filepath.Join(root, "..", "other.txt"): http.StatusForbidden,
+	} {
+		request, err := json.Marshal(map[string]string{"path": path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, body := do(t, "POST", ts.URL+"/jobs/store", "", string(request)); resp.StatusCode != status {
+			t.Errorf("storing %s answered %d, want %d: %s", path, resp.StatusCode, status, body)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ts := newServer(t, func(api *server.Server) {
+		api.SetQuota(4)
+	})
+	if resp, body := do(t, "POST", ts.URL+"/files/a.txt", "", "alpha\n"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("store answered %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := do(t, "POST", ts.URL+"/files/b.txt", "", "bravo\n"); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("store into a full repository answered %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestDeltaUpload(t *testing.T) {
+	ts := newServer(t, func(api *server.Server) {
+		api.SetUploadDir(t.TempDir())
+	})
+	base := strings.Repeat("0123456789abcdef", 1000)
+	changed := "new start " + base
+	if resp, body := do(t, "POST", ts.URL+"/files/a.txt", "", base); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("store answered %d: %s", resp.StatusCode, body)
+	}
+
+	_, body := do(t, "GET", ts.URL+"/signatures/a.txt", "", "")
+	sig := &delta.Signature{}
+	if err := json.Unmarshal([]byte(body), sig); err != nil {
+		t.Fatalf("signature answered %s", body)
+	}
+	var patch strings.Builder
+	if _, err := delta.Diff(sig, strings.NewReader(changed), &patch); err != nil {
+		t.Fatal(err)
+	}
+
+	_, body = do(t, "POST", ts.URL+"/uploads", "", `{"filename": "a.txt"}`)
+	var upload server.Upload
+	if err := json.Unmarshal([]byte(body), &upload); err != nil {
+		t.Fatalf("upload answered %s", body)
+	}
+	// A delta missing the size of its content, or going beyond it, leaves
+	// the upload empty
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"version=1", http.StatusBadRequest},
+		{"version=1&size=" + strconv.Itoa(len(base)), http.StatusBadRequest},
+		{"version=1&size=" + strconv.Itoa(len(changed)), http.StatusOK},
+	} {
+		resp, body := do(t, "PUT", ts.URL+"/uploads/"+upload.ID+"/delta?"+tc.query, "", patch.String())
+		if resp.StatusCode != tc.status {
+			t.Errorf("delta with %s answered %d, want %d: %s", tc.query, resp.StatusCode, tc.status, body)
+		}
+	}
+
+	resp, body := do(t, "POST", ts.URL+"/uploads/"+upload.ID+"/finish", "", "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("finishing the upload answered %d: %s", resp.StatusCode, body)
+	}
+	if _, body := do(t, "GET", ts.URL+"/files/a.txt", "", ""); body != changed {
+		t.Errorf("the delta stored %d bytes differing from the changed file", len(body))
+	}
+}
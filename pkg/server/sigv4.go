@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sigv4Algorithm names AWS signature version 4
+const sigv4Algorithm = "AWS4-HMAC-SHA256"
+
+// sigv4Skew is how far the time a request was signed at may be from ours
+const sigv4Skew = 15 * time.Minute
+
+// sigv4TimeFormat is the layout of X-Amz-Date
+const sigv4TimeFormat = "20060102T150405Z"
+
+// sigv4MaxExpires is the longest a presigned URL may stay valid, 7 days
+const sigv4MaxExpires = 7 * 24 * time.Hour
+
+// Payload hashes that do not cover the body. Streamed bodies are sent in
+// aws-chunked chunks, signed one after another or not at all.
+const (
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPrefix          = "STREAMING-"
+	streamingSignedPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// sigv4ChunkAlgorithm names the signatures of aws-chunked chunks
+const sigv4ChunkAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+
+// errSignature is returned for requests whose signature does not match
+var errSignature = errors.New("the request signature does not match")
+
+// sigv4Request is the signature of a request, from its Authorization
+// header or, for presigned URLs, its query
+type sigv4Request struct {
+	accessKey     string
+	scope         string // date/region/service/aws4_request
+	date          string // the credential scope date
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+	key           []byte // the signing key, once the signature is verified
+}
+
+// Parse the signature of a request
+func parseSigV4(r *http.Request) (*sigv4Request, error) {
+	sig := &sigv4Request{}
+	var credential, signedHeaders string
+	if query := r.URL.Query(); query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != sigv4Algorithm {
+			return nil, fmt.Errorf("unsupported signature algorithm %q", query.Get("X-Amz-Algorithm"))
+		}
+		sig.presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		sig.signature = query.Get("X-Amz-Signature")
+		sig.amzDate = query.Get("X-Amz-Date")
+		sig.payloadHash = unsignedPayload
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds < 0 {
+			return nil, errors.New("invalid X-Amz-Expires")
+		}
+		if time.Duration(seconds)*time.Second > sigv4MaxExpires {
+			return nil, fmt.Errorf("X-Amz-Expires must be at most %d seconds", int(sigv4MaxExpires.Seconds()))
+		}
+		sig.expires = time.Duration(seconds) * time.Second
+	} else {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigv4Algorithm+" ")
+		if !ok {
+			return nil, errors.New("requests must be signed with AWS signature version 4")
+		}
+		for _, field := range strings.Split(auth, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				sig.signature = value
+			}
+		}
+		sig.amzDate = r.Header.Get("X-Amz-Date")
+		sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if sig.payloadHash == "" {
+			return nil, errors.New("missing X-Amz-Content-Sha256 header")
+		}
+		// Chunks signed with ECDSA or followed by signed trailers cannot be checked
+		if strings.HasPrefix(sig.payloadHash, streamingPrefix) && sig.payloadHash != streamingSignedPayload && sig.payloadHash != streamingUnsignedTrailer {
+			return nil, fmt.Errorf("unsupported payload %s", sig.payloadHash)
+		}
+	}
+
+	accessKey, scope, ok := strings.Cut(credential, "/")
+	parts := strings.Split(scope, "/")
+	if !ok || len(parts) != 4 || parts[3] != "aws4_request" {
+		return nil, errors.New("malformed credential")
+	}
+	sig.accessKey, sig.scope, sig.date = accessKey, scope, parts[0]
+	if signedHeaders == "" || sig.signature == "" || sig.amzDate == "" {
+		return nil, errors.New("incomplete signature")
+	}
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+	// Unless the host is signed, a request can be replayed on another one
+	if !slices.Contains(sig.signedHeaders, "host") {
+		return nil, errors.New("the host header must be signed")
+	}
+	return sig, nil
+}
+
+// Authenticate a request signed with AWS signature version 4 by a user
+// with an S3 secret. rawPath is the path the client signed, before any
+// prefix was stripped from the request.
+func (s *Server) authenticateS3(r *http.Request, rawPath string) (User, *sigv4Request, error) {
+	sig, err := parseSigV4(r)
+	if err != nil {
+		return User{}, nil, err
+	}
+	var user User
+	found := false
+	for _, u := range s.users {
+		if u.Name == sig.accessKey && u.S3Secret != "" {
+			user, found = u, true
+		}
+	}
+	if !found {
+		return User{}, nil, fmt.Errorf("access key %s does not exist", sig.accessKey)
+	}
+
+	signed, err := time.Parse(sigv4TimeFormat, sig.amzDate)
+	if err != nil || !strings.HasPrefix(sig.amzDate, sig.date) {
+		return User{}, nil, errors.New("invalid X-Amz-Date")
+	}
+	now := time.Now()
+	if sig.presigned {
+		if now.After(signed.Add(sig.expires)) || signed.After(now.Add(sigv4Skew)) {
+			return User{}, nil, errors.New("the presigned URL has expired")
+		}
+	} else if d := now.Sub(signed); d > sigv4Skew || d < -sigv4Skew {
+		return User{}, nil, errors.New("the difference between the request time and the server's time is too large")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		sigv4Escape(rawPath, false),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, sig.signedHeaders),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{sigv4Algorithm, sig.amzDate, sig.scope, hex.EncodeToString(digest[:])}, "\n")
+
+	key := []byte("AWS4" + user.S3Secret)
+	for _, part := range strings.Split(sig.scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, toSign))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sig.signature))) {
+		return User{}, nil, errSignature
+	}
+	sig.key = key
+	return user, sig, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Escape s the way signature version 4 does, leaving only unreserved
+// characters and, unless all is set, slashes as they are
+func sigv4Escape(s string, all bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !all:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Return the canonical query string, without the signature of presigned URLs
+func canonicalQuery(query url.Values) string {
+	var pairs [][2]string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, [2]string{sigv4Escape(key, true), sigv4Escape(value, true)})
+		}
+	}
+	// Sorted by key, then value
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	joined := make([]string, len(pairs))
+	for i, pair := range pairs {
+		joined[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(joined, "&")
+}
+
+// Return the canonical headers block, each signed header on its own line
+func canonicalHeaders(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = r.Header.Get("Content-Length")
+			if value == "" {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		default:
+			var values []string
+			for _, v := range r.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	return b.String()
+}
+
+// Return the body of a request with the given payload hash, signed by sig
+// unless it is nil: aws-chunked bodies are decoded, and their chunks fail
+// unless each matches its signature in the chain started by sig. Other
+// bodies whose hash was signed fail at their end unless they match it.
+func s3Body(r *http.Request, payloadHash string, sig *sigv4Request) io.Reader {
+	var body io.Reader = r.Body
+	if strings.HasPrefix(payloadHash, streamingPrefix) || strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		chunked := &awsChunkedReader{r: bufio.NewReader(body)}
+		if sig != nil && payloadHash == streamingSignedPayload {
+			chunked.chain = &chunkChain{key: sig.key, amzDate: sig.amzDate, scope: sig.scope, previous: strings.ToLower(sig.signature), hash: sha256.New()}
+		}
+		return chunked
+	}
+	if payloadHash == "" || payloadHash == unsignedPayload {
+		return body
+	}
+	return &verifyingReader{r: body, hash: sha256.New(), want: strings.ToLower(payloadHash)}
+}
+
+// verifyingReader fails at the end of a body that does not hash to want
+type verifyingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) && hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+		return n, fmt.Errorf("content does not match X-Amz-Content-Sha256: %w", errSignature)
+	}
+	return n, err
+}
+
+// chunkChain checks the signatures of aws-chunked chunks, each of which
+// signs its data and the signature before it
+type chunkChain struct {
+	key      []byte
+	amzDate  string
+	scope    string
+	previous string    // the signature of the chunk before, or the request
+	want     string    // the signature of the current chunk
+	hash     hash.Hash // of the current chunk
+}
+
+// Start checking a chunk from its header extensions
+func (c *chunkChain) start(extensions string) error {
+	for _, extension := range strings.Split(extensions, ";") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(extension), "chunk-signature="); ok {
+			c.want = strings.ToLower(value)
+			c.hash.Reset()
+			return nil
+		}
+	}
+	return fmt.Errorf("chunk without a chunk-signature: %w", errSignature)
+}
+
+// Check the chunk read since start against its signature
+func (c *chunkChain) verify() error {
+	empty := sha256.Sum256(nil)
+	toSign := strings.Join([]string{sigv4ChunkAlgorithm, c.amzDate, c.scope, c.previous,
+		hex.EncodeToString(empty[:]), hex.EncodeToString(c.hash.Sum(nil))}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(c.key, toSign))
+	if !hmac.Equal([]byte(expected), []byte(c.want)) {
+		return fmt.Errorf("chunk signature does not match: %w", errSignature)
+	}
+	c.previous = c.want
+	return nil
+}
+
+// awsChunkedReader decodes the aws-chunked content encoding: chunks of
+// "size[;extensions]\r\ndata\r\n" up to one of size 0, then trailers.
+// With a chain, each chunk is checked against its signature once read.
+type awsChunkedReader struct {
+	r     *bufio.Reader
+	chain *chunkChain
+	left  int64 // bytes of the current chunk not read yet
+	more  bool  // a chunk was read, whose terminating CRLF follows
+	done  bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		if c.more {
+			if _, err := c.line(); err != nil {
+				return 0, err
+			}
+		}
+		header, err := c.line()
+		if err != nil {
+			return 0, err
+		}
+		sizeField, extensions, _ := strings.Cut(header, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("malformed aws-chunked body: bad chunk size %q", sizeField)
+		}
+		if c.chain != nil {
+			if err := c.chain.start(extensions); err != nil {
+				return 0, err
+			}
+		}
+		if size == 0 {
+			// The final chunk is signed too, ending the chain
+			if c.chain != nil {
+				if err := c.chain.verify(); err != nil {
+					return 0, err
+				}
+			}
+			// Trailers, such as checksums, end with an empty line
+			for {
+				line, err := c.line()
+				if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+					return 0, err
+				}
+				if line == "" {
+					break
+				}
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left, c.more = size, true
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if c.chain != nil {
+		c.chain.hash.Write(p[:n])
+		if c.left == 0 && err == nil {
+			err = c.chain.verify()
+		}
+	}
+	return n, err
+}
+
+// Read a line without its CRLF
+func (c *awsChunkedReader) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		return strings.TrimRight(line, "\r\n"), io.ErrUnexpectedEOF
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tenantPrefix is where Tenants serves each repository, by name
+const tenantPrefix = "/repos/"
+
+// Tenants serves several isolated repositories, each by its own Server with
+// its own database, storage, users and quota. A repository is selected by
+// its path, /repos/<name>/, or by a token of one of its users: requests
+// outside /repos/ go to the only repository the request authenticates
+// with.
+type Tenants struct {
+	servers map[string]*Server
+}
+
+// NewTenants returns a multi-repository server without repositories
+func NewTenants() *Tenants {
+	return &Tenants{servers: map[string]*Server{}}
+}
+
+// Add serves a repository under name
+func (t *Tenants) Add(name string, s *Server) error {
+	if name == "" || strings.ContainsAny(name, "/?#%") || name == "." || name == ".." {
+		return fmt.Errorf("invalid repository name %q", name)
+	}
+	if _, exists := t.servers[name]; exists {
+		return fmt.Errorf("repository %s is added twice", name)
+	}
+	t.servers[name] = s
+	return nil
+}
+
+// Names returns the names of the repositories, sorted
+func (t *Tenants) Names() []string {
+	names := make([]string, 0, len(t.servers))
+	for name := range t.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler returns the HTTP handler serving every repository as described
+// by Server.Handler below /repos/<name>, at GET /repos the names of the
+// repositories the request may use, and at GET /healthz the health of
+// every repository
+func (t *Tenants) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos", t.listRepos)
+	mux.HandleFunc("GET /healthz", t.healthz)
+	handlers := map[string]http.Handler{}
+	for _, name := range t.Names() {
+		prefix := tenantPrefix + name
+		handlers[name] = t.servers[name].Handler()
+		mux.Handle(prefix+"/", withBase(prefix, http.StripPrefix(prefix, handlers[name])))
+		mux.Handle(prefix, http.RedirectHandler(prefix+"/", http.StatusMovedPermanently))
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.serveByToken(w, r, handlers)
+	})
+	return mux
+}
+
+// ListenAndServe serves the repositories on addr until ctx is cancelled,
+// then waits for requests in flight and cancels the running jobs
+func (t *Tenants) ListenAndServe(ctx context.Context, addr string) error {
+	return listenAndServe(ctx, addr, t.Handler(), t.Close)
+}
+
+// Serve the repositories on listener like ListenAndServe
+func (t *Tenants) Serve(ctx context.Context, listener net.Listener) error {
+	return serve(ctx, listener, t.Handler(), t.Close)
+}
+
+// Close shuts down the jobs of every repository like Server.Close, all
+// within the same grace period
+func (t *Tenants) Close() {
+	var wg sync.WaitGroup
+	for _, s := range t.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// Answer 200 while every repository is healthy and 503 otherwise
+func (t *Tenants) healthz(w http.ResponseWriter, r *http.Request) {
+	var answer struct {
+		Status       string            `json:"status"`
+		Repositories map[string]Health `json:"repositories"`
+	}
+	answer.Status = "ok"
+	answer.Repositories = map[string]Health{}
+	for name, s := range t.servers {
+		h := s.health(r.Context())
+		answer.Repositories[name] = h
+		if h.Status != "ok" && answer.Status != "unhealthy" {
+			answer.Status = h.Status
+		}
+	}
+	status := http.StatusOK
+	if answer.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, answer)
+}
+
+// List the repositories that are open or that the request authenticates
+// with
+func (t *Tenants) listRepos(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for _, name := range t.Names() {
+		s := t.servers[name]
+		if _, ok := s.authenticate(r); ok || len(s.users) == 0 {
+			names = append(names, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, names)
+}
+
+// Serve a request outside /repos/ by the handler of the repository whose
+// users its token belongs to
+func (t *Tenants) serveByToken(w http.ResponseWriter, r *http.Request, handlers map[string]http.Handler) {
+	var matched []string
+	for _, name := range t.Names() {
+		s := t.servers[name]
+		if _, ok := s.authenticate(r); ok && len(s.users) > 0 {
+			matched = append(matched, name)
+		}
+	}
+	switch len(matched) {
+	case 1:
+		handlers[matched[0]].ServeHTTP(w, r)
+	case 0:
+		w.Header().Set("WWW-Authenticate", `Basic realm="file manager", charset="UTF-8"`)
+		writeError(w, http.StatusUnauthorized, errors.New("select a repository under "+tenantPrefix+"<name>/ or authenticate with the token of a repository user"))
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("the token is valid for repositories %s; select one under %s<name>/", strings.Join(matched, ", "), tenantPrefix))
+	}
+}
+
+// baseKey is the context key of the path a repository is served below
+type baseKey struct{}
+
+// Record the path a handler is served below, for links in its responses
+func withBase(base string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), baseKey{}, base)))
+	})
+}
+
+// Return the path the repository serving a request is served below, empty
+// when it is served at the root
+func basePath(ctx context.Context) string {
+	base, _ := ctx.Value(baseKey{}).(string)
+	return base
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/policy"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadExpiry is how long an unfinished upload is kept after it was last
+// written to
+const uploadExpiry = 7 * 24 * time.Hour
+
+// ChecksumHeader carries the checksum of an upload chunk as "sha256 <hex>".
+// A chunk that does not match it is discarded, and the client resends it.
+const ChecksumHeader = "Upload-Checksum"
+
+// Parse the checksum of a chunk, returning nil when the header is absent
+func parseChecksum(header string) ([]byte, error) {
+	if header == "" {
+		return nil, nil
+	}
+	algorithm, digest, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(algorithm, "sha256") {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q (use sha256)", algorithm)
+	}
+	sum, err := hex.DecodeString(strings.TrimSpace(digest))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid %s header %q", ChecksumHeader, header)
+	}
+	return sum, nil
+}
+
+// Upload describes a file being uploaded in chunks. Its content so far is
+// kept next to it in the upload directory, so that an interrupted upload
+// can be resumed from Offset, even after the server restarts.
+type Upload struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Principal string    `json:"principal,omitempty"` // who started it; only they may continue it
+	Started   time.Time `json:"started"`
+	Offset    int64     `json:"offset"` // bytes received
+}
+
+// uploads serializes the requests writing to an upload
+type uploads struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// SetUploadDir keeps the chunks of resumable uploads in dir. Without it
+// only single-request uploads are accepted.
+func (s *Server) SetUploadDir(dir string) {
+	s.uploadDir = dir
+}
+
+// Claim an upload for the duration of a request, reporting false when
+// another request is writing to it
+func (u *uploads) claim(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.active == nil {
+		u.active = map[string]bool{}
+	}
+	if u.active[id] {
+		return false
+	}
+	u.active[id] = true
+	return true
+}
+
+func (u *uploads) release(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.active, id)
+}
+
+// Claim an upload for a request, writing the error response when another
+// request has it
+func (s *Server) claimUpload(w http.ResponseWriter, id string) bool {
+	if !s.uploads.claim(id) {
+		writeError(w, http.StatusConflict, fmt.Errorf("upload %s is being written by another request", id))
+		return false
+	}
+	return true
+}
+
+// Return the path of an upload's description and of its content
+func (s *Server) uploadPaths(id string) (info, content string) {
+	return filepath.Join(s.uploadDir, id+".json"), filepath.Join(s.uploadDir, id+".part")
+}
+
+func (s *Server) startUpload(w http.ResponseWriter, r *http.Request) {
+	if s.uploadDir == "" {
+		writeError(w, http.StatusNotImplemented, errors.New("resumable uploads are not enabled"))
+		return
+	}
+	var request struct {
+		Filename string `json:"filename"`
+	}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Filename == "" {
+		writeError(w, http.StatusBadRequest, errors.New("filename is required"))
+		return
+	}
+	if !s.checkQuota(w, r) {
+		return
+	}
+	if err := os.MkdirAll(s.uploadDir, os.ModePerm); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create upload directory: %w", err))
+		return
+	}
+	s.expireUploads()
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	upload := &Upload{
+		ID:        hex.EncodeToString(secret),
+		Filename:  request.Filename,
+		Principal: db.Principal(r.Context()),
+		Started:   time.Now().UTC(),
+	}
+	infoPath, contentPath := s.uploadPaths(upload.ID)
+	if err := os.WriteFile(contentPath, nil, 0o600); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create upload: %w", err))
+		return
+	}
+	data, err := json.Marshal(upload)
+	if err == nil {
+		err = os.WriteFile(infoPath, data, 0o600)
+	}
+	if err != nil {
+		_ = os.Remove(contentPath)
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create upload: %w", err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, upload)
+}
+
+// Load the upload a request refers to, writing the error response when it
+// does not exist or belongs to another user
+func (s *Server) loadUpload(w http.ResponseWriter, r *http.Request) (*Upload, bool) {
+	id := r.PathValue("id")
+	if _, err := hex.DecodeString(id); err != nil || s.uploadDir == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("upload %s does not exist", id))
+		return nil, false
+	}
+	infoPath, contentPath := s.uploadPaths(id)
+	data, err := os.ReadFile(infoPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("upload %s does not exist", id))
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	upload := &Upload{}
+	if err := json.Unmarshal(data, upload); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read upload %s: %w", id, err))
+		return nil, false
+	}
+	if upload.Principal != db.Principal(r.Context()) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("upload %s was started by another user", id))
+		return nil, false
+	}
+	info, err := os.Stat(contentPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("upload %s does not exist", id))
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	upload.Offset = info.Size()
+	return upload, true
+}
+
+func (s *Server) getUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.claimUpload(w, id) {
+		return
+	}
+	defer s.uploads.release(id)
+	if upload, ok := s.loadUpload(w, r); ok {
+		writeJSON(w, http.StatusOK, upload)
+	}
+}
+
+// Append the request body to an upload. The offset query parameter must
+// match the bytes received so far, so that a chunk retried after a lost
+// response is not appended twice. A chunk sent with a checksum is kept
+// only when it arrived whole and matches it.
+func (s *Server) writeUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.claimUpload(w, id) {
+		return
+	}
+	defer s.uploads.release(id)
+	upload, ok := s.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeError(w, http.StatusConflict, fmt.Errorf("upload %s continues at offset %d", id, upload.Offset))
+		return
+	}
+
+	checksum, err := parseChecksum(r.Header.Get(ChecksumHeader))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	_, contentPath := s.uploadPaths(id)
+	f, err := os.OpenFile(contentPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	digest := sha256.New()
+	written, err := io.Copy(io.MultiWriter(f, digest), r.Body)
+	if checksum != nil && (err != nil || !bytes.Equal(digest.Sum(nil), checksum)) {
+		// Drop what arrived of the chunk, so that it is resent whole
+		if truncErr := f.Truncate(upload.Offset); truncErr != nil && err == nil {
+			err = truncErr
+		}
+		written = 0
+		if err == nil {
+			_ = f.Close()
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("chunk of upload %s at offset %d does not match its checksum", id, upload.Offset))
+			return
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	upload.Offset += written
+	if err != nil {
+		// The bytes received are kept; the client resumes from the offset
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to write upload %s: %w", id, err))
+		return
+	}
+	writeJSON(w, http.StatusOK, upload)
+}
+
+// Store a completed upload as a new version. The size and sha256 query
+// parameters, when given, must match the bytes received.
+func (s *Server) finishUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.claimUpload(w, id) {
+		return
+	}
+	defer s.uploads.release(id)
+	upload, ok := s.loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if query := r.URL.Query().Get("size"); query != "" {
+		if size, err := strconv.ParseInt(query, 10, 64); err != nil || size != upload.Offset {
+			writeError(w, http.StatusConflict, fmt.Errorf("upload %s has %d bytes, not %s", id, upload.Offset, query))
+			return
+		}
+	}
+	var checksum []byte
+	if query := r.URL.Query().Get("sha256"); query != "" {
+		sum, err := parseChecksum("sha256 " + query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		checksum = sum
+	}
+	if !s.checkQuota(w, r) {
+		return
+	}
+
+	infoPath, contentPath := s.uploadPaths(id)
+	f, err := os.Open(contentPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if checksum != nil {
+		digest := sha256.New()
+		_, err := io.Copy(digest, f)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			_ = f.Close()
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to read upload %s: %w", id, err))
+			return
+		}
+		if !bytes.Equal(digest.Sum(nil), checksum) {
+			_ = f.Close()
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("upload %s does not match its checksum", id))
+			return
+		}
+	}
+	result, err := s.store.StoreReader(r.Context(), upload.Filename, f)
+	_ = f.Close()
+	if err != nil {
+		// Refused content is not kept for the upload to be resumed
+		if errors.Is(err, store.ErrInfected) || errors.Is(err, policy.ErrRejected) {
+			_ = os.Remove(infoPath)
+			_ = os.Remove(contentPath)
+		}
+		writeStoreError(w, err)
+		return
+	}
+	// Without its description the upload no longer exists for clients
+	_ = os.Remove(infoPath)
+	_ = os.Remove(contentPath)
+	status := http.StatusCreated
+	if result.Duplicate {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, result)
+}
+
+func (s *Server) cancelUpload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.claimUpload(w, id) {
+		return
+	}
+	defer s.uploads.release(id)
+	if _, ok := s.loadUpload(w, r); !ok {
+		return
+	}
+	infoPath, contentPath := s.uploadPaths(id)
+	if err := os.Remove(infoPath); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	_ = os.Remove(contentPath)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove the uploads nobody wrote to within uploadExpiry
+func (s *Server) expireUploads() {
+	entries, err := os.ReadDir(s.uploadDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".part")
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < uploadExpiry || !s.uploads.claim(id) {
+			continue
+		}
+		infoPath, contentPath := s.uploadPaths(id)
+		_ = os.Remove(infoPath)
+		_ = os.Remove(contentPath)
+		s.uploads.release(id)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// davPrefix is where the WebDAV view of the versions is served
+const davPrefix = "/dav/"
+
+// davMethods are the methods the read-only WebDAV endpoint supports
+const davMethods = "OPTIONS, GET, HEAD, PROPFIND"
+
+// multistatus is the body of a PROPFIND response
+type multistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	SupportedLock *struct{}       `xml:"D:supportedlock"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+// Serve the versions read-only over WebDAV, laid out like Store.VersionFS,
+// so that they can be mapped as a network drive
+func (s *Server) serveDAV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", "1")
+	w.Header().Set("MS-Author-Via", "DAV")
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", davMethods)
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodGet, http.MethodHead, "PROPFIND":
+	default:
+		w.Header().Set("Allow", davMethods)
+		http.Error(w, "the WebDAV view is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, davPrefix))[1:]
+	if name == "" {
+		name = "."
+	}
+	vfs, err := s.store.VersionFS(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := fs.Stat(vfs, name)
+	if err != nil {
+		http.Error(w, err.Error(), davStatus(err))
+		return
+	}
+
+	if r.Method == "PROPFIND" {
+		s.propfind(w, r, vfs, name, info)
+		return
+	}
+	if info.IsDir() {
+		listDAVDir(w, r, vfs, name)
+		return
+	}
+	f, err := vfs.Open(name)
+	if err != nil {
+		http.Error(w, err.Error(), davStatus(err))
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		s.opts.Events().OnError(event.Error{Op: "download", Name: name, Err: err})
+		panic(http.ErrAbortHandler)
+	}
+	if v, ok := f.(interface{ Version() db.Version }); ok {
+		s.logRetrieve(r.Context(), v.Version().Filename, store.StorageID(v.Version()))
+	}
+}
+
+// Answer a PROPFIND for name and, at depth 1, its entries
+func (s *Server) propfind(w http.ResponseWriter, r *http.Request, vfs fs.FS, name string, info fs.FileInfo) {
+	depth := r.Header.Get("Depth")
+	if depth == "" || strings.EqualFold(depth, "infinity") {
+		// Listing every version at once is refused, as RFC 4918 allows
+		http.Error(w, "PROPFIND with infinite depth is not supported", http.StatusForbidden)
+		return
+	}
+	base := basePath(r.Context())
+	result := multistatus{Namespace: "DAV:", Responses: []davResponse{davEntry(base, name, info)}}
+	if depth == "1" && info.IsDir() {
+		entries, err := fs.ReadDir(vfs, name)
+		if err != nil {
+			http.Error(w, err.Error(), davStatus(err))
+			return
+		}
+		for _, entry := range entries {
+			entryInfo, err := entry.Info()
+			if err != nil {
+				http.Error(w, err.Error(), davStatus(err))
+				return
+			}
+			result.Responses = append(result.Responses, davEntry(base, path.Join(name, entry.Name()), entryInfo))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// Describe a file or directory in a PROPFIND response
+func davEntry(base, name string, info fs.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:   path.Base(name),
+		LastModified:  info.ModTime().UTC().Format(http.TimeFormat),
+		SupportedLock: &struct{}{},
+	}
+	if name == "." {
+		prop.DisplayName = ""
+	}
+	if info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := info.Size()
+		prop.ContentLength = &size
+		prop.ContentType = "application/octet-stream"
+	}
+	return davResponse{
+		Href:     davHref(base, name, info.IsDir()),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// Return the URL path of a file or directory of the WebDAV view served
+// below base
+func davHref(base, name string, dir bool) string {
+	if name == "." {
+		return base + davPrefix
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	href := base + davPrefix + strings.Join(parts, "/")
+	if dir {
+		href += "/"
+	}
+	return href
+}
+
+// List a directory for browsers visiting the WebDAV view
+func listDAVDir(w http.ResponseWriter, r *http.Request, vfs fs.FS, name string) {
+	entries, err := fs.ReadDir(vfs, name)
+	if err != nil {
+		http.Error(w, err.Error(), davStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	base := basePath(r.Context())
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<ul>\n", html.EscapeString(davHref(base, name, true)))
+	for _, entry := range entries {
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n",
+			html.EscapeString(davHref(base, path.Join(name, entry.Name()), entry.IsDir())), html.EscapeString(entry.Name()))
+	}
+	fmt.Fprintln(w, "</ul>")
+}
+
+// Map a file system error to an HTTP status
+func davStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
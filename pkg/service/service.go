@@ -0,0 +1,164 @@
+// Package service runs the file manager under a service manager: it tells
+// systemd when the service is ready or stopping, and writes the service
+// definitions that install it under systemd or as a Windows service.
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Notify sends a state change such as READY=1 or STOPPING=1 to systemd when
+// it started the process as a Type=notify service. It does nothing
+// otherwise.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to notify service manager: %w", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify service manager: %w", err)
+	}
+	return nil
+}
+
+// Definition describes a service to install
+type Definition struct {
+	Name        string
+	Description string
+	Executable  string
+	Args        []string
+	Dir         string // working directory
+	User        string // account to run as, where the format supports it
+
+	// StopTimeout is how long the service manager waits for the service to
+	// stop after asking it to, before killing it
+	StopTimeout time.Duration
+}
+
+// Formats lists the service definition formats Write supports
+var Formats = []string{"systemd", "winsw"}
+
+// Write the definition in format: a systemd unit, or the configuration of
+// WinSW, the wrapper that runs a console program as a Windows service. WinSW
+// stops the program with Ctrl-C, which shuts it down like SIGTERM does.
+func (d *Definition) Write(format string) ([]byte, error) {
+	var tmpl *template.Template
+	switch format {
+	case "systemd":
+		tmpl = systemdUnit
+	case "winsw":
+		tmpl = winswConfig
+	default:
+		return nil, fmt.Errorf("unsupported service format %q (use %s)", format, strings.Join(Formats, " or "))
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return nil, fmt.Errorf("failed to write %s service: %w", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+var systemdUnit = template.Must(template.New("systemd").Funcs(template.FuncMap{
+	"quote":   systemdQuote,
+	"literal": systemdLiteral,
+}).Parse(`[Unit]
+Description={{literal .Description}}
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart={{quote .Executable}}{{range .Args}} {{quote .}}{{end}}
+WorkingDirectory={{literal .Dir}}
+{{- if .User}}
+User={{.User}}
+{{- end}}
+Restart=on-failure
+RestartSec=5s
+KillSignal=SIGTERM
+KillMode=mixed
+TimeoutStopSec={{printf "%.0f" .StopTimeout.Seconds}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var winswConfig = template.Must(template.New("winsw").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+	"arg": windowsQuote,
+}).Parse(`<service>
+  <id>{{xml .Name}}</id>
+  <name>{{xml .Name}}</name>
+  <description>{{xml .Description}}</description>
+  <executable>{{xml .Executable}}</executable>
+  <arguments>{{range $i, $arg := .Args}}{{if $i}} {{end}}{{xml (arg $arg)}}{{end}}</arguments>
+  <workingdirectory>{{xml .Dir}}</workingdirectory>
+  <stoptimeout>{{printf "%.0f" .StopTimeout.Seconds}} sec</stoptimeout>
+  <onfailure action="restart" delay="5 sec"/>
+  <log mode="roll"/>
+</service>
+`))
+
+// Quote a word of a systemd command line or setting
+func systemdQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
+
+// Escape the specifiers systemd expands in a setting
+func systemdLiteral(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// Quote a command line argument the way Windows programs split them
+func windowsQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"") {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for _, c := range s {
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			// Backslashes before a quote are escaped along with it
+			b.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		b.WriteRune(c)
+	}
+	// Backslashes before the closing quote are escaped too
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Escape text for an XML element
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,227 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/content"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AdoptReport summarizes an adopted tree
+type AdoptReport struct {
+	Source     string `json:"source"`
+	Registered int    `json:"registered"` // files recorded as version 1
+	Copied     int    `json:"copied"`     // registered files whose content was copied into storage
+	Skipped    int    `json:"skipped"`    // files that had versions already
+	Bytes      int64  `json:"bytes"`
+
+	// Unreadable lists the parts of the tree that were skipped as they
+	// could not be read, with why
+	Unreadable []string `json:"unreadable,omitempty"`
+}
+
+// Print the report in a human-readable form
+func (r *AdoptReport) Print() {
+	for _, skipped := range r.Unreadable {
+		fmt.Printf("unreadable %s\n", skipped)
+	}
+	fmt.Printf("Adopted %s: %d files registered (%d copied into storage), %d skipped as already versioned, %d bytes\n",
+		r.Source, r.Registered, r.Copied, r.Skipped, r.Bytes)
+}
+
+// Adopt registers every file of directory as version 1, keyed by its name
+// within directory like StoreDirectory keys them, giving an existing
+// archive a catalog at once. Files with versions already are skipped. The
+// content stays where it is and is read from there when retrieved, unless
+// copyBlobs is set, which copies it into storage as well.
+func (s *Store) Adopt(ctx context.Context, directory string, copyBlobs bool) (*AdoptReport, error) {
+	report := &AdoptReport{Source: directory}
+	latest, err := db.ListLatestVersions(ctx, s.db, db.VersionFilter{})
+	if err != nil {
+		return report, fmt.Errorf("failed to list versions: %w", err)
+	}
+	versioned := make(map[string]bool, len(latest))
+	for _, v := range latest {
+		versioned[v.Filename] = true
+	}
+
+	walkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	fsys := fsutil.HostFS(directory)
+	root := sourcePath(directory)
+	workers := max(s.workers, 1)
+	names := make(chan string, workers*2)
+	files := make(chan treeFile, workers*2)
+	var walkErr error
+	go func() {
+		defer close(names)
+		skip := func(name string, err error) {
+			report.Unreadable = append(report.Unreadable, fmt.Sprintf("%s: %v", name, err))
+		}
+		walkErr = fs.WalkDir(fsys, ".", s.opts.SkipUnreadable("adopt", ".", skip, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := walkCtx.Err(); err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			if versioned[name] {
+				report.Skipped++
+				return nil
+			}
+			select {
+			case names <- name:
+				return nil
+			case <-walkCtx.Done():
+				return walkCtx.Err()
+			}
+		}))
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				source := path.Join(root, name)
+				var blob *Blob
+				var err error
+				if copyBlobs {
+					blob, err = s.writeBlobFS(walkCtx, fsys, name, source)
+				} else {
+					blob, err = s.registerBlob(walkCtx, fsys, name, source)
+				}
+				if err != nil {
+					err = fmt.Errorf("failed to adopt %s: %w", name, err)
+				}
+				files <- treeFile{name: name, blob: blob, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(files)
+	}()
+
+	batch := db.NewBatch(s.db, db.BatchSize)
+	defer s.flushCache(ctx)
+	var errs []error
+	for file := range files {
+		if file.err != nil {
+			if len(errs) == 0 {
+				cancel()
+			}
+			errs = append(errs, file.err)
+			continue
+		}
+		stored := s.stored(ctx, file.blob)
+		if file.blob.Duplicate || !copyBlobs {
+			// Another version refers to the blob, or there is none
+			stored.Remove = nil
+		}
+		if !copyBlobs {
+			stored.Action.ActionType = "adopt"
+			stored.External = file.blob.external
+		}
+		if err := batch.AddStore(context.WithoutCancel(ctx), stored); err != nil {
+			errs = append(errs, err)
+			cancel()
+			continue
+		}
+		report.Registered++
+		report.Bytes += file.blob.Bytes
+		if copyBlobs && !file.blob.Duplicate {
+			report.Copied++
+		}
+		s.opts.Events().OnFileStored(s.fileStored(file.blob, file.name))
+	}
+	if walkErr != nil && len(errs) == 0 {
+		errs = append(errs, walkErr)
+	}
+	if err := batch.Flush(context.WithoutCancel(ctx)); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		// Files cut short by the first failure only report the cancellation
+		return report, errs[0]
+	}
+	return report, db.RecordAction(ctx, s.db, db.Action{ActionType: "adopt_tree", Filename: root, Bytes: report.Bytes})
+}
+
+// Describe the file name of fsys, at source on the host, as a blob that
+// stays there: it is hashed, or its cached digest used, without copying
+// it. Content stored already refers to that blob instead.
+func (s *Store) registerBlob(ctx context.Context, fsys fs.FS, name, source string) (*Blob, error) {
+	start := time.Now()
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat source file: %w", err)
+	}
+
+	head := &content.Head{}
+	sum, cached := s.cachedHash(ctx, source, info)
+	if cached {
+		if _, err := io.CopyN(head, file, content.SniffLen); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read source file: %w", err)
+		}
+	} else {
+		if sum, err = s.hash.Reader(ctx, io.TeeReader(file, head)); err != nil {
+			return nil, fmt.Errorf("failed to hash file: %w", err)
+		}
+		if err := s.cache.Remember(ctx, source, info, sum); err != nil {
+			s.opts.Events().OnError(event.Error{Op: "hash cache", Name: source, Err: err})
+		}
+	}
+
+	blob := s.newBlob(name, sum)
+	blob.Source = source
+	blob.Type = content.Detect(name, head.Bytes())
+	blob.Xattrs = s.sourceXattrs(file, source)
+	if _, err := s.exists(ctx, blob); err != nil {
+		return nil, err
+	}
+	if !blob.Duplicate {
+		blob.Bytes = info.Size()
+		blob.Path = filepath.FromSlash(source)
+		blob.external = &db.ExternalBlob{StorageID: blob.StorageID, Path: source, Size: info.Size(), ModTime: info.ModTime()}
+	}
+	blob.Duration = time.Since(start)
+	return blob, nil
+}
+
+// Open the file an external blob stays in. Failing that, err is returned,
+// the error opening the blob from storage.
+func (s *Store) openExternal(ctx context.Context, id string, err error) (io.ReadCloser, error) {
+	external, ok, lookupErr := db.GetExternalBlob(ctx, s.db, id)
+	if lookupErr != nil {
+		return nil, errors.Join(err, lookupErr)
+	}
+	if !ok {
+		return nil, err
+	}
+	file, openErr := os.Open(fsutil.LongPath(filepath.FromSlash(external.Path)))
+	if openErr != nil {
+		return nil, fmt.Errorf("blob %s is not stored and its adopted file is gone: %w", id, openErr)
+	}
+	return file, nil
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Backend keeps blob contents by storage ID. Backends must be safe for
+// concurrent use.
+type Backend interface {
+	// Stat returns the size of a blob. A missing blob gives an error
+	// wrapping fs.ErrNotExist.
+	Stat(ctx context.Context, id string) (int64, error)
+
+	// Open returns the contents of a blob
+	Open(ctx context.Context, id string) (io.ReadCloser, error)
+
+	// Write stores everything read from r as the blob id and returns the
+	// number of bytes written. The blob must only become visible once it is
+	// complete.
+	Write(ctx context.Context, id string, r io.Reader) (int64, error)
+
+	// Remove deletes a blob
+	Remove(ctx context.Context, id string) error
+
+	// List calls fn with the ID of every complete blob
+	List(ctx context.Context, fn func(id string) error) error
+
+	// Location describes where a blob is kept, for messages
+	Location(id string) string
+}
+
+// BackendFactory opens a backend from its configured settings. root is the
+// repository directory that relative paths resolve against.
+type BackendFactory func(settings map[string]string, root string, opts fsutil.Options) (Backend, error)
+
+var backends = map[string]BackendFactory{
+	"local":  openLocal,
+	"memory": openMemory,
+}
+
+// RegisterBackend makes a backend available under name. It is meant to be
+// called from the init function of the package providing the backend and
+// panics if the name is taken.
+func RegisterBackend(name string, factory BackendFactory) {
+	if _, exists := backends[name]; exists {
+		panic("store: backend " + name + " registered twice")
+	}
+	backends[name] = factory
+}
+
+// OpenBackend opens the backend registered under name. Its operations are
+// retried as opts.Retry says.
+func OpenBackend(name string, settings map[string]string, root string, opts fsutil.Options) (Backend, error) {
+	factory, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q (use %s)", name, strings.Join(BackendNames(), ", "))
+	}
+	backend, err := factory(settings, root, opts)
+	if err != nil || opts.Retry.Attempts <= 1 {
+		return backend, err
+	}
+	return &retrying{backend: backend, policy: opts.Retry}, nil
+}
+
+// BackendNames returns the names of the registered backends, sorted
+func BackendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
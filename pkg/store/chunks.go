@@ -0,0 +1,261 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/chunker"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// chunkPrefix starts the IDs of chunks, followed by their digest
+const chunkPrefix = "chunk-"
+
+// DefaultChunkMinSize is the size from which blobs are stored in chunks
+const DefaultChunkMinSize = 16 << 20
+
+// ChunkProcessor stores every new blob of at least minSize bytes as
+// content-defined chunks, which blobs sharing content share, instead of
+// whole. It must come after processors reading blobs from the backend.
+func ChunkProcessor(minSize int64) Processor {
+	return ProcessorFunc(func(ctx context.Context, s *Store, result *StoreResult) error {
+		if result.Bytes < minSize {
+			return nil
+		}
+		if _, err := s.backend.Stat(ctx, result.StorageID); err != nil {
+			// Chunked, stored as a delta or adopted in place already
+			return nil
+		}
+		_, err := s.chunkBlob(ctx, result.StorageID)
+		return err
+	})
+}
+
+// ChunkReport summarizes storing blobs in chunks or whole again
+type ChunkReport struct {
+	Chunked      int   `json:"chunked"`
+	Joined       int   `json:"joined"` // blobs stored whole again
+	BytesWritten int64 `json:"bytes_written"`
+	Saved        int64 `json:"saved"` // bytes freed in storage; negative when joining
+}
+
+// Print the report in a human-readable form
+func (r *ChunkReport) Print() {
+	fmt.Printf("Stored %d blobs in chunks and %d whole, %d bytes written, %d bytes saved\n", r.Chunked, r.Joined, r.BytesWritten, r.Saved)
+}
+
+// Chunk stores every whole blob of at least minSize bytes in chunks, so
+// that blobs written before chunking was enabled dedupe too. With minSize
+// 0 it stores every chunked blob whole again instead.
+func (s *Store) Chunk(ctx context.Context, minSize int64) (*ChunkReport, error) {
+	report := &ChunkReport{}
+	if minSize <= 0 {
+		chunked, err := db.ChunkedBlobs(ctx, s.db)
+		if err != nil {
+			return report, fmt.Errorf("failed to list chunked blobs: %w", err)
+		}
+		for _, id := range sortedKeys(chunked) {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			written, freed, err := s.joinChunks(ctx, id)
+			if err != nil {
+				return report, fmt.Errorf("failed to store %s whole: %w", id, err)
+			}
+			report.Joined++
+			report.BytesWritten += written
+			report.Saved += freed - written
+		}
+		return report, nil
+	}
+
+	// Blobs are listed up front since chunking removes them
+	var ids []string
+	err := s.backend.List(ctx, func(id string) error {
+		if !strings.HasPrefix(id, chunkPrefix) && !strings.HasPrefix(id, deltaPrefix) && !strings.HasPrefix(id, packPrefix) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		size, err := s.backend.Stat(ctx, id)
+		if err != nil {
+			return report, fmt.Errorf("failed to stat %s: %w", id, err)
+		}
+		if size < minSize {
+			continue
+		}
+		written, err := s.chunkBlob(ctx, id)
+		if err != nil {
+			return report, fmt.Errorf("failed to store %s in chunks: %w", id, err)
+		}
+		report.Chunked++
+		report.BytesWritten += written
+		report.Saved += size - written
+	}
+	return report, nil
+}
+
+// Store the whole blob id in chunks, writing those not stored yet, and
+// remove it once they are recorded. It returns the bytes written.
+func (s *Store) chunkBlob(ctx context.Context, id string) (int64, error) {
+	start := time.Now()
+	r, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	// Content that does not match its digest fails at its end, before
+	// anything is recorded
+	var chunks []db.Chunk
+	var written int64
+	pieces := chunker.New(fsutil.ContextReader(ctx, s.opts.Reader(ctx, r)))
+	for {
+		data, err := pieces.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+		hashed := s.hash.New()
+		hashed.Write(data)
+		chunk := db.Chunk{ID: fmt.Sprintf("%s%x", chunkPrefix, hashed.Sum(nil)), Size: int64(len(data))}
+		if _, err := s.backend.Stat(ctx, chunk.ID); errors.Is(err, fs.ErrNotExist) {
+			n, err := s.write(ctx, chunk.ID, bytes.NewReader(data))
+			if err != nil {
+				return written, fmt.Errorf("failed to write chunk: %w", err)
+			}
+			written += n
+		} else if err != nil {
+			return written, fmt.Errorf("failed to check for existing chunk: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		if err := db.SetBlobChunks(ctx, tx, id, chunks); err != nil {
+			return err
+		}
+		return db.RecordAction(ctx, tx, db.Action{ActionType: "chunk", Filename: id, StorageID: id, Bytes: written, Duration: time.Since(start)})
+	})
+	if err != nil {
+		return written, err
+	}
+	if err := s.backend.Remove(ctx, id); err != nil {
+		return written, fmt.Errorf("failed to remove whole blob: %w", err)
+	}
+	return written, nil
+}
+
+// Store a chunked blob whole again and remove the chunks no other blob
+// has, returning the bytes written and the bytes of chunks removed
+func (s *Store) joinChunks(ctx context.Context, id string) (int64, int64, error) {
+	start := time.Now()
+	chunks, err := db.BlobChunks(ctx, s.db, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	written, err := s.write(ctx, id, r)
+	_ = r.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		if err := db.RemoveBlobChunks(ctx, tx, id); err != nil {
+			return err
+		}
+		return db.RecordAction(ctx, tx, db.Action{ActionType: "unchunk", Filename: id, StorageID: id, Bytes: written, Duration: time.Since(start)})
+	})
+	if err != nil {
+		return written, 0, err
+	}
+	var freed int64
+	for _, chunk := range chunks {
+		inUse, err := db.ChunkInUse(ctx, s.db, chunk.ID)
+		if err != nil {
+			return written, freed, err
+		}
+		if inUse {
+			continue
+		}
+		if err := s.backend.Remove(ctx, chunk.ID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return written, freed, fmt.Errorf("failed to remove chunk %s: %w", chunk.ID, err)
+		}
+		freed += chunk.Size
+	}
+	return written, freed, nil
+}
+
+// Open the content of a blob stored in chunks. Failing that, err is
+// returned, the error opening the blob from storage.
+func (s *Store) openChunks(ctx context.Context, id string, err error) (io.ReadCloser, error) {
+	chunks, lookupErr := db.BlobChunks(ctx, s.db, id)
+	if lookupErr != nil {
+		return nil, errors.Join(err, lookupErr)
+	}
+	if len(chunks) == 0 {
+		return nil, err
+	}
+	return &chunkReader{ctx: ctx, s: s, chunks: chunks}, nil
+}
+
+// chunkReader reads the chunks of a blob one after the other
+type chunkReader struct {
+	ctx     context.Context
+	s       *Store
+	chunks  []db.Chunk
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := r.s.backend.Open(r.ctx, r.chunks[0].ID)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open chunk %s: %w", r.chunks[0].ID, err)
+			}
+			r.current = chunk
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			_ = r.current.Close()
+			r.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
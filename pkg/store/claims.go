@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"io/fs"
+	"sync"
+)
+
+// claims counts the stores about to record each blob. A store failing to
+// record a blob it wrote only removes it when no other store of the same
+// process claims it and no version references it, so that concurrent
+// stores of the same content, as the server runs, keep it.
+type claims struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+// Claim a new blob for recording its version, failing when a store that
+// failed removed it meanwhile. The claim lasts until blob.unclaim.
+func (s *Store) claim(ctx context.Context, blob *Blob) error {
+	s.claims.mu.Lock()
+	s.claims.n[blob.StorageID]++
+	s.claims.mu.Unlock()
+	var once sync.Once
+	blob.unclaim = func() {
+		once.Do(func() {
+			s.claims.mu.Lock()
+			defer s.claims.mu.Unlock()
+			if s.claims.n[blob.StorageID]--; s.claims.n[blob.StorageID] == 0 {
+				delete(s.claims.n, blob.StorageID)
+			}
+		})
+	}
+
+	// Content registered in place is not in the backend
+	if blob.external != nil {
+		return nil
+	}
+	if _, err := s.backend.Stat(ctx, blob.StorageID); err != nil {
+		blob.release()
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("blob %s was removed by a store that failed meanwhile; store the file again: %w", blob.StorageID, err)
+		}
+		return fmt.Errorf("failed to check for existing blob: %w", err)
+	}
+	return nil
+}
+
+// Release the claim on the blob, if any
+func (b *Blob) release() {
+	if b.unclaim != nil {
+		b.unclaim()
+	}
+}
+
+// Remove a blob written for a file that is not recorded, releasing the
+// claim on it, unless other stores claim it or versions reference it
+func (s *Store) removeUnused(ctx context.Context, blob *Blob) error {
+	blob.release()
+	ctx = context.WithoutCancel(ctx)
+	s.claims.mu.Lock()
+	defer s.claims.mu.Unlock()
+	if s.claims.n[blob.StorageID] > 0 {
+		return nil
+	}
+	versions, err := db.ListVersionsByHash(ctx, s.db, blob.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to look up versions of %s: %w", blob.StorageID, err)
+	}
+	for _, v := range versions {
+		if StorageID(v) == blob.StorageID {
+			return nil
+		}
+	}
+	return s.backend.Remove(ctx, blob.StorageID)
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"io"
+	"io/fs"
+)
+
+// CloneReport summarizes what Clone copied
+type CloneReport struct {
+	Source   string `json:"source"`
+	Files    int    `json:"files"`
+	Versions int    `json:"versions"`
+	Blobs    int    `json:"blobs"` // blobs copied; the others were stored already
+	Bytes    int64  `json:"bytes"`
+}
+
+// Print the report in a human-readable form
+func (r *CloneReport) Print() {
+	fmt.Printf("Cloned %d versions of %d files from %s: %d blobs copied (%d bytes)\n", r.Versions, r.Files, r.Source, r.Blobs, r.Bytes)
+}
+
+// Clone makes the repository, which must have no versions yet, a copy of
+// the one snap was read from, reading the blobs its versions refer to with
+// open. Each blob is verified against its hash as it arrives, and the
+// versions are only recorded once all of them did, so that cloning again
+// after a failure resumes with the blobs still missing.
+func (s *Store) Clone(ctx context.Context, source string, snap *db.Snapshot, open func(ctx context.Context, id string) (io.ReadCloser, error)) (*CloneReport, error) {
+	report := &CloneReport{Source: source, Versions: len(snap.Versions)}
+	if snap.Hash != s.hash.Name {
+		return report, fmt.Errorf("%s addresses blobs by %s, but the repository uses %s", source, snap.Hash, s.hash.Name)
+	}
+	if exists, err := db.HasVersions(ctx, s.db); err != nil {
+		return report, err
+	} else if exists {
+		return report, errors.New("the repository to clone into has versions already")
+	}
+
+	files := map[string]bool{}
+	for _, v := range snap.Versions {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		files[v.Filename] = true
+		blob, err := s.copyVersionBlob(ctx, open, v.Filename, v)
+		if err != nil {
+			return report, fmt.Errorf("failed to copy %s: %w", v.Filename, err)
+		}
+		if !blob.Duplicate {
+			report.Blobs++
+			report.Bytes += blob.Bytes
+		}
+	}
+	report.Files = len(files)
+	if err := db.RestoreSnapshot(ctx, s.db, snap); err != nil {
+		return report, fmt.Errorf("failed to record versions: %w", err)
+	}
+	return report, nil
+}
+
+// Copy the content of version v, read with open, into storage for the file
+// target unless it is stored already, verifying it against the version's
+// hash
+func (s *Store) copyVersionBlob(ctx context.Context, open func(ctx context.Context, id string) (io.ReadCloser, error), target string, v db.Version) (*Blob, error) {
+	blob := s.newBlob(target, v.Hash)
+	if duplicate, err := s.exists(ctx, blob); err != nil || duplicate {
+		return blob, err
+	}
+	r, err := open(ctx, StorageID(v))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open version %d: %w", v.Version, err)
+	}
+	blob, err = s.WriteBlobReader(ctx, target, r)
+	if closeErr := r.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy version %d: %w", v.Version, err)
+	}
+	if blob.Hash != v.Hash {
+		if !blob.Duplicate {
+			if err := s.removeUnused(ctx, blob); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to remove damaged copy: %w", err)
+			}
+		}
+		return nil, fmt.Errorf("version %d arrived with hash %s instead of %s: %w", v.Version, blob.Hash, v.Hash, ErrChecksumMismatch)
+	}
+	return blob, nil
+}
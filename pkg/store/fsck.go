@@ -0,0 +1,391 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecoveredPrefix namespaces the versions created for adopted blobs, which
+// are recorded as RecoveredPrefix followed by the storage ID
+const RecoveredPrefix = "recovered/"
+
+// Ways Fsck treats orphaned blobs
+const (
+	AdoptNone     = ""         // only report them
+	AdoptRegister = "register" // record a version under RecoveredPrefix
+	AdoptRemove   = "remove"   // delete them from storage
+)
+
+// FsckOptions selects what Fsck changes
+type FsckOptions struct {
+	Adopt     string // AdoptNone, AdoptRegister or AdoptRemove
+	Split     bool   // separate histories of files stored from different paths
+	Normalize bool   // merge histories recorded under names not in NFC into those of the NFC names
+	DryRun    bool   // report what would change without changing it
+}
+
+// FsckReport lists the inconsistencies Fsck found between the action log,
+// the versions and the stored blobs, and what it did about them. Entries
+// are storage IDs unless noted.
+type FsckReport struct {
+	DryRun      bool     `json:"dry_run"`
+	Orphaned    []string `json:"orphaned"`    // stored but referenced by no version
+	Missing     []string `json:"missing"`     // versions whose blob is not stored
+	Unlogged    []string `json:"unlogged"`    // versions whose blob no store action wrote
+	Unversioned []string `json:"unversioned"` // stored by an action, since gone from versions and storage
+	Adopted     []string `json:"adopted"`
+	Removed     []string `json:"removed"`
+	Skipped     []string `json:"skipped"` // orphans whose name or content no stored file could have produced
+
+	// Abandoned lists the temporary files of blobs being written by runs
+	// killed before removing them; Discarded those removed
+	Abandoned []string `json:"abandoned"`
+	Discarded []string `json:"discarded"`
+
+	// Tangled maps files whose versions were stored from several paths to
+	// those paths; Split maps each path moved to its own history to the
+	// name of that history
+	Tangled map[string][]string `json:"tangled"`
+	Split   map[string]string   `json:"split"`
+
+	// Unnormalized maps the names recorded before names were normalized to
+	// NFC to their NFC form; Normalized lists those merged into it
+	Unnormalized map[string]string `json:"unnormalized"`
+	Normalized   []string          `json:"normalized"`
+
+	// Plan repairs every inconsistency found, for review before ApplyPlan
+	Plan *RepairPlan `json:"plan"`
+}
+
+// Clean reports whether the repository is consistent after the run
+func (r *FsckReport) Clean() bool {
+	return !r.DryRun && len(r.Orphaned) == len(r.Adopted)+len(r.Removed) &&
+		len(r.Missing) == 0 && len(r.Unlogged) == 0 &&
+		(len(r.Tangled) == 0 || len(r.Split) > 0) && len(r.Unnormalized) == len(r.Normalized)
+}
+
+// Print the report in a human-readable form
+func (r *FsckReport) Print() {
+	prefix := ""
+	if r.DryRun {
+		prefix = "would have "
+	}
+	for _, id := range r.Orphaned {
+		fmt.Printf("orphaned %s\n", id)
+	}
+	for _, v := range r.Missing {
+		fmt.Printf("missing %s\n", v)
+	}
+	for _, v := range r.Unlogged {
+		fmt.Printf("unlogged %s\n", v)
+	}
+	for _, id := range r.Unversioned {
+		fmt.Printf("unversioned %s\n", id)
+	}
+	for _, id := range r.Adopted {
+		fmt.Printf("%sadopted %s as %s\n", prefix, id, RecoveredPrefix+id)
+	}
+	for _, id := range r.Removed {
+		fmt.Printf("%sremoved %s\n", prefix, id)
+	}
+	for _, id := range r.Skipped {
+		fmt.Printf("skipped %s: not a blob this repository could have stored\n", id)
+	}
+	for _, name := range r.Abandoned {
+		fmt.Printf("abandoned %s: left by a run that did not finish\n", name)
+	}
+	for _, name := range r.Discarded {
+		fmt.Printf("%sdiscarded %s\n", prefix, name)
+	}
+	filenames := make([]string, 0, len(r.Tangled))
+	for filename := range r.Tangled {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		fmt.Printf("tangled %s: stored from %s\n", filename, strings.Join(r.Tangled[filename], ", "))
+		for _, source := range r.Tangled[filename] {
+			if key, ok := r.Split[source]; ok {
+				fmt.Printf("%ssplit %s versions from %s into %s\n", prefix, filename, source, key)
+			}
+		}
+	}
+	names := make([]string, 0, len(r.Unnormalized))
+	for name := range r.Unnormalized {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("unnormalized %+q: recorded before names were normalized to %+q\n", name, r.Unnormalized[name])
+	}
+	for _, name := range r.Normalized {
+		fmt.Printf("%smerged %+q into %+q\n", prefix, name, r.Unnormalized[name])
+	}
+	fmt.Printf("Fsck summary: %d orphaned, %d missing, %d unlogged, %d unversioned, %d adopted, %d removed, %d skipped, %d tangled, %d unnormalized, %d abandoned\n",
+		len(r.Orphaned), len(r.Missing), len(r.Unlogged), len(r.Unversioned), len(r.Adopted), len(r.Removed), len(r.Skipped), len(r.Tangled), len(r.Unnormalized), len(r.Abandoned))
+	if r.Plan != nil && len(r.Plan.Steps) > 0 {
+		r.Plan.Print()
+	}
+}
+
+// Fsck cross-checks the action log, the versions and the stored blobs:
+// every blob must be referenced by a version, every version must have its
+// blob stored and logged, and no version history may mix files stored from
+// different paths. The report carries a plan repairing what it found. As
+// selected by fopts it also adopts or removes the orphans left by manual
+// copies and crashed runs, with the half-written blobs the latter leave,
+// and splits tangled histories.
+func (s *Store) Fsck(ctx context.Context, fopts FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{DryRun: fopts.DryRun, Split: map[string]string{}, Unnormalized: map[string]string{}}
+	switch fopts.Adopt {
+	case AdoptNone, AdoptRegister, AdoptRemove:
+	default:
+		return report, fmt.Errorf("unknown adopt mode %q (use %s, %s)", fopts.Adopt, AdoptRegister, AdoptRemove)
+	}
+	// A hold on every file pauses collecting garbage, as after an anomaly
+	if fopts.Adopt == AdoptRemove && !fopts.DryRun {
+		if err := db.CheckGlobalHold(ctx, s.db); err != nil {
+			return report, s.refused(ctx, "fsck_remove", "", err)
+		}
+	}
+
+	referenced, err := s.referencedBlobs(ctx)
+	if err != nil {
+		return report, err
+	}
+	stored := map[string]bool{}
+	err = s.backend.List(ctx, func(id string) error {
+		stored[id] = true
+		if !referenced[id] {
+			report.Orphaned = append(report.Orphaned, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	// Adopted files left in place count as stored
+	external, err := db.ExternalBlobIDs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list adopted files: %w", err)
+	}
+	for id := range external {
+		stored[id] = true
+	}
+	// So do blobs stored as deltas
+	deltas, err := db.DeltaBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list delta blobs: %w", err)
+	}
+	for id := range deltas {
+		stored[id] = true
+	}
+	chunked, err := db.ChunkedBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list chunked blobs: %w", err)
+	}
+	for id := range chunked {
+		stored[id] = true
+	}
+	packed, err := db.PackedBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list packed blobs: %w", err)
+	}
+	for id := range packed {
+		stored[id] = true
+	}
+	report.Tangled, err = db.TangledVersions(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to check version paths: %w", err)
+	}
+	if err := s.planRepairs(ctx, report, stored); err != nil {
+		return report, err
+	}
+
+	for _, id := range report.Orphaned {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		switch fopts.Adopt {
+		case AdoptRegister:
+			adopted, err := s.adoptBlob(ctx, id, fopts.DryRun)
+			if err != nil {
+				return report, fmt.Errorf("failed to adopt %s: %w", id, err)
+			}
+			if adopted {
+				report.Adopted = append(report.Adopted, id)
+			} else {
+				report.Skipped = append(report.Skipped, id)
+			}
+		case AdoptRemove:
+			if !fopts.DryRun {
+				if err := s.removeOrphan(ctx, id); err != nil {
+					return report, fmt.Errorf("failed to remove %s: %w", id, err)
+				}
+			}
+			report.Removed = append(report.Removed, id)
+		}
+	}
+
+	// Removing orphans also removes blobs left half-written
+	if local, ok := Unwrap(s.backend).(*Local); ok {
+		if report.Abandoned, err = local.abandoned(ctx); err != nil {
+			return report, err
+		}
+		for _, name := range report.Abandoned {
+			if fopts.Adopt != AdoptRemove {
+				break
+			}
+			if !fopts.DryRun {
+				if err := local.removeAbandoned(name); err != nil {
+					return report, fmt.Errorf("failed to remove %s: %w", name, err)
+				}
+			}
+			report.Discarded = append(report.Discarded, name)
+		}
+	}
+
+	if fopts.Normalize {
+		names := make([]string, 0, len(report.Unnormalized))
+		for name := range report.Unnormalized {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !fopts.DryRun {
+				if err := db.RenameFile(ctx, s.db, name, report.Unnormalized[name]); err != nil {
+					return report, fmt.Errorf("failed to normalize %s: %w", name, s.refused(ctx, "fsck_normalize", name, err))
+				}
+				if err := db.LogAction(ctx, s.db, "fsck_normalize", report.Unnormalized[name], ""); err != nil {
+					return report, err
+				}
+			}
+			report.Normalized = append(report.Normalized, name)
+		}
+	}
+
+	if !fopts.Split {
+		return report, nil
+	}
+	for filename, sources := range report.Tangled {
+		if _, merged := report.Unnormalized[filename]; merged && fopts.Normalize && !fopts.DryRun {
+			// Its versions moved; a later run sees whether they are tangled
+			continue
+		}
+		latest, err := db.GetVersion(ctx, s.db, filename, 0)
+		if err != nil {
+			return report, err
+		}
+		keys := splitKeys(sources, latest.Path)
+		if !fopts.DryRun {
+			if err := db.SplitVersions(ctx, s.db, filename, keys); err != nil {
+				return report, fmt.Errorf("failed to split %s: %w", filename, s.refused(ctx, "fsck_split", filename, err))
+			}
+			if err := db.LogAction(ctx, s.db, "fsck_split", filename, ""); err != nil {
+				return report, err
+			}
+		}
+		for source, key := range keys {
+			report.Split[source] = key
+		}
+	}
+	return report, nil
+}
+
+// Name the histories a tangled file is split into: versions stored from
+// keep stay where they are, and those of every other source move to the
+// shortest trailing part of its path that tells the sources apart
+func splitKeys(sources []string, keep string) map[string]string {
+	parts := make([][]string, len(sources))
+	longest := 0
+	for i, source := range sources {
+		parts[i] = strings.Split(strings.Trim(source, "/"), "/")
+		longest = max(longest, len(parts[i]))
+	}
+
+	keys := map[string]string{}
+	for n := 2; n <= longest; n++ {
+		seen := map[string]bool{}
+		unique := true
+		for i := range sources {
+			key := strings.Join(parts[i][max(0, len(parts[i])-n):], "/")
+			unique = unique && !seen[key]
+			seen[key] = true
+			keys[sources[i]] = key
+		}
+		if unique {
+			break
+		}
+	}
+	delete(keys, keep)
+	return keys
+}
+
+// Storage IDs of the blobs referenced by a version, of the deltas of delta
+// blobs, of the chunks of chunked blobs and of the packfiles of packed ones
+func (s *Store) referencedBlobs(ctx context.Context) (map[string]bool, error) {
+	versions, err := db.ListVersions(ctx, s.db, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	referenced := map[string]bool{}
+	for _, v := range versions {
+		referenced[StorageID(v)] = true
+	}
+	deltas, err := db.DeltaBlobs(ctx, s.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list delta blobs: %w", err)
+	}
+	for _, row := range deltas {
+		referenced[row.DeltaID] = true
+	}
+	chunks, err := db.ChunkUses(ctx, s.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	for id := range chunks {
+		referenced[id] = true
+	}
+	packed, err := db.PackedBlobs(ctx, s.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packed blobs: %w", err)
+	}
+	for _, row := range packed {
+		referenced[row.PackID] = true
+	}
+	return referenced, nil
+}
+
+// Record a version for an orphaned blob, reporting whether it could be
+// adopted: its content must match its name, which must be one a stored
+// file could have produced
+func (s *Store) adoptBlob(ctx context.Context, id string, dryRun bool) (bool, error) {
+	start := time.Now()
+	digest, _ := splitID(id)
+	v := db.Version{Filename: RecoveredPrefix + id, Hash: digest}
+	if StorageID(v) != id {
+		return false, nil
+	}
+	intact, size, err := s.hashBlob(ctx, s.backend, id)
+	if err != nil || !intact || dryRun {
+		return intact, err
+	}
+
+	return true, db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		t := s.blobType(ctx, id, v.Filename)
+		if _, err := db.LogVersion(ctx, tx, v.Filename, digest, "", t.MIME, t.Kind); err != nil {
+			return err
+		}
+		return db.RecordAction(ctx, tx, db.Action{
+			ActionType: "adopt",
+			Filename:   v.Filename,
+			StorageID:  id,
+			Bytes:      size,
+			Duration:   time.Since(start),
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"io"
+	"time"
+)
+
+// ImportVersion stores the contents of r as a new version of name dated
+// at, taken from source in a history kept elsewhere. Unlike StoreReader it
+// records a version even when the content is stored already, so that an
+// imported history keeps every change of every file.
+func (s *Store) ImportVersion(ctx context.Context, name, source string, r io.Reader, at time.Time) (*StoreResult, error) {
+	return s.storeVersion(ctx, name, source, r, at)
+}
+
+// StoreVersion stores the contents of r as a new version of name, recording
+// a version even when the content is stored already, the way object stores
+// version every write
+func (s *Store) StoreVersion(ctx context.Context, name string, r io.Reader) (*StoreResult, error) {
+	return s.storeVersion(ctx, name, "", r, time.Time{})
+}
+
+// Store r as a new version of name whatever is stored already, dated at
+// unless it is zero
+func (s *Store) storeVersion(ctx context.Context, name, source string, r io.Reader, at time.Time) (*StoreResult, error) {
+	blob, err := s.WriteBlobReader(ctx, name, r)
+	if err != nil {
+		return nil, err
+	}
+	blob.Source = source
+	if source == "" {
+		source = name
+	}
+	signature, err := s.screen(ctx, blob, source)
+	if err != nil {
+		return nil, err
+	}
+
+	var version int
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		if err := db.RecordAction(ctx, tx, blob.Action()); err != nil {
+			return fmt.Errorf("failed to log action: %w", err)
+		}
+		var err error
+		version, err = db.LogVersion(ctx, tx, blob.Filename, blob.Hash, blob.Source, blob.Type.MIME, blob.Type.Kind)
+		if err != nil {
+			return fmt.Errorf("failed to log version: %w", err)
+		}
+		if err := db.SetVersionOriginalName(ctx, tx, blob.Filename, version, blob.OriginalName); err != nil {
+			return fmt.Errorf("failed to record original name: %w", err)
+		}
+		if at.IsZero() {
+			return nil
+		}
+		if err := db.SetVersionTime(ctx, tx, blob.Filename, version, at); err != nil {
+			return fmt.Errorf("failed to date version: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		if !blob.Duplicate {
+			if removeErr := s.removeUnused(ctx, blob); removeErr != nil {
+				s.opts.Events().OnError(event.Error{Op: "store", Name: blob.Path, Err: fmt.Errorf("failed to remove blob after rollback: %w", removeErr)})
+			}
+		}
+		return nil, err
+	}
+
+	if signature != "" {
+		s.flag(ctx, map[string]string{blob.Filename: signature})
+	}
+	s.opts.Events().OnFileStored(s.fileStored(blob, source))
+	result := blob.Result(version)
+	s.process(ctx, result)
+	return result, nil
+}
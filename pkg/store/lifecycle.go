@@ -0,0 +1,194 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// ErrArchived is wrapped by the errors of backends opening a blob kept in
+// an archive storage class, which must be thawed before it can be read
+var ErrArchived = errors.New("blob is archived")
+
+// DefaultThawDays is how long a thawed blob stays readable unless the
+// store is told otherwise
+const DefaultThawDays = 7
+
+// ClassBackend is implemented by backends keeping blobs in storage classes
+// of different cost and retrieval latency, such as the tiers of cloud
+// object stores
+type ClassBackend interface {
+	// Class returns the storage class of a blob
+	Class(ctx context.Context, id string) (string, error)
+
+	// SetClass moves a blob to a storage class
+	SetClass(ctx context.Context, id, class string) error
+
+	// Thaw starts restoring an archived blob so that it can be read for
+	// the given number of days. It returns at once; until the restore
+	// completes, Open keeps failing with ErrArchived.
+	Thaw(ctx context.Context, id string, days int) error
+}
+
+// LifecycleRule moves blobs to a storage class once the newest version
+// referring to them is older than Age
+type LifecycleRule struct {
+	Class      string
+	Age        time.Duration
+	Match      string // only blobs all of whose versions are of files matching this pattern, as by fsutil.MatchGlob
+	Noncurrent bool   // only blobs no latest mainline version refers to
+}
+
+// LifecycleReport lists the blobs ApplyLifecycle moved between classes
+type LifecycleReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Moved   map[string]string `json:"moved"`   // storage IDs to their new class
+	Kept    int               `json:"kept"`    // blobs in the class their rule selects already
+	Skipped []string          `json:"skipped"` // blobs kept in packs, chunks or deltas, which have no class of their own
+}
+
+// Print the report in a human-readable form
+func (r *LifecycleReport) Print() {
+	verb := "moved"
+	if r.DryRun {
+		verb = "would move"
+	}
+	ids := make([]string, 0, len(r.Moved))
+	for id := range r.Moved {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Printf("%s %s to %s\n", verb, id, r.Moved[id])
+	}
+	fmt.Printf("Lifecycle summary: %d %s, %d already in place, %d skipped\n", len(r.Moved), verb, r.Kept, len(r.Skipped))
+}
+
+// SetThawDays sets how long blobs thawed when they are opened stay
+// readable; 0 means DefaultThawDays
+func (s *Store) SetThawDays(days int) {
+	s.thawDays = days
+}
+
+// ApplyLifecycle moves every blob to the class of the first of rules that
+// selects it, so the coldest class is listed first. Blobs no rule selects
+// keep their class.
+func (s *Store) ApplyLifecycle(ctx context.Context, rules []LifecycleRule, dryRun bool) (*LifecycleReport, error) {
+	classes, ok := Unwrap(s.backend).(ClassBackend)
+	if !ok {
+		return nil, errors.New("the storage backend has no storage classes")
+	}
+	for _, rule := range rules {
+		if _, err := fsutil.MatchGlob(rule.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", rule.Match, err)
+		}
+	}
+	report := &LifecycleReport{DryRun: dryRun, Moved: map[string]string{}}
+
+	versions, err := db.ListVersions(ctx, s.db, "")
+	if err != nil {
+		return report, fmt.Errorf("failed to list versions: %w", err)
+	}
+	latest, err := db.ListLatestVersions(ctx, s.db, db.VersionFilter{})
+	if err != nil {
+		return report, fmt.Errorf("failed to list versions: %w", err)
+	}
+	current := map[string]bool{}
+	for _, v := range latest {
+		current[StorageID(v)] = true
+	}
+	newest := map[string]time.Time{}
+	names := map[string][]string{}
+	for _, v := range versions {
+		id := StorageID(v)
+		if v.Timestamp.After(newest[id]) {
+			newest[id] = v.Timestamp
+		}
+		names[id] = append(names[id], v.Filename)
+	}
+	ids := make([]string, 0, len(newest))
+	for id := range newest {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		class := ""
+		for _, rule := range rules {
+			if now.Sub(newest[id]) >= rule.Age && !(rule.Noncurrent && current[id]) && matchAll(rule.Match, names[id]) {
+				class = rule.Class
+				break
+			}
+		}
+		if class == "" {
+			continue
+		}
+		if _, err := s.backend.Stat(ctx, id); errors.Is(err, fs.ErrNotExist) {
+			report.Skipped = append(report.Skipped, id)
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		was, err := classes.Class(ctx, id)
+		if err != nil {
+			return report, fmt.Errorf("failed to read class of %s: %w", id, err)
+		}
+		if was == class {
+			report.Kept++
+			continue
+		}
+		if !dryRun {
+			if err := classes.SetClass(ctx, id, class); err != nil {
+				return report, fmt.Errorf("failed to move %s to %s: %w", id, class, err)
+			}
+		}
+		report.Moved[id] = class
+	}
+	return report, nil
+}
+
+// Report whether every one of names matches a valid pattern, which an
+// empty one always does
+func matchAll(pattern string, names []string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, name := range names {
+		if ok, _ := fsutil.MatchGlob(pattern, name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Thaw starts restoring the archived blob id so that it can be read, as
+// ClassBackend.Thaw does
+func (s *Store) Thaw(ctx context.Context, id string) error {
+	classes, ok := Unwrap(s.backend).(ClassBackend)
+	if !ok {
+		return errors.New("the storage backend has no storage classes")
+	}
+	days := s.thawDays
+	if days <= 0 {
+		days = DefaultThawDays
+	}
+	return classes.Thaw(ctx, id, days)
+}
+
+// Request a thaw of a blob that could not be opened as it is archived,
+// returning the error to report
+func (s *Store) thawArchived(ctx context.Context, id string, err error) error {
+	if thawErr := s.Thaw(ctx, id); thawErr != nil {
+		return fmt.Errorf("%w; failed to request a thaw: %v", err, thawErr)
+	}
+	return fmt.Errorf("%w; a thaw was requested, try again once it completes, which may take hours", err)
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultDir is the storage directory of the local backend, relative to the
+// repository root
+const DefaultDir = "storage"
+
+// incomingPrefix marks blobs that are still being written
+const incomingPrefix = ".incoming-"
+
+// abandonedAge is how long a blob being written must have gone unchanged
+// to be taken as left by a run killed before it could remove it
+const abandonedAge = 24 * time.Hour
+
+// Local keeps blobs as files in a directory
+type Local struct {
+	dir  string
+	opts fsutil.Options
+}
+
+// NewLocal creates a backend storing blobs in dir, which is created on the
+// first write
+func NewLocal(dir string, opts fsutil.Options) *Local {
+	return &Local{dir: dir, opts: opts}
+}
+
+// Open the local backend; the "dir" setting overrides DefaultDir
+func openLocal(settings map[string]string, root string, opts fsutil.Options) (Backend, error) {
+	dir := settings["dir"]
+	if dir == "" {
+		dir = DefaultDir
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	return NewLocal(dir, opts), nil
+}
+
+// Dir returns the storage directory
+func (l *Local) Dir() string {
+	return l.dir
+}
+
+// Path returns the file holding a blob
+func (l *Local) Path(id string) string {
+	return filepath.Join(l.dir, id)
+}
+
+// Path of a blob as passed to the os package, in the long form on Windows
+func (l *Local) file(id string) string {
+	return fsutil.LongPath(l.Path(id))
+}
+
+func (l *Local) Stat(ctx context.Context, id string) (int64, error) {
+	info, err := os.Stat(l.file(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *Local) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	return os.Open(l.file(id))
+}
+
+// Write copies r into a temporary file that is renamed into place once
+// complete
+func (l *Local) Write(ctx context.Context, id string, r io.Reader) (int64, error) {
+	tmpFile, err := l.createTemp()
+	if err != nil {
+		return 0, err
+	}
+	n, err := l.opts.Copy(ctx, tmpFile, r)
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return 0, fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := l.commit(tmpFile, id); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Create a temporary file in the storage directory for a blob being written
+func (l *Local) createTemp() (*os.File, error) {
+	if err := os.MkdirAll(fsutil.LongPath(l.dir), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	tmpFile, err := os.CreateTemp(fsutil.LongPath(l.dir), incomingPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	return tmpFile, nil
+}
+
+// Persist a completely written temporary file as the blob id. The file is
+// closed, and removed again on failure.
+func (l *Local) commit(tmpFile *os.File, id string) error {
+	tmpPath := tmpFile.Name()
+	discard := func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpPath)
+	}
+	if err := tmpFile.Chmod(0o644); err != nil {
+		discard()
+		return fmt.Errorf("failed to set blob permissions: %w", err)
+	}
+	if err := l.opts.SyncFile(tmpFile); err != nil {
+		discard()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Rename(tmpPath, l.file(id)); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to move blob into place: %w", err)
+	}
+	return l.opts.SyncDir(l.dir)
+}
+
+func (l *Local) Remove(ctx context.Context, id string) error {
+	return os.Remove(l.file(id))
+}
+
+// Rename moves a blob to a new ID without copying it
+func (l *Local) Rename(ctx context.Context, oldID, newID string) error {
+	if err := os.Rename(l.file(oldID), l.file(newID)); err != nil {
+		return err
+	}
+	return l.opts.SyncDir(l.dir)
+}
+
+func (l *Local) List(ctx context.Context, fn func(id string) error) error {
+	entries, err := os.ReadDir(fsutil.LongPath(l.dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read storage directory: %w", err)
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), incomingPrefix) {
+			continue
+		}
+		if err := fn(entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the names of the blobs being written that were abandoned, which
+// List skips
+func (l *Local) abandoned(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(fsutil.LongPath(l.dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), incomingPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > abandonedAge {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Remove an abandoned blob being written
+func (l *Local) removeAbandoned(name string) error {
+	err := os.Remove(l.file(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) Location(id string) string {
+	return l.Path(id)
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/content"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"io"
+)
+
+// MediaMetadataProcessor is the name of the processor recording when and
+// with which camera photos and videos were taken, and their size
+const MediaMetadataProcessor = "media-metadata"
+
+func init() {
+	RegisterProcessor(MediaMetadataProcessor, ProcessorFunc(recordMedia))
+}
+
+// Record the media metadata of a newly stored photo or video as metadata
+// of the file
+func recordMedia(ctx context.Context, s *Store, result *StoreResult) error {
+	if result.Duplicate {
+		return nil
+	}
+	r, err := s.backend.Open(ctx, result.StorageID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	head := make([]byte, content.SniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	t := content.Detect(result.Filename, head[:n])
+	if t.Kind != content.Image && t.Kind != content.Video {
+		return nil
+	}
+	// Seek back where the backend can, letting videos skip their media data
+	var media io.Reader = io.MultiReader(bytes.NewReader(head[:n]), r)
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+			media = seeker
+		}
+	}
+	m, err := content.ReadMedia(media, t)
+	if err != nil {
+		return fmt.Errorf("failed to read media metadata: %w", err)
+	}
+	if meta := m.Metadata(); len(meta) > 0 {
+		return db.SetMeta(ctx, s.db, result.Filename, meta)
+	}
+	return nil
+}
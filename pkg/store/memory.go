@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// Memory keeps blobs in memory. It suits tests and throwaway repositories.
+type Memory struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewMemory creates an empty in-memory backend
+func NewMemory() *Memory {
+	return &Memory{blobs: map[string][]byte{}}
+}
+
+// Open the memory backend; it has no settings
+func openMemory(settings map[string]string, root string, opts fsutil.Options) (Backend, error) {
+	return NewMemory(), nil
+}
+
+func (m *Memory) Stat(ctx context.Context, id string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.blobs[id]
+	if !ok {
+		return 0, &fs.PathError{Op: "stat", Path: id, Err: fs.ErrNotExist}
+	}
+	return int64(len(data)), nil
+}
+
+func (m *Memory) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.blobs[id]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: id, Err: fs.ErrNotExist}
+	}
+	// Stored slices are never modified, so readers can share them
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *Memory) Write(ctx context.Context, id string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(fsutil.ContextReader(ctx, r))
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy file: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[id] = data
+	return int64(len(data)), nil
+}
+
+func (m *Memory) Remove(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.blobs[id]; !ok {
+		return &fs.PathError{Op: "remove", Path: id, Err: fs.ErrNotExist}
+	}
+	delete(m.blobs, id)
+	return nil
+}
+
+// Rename moves a blob to a new ID without copying it
+func (m *Memory) Rename(ctx context.Context, oldID, newID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[oldID]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldID, Err: fs.ErrNotExist}
+	}
+	delete(m.blobs, oldID)
+	m.blobs[newID] = data
+	return nil
+}
+
+// List calls fn for a sorted snapshot of the IDs, so fn may change the
+// backend
+func (m *Memory) List(ctx context.Context, fn func(id string) error) error {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.blobs))
+	for id := range m.blobs {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Location(id string) string {
+	return "memory:" + id
+}
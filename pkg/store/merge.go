@@ -0,0 +1,422 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Policies of MergeRepository for a file whose history in the other
+// repository diverged from the local one
+const (
+	MergeAppend = "append" // append the versions the local history lacks after it
+	MergeRename = "rename" // import the other history as a file of its own
+	MergeSkip   = "skip"   // keep the local history only
+)
+
+// MergeOptions selects how MergeRepository resolves conflicts
+type MergeOptions struct {
+	Conflicts string // MergeAppend (the default), MergeRename or MergeSkip
+	Name      string // names the other repository in renamed files and branches
+	DryRun    bool   // report what would be imported without importing it
+}
+
+// MergeReport summarizes what MergeRepository imported
+type MergeReport struct {
+	Source   string            `json:"source"`
+	DryRun   bool              `json:"dry_run"`
+	Files    int               `json:"files"`    // files versions were imported into
+	Versions int               `json:"versions"` // versions imported
+	Present  int               `json:"present"`  // versions the repository had already
+	Blobs    int               `json:"blobs"`    // blobs copied; the others were stored already
+	Bytes    int64             `json:"bytes"`
+	Meta     int               `json:"meta"`     // metadata values imported
+	Aliases  int               `json:"aliases"`  // aliases imported
+	Branches int               `json:"branches"` // branches imported
+	Renamed  map[string]string `json:"renamed"`  // files imported under another name, to that name
+	Skipped  []string          `json:"skipped"`  // files whose diverged history was left out
+	Taken    []string          `json:"taken"`    // aliases left out as the name stands for another file
+}
+
+// Print the report in a human-readable form
+func (r *MergeReport) Print() {
+	verb := "Merged"
+	if r.DryRun {
+		verb = "Would merge"
+	}
+	names := make([]string, 0, len(r.Renamed))
+	for name := range r.Renamed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("renamed %s to %s: its history diverged from the local one\n", name, r.Renamed[name])
+	}
+	for _, name := range r.Skipped {
+		fmt.Printf("skipped %s: its history diverged from the local one\n", name)
+	}
+	for _, alias := range r.Taken {
+		fmt.Printf("skipped alias %s: the name is taken\n", alias)
+	}
+	fmt.Printf("%s %d versions of %d files from %s: %d blobs copied (%d bytes), %d versions present already, %d metadata values, %d aliases, %d branches\n",
+		verb, r.Versions, r.Files, r.Source, r.Blobs, r.Bytes, r.Present, r.Meta, r.Aliases, r.Branches)
+}
+
+// MergeRepository imports the file histories of other into the repository
+// with their metadata, aliases and branches, copying the blobs it lacks and
+// verifying their content on arrival. Both must address blobs by the same
+// hash algorithm.
+//
+// A version of other is present already when the local history of its file
+// has a version of the same content stored at the same time, as after an
+// earlier merge or when both were cloned from one repository. The others
+// are appended to the local history in the order other stored them,
+// renumbered after its versions and keeping their dates. When the local
+// history has versions other lacks as well, the histories diverged and
+// mopts.Conflicts decides: MergeAppend appends them all the same,
+// MergeRename imports the history of other under the name of the file with
+// mopts.Name added before its extension, and MergeSkip leaves it out.
+//
+// Metadata keys and aliases the repository has already keep their local
+// values. Branches of other whose names are taken by different local
+// branches are imported with mopts.Name appended. The action log of other
+// is not imported.
+func (s *Store) MergeRepository(ctx context.Context, other *Store, mopts MergeOptions) (*MergeReport, error) {
+	report := &MergeReport{Source: mopts.Name, DryRun: mopts.DryRun, Renamed: map[string]string{}}
+	switch mopts.Conflicts {
+	case "":
+		mopts.Conflicts = MergeAppend
+	case MergeAppend, MergeRename, MergeSkip:
+	default:
+		return report, fmt.Errorf("unknown conflict policy %q (use %s, %s, %s)", mopts.Conflicts, MergeAppend, MergeRename, MergeSkip)
+	}
+	if other.hash.Name != s.hash.Name {
+		return report, fmt.Errorf("%s addresses blobs by %s, but the repository uses %s; rehash one of them first", mopts.Name, other.hash.Name, s.hash.Name)
+	}
+
+	versions, err := db.ListVersions(ctx, other.db, "")
+	if err != nil {
+		return report, fmt.Errorf("failed to list versions of %s: %w", mopts.Name, err)
+	}
+	var names []string
+	histories := map[string][]db.Version{}
+	for _, v := range versions {
+		if _, ok := histories[v.Filename]; !ok {
+			names = append(names, v.Filename)
+		}
+		histories[v.Filename] = append(histories[v.Filename], v)
+	}
+
+	// Files of other mapped to the names their versions went under
+	targets := map[string]string{}
+	copied := map[string]bool{}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		target, err := s.mergeFile(ctx, other, name, histories[name], mopts, report, copied)
+		if err != nil {
+			return report, fmt.Errorf("failed to merge %s: %w", name, err)
+		}
+		if target != "" {
+			targets[name] = target
+		}
+	}
+	if err := s.mergeMeta(ctx, other, targets, report); err != nil {
+		return report, err
+	}
+	if err := s.mergeAliases(ctx, other, targets, report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// Import the versions of a file of other the local history lacks,
+// returning the name they went under, or "" when they were skipped
+func (s *Store) mergeFile(ctx context.Context, other *Store, name string, versions []db.Version, mopts MergeOptions, report *MergeReport, copied map[string]bool) (string, error) {
+	target := name
+	local, err := db.ListVersions(ctx, s.db, target)
+	if err != nil {
+		return "", err
+	}
+	numbers, missing := matchVersions(local, versions)
+	if len(missing) > 0 && len(numbers) < len(local) {
+		switch mopts.Conflicts {
+		case MergeSkip:
+			report.Skipped = append(report.Skipped, name)
+			return "", nil
+		case MergeRename:
+			target = mergedName(name, mopts.Name)
+			report.Renamed[name] = target
+			if local, err = db.ListVersions(ctx, s.db, target); err != nil {
+				return "", err
+			}
+			numbers, missing = matchVersions(local, versions)
+		}
+	}
+	report.Present += len(versions) - len(missing)
+	if len(missing) == 0 {
+		return target, nil
+	}
+
+	branches, err := db.ListBranches(ctx, other.db, name)
+	if err != nil {
+		return "", err
+	}
+	// Local names of the branches of other, and those to create
+	renamed := map[string]string{}
+	var added []db.Branch
+	for _, b := range branches {
+		renamed[b.Name] = b.Name
+		existing, err := db.GetBranch(ctx, s.db, target, b.Name)
+		if err == nil {
+			if base, ok := numbers[b.Base]; ok && base == existing.Base {
+				continue
+			}
+			renamed[b.Name] = b.Name + "-" + mopts.Name
+		} else if !errors.Is(err, db.ErrNoBranch) {
+			return "", err
+		}
+		b.Name = renamed[b.Name]
+		added = append(added, b)
+	}
+
+	blobs := make([]*Blob, 0, len(missing))
+	// Blobs copied for versions that cannot be recorded are removed again
+	discard := func() {
+		for _, blob := range blobs {
+			if blob.Duplicate || mopts.DryRun {
+				continue
+			}
+			if err := s.removeUnused(ctx, blob); err != nil {
+				s.opts.Events().OnError(event.Error{Op: "merge", Name: blob.StorageID, Err: fmt.Errorf("failed to remove blob after rollback: %w", err)})
+			}
+		}
+	}
+	for _, v := range missing {
+		blob, err := s.mergeBlob(ctx, other, target, v, mopts.DryRun, copied)
+		if err != nil {
+			discard()
+			return "", err
+		}
+		blobs = append(blobs, blob)
+		if !blob.Duplicate {
+			report.Blobs++
+			report.Bytes += blob.Bytes
+		}
+	}
+	report.Files++
+	report.Versions += len(missing)
+	report.Branches += len(added)
+	if mopts.DryRun {
+		return target, nil
+	}
+
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		for i, v := range missing {
+			if err := db.RecordAction(ctx, tx, blobs[i].Action()); err != nil {
+				return fmt.Errorf("failed to log action: %w", err)
+			}
+			n, err := db.LogVersion(ctx, tx, target, v.Hash, v.Path, v.MimeType, v.Kind)
+			if err != nil {
+				return fmt.Errorf("failed to log version: %w", err)
+			}
+			numbers[v.Version] = n
+			if err := db.SetVersionTime(ctx, tx, target, n, v.Timestamp); err != nil {
+				return fmt.Errorf("failed to date version: %w", err)
+			}
+			if target == name {
+				if err := db.SetVersionOriginalName(ctx, tx, target, n, v.OriginalName); err != nil {
+					return fmt.Errorf("failed to record original name: %w", err)
+				}
+			}
+			if v.Branch != "" {
+				if err := db.SetVersionBranch(ctx, tx, target, n, renamed[v.Branch]); err != nil {
+					return fmt.Errorf("failed to record branch: %w", err)
+				}
+			}
+		}
+		for _, b := range added {
+			b.Filename, b.Base, b.Merged = target, numbers[b.Base], numbers[b.Merged]
+			if err := db.AddBranch(ctx, tx, b); err != nil {
+				return fmt.Errorf("failed to record branch %s: %w", b.Name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		discard()
+		return "", err
+	}
+	return target, nil
+}
+
+// Match versions of other to those of the local history with the same
+// content and time, returning the local numbers of those matched and the
+// versions not matched
+func matchVersions(local, versions []db.Version) (map[int]int, []db.Version) {
+	key := func(v db.Version) string {
+		return fmt.Sprintf("%s@%d", v.Hash, v.Timestamp.Unix())
+	}
+	have := map[string]int{}
+	for _, v := range local {
+		have[key(v)] = v.Version
+	}
+	numbers := map[int]int{}
+	var missing []db.Version
+	for _, v := range versions {
+		if n, ok := have[key(v)]; ok {
+			numbers[v.Version] = n
+			delete(have, key(v))
+		} else {
+			missing = append(missing, v)
+		}
+	}
+	return numbers, missing
+}
+
+// Return the name a diverged history of other is imported under, with the
+// name of other added before the extension: report.pdf becomes
+// report.laptop.pdf
+func mergedName(filename, name string) string {
+	ext := path.Ext(filename)
+	stem := strings.TrimSuffix(filename, ext)
+	if stem == "" || strings.HasSuffix(stem, "/") {
+		return filename + "." + name
+	}
+	return stem + "." + name + ext
+}
+
+// Copy the content of a version of other into storage for the file
+// target as copyVersionBlob does. A dry run only looks up whether it is stored.
+func (s *Store) mergeBlob(ctx context.Context, other *Store, target string, v db.Version, dryRun bool, copied map[string]bool) (*Blob, error) {
+	if !dryRun {
+		return s.copyVersionBlob(ctx, other.OpenBlob, target, v)
+	}
+	blob := s.newBlob(target, v.Hash)
+	if duplicate, err := s.exists(ctx, blob); err != nil || duplicate {
+		return blob, err
+	}
+	blob.Duplicate = copied[blob.StorageID]
+	copied[blob.StorageID] = true
+	if size, err := other.backend.Stat(ctx, StorageID(v)); err == nil {
+		blob.Bytes = size
+	}
+	return blob, nil
+}
+
+// Import the metadata of the merged files the local files lack
+func (s *Store) mergeMeta(ctx context.Context, other *Store, targets map[string]string, report *MergeReport) error {
+	for _, name := range sortedNames(targets) {
+		theirs, err := db.GetMeta(ctx, other.db, name)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata of %s: %w", name, err)
+		}
+		ours, err := db.GetMeta(ctx, s.db, targets[name])
+		if err != nil {
+			return fmt.Errorf("failed to read metadata of %s: %w", targets[name], err)
+		}
+		meta := map[string]string{}
+		for key, value := range theirs {
+			if _, ok := ours[key]; !ok {
+				meta[key] = value
+			}
+		}
+		if len(meta) == 0 {
+			continue
+		}
+		report.Meta += len(meta)
+		if report.DryRun {
+			continue
+		}
+		if err := db.SetMetaAll(ctx, s.db, []string{targets[name]}, meta); err != nil {
+			return fmt.Errorf("failed to set metadata of %s: %w", targets[name], err)
+		}
+	}
+	return nil
+}
+
+// Import the aliases of the merged files whose names are free
+func (s *Store) mergeAliases(ctx context.Context, other *Store, targets map[string]string, report *MergeReport) error {
+	aliases, err := db.ListAliases(ctx, other.db)
+	if err != nil {
+		return fmt.Errorf("failed to list aliases of %s: %w", report.Source, err)
+	}
+	for _, a := range aliases {
+		target, ok := targets[a.Filename]
+		if !ok {
+			continue
+		}
+		resolved, err := db.ResolveName(ctx, s.db, a.Name)
+		if err != nil {
+			return err
+		}
+		if resolved == target {
+			continue
+		}
+		if resolved != a.Name {
+			report.Taken = append(report.Taken, a.Name)
+			continue
+		}
+		if _, err := db.GetVersion(ctx, s.db, a.Name, 0); err == nil {
+			report.Taken = append(report.Taken, a.Name)
+			continue
+		} else if !errors.Is(err, db.ErrNoVersion) {
+			return err
+		}
+		report.Aliases++
+		if report.DryRun {
+			continue
+		}
+		if err := db.SetAlias(ctx, s.db, a.Name, target); err != nil {
+			return fmt.Errorf("failed to set alias %s: %w", a.Name, err)
+		}
+	}
+	return nil
+}
+
+// Return the keys of names, sorted
+func sortedNames(names map[string]string) []string {
+	keys := make([]string, 0, len(names))
+	for key := range names {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CopyBlobs copies the blobs of from that the repository lacks into its
+// storage, returning how many were copied. Blobs are content-addressed, so
+// copying them cannot clash with those stored already.
+func (s *Store) CopyBlobs(ctx context.Context, from Backend) (int, error) {
+	if own, ok := Unwrap(s.backend).(*Local); ok {
+		if other, ok := Unwrap(from).(*Local); ok && other.Dir() == own.Dir() {
+			return 0, nil
+		}
+	}
+	copied := 0
+	err := from.List(ctx, func(id string) error {
+		if _, err := s.backend.Stat(ctx, id); err == nil {
+			return nil
+		}
+		blob, err := from.Open(ctx, id)
+		if err != nil {
+			return err
+		}
+		_, err = s.write(ctx, id, blob)
+		if closeErr := blob.Close(); closeErr != nil {
+			s.opts.Events().OnError(event.Error{Op: "copy", Name: id, Err: fmt.Errorf("failed to close blob: %w", closeErr)})
+		}
+		if err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	return copied, err
+}
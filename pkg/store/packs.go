@@ -0,0 +1,391 @@
+package store
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// packPrefix starts the IDs of packfiles, followed by their digest
+const packPrefix = "pack-"
+
+// packMagic starts every packfile, followed by the compressed blobs
+const packMagic = "FMPACK1\n"
+
+// DefaultPackMaxSize is the size below which blobs are packed
+const DefaultPackMaxSize = 1 << 20
+
+// packTargetSize is the size at which a packfile is closed. Packfiles
+// below half of it are rewritten together with the loose blobs.
+const packTargetSize = 64 << 20
+
+// PackReport summarizes packing blobs into packfiles or storing them loose
+type PackReport struct {
+	Packed   int   `json:"packed"`
+	Unpacked int   `json:"unpacked"` // blobs stored loose again
+	Packs    int   `json:"packs"`    // packfiles written
+	Skipped  int   `json:"skipped"`  // blobs whose content does not match their ID
+	Saved    int64 `json:"saved"`    // bytes freed in storage; negative when unpacking
+}
+
+// Print the report in a human-readable form
+func (r *PackReport) Print() {
+	fmt.Printf("Packed %d blobs into %d packfiles and %d loose (%d skipped), %d bytes saved\n", r.Packed, r.Packs, r.Unpacked, r.Skipped, r.Saved)
+}
+
+// Pack compresses every loose blob smaller than maxSize into packfiles,
+// which keep thousands of small blobs in a single blob each, and rewrites
+// packfiles left small by earlier runs. With maxSize 0 it stores every
+// packed blob loose again instead. Reading blobs is transparent either
+// way, and an interrupted run can simply be run again.
+func (s *Store) Pack(ctx context.Context, maxSize int64) (*PackReport, error) {
+	report := &PackReport{}
+	packed, err := db.PackedBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list packed blobs: %w", err)
+	}
+	for _, id := range sortedKeys(packed) {
+		if _, err := s.backend.Stat(ctx, id); err == nil {
+			// The content was stored loose again since
+			if err := db.RemovePackedBlob(ctx, s.db, id); err != nil {
+				return report, err
+			}
+			delete(packed, id)
+		}
+	}
+
+	if maxSize <= 0 {
+		for _, id := range sortedKeys(packed) {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			n, err := s.unpackBlob(ctx, id)
+			if err != nil {
+				return report, fmt.Errorf("failed to store %s loose: %w", id, err)
+			}
+			report.Unpacked++
+			report.Saved -= n
+		}
+		freed, err := s.removeUnusedPacks(ctx)
+		report.Saved += freed
+		return report, err
+	}
+
+	// Delta blobs and chunks are opened by their ID, so they stay loose.
+	// Blobs are listed up front since packing removes them.
+	var loose []string
+	err = s.backend.List(ctx, func(id string) error {
+		if !strings.HasPrefix(id, packPrefix) && !strings.HasPrefix(id, chunkPrefix) && !strings.HasPrefix(id, deltaPrefix) {
+			loose = append(loose, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	var candidates []string
+	for _, id := range loose {
+		size, err := s.backend.Stat(ctx, id)
+		if err != nil {
+			return report, fmt.Errorf("failed to stat %s: %w", id, err)
+		}
+		if size < maxSize {
+			candidates = append(candidates, id)
+		}
+	}
+
+	packSizes := map[string]int64{}
+	for _, row := range packed {
+		packSizes[row.PackID] += row.PackedSize
+	}
+	var small []string
+	for id, size := range packSizes {
+		if size < packTargetSize/2 {
+			small = append(small, id)
+		}
+	}
+	if len(candidates) > 0 || len(small) > 1 {
+		for _, id := range sortedKeys(packed) {
+			if size := packSizes[packed[id].PackID]; size < packTargetSize/2 {
+				candidates = append(candidates, id)
+			}
+		}
+	}
+
+	w := &packWriter{s: s, report: report}
+	defer w.cleanup()
+	for _, id := range candidates {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := w.add(ctx, id); err != nil {
+			return report, fmt.Errorf("failed to pack %s: %w", id, err)
+		}
+		if w.size() >= packTargetSize {
+			if err := w.flush(ctx); err != nil {
+				return report, fmt.Errorf("failed to write packfile: %w", err)
+			}
+		}
+	}
+	if err := w.flush(ctx); err != nil {
+		return report, fmt.Errorf("failed to write packfile: %w", err)
+	}
+	freed, err := s.removeUnusedPacks(ctx)
+	report.Saved += freed
+	return report, err
+}
+
+// packWriter collects compressed blobs in a temporary file until it is
+// written as a packfile
+type packWriter struct {
+	s       *Store
+	report  *PackReport
+	tmpFile *os.File
+	start   time.Time
+	entries []db.PackedBlob
+	freed   int64 // bytes of the blobs once they are packed
+}
+
+// Return the bytes collected so far
+func (w *packWriter) size() int64 {
+	if len(w.entries) == 0 {
+		return 0
+	}
+	last := w.entries[len(w.entries)-1]
+	return last.Offset + last.PackedSize
+}
+
+// Compress the content of the blob id into the packfile. Content that does
+// not match its digest is left where it is.
+func (w *packWriter) add(ctx context.Context, id string) error {
+	if w.tmpFile == nil {
+		tmpFile, err := os.CreateTemp("", "fm-pack-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		w.tmpFile, w.start = tmpFile, time.Now()
+		if _, err := io.WriteString(tmpFile, packMagic); err != nil {
+			return err
+		}
+	}
+	offset := int64(len(packMagic))
+	if len(w.entries) > 0 {
+		offset = w.size()
+	}
+
+	// A blob packed already frees nothing by itself; its old packfile is
+	// removed once nothing is left in it
+	stored, err := w.s.backend.Stat(ctx, id)
+	if errors.Is(err, fs.ErrNotExist) {
+		stored = 0
+	} else if err != nil {
+		return err
+	}
+	r, err := w.s.OpenBlob(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	packed := &fsutil.CountingWriter{W: w.tmpFile}
+	compressor, err := flate.NewWriter(packed, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	n, err := fsutil.Copy(ctx, compressor, w.s.opts.Reader(ctx, r))
+	if err == nil {
+		err = compressor.Close()
+	}
+	if errors.Is(err, ErrChecksumMismatch) {
+		w.s.opts.Events().OnError(event.Error{Op: "pack", Name: id, Err: err})
+		w.report.Skipped++
+		return w.rewind(offset)
+	}
+	if err != nil {
+		return err
+	}
+	w.entries = append(w.entries, db.PackedBlob{StorageID: id, Offset: offset, PackedSize: packed.N, Size: n})
+	w.freed += stored
+	return nil
+}
+
+// Drop what was written past offset
+func (w *packWriter) rewind(offset int64) error {
+	if err := w.tmpFile.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := w.tmpFile.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Write the collected blobs as a packfile, checked before the blobs are
+// recorded as packed in it and removed, and start a new one
+func (w *packWriter) flush(ctx context.Context) error {
+	if len(w.entries) == 0 {
+		return nil
+	}
+	s := w.s
+	if _, err := w.tmpFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hashed := s.hash.New()
+	if _, err := fsutil.Copy(ctx, hashed, w.tmpFile); err != nil {
+		return err
+	}
+	packID := fmt.Sprintf("%s%x", packPrefix, hashed.Sum(nil))
+	if _, err := w.tmpFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	written, err := s.write(ctx, packID, w.tmpFile)
+	if err != nil {
+		return err
+	}
+	if intact, _, err := s.hashBlob(ctx, s.backend, packID); err != nil || !intact {
+		_ = s.backend.Remove(context.WithoutCancel(ctx), packID)
+		if err == nil {
+			err = fmt.Errorf("packfile %s: %w", packID, ErrChecksumMismatch)
+		}
+		return err
+	}
+
+	for i := range w.entries {
+		w.entries[i].PackID = packID
+	}
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		for _, row := range w.entries {
+			if err := db.AddPackedBlob(ctx, tx, row); err != nil {
+				return err
+			}
+		}
+		return db.RecordAction(ctx, tx, db.Action{ActionType: "pack", Filename: packID, StorageID: packID, Bytes: written, Duration: time.Since(w.start)})
+	})
+	if err != nil {
+		_ = s.backend.Remove(context.WithoutCancel(ctx), packID)
+		return err
+	}
+	for _, row := range w.entries {
+		if err := s.backend.Remove(context.WithoutCancel(ctx), row.StorageID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", row.StorageID, err)
+		}
+	}
+	w.report.Packed += len(w.entries)
+	w.report.Packs++
+	w.report.Saved += w.freed - written
+	w.cleanup()
+	return nil
+}
+
+// Remove the temporary file and forget the blobs collected in it
+func (w *packWriter) cleanup() {
+	if w.tmpFile != nil {
+		_ = w.tmpFile.Close()
+		_ = os.Remove(w.tmpFile.Name())
+	}
+	w.tmpFile, w.entries, w.freed = nil, nil, 0
+}
+
+// Store a packed blob loose again and forget it is packed, returning the
+// bytes written
+func (s *Store) unpackBlob(ctx context.Context, id string) (int64, error) {
+	start := time.Now()
+	r, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.write(ctx, id, r)
+	_ = r.Close()
+	if err != nil {
+		return 0, err
+	}
+	return n, db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		if err := db.RemovePackedBlob(ctx, tx, id); err != nil {
+			return err
+		}
+		return db.RecordAction(ctx, tx, db.Action{ActionType: "unpack", Filename: id, StorageID: id, Bytes: n, Duration: time.Since(start)})
+	})
+}
+
+// Remove the packfiles no packed blob is in any more, returning the bytes
+// freed
+func (s *Store) removeUnusedPacks(ctx context.Context) (int64, error) {
+	packed, err := db.PackedBlobs(ctx, s.db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list packed blobs: %w", err)
+	}
+	used := map[string]bool{}
+	for _, row := range packed {
+		used[row.PackID] = true
+	}
+	var unused []string
+	err = s.backend.List(ctx, func(id string) error {
+		if strings.HasPrefix(id, packPrefix) && !used[id] {
+			unused = append(unused, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list packfiles: %w", err)
+	}
+	var freed int64
+	for _, id := range unused {
+		size, err := s.backend.Stat(ctx, id)
+		if err != nil {
+			return freed, err
+		}
+		if err := s.backend.Remove(ctx, id); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return freed, fmt.Errorf("failed to remove packfile %s: %w", id, err)
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// Open the content of a packed blob. Failing that, err is returned, the
+// error opening the blob from storage.
+func (s *Store) openPacked(ctx context.Context, id string, err error) (io.ReadCloser, error) {
+	row, ok, lookupErr := db.GetPackedBlob(ctx, s.db, id)
+	if lookupErr != nil {
+		return nil, errors.Join(err, lookupErr)
+	}
+	if !ok {
+		return nil, err
+	}
+
+	pack, err := s.backend.Open(ctx, row.PackID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packfile %s of %s: %w", row.PackID, id, err)
+	}
+	var section io.Reader
+	if file, ok := pack.(*os.File); ok {
+		section = io.NewSectionReader(file, row.Offset, row.PackedSize)
+	} else {
+		if _, err := io.CopyN(io.Discard, pack, row.Offset); err != nil {
+			_ = pack.Close()
+			return nil, fmt.Errorf("failed to read packfile %s of %s: %w", row.PackID, id, err)
+		}
+		section = io.LimitReader(pack, row.PackedSize)
+	}
+	return &packReader{ReadCloser: flate.NewReader(section), pack: pack}, nil
+}
+
+// packReader decompresses a blob from its packfile
+type packReader struct {
+	io.ReadCloser
+	pack io.Closer
+}
+
+func (r *packReader) Close() error {
+	_ = r.ReadCloser.Close()
+	return r.pack.Close()
+}
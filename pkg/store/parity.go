@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/parity"
+	"io"
+	"io/fs"
+)
+
+// ParityProcessor writes parity data for every stored blob into the
+// backend dest, under the blob's storage ID, adding overhead percent of the
+// blob size. Verify uses it to repair damaged blobs in place.
+func ParityProcessor(dest Backend, overhead int) Processor {
+	return ProcessorFunc(func(ctx context.Context, s *Store, result *StoreResult) error {
+		if _, err := dest.Stat(ctx, result.StorageID); err == nil {
+			return nil
+		}
+		return s.WriteParity(ctx, dest, result.StorageID, overhead)
+	})
+}
+
+// WriteParity writes parity data for the blob id into dest. A blob that
+// does not match its digest gets none.
+func (s *Store) WriteParity(ctx context.Context, dest Backend, id string, overhead int) error {
+	size, err := s.backend.Stat(ctx, id)
+	if err != nil {
+		return err
+	}
+	r, err := s.backend.Open(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	// Parity of a damaged blob would preserve the damage, so the blob is
+	// hashed while encoding and the parity discarded if it does not match
+	pr, pw := io.Pipe()
+	go func() {
+		hashed := s.hash.New()
+		err := parity.Encode(io.TeeReader(fsutil.ContextReader(ctx, r), hashed), size, pw, overhead)
+		if digest, _ := splitID(id); err == nil && fmt.Sprintf("%x", hashed.Sum(nil)) != digest {
+			err = fmt.Errorf("blob %s does not match its digest", id)
+		}
+		pw.CloseWithError(err)
+	}()
+	if _, err := dest.Write(ctx, id, pr); err != nil {
+		_ = pr.CloseWithError(err)
+		return fmt.Errorf("failed to write parity: %w", err)
+	}
+	return nil
+}
+
+// Rebuild a damaged blob from its parity data, reporting whether it was
+// repaired. The repair is only written once it yields the blob's digest.
+func (s *Store) repairFromParity(ctx context.Context, source Backend, id string) (bool, error) {
+	repair := func(w io.Writer) error {
+		p, err := source.Open(ctx, id)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = p.Close()
+		}()
+		r, err := s.backend.Open(ctx, id)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = r.Close()
+		}()
+		_, err = parity.Repair(fsutil.ContextReader(ctx, r), p, w)
+		return err
+	}
+
+	hashed := s.hash.New()
+	err := repair(hashed)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, parity.ErrUnrepairable) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if digest, _ := splitID(id); fmt.Sprintf("%x", hashed.Sum(nil)) != digest {
+		return false, nil
+	}
+
+	// The damaged blob is read while its replacement is written, which every
+	// backend allows as Write only replaces the blob once complete
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(repair(pw))
+	}()
+	if _, err := s.backend.Write(ctx, id, pr); err != nil {
+		_ = pr.CloseWithError(err)
+		return false, err
+	}
+	return true, nil
+}
+
+// WriteMissingParity writes parity data into dest for every blob that has
+// none yet, returning how many were written
+func (s *Store) WriteMissingParity(ctx context.Context, dest Backend, overhead int) (int, error) {
+	var ids []string
+	err := s.backend.List(ctx, func(id string) error {
+		if _, err := dest.Stat(ctx, id); errors.Is(err, fs.ErrNotExist) {
+			ids = append(ids, id)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	for i, id := range ids {
+		if err := s.WriteParity(ctx, dest, id, overhead); err != nil {
+			return i, fmt.Errorf("failed to write parity for %s: %w", id, err)
+		}
+	}
+	return len(ids), nil
+}
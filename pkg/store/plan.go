@@ -0,0 +1,291 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"path"
+	"slices"
+)
+
+// Repair step operations
+const (
+	StepAdoptBlob      = "adopt_blob"      // record a version under RecoveredPrefix for an orphaned blob
+	StepRemoveBlob     = "remove_blob"     // delete an orphaned blob
+	StepRestoreVersion = "restore_version" // record the version a logged store of an orphaned blob lost
+	StepDropVersion    = "drop_version"    // delete a version whose blob is missing
+	StepLogStore       = "log_store"       // log the store action missing for a version
+	StepSplitHistory   = "split_history"   // move the versions stored from Source to the history Target
+	StepNormalizeName  = "normalize_name"  // append the history of a name not in NFC to that of its NFC form Target
+)
+
+// RepairStep is one change proposed by Fsck
+type RepairStep struct {
+	Op        string `json:"op"`
+	Problem   string `json:"problem"` // why the step is needed
+	StorageID string `json:"storage_id,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Version   int    `json:"version,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Target    string `json:"target,omitempty"`
+}
+
+// RepairPlan lists the changes that make the action log, versions and
+// blobs consistent. It is meant to be reviewed, and edited if need be,
+// before ApplyPlan runs it.
+type RepairPlan struct {
+	Steps []RepairStep `json:"steps"`
+}
+
+// Print the plan in a human-readable form
+func (p *RepairPlan) Print() {
+	for _, step := range p.Steps {
+		fmt.Printf("%-15s %s\n", step.Op, step.describe())
+	}
+	fmt.Printf("Repair plan: %d steps\n", len(p.Steps))
+}
+
+// Describe the target and reason of a step
+func (step RepairStep) describe() string {
+	switch step.Op {
+	case StepSplitHistory:
+		return fmt.Sprintf("%s from %s into %s: %s", step.Filename, step.Source, step.Target, step.Problem)
+	case StepNormalizeName:
+		return fmt.Sprintf("%s into %s: %s", step.Filename, step.Target, step.Problem)
+	case StepDropVersion, StepLogStore:
+		return fmt.Sprintf("%s version %d (%s): %s", step.Filename, step.Version, step.StorageID, step.Problem)
+	case StepRestoreVersion:
+		return fmt.Sprintf("%s (%s): %s", step.Filename, step.StorageID, step.Problem)
+	default:
+		return fmt.Sprintf("%s: %s", step.StorageID, step.Problem)
+	}
+}
+
+// ApplyReport lists which steps of a plan were applied. Steps whose
+// problem no longer exists are skipped.
+type ApplyReport struct {
+	Applied []RepairStep `json:"applied"`
+	Skipped []RepairStep `json:"skipped"`
+}
+
+// Print the report in a human-readable form
+func (r *ApplyReport) Print() {
+	for _, step := range r.Applied {
+		fmt.Printf("applied %-15s %s\n", step.Op, step.describe())
+	}
+	for _, step := range r.Skipped {
+		fmt.Printf("skipped %-15s %s\n", step.Op, step.describe())
+	}
+	fmt.Printf("Applied %d repair steps (%d skipped)\n", len(r.Applied), len(r.Skipped))
+}
+
+// Cross-check the action log, versions and blobs, recording the problems
+// found in report and the steps repairing them in report.Plan
+func (s *Store) planRepairs(ctx context.Context, report *FsckReport, stored map[string]bool) error {
+	versions, err := db.ListVersions(ctx, s.db, "")
+	if err != nil {
+		return fmt.Errorf("failed to list versions: %w", err)
+	}
+	actions, err := db.StoreActions(ctx, s.db)
+	if err != nil {
+		return fmt.Errorf("failed to read action log: %w", err)
+	}
+	logged := map[string]db.LoggedAction{}
+	for _, a := range actions {
+		logged[a.StorageID] = a
+	}
+	referenced := map[string]bool{}
+	for _, v := range versions {
+		referenced[StorageID(v)] = true
+	}
+
+	plan := &RepairPlan{}
+	for _, id := range report.Orphaned {
+		digest, _ := splitID(id)
+		if a, ok := logged[id]; ok && StorageID(db.Version{Filename: a.Filename, Hash: digest}) == id {
+			plan.Steps = append(plan.Steps, RepairStep{Op: StepRestoreVersion, Problem: "blob was stored but has no version",
+				StorageID: id, Filename: a.Filename, Hash: digest})
+			continue
+		}
+		adoptable, err := s.adoptBlob(ctx, id, true)
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %w", id, err)
+		}
+		if adoptable {
+			plan.Steps = append(plan.Steps, RepairStep{Op: StepAdoptBlob, Problem: "blob has no version", StorageID: id})
+			continue
+		}
+		plan.Steps = append(plan.Steps, RepairStep{Op: StepRemoveBlob, Problem: "blob has no version and no stored file could have produced it", StorageID: id})
+	}
+
+	for _, v := range versions {
+		// Names whose extension changes are left alone, as the extension
+		// is part of the storage ID
+		if key := fsutil.NormalizeName(v.Filename); key != v.Filename && path.Ext(key) == path.Ext(v.Filename) && report.Unnormalized[v.Filename] == "" {
+			report.Unnormalized[v.Filename] = key
+			plan.Steps = append(plan.Steps, RepairStep{Op: StepNormalizeName, Problem: "name was recorded before names were normalized",
+				Filename: v.Filename, Target: key})
+		}
+		id := StorageID(v)
+		switch {
+		case !stored[id]:
+			report.Missing = append(report.Missing, fmt.Sprintf("%s version %d (%s)", v.Filename, v.Version, id))
+			plan.Steps = append(plan.Steps, RepairStep{Op: StepDropVersion, Problem: "blob is missing",
+				StorageID: id, Filename: v.Filename, Version: v.Version, Hash: v.Hash})
+		case logged[id].StorageID == "":
+			report.Unlogged = append(report.Unlogged, fmt.Sprintf("%s version %d (%s)", v.Filename, v.Version, id))
+			plan.Steps = append(plan.Steps, RepairStep{Op: StepLogStore, Problem: "version has no store action",
+				StorageID: id, Filename: v.Filename, Version: v.Version, Hash: v.Hash})
+			// One logged store covers every version of the blob
+			logged[id] = db.LoggedAction{StorageID: id}
+		}
+	}
+
+	for _, a := range actions {
+		if a.StorageID != "" && !referenced[a.StorageID] && !stored[a.StorageID] {
+			// Nothing is left to repair; the log keeps the history
+			report.Unversioned = append(report.Unversioned, a.StorageID)
+		}
+	}
+
+	for filename, sources := range report.Tangled {
+		latest, err := db.GetVersion(ctx, s.db, filename, 0)
+		if err != nil {
+			return err
+		}
+		for source, key := range splitKeys(sources, latest.Path) {
+			plan.Steps = append(plan.Steps, RepairStep{Op: StepSplitHistory, Problem: "history mixes files from several paths",
+				Filename: filename, Source: source, Target: key})
+		}
+	}
+
+	report.Plan = plan
+	return nil
+}
+
+// ApplyPlan runs the steps of a repair plan in order, skipping those whose
+// problem is gone, so that a plan can be applied again after a failure
+func (s *Store) ApplyPlan(ctx context.Context, plan *RepairPlan) (*ApplyReport, error) {
+	report := &ApplyReport{}
+	for _, step := range plan.Steps {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		applied, err := s.applyStep(ctx, step)
+		if err != nil {
+			err = s.refused(ctx, "fsck_"+step.Op, step.Filename, err)
+			return report, fmt.Errorf("failed to apply %s for %s: %w", step.Op, step.describe(), err)
+		}
+		if applied {
+			report.Applied = append(report.Applied, step)
+		} else {
+			report.Skipped = append(report.Skipped, step)
+		}
+	}
+	return report, nil
+}
+
+// Apply one repair step, reporting whether it changed anything
+func (s *Store) applyStep(ctx context.Context, step RepairStep) (bool, error) {
+	switch step.Op {
+	case StepAdoptBlob, StepRemoveBlob, StepRestoreVersion:
+		orphaned, err := s.orphaned(ctx, step.StorageID)
+		if err != nil || !orphaned {
+			return false, err
+		}
+		switch step.Op {
+		case StepAdoptBlob:
+			return s.adoptBlob(ctx, step.StorageID, false)
+		case StepRemoveBlob:
+			return true, s.removeOrphan(ctx, step.StorageID)
+		}
+		if StorageID(db.Version{Filename: step.Filename, Hash: step.Hash}) != step.StorageID {
+			return false, errors.New("filename and hash do not match the blob")
+		}
+		t := s.blobType(ctx, step.StorageID, step.Filename)
+		return true, db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+			if _, err := db.LogVersion(ctx, tx, step.Filename, step.Hash, "", t.MIME, t.Kind); err != nil {
+				return err
+			}
+			return db.LogAction(ctx, tx, "fsck_restore", step.Filename, step.StorageID)
+		})
+	case StepDropVersion:
+		if _, err := s.backend.Stat(ctx, step.StorageID); !errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		var deleted bool
+		err := db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+			var err error
+			deleted, err = db.DeleteVersion(ctx, tx, step.Filename, step.Version, step.Hash)
+			if err != nil || !deleted {
+				return err
+			}
+			return db.LogAction(ctx, tx, "fsck_drop", step.Filename, step.StorageID)
+		})
+		return deleted, err
+	case StepLogStore:
+		actions, err := db.StoreActions(ctx, s.db)
+		if err != nil {
+			return false, err
+		}
+		for _, a := range actions {
+			if a.StorageID == step.StorageID {
+				return false, nil
+			}
+		}
+		size, err := s.backend.Stat(ctx, step.StorageID)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, db.RecordAction(ctx, s.db, db.Action{ActionType: "store", Filename: step.Filename, StorageID: step.StorageID, Bytes: size})
+	case StepSplitHistory:
+		tangled, err := db.TangledVersions(ctx, s.db)
+		if err != nil || !slices.Contains(tangled[step.Filename], step.Source) {
+			return false, err
+		}
+		if err := db.SplitVersions(ctx, s.db, step.Filename, map[string]string{step.Source: step.Target}); err != nil {
+			return false, err
+		}
+		return true, db.LogAction(ctx, s.db, "fsck_split", step.Filename, "")
+	case StepNormalizeName:
+		if fsutil.NormalizeName(step.Filename) != step.Target {
+			return false, errors.New("target is not the normalized form of the name")
+		}
+		versions, err := db.ListVersions(ctx, s.db, step.Filename)
+		if err != nil || len(versions) == 0 {
+			return false, err
+		}
+		if err := db.RenameFile(ctx, s.db, step.Filename, step.Target); err != nil {
+			return false, err
+		}
+		return true, db.LogAction(ctx, s.db, "fsck_normalize", step.Target, "")
+	default:
+		return false, fmt.Errorf("unknown repair step %q", step.Op)
+	}
+}
+
+// Report whether a blob is stored and referenced by no version
+func (s *Store) orphaned(ctx context.Context, id string) (bool, error) {
+	if _, err := s.backend.Stat(ctx, id); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	referenced, err := s.referencedBlobs(ctx)
+	return !referenced[id], err
+}
+
+// Delete an orphaned blob and log its removal
+func (s *Store) removeOrphan(ctx context.Context, id string) error {
+	if err := s.backend.Remove(ctx, id); err != nil {
+		return err
+	}
+	return db.LogAction(ctx, s.db, "fsck_remove", id, id)
+}
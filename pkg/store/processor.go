@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"sort"
+	"strings"
+)
+
+// Processor acts on files after they have been stored, for example to
+// index or scan them. Its blob can be read through the store's backend.
+type Processor interface {
+	Process(ctx context.Context, s *Store, result *StoreResult) error
+}
+
+// ProcessorFunc adapts a function to the Processor interface
+type ProcessorFunc func(ctx context.Context, s *Store, result *StoreResult) error
+
+func (f ProcessorFunc) Process(ctx context.Context, s *Store, result *StoreResult) error {
+	return f(ctx, s, result)
+}
+
+var processors = map[string]Processor{}
+
+// RegisterProcessor makes a processor available under name. It is meant to
+// be called from the init function of the package providing the processor
+// and panics if the name is taken.
+func RegisterProcessor(name string, p Processor) {
+	if _, exists := processors[name]; exists {
+		panic("store: processor " + name + " registered twice")
+	}
+	processors[name] = p
+}
+
+// LookupProcessor returns the processor registered under name
+func LookupProcessor(name string) (Processor, error) {
+	p, ok := processors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown processor %q (use %s)", name, strings.Join(ProcessorNames(), ", "))
+	}
+	return p, nil
+}
+
+// ProcessorNames returns the names of the registered processors, sorted
+func ProcessorNames() []string {
+	names := make([]string, 0, len(processors))
+	for name := range processors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddProcessor runs p on every file stored from now on, in the order the
+// processors were added
+func (s *Store) AddProcessor(p Processor) {
+	s.processors = append(s.processors, p)
+}
+
+// Run the processors on a stored file. The file stays stored when one
+// fails, so failures are reported as events.
+func (s *Store) process(ctx context.Context, result *StoreResult) {
+	for _, p := range s.processors {
+		if err := p.Process(ctx, s, result); err != nil {
+			s.opts.Events().OnError(event.Error{Op: "process", Name: result.Filename, Err: err})
+		}
+	}
+}
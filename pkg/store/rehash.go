@@ -0,0 +1,182 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"io"
+	"time"
+)
+
+// RehashReport summarizes a rehash
+type RehashReport struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Converted int    `json:"converted"`
+	Skipped   int    `json:"skipped"` // blobs already renamed or not matching their digest
+}
+
+// Print the report in a human-readable form
+func (r *RehashReport) Print() {
+	fmt.Printf("Rehashed %d blobs from %s to %s (%d skipped)\n", r.Converted, r.From, r.To, r.Skipped)
+}
+
+// Rehash renames every blob from its digest under from to its digest under
+// the store's algorithm, rewriting the versions and action log to match,
+// and records the new algorithm as the repository's. Blobs already renamed
+// are skipped, so an interrupted rehash can simply be run again.
+func (s *Store) Rehash(ctx context.Context, from hash.Algorithm) (*RehashReport, error) {
+	start := time.Now()
+	report := &RehashReport{From: from.Name, To: s.hash.Name}
+
+	// Rewriting the digests of retained or held versions would alter them
+	if err := db.CheckAnyRetention(ctx, s.db); err != nil {
+		return report, s.refused(ctx, "rehash", from.Name, err)
+	}
+
+	// Deltas name the blobs they apply to, which renaming would break
+	deltas, err := db.DeltaBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list delta blobs: %w", err)
+	}
+	if len(deltas) > 0 {
+		return report, fmt.Errorf("%d blobs are stored as deltas; store them whole with -action repack before rehashing", len(deltas))
+	}
+	// So do chunk lists, and chunks are named by the old algorithm
+	chunked, err := db.ChunkedBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list chunked blobs: %w", err)
+	}
+	if len(chunked) > 0 {
+		return report, fmt.Errorf("%d blobs are stored in chunks; store them whole with -action chunk -join before rehashing", len(chunked))
+	}
+	packed, err := db.PackedBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list packed blobs: %w", err)
+	}
+	if len(packed) > 0 {
+		return report, fmt.Errorf("%d blobs are stored in packfiles; store them loose with -action repack before rehashing", len(packed))
+	}
+
+	// Blobs are listed up front since rehashing renames them
+	var ids []string
+	err = s.backend.List(ctx, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		done, err := s.rehashBlob(ctx, from, id)
+		if err != nil {
+			return report, fmt.Errorf("failed to rehash %s: %w", id, err)
+		}
+		if done {
+			report.Converted++
+		} else {
+			report.Skipped++
+		}
+	}
+
+	if err := db.SetSetting(ctx, s.db, db.HashAlgorithmSetting, s.hash.Name); err != nil {
+		return report, fmt.Errorf("failed to record hash algorithm: %w", err)
+	}
+	err = db.RecordAction(ctx, s.db, db.Action{
+		ActionType: "rehash",
+		Filename:   from.Name,
+		StorageID:  s.hash.Name,
+		Duration:   time.Since(start),
+	})
+	return report, err
+}
+
+// Rename one blob and its references, reporting whether anything changed
+func (s *Store) rehashBlob(ctx context.Context, from hash.Algorithm, name string) (bool, error) {
+	digest, ext := splitID(name)
+
+	file, err := s.backend.Open(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	oldHash, newHash := from.New(), s.hash.New()
+	_, err = fsutil.Copy(ctx, io.MultiWriter(oldHash, newHash), s.opts.Reader(ctx, file))
+	if closeErr := file.Close(); closeErr != nil {
+		s.opts.Events().OnError(event.Error{Op: "rehash", Name: name, Err: fmt.Errorf("failed to close blob: %w", closeErr)})
+	}
+	if err != nil {
+		return false, err
+	}
+
+	oldSum := fmt.Sprintf("%x", oldHash.Sum(nil))
+	newSum := fmt.Sprintf("%x", newHash.Sum(nil))
+	if newSum == digest {
+		return false, nil
+	}
+	if oldSum != digest {
+		s.opts.Events().OnError(event.Error{Op: "rehash", Name: name, Err: fmt.Errorf("skipped, content does not match its %s digest", from.Name)})
+		return false, nil
+	}
+
+	newName := newSum + ext
+	renamed := false
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE versions SET hash = ? WHERE hash = ?;`, newSum, oldSum); err != nil {
+			return fmt.Errorf("failed to update versions: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE actions SET storage_id = ? WHERE storage_id = ?;`, newName, name); err != nil {
+			return fmt.Errorf("failed to update action log: %w", err)
+		}
+		// The blob is renamed last so a failed rename rolls the rows back
+		if _, err := s.backend.Stat(ctx, newName); err == nil {
+			return s.backend.Remove(ctx, name)
+		}
+		if err := s.rename(ctx, name, newName); err != nil {
+			return err
+		}
+		renamed = true
+		return nil
+	})
+	if err != nil {
+		if renamed {
+			if renameErr := s.rename(context.WithoutCancel(ctx), newName, name); renameErr != nil {
+				s.opts.Events().OnError(event.Error{Op: "rehash", Name: name, Err: fmt.Errorf("failed to restore blob after rollback: %w", renameErr)})
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// renamer is implemented by backends that can move a blob without copying it
+type renamer interface {
+	Rename(ctx context.Context, oldID, newID string) error
+}
+
+// Move a blob to a new ID, copying it when the backend cannot rename
+func (s *Store) rename(ctx context.Context, oldID, newID string) error {
+	if r, ok := Unwrap(s.backend).(renamer); ok {
+		return r.Rename(ctx, oldID, newID)
+	}
+
+	file, err := s.backend.Open(ctx, oldID)
+	if err != nil {
+		return err
+	}
+	_, err = s.backend.Write(ctx, newID, file)
+	if closeErr := file.Close(); closeErr != nil {
+		s.opts.Events().OnError(event.Error{Op: "rename", Name: oldID, Err: fmt.Errorf("failed to close blob: %w", closeErr)})
+	}
+	if err != nil {
+		return err
+	}
+	return s.backend.Remove(ctx, oldID)
+}
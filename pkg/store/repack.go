@@ -0,0 +1,412 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/delta"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+// deltaPrefix starts the IDs of blobs holding deltas, which no digest does
+const deltaPrefix = "delta-"
+
+// deltaMaxRatio is the share of the content a delta must stay below to be
+// kept instead of the whole content
+const deltaMaxRatio = 0.5
+
+// Return the ID of the delta turning the blob base into the blob id. Every
+// base gets its own, so a new delta never replaces one still in use.
+func deltaID(id, base string) string {
+	digest, _ := splitID(base)
+	return deltaPrefix + digest[:min(len(digest), 16)] + "-" + id
+}
+
+// RepackReport summarizes a repack
+type RepackReport struct {
+	Encoded  int   `json:"encoded"`  // blobs stored as a delta, or as a delta against a newer base
+	Expanded int   `json:"expanded"` // delta blobs stored whole again
+	Skipped  int   `json:"skipped"`  // blobs whose delta would save too little
+	Saved    int64 `json:"saved"`    // bytes freed in storage; negative when expanding
+}
+
+// Print the report in a human-readable form
+func (r *RepackReport) Print() {
+	fmt.Printf("Repacked %d blobs as deltas and %d whole (%d skipped), %d bytes saved\n", r.Encoded, r.Expanded, r.Skipped, r.Saved)
+}
+
+// Repack with encode set stores the blobs of versions other than the
+// latest as deltas against the latest version of their file, which stays
+// whole, and redoes deltas against blobs no longer the latest, so that
+// reading an old version applies a single delta. Without encode every
+// delta blob is stored whole again. Reading blobs is transparent either
+// way, and an interrupted repack can simply be run again.
+func (s *Store) Repack(ctx context.Context, encode bool) (*RepackReport, error) {
+	report := &RepackReport{}
+	deltas, err := db.DeltaBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list delta blobs: %w", err)
+	}
+	versions, err := db.ListVersions(ctx, s.db, "")
+	if err != nil {
+		return report, fmt.Errorf("failed to list versions: %w", err)
+	}
+
+	// Versions come oldest first, so the last of each file is its latest
+	latest := map[string]string{}
+	for _, v := range versions {
+		latest[v.Filename] = StorageID(v)
+	}
+	heads := map[string]bool{}
+	for _, id := range latest {
+		heads[id] = true
+	}
+	bases := map[string]string{}
+	for _, v := range versions {
+		if id := StorageID(v); !heads[id] && bases[id] == "" {
+			bases[id] = latest[v.Filename]
+		}
+	}
+
+	for _, id := range sortedKeys(deltas) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		row := deltas[id]
+		if _, err := s.backend.Stat(ctx, id); err == nil {
+			// The content was stored whole again since
+			if err := s.dropDelta(ctx, row); err != nil {
+				return report, fmt.Errorf("failed to remove delta of %s: %w", id, err)
+			}
+			delete(deltas, id)
+			continue
+		}
+		if encode && !heads[id] {
+			continue
+		}
+		saved, err := s.expandDelta(ctx, row)
+		if err != nil {
+			return report, fmt.Errorf("failed to store %s whole: %w", id, err)
+		}
+		report.Expanded++
+		report.Saved += saved
+		delete(deltas, id)
+	}
+	if !encode {
+		return report, nil
+	}
+
+	// Blobs sharing a base are encoded one after the other, with its signature
+	candidates := sortedKeys(bases)
+	sort.SliceStable(candidates, func(i, j int) bool { return bases[candidates[i]] < bases[candidates[j]] })
+	var sig *delta.Signature
+	var signed string
+	for _, id := range candidates {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		base := bases[id]
+		old, isDelta := deltas[id]
+		if isDelta && old.BaseID == base {
+			continue
+		}
+		// Blobs and bases adopted in place stay where they are
+		if _, err := s.backend.Stat(ctx, base); err != nil {
+			continue
+		}
+		if _, err := s.backend.Stat(ctx, id); err != nil && !isDelta {
+			continue
+		}
+		if signed != base {
+			if sig, err = s.signBlob(ctx, base); err != nil {
+				return report, fmt.Errorf("failed to sign %s: %w", base, err)
+			}
+			signed = base
+		}
+		var previous *db.DeltaBlob
+		if isDelta {
+			previous = &old
+		}
+		saved, ok, err := s.encodeDelta(ctx, id, base, sig, previous)
+		if err != nil {
+			return report, fmt.Errorf("failed to store %s as a delta: %w", id, err)
+		}
+		if !ok {
+			report.Skipped++
+			continue
+		}
+		report.Encoded++
+		report.Saved += saved
+	}
+	return report, nil
+}
+
+// Return the keys of m, sorted
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Compute the delta signature of a blob
+func (s *Store) signBlob(ctx context.Context, id string) (*delta.Signature, error) {
+	size, err := s.BlobSize(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return delta.Sign(fsutil.ContextReader(ctx, s.opts.Reader(ctx, r)), delta.BlockSize(size))
+}
+
+// Store the blob id as a delta against base, whose signature is sig,
+// replacing the whole blob or its previous delta once the new one is known
+// to reproduce it. It reports the bytes freed, and false when the delta
+// would not be small enough to keep.
+func (s *Store) encodeDelta(ctx context.Context, id, base string, sig *delta.Signature, previous *db.DeltaBlob) (int64, bool, error) {
+	start := time.Now()
+	tmpFile, err := os.CreateTemp("", "fm-delta-*")
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}()
+
+	r, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		return 0, false, err
+	}
+	content := &fsutil.CountingWriter{W: io.Discard}
+	patch := &fsutil.CountingWriter{W: tmpFile}
+	_, err = delta.Diff(sig, io.TeeReader(fsutil.ContextReader(ctx, s.opts.Reader(ctx, r)), content), patch)
+	_ = r.Close()
+	if err != nil {
+		return 0, false, err
+	}
+	if float64(patch.N) >= deltaMaxRatio*float64(content.N) {
+		return 0, false, nil
+	}
+
+	row := db.DeltaBlob{StorageID: id, BaseID: base, DeltaID: deltaID(id, base), Size: content.N}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	if _, err := s.write(ctx, row.DeltaID, tmpFile); err != nil {
+		return 0, false, err
+	}
+	// The old content goes only once the delta is known to reproduce it
+	if err := s.checkDelta(ctx, row); err != nil {
+		_ = s.backend.Remove(context.WithoutCancel(ctx), row.DeltaID)
+		return 0, false, err
+	}
+
+	freed := content.N
+	replaced := id
+	if previous != nil {
+		freed, _ = s.backend.Stat(ctx, previous.DeltaID)
+		replaced = previous.DeltaID
+	}
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		if err := db.AddDeltaBlob(ctx, tx, row); err != nil {
+			return err
+		}
+		return db.RecordAction(ctx, tx, db.Action{ActionType: "repack_delta", Filename: id, StorageID: row.DeltaID, Bytes: patch.N, Duration: time.Since(start)})
+	})
+	if err != nil {
+		_ = s.backend.Remove(context.WithoutCancel(ctx), row.DeltaID)
+		return 0, false, err
+	}
+	if replaced != row.DeltaID {
+		if err := s.backend.Remove(context.WithoutCancel(ctx), replaced); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, false, fmt.Errorf("failed to remove %s: %w", replaced, err)
+		}
+	}
+	return freed - patch.N, true, nil
+}
+
+// Read a delta blob back through to its end, which fails unless it gives
+// the content its storage ID names
+func (s *Store) checkDelta(ctx context.Context, row db.DeltaBlob) error {
+	r, err := s.openDeltaBlob(ctx, row)
+	if err != nil {
+		return err
+	}
+	digest, _ := splitID(row.StorageID)
+	verifying := &verifyingReader{ReadCloser: r, s: s, id: row.StorageID, digest: digest, hashed: s.hash.New()}
+	_, err = fsutil.Copy(ctx, io.Discard, verifying)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Store a delta blob whole again and drop its delta, returning the bytes
+// freed, which are negative
+func (s *Store) expandDelta(ctx context.Context, row db.DeltaBlob) (int64, error) {
+	start := time.Now()
+	r, err := s.OpenBlob(ctx, row.StorageID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.write(ctx, row.StorageID, r)
+	_ = r.Close()
+	if err != nil {
+		return 0, err
+	}
+	patchSize, _ := s.backend.Stat(ctx, row.DeltaID)
+	if err := db.RecordAction(ctx, s.db, db.Action{ActionType: "repack_whole", Filename: row.StorageID, StorageID: row.StorageID, Bytes: n, Duration: time.Since(start)}); err != nil {
+		return 0, err
+	}
+	if err := s.dropDelta(ctx, row); err != nil {
+		return 0, err
+	}
+	return patchSize - n, nil
+}
+
+// Forget a delta blob whose content is stored whole and remove its delta
+func (s *Store) dropDelta(ctx context.Context, row db.DeltaBlob) error {
+	if err := db.RemoveDeltaBlob(ctx, s.db, row.StorageID); err != nil {
+		return err
+	}
+	if err := s.backend.Remove(ctx, row.DeltaID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Open the content of a blob stored as a delta. Failing that, err is
+// returned, the error opening the blob from storage.
+func (s *Store) openDelta(ctx context.Context, id string, err error) (io.ReadCloser, error) {
+	row, ok, lookupErr := db.GetDeltaBlob(ctx, s.db, id)
+	if lookupErr != nil {
+		return nil, errors.Join(err, lookupErr)
+	}
+	if !ok {
+		return nil, err
+	}
+	return s.openDeltaBlob(ctx, row)
+}
+
+// Open the content a delta blob describes, applying its delta to its base
+func (s *Store) openDeltaBlob(ctx context.Context, row db.DeltaBlob) (io.ReadCloser, error) {
+	base, err := s.OpenBlob(ctx, row.BaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open base %s of %s: %w", row.BaseID, row.StorageID, err)
+	}
+	reader := &deltaReader{closers: []io.Closer{base}}
+
+	// Deltas copy blocks in any order, which needs the base at hand; only
+	// the content applying them gives is verified
+	var at io.ReaderAt
+	var size int64
+	if file, ok := blobFile(base); ok {
+		info, err := file.Stat()
+		if err != nil {
+			reader.cleanup()
+			return nil, err
+		}
+		at, size = file, info.Size()
+	} else {
+		tmpFile, err := os.CreateTemp("", "fm-delta-base-*")
+		if err != nil {
+			reader.cleanup()
+			return nil, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		reader.temp = tmpFile
+		if size, err = s.opts.Copy(ctx, tmpFile, base); err != nil {
+			reader.cleanup()
+			return nil, fmt.Errorf("failed to read base %s of %s: %w", row.BaseID, row.StorageID, err)
+		}
+		at = tmpFile
+	}
+
+	patch, err := s.backend.Open(ctx, row.DeltaID)
+	if err != nil {
+		reader.cleanup()
+		return nil, fmt.Errorf("failed to open delta of %s: %w", row.StorageID, err)
+	}
+	reader.closers = append(reader.closers, patch)
+
+	pr, pw := io.Pipe()
+	reader.PipeReader = pr
+	reader.done = make(chan struct{})
+	go func() {
+		defer close(reader.done)
+		_, err := delta.Apply(at, size, bufio.NewReader(patch), pw, row.Size)
+		_ = pw.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// deltaReader reads the content a delta gives as it is applied
+type deltaReader struct {
+	*io.PipeReader
+	done    chan struct{}
+	closers []io.Closer
+	temp    *os.File
+}
+
+func (r *deltaReader) Close() error {
+	_ = r.PipeReader.Close()
+	<-r.done
+	r.cleanup()
+	return nil
+}
+
+// Close the base and the delta and remove the copy of the base
+func (r *deltaReader) cleanup() {
+	for _, c := range r.closers {
+		_ = c.Close()
+	}
+	if r.temp != nil {
+		_ = r.temp.Close()
+		_ = os.Remove(r.temp.Name())
+	}
+}
+
+// BlobSize returns the size of the content of a blob, whether it is
+// stored loose, as a delta, in chunks or in a packfile, or adopted in place
+func (s *Store) BlobSize(ctx context.Context, id string) (int64, error) {
+	size, err := s.backend.Stat(ctx, id)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return size, err
+	}
+	row, ok, lookupErr := db.GetDeltaBlob(ctx, s.db, id)
+	if lookupErr != nil || ok {
+		return row.Size, lookupErr
+	}
+	chunks, lookupErr := db.BlobChunks(ctx, s.db, id)
+	if lookupErr != nil || len(chunks) > 0 {
+		var size int64
+		for _, chunk := range chunks {
+			size += chunk.Size
+		}
+		return size, lookupErr
+	}
+	packed, ok, lookupErr := db.GetPackedBlob(ctx, s.db, id)
+	if lookupErr != nil || ok {
+		return packed.Size, lookupErr
+	}
+	external, ok, lookupErr := db.GetExternalBlob(ctx, s.db, id)
+	if lookupErr != nil || ok {
+		return external.Size, lookupErr
+	}
+	return 0, err
+}
@@ -0,0 +1,20 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+)
+
+// Log a change a retention lock or legal hold refused as a failed action
+// of type op, so that the audit log shows the attempt, and return err
+func (s *Store) refused(ctx context.Context, op, name string, err error) error {
+	if !db.IsRefused(err) {
+		return err
+	}
+	if logErr := db.RecordAction(context.WithoutCancel(ctx), s.db, db.Action{ActionType: op, Filename: name, Err: err}); logErr != nil {
+		s.opts.Events().OnError(event.Error{Op: op, Name: name, Err: fmt.Errorf("failed to log refusal: %w", logErr)})
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/content"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrChecksumMismatch is returned when a blob read back from storage does
+// not match its recorded hash
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// OpenBlob opens a stored blob for reading, the content a delta blob, a
+// blob stored in chunks or a packed blob gives, or the file of an adopted
+// one that was not copied into storage. Opening a blob in an archive
+// storage class requests a thaw of it and fails with ErrArchived. The
+// content is hashed as it is read, and reaching its end fails with an error
+// wrapping ErrChecksumMismatch when it does not match the digest in id.
+func (s *Store) OpenBlob(ctx context.Context, id string) (io.ReadCloser, error) {
+	r, err := s.backend.Open(ctx, id)
+	if errors.Is(err, ErrArchived) {
+		return nil, s.thawArchived(ctx, id, err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		r, err = s.openDelta(ctx, id, err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		r, err = s.openChunks(ctx, id, err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		r, err = s.openPacked(ctx, id, err)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		r, err = s.openExternal(ctx, id, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	digest, _ := splitID(id)
+	return &verifyingReader{ReadCloser: r, s: s, id: id, digest: digest, hashed: s.hash.New()}, nil
+}
+
+// verifyingReader checks the content of a blob once it is read to the end
+type verifyingReader struct {
+	io.ReadCloser
+	s      *Store
+	id     string
+	digest string
+	hashed hash.Hash
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hashed.Write(p[:n])
+	if err == io.EOF && fmt.Sprintf("%x", r.hashed.Sum(nil)) != r.digest {
+		err = fmt.Errorf("blob %s: %w", r.id, ErrChecksumMismatch)
+		r.s.opts.Events().OnError(event.Error{Op: "retrieve", Name: r.id, Err: err})
+	}
+	return n, err
+}
+
+// Retrieve writes version n of a file, or its latest version when n is 0,
+// to dest, replacing what is there. The content is verified before dest is
+// touched, so a damaged blob never overwrites a working file. With
+// SetPreserveXattrs the extended attributes recorded for the version are
+// set on it too.
+func (s *Store) Retrieve(ctx context.Context, filename string, n int, dest string) (db.Version, error) {
+	return s.RetrieveFromBranch(ctx, filename, "", n, dest)
+}
+
+// RetrieveFromBranch writes version n of a file on a branch of its
+// history, or the latest version of the branch when n is 0, to dest as
+// Retrieve does. An empty branch is the mainline.
+func (s *Store) RetrieveFromBranch(ctx context.Context, filename, branch string, n int, dest string) (db.Version, error) {
+	v, err := db.GetBranchVersion(ctx, s.db, fsutil.NormalizeName(filename), branch, n)
+	if err != nil {
+		return v, err
+	}
+	r, err := s.OpenBlob(ctx, StorageID(v))
+	if err != nil {
+		return v, fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	dest = fsutil.LongPath(dest)
+	tmpFile, err := os.CreateTemp(filepath.Dir(dest), ".fm-retrieve-*")
+	if err != nil {
+		return v, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+	err = s.retrieveBlob(ctx, tmpFile, r, StorageID(v))
+	if err != nil {
+		_ = tmpFile.Close()
+		return v, fmt.Errorf("failed to retrieve %s version %d: %w", v.Filename, v.Version, err)
+	}
+	// The mode is set first, as it would change the mask of an ACL
+	if err := tmpFile.Chmod(0o644); err != nil {
+		_ = tmpFile.Close()
+		return v, err
+	}
+	if s.preserveXattrs {
+		if err := s.restoreXattrs(ctx, tmpFile, v); err != nil {
+			_ = tmpFile.Close()
+			return v, fmt.Errorf("failed to restore extended attributes of %s version %d: %w", v.Filename, v.Version, err)
+		}
+	}
+	if err := s.opts.SyncFile(tmpFile); err != nil {
+		_ = tmpFile.Close()
+		return v, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return v, err
+	}
+	if err := os.Rename(tmpFile.Name(), dest); err != nil {
+		return v, fmt.Errorf("failed to replace %s: %w", dest, err)
+	}
+	return v, s.opts.SyncDir(filepath.Dir(dest))
+}
+
+// Write the blob id, open for reading as r, to an empty file. A local blob
+// is cloned where the file system shares data between files, and only read
+// to verify it; a sparse one keeps its holes.
+func (s *Store) retrieveBlob(ctx context.Context, file *os.File, r io.ReadCloser, id string) error {
+	local, isLocal := Unwrap(s.backend).(*Local)
+	if blob, ok := blobFile(r); ok && isLocal {
+		err := fsutil.Clone(file, blob)
+		if err == nil {
+			_, err = s.opts.Copy(ctx, io.Discard, r)
+			return err
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	if isLocal && fsutil.IsSparse(local.file(id)) {
+		sparse := fsutil.NewSparseWriter(file)
+		if _, err := s.opts.Copy(ctx, sparse, r); err != nil {
+			return err
+		}
+		return sparse.Finish()
+	}
+
+	// Without a known size the file is not preallocated
+	size, _ := s.BlobSize(ctx, id)
+	if err := fsutil.Preallocate(file, size); err != nil {
+		return err
+	}
+	written, err := s.opts.Copy(ctx, file, r)
+	if err != nil {
+		return err
+	}
+	return fsutil.TrimPreallocated(file, written, size)
+}
+
+// Return the file a local blob opened by OpenBlob is read from
+func blobFile(r io.Reader) (*os.File, bool) {
+	verifying, ok := r.(*verifyingReader)
+	if !ok {
+		return nil, false
+	}
+	inner := verifying.ReadCloser
+	if retried, ok := inner.(*retryReader); ok {
+		inner = retried.r
+	}
+	file, ok := inner.(*os.File)
+	return file, ok
+}
+
+// Detect the type of a stored blob from its first bytes, for a version of
+// the file name. A blob that cannot be read gives the zero type.
+func (s *Store) blobType(ctx context.Context, id, name string) content.Type {
+	r, err := s.backend.Open(ctx, id)
+	if err != nil {
+		return content.Type{}
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	head := make([]byte, content.SniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return content.Type{}
+	}
+	return content.Detect(name, head[:n])
+}
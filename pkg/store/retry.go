@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/retry"
+	"io"
+)
+
+// retrying is a backend retrying the operations of another that fail with
+// transient errors, as OpenBackend sets up
+type retrying struct {
+	backend Backend
+	policy  retry.Policy
+}
+
+// Unwrap returns the backend a backend adds behaviour to, such as retries,
+// or the backend itself
+func Unwrap(b Backend) Backend {
+	if r, ok := b.(*retrying); ok {
+		return r.backend
+	}
+	return b
+}
+
+func (r *retrying) Stat(ctx context.Context, id string) (size int64, err error) {
+	err = r.policy.Do(ctx, func() error {
+		size, err = r.backend.Stat(ctx, id)
+		return err
+	})
+	return size, err
+}
+
+// Open retries opening the blob, and its reader reopens it and skips what
+// was read already when a read fails
+func (r *retrying) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	reader := &retryReader{ctx: ctx, backend: r.backend, policy: r.policy, id: id}
+	err := r.policy.Do(ctx, func() error {
+		var err error
+		reader.r, err = r.backend.Open(ctx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Write retries only when r can be rewound to where it started
+func (r *retrying) Write(ctx context.Context, id string, src io.Reader) (n int64, err error) {
+	seeker, ok := src.(io.Seeker)
+	if !ok {
+		return r.backend.Write(ctx, id, src)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return r.backend.Write(ctx, id, src)
+	}
+	first := true
+	err = r.policy.Do(ctx, func() error {
+		if !first {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to rewind %s for another attempt: %w", id, err)
+			}
+		}
+		first = false
+		n, err = r.backend.Write(ctx, id, src)
+		return err
+	})
+	return n, err
+}
+
+func (r *retrying) Remove(ctx context.Context, id string) error {
+	return r.policy.Do(ctx, func() error {
+		return r.backend.Remove(ctx, id)
+	})
+}
+
+// List is retried until it has passed on the first ID, after which fn
+// would see IDs twice
+func (r *retrying) List(ctx context.Context, fn func(id string) error) error {
+	listed := false
+	policy := r.policy
+	retryable := retryableOf(policy)
+	policy.Retryable = func(err error) bool {
+		return !listed && retryable(err)
+	}
+	return policy.Do(ctx, func() error {
+		return r.backend.List(ctx, func(id string) error {
+			listed = true
+			return fn(id)
+		})
+	})
+}
+
+func (r *retrying) Location(id string) string {
+	return r.backend.Location(id)
+}
+
+// Return what a policy considers worth retrying
+func retryableOf(policy retry.Policy) func(error) bool {
+	if policy.Retryable == nil {
+		return retry.Transient
+	}
+	return policy.Retryable
+}
+
+// retryReader reads a blob, reopening it at the offset reached when a read
+// fails with a transient error
+type retryReader struct {
+	ctx     context.Context
+	backend Backend
+	policy  retry.Policy
+	id      string
+	r       io.ReadCloser
+	n       int64 // bytes read
+	retries int
+	err     error // of a failed reopen
+}
+
+func (rr *retryReader) Read(p []byte) (int, error) {
+	for {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		n, err := rr.r.Read(p)
+		rr.n += int64(n)
+		if err == nil || err == io.EOF || n > 0 || rr.retries+1 >= rr.policy.Attempts || !retryableOf(rr.policy)(err) {
+			return n, err
+		}
+		if rr.policy.OnRetry != nil {
+			rr.policy.OnRetry(err, rr.retries+1, 0)
+		}
+		// Reopening counts against the attempts left to the reader
+		policy := rr.policy
+		policy.Attempts -= 1 + rr.retries
+		attempts := 0
+		if reopenErr := policy.Do(rr.ctx, func() error {
+			attempts++
+			return rr.reopen()
+		}); reopenErr != nil {
+			rr.err = errors.Join(err, reopenErr)
+		}
+		rr.retries += attempts
+	}
+}
+
+// Open the blob again and skip to where reading stopped
+func (rr *retryReader) reopen() error {
+	_ = rr.r.Close()
+	rr.r = io.NopCloser(eofReader{})
+	r, err := rr.backend.Open(rr.ctx, rr.id)
+	if err != nil {
+		return err
+	}
+	if skipped, err := io.CopyN(io.Discard, r, rr.n); err != nil {
+		_ = r.Close()
+		if err == io.EOF {
+			return fmt.Errorf("blob %s has %d bytes, fewer than read before", rr.id, skipped)
+		}
+		return err
+	}
+	rr.r = r
+	return nil
+}
+
+func (rr *retryReader) Close() error {
+	return rr.r.Close()
+}
+
+// eofReader stands in for a blob being reopened
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/scan"
+)
+
+// What happens to infected content
+const (
+	ScanReject     = "reject"     // refuse to store it
+	ScanQuarantine = "quarantine" // move it to ScanOptions.Quarantine instead of storing it
+	ScanFlag       = "flag"       // store it and mark the file with InfectedKey
+)
+
+// InfectedKey is the metadata key ScanFlag sets to what was found
+const InfectedKey = "infected"
+
+// ErrInfected is wrapped by the errors of files refused for infected content
+var ErrInfected = errors.New("infected")
+
+// ScanOptions set up virus scanning of stored content
+type ScanOptions struct {
+	Scanner    scan.Scanner
+	Policy     string  // ScanReject, ScanQuarantine or ScanFlag
+	Quarantine Backend // for ScanQuarantine
+}
+
+// ValidateScanPolicy checks a policy for infected content
+func ValidateScanPolicy(policy string) error {
+	switch policy {
+	case ScanReject, ScanQuarantine, ScanFlag:
+		return nil
+	}
+	return fmt.Errorf("unknown scan policy %q (use %s, %s, %s)", policy, ScanReject, ScanQuarantine, ScanFlag)
+}
+
+// SetScanner scans the content of every file stored from now on before its
+// version is recorded, acting on infected content as the policy says.
+// Content that cannot be scanned is not stored.
+func (s *Store) SetScanner(opts ScanOptions) {
+	s.scan = opts
+}
+
+// Check a written blob against the content policy, unless that was done
+// before writing it, and scan its content before its version is recorded.
+// Clean content passes, and so does infected content under ScanFlag, which
+// returns what was found to flag the file with. Otherwise the blob is
+// removed unless a version references it already, and the file fails with
+// an error wrapping ErrInfected. Every detection is logged as a failed scan
+// action.
+func (s *Store) screen(ctx context.Context, blob *Blob, source string) (string, error) {
+	if !blob.admitted {
+		if err := s.opts.Admits(ctx, "store", blob.Filename, blob.Bytes); err != nil {
+			s.discard(ctx, blob)
+			return "", err
+		}
+	}
+	if s.scan.Scanner == nil {
+		return "", nil
+	}
+	r, err := s.OpenBlob(ctx, blob.StorageID)
+	if err != nil {
+		s.discard(ctx, blob)
+		return "", fmt.Errorf("failed to scan %s: %w", source, err)
+	}
+	result, err := s.scan.Scanner.Scan(ctx, blob.Filename, r)
+	_ = r.Close()
+	if err != nil {
+		s.discard(ctx, blob)
+		return "", fmt.Errorf("failed to scan %s: %w", source, err)
+	}
+	if !result.Infected {
+		return "", nil
+	}
+
+	infected := fmt.Errorf("%w: %s contains %s", ErrInfected, source, result.Signature)
+	switch s.scan.Policy {
+	case ScanFlag:
+		infected = fmt.Errorf("%w; stored flagged", infected)
+	case ScanQuarantine:
+		if err := s.quarantineCopy(ctx, blob.StorageID); err != nil {
+			infected = fmt.Errorf("%w; failed to quarantine: %v", infected, err)
+		} else {
+			infected = fmt.Errorf("%w; quarantined", infected)
+		}
+	}
+	logErr := db.RecordAction(context.WithoutCancel(ctx), s.db, db.Action{ActionType: "scan", Filename: blob.Filename, StorageID: blob.StorageID, Bytes: blob.Bytes, Err: infected})
+	if logErr != nil {
+		s.opts.Events().OnError(event.Error{Op: "scan", Name: source, Err: fmt.Errorf("failed to log detection: %w", logErr)})
+	}
+	if s.scan.Policy == ScanFlag {
+		s.opts.Events().OnError(event.Error{Op: "scan", Name: source, Err: infected})
+		return result.Signature, nil
+	}
+	s.discard(ctx, blob)
+	return "", infected
+}
+
+// Copy a blob to the scan quarantine
+func (s *Store) quarantineCopy(ctx context.Context, id string) error {
+	if s.scan.Quarantine == nil {
+		return errors.New("no quarantine is set up")
+	}
+	r, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	_, err = s.scan.Quarantine.Write(ctx, id, r)
+	return err
+}
+
+// Remove a blob written for a file that is not recorded, unless it is a
+// duplicate or other stores or versions use it; see removeUnused
+func (s *Store) discard(ctx context.Context, blob *Blob) {
+	if blob.Duplicate {
+		return
+	}
+	if err := s.removeUnused(ctx, blob); err != nil {
+		s.opts.Events().OnError(event.Error{Op: "store", Name: blob.Path, Err: fmt.Errorf("failed to remove blob: %w", err)})
+	}
+}
+
+// Mark files stored with infected content under ScanFlag
+func (s *Store) flag(ctx context.Context, flagged map[string]string) {
+	for filename, signature := range flagged {
+		if err := db.SetMeta(ctx, s.db, filename, map[string]string{InfectedKey: signature}); err != nil {
+			s.opts.Events().OnError(event.Error{Op: "scan", Name: filename, Err: fmt.Errorf("failed to flag: %w", err)})
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/content"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"io"
+)
+
+// ContentIndexProcessor is the name of the processor indexing the text of
+// stored files for -action search
+const ContentIndexProcessor = "content-index"
+
+func init() {
+	RegisterProcessor(ContentIndexProcessor, ProcessorFunc(indexContent))
+}
+
+// Extract the text of a newly stored version into the search index
+func indexContent(ctx context.Context, s *Store, result *StoreResult) error {
+	if result.Duplicate {
+		return nil
+	}
+	text, err := s.extractText(ctx, result.StorageID, result.Filename)
+	if err != nil {
+		return fmt.Errorf("failed to extract text: %w", err)
+	}
+	if err := db.IndexContent(ctx, s.db, result.Filename, text); err != nil {
+		return fmt.Errorf("failed to index text: %w", err)
+	}
+	return nil
+}
+
+// Extract the text of a blob stored for a version of the file name
+func (s *Store) extractText(ctx context.Context, id, name string) (string, error) {
+	r, err := s.backend.Open(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	head := &content.Head{}
+	if _, err := io.CopyN(head, r, content.SniffLen); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	t := content.Detect(name, head.Bytes())
+	if !t.Extractable() {
+		return "", nil
+	}
+	return content.ExtractText(io.MultiReader(bytes.NewReader(head.Bytes()), r), t)
+}
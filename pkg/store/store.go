@@ -0,0 +1,819 @@
+// Package store copies files into content-addressed storage and records
+// their versions in the metadata database.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/content"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a content-addressed blob backend paired with a metadata
+// database
+type Store struct {
+	backend    Backend
+	db         *db.DB
+	hash       hash.Algorithm
+	opts       fsutil.Options
+	processors []Processor
+	workers    int           // files StoreDirectory stores at once
+	io         chan struct{} // slots for blobs being written to the backend
+	cache      *db.HashCache // digests of host files stored before
+	claims     *claims       // blobs being recorded, shared with the copies of the store
+
+	preserveXattrs bool        // Retrieve sets the extended attributes recorded for versions
+	thawDays       int         // how long blobs thawed by OpenBlob stay readable
+	scan           ScanOptions // scanning of stored content for viruses, if any
+}
+
+// New creates a store keeping blobs in backend, named by their digest under
+// algorithm, and recording them in metadata
+func New(backend Backend, metadata *db.DB, algorithm hash.Algorithm, opts fsutil.Options) *Store {
+	return &Store{
+		backend: backend,
+		db:      metadata,
+		hash:    algorithm,
+		opts:    opts,
+		workers: 1,
+		cache:   db.NewHashCache(metadata, algorithm.Name),
+		claims:  &claims{n: map[string]int{}},
+	}
+}
+
+// SetConcurrency makes StoreDirectory hash and copy up to workers files at
+// once, and every operation of the store and its copies write at most ioLimit
+// blobs to the backend at once; 0 means as many as workers
+func (s *Store) SetConcurrency(workers, ioLimit int) {
+	s.workers = max(workers, 1)
+	if ioLimit < 1 {
+		ioLimit = s.workers
+	}
+	s.io = make(chan struct{}, ioLimit)
+}
+
+// WithOptions returns a store sharing this one's storage, database and
+// processors that reports to and throttles by opts instead
+func (s *Store) WithOptions(opts fsutil.Options) *Store {
+	clone := *s
+	clone.opts = opts
+	return &clone
+}
+
+// Backend returns the backend holding the blobs
+func (s *Store) Backend() Backend {
+	return s.backend
+}
+
+// Algorithm returns the hash algorithm addressing the blobs
+func (s *Store) Algorithm() hash.Algorithm {
+	return s.hash
+}
+
+// Usage returns the number of bytes the blobs take in the backend
+func (s *Store) Usage(ctx context.Context) (int64, error) {
+	var total int64
+	err := s.backend.List(ctx, func(id string) error {
+		size, err := s.backend.Stat(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", s.backend.Location(id), err)
+		}
+		total += size
+		return nil
+	})
+	return total, err
+}
+
+// Blob describes the outcome of copying a file into storage
+type Blob struct {
+	Filename  string // the version key: the name within the stored tree, or the base name of a single file
+	Source    string // where the content was read from, recorded with its version
+	Hash      string
+	StorageID string // hash-named blob inside the backend
+	Path      string // where the backend keeps the blob
+	Bytes     int64
+	Duplicate bool         // the blob already existed and nothing was written
+	Type      content.Type // detected from the content read; zero when none was
+	Duration  time.Duration
+	Xattrs    map[string][]byte // extended attributes of the source file, recorded with its version
+
+	// OriginalName is the name as read when Filename, which is normalized
+	// to NFC, differs from it
+	OriginalName string
+
+	// Branch is the branch of the history of Filename the version is
+	// recorded on; empty for the mainline
+	Branch string
+
+	external *db.ExternalBlob // set when the content was registered in place instead of copied
+	admitted bool             // set when the content policy was checked before writing
+	unclaim  func()           // releases the claim taken to record the blob; see claim
+}
+
+// Action returns the action log entry describing the blob
+func (b *Blob) Action() db.Action {
+	record := db.Action{
+		ActionType: "store",
+		Filename:   b.Filename,
+		StorageID:  b.StorageID,
+		Bytes:      b.Bytes,
+		Duration:   b.Duration,
+
+		// Storing the same content under the same name again has the same result
+		IdempotencyKey: db.IdempotencyKey("store", b.Filename, b.Hash),
+	}
+	if b.Branch != "" {
+		record.IdempotencyKey = db.IdempotencyKey("store", b.Filename, b.Branch, b.Hash)
+	}
+	if b.Duplicate {
+		record.ActionType = "store_duplicate"
+	}
+	return record
+}
+
+// Rows to record for a newly written blob
+func (s *Store) stored(ctx context.Context, blob *Blob) db.StoredFile {
+	return db.StoredFile{
+		Action:       blob.Action(),
+		Filename:     blob.Filename,
+		Hash:         blob.Hash,
+		Path:         blob.Source,
+		MimeType:     blob.Type.MIME,
+		Kind:         blob.Type.Kind,
+		Xattrs:       blob.Xattrs,
+		OriginalName: blob.OriginalName,
+		Remove: func() error {
+			return s.removeUnused(ctx, blob)
+		},
+	}
+}
+
+// StoreResult describes a stored file
+type StoreResult struct {
+	Filename     string `json:"filename"`
+	Hash         string `json:"hash"`
+	StorageID    string `json:"storage_id"`
+	Path         string `json:"path"`
+	Version      int    `json:"version"`   // version recorded for the file; for a duplicate, the latest one when it has the same content, or 0
+	Duplicate    bool   `json:"duplicate"` // the content was already stored and no version was recorded
+	Bytes        int64  `json:"bytes"`
+	BytesWritten int64  `json:"bytes_written"` // bytes copied into storage; 0 for a duplicate
+}
+
+// Result returns the result of storing the blob as the given version
+func (b *Blob) Result(version int) *StoreResult {
+	result := &StoreResult{
+		Filename:  b.Filename,
+		Hash:      b.Hash,
+		StorageID: b.StorageID,
+		Path:      b.Path,
+		Version:   version,
+		Duplicate: b.Duplicate,
+		Bytes:     b.Bytes,
+	}
+	if !b.Duplicate {
+		result.BytesWritten = b.Bytes
+	}
+	return result
+}
+
+// StoreReport summarizes storing a directory tree
+type StoreReport struct {
+	Source       string `json:"source"`
+	Stored       int    `json:"stored"`     // new blobs written
+	Duplicates   int    `json:"duplicates"` // files whose content was already stored
+	BytesWritten int64  `json:"bytes_written"`
+
+	// Unreadable lists the parts of the tree that were skipped as they
+	// could not be read, with why, and Failed the errors of the files that
+	// could not be stored
+	Unreadable []string `json:"unreadable,omitempty"`
+	Failed     []string `json:"failed,omitempty"`
+}
+
+// Complete reports whether every file of the tree was stored
+func (r *StoreReport) Complete() bool {
+	return len(r.Unreadable) == 0 && len(r.Failed) == 0
+}
+
+// Print the report in a human-readable form
+func (r *StoreReport) Print() {
+	for _, skipped := range r.Unreadable {
+		fmt.Printf("unreadable %s\n", skipped)
+	}
+	for _, failed := range r.Failed {
+		fmt.Println(failed)
+	}
+	fmt.Printf("Stored %d files (%d already present) from %s\n", r.Stored+r.Duplicates, r.Duplicates, r.Source)
+}
+
+// WriteBlob copies a file into storage without touching the database. A
+// blob interrupted by cancelling ctx is removed again.
+func (s *Store) WriteBlob(ctx context.Context, filePath string) (*Blob, error) {
+	return s.writeBlobFS(ctx, fsutil.HostFS(filepath.Dir(filePath)), filepath.Base(filePath), sourcePath(filePath))
+}
+
+// WriteBlobFS copies the file name of fsys into storage like WriteBlob,
+// keyed by that name
+func (s *Store) WriteBlobFS(ctx context.Context, fsys fs.FS, name string) (*Blob, error) {
+	return s.writeBlobFS(ctx, fsys, name, "")
+}
+
+// Copy the file name of fsys into storage. A file with a source path on
+// the host is not read at all when the hash cache knows its digest and
+// that blob is stored, unless the options are paranoid.
+func (s *Store) writeBlobFS(ctx context.Context, fsys fs.FS, name, source string) (*Blob, error) {
+	start := time.Now()
+	srcFile, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer func(srcFile fs.File) {
+		if err := srcFile.Close(); err != nil {
+			s.opts.Events().OnError(event.Error{Op: "store", Name: name, Err: fmt.Errorf("failed to close source file: %w", err)})
+		}
+	}(srcFile)
+	info, err := srcFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat source file: %w", err)
+	}
+	// Files the content policy rejects are not copied at all
+	if err := s.opts.Admits(ctx, "store", name, info.Size()); err != nil {
+		return nil, err
+	}
+	if source == "" {
+		blob, err := s.copyBlob(ctx, fsys, name, srcFile, start)
+		if err != nil {
+			return nil, err
+		}
+		blob.Xattrs = s.sourceXattrs(srcFile, name)
+		blob.admitted = true
+		return blob, nil
+	}
+
+	if sum, ok := s.cachedHash(ctx, source, info); ok {
+		blob := s.newBlob(name, sum)
+		blob.Source = source
+		blob.admitted = true
+		duplicate, err := s.exists(ctx, blob)
+		if err != nil {
+			return nil, err
+		}
+		if duplicate {
+			blob.Duration = time.Since(start)
+			return blob, nil
+		}
+		// The blob is gone, so the file is stored again
+	}
+	blob, err := s.copyBlob(ctx, fsys, name, srcFile, start)
+	if err != nil {
+		return nil, err
+	}
+	blob.Source = source
+	blob.Xattrs = s.sourceXattrs(srcFile, source)
+	blob.admitted = true
+	if err := s.cache.Remember(ctx, source, info, blob.Hash); err != nil {
+		s.opts.Events().OnError(event.Error{Op: "hash cache", Name: source, Err: err})
+	}
+	return blob, nil
+}
+
+// Return the cached digest of a host file unless the options are paranoid
+func (s *Store) cachedHash(ctx context.Context, source string, info fs.FileInfo) (string, bool) {
+	if s.opts.Paranoid {
+		return "", false
+	}
+	return s.cache.Lookup(ctx, source, info)
+}
+
+// Write the digests the hash cache still holds back
+func (s *Store) flushCache(ctx context.Context) {
+	if err := s.cache.Flush(context.WithoutCancel(ctx)); err != nil {
+		s.opts.Events().OnError(event.Error{Op: "hash cache", Name: "flush", Err: err})
+	}
+}
+
+// Copy the opened file name of fsys into storage
+func (s *Store) copyBlob(ctx context.Context, fsys fs.FS, name string, srcFile fs.File, start time.Time) (*Blob, error) {
+	// The local backend hashes the file while copying it into a temporary
+	// blob, reading it once; others need the digest to name the blob first
+	if _, ok := Unwrap(s.backend).(*Local); ok {
+		return s.writeBlobReader(ctx, name, srcFile, false)
+	}
+
+	sum, err := s.hash.FSFile(ctx, fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	blob := s.newBlob(name, sum)
+	blob.Source = name
+	duplicate, err := s.exists(ctx, blob)
+	if err != nil {
+		return nil, err
+	}
+	if duplicate {
+		blob.Duration = time.Since(start)
+		return blob, nil
+	}
+
+	head := &content.Head{}
+	blob.Bytes, err = s.write(ctx, blob.StorageID, io.TeeReader(srcFile, head))
+	if err != nil {
+		return nil, err
+	}
+	blob.Type = content.Detect(name, head.Bytes())
+
+	blob.Duration = time.Since(start)
+	return blob, nil
+}
+
+// WriteBlobReader copies the contents of r into storage under the given
+// file name, which may be a slash-separated path like the names
+// StoreDirectory records, without touching the database. The stream is
+// hashed while it is written to a temporary file, which then becomes the
+// blob or is discarded as a duplicate. Content the content policy rejects,
+// judged by the size streamed, is discarded before it becomes a blob.
+func (s *Store) WriteBlobReader(ctx context.Context, name string, r io.Reader) (*Blob, error) {
+	return s.writeBlobReader(ctx, name, r, true)
+}
+
+// Copy the contents of r into storage, checking them against the content
+// policy first when admit is set
+func (s *Store) writeBlobReader(ctx context.Context, name string, r io.Reader, admit bool) (*Blob, error) {
+	start := time.Now()
+
+	// The local backend adopts the temporary file; others copy it
+	local, isLocal := Unwrap(s.backend).(*Local)
+	var tmpFile *os.File
+	var err error
+	if isLocal {
+		release, ioErr := s.acquireIO(ctx)
+		if ioErr != nil {
+			return nil, ioErr
+		}
+		defer release()
+		tmpFile, err = local.createTemp()
+	} else {
+		tmpFile, err = os.CreateTemp("", "fm-incoming-*")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	discard := func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpPath)
+	}
+
+	// Runs of zeros become holes, so that sparse files stay sparse
+	sparse := fsutil.NewSparseWriter(tmpFile)
+	counter := &fsutil.CountingWriter{W: s.opts.Writer(ctx, sparse)}
+	head := &content.Head{}
+	sum, err := s.hash.Reader(ctx, io.TeeReader(r, io.MultiWriter(counter, head)))
+	if err == nil {
+		err = sparse.Finish()
+	}
+	if err != nil {
+		discard()
+		return nil, fmt.Errorf("failed to copy stream: %w", err)
+	}
+
+	blob := s.newBlob(filepath.ToSlash(name), sum)
+	if admit {
+		if err := s.opts.Admits(ctx, "store", blob.Filename, counter.N); err != nil {
+			discard()
+			return nil, err
+		}
+	}
+	blob.admitted = true
+	blob.Source = blob.Filename
+	blob.Type = content.Detect(name, head.Bytes())
+	duplicate, err := s.exists(ctx, blob)
+	blob.Bytes = counter.N
+	if err != nil {
+		discard()
+		return nil, err
+	}
+	if duplicate {
+		discard()
+		blob.Duration = time.Since(start)
+		return blob, nil
+	}
+
+	if isLocal {
+		err = local.commit(tmpFile, blob.StorageID)
+	} else {
+		defer discard()
+		if _, err = tmpFile.Seek(0, io.SeekStart); err == nil {
+			_, err = s.write(ctx, blob.StorageID, tmpFile)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob.Duration = time.Since(start)
+	return blob, nil
+}
+
+// Write a blob to the backend once an I/O slot is free
+func (s *Store) write(ctx context.Context, id string, r io.Reader) (int64, error) {
+	release, err := s.acquireIO(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return s.backend.Write(ctx, id, r)
+}
+
+// Wait for a slot to write a blob, returning the function freeing it
+func (s *Store) acquireIO(ctx context.Context) (func(), error) {
+	if s.io == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.io <- struct{}{}:
+		return func() { <-s.io }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Describe the blob holding content with the given digest for a file name.
+// The version key is the NFC form of the name, so that the same name read
+// on macOS and elsewhere keys the same history.
+func (s *Store) newBlob(filename, sum string) *Blob {
+	key := fsutil.NormalizeName(filename)
+	id := sum + path.Ext(key)
+	blob := &Blob{Filename: key, Hash: sum, StorageID: id, Path: s.backend.Location(id)}
+	if key != filename {
+		blob.OriginalName = filename
+	}
+	return blob
+}
+
+// Absolute, slash-separated form of a source file path, so that versions
+// stored from the same file compare equal however it was named
+func sourcePath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	return filepath.ToSlash(name)
+}
+
+// Report whether the blob is already stored, marking it as a duplicate
+func (s *Store) exists(ctx context.Context, blob *Blob) (bool, error) {
+	size, err := s.backend.Stat(ctx, blob.StorageID)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check for existing blob: %w", err)
+	}
+	blob.Bytes = size
+	blob.Duplicate = true
+	return true, nil
+}
+
+// StoreFile stores a file and records a new version of it
+func (s *Store) StoreFile(ctx context.Context, filePath string) (*StoreResult, error) {
+	return s.StoreFileOnBranch(ctx, filePath, "")
+}
+
+// StoreFileOnBranch stores a file and records a new version of it on a
+// branch of its history, or on the mainline when branch is empty
+func (s *Store) StoreFileOnBranch(ctx context.Context, filePath, branch string) (*StoreResult, error) {
+	blob, err := s.WriteBlob(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer s.flushCache(ctx)
+	blob.Branch = branch
+	return s.record(ctx, blob, filePath)
+}
+
+// StoreTreeFile stores the file name of the tree at directory and records
+// a new version of it, keyed by name like StoreDirectory keys its files
+func (s *Store) StoreTreeFile(ctx context.Context, directory, name string) (*StoreResult, error) {
+	blob, err := s.writeBlobFS(ctx, fsutil.HostFS(directory), name, path.Join(sourcePath(directory), name))
+	if err != nil {
+		return nil, err
+	}
+	defer s.flushCache(ctx)
+	return s.record(ctx, blob, name)
+}
+
+// StoreReader stores the contents of r under the given file name and
+// records a new version of it
+func (s *Store) StoreReader(ctx context.Context, name string, r io.Reader) (*StoreResult, error) {
+	blob, err := s.WriteBlobReader(ctx, name, r)
+	if err != nil {
+		return nil, err
+	}
+	return s.record(ctx, blob, name)
+}
+
+// StoreKnown records a new version of name with content already stored,
+// given its digest and size, the way StoreReader would were it sent the
+// content. It fails with an error wrapping fs.ErrNotExist when no blob of
+// that digest and size is stored for a file of name's extension.
+func (s *Store) StoreKnown(ctx context.Context, name, sum string, size int64) (*StoreResult, error) {
+	start := time.Now()
+	blob := s.newBlob(filepath.ToSlash(name), strings.ToLower(sum))
+	blob.Source = blob.Filename
+	duplicate, err := s.exists(ctx, blob)
+	if err != nil {
+		return nil, err
+	}
+	if !duplicate || blob.Bytes != size {
+		return nil, fmt.Errorf("no blob %s of %d bytes: %w", blob.StorageID, size, fs.ErrNotExist)
+	}
+	blob.Duration = time.Since(start)
+	return s.record(ctx, blob, name)
+}
+
+// Record the action and version rows of a written blob. A new blob is
+// removed again if they cannot be committed.
+func (s *Store) record(ctx context.Context, blob *Blob, source string) (*StoreResult, error) {
+	signature, err := s.screen(ctx, blob, source)
+	if err != nil {
+		return nil, err
+	}
+	if blob.Duplicate {
+		s.opts.Events().OnDuplicateFound(event.DuplicateFound{Op: "store", Name: source, Original: blob.Path, Bytes: blob.Bytes})
+		if err := db.RecordAction(ctx, s.db, blob.Action()); err != nil {
+			return nil, err
+		}
+		// Storing the latest content again leaves the result as it was
+		version := 0
+		if latest, err := db.GetBranchVersion(ctx, s.db, blob.Filename, blob.Branch, 0); err == nil && latest.Hash == blob.Hash {
+			version = latest.Version
+		}
+		if signature != "" {
+			s.flag(ctx, map[string]string{blob.Filename: signature})
+		}
+		result := blob.Result(version)
+		s.process(ctx, result)
+		return result, nil
+	}
+
+	if err := s.claim(ctx, blob); err != nil {
+		return nil, err
+	}
+	defer blob.release()
+	s.checkSource(ctx, blob)
+	var version int
+	logged := false
+	err = db.WithTx(ctx, s.db, func(tx *db.Tx) error {
+		var err error
+		if blob.Branch != "" {
+			version, logged, err = db.LogBranchVersion(ctx, tx, blob.Filename, blob.Branch, blob.Hash, blob.Source, blob.Type.MIME, blob.Type.Kind)
+		} else {
+			version, logged, err = db.LogChangedVersion(ctx, tx, blob.Filename, blob.Hash, blob.Source, blob.Type.MIME, blob.Type.Kind)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to log version: %w", err)
+		}
+		// A concurrent run stored the same content, which is the latest
+		// version already and references the blob
+		blob.Duplicate = !logged
+		if err := db.RecordAction(ctx, tx, blob.Action()); err != nil {
+			return fmt.Errorf("failed to log action: %w", err)
+		}
+		if !logged {
+			return nil
+		}
+		if err := db.SetVersionXattrs(ctx, tx, blob.Filename, version, blob.Xattrs); err != nil {
+			return fmt.Errorf("failed to record extended attributes: %w", err)
+		}
+		if err := db.SetVersionOriginalName(ctx, tx, blob.Filename, version, blob.OriginalName); err != nil {
+			return fmt.Errorf("failed to record original name: %w", err)
+		}
+		return nil
+	})
+	if err != nil && blob.Duplicate {
+		return nil, err
+	}
+	if err != nil {
+		if removeErr := s.removeUnused(ctx, blob); removeErr != nil {
+			s.opts.Events().OnError(event.Error{Op: "store", Name: blob.Path, Err: fmt.Errorf("failed to remove blob after rollback: %w", removeErr)})
+		}
+		return nil, err
+	}
+
+	if blob.Duplicate {
+		s.opts.Events().OnDuplicateFound(event.DuplicateFound{Op: "store", Name: source, Original: blob.Path, Bytes: blob.Bytes})
+	} else {
+		s.opts.Events().OnFileStored(s.fileStored(blob, source))
+	}
+	if signature != "" {
+		s.flag(ctx, map[string]string{blob.Filename: signature})
+	}
+	result := blob.Result(version)
+	s.process(ctx, result)
+	return result, nil
+}
+
+// Warn when a new version of a file comes from another path than the last
+// one, which interleaves the histories of two files sharing a name
+func (s *Store) checkSource(ctx context.Context, blob *Blob) {
+	latest, err := db.GetVersion(ctx, s.db, blob.Filename, 0)
+	if err != nil || latest.Path == "" || blob.Source == "" || latest.Path == blob.Source {
+		return
+	}
+	s.opts.Events().OnError(event.Error{Op: "store", Name: blob.Source, Err: fmt.Errorf(
+		"version %d of %s was stored from %s; run -action fsck -split to separate their histories",
+		latest.Version, blob.Filename, latest.Path)})
+}
+
+// Event describing a newly stored blob; source names the stored file
+func (s *Store) fileStored(blob *Blob, source string) event.FileStored {
+	return event.FileStored{Name: source, StorageID: blob.StorageID, Path: blob.Path, Bytes: blob.Bytes}
+}
+
+// StoreDirectory stores every file below a directory, keyed by its
+// slash-separated path relative to the directory, hashing and copying as
+// many files at once as SetConcurrency allows and writing metadata in
+// batches. When ctx is cancelled or a file fails, the files stored so far
+// are still recorded. Processors run once the metadata is committed and see
+// version 0, as the versions are assigned in bulk.
+func (s *Store) StoreDirectory(ctx context.Context, directory string) (*StoreReport, error) {
+	return s.storeTree(ctx, fsutil.HostFS(directory), directory, sourcePath(directory))
+}
+
+// StoreFS stores every file of fsys like StoreDirectory
+func (s *Store) StoreFS(ctx context.Context, fsys fs.FS) (*StoreReport, error) {
+	return s.storeTree(ctx, fsys, "file system", "")
+}
+
+// treeFile is a file of a stored tree once a worker has written its blob
+type treeFile struct {
+	name string
+	blob *Blob
+	err  error
+}
+
+// Store every file of fsys, keyed by its name within fsys. Source names
+// the tree in the report and root is prefixed to the recorded paths.
+func (s *Store) storeTree(ctx context.Context, fsys fs.FS, source, root string) (*StoreReport, error) {
+	// Workers stop at the first failure; the blobs they already wrote are
+	// recorded regardless
+	walkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := max(s.workers, 1)
+	names := make(chan string, workers*2)
+	files := make(chan treeFile, workers*2)
+	var walkErr error
+	var unreadable []string
+	go func() {
+		defer close(names)
+		skip := func(name string, err error) {
+			unreadable = append(unreadable, fmt.Sprintf("%s: %v", name, err))
+		}
+		walkErr = fs.WalkDir(fsys, ".", s.opts.SkipUnreadable("store", ".", skip, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := walkCtx.Err(); err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			select {
+			case names <- name:
+				return nil
+			case <-walkCtx.Done():
+				return walkCtx.Err()
+			}
+		}))
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				source := ""
+				if root != "" {
+					source = path.Join(root, name)
+				}
+				blob, err := s.writeBlobFS(walkCtx, fsys, name, source)
+				if err != nil {
+					err = fmt.Errorf("failed to store %s: %w", name, err)
+				}
+				files <- treeFile{name: name, blob: blob, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(files)
+	}()
+
+	batch := db.NewBatch(s.db, db.BatchSize)
+	defer s.flushCache(ctx)
+	report := &StoreReport{Source: source}
+	var pending []*StoreResult // waiting for processors
+	var claimed []*Blob        // until their versions are committed
+	defer func() {
+		for _, blob := range claimed {
+			blob.release()
+		}
+	}()
+	flagged := map[string]string{}
+	var err error
+	batchCtx := ctx
+	// Record the first failure and stop the walk and the workers
+	fail := func(e error) {
+		if err == nil {
+			err = e
+			cancel()
+			batchCtx = context.WithoutCancel(ctx)
+		}
+	}
+	for file := range files {
+		if file.err != nil {
+			// Files cut short by the first failure fail with the cancellation,
+			// which is not reported over it
+			if skipErr := s.opts.SkipFailed("store", file.name, file.err, &report.Failed); skipErr != nil {
+				fail(skipErr)
+			}
+			continue
+		}
+		blob, name := file.blob, file.name
+		signature, scanErr := s.screen(batchCtx, blob, name)
+		if scanErr != nil {
+			if skipErr := s.opts.SkipFailed("store", name, scanErr, &report.Failed); skipErr != nil {
+				fail(skipErr)
+			}
+			continue
+		}
+		if signature != "" {
+			flagged[blob.Filename] = signature
+		}
+		if blob.Duplicate {
+			report.Duplicates++
+			s.opts.Events().OnDuplicateFound(event.DuplicateFound{Op: "store", Name: name, Original: blob.Path, Bytes: blob.Bytes})
+			if len(s.processors) > 0 {
+				pending = append(pending, blob.Result(0))
+			}
+			if addErr := batch.AddAction(batchCtx, blob.Action()); addErr != nil {
+				fail(addErr)
+			}
+			continue
+		}
+		if claimErr := s.claim(batchCtx, blob); claimErr != nil {
+			if skipErr := s.opts.SkipFailed("store", name, claimErr, &report.Failed); skipErr != nil {
+				fail(skipErr)
+			}
+			continue
+		}
+		claimed = append(claimed, blob)
+		if addErr := batch.AddStore(batchCtx, s.stored(ctx, blob)); addErr != nil {
+			fail(addErr)
+			continue
+		}
+		report.Stored++
+		report.BytesWritten += blob.Bytes
+		s.opts.Events().OnFileStored(s.fileStored(blob, name))
+		if len(s.processors) > 0 {
+			pending = append(pending, blob.Result(0))
+		}
+	}
+	// The walk is over once every worker is
+	report.Unreadable = unreadable
+	if err == nil && walkErr != nil {
+		fail(walkErr)
+	}
+	if err != nil {
+		if flushErr := batch.Flush(context.WithoutCancel(ctx)); flushErr != nil {
+			return report, errors.Join(err, flushErr)
+		}
+		s.flag(context.WithoutCancel(ctx), flagged)
+		return report, err
+	}
+	if err := batch.Flush(ctx); err != nil {
+		return report, err
+	}
+	s.flag(ctx, flagged)
+
+	for _, result := range pending {
+		s.process(ctx, result)
+	}
+	return report, nil
+}
@@ -0,0 +1,233 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"github.com/Lenstack/file_manager_version/pkg/scan"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStoreRetrieveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+
+	report, err := repo.Store.StoreFS(ctx, fmtest.Fixture(t, fmtest.SampleFiles))
+	if err != nil {
+		t.Fatalf("failed to store the sample files: %v", err)
+	}
+	// a.txt and dir/sub/c.txt share their content
+	if report.Stored != 3 || report.Duplicates != 1 || len(report.Failed) != 0 {
+		t.Errorf("stored %d, %d duplicates, failed %v; want 3, 1 and none", report.Stored, report.Duplicates, report.Failed)
+	}
+
+	// A file whose content is stored already gets no version of its own
+	versions, err := repo.Store.Versions(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Errorf("%d versions recorded, want 3", len(versions))
+	}
+	dir := t.TempDir()
+	for _, v := range versions {
+		dest := filepath.Join(dir, filepath.Base(v.Filename))
+		if _, err := repo.Store.Retrieve(ctx, v.Filename, v.Version, dest); err != nil {
+			t.Errorf("failed to retrieve %s: %v", v.Filename, err)
+			continue
+		}
+		got, err := os.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmtest.SampleFiles[v.Filename]; string(got) != want {
+			t.Errorf("%s retrieved as %q, want %q", v.Filename, got, want)
+		}
+	}
+}
+
+func TestStoreVersions(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+
+	for i, content := range []string{"one\n", "two\n", "two\n"} {
+		result, err := repo.Store.StoreReader(ctx, "notes.txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("failed to store revision %d: %v", i+1, err)
+		}
+		if duplicate := i == 2; result.Duplicate != duplicate {
+			t.Errorf("revision %d: duplicate is %v, want %v", i+1, result.Duplicate, duplicate)
+		}
+	}
+
+	versions, err := repo.Store.Versions(ctx, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("%d versions recorded, want 2", len(versions))
+	}
+
+	dest := filepath.Join(t.TempDir(), "notes.txt")
+	for n, want := range map[int]string{1: "one\n", 2: "two\n", 0: "two\n"} {
+		if _, err := repo.Store.Retrieve(ctx, "notes.txt", n, dest); err != nil {
+			t.Fatalf("failed to retrieve version %d: %v", n, err)
+		}
+		if got, _ := os.ReadFile(dest); string(got) != want {
+			t.Errorf("version %d retrieved as %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestOpenBlobDetectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+
+	result, err := repo.Store.StoreReader(ctx, "a.txt", strings.NewReader("alpha\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Backend.Write(ctx, result.StorageID, bytes.NewReader([]byte("alpha!\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := repo.Store.OpenBlob(ctx, result.StorageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	if _, err := io.ReadAll(r); !errors.Is(err, store.ErrChecksumMismatch) {
+		t.Errorf("reading a damaged blob gave %v, want %v", err, store.ErrChecksumMismatch)
+	}
+
+	dest := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(dest, []byte("working copy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Store.Retrieve(ctx, "a.txt", 0, dest); !errors.Is(err, store.ErrChecksumMismatch) {
+		t.Errorf("retrieving a damaged blob gave %v, want %v", err, store.ErrChecksumMismatch)
+	}
+	if got, _ := os.ReadFile(dest); string(got) != "working copy" {
+		t.Errorf("a failed retrieve replaced the working copy with %q", got)
+	}
+}
+
+// hidingBackend reports the next blob it is asked about as missing, as a
+// store racing another to write the same content sees it
+type hidingBackend struct {
+	store.Backend
+	mu       sync.Mutex
+	hideNext bool
+}
+
+func (b *hidingBackend) Stat(ctx context.Context, id string) (int64, error) {
+	b.mu.Lock()
+	hide := b.hideNext
+	b.hideNext = false
+	b.mu.Unlock()
+	if hide {
+		return 0, fs.ErrNotExist
+	}
+	return b.Backend.Stat(ctx, id)
+}
+
+// scanFunc scans content by calling itself with the file name
+type scanFunc func(name string) (scan.Result, error)
+
+func (f scanFunc) Scan(ctx context.Context, name string, r io.Reader) (scan.Result, error) {
+	return f(name)
+}
+
+// A store failing after writing a blob must not remove it from under
+// another that wrote the same content meanwhile and recorded a version
+func TestFailedStoreKeepsBlobOfOthers(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	backend := &hidingBackend{Backend: repo.Backend}
+	blobs := store.New(backend, repo.DB, repo.Store.Algorithm(), repo.Options)
+
+	var other *store.StoreResult
+	blobs.SetScanner(store.ScanOptions{Policy: store.ScanReject, Scanner: scanFunc(func(name string) (scan.Result, error) {
+		if name != "a.txt" {
+			return scan.Result{}, nil
+		}
+		backend.hideNext = true
+		var err error
+		if other, err = blobs.StoreReader(ctx, "b.txt", strings.NewReader("alpha\n")); err != nil {
+			t.Fatalf("failed to store b.txt: %v", err)
+		}
+		return scan.Result{}, errors.New("scanner unavailable")
+	})})
+
+	if _, err := blobs.StoreReader(ctx, "a.txt", strings.NewReader("alpha\n")); err == nil {
+		t.Fatal("storing a.txt succeeded despite the failed scan")
+	}
+	if other == nil || other.Duplicate || other.Version != 1 {
+		t.Fatalf("b.txt stored as %+v, want version 1 of new content", other)
+	}
+	dest := filepath.Join(t.TempDir(), "b.txt")
+	if _, err := blobs.Retrieve(ctx, "b.txt", 0, dest); err != nil {
+		t.Errorf("failed to retrieve b.txt: %v", err)
+	}
+}
+
+// writeCounter counts the blobs written to a backend
+type writeCounter struct {
+	store.Backend
+	writes int
+}
+
+func (b *writeCounter) Write(ctx context.Context, id string, r io.Reader) (int64, error) {
+	b.writes++
+	return b.Backend.Write(ctx, id, r)
+}
+
+func TestStoreReaderChecksPolicyBeforeWriting(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	if _, err := repo.Store.StoreReader(ctx, "a.txt", strings.NewReader("alpha\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &writeCounter{Backend: repo.Backend}
+	opts := repo.Options
+	var sizes []int64
+	tooLarge := errors.New("too large")
+	opts.Admit = func(ctx context.Context, op, name string, size int64) error {
+		sizes = append(sizes, size)
+		if size > 4 {
+			return tooLarge
+		}
+		return nil
+	}
+	blobs := store.New(backend, repo.DB, repo.Store.Algorithm(), opts)
+
+	// Both new content and a duplicate of stored content are judged by the
+	// size streamed
+	for _, content := range []string{"0123456789", "alpha\n"} {
+		if _, err := blobs.StoreReader(ctx, "b.txt", strings.NewReader(content)); !errors.Is(err, tooLarge) {
+			t.Errorf("storing %q gave %v, want the policy to reject it", content, err)
+		}
+	}
+	if _, err := blobs.StoreReader(ctx, "c.txt", strings.NewReader("abc")); err != nil {
+		t.Errorf("storing content the policy admits failed: %v", err)
+	}
+	if want := []int64{10, 6, 3}; !slices.Equal(sizes, want) {
+		t.Errorf("policy checked sizes %v, want %v", sizes, want)
+	}
+	if backend.writes != 1 {
+		t.Errorf("%d blobs written, want only the admitted one", backend.writes)
+	}
+}
@@ -0,0 +1,320 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VerifyOptions selects which blobs Verify re-hashes and how it repairs
+// damaged ones. Without any backend it only reports them.
+type VerifyOptions struct {
+	// Fraction of the blobs to re-hash, least recently verified first, so
+	// that repeated runs cover the whole store. 0 re-hashes every blob.
+	Fraction float64
+
+	// Parity holds parity data written by ParityProcessor. Damaged blobs
+	// are rebuilt from it in place when the damage is limited enough.
+	Parity Backend
+
+	// Replica holds copies of the blobs. Damaged and missing blobs are
+	// copied back from it when its copy matches the digest.
+	Replica Backend
+
+	// Quarantine receives damaged blobs that could not be repaired, which
+	// are then removed from storage
+	Quarantine Backend
+}
+
+// VerifyReport lists the blobs whose content does not match the repository.
+// Entries are storage IDs.
+type VerifyReport struct {
+	Checked     int      `json:"checked"`
+	Skipped     int      `json:"skipped"`   // left for a later run by VerifyOptions.Fraction
+	Archived    []string `json:"archived"`  // in an archive storage class, which is not read
+	Corrupted   []string `json:"corrupted"` // content does not match the digest in the name
+	Truncated   []string `json:"truncated"` // shorter than when it was written
+	Missing     []string `json:"missing"`   // referenced by a version but not stored
+	Orphaned    []string `json:"orphaned"`  // stored but referenced by no version
+	Repaired    []string `json:"repaired"`
+	Quarantined []string `json:"quarantined"`
+}
+
+// Clean reports whether every blob was intact and present
+func (r *VerifyReport) Clean() bool {
+	return len(r.Corrupted) == 0 && len(r.Truncated) == 0 && len(r.Missing) == 0 && len(r.Orphaned) == 0
+}
+
+// Print the report in a human-readable form
+func (r *VerifyReport) Print() {
+	for _, group := range []struct {
+		label string
+		ids   []string
+	}{
+		{"corrupted  ", r.Corrupted},
+		{"truncated  ", r.Truncated},
+		{"missing    ", r.Missing},
+		{"orphaned   ", r.Orphaned},
+		{"repaired   ", r.Repaired},
+		{"quarantined", r.Quarantined},
+	} {
+		for _, id := range group.ids {
+			fmt.Printf("%s %s\n", group.label, id)
+		}
+	}
+	fmt.Printf("Verified %d blobs (%d skipped, %d archived): %d corrupted, %d truncated, %d missing, %d orphaned, %d repaired, %d quarantined\n",
+		r.Checked, r.Skipped, len(r.Archived), len(r.Corrupted), len(r.Truncated), len(r.Missing), len(r.Orphaned), len(r.Repaired), len(r.Quarantined))
+}
+
+// Verify re-hashes the blobs and checks them against their names and the
+// recorded versions, repairing damaged blobs as selected by vopts. The time
+// each blob is re-hashed is recorded for later partial runs.
+func (s *Store) Verify(ctx context.Context, vopts VerifyOptions) (*VerifyReport, error) {
+	report := &VerifyReport{}
+
+	referenced, err := s.referencedBlobs(ctx)
+	if err != nil {
+		return report, err
+	}
+	sizes, err := db.StoredSizes(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to read blob sizes: %w", err)
+	}
+
+	// Blobs are listed up front since repairs change the backend
+	var ids []string
+	err = s.backend.List(ctx, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	selected, err := s.selectBlobs(ctx, ids, vopts.Fraction)
+	if err != nil {
+		return report, err
+	}
+
+	deltas, err := db.DeltaBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list delta blobs: %w", err)
+	}
+	patches := map[string]db.DeltaBlob{}
+	for _, row := range deltas {
+		patches[row.DeltaID] = row
+	}
+
+	var damaged []string
+	stored := map[string]bool{}
+	for _, id := range ids {
+		stored[id] = true
+		if !selected[id] {
+			report.Skipped++
+			if !referenced[id] {
+				report.Orphaned = append(report.Orphaned, id)
+			}
+			continue
+		}
+		if row, ok := patches[id]; ok {
+			// A delta is checked by the content it gives. As it cannot be
+			// told apart from damage to its base, it is not repaired.
+			if err := s.checkDelta(ctx, row); err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return report, ctxErr
+				}
+				report.Corrupted = append(report.Corrupted, id)
+			}
+			if err := db.RecordBlobCheck(ctx, s.db, id, time.Now()); err != nil {
+				return report, fmt.Errorf("failed to record check of %s: %w", id, err)
+			}
+			report.Checked++
+			continue
+		}
+		intact, size, err := s.hashBlob(ctx, s.backend, id)
+		if errors.Is(err, ErrArchived) {
+			report.Archived = append(report.Archived, id)
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to verify %s: %w", id, err)
+		}
+		if err := db.RecordBlobCheck(ctx, s.db, id, time.Now()); err != nil {
+			return report, fmt.Errorf("failed to record check of %s: %w", id, err)
+		}
+		report.Checked++
+		switch {
+		case intact && !referenced[id]:
+			report.Orphaned = append(report.Orphaned, id)
+		case intact:
+		case size < sizes[id]:
+			report.Truncated = append(report.Truncated, id)
+			damaged = append(damaged, id)
+		default:
+			report.Corrupted = append(report.Corrupted, id)
+			damaged = append(damaged, id)
+		}
+	}
+	external, err := db.ExternalBlobIDs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list adopted files: %w", err)
+	}
+	chunked, err := db.ChunkedBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list chunked blobs: %w", err)
+	}
+	packed, err := db.PackedBlobs(ctx, s.db)
+	if err != nil {
+		return report, fmt.Errorf("failed to list packed blobs: %w", err)
+	}
+	for id := range referenced {
+		_, isDelta := deltas[id]
+		_, isChunked := chunked[id]
+		_, isPacked := packed[id]
+		if !stored[id] && !external[id] && !isDelta && !isChunked && !isPacked {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	sort.Strings(report.Missing)
+
+	for _, id := range append(damaged, report.Missing...) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if vopts.Parity != nil && stored[id] {
+			repaired, err := s.repairFromParity(ctx, vopts.Parity, id)
+			if err != nil {
+				s.opts.Events().OnError(event.Error{Op: "repair", Name: id, Err: err})
+			}
+			if repaired {
+				report.Repaired = append(report.Repaired, id)
+				continue
+			}
+		}
+		if vopts.Replica != nil {
+			repaired, err := s.repairFromReplica(ctx, vopts.Replica, id)
+			if err != nil {
+				s.opts.Events().OnError(event.Error{Op: "repair", Name: id, Err: err})
+			}
+			if repaired {
+				report.Repaired = append(report.Repaired, id)
+				continue
+			}
+		}
+		if vopts.Quarantine != nil && stored[id] {
+			// A retained or held version keeps its blob, damaged or not
+			digest, _ := splitID(id)
+			if err := db.CheckContentRetention(ctx, s.db, digest); err != nil {
+				if err = s.refused(ctx, "quarantine", id, err); !db.IsRefused(err) {
+					return report, err
+				}
+				s.opts.Events().OnError(event.Error{Op: "quarantine", Name: id, Err: err})
+				continue
+			}
+			if err := s.quarantineBlob(ctx, vopts.Quarantine, id); err != nil {
+				return report, fmt.Errorf("failed to quarantine %s: %w", id, err)
+			}
+			report.Quarantined = append(report.Quarantined, id)
+		}
+	}
+	return report, nil
+}
+
+// Select the blobs to re-hash: the given fraction of ids, rounded up,
+// taking blobs never verified and then the least recently verified
+func (s *Store) selectBlobs(ctx context.Context, ids []string, fraction float64) (map[string]bool, error) {
+	selected := map[string]bool{}
+	if fraction <= 0 || fraction >= 1 {
+		for _, id := range ids {
+			selected[id] = true
+		}
+		return selected, nil
+	}
+
+	checks, err := db.BlobChecks(ctx, s.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob checks: %w", err)
+	}
+	order := append([]string(nil), ids...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return checks[order[i]].Before(checks[order[j]])
+	})
+	for _, id := range order[:int(math.Ceil(fraction*float64(len(order))))] {
+		selected[id] = true
+	}
+	return selected, nil
+}
+
+// Split a storage ID into the digest and the extension of the stored file
+func splitID(id string) (digest, ext string) {
+	if i := strings.Index(id, "."); i >= 0 {
+		return id[:i], id[i:]
+	}
+	return id, ""
+}
+
+// Hash a blob of backend, reporting whether it matches the digest in its
+// ID, past the prefix of chunks and packfiles, and how many bytes it holds
+func (s *Store) hashBlob(ctx context.Context, backend Backend, id string) (bool, int64, error) {
+	r, err := backend.Open(ctx, id)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	hashed := s.hash.New()
+	n, err := fsutil.Copy(ctx, hashed, s.opts.Reader(ctx, r))
+	if err != nil {
+		return false, n, fmt.Errorf("failed to hash blob: %w", err)
+	}
+	digest, _ := splitID(strings.TrimPrefix(strings.TrimPrefix(id, chunkPrefix), packPrefix))
+	return fmt.Sprintf("%x", hashed.Sum(nil)) == digest, n, nil
+}
+
+// Copy a blob back from a replica whose copy is intact, reporting whether
+// it was repaired
+func (s *Store) repairFromReplica(ctx context.Context, replica Backend, id string) (bool, error) {
+	intact, _, err := s.hashBlob(ctx, replica, id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil || !intact {
+		return false, err
+	}
+
+	r, err := replica.Open(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	if _, err := s.backend.Write(ctx, id, r); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Move a damaged blob into quarantine
+func (s *Store) quarantineBlob(ctx context.Context, quarantine Backend, id string) error {
+	r, err := s.backend.Open(ctx, id)
+	if err != nil {
+		return err
+	}
+	_, err = quarantine.Write(ctx, id, r)
+	_ = r.Close()
+	if err != nil {
+		return err
+	}
+	return s.backend.Remove(ctx, id)
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// VersionFS returns a read-only file system presenting every recorded
+// version as <filename>/v<version>/<base name>, so that versions can be
+// browsed and copied by code written for fs.FS, such as a FUSE or WebDAV
+// layer. It reflects the versions recorded when it is created; file
+// contents are verified like OpenBlob as they are read. Open files have a
+// Version method returning the db.Version they hold.
+func (s *Store) VersionFS(ctx context.Context) (fs.FS, error) {
+	vfs, _, err := s.versionFS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return vfs, nil
+}
+
+// MountFS returns the file system of VersionFS with every backup in the
+// catalog added as snapshots/<time of the backup>/<filename>, holding the
+// latest mainline version of each file recorded by then. It is what a
+// FUSE mount presents.
+func (s *Store) MountFS(ctx context.Context) (fs.FS, error) {
+	vfs, versions, err := s.versionFS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := db.ListBackups(ctx, s.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	for _, b := range backups {
+		dir := path.Join("snapshots", b.Timestamp.UTC().Format("2006-01-02T15:04:05Z"))
+		if _, ok := vfs.dirs[dir]; ok {
+			dir += "." + strconv.FormatInt(b.ID, 10)
+		}
+		latest := map[string]db.Version{}
+		for _, v := range versions {
+			if v.Branch != "" || v.Timestamp.After(b.Timestamp) {
+				continue
+			}
+			if found, ok := latest[v.Filename]; !ok || v.Version > found.Version {
+				latest[v.Filename] = v
+			}
+		}
+		for filename, v := range latest {
+			vfs.add(path.Join(dir, path.Clean(filename)), v)
+		}
+	}
+	vfs.sortEntries()
+	return vfs, nil
+}
+
+// Create the file system of VersionFS, returning it with the versions it
+// holds
+func (s *Store) versionFS(ctx context.Context) (*versionFS, []db.Version, error) {
+	versions, err := db.ListVersions(ctx, s.db, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	vfs := &versionFS{
+		ctx:   ctx,
+		s:     s,
+		dirs:  map[string]*versionDir{".": {}},
+		files: map[string]db.Version{},
+	}
+	for _, v := range versions {
+		vfs.add(path.Join(path.Clean(v.Filename), "v"+strconv.Itoa(v.Version), path.Base(v.Filename)), v)
+	}
+	vfs.sortEntries()
+	return vfs, versions, nil
+}
+
+// versionFS is the file system returned by VersionFS
+type versionFS struct {
+	ctx   context.Context
+	s     *Store
+	dirs  map[string]*versionDir
+	files map[string]db.Version
+}
+
+// versionDir lists the names within a directory of a versionFS
+type versionDir struct {
+	entries []string
+	modTime time.Time // of the newest version below it
+}
+
+// Add a version as the file name, unless the name is taken or invalid
+func (vfs *versionFS) add(name string, v db.Version) {
+	if _, ok := vfs.files[name]; ok || !fs.ValidPath(name) {
+		return
+	}
+	if _, ok := vfs.dirs[name]; ok {
+		return
+	}
+	vfs.files[name] = v
+	vfs.addEntry(name, v.Timestamp)
+}
+
+// Sort the entries of every directory by name
+func (vfs *versionFS) sortEntries() {
+	for _, dir := range vfs.dirs {
+		sort.Strings(dir.entries)
+	}
+}
+
+// Add a file and its missing parent directories
+func (vfs *versionFS) addEntry(name string, modTime time.Time) {
+	for name != "." {
+		parent := path.Dir(name)
+		dir, ok := vfs.dirs[parent]
+		if !ok {
+			dir = &versionDir{}
+			vfs.dirs[parent] = dir
+		}
+		if modTime.After(dir.modTime) {
+			dir.modTime = modTime
+		}
+		if ok && containsName(dir.entries, path.Base(name)) {
+			return
+		}
+		dir.entries = append(dir.entries, path.Base(name))
+		name = parent
+	}
+}
+
+// Report whether names holds name
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe the file or directory name
+func (vfs *versionFS) stat(name string) (*versionInfo, error) {
+	if dir, ok := vfs.dirs[name]; ok {
+		return &versionInfo{name: path.Base(name), modTime: dir.modTime, dir: true}, nil
+	}
+	v, ok := vfs.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	size, err := vfs.s.BlobSize(vfs.ctx, StorageID(v))
+	if err != nil {
+		return nil, err
+	}
+	return &versionInfo{name: path.Base(name), size: size, modTime: v.Timestamp}, nil
+}
+
+func (vfs *versionFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := vfs.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if info.dir {
+		return &versionDirFile{vfs: vfs, name: name, info: info, entries: vfs.dirs[name].entries}, nil
+	}
+	r, err := vfs.s.OpenBlob(vfs.ctx, StorageID(vfs.files[name]))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &versionFile{ReadCloser: r, info: info, version: vfs.files[name]}, nil
+}
+
+// versionInfo describes a file or directory of a versionFS
+type versionInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *versionInfo) Name() string       { return i.name }
+func (i *versionInfo) Size() int64        { return i.size }
+func (i *versionInfo) ModTime() time.Time { return i.modTime }
+func (i *versionInfo) IsDir() bool        { return i.dir }
+func (i *versionInfo) Sys() any           { return nil }
+
+func (i *versionInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// versionFile is an open version
+type versionFile struct {
+	io.ReadCloser
+	info    *versionInfo
+	version db.Version
+}
+
+func (f *versionFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Version returns the version whose content the file holds
+func (f *versionFile) Version() db.Version {
+	return f.version
+}
+
+// versionDirFile is an open directory of a versionFS
+type versionDirFile struct {
+	vfs     *versionFS
+	name    string
+	info    *versionInfo
+	entries []string // not yet read
+}
+
+func (d *versionDirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *versionDirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *versionDirFile) Close() error {
+	return nil
+}
+
+func (d *versionDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	count := len(d.entries)
+	if n > 0 {
+		if count == 0 {
+			return nil, io.EOF
+		}
+		count = min(count, n)
+	}
+	entries := make([]fs.DirEntry, 0, count)
+	for _, name := range d.entries[:count] {
+		info, err := d.vfs.stat(path.Join(d.name, name))
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	d.entries = d.entries[count:]
+	return entries, nil
+}
@@ -0,0 +1,57 @@
+package store_test
+
+import (
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/fmtest"
+	"github.com/Lenstack/file_manager_version/pkg/hash"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMountFS(t *testing.T) {
+	ctx := context.Background()
+	repo := fmtest.NewRepo(t, hash.Algorithm{})
+	for i, content := range []string{"alpha\n", "alpha 2\n"} {
+		if _, err := repo.Store.StoreReader(ctx, "docs/a.txt", strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		stored := fmtest.FixedTime.Add(time.Duration(i) * 2 * time.Hour)
+		if _, err := repo.DB.ExecContext(ctx, `UPDATE versions SET timestamp = ? WHERE version = ?;`, stored, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A backup taken between the two versions
+	backup := fmtest.FixedTime.Add(time.Hour)
+	if _, err := repo.DB.ExecContext(ctx, `INSERT INTO backups (path, size, timestamp) VALUES (?, ?, ?);`, "/backups/a.tar.gz", 1, backup); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := repo.Store.MountFS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"docs/a.txt/v1/a.txt":                       "alpha\n",
+		"docs/a.txt/v2/a.txt":                       "alpha 2\n",
+		"snapshots/2024-01-01T01:00:00Z/docs/a.txt": "alpha\n",
+	} {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil || string(got) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, got, err, want)
+		}
+	}
+	if entries, err := fs.ReadDir(fsys, "snapshots"); err != nil || len(entries) != 1 {
+		t.Errorf("snapshots holds %v (%v), want the one backup", entries, err)
+	}
+
+	// The versions alone are served as they were
+	versions, err := repo.Store.VersionFS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(versions, "snapshots"); err == nil {
+		t.Error("VersionFS lists snapshots")
+	}
+}
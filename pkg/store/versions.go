@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io"
+	"path"
+)
+
+// Versions returns the recorded versions of a file, oldest first, or those
+// of every file when filename is empty. Files are known by their base name,
+// in either Unicode normalization form.
+func (s *Store) Versions(ctx context.Context, filename string) ([]db.Version, error) {
+	versions, err := db.ListVersions(ctx, s.db, fsutil.NormalizeName(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	return versions, nil
+}
+
+// Latest returns the newest version of a file. A file that was never
+// stored gives an error wrapping db.ErrNoVersion.
+func (s *Store) Latest(ctx context.Context, filename string) (db.Version, error) {
+	return db.GetVersion(ctx, s.db, fsutil.NormalizeName(filename), 0)
+}
+
+// OpenVersion opens the content of version n of a file, or of its latest
+// version when n is 0. Like OpenBlob, it verifies the content as it is read.
+func (s *Store) OpenVersion(ctx context.Context, filename string, n int) (io.ReadCloser, error) {
+	v, err := db.GetVersion(ctx, s.db, fsutil.NormalizeName(filename), n)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.OpenBlob(ctx, StorageID(v))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s version %d: %w", v.Filename, v.Version, err)
+	}
+	return r, nil
+}
+
+// StorageID returns the ID of the blob holding a version's content
+func StorageID(v db.Version) string {
+	return v.Hash + path.Ext(v.Filename)
+}
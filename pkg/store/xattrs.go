@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"github.com/Lenstack/file_manager_version/pkg/db"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/fsutil"
+	"io/fs"
+	"os"
+)
+
+// SetPreserveXattrs makes Retrieve set the extended attributes recorded for
+// a version, POSIX ACLs and SELinux labels included, on the file it writes
+func (s *Store) SetPreserveXattrs(preserve bool) {
+	s.preserveXattrs = preserve
+}
+
+// Read the extended attributes of a file being stored, which are recorded
+// with its version. Files not on the host have none, and failing to read
+// them is reported without failing the store.
+func (s *Store) sourceXattrs(file fs.File, name string) map[string][]byte {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return nil
+	}
+	attrs, err := fsutil.Xattrs(osFile)
+	if err != nil {
+		s.opts.Events().OnError(event.Error{Op: "store", Name: name, Err: err})
+	}
+	return attrs
+}
+
+// Set the extended attributes recorded for version v on a retrieved file
+func (s *Store) restoreXattrs(ctx context.Context, file *os.File, v db.Version) error {
+	attrs, err := db.VersionXattrs(ctx, s.db, v.Filename, v.Version)
+	if err != nil {
+		return err
+	}
+	return fsutil.SetXattrs(file, attrs)
+}
@@ -0,0 +1,218 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultGuardWindow is the span changes are counted over
+	DefaultGuardWindow = time.Minute
+
+	// DefaultEntropyThreshold is the entropy, in bits per byte, above which
+	// content looks encrypted. Text stays below 5 and most documents below
+	// 7; encrypted and well compressed data come close to 8.
+	DefaultEntropyThreshold = 7.5
+
+	// entropySample is how much of the start of a file its entropy is
+	// estimated from
+	entropySample = 8 << 10
+
+	// canaryContent is written to canaries that do not exist yet
+	canaryContent = "This file is monitored for unauthorized changes. Do not modify, rename or delete it.\n"
+)
+
+// Kinds of anomaly
+const (
+	AnomalyCanary     = "canary"      // a canary was changed or deleted
+	AnomalyMassChange = "mass_change" // more files changed than Guard.MaxChanges
+	AnomalyEntropy    = "entropy"     // files turned into what looks like encrypted data
+)
+
+// Guard looks for what ransomware encrypting the tree does. When it sees
+// an anomaly, every file of the tree is stored at once, so that what has
+// not been encrypted yet is kept, and OnAnomaly is called to respond.
+type Guard struct {
+	// Canaries are paths within the tree nothing should touch; missing
+	// ones are created when watching starts. Changing or deleting one is
+	// an anomaly.
+	Canaries []string
+
+	// MaxChanges files created, modified or deleted within Window is an
+	// anomaly; 0 disables the check
+	MaxChanges int
+
+	// EntropySpikes files whose content goes from below EntropyThreshold
+	// to above it within Window is an anomaly; 0 disables the check,
+	// which reads the start of every file when watching starts
+	EntropySpikes    int
+	EntropyThreshold float64
+
+	Window time.Duration
+
+	// OnAnomaly responds to an anomaly once the tree is stored, such as by
+	// pausing pruning and alerting people
+	OnAnomaly func(ctx context.Context, a Anomaly)
+}
+
+// Anomaly is suspicious activity Guard detected
+type Anomaly struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Files   []string  `json:"files"`
+	Time    time.Time `json:"time"`
+
+	// Snapshot counts the files stored in response, which are new versions
+	// unless their content was stored already
+	Snapshot int `json:"snapshot"`
+}
+
+// Validate checks the guard settings
+func (g *Guard) Validate() error {
+	if g.MaxChanges < 0 || g.EntropySpikes < 0 {
+		return errors.New("max_changes and entropy_spikes must not be negative")
+	}
+	if g.EntropyThreshold < 0 || g.EntropyThreshold > 8 {
+		return errors.New("entropy_threshold must be between 0 and 8 bits per byte")
+	}
+	for _, canary := range g.Canaries {
+		if canary == "" || filepath.IsAbs(canary) || !filepath.IsLocal(canary) {
+			return fmt.Errorf("canary %q must be a path within the watched directory", canary)
+		}
+	}
+	return nil
+}
+
+// enabled reports whether the guard checks anything
+func (g *Guard) enabled() bool {
+	return len(g.Canaries) > 0 || g.MaxChanges > 0 || g.EntropySpikes > 0
+}
+
+// guard tracks what a watch session saw against its Guard
+type guard struct {
+	Guard
+	canaries map[string]bool
+	changes  map[string]time.Time // files changed within the window, and when
+	spikes   map[string]time.Time // files whose entropy spiked within the window
+}
+
+// Return the state of the guard of a session, creating missing canaries
+func newGuard(g Guard, directory string) (*guard, error) {
+	if g.Window <= 0 {
+		g.Window = DefaultGuardWindow
+	}
+	if g.EntropyThreshold == 0 {
+		g.EntropyThreshold = DefaultEntropyThreshold
+	}
+	s := &guard{Guard: g, canaries: map[string]bool{}, changes: map[string]time.Time{}, spikes: map[string]time.Time{}}
+	for _, canary := range g.Canaries {
+		s.canaries[filepath.ToSlash(filepath.Clean(canary))] = true
+		p := filepath.Join(directory, canary)
+		if _, err := os.Stat(p); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to check canary %s: %w", p, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create canary %s: %w", p, err)
+		}
+		if err := os.WriteFile(p, []byte(canaryContent), 0o644); err != nil {
+			return nil, fmt.Errorf("failed to create canary %s: %w", p, err)
+		}
+	}
+	return s, nil
+}
+
+// Note that a file was created, modified or deleted at now, returning the
+// anomaly this makes, if any
+func (g *guard) changed(name string, now time.Time, deleted bool) *Anomaly {
+	if g.canaries[name] {
+		what := "modified"
+		if deleted {
+			what = "deleted"
+		}
+		return &Anomaly{Kind: AnomalyCanary, Message: fmt.Sprintf("canary %s was %s", name, what), Files: []string{name}, Time: now}
+	}
+	if g.MaxChanges == 0 {
+		return nil
+	}
+	g.changes[name] = now
+	if files := recent(g.changes, now.Add(-g.Window)); len(files) > g.MaxChanges {
+		clear(g.changes)
+		return &Anomaly{Kind: AnomalyMassChange, Message: fmt.Sprintf("%d files changed within %s", len(files), g.Window), Files: files, Time: now}
+	}
+	return nil
+}
+
+// Note the entropy of a file about to be stored, which was before when
+// known, returning the anomaly this makes, if any
+func (g *guard) sampled(name string, before, after float64, now time.Time) *Anomaly {
+	if g.EntropySpikes == 0 || before < 0 || before >= g.EntropyThreshold || after < g.EntropyThreshold {
+		return nil
+	}
+	g.spikes[name] = now
+	if files := recent(g.spikes, now.Add(-g.Window)); len(files) >= g.EntropySpikes {
+		clear(g.spikes)
+		return &Anomaly{Kind: AnomalyEntropy, Message: fmt.Sprintf("%d files turned into what looks like encrypted data within %s", len(files), g.Window), Files: files, Time: now}
+	}
+	return nil
+}
+
+// Forget the entries of times older than since and return the names of
+// the others, sorted
+func recent(times map[string]time.Time, since time.Time) []string {
+	var names []string
+	for name, t := range times {
+		if t.Before(since) {
+			delete(times, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Estimate the entropy of a file in bits per byte from its start, or
+// return -1 when it cannot be read
+func fileEntropy(p string) float64 {
+	f, err := os.Open(p)
+	if err != nil {
+		return -1
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	buf := make([]byte, entropySample)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return -1
+	}
+	return entropy(buf[:n])
+}
+
+// Return the Shannon entropy of data in bits per byte
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var bits float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(data))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
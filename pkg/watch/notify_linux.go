@@ -0,0 +1,62 @@
+//go:build linux
+
+package watch
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inotifyMask selects the changes that wake the watcher
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotify wakes the watcher through the Linux inotify API. The events
+// themselves are not parsed: any of them triggers a scan.
+type inotify struct {
+	fd      int      // for adding watches; file.Fd would make reads blocking
+	file    *os.File // reads events, and unblocks them when closed
+	changes chan struct{}
+}
+
+func newNotifier() (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	n := &inotify{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), changes: make(chan struct{}, 1)}
+	go n.read()
+	return n, nil
+}
+
+// Add watches a directory. Adding one that is already watched does
+// nothing; watches of removed directories end by themselves.
+func (n *inotify) Add(dir string) error {
+	if _, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask); err != nil {
+		return fmt.Errorf("failed to watch for changes: %w", err)
+	}
+	return nil
+}
+
+func (n *inotify) Changes() <-chan struct{} {
+	return n.changes
+}
+
+func (n *inotify) Close() error {
+	return n.file.Close()
+}
+
+// Signal a change for every batch of events until the notifier is closed
+func (n *inotify) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := n.file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case n.changes <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package watch
+
+// Without a notifier changes are found by scanning at the interval
+func newNotifier() (notifier, error) {
+	return nil, nil
+}
@@ -0,0 +1,339 @@
+// Package watch stores a new version of every file in a directory tree as
+// it changes.
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Lenstack/file_manager_version/pkg/event"
+	"github.com/Lenstack/file_manager_version/pkg/store"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultInterval is how often the tree is rescanned
+	DefaultInterval = 2 * time.Second
+
+	// DefaultDebounce is how long a file must stay unchanged to be stored
+	DefaultDebounce = time.Second
+)
+
+// DefaultIgnore matches version control, editor and temporary files
+var DefaultIgnore = []string{".git", ".hg", ".svn", "*.swp", "*.swx", "*.tmp", "*~", ".#*", ".fm-*"}
+
+// Options control how a tree is watched
+type Options struct {
+	// Interval between scans of the tree. Where the system notifies about
+	// changes, the tree is also scanned as soon as something changes.
+	Interval time.Duration
+
+	// Debounce is how long a changed file must stay unchanged before it is
+	// stored, so that a file is stored once it is completely written
+	Debounce time.Duration
+
+	// Ignore holds path.Match patterns. Files and directories whose
+	// slash-separated path within the tree, or whose base name, matches
+	// one are not watched.
+	Ignore []string
+
+	// Events receives errors storing files; the store reports the files it
+	// stores to its own observer
+	Events event.Observer
+
+	// Guard watches for signs of ransomware
+	Guard Guard
+}
+
+// ValidatePatterns checks that ignore patterns are well-formed
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Report summarizes a watch session
+type Report struct {
+	Directory  string `json:"directory"`
+	Watched    int    `json:"watched"`    // files being watched when it stopped
+	Stored     int    `json:"stored"`     // new versions recorded
+	Duplicates int    `json:"duplicates"` // changes whose content was already stored
+	Failed     int    `json:"failed"`
+	Anomalies  int    `json:"anomalies"` // detected by the guard
+}
+
+// Print the report in a human-readable form
+func (r *Report) Print() {
+	fmt.Printf("Stopped watching %s (%d files): %d versions stored, %d already present, %d failed\n",
+		r.Directory, r.Watched, r.Stored, r.Duplicates, r.Failed)
+	if r.Anomalies > 0 {
+		fmt.Printf("Detected %d anomalies that may be ransomware at work\n", r.Anomalies)
+	}
+}
+
+// fileState is what a scan saw of a file
+type fileState struct {
+	size    int64
+	modTime time.Time
+	changed time.Time // when it was last seen changing; zero once stored
+	entropy float64   // of its start when last stored, -1 when unknown
+}
+
+// Run watches directory until ctx is cancelled, which ends it without an
+// error. The files present when it starts are the baseline; from then on
+// every file created or modified is stored as a new version once it stays
+// unchanged for opts.Debounce, keyed by its path within directory.
+// A file that cannot be stored is reported and retried when it next changes.
+// When opts.Guard detects an anomaly, every file is stored at once.
+func Run(ctx context.Context, s *store.Store, directory string, opts Options) (*Report, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Debounce < 0 {
+		opts.Debounce = 0
+	}
+	if opts.Events == nil {
+		opts.Events = event.Discard{}
+	}
+	if err := ValidatePatterns(opts.Ignore); err != nil {
+		return nil, err
+	}
+	if err := opts.Guard.Validate(); err != nil {
+		return nil, err
+	}
+	w := &watcher{directory: directory, opts: opts}
+	report := &Report{Directory: directory}
+	if opts.Guard.enabled() {
+		var err error
+		if w.guard, err = newGuard(opts.Guard, directory); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if w.notifier, err = newNotifier(); err != nil {
+		// Scanning at the interval still catches every change
+		opts.Events.OnError(event.Error{Op: "watch", Name: directory, Err: fmt.Errorf("change notifications are unavailable: %w", err)})
+		w.notifier = nil
+	}
+	defer func() {
+		if w.notifier != nil {
+			_ = w.notifier.Close()
+		}
+	}()
+
+	state, err := w.scan()
+	if err != nil {
+		return report, err
+	}
+	for name, seen := range state {
+		seen.entropy = -1
+		if w.guard != nil && w.guard.EntropySpikes > 0 {
+			seen.entropy = fileEntropy(filepath.Join(directory, filepath.FromSlash(name)))
+		}
+		state[name] = seen
+	}
+	var wake <-chan struct{}
+	if w.notifier != nil {
+		wake = w.notifier.Changes()
+	}
+	timer := time.NewTimer(opts.Interval)
+	defer timer.Stop()
+
+	for {
+		report.Watched = len(state)
+		select {
+		case <-ctx.Done():
+			return report, nil
+		case <-timer.C:
+		case <-wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+
+		current, err := w.scan()
+		if err != nil {
+			return report, err
+		}
+		now := time.Now()
+		next := opts.Interval
+		var anomalies []*Anomaly
+		for name, seen := range current {
+			previous, known := state[name]
+			if !known || previous.size != seen.size || !previous.modTime.Equal(seen.modTime) {
+				seen.changed = now
+				seen.entropy = -1
+				if known {
+					seen.entropy = previous.entropy
+				}
+				state[name] = seen
+				next = min(next, opts.Debounce)
+				if w.guard != nil {
+					anomalies = append(anomalies, w.guard.changed(name, now, false))
+				}
+				continue
+			}
+			if previous.changed.IsZero() {
+				continue
+			}
+			if wait := opts.Debounce - now.Sub(previous.changed); wait > 0 {
+				next = min(next, wait)
+				continue
+			}
+
+			previous.changed = time.Time{}
+			if w.guard != nil && w.guard.EntropySpikes > 0 {
+				before := previous.entropy
+				previous.entropy = fileEntropy(filepath.Join(directory, filepath.FromSlash(name)))
+				anomalies = append(anomalies, w.guard.sampled(name, before, previous.entropy, now))
+			}
+			state[name] = previous
+			if !w.store(ctx, s, name, report) {
+				return report, nil
+			}
+		}
+		for name := range state {
+			if _, ok := current[name]; !ok {
+				delete(state, name)
+				if w.guard != nil {
+					anomalies = append(anomalies, w.guard.changed(name, now, true))
+				}
+			}
+		}
+		for _, a := range anomalies {
+			if a == nil {
+				continue
+			}
+			if !w.respond(ctx, s, *a, current, report) {
+				return report, nil
+			}
+			// One response covers whatever else the scan found
+			break
+		}
+		timer.Reset(max(next, 10*time.Millisecond))
+	}
+}
+
+// watcher scans a tree for changes
+type watcher struct {
+	directory string
+	opts      Options
+	notifier  notifier
+	guard     *guard // nil without checks
+}
+
+// Store a file of the tree as a new version, counting it in the report, and
+// report whether to go on watching
+func (w *watcher) store(ctx context.Context, s *store.Store, name string, report *Report) bool {
+	result, err := s.StoreTreeFile(ctx, w.directory, name)
+	switch {
+	case ctx.Err() != nil:
+		return false
+	case err != nil:
+		report.Failed++
+		w.opts.Events.OnError(event.Error{Op: "watch", Name: name, Err: err})
+	case result.Duplicate:
+		report.Duplicates++
+	default:
+		report.Stored++
+	}
+	return true
+}
+
+// Respond to an anomaly by storing every file of the tree, so that what is
+// still intact is kept, before calling the guard's OnAnomaly; report
+// whether to go on watching
+func (w *watcher) respond(ctx context.Context, s *store.Store, a Anomaly, files map[string]fileState, report *Report) bool {
+	report.Anomalies++
+	w.opts.Events.OnError(event.Error{Op: "watch", Name: w.directory, Err: fmt.Errorf("possible ransomware: %s; storing every file", a.Message)})
+	before := report.Stored
+	for name := range files {
+		if !w.store(ctx, s, name, report) {
+			return false
+		}
+	}
+	a.Snapshot = report.Stored - before
+	if w.guard.OnAnomaly != nil {
+		w.guard.OnAnomaly(ctx, a)
+	}
+	return true
+}
+
+// notifier wakes the watcher when something in a watched directory
+// changes. It is optional; without it changes are found by scanning.
+type notifier interface {
+	Add(dir string) error
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// Report whether a path within the tree is ignored
+func (w *watcher) ignored(name string) bool {
+	base := path.Base(name)
+	for _, pattern := range w.opts.Ignore {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// List the regular files of the tree that are not ignored, registering
+// each directory with the notifier
+func (w *watcher) scan() (map[string]fileState, error) {
+	files := map[string]fileState{}
+	err := filepath.WalkDir(w.directory, func(p string, entry fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(w.directory, p)
+		if relErr != nil {
+			return relErr
+		}
+		name := filepath.ToSlash(rel)
+		if err != nil {
+			if name == "." {
+				return err
+			}
+			// The entry vanished or cannot be read; the rest is still watched
+			if !errors.Is(err, fs.ErrNotExist) {
+				w.opts.Events.OnError(event.Error{Op: "watch", Name: p, Err: err})
+			}
+			return nil
+		}
+		if name != "." && w.ignored(name) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if w.notifier != nil {
+				if err := w.notifier.Add(p); err != nil {
+					w.opts.Events.OnError(event.Error{Op: "watch", Name: p, Err: err})
+				}
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files[name] = fileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", w.directory, err)
+	}
+	return files, nil
+}